@@ -0,0 +1,341 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	maxAPITokenNameLen = 128
+
+	// apiTokenTouchInterval is how stale an API token's LAST_USED may get
+	// before a request updates it. This spares busy integrations a database
+	// write on every request.
+	apiTokenTouchInterval = time.Minute
+)
+
+// requireAPITokenAdmin does the checks common to all the API token admin
+// endpoints. The requestor must have GlobalAdministrateEvents permission, and
+// must be a person, since a token that could make more tokens could grant
+// itself anything.
+func requireAPITokenAdmin(req *http.Request, imsDBQ *store.DBQ, userStore *directory.UserStore, imsAdmins []string) (
+	JWTContext, *herr.HTTPError,
+) {
+	jwtCtx, globalPermissions, errHTTP := getGlobalPermissions(req, imsDBQ, userStore, imsAdmins)
+	if errHTTP != nil {
+		return JWTContext{}, errHTTP.From("[getGlobalPermissions]")
+	}
+	if jwtCtx.Claims.APIToken() != nil {
+		return JWTContext{}, herr.Forbidden("API tokens cannot be managed with an API token", nil)
+	}
+	if globalPermissions&authz.GlobalAdministrateEvents == 0 {
+		return JWTContext{}, herr.Forbidden("The requestor does not have GlobalAdministrateEvents permission", nil)
+	}
+	return jwtCtx, nil
+}
+
+type GetAPITokens struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetAPITokens) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getAPITokens(req)
+	if errHTTP != nil {
+		errHTTP.From("[getAPITokens]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetAPITokens) getAPITokens(req *http.Request) (imsjson.APITokens, *herr.HTTPError) {
+	_, errHTTP := requireAPITokenAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[requireAPITokenAdmin]")
+	}
+	rows, err := action.imsDBQ.APITokens(req.Context(), action.imsDBQ)
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch API tokens", err).From("[APITokens]")
+	}
+	resp := make(imsjson.APITokens, 0, len(rows))
+	for _, row := range rows {
+		eventNames, err := unmarshalByteSlice[[]string](row.EventNames)
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to read API token Events", err).From("[unmarshalByteSlice]")
+		}
+		t := row.ApiToken
+		resp = append(resp, imsjson.APIToken{
+			ID:     t.ID,
+			Name:   t.Name,
+			Events: eventNames,
+			// #nosec G115 // these were stored from 16-bit masks
+			EventPermissions: authz.EventPermissionMask(t.EventPermissions).Names(),
+			// #nosec G115 // these were stored from 16-bit masks
+			GlobalPermissions: authz.GlobalPermissionMask(t.GlobalPermissions).Names(),
+			Expires:           conv.NullFloatToTime(t.Expires),
+			Created:           conv.FloatToTime(t.Created),
+			CreatedBy:         t.CreatedBy,
+			LastUsed:          conv.NullFloatToTime(t.LastUsed),
+			Revoked:           conv.NullFloatToTime(t.Revoked),
+		})
+	}
+	return resp, nil
+}
+
+// NewAPIToken creates an API token, and returns it in the response. That's
+// the only time the token is ever revealed.
+type NewAPIToken struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action NewAPIToken) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.newAPIToken(req)
+	if errHTTP != nil {
+		errHTTP.From("[newAPIToken]").WriteResponse(w)
+		return
+	}
+	w.Header().Set("IMS-API-Token-ID", strconv.Itoa(int(resp.ID)))
+	mustWriteJSON(w, req, resp)
+}
+
+func (action NewAPIToken) newAPIToken(req *http.Request) (imsjson.APIToken, *herr.HTTPError) {
+	var empty imsjson.APIToken
+	jwtCtx, errHTTP := requireAPITokenAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[requireAPITokenAdmin]")
+	}
+	tokenReq, errHTTP := readBodyAs[imsjson.APIToken](req)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[readBodyAs]")
+	}
+	ctx := req.Context()
+	now := time.Now()
+
+	tokenReq.Name = strings.TrimSpace(tokenReq.Name)
+	if tokenReq.Name == "" || len(tokenReq.Name) > maxAPITokenNameLen {
+		return empty, herr.BadRequest(fmt.Sprintf("An API token needs a name of up to %v characters", maxAPITokenNameLen), nil)
+	}
+	// The token's name is what it'll be known by in report entries and the
+	// action log, so it mustn't be mistaken for a person.
+	users, err := action.userStore.GetAllUsers(ctx)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to fetch personnel", err).From("[GetAllUsers]")
+	}
+	for _, user := range users {
+		if strings.EqualFold(user.Handle, tokenReq.Name) {
+			return empty, herr.BadRequest("An API token can't have the same name as a person", nil)
+		}
+	}
+	eventPerms, err := authz.ParseEventPermissions(tokenReq.EventPermissions)
+	if err != nil {
+		return empty, herr.BadRequest("Invalid event permissions", err).From("[ParseEventPermissions]")
+	}
+	globalPerms, err := authz.ParseGlobalPermissions(tokenReq.GlobalPermissions)
+	if err != nil {
+		return empty, herr.BadRequest("Invalid global permissions", err).From("[ParseGlobalPermissions]")
+	}
+	if eventPerms != authz.EventNoPermissions && len(tokenReq.Events) == 0 {
+		return empty, herr.BadRequest("An API token with event permissions needs at least one Event", nil)
+	}
+	if !tokenReq.Expires.IsZero() && !tokenReq.Expires.After(now) {
+		return empty, herr.BadRequest("An API token's expiry must be in the future", nil)
+	}
+	eventIDs := make([]int32, 0, len(tokenReq.Events))
+	for _, eventName := range tokenReq.Events {
+		event, errHTTP := getEvent(req, eventName, action.imsDBQ)
+		if errHTTP != nil {
+			return empty, errHTTP.From("[getEvent]")
+		}
+		if event.IsGroup {
+			return empty, herr.BadRequest("An API token can only be scoped to Events, not to Event groups", nil)
+		}
+		eventIDs = append(eventIDs, event.ID)
+	}
+
+	token := authz.NewAPIToken()
+	tokenID, errHTTP := retryOnDeadlock(func() (int32, *herr.HTTPError) {
+		txn, err := action.imsDBQ.Begin()
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+		}
+		defer rollback(txn)
+		id, err := action.imsDBQ.CreateAPIToken(ctx, txn, imsdb.CreateAPITokenParams{
+			Name:              tokenReq.Name,
+			TokenHash:         authz.HashAPIToken(token),
+			EventPermissions:  int32(eventPerms),
+			GlobalPermissions: int32(globalPerms),
+			Created:           conv.TimeToFloat(now),
+			CreatedBy:         jwtCtx.Claims.RangerHandle(),
+			Expires:           conv.TimeToNullFloat(tokenReq.Expires),
+		})
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to create API token", err).From("[CreateAPIToken]")
+		}
+		// #nosec G115 // API_TOKEN.ID is an integer column
+		tokenID := int32(id)
+		for _, eventID := range eventIDs {
+			err = action.imsDBQ.AddAPITokenEvent(ctx, txn, imsdb.AddAPITokenEventParams{
+				ApiToken: tokenID,
+				Event:    eventID,
+			})
+			if err != nil {
+				return 0, herr.InternalServerError("Failed to scope API token", err).From("[AddAPITokenEvent]")
+			}
+		}
+		if err = txn.Commit(); err != nil {
+			return 0, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		}
+		return tokenID, nil
+	})
+	if errHTTP != nil {
+		return empty, errHTTP
+	}
+	slog.Info("Created API token", "id", tokenID, "name", tokenReq.Name, "by", jwtCtx.Claims.RangerHandle())
+	return imsjson.APIToken{
+		ID:                tokenID,
+		Name:              tokenReq.Name,
+		Token:             token,
+		Events:            tokenReq.Events,
+		EventPermissions:  eventPerms.Names(),
+		GlobalPermissions: globalPerms.Names(),
+		Expires:           tokenReq.Expires,
+		Created:           now,
+		CreatedBy:         jwtCtx.Claims.RangerHandle(),
+	}, nil
+}
+
+// RevokeAPIToken stops an API token from working. The token's record stays
+// around, so that its name still means something in the logs.
+type RevokeAPIToken struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action RevokeAPIToken) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.revokeAPIToken(req)
+	if errHTTP != nil {
+		errHTTP.From("[revokeAPIToken]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action RevokeAPIToken) revokeAPIToken(req *http.Request) *herr.HTTPError {
+	jwtCtx, errHTTP := requireAPITokenAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[requireAPITokenAdmin]")
+	}
+	tokenID, err := conv.ParseInt32(req.PathValue("tokenId"))
+	if err != nil {
+		return herr.BadRequest("Invalid API token ID", err).From("[ParseInt32]")
+	}
+	rows, err := action.imsDBQ.RevokeAPIToken(req.Context(), action.imsDBQ, imsdb.RevokeAPITokenParams{
+		Revoked: conv.TimeToNullFloat(time.Now()),
+		ID:      tokenID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to revoke API token", err).From("[RevokeAPIToken]")
+	}
+	if rows == 0 {
+		return herr.NotFound("No such unrevoked API token", nil)
+	}
+	slog.Info("Revoked API token", "id", tokenID, "by", jwtCtx.Claims.RangerHandle())
+	return nil
+}
+
+// authenticateAPIToken gives the claims for a valid API token, which act under
+// the token's name, with the token's scope. It returns an error if the token
+// doesn't exist, has been revoked, or has expired.
+func authenticateAPIToken(ctx context.Context, imsDBQ *store.DBQ, token string) (*authz.IMSClaims, error) {
+	row, err := imsDBQ.APITokenByHash(ctx, imsDBQ, authz.HashAPIToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("no such API token")
+		}
+		return nil, fmt.Errorf("[APITokenByHash]: %w", err)
+	}
+	t := row.ApiToken
+	now := time.Now()
+	if t.Revoked.Valid {
+		return nil, fmt.Errorf("API token %v has been revoked", t.ID)
+	}
+	if t.Expires.Valid && !conv.FloatToTime(t.Expires.Float64).After(now) {
+		return nil, fmt.Errorf("API token %v has expired", t.ID)
+	}
+	eventIDs, err := unmarshalByteSlice[[]int32](row.EventIds)
+	if err != nil {
+		return nil, fmt.Errorf("[unmarshalByteSlice]: %w", err)
+	}
+	err = imsDBQ.TouchAPIToken(ctx, imsDBQ, imsdb.TouchAPITokenParams{
+		Now:         conv.TimeToNullFloat(now),
+		ID:          t.ID,
+		StaleBefore: conv.TimeToNullFloat(now.Add(-apiTokenTouchInterval)),
+	})
+	if err != nil {
+		// This shouldn't stop the request from going through.
+		slog.Error("Failed to record API token use", "id", t.ID, "error", err)
+	}
+	claims := authz.IMSClaims{}.
+		WithIssuer("ims").
+		WithTokenType(authz.TokenTypeAccess).
+		WithRangerHandle(t.Name).
+		WithAPIToken(&authz.APIToken{
+			ID:     t.ID,
+			Events: eventIDs,
+			// #nosec G115 // these were stored from 16-bit masks
+			EventPermissions: authz.EventPermissionMask(t.EventPermissions),
+			// #nosec G115 // these were stored from 16-bit masks
+			GlobalPermissions: authz.GlobalPermissionMask(t.GlobalPermissions),
+		})
+	if t.Expires.Valid {
+		claims = claims.WithExpiration(conv.FloatToTime(t.Expires.Float64))
+	}
+	return &claims, nil
+}
+
+// apiTokenRevoked reports whether the API token has been revoked, or can't be
+// found any more. A failure to check counts as revoked too, as it's only used
+// to end long-lived streams, which the client can just reopen.
+func apiTokenRevoked(ctx context.Context, imsDBQ *store.DBQ, tokenID int32) bool {
+	active, err := imsDBQ.APITokenActive(ctx, imsDBQ, tokenID)
+	if err != nil {
+		slog.Error("Failed to check whether an API token has been revoked", "id", tokenID, "error", err)
+		return true
+	}
+	return active == 0
+}
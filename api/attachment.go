@@ -19,6 +19,7 @@ package api
 import (
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
@@ -39,6 +40,7 @@ import (
 	"github.com/burningmantech/ranger-ims-go/lib/format"
 	"github.com/burningmantech/ranger-ims-go/lib/herr"
 	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
 	"github.com/gabriel-vasile/mimetype"
 )
 
@@ -124,6 +126,10 @@ func (action GetIncidentAttachment) getIncidentAttachment(
 	if err != nil {
 		return nil, "", herr.BadRequest("Failed to parse incident number", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, sql.NullInt32{Int32: incidentNumber, Valid: true}, eventPermissions)
+	if errHTTP != nil {
+		return nil, "", errHTTP.From("[checkConfidentialIncident]")
+	}
 	attachmentNumber, err := conv.ParseInt32(req.PathValue("attachmentNumber"))
 	if err != nil {
 		return nil, "", herr.BadRequest("Failed to parse attachment number", err).From("[ParseInt32]")
@@ -268,6 +274,10 @@ func (action GetFieldReportAttachment) getFieldReportAttachment(
 	if err != nil {
 		return nil, "", herr.BadRequest("Failed to parse Field Report number", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialFieldReport(req, action.imsDBQ, event.ID, fieldReportNumber, eventPermissions)
+	if errHTTP != nil {
+		return nil, "", errHTTP.From("[checkConfidentialFieldReport]")
+	}
 	attachmentNumber, err := conv.ParseInt32(req.PathValue("attachmentNumber"))
 	if err != nil {
 		return nil, "", herr.BadRequest("Failed to parse attachment number", err).From("[ParseInt32]")
@@ -331,6 +341,10 @@ func (action AttachToIncident) attachToIncident(req *http.Request) (int32, *herr
 	if err != nil {
 		return 0, herr.BadRequest("Failed to parse incident number", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, sql.NullInt32{Int32: incidentNumber, Valid: true}, eventPermissions)
+	if errHTTP != nil {
+		return 0, errHTTP.From("[checkConfidentialIncident]")
+	}
 
 	// this must match the key sent by the client
 	fi, fiHead, err := req.FormFile(IMSAttachmentFormKey)
@@ -367,15 +381,19 @@ func (action AttachToIncident) attachToIncident(req *http.Request) (int32, *herr
 
 	reText := fmt.Sprintf("File Name: %v, Size: %v, Type:%v",
 		fiHead.Filename, format.HumanByteSize(fiHead.Size), mtype.String())
-	reID, errHTTP := addIncidentReportEntry(ctx, action.imsDBQ, action.imsDBQ, event.ID, incidentNumber, newReportEntry{
-		author:                   jwtCtx.Claims.RangerHandle(),
-		text:                     reText,
-		attachedFile:             newFileName,
-		attachedFileOriginalName: fiHead.Filename,
-		attachedFileMediaType:    mtype.String(),
-	})
+	reID, errHTTP := addAttachmentReportEntry(ctx, action.imsDBQ, changes{eventID: event.ID, incidents: []int32{incidentNumber}},
+		func(dbtx imsdb.DBTX) (int32, *herr.HTTPError) {
+			return addIncidentReportEntry(ctx, action.imsDBQ, dbtx, event.ID, incidentNumber, newReportEntry{
+				author:                   jwtCtx.Claims.RangerHandle(),
+				text:                     reText,
+				attachedFile:             newFileName,
+				attachedFileOriginalName: fiHead.Filename,
+				attachedFileMediaType:    mtype.String(),
+			})
+		},
+	)
 	if errHTTP != nil {
-		return 0, errHTTP.From("[addIncidentReportEntry]")
+		return 0, errHTTP.From("[addAttachmentReportEntry]")
 	}
 
 	action.es.notifyIncidentUpdate(event.ID, incidentNumber)
@@ -438,6 +456,10 @@ func (action AttachToFieldReport) attachToFieldReport(req *http.Request) (int32,
 	if err != nil {
 		return 0, herr.BadRequest("Failed to parse Field Report number", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialFieldReport(req, action.imsDBQ, event.ID, fieldReportNumber, eventPermissions)
+	if errHTTP != nil {
+		return 0, errHTTP.From("[checkConfidentialFieldReport]")
+	}
 
 	fieldReport, entries, errHTTP := fetchFieldReport(ctx, action.imsDBQ, event.ID, fieldReportNumber)
 	if errHTTP != nil {
@@ -484,15 +506,19 @@ func (action AttachToFieldReport) attachToFieldReport(req *http.Request) (int32,
 
 	reText := fmt.Sprintf("File Name: %v, Size: %v, Type: %v",
 		fiHead.Filename, format.HumanByteSize(fiHead.Size), mtype.String())
-	reID, errHTTP := addFRReportEntry(ctx, action.imsDBQ, action.imsDBQ, event.ID, fieldReportNumber, newReportEntry{
-		author:                   jwtCtx.Claims.RangerHandle(),
-		text:                     reText,
-		attachedFile:             newFileName,
-		attachedFileOriginalName: fiHead.Filename,
-		attachedFileMediaType:    mtype.String(),
-	})
+	reID, errHTTP := addAttachmentReportEntry(ctx, action.imsDBQ, changes{eventID: event.ID, fieldReports: []int32{fieldReportNumber}},
+		func(dbtx imsdb.DBTX) (int32, *herr.HTTPError) {
+			return addFRReportEntry(ctx, action.imsDBQ, dbtx, event.ID, fieldReportNumber, newReportEntry{
+				author:                   jwtCtx.Claims.RangerHandle(),
+				text:                     reText,
+				attachedFile:             newFileName,
+				attachedFileOriginalName: fiHead.Filename,
+				attachedFileMediaType:    mtype.String(),
+			})
+		},
+	)
 	if errHTTP != nil {
-		return 0, errHTTP.From("[addFRReportEntry]")
+		return 0, errHTTP.From("[addAttachmentReportEntry]")
 	}
 
 	action.es.notifyFieldReportUpdate(event.ID, fieldReportNumber)
@@ -528,6 +554,10 @@ func (action GetVisitAttachment) getVisitAttachment(
 	if err != nil {
 		return nil, "", herr.BadRequest("Failed to parse visit number", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialVisit(req, action.imsDBQ, event.ID, visitNumber, eventPermissions)
+	if errHTTP != nil {
+		return nil, "", errHTTP.From("[checkConfidentialVisit]")
+	}
 	attachmentNumber, err := conv.ParseInt32(req.PathValue("attachmentNumber"))
 	if err != nil {
 		return nil, "", herr.BadRequest("Failed to parse attachment number", err).From("[ParseInt32]")
@@ -585,6 +615,10 @@ func (action AttachToVisit) attachToVisit(req *http.Request) (int32, *herr.HTTPE
 	if err != nil {
 		return 0, herr.BadRequest("Failed to parse visit number", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialVisit(req, action.imsDBQ, event.ID, visitNumber, eventPermissions)
+	if errHTTP != nil {
+		return 0, errHTTP.From("[checkConfidentialVisit]")
+	}
 
 	// this must match the key sent by the client
 	fi, fiHead, err := req.FormFile(IMSAttachmentFormKey)
@@ -621,21 +655,54 @@ func (action AttachToVisit) attachToVisit(req *http.Request) (int32, *herr.HTTPE
 
 	reText := fmt.Sprintf("File Name: %v, Size: %v, Type:%v",
 		fiHead.Filename, format.HumanByteSize(fiHead.Size), mtype.String())
-	reID, errHTTP := addVisitReportEntry(ctx, action.imsDBQ, action.imsDBQ, event.ID, visitNumber, newReportEntry{
-		author:                   jwtCtx.Claims.RangerHandle(),
-		text:                     reText,
-		attachedFile:             newFileName,
-		attachedFileOriginalName: fiHead.Filename,
-		attachedFileMediaType:    mtype.String(),
-	})
+	reID, errHTTP := addAttachmentReportEntry(ctx, action.imsDBQ, changes{eventID: event.ID, visits: []int32{visitNumber}},
+		func(dbtx imsdb.DBTX) (int32, *herr.HTTPError) {
+			return addVisitReportEntry(ctx, action.imsDBQ, dbtx, event.ID, visitNumber, newReportEntry{
+				author:                   jwtCtx.Claims.RangerHandle(),
+				text:                     reText,
+				attachedFile:             newFileName,
+				attachedFileOriginalName: fiHead.Filename,
+				attachedFileMediaType:    mtype.String(),
+			})
+		},
+	)
 	if errHTTP != nil {
-		return 0, errHTTP.From("[addVisitReportEntry]")
+		return 0, errHTTP.From("[addAttachmentReportEntry]")
 	}
 
 	action.es.notifyVisitUpdate(event.ID, visitNumber)
 	return reID, nil
 }
 
+// addAttachmentReportEntry calls add to write the report entry for an uploaded
+// file, in a transaction with recordChanges.
+func addAttachmentReportEntry(
+	ctx context.Context, imsDBQ *store.DBQ, changed changes,
+	add func(dbtx imsdb.DBTX) (int32, *herr.HTTPError),
+) (int32, *herr.HTTPError) {
+	return retryOnDeadlock(func() (int32, *herr.HTTPError) {
+		txn, err := imsDBQ.Begin()
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+		}
+		defer rollback(txn)
+
+		reID, errHTTP := add(txn)
+		if errHTTP != nil {
+			return 0, errHTTP.From("[add]")
+		}
+		errHTTP = recordChanges(ctx, imsDBQ, txn, changed)
+		if errHTTP != nil {
+			return 0, errHTTP.From("[recordChanges]")
+		}
+		err = txn.Commit()
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		}
+		return reID, nil
+	})
+}
+
 func sniffFile(fi io.ReadSeeker) (*mimetype.MIME, *herr.HTTPError) {
 	mtype, err := mimetype.DetectReader(fi)
 	if err != nil {
@@ -17,19 +17,26 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"slices"
 	"strings"
 	"time"
 
 	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
 	"github.com/burningmantech/ranger-ims-go/lib/authn"
 	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
 	"github.com/burningmantech/ranger-ims-go/lib/herr"
 	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
 )
 
 type authError string
@@ -45,9 +52,15 @@ const (
 type PostAuth struct {
 	imsDBQ               *store.DBQ
 	userStore            *directory.UserStore
-	jwtSecret            string
+	jwter                authz.JWTer
 	accessTokenDuration  time.Duration
 	refreshTokenDuration time.Duration
+	throttle             loginThrottle
+	// directoryIsIMS is whether there are second factors to consider. Only
+	// the IMS-native directory has them.
+	directoryIsIMS     bool
+	masterKey          string
+	passwordHashParams *argon2id.Params
 }
 
 type PostAuthRequest struct {
@@ -58,15 +71,33 @@ type PostAuthRequest struct {
 type PostAuthResponse struct {
 	Token         string `json:"token"`
 	ExpiresUnixMs int64  `json:"expires_unix_ms"`
+
+	// SecondFactor is set, in place of Token, when the password was right but
+	// there's still a second factor to give. It's "totp" for a TOTP code, or
+	// "totp_enroll" when the person must first set up their authenticator
+	// app, using TOTPEnrollment. Either way, the code goes to PostAuthSecondFactor
+	// along with the SecondFactorToken.
+	SecondFactor      string                  `json:"second_factor,omitzero"`
+	SecondFactorToken string                  `json:"second_factor_token,omitzero"`
+	TOTPEnrollment    *imsjson.TOTPEnrollment `json:"totp_enrollment,omitzero"`
+
+	// RecoveryCodes is set when this login completed a TOTP enrollment. This
+	// is the only time they're ever shown.
+	RecoveryCodes []string `json:"recovery_codes,omitzero"`
 }
 
 func (action PostAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	resp, cookie, errHTTP := action.postAuth(req)
 	if errHTTP != nil {
+		if throttled, ok := errors.AsType[loginThrottledError](errHTTP); ok {
+			w.Header().Set("Retry-After", conv.FormatInt(int64(math.Ceil(throttled.retryAfter.Seconds()))))
+		}
 		errHTTP.From("[postAuth]").WriteResponse(w)
 		return
 	}
-	http.SetCookie(w, cookie)
+	if cookie != nil {
+		http.SetCookie(w, cookie)
+	}
 	mustWriteJSON(w, req, resp)
 }
 func (action PostAuth) postAuth(req *http.Request) (PostAuthResponse, *http.Cookie, *herr.HTTPError) {
@@ -83,19 +114,7 @@ func (action PostAuth) postAuth(req *http.Request) (PostAuthResponse, *http.Cook
 	if err != nil {
 		return empty, nil, herr.InternalServerError("Failed to fetch personnel", err).From("[GetRangers]")
 	}
-	var matchedPerson *directory.User
-	for _, person := range rangers {
-		callsignMatch := person.Handle != "" && strings.EqualFold(person.Handle, vals.Identification)
-		if callsignMatch {
-			matchedPerson = person
-			break
-		}
-		emailMatch := person.Email != "" && strings.EqualFold(person.Email, vals.Identification)
-		if emailMatch {
-			matchedPerson = person
-			break
-		}
-	}
+	matchedPerson := matchUser(rangers, vals.Identification)
 
 	// See https://instatunnel.my/blog/the-1mb-password-crashing-backends-via-hashing-exhaustion
 	if len(vals.Password) > 256 {
@@ -105,33 +124,125 @@ func (action PostAuth) postAuth(req *http.Request) (PostAuthResponse, *http.Cook
 		)
 	}
 
+	now := time.Now()
+	throttleSubject := loginThrottleSubject(vals.Identification, matchedPerson)
+	remoteAddr := action.throttle.address(req)
+	errHTTP = action.throttle.check(req.Context(), throttleSubject, remoteAddr, now)
+	if errHTTP != nil {
+		return empty, nil, errHTTP.From("[check]")
+	}
+
 	if matchedPerson == nil {
 		// Run Verify against some dummy hashed password.
 		// We want to avoid timing attacks, where the client could know
 		// the username is invalid because the login attempt is fast, so
 		// we force a password verification even if no one matched.
-		_, _ = authn.Verify(vals.Password, "$argon2id$v=19$m=8192,t=4,p=1$Ke9wio+D+PfBYlVzJ3CTAA$/kNb/yXgSLyFpfmwIfwKwcNnBRRrUqJp8YXPtDKfNTE")
+		_, _, _ = authn.Verify(vals.Password, "$argon2id$v=19$m=8192,t=4,p=1$Ke9wio+D+PfBYlVzJ3CTAA$/kNb/yXgSLyFpfmwIfwKwcNnBRRrUqJp8YXPtDKfNTE")
+		errHTTP = action.throttle.recordFailure(req, throttleSubject, remoteAddr, sql.NullInt64{}, now)
+		if errHTTP != nil {
+			return empty, nil, errHTTP.From("[recordFailure]")
+		}
 		return empty, nil, herr.Unauthorized(
 			"Failed login attempt (bad credentials)",
 			fmt.Errorf("login attempt for nonexistent user. Identification: %v", vals.Identification),
 		)
 	}
 
-	correct, err := authn.Verify(vals.Password, matchedPerson.Password)
-	if err != nil {
-		return empty, nil, herr.InternalServerError("Invalid stored password. Get in touch with the tech team.", err).From("[Verify]")
+	var correct bool
+	var hashParams *argon2id.Params
+	if verifier, ok := action.userStore.PasswordVerifier(); ok {
+		// The directory has no password hashes to give, e.g. LDAP, so it
+		// checks the password itself.
+		correct, err = verifier.VerifyPassword(req.Context(), matchedPerson, vals.Password)
+		if err != nil {
+			return empty, nil, herr.InternalServerError("Failed to check password with the directory", err).From("[VerifyPassword]")
+		}
+	} else {
+		correct, hashParams, err = authn.Verify(vals.Password, matchedPerson.Password)
+		if err != nil {
+			return empty, nil, herr.InternalServerError("Invalid stored password. Get in touch with the tech team.", err).From("[Verify]")
+		}
 	}
 	if !correct {
+		errHTTP = action.throttle.recordFailure(
+			req, throttleSubject, remoteAddr, sql.NullInt64{Int64: matchedPerson.ID, Valid: true}, now,
+		)
+		if errHTTP != nil {
+			return empty, nil, errHTTP.From("[recordFailure]")
+		}
 		return empty, nil, herr.Unauthorized(
 			"Failed login attempt (bad credentials)",
 			fmt.Errorf("bad password for valid user. Identification: %v", vals.Identification),
 		)
 	}
 
+	if personID, ok := action.userStore.IMSPersonID(matchedPerson.ID); ok {
+		if hashParams.WeakerThan(action.passwordHashParams) {
+			action.rehashPassword(req.Context(), matchedPerson, personID, vals.Password)
+		}
+		challenge, errHTTP := action.secondFactorChallenge(req.Context(), matchedPerson, personID, now)
+		if errHTTP != nil {
+			return empty, nil, errHTTP.From("[secondFactorChallenge]")
+		}
+		if challenge != nil {
+			// #nosec G706 // log injection
+			slog.Info("Correct password for Ranger, who must now give a second factor",
+				"identification", matchedPerson.Handle, "secondFactor", challenge.SecondFactor)
+			return *challenge, nil, nil
+		}
+	}
+
+	return action.logIn(req, matchedPerson, throttleSubject, now)
+}
+
+// matchUser finds the user whose handle or email is the identification, or
+// gives nil if there's no such user.
+func matchUser(users map[int64]*directory.User, identification string) *directory.User {
+	for _, person := range users {
+		callsignMatch := person.Handle != "" && strings.EqualFold(person.Handle, identification)
+		if callsignMatch {
+			return person
+		}
+		emailMatch := person.Email != "" && strings.EqualFold(person.Email, identification)
+		if emailMatch {
+			return person
+		}
+	}
+	return nil
+}
+
+// rehashPassword replaces a person's password hash with one made with the
+// current params, now that the password is at hand. It's only done if the hash
+// is unchanged since the login read it. A failure is only logged, since the
+// old hash still works.
+func (action PostAuth) rehashPassword(ctx context.Context, person *directory.User, personID int64, password string) {
+	rehashed := authn.Hash(password, action.passwordHashParams)
+	updated, err := action.imsDBQ.DirectoryRehashPersonPassword(ctx, action.imsDBQ, imsdb.DirectoryRehashPersonPasswordParams{
+		NewPassword: rehashed,
+		ID:          personID,
+		OldPassword: person.Password,
+	})
+	if err != nil {
+		slog.Error("Failed to rehash password", "identification", person.Handle, "error", err)
+		return
+	}
+	if updated > 0 {
+		slog.Info("Rehashed password with the current params", "identification", person.Handle)
+		action.userStore.Flush()
+	}
+}
+
+// logIn gives an access token and a refresh cookie to someone who has proven
+// who they are.
+func (action PostAuth) logIn(
+	req *http.Request, matchedPerson *directory.User, throttleSubject string, now time.Time,
+) (PostAuthResponse, *http.Cookie, *herr.HTTPError) {
+	var empty PostAuthResponse
 	slog.Info("Successful login for Ranger", "identification", matchedPerson.Handle)
+	action.throttle.recordSuccess(req.Context(), throttleSubject, now)
 
 	accessTokenExpiration := time.Now().Add(action.accessTokenDuration)
-	jwt, err := authz.JWTer{SecretKey: action.jwtSecret}.
+	jwt, err := action.jwter.
 		CreateAccessToken(
 			matchedPerson.Handle,
 			matchedPerson.ID,
@@ -149,23 +260,11 @@ func (action PostAuth) postAuth(req *http.Request) (PostAuthResponse, *http.Cook
 	resp := PostAuthResponse{Token: jwt, ExpiresUnixMs: suggestedRefreshTime}
 
 	// The refresh token should be valid much longer than the access token.
-	refreshTokenExpiration := time.Now().Add(action.refreshTokenDuration)
-	refreshToken, err := authz.JWTer{SecretKey: action.jwtSecret}.
-		CreateRefreshToken(matchedPerson.Handle, matchedPerson.ID, refreshTokenExpiration)
-	if err != nil {
-		return empty, nil, herr.InternalServerError("Failed to create refresh token", err).From("[CreateRefreshToken]")
-	}
-
-	refreshCookie := &http.Cookie{
-		Name:     authz.RefreshTokenCookieName,
-		Value:    refreshToken,
-		Path:     "/",
-		MaxAge:   int(action.refreshTokenDuration.Milliseconds() / 1000),
-		HttpOnly: true,
-		Secure:   true,
-		// We only ever read this cookie on POSTs to the refresh endpoint,
-		// so strict is fine.
-		SameSite: http.SameSiteStrictMode,
+	refreshCookie, errHTTP := startSession(
+		req, action.imsDBQ, action.jwter, matchedPerson, action.refreshTokenDuration,
+	)
+	if errHTTP != nil {
+		return empty, nil, errHTTP.From("[startSession]")
 	}
 
 	return resp, refreshCookie, nil
@@ -204,6 +303,9 @@ type AccessForEvent struct {
 	ReadVisits        bool  `json:"readVisits"`
 	WriteVisits       bool  `json:"writeVisits"`
 	AttachFiles       bool  `json:"attachFiles"`
+	// ReadConfidential is whether the requestor may read confidential
+	// Incidents, and so may mark an Incident confidential or not.
+	ReadConfidential bool `json:"readConfidential"`
 }
 
 func (action GetAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -228,7 +330,9 @@ func (action GetAuth) getAuth(req *http.Request) (GetAuthResponse, *herr.HTTPErr
 	claims := jwtCtx.Claims
 	handle := claims.RangerHandle()
 	var roles []authz.Role
-	if slices.Contains(action.admins, handle) {
+	// An API token's name could match an admin's handle, but it's still
+	// limited to its own permissions.
+	if slices.Contains(action.admins, handle) && claims.APIToken() == nil {
 		roles = append(roles, authz.Administrator)
 	}
 	resp = GetAuthResponse{
@@ -257,6 +361,7 @@ func (action GetAuth) getAuth(req *http.Request) (GetAuthResponse, *herr.HTTPErr
 						ReadVisits:        false,
 						WriteVisits:       false,
 						AttachFiles:       false,
+						ReadConfidential:  false,
 					},
 				}
 				return resp, nil
@@ -277,6 +382,7 @@ func (action GetAuth) getAuth(req *http.Request) (GetAuthResponse, *herr.HTTPErr
 				ReadVisits:        eventPermissions[event.ID]&authz.EventReadVisits != 0,
 				WriteVisits:       eventPermissions[event.ID]&authz.EventWriteVisits != 0,
 				AttachFiles:       action.attachmentsEnabled,
+				ReadConfidential:  canReadConfidential(eventPermissions[event.ID]),
 			},
 		}
 	}
@@ -286,7 +392,7 @@ func (action GetAuth) getAuth(req *http.Request) (GetAuthResponse, *herr.HTTPErr
 type RefreshAccessToken struct {
 	imsDBQ              *store.DBQ
 	userStore           *directory.UserStore
-	jwtSecret           string
+	jwter               authz.JWTer
 	accessTokenDuration time.Duration
 }
 
@@ -296,32 +402,45 @@ type RefreshAccessTokenResponse struct {
 }
 
 func (action RefreshAccessToken) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	resp, errHTTP := action.refreshAccessToken(req)
+	resp, cookie, errHTTP := action.refreshAccessToken(req)
 	if errHTTP != nil {
 		errHTTP.From("[refreshAccessToken]").WriteResponse(w)
 		return
 	}
+	if cookie != nil {
+		http.SetCookie(w, cookie)
+	}
 	mustWriteJSON(w, req, resp)
 }
-func (action RefreshAccessToken) refreshAccessToken(req *http.Request) (RefreshAccessTokenResponse, *herr.HTTPError) {
+
+// refreshAccessToken gives a new access token to the holder of a refresh token,
+// and gives the cookie holding that refresh token's replacement (or nil if it
+// isn't being replaced this time).
+func (action RefreshAccessToken) refreshAccessToken(req *http.Request) (RefreshAccessTokenResponse, *http.Cookie, *herr.HTTPError) {
 	var empty RefreshAccessTokenResponse
 	refreshCookie, err := req.Cookie(authz.RefreshTokenCookieName)
 	if errors.Is(err, http.ErrNoCookie) {
-		return empty, herr.Unauthorized("No refresh token cookie found", err).SetExpectedError().From("[Cookie]")
+		return empty, nil, herr.Unauthorized("No refresh token cookie found", err).SetExpectedError().From("[Cookie]")
 	}
 	if err != nil {
-		return empty, herr.Unauthorized("Bad refresh token cookie found", err).From("[Cookie]")
+		return empty, nil, herr.Unauthorized("Bad refresh token cookie found", err).From("[Cookie]")
 	}
-	jwt, err := authz.JWTer{SecretKey: action.jwtSecret}.AuthenticateRefreshToken(refreshCookie.Value)
+	jwt, err := action.jwter.AuthenticateRefreshToken(refreshCookie.Value)
 	if err != nil {
-		return empty, herr.Unauthorized("Failed to authenticate refresh token", err).From("[AuthenticateRefreshToken]")
+		return empty, nil, herr.Unauthorized("Failed to authenticate refresh token", err).From("[AuthenticateRefreshToken]")
+	}
+	newRefreshCookie, errHTTP := continueSession(
+		req.Context(), action.imsDBQ, action.jwter, refreshCookie.Value, jwt,
+	)
+	if errHTTP != nil {
+		return empty, nil, errHTTP.From("[continueSession]")
 	}
 
 	// #nosec G706 // log injection
 	slog.Info("Refreshing access token", "ranger", jwt.RangerHandle())
 	rangers, err := action.userStore.GetAllUsers(req.Context())
 	if err != nil {
-		return empty, herr.InternalServerError("Failed to fetch personnel", err).From("[GetRangers]")
+		return empty, nil, herr.InternalServerError("Failed to fetch personnel", err).From("[GetRangers]")
 	}
 	var matchedPerson *directory.User
 	for _, ranger := range rangers {
@@ -331,10 +450,10 @@ func (action RefreshAccessToken) refreshAccessToken(req *http.Request) (RefreshA
 		}
 	}
 	if matchedPerson == nil {
-		return empty, herr.Unauthorized("User not found", nil)
+		return empty, nil, herr.Unauthorized("User not found", nil)
 	}
 	accessTokenExpiration := time.Now().Add(action.accessTokenDuration)
-	accessToken, err := authz.JWTer{SecretKey: action.jwtSecret}.
+	accessToken, err := action.jwter.
 		CreateAccessToken(
 			jwt.RangerHandle(),
 			matchedPerson.ID,
@@ -345,11 +464,11 @@ func (action RefreshAccessToken) refreshAccessToken(req *http.Request) (RefreshA
 			accessTokenExpiration,
 		)
 	if err != nil {
-		return empty, herr.InternalServerError("Failed to create access token", err).From("[CreateAccessToken]")
+		return empty, nil, herr.InternalServerError("Failed to create access token", err).From("[CreateAccessToken]")
 	}
 	resp := RefreshAccessTokenResponse{
 		Token:         accessToken,
 		ExpiresUnixMs: accessTokenExpiration.Add(authz.SuggestedEarlyAccessTokenRefresh).UnixMilli(),
 	}
-	return resp, nil
+	return resp, newRefreshCookie, nil
 }
@@ -0,0 +1,372 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/lib/mail"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// breakGlassJustificationMinLength keeps "x" from being a justification.
+	breakGlassJustificationMinLength = 10
+	breakGlassJustificationMaxLength = 1024
+)
+
+// breakGlassRecord is the kind of record that break-glass access is for.
+type breakGlassRecord string
+
+const (
+	breakGlassIncident breakGlassRecord = "Incident"
+	breakGlassVisit    breakGlassRecord = "Visit"
+)
+
+// NewBreakGlass gives someone who can't read an Event's Incidents (or Visits)
+// read access to just one of them for a short while, without an admin having
+// to change the Event's access rules. They must give a justification, which
+// is put on the record's timeline, and the admins are emailed about it.
+type NewBreakGlass struct {
+	imsDBQ      *store.DBQ
+	userStore   *directory.UserStore
+	eventSource *EventSourcerer
+	imsAdmins   []string
+	// duration is how long the access lasts. It's switched off when it's 0.
+	duration time.Duration
+	// eligible is an EVENT_ACCESS expression of who may break the glass.
+	eligible string
+	mailer   *passwordMailer
+	record   breakGlassRecord
+}
+
+func (action NewBreakGlass) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.newBreakGlass(req)
+	if errHTTP != nil {
+		errHTTP.From("[newBreakGlass]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action NewBreakGlass) newBreakGlass(req *http.Request) (imsjson.BreakGlass, *herr.HTTPError) {
+	var empty imsjson.BreakGlass
+	if action.duration <= 0 {
+		return empty, herr.NotFound("Break-glass access is switched off", nil)
+	}
+	if action.mailer == nil {
+		// No one would hear of it, so it isn't allowed
+		return empty, herr.New(http.StatusServiceUnavailable, "Break-glass access needs IMS to be able to email the admins", nil)
+	}
+	event, jwtCtx, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[getEventPermissions]")
+	}
+	if jwtCtx.Claims.APIToken() != nil {
+		return empty, herr.Forbidden("An API token can't be given break-glass access", nil)
+	}
+	ctx := req.Context()
+
+	readPermission := authz.EventReadIncidents
+	numberParam := "incidentNumber"
+	if action.record == breakGlassVisit {
+		readPermission = authz.EventReadVisits
+		numberParam = "visitNumber"
+	}
+	if eventPermissions&readPermission != 0 {
+		return empty, herr.Conflict(fmt.Sprintf("The requestor can already read this %v", action.record), nil)
+	}
+	number, err := conv.ParseInt32(req.PathValue(numberParam))
+	if err != nil {
+		return empty, herr.BadRequest(fmt.Sprintf("Failed to parse %v number", action.record), err).From("[ParseInt32]")
+	}
+
+	subject, err := authz.ClaimsSubject(ctx, action.userStore, *jwtCtx.Claims)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to look up the requestor", err).From("[ClaimsSubject]")
+	}
+	eligible, err := authz.ParseAccessExpression(action.eligible)
+	if err != nil {
+		return empty, herr.InternalServerError("Break-glass access is misconfigured", err).From("[ParseAccessExpression]")
+	}
+	if !eligible.Matches(subject) {
+		return empty, herr.Forbidden("The requestor isn't eligible for break-glass access", nil)
+	}
+
+	breakGlassReq, errHTTP := readBodyAs[imsjson.BreakGlassRequest](req)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[readBodyAs]")
+	}
+	justification := strings.TrimSpace(breakGlassReq.Justification)
+	if utf8.RuneCountInString(justification) < breakGlassJustificationMinLength {
+		return empty, herr.BadRequest(fmt.Sprintf(
+			"A justification of at least %v characters is required", breakGlassJustificationMinLength), nil)
+	}
+	if utf8.RuneCountInString(justification) > breakGlassJustificationMaxLength {
+		return empty, herr.BadRequest(fmt.Sprintf(
+			"The justification may have at most %v characters", breakGlassJustificationMaxLength), nil)
+	}
+
+	var confidential bool
+	if action.record == breakGlassVisit {
+		var visitRow imsdb.VisitRow
+		visitRow, _, errHTTP = fetchVisit(ctx, action.imsDBQ, event.ID, number)
+		if errHTTP == nil {
+			confidential, errHTTP = incidentConfidential(ctx, action.imsDBQ, event.ID, visitRow.Visit.IncidentNumber)
+		}
+	} else {
+		var incidentRow imsdb.IncidentRow
+		incidentRow, _, errHTTP = fetchIncident(ctx, action.imsDBQ, event.ID, number)
+		confidential = incidentRow.Incident.Confidential
+	}
+	if errHTTP != nil {
+		return empty, errHTTP.From("[fetch]")
+	}
+	// Confidential records are only for EventReadConfidential holders, and an
+	// emergency doesn't change that.
+	if confidential {
+		return empty, herr.Forbidden(fmt.Sprintf("Break-glass access is not available for a confidential %v", action.record), nil)
+	}
+
+	handle := jwtCtx.Claims.RangerHandle()
+	now := time.Now()
+	expires := now.Add(action.duration)
+	params := imsdb.CreateBreakGlassParams{
+		Event:         event.ID,
+		Handle:        handle,
+		Justification: justification,
+		Created:       conv.TimeToFloat(now),
+		Expires:       conv.TimeToFloat(expires),
+	}
+	record := changes{eventID: event.ID}
+	addReportEntry := addIncidentReportEntry
+	if action.record == breakGlassVisit {
+		params.VisitNumber = sql.NullInt32{Int32: number, Valid: true}
+		record.visits = []int32{number}
+		addReportEntry = addVisitReportEntry
+	} else {
+		params.IncidentNumber = sql.NullInt32{Int32: number, Valid: true}
+		record.incidents = []int32{number}
+	}
+
+	var id int32
+	errHTTP = retryOnDeadlockErr(func() *herr.HTTPError {
+		txn, err := action.imsDBQ.Begin()
+		if err != nil {
+			return herr.InternalServerError("Error beginning transaction", err).From("[Begin]")
+		}
+		defer rollback(txn)
+		id64, err := action.imsDBQ.CreateBreakGlass(ctx, txn, params)
+		if err != nil {
+			return herr.InternalServerError("Failed to record break-glass access", err).From("[CreateBreakGlass]")
+		}
+		id = conv.MustInt32(id64)
+		_, errHTTP := addReportEntry(ctx, action.imsDBQ, txn, event.ID, number, newReportEntry{
+			author: handle,
+			text: fmt.Sprintf("Break-glass read access granted to %v until %v. Justification: %v",
+				handle, expires.UTC().Format(time.RFC3339), justification),
+			generated: true,
+		})
+		if errHTTP != nil {
+			return errHTTP.From("[addReportEntry]")
+		}
+		errHTTP = recordChanges(ctx, action.imsDBQ, txn, record)
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
+		err = txn.Commit()
+		if err != nil {
+			return herr.InternalServerError("Error committing transaction", err).From("[Commit]")
+		}
+		return nil
+	})
+	if errHTTP != nil {
+		return empty, errHTTP
+	}
+	if action.record == breakGlassVisit {
+		defer action.eventSource.notifyVisitUpdate(event.ID, number)
+	} else {
+		defer action.eventSource.notifyIncidentUpdate(event.ID, number)
+	}
+
+	resp := imsjson.BreakGlass{
+		ID:            id,
+		Event:         event.Name,
+		Handle:        handle,
+		Justification: justification,
+		Created:       now,
+		Expires:       expires,
+	}
+	if action.record == breakGlassVisit {
+		resp.Visit = &number
+	} else {
+		resp.Incident = &number
+	}
+	slog.Warn("Break-glass access granted",
+		"handle", handle, "event", event.Name, "record", action.record, "number", number,
+		"justification", justification, "expires", expires)
+	// The emails are sent in the background, so the response doesn't wait on
+	// the mail server.
+	queued := action.mailer.background(func(ctx context.Context) {
+		action.notifyAdmins(ctx, resp)
+	})
+	if !queued {
+		slog.Error("Failed to tell the admins about break-glass access, as the mail queue is full",
+			"handle", handle, "event", event.Name, "record", action.record, "number", number)
+	}
+	return resp, nil
+}
+
+// notifyAdmins emails the IMS admins about a grant of break-glass access.
+// The grant's already been made by then, so a failure is only logged.
+func (action NewBreakGlass) notifyAdmins(ctx context.Context, grant imsjson.BreakGlass) {
+	users, err := action.userStore.GetAllUsers(ctx)
+	if err != nil {
+		slog.Error("Failed to fetch admins to tell about break-glass access", "error", err)
+		return
+	}
+	number := grant.Incident
+	path := "incidents"
+	if grant.Visit != nil {
+		number, path = grant.Visit, "visits"
+	}
+	link := action.mailer.publicURL + "/ims/app/events/" + url.PathEscape(grant.Event) + "/" + path + "/" + conv.FormatInt(*number)
+	body := fmt.Sprintf("%v broke the glass to read %v %v in event %v, which they can\n"+
+		"do until %v.\n\n"+
+		"Their justification:\n\n%v\n\n"+
+		"%v\n",
+		grant.Handle, action.record, *number, grant.Event,
+		grant.Expires.UTC().Format("Monday, January 2 at 15:04 MST"),
+		grant.Justification, link)
+
+	ctx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+	defer cancel()
+	for _, u := range users {
+		if u.Email == "" || !slices.Contains(action.imsAdmins, u.Handle) {
+			continue
+		}
+		err = action.mailer.sender.Send(ctx, mail.Message{
+			To:      u.Email,
+			Subject: fmt.Sprintf("Break-glass access to %v %v in %v", action.record, *number, grant.Event),
+			Body:    body,
+		})
+		if err != nil {
+			slog.Error("Failed to tell an admin about break-glass access", "admin", u.Handle, "error", err)
+		}
+	}
+}
+
+// breakGlassActive is whether the person holds break-glass access to the
+// Incident or Visit now.
+func breakGlassActive(
+	ctx context.Context, imsDBQ *store.DBQ, eventID int32, handle string, record breakGlassRecord, number int32,
+) (bool, *herr.HTTPError) {
+	if handle == "" {
+		return false, nil
+	}
+	now := conv.TimeToFloat(time.Now())
+	var count int64
+	var err error
+	if record == breakGlassVisit {
+		count, err = imsDBQ.VisitBreakGlassActive(ctx, imsDBQ, imsdb.VisitBreakGlassActiveParams{
+			Event:       eventID,
+			VisitNumber: sql.NullInt32{Int32: number, Valid: true},
+			Handle:      handle,
+			Now:         now,
+		})
+	} else {
+		count, err = imsDBQ.IncidentBreakGlassActive(ctx, imsDBQ, imsdb.IncidentBreakGlassActiveParams{
+			Event:          eventID,
+			IncidentNumber: sql.NullInt32{Int32: number, Valid: true},
+			Handle:         handle,
+			Now:            now,
+		})
+	}
+	if err != nil {
+		return false, herr.InternalServerError("Failed to check break-glass access", err).From("[BreakGlassActive]")
+	}
+	return count > 0, nil
+}
+
+// GetBreakGlasses lists the grants of break-glass access for admins, newest
+// first, going back as far as the since parameter (or a week).
+type GetBreakGlasses struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetBreakGlasses) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getBreakGlasses(req)
+	if errHTTP != nil {
+		errHTTP.From("[getBreakGlasses]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetBreakGlasses) getBreakGlasses(req *http.Request) ([]imsjson.BreakGlass, *herr.HTTPError) {
+	_, globalPermissions, errHTTP := getGlobalPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[getGlobalPermissions]")
+	}
+	if globalPermissions&authz.GlobalAdministrateEvents == 0 {
+		return nil, herr.Forbidden("The requestor does not have GlobalAdministrateEvents permission", nil)
+	}
+	since := time.Now().Add(-7 * 24 * time.Hour)
+	if sinceParam := req.URL.Query().Get("since"); sinceParam != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, sinceParam)
+		if err != nil {
+			return nil, herr.BadRequest("Invalid since, which must be an RFC 3339 time", err).From("[time.Parse]")
+		}
+	}
+	rows, err := action.imsDBQ.BreakGlasses(req.Context(), action.imsDBQ, conv.TimeToFloat(since))
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch break-glass access", err).From("[BreakGlasses]")
+	}
+	resp := make([]imsjson.BreakGlass, 0, len(rows))
+	for _, row := range rows {
+		bg := row.BreakGlass
+		resp = append(resp, imsjson.BreakGlass{
+			ID:            bg.ID,
+			Event:         row.EventName,
+			Incident:      conv.SqlToInt32(bg.IncidentNumber),
+			Visit:         conv.SqlToInt32(bg.VisitNumber),
+			Handle:        bg.Handle,
+			Justification: bg.Justification,
+			Created:       conv.FloatToTime(bg.Created),
+			Expires:       conv.FloatToTime(bg.Expires),
+		})
+	}
+	return resp, nil
+}
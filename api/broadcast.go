@@ -0,0 +1,193 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// outboxBatchSize is how many SSE_OUTBOX rows a poll reads at once. A poll
+	// that fills its batch is followed straight away by another.
+	outboxBatchSize = 256
+
+	// outboxRetention is how long SSE_OUTBOX rows are kept. It only needs to
+	// cover how far behind a replica's poller might fall, since a replica that
+	// (re)starts picks up from the latest row.
+	outboxRetention = time.Hour
+
+	// outboxPrunePeriod is how often each replica deletes expired rows.
+	outboxPrunePeriod = 5 * time.Minute
+)
+
+// Broadcaster carries IMS SSEs from the server where a change was made to
+// every server that might have streams waiting to hear about it.
+//
+// What's broadcast is just the entity numbers. Each server loads the payload
+// for itself when the event is delivered, as that's cheaper than shipping it
+// around, and the payload is for the subscriber anyway, not the publisher.
+type Broadcaster interface {
+	// Publish sends data to every server, this one included.
+	Publish(ctx context.Context, data IMSEventData) *herr.HTTPError
+
+	// Start begins passing everything that's published to deliver, one event
+	// at a time and in ID order. It returns the ID of the latest event that was
+	// published before it started.
+	//
+	// A Broadcaster that doesn't number events itself gives deliver an ID of 0,
+	// in which case the EventSourcerer numbers them as it sends them out.
+	Start(ctx context.Context, deliver func(id int64, data IMSEventData)) (latestID int64, err error)
+}
+
+// localBroadcaster delivers events straight back to the server that published
+// them. That's all that's needed when there's only one IMS server.
+type localBroadcaster struct {
+	deliver func(id int64, data IMSEventData)
+}
+
+func (b *localBroadcaster) Publish(_ context.Context, data IMSEventData) *herr.HTTPError {
+	b.deliver(0, data)
+	return nil
+}
+
+func (b *localBroadcaster) Start(_ context.Context, deliver func(id int64, data IMSEventData)) (int64, error) {
+	b.deliver = deliver
+	return 0, nil
+}
+
+// OutboxBroadcaster shares events among IMS servers through the IMS database.
+// Publishing writes a row to SSE_OUTBOX, and every server polls that table for
+// new rows. This is slower than a message broker would be, by up to the poll
+// interval, but it needs nothing besides the database IMS already has.
+//
+// The SSE IDs come from the SSE_SEQUENCE row, which is bumped in the same
+// transaction as each insert. That makes the IDs globally ordered, so clients
+// can compare them across servers, and it means they become visible in order,
+// so a poller never skips past one that hasn't committed yet.
+type OutboxBroadcaster struct {
+	imsDBQ       *store.DBQ
+	pollInterval time.Duration
+}
+
+func NewOutboxBroadcaster(imsDBQ *store.DBQ, pollInterval time.Duration) *OutboxBroadcaster {
+	return &OutboxBroadcaster{
+		imsDBQ:       imsDBQ,
+		pollInterval: pollInterval,
+	}
+}
+
+func (b *OutboxBroadcaster) Publish(ctx context.Context, data IMSEventData) *herr.HTTPError {
+	return retryOnDeadlockErr(func() *herr.HTTPError {
+		txn, err := b.imsDBQ.Begin()
+		if err != nil {
+			return herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+		}
+		defer rollback(txn)
+		id, err := b.imsDBQ.NextSSEID(ctx, txn)
+		if err != nil {
+			return herr.InternalServerError("Failed to get next SSE ID", err).From("[NextSSEID]")
+		}
+		err = b.imsDBQ.AddSSEOutboxEntry(ctx, txn, imsdb.AddSSEOutboxEntryParams{
+			ID:                id,
+			Event:             data.EventID,
+			IncidentNumber:    nullIfZero(data.IncidentNumber),
+			FieldReportNumber: nullIfZero(data.FieldReportNumber),
+			VisitNumber:       nullIfZero(data.VisitNumber),
+			Created:           conv.TimeToFloat(time.Now()),
+		})
+		if err != nil {
+			return herr.InternalServerError("Failed to add SSE outbox entry", err).From("[AddSSEOutboxEntry]")
+		}
+		err = txn.Commit()
+		if err != nil {
+			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		}
+		return nil
+	})
+}
+
+func (b *OutboxBroadcaster) Start(ctx context.Context, deliver func(id int64, data IMSEventData)) (int64, error) {
+	latestID, err := b.imsDBQ.LatestSSEID(ctx, b.imsDBQ)
+	if err != nil {
+		return 0, err
+	}
+	go b.poll(ctx, latestID, deliver)
+	return latestID, nil
+}
+
+// poll delivers every row after cursor, until ctx is done. A failed poll is
+// only logged, and retried at the next tick from the same cursor, so nothing
+// is skipped.
+func (b *OutboxBroadcaster) poll(ctx context.Context, cursor int64, deliver func(id int64, data IMSEventData)) {
+	pollTicker := time.NewTicker(b.pollInterval)
+	defer pollTicker.Stop()
+	pruneTicker := time.NewTicker(outboxPrunePeriod)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pruneTicker.C:
+			b.prune(ctx)
+		case <-pollTicker.C:
+			for {
+				entries, err := b.imsDBQ.SSEOutboxEntries(ctx, b.imsDBQ, imsdb.SSEOutboxEntriesParams{
+					ID:    cursor,
+					Limit: outboxBatchSize,
+				})
+				if err != nil {
+					slog.Error("Failed to poll SSE outbox", "cursor", cursor, "error", err)
+					break
+				}
+				for _, entry := range entries {
+					deliver(entry.ID, IMSEventData{
+						EventID:           entry.Event,
+						IncidentNumber:    entry.IncidentNumber.Int32,
+						FieldReportNumber: entry.FieldReportNumber.Int32,
+						VisitNumber:       entry.VisitNumber.Int32,
+					})
+					cursor = entry.ID
+				}
+				if len(entries) < outboxBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// prune deletes expired rows. Every server does this, which is harmless, and
+// saves having to pick one to do it.
+func (b *OutboxBroadcaster) prune(ctx context.Context) {
+	cutoff := conv.TimeToFloat(time.Now().Add(-outboxRetention))
+	err := b.imsDBQ.PruneSSEOutbox(ctx, b.imsDBQ, cutoff)
+	if err != nil {
+		slog.Error("Failed to prune SSE outbox", "error", err)
+	}
+}
+
+func nullIfZero(i int32) sql.NullInt32 {
+	return sql.NullInt32{Int32: i, Valid: i != 0}
+}
@@ -0,0 +1,95 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBroadcaster stands in for a shared backend, like the OutboxBroadcaster,
+// by holding on to what's published until the test chooses to deliver it.
+type fakeBroadcaster struct {
+	latestID  int64
+	published []IMSEventData
+	deliver   func(id int64, data IMSEventData)
+}
+
+func (b *fakeBroadcaster) Publish(_ context.Context, data IMSEventData) *herr.HTTPError {
+	b.published = append(b.published, data)
+	return nil
+}
+
+func (b *fakeBroadcaster) Start(_ context.Context, deliver func(id int64, data IMSEventData)) (int64, error) {
+	b.deliver = deliver
+	return b.latestID, nil
+}
+
+func TestEventSourcererBroadcast(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+	b := &fakeBroadcaster{latestID: 41}
+	require.NoError(t, es.Broadcast(t.Context(), b))
+
+	// Without a DB, each record is taken to be confidential.
+	perms := map[int32]authz.EventPermissionMask{1: authz.RolesToEventPerms[authz.EventWriter] | authz.EventReadConfidential}
+	sub := es.subscribe("Someone", perms)
+	// The InitialEvent carries the latest ID across all servers, not just this one.
+	frame := string(<-sub.frames)
+	assert.True(t, strings.HasPrefix(frame, "id: 41\nevent: InitialEvent\n"), frame)
+
+	// Changes go out through the Broadcaster, and nothing reaches subscribers
+	// until it's delivered back.
+	es.notifyIncidentUpdate(1, 10)
+	es.notifyVisitUpdate(1, 30)
+	assert.Equal(t, []IMSEventData{
+		{EventID: 1, IncidentNumber: 10},
+		{EventID: 1, VisitNumber: 30},
+	}, b.published)
+	assert.Empty(t, received(t, sub))
+
+	// Delivered events keep the Broadcaster's IDs, including for events that
+	// were published by some other server.
+	b.deliver(42, IMSEventData{EventID: 1, IncidentNumber: 10})
+	b.deliver(43, IMSEventData{EventID: 1, FieldReportNumber: 20})
+	assert.True(t, strings.HasPrefix(string(<-sub.frames), "id: 42\nevent: Incident\n"))
+	assert.True(t, strings.HasPrefix(string(<-sub.frames), "id: 43\nevent: FieldReport\n"))
+
+	late := es.subscribe("Late", perms)
+	frame = string(<-late.frames)
+	assert.True(t, strings.HasPrefix(frame, "id: 43\nevent: InitialEvent\n"), frame)
+}
+
+func TestLocalBroadcasterNumbersInOrder(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+
+	// Without a DB, each record is taken to be confidential.
+	perms := map[int32]authz.EventPermissionMask{1: authz.RolesToEventPerms[authz.EventWriter] | authz.EventReadConfidential}
+	sub := es.subscribe("Someone", perms)
+	<-sub.frames
+	es.notifyIncidentUpdate(1, 10)
+	es.notifyFieldReportUpdate(1, 20)
+	assert.True(t, strings.HasPrefix(string(<-sub.frames), "id: 1\nevent: Incident\n"))
+	assert.True(t, strings.HasPrefix(string(<-sub.frames), "id: 2\nevent: FieldReport\n"))
+}
@@ -0,0 +1,279 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+// beforeAllChanges is a CHANGE_SEQ lower than any record's, including those
+// written before there was a change feed.
+const beforeAllChanges int64 = -1
+
+// GetChanges is the change feed. It returns every Incident, Field Report and
+// Visit in an Event that changed after the request's "cursor", which comes
+// from the previous response. A client that might have missed some
+// EventSource notifications can use it to catch up, instead of refetching
+// every list. Without a cursor, everything is returned.
+//
+// Each record is returned as it would be by GetIncidents, GetFieldReports or
+// GetVisits, subject to the same permissions. A record might be returned
+// again by the next request, if it changed again while this one was running.
+type GetChanges struct {
+	imsDBQ             *store.DBQ
+	userStore          *directory.UserStore
+	imsAdmins          []string
+	attachmentsEnabled bool
+}
+
+func (action GetChanges) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getChanges(req)
+	if errHTTP != nil {
+		errHTTP.From("[getChanges]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetChanges) getChanges(req *http.Request) (imsjson.Changes, *herr.HTTPError) {
+	var resp imsjson.Changes
+	event, jwtCtx, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return resp, errHTTP.From("[getEventPermissions]")
+	}
+	readPermissions := authz.EventReadIncidents | authz.EventReadAllFieldReports | authz.EventReadOwnFieldReports | authz.EventReadVisits
+	if eventPermissions&readPermissions == 0 {
+		return resp, herr.Forbidden("The requestor does not have permission to read anything on this Event", nil)
+	}
+	err := req.ParseForm()
+	if err != nil {
+		return resp, herr.BadRequest("Failed to parse form", err).From("[ParseForm]")
+	}
+	includeSystemEntries := !strings.EqualFold(req.Form.Get("exclude_system_entries"), "true")
+	changedAfter := beforeAllChanges
+	if v := req.Form.Get("cursor"); v != "" {
+		changedAfter, err = conv.ParseInt64(v)
+		if err != nil || changedAfter < 0 {
+			return resp, herr.BadRequest("Invalid cursor", err).From("[ParseInt64]")
+		}
+	}
+	ctx := req.Context()
+
+	// This must be read before any of the records are. Every record stamped
+	// with this value or less has been committed by now, so it will be found
+	// below, and anything stamped later will be found next time.
+	changeSeq, err := action.imsDBQ.EventChangeSeq(ctx, action.imsDBQ, event.ID)
+	if err != nil {
+		return resp, herr.InternalServerError("Failed to fetch change sequence number", err).From("[EventChangeSeq]")
+	}
+	resp.Event = event.Name
+	resp.Cursor = conv.FormatInt(changeSeq)
+
+	// The filters are left empty, so that these only filter on changedAfter.
+	noFilters := url.Values{}
+
+	if eventPermissions&authz.EventReadIncidents != 0 {
+		params, _, errHTTP := incidentsParams(noFilters, event.ID)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[incidentsParams]")
+		}
+		params.ChangedAfter = changedAfter
+		params.IncludeConfidential = canReadConfidential(eventPermissions)
+		incidents, errHTTP := fetchIncidents(ctx, action.imsDBQ, event, params, includeSystemEntries, action.attachmentsEnabled)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[fetchIncidents]")
+		}
+		noteConfidentialIncidents(req, incidents)
+		resp.Incidents = &incidents
+	}
+
+	if eventPermissions&(authz.EventReadAllFieldReports|authz.EventReadOwnFieldReports) != 0 {
+		params, _, errHTTP := fieldReportsParams(noFilters, event.ID)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[fieldReportsParams]")
+		}
+		params.ChangedAfter = changedAfter
+		params.IncludeGenerated = includeSystemEntries
+		params.IncludeConfidential = canReadConfidential(eventPermissions)
+		// i.e. the user has EventReadOwnFieldReports, but not EventReadAllFieldReports
+		if eventPermissions&authz.EventReadAllFieldReports == 0 {
+			params.Author = sql.NullString{String: jwtCtx.Claims.RangerHandle(), Valid: true}
+		}
+		fieldReports, errHTTP := fetchFieldReports(ctx, action.imsDBQ, event, params, action.attachmentsEnabled)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[fetchFieldReports]")
+		}
+		errHTTP = noteConfidentialAttached(req, action.imsDBQ, event.ID, fieldReportIncidents(fieldReports))
+		if errHTTP != nil {
+			return resp, errHTTP.From("[noteConfidentialAttached]")
+		}
+		resp.FieldReports = &fieldReports
+	}
+
+	if eventPermissions&authz.EventReadVisits != 0 {
+		params, _, errHTTP := visitsParams(noFilters, event.ID)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[visitsParams]")
+		}
+		params.ChangedAfter = changedAfter
+		params.IncludeConfidential = canReadConfidential(eventPermissions)
+		visits, errHTTP := fetchVisits(ctx, action.imsDBQ, event, params, includeSystemEntries, action.attachmentsEnabled)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[fetchVisits]")
+		}
+		errHTTP = noteConfidentialAttached(req, action.imsDBQ, event.ID, visitIncidents(visits))
+		if errHTTP != nil {
+			return resp, errHTTP.From("[noteConfidentialAttached]")
+		}
+		resp.Visits = &visits
+	}
+
+	return resp, nil
+}
+
+// changes lists the records in one Event that a write touched, for
+// recordChanges. These are the same records that the write notifies
+// EventSource clients about afterward.
+type changes struct {
+	eventID      int32
+	incidents    []int32
+	fieldReports []int32
+	visits       []int32
+}
+
+// recordChanges stamps each changed record with the next CHANGE_SEQ of its
+// Event, which is how the change feed finds it later. It must be the last
+// thing a write transaction does before committing, since the Event's row
+// lock it takes is then held until commit.
+//
+// All the records are locked before any Event is, and the Events in order of
+// ID, so that two writes can't deadlock over the Event rows. As with the
+// notify functions, a zero number means no record, and is skipped.
+func recordChanges(ctx context.Context, imsDBQ *store.DBQ, dbtx imsdb.DBTX, changed ...changes) *herr.HTTPError {
+	byEvent := make(map[int32]*changes)
+	for _, c := range changed {
+		ec, ok := byEvent[c.eventID]
+		if !ok {
+			ec = &changes{eventID: c.eventID}
+			byEvent[c.eventID] = ec
+		}
+		ec.incidents = append(ec.incidents, c.incidents...)
+		ec.fieldReports = append(ec.fieldReports, c.fieldReports...)
+		ec.visits = append(ec.visits, c.visits...)
+	}
+	events := make([]*changes, 0, len(byEvent))
+	for _, ec := range byEvent {
+		ec.incidents = changedNumbers(ec.incidents)
+		ec.fieldReports = changedNumbers(ec.fieldReports)
+		ec.visits = changedNumbers(ec.visits)
+		if len(ec.incidents)+len(ec.fieldReports)+len(ec.visits) > 0 {
+			events = append(events, ec)
+		}
+	}
+	slices.SortFunc(events, func(a, b *changes) int {
+		return cmp.Compare(a.eventID, b.eventID)
+	})
+
+	for _, ec := range events {
+		if len(ec.incidents) > 0 {
+			_, err := imsDBQ.LockIncidentsForChange(ctx, dbtx, imsdb.LockIncidentsForChangeParams{
+				Event:   ec.eventID,
+				Numbers: ec.incidents,
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to lock Incidents", err).From("[LockIncidentsForChange]")
+			}
+		}
+		if len(ec.fieldReports) > 0 {
+			_, err := imsDBQ.LockFieldReportsForChange(ctx, dbtx, imsdb.LockFieldReportsForChangeParams{
+				Event:   ec.eventID,
+				Numbers: ec.fieldReports,
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to lock Field Reports", err).From("[LockFieldReportsForChange]")
+			}
+		}
+		if len(ec.visits) > 0 {
+			_, err := imsDBQ.LockVisitsForChange(ctx, dbtx, imsdb.LockVisitsForChangeParams{
+				Event:   ec.eventID,
+				Numbers: ec.visits,
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to lock Visits", err).From("[LockVisitsForChange]")
+			}
+		}
+	}
+
+	for _, ec := range events {
+		changeSeq, err := imsDBQ.NextEventChangeSeq(ctx, dbtx, ec.eventID)
+		if err != nil {
+			return herr.InternalServerError("Failed to take next change sequence number", err).From("[NextEventChangeSeq]")
+		}
+		if len(ec.incidents) > 0 {
+			err = imsDBQ.StampIncidentsChange(ctx, dbtx, imsdb.StampIncidentsChangeParams{
+				ChangeSeq: changeSeq,
+				Event:     ec.eventID,
+				Numbers:   ec.incidents,
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to stamp Incidents", err).From("[StampIncidentsChange]")
+			}
+		}
+		if len(ec.fieldReports) > 0 {
+			err = imsDBQ.StampFieldReportsChange(ctx, dbtx, imsdb.StampFieldReportsChangeParams{
+				ChangeSeq: changeSeq,
+				Event:     ec.eventID,
+				Numbers:   ec.fieldReports,
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to stamp Field Reports", err).From("[StampFieldReportsChange]")
+			}
+		}
+		if len(ec.visits) > 0 {
+			err = imsDBQ.StampVisitsChange(ctx, dbtx, imsdb.StampVisitsChangeParams{
+				ChangeSeq: changeSeq,
+				Event:     ec.eventID,
+				Numbers:   ec.visits,
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to stamp Visits", err).From("[StampVisitsChange]")
+			}
+		}
+	}
+	return nil
+}
+
+// changedNumbers sorts and dedupes numbers, and drops any zeroes.
+func changedNumbers(numbers []int32) []int32 {
+	numbers = slices.DeleteFunc(numbers, func(n int32) bool { return n == 0 })
+	slices.Sort(numbers)
+	return slices.Compact(numbers)
+}
@@ -0,0 +1,30 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangedNumbers(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []int32{1, 3, 7}, changedNumbers([]int32{7, 0, 3, 1, 3, 0}))
+	assert.Empty(t, changedNumbers([]int32{0, 0}))
+	assert.Empty(t, changedNumbers(nil))
+}
@@ -0,0 +1,177 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+// Some Incidents, e.g. a sexual assault or one that involves law enforcement,
+// are marked confidential. Such an Incident, and the Field Reports and Visits
+// attached to it, may only be read by someone who has EventReadConfidential
+// on top of the usual permission to read them. Everyone else gets a 403 for
+// the record itself, and doesn't find it among the others, in a search, or on
+// the EventSource. Each request that reads or changes a confidential record is
+// written to the action log, whether or not its route's requests usually are.
+
+const (
+	// confidentialAccessActionType is the ACTION_LOG ACTION_TYPE for a request
+	// that touched a confidential record.
+	confidentialAccessActionType = "confidential"
+
+	confidentialAccessKey ContextKey = "ConfidentialAccess"
+)
+
+// confidentialAccess is how a handler tells LogRequest that it touched a
+// confidential record.
+type confidentialAccess struct {
+	touched atomic.Bool
+}
+
+// withConfidentialAccess gives the request a confidentialAccess for its handler
+// to mark.
+func withConfidentialAccess(req *http.Request) (*http.Request, *confidentialAccess) {
+	access := &confidentialAccess{}
+	return req.WithContext(context.WithValue(req.Context(), confidentialAccessKey, access)), access
+}
+
+// noteConfidentialAccess has the request written to the action log as one that
+// touched a confidential record.
+func noteConfidentialAccess(req *http.Request) {
+	if access, ok := req.Context().Value(confidentialAccessKey).(*confidentialAccess); ok {
+		access.touched.Store(true)
+	}
+}
+
+func canReadConfidential(eventPermissions authz.EventPermissionMask) bool {
+	return eventPermissions&authz.EventReadConfidential != 0
+}
+
+// allowConfidential refuses the request if the record is confidential and the
+// requestor may not read confidential records, and otherwise notes that they
+// touched it.
+func allowConfidential(req *http.Request, confidential bool, eventPermissions authz.EventPermissionMask) *herr.HTTPError {
+	if !confidential {
+		return nil
+	}
+	if !canReadConfidential(eventPermissions) {
+		return herr.Forbidden("The requestor does not have EventReadConfidential permission on this Event", nil)
+	}
+	noteConfidentialAccess(req)
+	return nil
+}
+
+// incidentConfidential says whether the Incident is confidential. There's no
+// Incident at all for a null number, and a missing Incident isn't confidential
+// either, so that the caller may report it as missing in its own way.
+func incidentConfidential(ctx context.Context, imsDBQ *store.DBQ, eventID int32, incidentNumber sql.NullInt32) (bool, *herr.HTTPError) {
+	if !incidentNumber.Valid {
+		return false, nil
+	}
+	confidential, err := imsDBQ.IncidentConfidential(ctx, imsDBQ, imsdb.IncidentConfidentialParams{
+		Event:  eventID,
+		Number: incidentNumber.Int32,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, herr.InternalServerError("Failed to fetch Incident", err).From("[IncidentConfidential]")
+	}
+	return confidential, nil
+}
+
+// checkConfidentialIncident is allowConfidential for the Incident, or for a
+// Field Report or Visit that's attached to it.
+func checkConfidentialIncident(
+	req *http.Request, imsDBQ *store.DBQ, eventID int32, incidentNumber sql.NullInt32, eventPermissions authz.EventPermissionMask,
+) *herr.HTTPError {
+	confidential, errHTTP := incidentConfidential(req.Context(), imsDBQ, eventID, incidentNumber)
+	if errHTTP != nil {
+		return errHTTP.From("[incidentConfidential]")
+	}
+	return allowConfidential(req, confidential, eventPermissions)
+}
+
+// noteConfidentialAttached notes the access if any of the Field Reports or
+// Visits, given by the Incidents they're attached to, is attached to a
+// confidential Incident.
+func noteConfidentialAttached(req *http.Request, imsDBQ *store.DBQ, eventID int32, incidentNumbers []*int32) *herr.HTTPError {
+	if !slices.ContainsFunc(incidentNumbers, func(n *int32) bool { return n != nil }) {
+		return nil
+	}
+	confidentialNumbers, err := imsDBQ.ConfidentialIncidentNumbers(req.Context(), imsDBQ, eventID)
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch confidential Incidents", err).From("[ConfidentialIncidentNumbers]")
+	}
+	for _, n := range incidentNumbers {
+		if n != nil && slices.Contains(confidentialNumbers, *n) {
+			noteConfidentialAccess(req)
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkConfidentialFieldReport is checkConfidentialIncident for the Incident
+// that the Field Report is attached to. A missing Field Report is left for the
+// caller to report.
+func checkConfidentialFieldReport(
+	req *http.Request, imsDBQ *store.DBQ, eventID, fieldReportNumber int32, eventPermissions authz.EventPermissionMask,
+) *herr.HTTPError {
+	confidential, err := imsDBQ.FieldReportConfidential(req.Context(), imsDBQ, imsdb.FieldReportConfidentialParams{
+		Event:  eventID,
+		Number: fieldReportNumber,
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return herr.InternalServerError("Failed to fetch Field Report", err).From("[FieldReportConfidential]")
+	}
+	return allowConfidential(req, confidential, eventPermissions)
+}
+
+// checkConfidentialVisit is checkConfidentialFieldReport for a Visit.
+func checkConfidentialVisit(
+	req *http.Request, imsDBQ *store.DBQ, eventID, visitNumber int32, eventPermissions authz.EventPermissionMask,
+) *herr.HTTPError {
+	confidential, err := imsDBQ.VisitConfidential(req.Context(), imsDBQ, imsdb.VisitConfidentialParams{
+		Event:  eventID,
+		Number: visitNumber,
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return herr.InternalServerError("Failed to fetch Visit", err).From("[VisitConfidential]")
+	}
+	return allowConfidential(req, confidential, eventPermissions)
+}
+
+// incidentRef is the Incident that a JSON Field Report or Visit refers to,
+// where a missing or nonpositive number refers to no Incident.
+func incidentRef(incident *int32) sql.NullInt32 {
+	if incident == nil || *incident <= 0 {
+		return sql.NullInt32{}
+	}
+	return sql.NullInt32{Int32: *incident, Valid: true}
+}
@@ -23,10 +23,13 @@ import (
 	"net/http"
 	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/burningmantech/ranger-ims-go/directory"
 	imsjson "github.com/burningmantech/ranger-ims-go/json"
 	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
+	"github.com/burningmantech/ranger-ims-go/lib/authn"
 	"github.com/burningmantech/ranger-ims-go/lib/authz"
 	"github.com/burningmantech/ranger-ims-go/lib/conv"
 	"github.com/burningmantech/ranger-ims-go/lib/herr"
@@ -35,14 +38,14 @@ import (
 )
 
 const (
-	maxDirectoryHandleLen   = 128
-	maxDirectoryEmailLen    = 256
-	maxDirectoryTitleLen    = 128
-	maxDirectoryPasswordLen = 256
+	maxDirectoryHandleLen = 128
+	maxDirectoryEmailLen  = 256
+	maxDirectoryTitleLen  = 128
 )
 
 // requireDirectoryAdmin does the checks common to all the directory admin
-// endpoints: the deployment must use the IMS-native directory, and the
+// endpoints: the deployment must use the IMS-native directory, perhaps as
+// part of a composite one, and the
 // requestor must have GlobalAdministrateDirectory permission.
 func requireDirectoryAdmin(
 	req *http.Request,
@@ -54,7 +57,7 @@ func requireDirectoryAdmin(
 	if !directoryIsIMS {
 		return herr.Forbidden(
 			"This deployment's user directory is not managed by IMS "+
-				"(IMS_DIRECTORY is not 'ims'), so it cannot be administered here",
+				"(IMS_DIRECTORY is neither 'ims' nor 'composite'), so it cannot be administered here",
 			nil,
 		)
 	}
@@ -132,15 +135,22 @@ func (action GetDirectory) getDirectory(req *http.Request) (imsjson.Directory, *
 		}
 		slices.Sort(teamIDs)
 		slices.Sort(positionIDs)
-		resp.Persons = append(resp.Persons, imsjson.DirectoryPerson{
-			ID:          p.ID,
-			Handle:      new(p.Handle),
-			Email:       conv.SqlToString(p.Email),
-			Active:      new(p.Active),
-			Onsite:      new(p.Onsite),
-			TeamIDs:     &teamIDs,
-			PositionIDs: &positionIDs,
-		})
+		person := imsjson.DirectoryPerson{
+			ID:           p.ID,
+			Handle:       new(p.Handle),
+			Email:        conv.SqlToString(p.Email),
+			Active:       new(p.Active),
+			Onsite:       new(p.Onsite),
+			TeamIDs:      &teamIDs,
+			PositionIDs:  &positionIDs,
+			TOTPRequired: new(p.TotpRequired),
+			TOTPEnrolled: p.TotpConfirmed,
+			OnDutySince:  conv.NullFloatToTime(p.OnDutySince),
+		}
+		if p.OnDutyPositionID.Valid {
+			person.OnDutyPositionID = &p.OnDutyPositionID.Int64
+		}
+		resp.Persons = append(resp.Persons, person)
 	}
 	for _, t := range teams {
 		resp.Teams = append(resp.Teams, imsjson.DirectoryGroup{
@@ -169,10 +179,11 @@ func (action GetDirectory) getDirectory(req *http.Request) (imsjson.Directory, *
 }
 
 type EditDirectoryPerson struct {
-	imsDBQ         *store.DBQ
-	userStore      *directory.UserStore
-	imsAdmins      []string
-	directoryIsIMS bool
+	imsDBQ             *store.DBQ
+	userStore          *directory.UserStore
+	imsAdmins          []string
+	directoryIsIMS     bool
+	passwordHashParams *argon2id.Params
 }
 
 func (action EditDirectoryPerson) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -216,7 +227,7 @@ func (action EditDirectoryPerson) editDirectoryPerson(req *http.Request) (newPer
 		}
 		// New persons start with an unguessable placeholder password, so
 		// they can't log in until an admin sets a real password for them.
-		placeholder := argon2id.CreateHash(rand.Text(), argon2id.SecondRecommendedParams)
+		placeholder := argon2id.CreateHash(rand.Text(), action.passwordHashParams)
 		var email sql.NullString
 		if personReq.Email != nil {
 			email = conv.StringToSql(conv.EmptyToNil(*personReq.Email), maxDirectoryEmailLen)
@@ -269,6 +280,27 @@ func (action EditDirectoryPerson) editDirectoryPerson(req *http.Request) (newPer
 			return nil, herr.BadRequest("Failed to update person. Handles and emails must be unique.", err).
 				From("[DirectoryUpdatePerson]")
 		}
+		// A deactivated person is logged out everywhere, and goes off duty.
+		if existing.Active && !active {
+			errHTTP = revokeUserSessions(ctx, action.imsDBQ, action.userStore.UserID(personID))
+			if errHTTP != nil {
+				return nil, errHTTP.From("[revokeUserSessions]")
+			}
+			errHTTP = signOffPerson(ctx, action.imsDBQ, personID, time.Now())
+			if errHTTP != nil {
+				return nil, errHTTP.From("[signOffPerson]")
+			}
+		}
+	}
+
+	if personReq.TOTPRequired != nil {
+		err := action.imsDBQ.DirectorySetPersonTOTPRequired(ctx, action.imsDBQ, imsdb.DirectorySetPersonTOTPRequiredParams{
+			TotpRequired: *personReq.TOTPRequired,
+			ID:           personID,
+		})
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to set TOTP requirement", err).From("[DirectorySetPersonTOTPRequired]")
+		}
 	}
 
 	errHTTP = action.setMemberships(req, personID, personReq.TeamIDs, personReq.PositionIDs)
@@ -316,15 +348,29 @@ func (action EditDirectoryPerson) setMemberships(
 					From("[DirectoryAddPersonPosition]")
 			}
 		}
+		// Someone who no longer holds the position they're on duty in goes
+		// off duty.
+		onDuty, err := action.imsDBQ.DirectoryPersonOnDuty(ctx, action.imsDBQ, personID)
+		if err != nil {
+			return herr.InternalServerError("Failed to fetch on-duty position", err).From("[DirectoryPersonOnDuty]")
+		}
+		if onDuty.OnDutyPositionID.Valid && !slices.Contains(*positionIDs, onDuty.OnDutyPositionID.Int64) {
+			errHTTP := signOffPerson(ctx, action.imsDBQ, personID, time.Now())
+			if errHTTP != nil {
+				return errHTTP.From("[signOffPerson]")
+			}
+		}
 	}
 	return nil
 }
 
 type SetDirectoryPersonPassword struct {
-	imsDBQ         *store.DBQ
-	userStore      *directory.UserStore
-	imsAdmins      []string
-	directoryIsIMS bool
+	imsDBQ             *store.DBQ
+	userStore          *directory.UserStore
+	imsAdmins          []string
+	directoryIsIMS     bool
+	passwordHashParams *argon2id.Params
+	passwordPolicy     authn.PasswordPolicy
 }
 
 func (action SetDirectoryPersonPassword) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -350,25 +396,24 @@ func (action SetDirectoryPersonPassword) setDirectoryPersonPassword(req *http.Re
 	if errHTTP != nil {
 		return errHTTP.From("[readBodyAs]")
 	}
-	if passwordReq.Password == "" {
-		return herr.BadRequest("Password must not be empty", nil)
-	}
-	if len(passwordReq.Password) > maxDirectoryPasswordLen {
-		return herr.BadRequest("Password is too long", nil)
-	}
 	// Ensure the person exists, so we can 404 rather than silently updating
 	// zero rows.
-	_, err = action.imsDBQ.DirectoryPersonByID(ctx, action.imsDBQ, personID)
+	person, err := action.imsDBQ.DirectoryPersonByID(ctx, action.imsDBQ, personID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return herr.NotFound("Person not found", err)
 		}
 		return herr.InternalServerError("Failed to fetch person", err).From("[DirectoryPersonByID]")
 	}
-	hashed := argon2id.CreateHash(passwordReq.Password, argon2id.SecondRecommendedParams)
+	errHTTP = checkPassword(action.passwordPolicy, passwordReq.Password, person.Handle, person.Email.String)
+	if errHTTP != nil {
+		return errHTTP.From("[checkPassword]")
+	}
+	hashed := argon2id.CreateHash(passwordReq.Password, action.passwordHashParams)
 	err = action.imsDBQ.DirectorySetPersonPassword(ctx, action.imsDBQ, imsdb.DirectorySetPersonPasswordParams{
-		Password: hashed,
-		ID:       personID,
+		Password:       hashed,
+		PasswordPolicy: sql.NullString{String: action.passwordPolicy.String(), Valid: true},
+		ID:             personID,
 	})
 	if err != nil {
 		return herr.InternalServerError("Failed to set password", err).From("[DirectorySetPersonPassword]")
@@ -376,6 +421,134 @@ func (action SetDirectoryPersonPassword) setDirectoryPersonPassword(req *http.Re
 	return nil
 }
 
+// checkPassword holds a new password for someone in the IMS-native directory
+// up to the password policy. Every rule it breaks is in the error response.
+func checkPassword(policy authn.PasswordPolicy, password, handle, email string) *herr.HTTPError {
+	violations, err := policy.Check(password, handle, email)
+	if err != nil {
+		return herr.InternalServerError("Failed to check password", err).From("[Check]")
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(violations))
+	problemViolations := make([]herr.Violation, 0, len(violations))
+	for _, v := range violations {
+		messages = append(messages, v.Message)
+		problemViolations = append(problemViolations, herr.Violation{Rule: string(v.Rule), Detail: v.Message})
+	}
+	return herr.BadRequest(strings.Join(messages, "; "), nil).SetViolations(problemViolations)
+}
+
+// GetDirectoryPasswordHashes reports how many password hashes were made with
+// each set of argon2id params, so that admins can tell how many are still weaker
+// than the current params, for people who haven't logged in since they changed.
+type GetDirectoryPasswordHashes struct {
+	imsDBQ             *store.DBQ
+	userStore          *directory.UserStore
+	imsAdmins          []string
+	directoryIsIMS     bool
+	passwordHashParams *argon2id.Params
+}
+
+func (action GetDirectoryPasswordHashes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getDirectoryPasswordHashes(req)
+	if errHTTP != nil {
+		errHTTP.From("[getDirectoryPasswordHashes]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetDirectoryPasswordHashes) getDirectoryPasswordHashes(req *http.Request) (imsjson.DirectoryPasswordHashes, *herr.HTTPError) {
+	empty := imsjson.DirectoryPasswordHashes{}
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[requireDirectoryAdmin]")
+	}
+	hashes, err := action.imsDBQ.DirectoryPasswordHashes(req.Context(), action.imsDBQ)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to fetch password hashes", err).From("[DirectoryPasswordHashes]")
+	}
+	counts := make(map[imsjson.DirectoryPasswordHashParams]int32)
+	for _, hash := range hashes {
+		key := imsjson.DirectoryPasswordHashParams{Params: "unknown", Weaker: true}
+		params, _, _, err := argon2id.DecodeHash(hash)
+		if err == nil {
+			key.Params = params.String()
+			key.Weaker = params.WeakerThan(action.passwordHashParams)
+		}
+		counts[key]++
+	}
+	resp := imsjson.DirectoryPasswordHashes{
+		Target: action.passwordHashParams.String(),
+		Params: make([]imsjson.DirectoryPasswordHashParams, 0, len(counts)),
+	}
+	for key, count := range counts {
+		key.Count = count
+		resp.Params = append(resp.Params, key)
+	}
+	slices.SortFunc(resp.Params, func(a, b imsjson.DirectoryPasswordHashParams) int {
+		if a.Count != b.Count {
+			return int(b.Count - a.Count)
+		}
+		return strings.Compare(a.Params, b.Params)
+	})
+	return resp, nil
+}
+
+// GetDirectoryPasswordPolicy lists the people whose passwords weren't checked
+// against the current password policy, because they were set before it came
+// into force, or under an older one. It includes people who have never had a
+// password at all. Admins may want to send these people password reset emails.
+type GetDirectoryPasswordPolicy struct {
+	imsDBQ         *store.DBQ
+	userStore      *directory.UserStore
+	imsAdmins      []string
+	directoryIsIMS bool
+	passwordPolicy authn.PasswordPolicy
+}
+
+func (action GetDirectoryPasswordPolicy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getDirectoryPasswordPolicy(req)
+	if errHTTP != nil {
+		errHTTP.From("[getDirectoryPasswordPolicy]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetDirectoryPasswordPolicy) getDirectoryPasswordPolicy(req *http.Request) (imsjson.DirectoryPasswordPolicy, *herr.HTTPError) {
+	empty := imsjson.DirectoryPasswordPolicy{}
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[requireDirectoryAdmin]")
+	}
+	rows, err := action.imsDBQ.DirectoryPasswordPolicies(req.Context(), action.imsDBQ)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to fetch password policies", err).From("[DirectoryPasswordPolicies]")
+	}
+	resp := imsjson.DirectoryPasswordPolicy{
+		Current:   action.passwordPolicy.String(),
+		Predating: make([]imsjson.DirectoryPasswordPolicyPerson, 0),
+	}
+	for _, row := range rows {
+		if row.PasswordPolicy.Valid && row.PasswordPolicy.String == resp.Current {
+			continue
+		}
+		resp.Predating = append(resp.Predating, imsjson.DirectoryPasswordPolicyPerson{
+			ID:     row.ID,
+			Handle: row.Handle,
+			Active: row.Active,
+			Policy: conv.SqlToString(row.PasswordPolicy),
+		})
+	}
+	slices.SortFunc(resp.Predating, func(a, b imsjson.DirectoryPasswordPolicyPerson) int {
+		return strings.Compare(a.Handle, b.Handle)
+	})
+	return resp, nil
+}
+
 type DeleteDirectoryPerson struct {
 	imsDBQ         *store.DBQ
 	userStore      *directory.UserStore
@@ -405,6 +578,10 @@ func (action DeleteDirectoryPerson) deleteDirectoryPerson(req *http.Request) *he
 	if err != nil {
 		return herr.InternalServerError("Failed to delete person", err).From("[DirectoryDeletePerson]")
 	}
+	errHTTP = revokeUserSessions(req.Context(), action.imsDBQ, action.userStore.UserID(personID))
+	if errHTTP != nil {
+		return errHTTP.From("[revokeUserSessions]")
+	}
 	return nil
 }
 
@@ -514,6 +691,13 @@ func editDirectoryGroup(
 	if groupReq.Active != nil {
 		active = *groupReq.Active
 	}
+	// Nobody stays on duty in a deactivated position.
+	if isPosition && existingActive && !active {
+		errHTTP = signOffPosition(ctx, imsDBQ, groupReq.ID, time.Now())
+		if errHTTP != nil {
+			return nil, errHTTP.From("[signOffPosition]")
+		}
+	}
 	var err error
 	if isPosition {
 		err = imsDBQ.DirectoryUpdatePosition(ctx, imsDBQ, imsdb.DirectoryUpdatePositionParams{
@@ -607,6 +791,12 @@ func (action DeleteDirectoryPosition) ServeHTTP(w http.ResponseWriter, req *http
 		herr.BadRequest("Invalid position ID", err).WriteResponse(w)
 		return
 	}
+	// The shift history outlives the position, so its shifts must end first.
+	errHTTP = signOffPosition(req.Context(), action.imsDBQ, positionID, time.Now())
+	if errHTTP != nil {
+		errHTTP.From("[signOffPosition]").WriteResponse(w)
+		return
+	}
 	err = action.imsDBQ.DirectoryDeletePosition(req.Context(), action.imsDBQ, positionID)
 	if err != nil {
 		herr.InternalServerError("Failed to delete position", err).From("[DirectoryDeletePosition]").WriteResponse(w)
@@ -0,0 +1,1022 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/conf"
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// DirectoryFormatCSV holds only the persons of a DirectoryBulk, one per
+	// row, under the columns in directoryCSVHeader. A person's teams and
+	// positions are their titles, separated by directoryCSVSeparator.
+	DirectoryFormatCSV = "csv"
+	// DirectoryFormatJSON is a DirectoryBulk as JSON.
+	DirectoryFormatJSON = "json"
+
+	directoryCSVSeparator = ";"
+
+	directoryImportKindPerson   = "person"
+	directoryImportKindTeam     = "team"
+	directoryImportKindPosition = "position"
+)
+
+// directoryCSVHeader is the header row of a CSV export. An import needs only
+// the handle column; a person's fields whose columns are left out, or whose
+// active and onsite cells are empty, are left unchanged.
+var directoryCSVHeader = []string{"handle", "email", "active", "onsite", "teams", "positions"}
+
+var (
+	errInvalidDirectoryBulk = errors.New("invalid directory import")
+	errDirectoryImportMail  = errors.New("this server isn't configured to send mail")
+)
+
+// DirectoryImportOptions change how a bulk import of the IMS-native directory
+// goes about it.
+type DirectoryImportOptions struct {
+	// DryRun works out what the import would change, without changing it.
+	DryRun bool
+	// DeactivateMissing deactivates every active person who isn't in the
+	// import, so that the active persons are exactly those who are.
+	DeactivateMissing bool
+	// Invite emails each new, active person who has an email address an
+	// invitation to choose their own password.
+	Invite bool
+}
+
+// ExportDirectory gives the whole IMS-native directory as a DirectoryBulk, in
+// the format given by the "format" parameter, which is "json" by default. The
+// export can be edited and then imported through ImportDirectory.
+type ExportDirectory struct {
+	imsDBQ         *store.DBQ
+	userStore      *directory.UserStore
+	imsAdmins      []string
+	directoryIsIMS bool
+}
+
+func (action ExportDirectory) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		errHTTP.From("[requireDirectoryAdmin]").WriteResponse(w)
+		return
+	}
+	format := req.FormValue("format")
+	if format == "" {
+		format = DirectoryFormatJSON
+	}
+	if format != DirectoryFormatJSON && format != DirectoryFormatCSV {
+		herr.BadRequest("The 'format' parameter must be 'json' or 'csv'", nil).WriteResponse(w)
+		return
+	}
+	bulk, err := ExportDirectoryBulk(req.Context(), action.imsDBQ)
+	if err != nil {
+		herr.InternalServerError("Failed to fetch directory", err).From("[ExportDirectoryBulk]").WriteResponse(w)
+		return
+	}
+	if format == DirectoryFormatJSON {
+		mustWriteJSON(w, req, bulk)
+		return
+	}
+	// Write the CSV out in full first, so that a failure can still get an
+	// error response.
+	var sb strings.Builder
+	err = WriteDirectoryBulk(&sb, DirectoryFormatCSV, bulk)
+	if err != nil {
+		herr.BadRequest("Failed to write CSV. Try the JSON format instead.", err).From("[WriteDirectoryBulk]").WriteResponse(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="directory.csv"`)
+	_, _ = io.WriteString(w, sb.String())
+}
+
+// ExportDirectoryBulk fetches the whole IMS-native directory, with persons in
+// order of handle, and teams and positions in order of title.
+func ExportDirectoryBulk(ctx context.Context, imsDBQ *store.DBQ) (imsjson.DirectoryBulk, error) {
+	empty := imsjson.DirectoryBulk{}
+	existing, err := fetchDirectoryForImport(ctx, imsDBQ)
+	if err != nil {
+		return empty, fmt.Errorf("[fetchDirectoryForImport]: %w", err)
+	}
+	bulk := imsjson.DirectoryBulk{
+		Persons:   make([]imsjson.DirectoryBulkPerson, 0, len(existing.persons)),
+		Teams:     existing.teams.bulkGroups(),
+		Positions: existing.positions.bulkGroups(),
+	}
+	for _, p := range existing.persons {
+		bulk.Persons = append(bulk.Persons, imsjson.DirectoryBulkPerson{
+			Handle:    p.Handle,
+			Email:     new(p.Email.String),
+			Active:    new(p.Active),
+			Onsite:    new(p.Onsite),
+			Teams:     new(existing.teams.titles(existing.teamIDs[p.ID])),
+			Positions: new(existing.positions.titles(existing.positionIDs[p.ID])),
+		})
+	}
+	slices.SortFunc(bulk.Persons, func(a, b imsjson.DirectoryBulkPerson) int {
+		return strings.Compare(strings.ToLower(a.Handle), strings.ToLower(b.Handle))
+	})
+	return bulk, nil
+}
+
+// ImportDirectory creates and updates persons, teams, and positions in the
+// IMS-native directory in bulk, from a CSV or JSON body (see ExportDirectory),
+// and responds with what it changed. Persons are matched to those already in
+// the directory by handle, and teams and positions by title, so importing the
+// same thing twice changes nothing the second time. These parameters are all
+// optional, and "false" by default:
+//
+//   - dryRun: only work out what would change.
+//   - deactivateMissing: deactivate every active person who isn't imported.
+//   - invite: email each new person an invitation to choose their password.
+type ImportDirectory struct {
+	imsDBQ             *store.DBQ
+	userStore          *directory.UserStore
+	imsAdmins          []string
+	directoryIsIMS     bool
+	passwordHashParams *argon2id.Params
+	mailer             *passwordMailer
+}
+
+func (action ImportDirectory) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.importDirectory(req)
+	if errHTTP != nil {
+		errHTTP.From("[importDirectory]").WriteResponse(w)
+		return
+	}
+	if !resp.DryRun {
+		action.userStore.Flush()
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action ImportDirectory) importDirectory(req *http.Request) (imsjson.DirectoryImport, *herr.HTTPError) {
+	empty := imsjson.DirectoryImport{}
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[requireDirectoryAdmin]")
+	}
+	var opts DirectoryImportOptions
+	query := req.URL.Query()
+	for name, opt := range map[string]*bool{
+		"dryRun":            &opts.DryRun,
+		"deactivateMissing": &opts.DeactivateMissing,
+		"invite":            &opts.Invite,
+	} {
+		if param := query.Get(name); param != "" {
+			var err error
+			*opt, err = strconv.ParseBool(param)
+			if err != nil {
+				return empty, herr.BadRequest(fmt.Sprintf("The '%v' parameter must be a boolean", name), nil)
+			}
+		}
+	}
+
+	// Only JSON and CSV are accepted. Neither is a type that a form on another
+	// site can send, for the reasons given on requireJSONContentType.
+	defer shut(req.Body)
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	var format string
+	switch strings.ToLower(mediaType) {
+	case "application/json":
+		format = DirectoryFormatJSON
+	case "text/csv":
+		format = DirectoryFormatCSV
+	default:
+		return empty, herr.UnsupportedMediaType("Request Content-Type must be application/json or text/csv", nil)
+	}
+	bulk, err := ReadDirectoryBulk(req.Body, format)
+	if err != nil {
+		return empty, herr.BadRequest(err.Error(), err).From("[ReadDirectoryBulk]")
+	}
+
+	resp, err := importDirectory(req.Context(), action.imsDBQ, bulk, opts,
+		action.passwordHashParams, action.mailer, action.userStore.UserID)
+	if errors.Is(err, errInvalidDirectoryBulk) {
+		return empty, herr.BadRequest(err.Error(), err).From("[importDirectory]")
+	}
+	if errors.Is(err, errDirectoryImportMail) {
+		return empty, herr.New(http.StatusServiceUnavailable, "This server isn't configured to send mail", err)
+	}
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to import directory", err).From("[importDirectory]")
+	}
+	return resp, nil
+}
+
+// ImportDirectoryBulk is a bulk import of the IMS-native directory, as done
+// by ImportDirectory, for use outside an IMS server. Invitations are sent as
+// IMS_MAIL configures, and a running server may not see the import until its
+// directory cache next expires.
+func ImportDirectoryBulk(
+	ctx context.Context, imsDBQ *store.DBQ, imsCfg *conf.IMSConfig, bulk imsjson.DirectoryBulk, opts DirectoryImportOptions,
+) (imsjson.DirectoryImport, error) {
+	// Sessions are by user ID, which is only the same as the person's ID when
+	// the IMS-native directory has the whole user directory to itself.
+	userID := func(personID int64) int64 { return personID }
+	if imsCfg.Directory.Directory == conf.DirectoryTypeComposite {
+		userID = func(personID int64) int64 { return personID + directory.GuestIDOffset }
+	}
+	return importDirectory(ctx, imsDBQ, bulk, opts,
+		imsCfg.Core.PasswordHashParams, newPasswordMailer(imsDBQ, imsCfg.Mail), userID)
+}
+
+// ReadDirectoryBulk reads a DirectoryBulk in the given format. It checks only
+// that it's well-formed; importing it checks the rest.
+func ReadDirectoryBulk(r io.Reader, format string) (imsjson.DirectoryBulk, error) {
+	empty := imsjson.DirectoryBulk{}
+	switch format {
+	case DirectoryFormatJSON:
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return empty, fmt.Errorf("[ReadAll]: %w", err)
+		}
+		var bulk imsjson.DirectoryBulk
+		if err = json.Unmarshal(b, &bulk); err != nil {
+			return empty, fmt.Errorf("%w: bad JSON: %w", errInvalidDirectoryBulk, err)
+		}
+		return bulk, nil
+	case DirectoryFormatCSV:
+		return readDirectoryCSV(r)
+	default:
+		return empty, fmt.Errorf("%w: unknown format %q", errInvalidDirectoryBulk, format)
+	}
+}
+
+func readDirectoryCSV(r io.Reader) (imsjson.DirectoryBulk, error) {
+	empty := imsjson.DirectoryBulk{}
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return empty, fmt.Errorf("%w: no CSV header row: %w", errInvalidDirectoryBulk, err)
+	}
+	column := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(directoryCSVHeader, name) {
+			return empty, fmt.Errorf("%w: unknown CSV column %q", errInvalidDirectoryBulk, name)
+		}
+		if _, ok := column[name]; ok {
+			return empty, fmt.Errorf("%w: CSV column %q is repeated", errInvalidDirectoryBulk, name)
+		}
+		column[name] = i
+	}
+	if _, ok := column["handle"]; !ok {
+		return empty, fmt.Errorf("%w: the CSV has no handle column", errInvalidDirectoryBulk)
+	}
+
+	bulk := imsjson.DirectoryBulk{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return empty, fmt.Errorf("%w: bad CSV: %w", errInvalidDirectoryBulk, err)
+		}
+		line, _ := reader.FieldPos(0)
+		cell := func(name string) (string, bool) {
+			i, ok := column[name]
+			if !ok {
+				return "", false
+			}
+			return strings.TrimSpace(record[i]), true
+		}
+		boolCell := func(name string) (*bool, error) {
+			v, ok := cell(name)
+			if !ok || v == "" {
+				return nil, nil
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %v: %v must be true or false", errInvalidDirectoryBulk, line, name)
+			}
+			return &b, nil
+		}
+		titlesCell := func(name string) *[]string {
+			v, ok := cell(name)
+			if !ok {
+				return nil
+			}
+			titles := []string{}
+			for title := range strings.SplitSeq(v, directoryCSVSeparator) {
+				if title = strings.TrimSpace(title); title != "" {
+					titles = append(titles, title)
+				}
+			}
+			return &titles
+		}
+
+		person := imsjson.DirectoryBulkPerson{}
+		person.Handle, _ = cell("handle")
+		if email, ok := cell("email"); ok {
+			person.Email = &email
+		}
+		if person.Active, err = boolCell("active"); err != nil {
+			return empty, err
+		}
+		if person.Onsite, err = boolCell("onsite"); err != nil {
+			return empty, err
+		}
+		person.Teams = titlesCell("teams")
+		person.Positions = titlesCell("positions")
+		bulk.Persons = append(bulk.Persons, person)
+	}
+	return bulk, nil
+}
+
+// WriteDirectoryBulk writes a DirectoryBulk in the given format. A CSV can't
+// have a team or position whose title has the separator in it.
+func WriteDirectoryBulk(w io.Writer, format string, bulk imsjson.DirectoryBulk) error {
+	switch format {
+	case DirectoryFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(bulk); err != nil {
+			return fmt.Errorf("[Encode]: %w", err)
+		}
+		return nil
+	case DirectoryFormatCSV:
+		writer := csv.NewWriter(w)
+		_ = writer.Write(directoryCSVHeader)
+		for _, p := range bulk.Persons {
+			var teams, positions []string
+			if p.Teams != nil {
+				teams = *p.Teams
+			}
+			if p.Positions != nil {
+				positions = *p.Positions
+			}
+			for _, title := range slices.Concat(teams, positions) {
+				if strings.Contains(title, directoryCSVSeparator) {
+					return fmt.Errorf("the title %q can't go in a CSV, as it has a %q in it", title, directoryCSVSeparator)
+				}
+			}
+			var email string
+			if p.Email != nil {
+				email = *p.Email
+			}
+			formatBool := func(b *bool) string {
+				if b == nil {
+					return ""
+				}
+				return strconv.FormatBool(*b)
+			}
+			_ = writer.Write([]string{
+				p.Handle,
+				email,
+				formatBool(p.Active),
+				formatBool(p.Onsite),
+				strings.Join(teams, directoryCSVSeparator),
+				strings.Join(positions, directoryCSVSeparator),
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("[Flush]: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// directoryGroups are the teams or positions of the IMS-native directory.
+type directoryGroups struct {
+	byID    map[int64]*directoryGroup
+	byTitle map[string]*directoryGroup
+}
+
+type directoryGroup struct {
+	id     int64
+	title  string
+	active bool
+	// created is whether an import is to create the group, in which case its
+	// id is 0 until it has.
+	created bool
+	// fields are those that an import is to change.
+	fields []string
+}
+
+func newDirectoryGroups() directoryGroups {
+	return directoryGroups{byID: map[int64]*directoryGroup{}, byTitle: map[string]*directoryGroup{}}
+}
+
+func (g directoryGroups) add(group *directoryGroup) {
+	if group.id != 0 {
+		g.byID[group.id] = group
+	}
+	g.byTitle[strings.ToLower(group.title)] = group
+}
+
+// titles gives the sorted titles of the groups with the given IDs.
+func (g directoryGroups) titles(ids []int64) []string {
+	titles := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if group, ok := g.byID[id]; ok {
+			titles = append(titles, group.title)
+		}
+	}
+	slices.SortFunc(titles, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	return titles
+}
+
+func (g directoryGroups) bulkGroups() []imsjson.DirectoryBulkGroup {
+	groups := make([]imsjson.DirectoryBulkGroup, 0, len(g.byTitle))
+	for _, key := range slices.Sorted(maps.Keys(g.byTitle)) {
+		group := g.byTitle[key]
+		groups = append(groups, imsjson.DirectoryBulkGroup{Title: group.title, Active: new(group.active)})
+	}
+	return groups
+}
+
+// sameTitles is whether the groups with the given IDs are exactly those with
+// the given titles.
+func (g directoryGroups) sameTitles(ids []int64, titles []string) bool {
+	want := make(map[string]bool, len(titles))
+	for _, title := range titles {
+		want[strings.ToLower(title)] = true
+	}
+	have := make(map[string]bool, len(ids))
+	for _, title := range g.titles(ids) {
+		have[strings.ToLower(title)] = true
+	}
+	return maps.Equal(want, have)
+}
+
+// plan works out which groups an import creates and updates. Groups that a
+// person is put in, but that aren't listed, are created active.
+func (g directoryGroups) plan(listed []imsjson.DirectoryBulkGroup, memberships []*[]string) {
+	for _, l := range listed {
+		group, ok := g.byTitle[strings.ToLower(l.Title)]
+		if !ok {
+			g.add(&directoryGroup{title: l.Title, active: l.Active == nil || *l.Active, created: true})
+			continue
+		}
+		if group.created {
+			continue
+		}
+		if l.Title != group.title {
+			group.title = l.Title
+			group.fields = append(group.fields, "title")
+		}
+		if l.Active != nil && *l.Active != group.active {
+			group.active = *l.Active
+			group.fields = append(group.fields, "active")
+		}
+	}
+	for _, titles := range memberships {
+		if titles == nil {
+			continue
+		}
+		for _, title := range *titles {
+			if _, ok := g.byTitle[strings.ToLower(title)]; !ok {
+				g.add(&directoryGroup{title: title, active: true, created: true})
+			}
+		}
+	}
+}
+
+// changes lists the groups that an import creates and updates, in order of
+// title.
+func (g directoryGroups) changes(kind string) (creates, updates []imsjson.DirectoryImportChange) {
+	for _, key := range slices.Sorted(maps.Keys(g.byTitle)) {
+		group := g.byTitle[key]
+		if group.created {
+			creates = append(creates, imsjson.DirectoryImportChange{Kind: kind, Name: group.title})
+		} else if len(group.fields) > 0 {
+			updates = append(updates, imsjson.DirectoryImportChange{Kind: kind, Name: group.title, Fields: group.fields})
+		}
+	}
+	return creates, updates
+}
+
+// ids gives the IDs of the groups with the given titles, all of which must
+// exist by now.
+func (g directoryGroups) ids(titles []string) []int64 {
+	ids := make([]int64, 0, len(titles))
+	for _, title := range titles {
+		if id := g.byTitle[strings.ToLower(title)].id; !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// existingDirectory is the IMS-native directory as it was before an import.
+type existingDirectory struct {
+	persons     []imsdb.DirectoryAllPersonsRow
+	teams       directoryGroups
+	positions   directoryGroups
+	teamIDs     map[int64][]int64
+	positionIDs map[int64][]int64
+}
+
+func fetchDirectoryForImport(ctx context.Context, imsDBQ *store.DBQ) (existingDirectory, error) {
+	var errs []error
+	persons, err := imsDBQ.DirectoryAllPersons(ctx, imsDBQ)
+	errs = append(errs, err)
+	teams, err := imsDBQ.DirectoryAllTeams(ctx, imsDBQ)
+	errs = append(errs, err)
+	positions, err := imsDBQ.DirectoryAllPositions(ctx, imsDBQ)
+	errs = append(errs, err)
+	personTeams, err := imsDBQ.DirectoryPersonTeams(ctx, imsDBQ)
+	errs = append(errs, err)
+	personPositions, err := imsDBQ.DirectoryPersonPositions(ctx, imsDBQ)
+	errs = append(errs, err)
+	err = errors.Join(errs...)
+	if err != nil {
+		return existingDirectory{}, fmt.Errorf("[DirectoryAll*]: %w", err)
+	}
+
+	existing := existingDirectory{
+		persons:     persons,
+		teams:       newDirectoryGroups(),
+		positions:   newDirectoryGroups(),
+		teamIDs:     make(map[int64][]int64),
+		positionIDs: make(map[int64][]int64),
+	}
+	for _, t := range teams {
+		existing.teams.add(&directoryGroup{id: t.ID, title: t.Title, active: t.Active})
+	}
+	for _, p := range positions {
+		existing.positions.add(&directoryGroup{id: p.ID, title: p.Title, active: p.Active})
+	}
+	for _, pt := range personTeams {
+		existing.teamIDs[pt.PersonID] = append(existing.teamIDs[pt.PersonID], pt.TeamID)
+	}
+	for _, pp := range personPositions {
+		existing.positionIDs[pp.PersonID] = append(existing.positionIDs[pp.PersonID], pp.PositionID)
+	}
+	return existing, nil
+}
+
+// validateDirectoryBulk checks everything about an import that can be checked
+// without the directory it's going into.
+func validateDirectoryBulk(bulk imsjson.DirectoryBulk) error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %v", errInvalidDirectoryBulk, fmt.Sprintf(format, args...))
+	}
+	checkTitle := func(title string) error {
+		if title == "" {
+			return invalid("a team or position has an empty title")
+		}
+		if len(title) > maxDirectoryTitleLen {
+			return invalid("the title %q is too long", title)
+		}
+		return nil
+	}
+	handles := make(map[string]bool, len(bulk.Persons))
+	for _, p := range bulk.Persons {
+		if p.Handle == "" {
+			return invalid("a person has an empty handle")
+		}
+		if len(p.Handle) > maxDirectoryHandleLen {
+			return invalid("the handle %q is too long", p.Handle)
+		}
+		if handles[strings.ToLower(p.Handle)] {
+			return invalid("the handle %q is in the import more than once", p.Handle)
+		}
+		handles[strings.ToLower(p.Handle)] = true
+		if p.Email != nil && len(*p.Email) > maxDirectoryEmailLen {
+			return invalid("the email of %q is too long", p.Handle)
+		}
+		for _, titles := range []*[]string{p.Teams, p.Positions} {
+			if titles == nil {
+				continue
+			}
+			for _, title := range *titles {
+				if err := checkTitle(title); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, groups := range [][]imsjson.DirectoryBulkGroup{bulk.Teams, bulk.Positions} {
+		titles := make(map[string]bool, len(groups))
+		for _, g := range groups {
+			if err := checkTitle(g.Title); err != nil {
+				return err
+			}
+			if titles[strings.ToLower(g.Title)] {
+				return invalid("the title %q is listed more than once", g.Title)
+			}
+			titles[strings.ToLower(g.Title)] = true
+		}
+	}
+	return nil
+}
+
+// directoryImportPerson is a person as an import is to leave them.
+type directoryImportPerson struct {
+	id          int64
+	handle      string
+	email       sql.NullString
+	active      bool
+	onsite      bool
+	teams       *[]string
+	positions   *[]string
+	fields      []string
+	deactivated bool
+	// signOff is whether they're to go off duty, because they're deactivated
+	// or no longer hold the position they're on duty in.
+	signOff bool
+}
+
+// importDirectory does a bulk import. Everything is changed in one
+// transaction, so that a failed import changes nothing. Invitations are sent
+// once it's done.
+func importDirectory(
+	ctx context.Context,
+	imsDBQ *store.DBQ,
+	bulk imsjson.DirectoryBulk,
+	opts DirectoryImportOptions,
+	passwordHashParams *argon2id.Params,
+	mailer *passwordMailer,
+	userID func(personID int64) int64,
+) (imsjson.DirectoryImport, error) {
+	resp := imsjson.DirectoryImport{
+		DryRun:        opts.DryRun,
+		Creates:       []imsjson.DirectoryImportChange{},
+		Updates:       []imsjson.DirectoryImportChange{},
+		Deactivations: []imsjson.DirectoryImportChange{},
+		Invited:       []string{},
+		NotInvited:    []string{},
+	}
+	if opts.Invite && mailer == nil {
+		return resp, errDirectoryImportMail
+	}
+	if err := validateDirectoryBulk(bulk); err != nil {
+		return resp, err
+	}
+	existing, err := fetchDirectoryForImport(ctx, imsDBQ)
+	if err != nil {
+		return resp, fmt.Errorf("[fetchDirectoryForImport]: %w", err)
+	}
+
+	teamMemberships := make([]*[]string, 0, len(bulk.Persons))
+	positionMemberships := make([]*[]string, 0, len(bulk.Persons))
+	for _, p := range bulk.Persons {
+		teamMemberships = append(teamMemberships, p.Teams)
+		positionMemberships = append(positionMemberships, p.Positions)
+	}
+	existing.teams.plan(bulk.Teams, teamMemberships)
+	existing.positions.plan(bulk.Positions, positionMemberships)
+	for _, groups := range []struct {
+		groups directoryGroups
+		kind   string
+	}{
+		{existing.teams, directoryImportKindTeam},
+		{existing.positions, directoryImportKindPosition},
+	} {
+		creates, updates := groups.groups.changes(groups.kind)
+		resp.Creates = append(resp.Creates, creates...)
+		resp.Updates = append(resp.Updates, updates...)
+	}
+
+	existingByHandle := make(map[string]imsdb.DirectoryAllPersonsRow, len(existing.persons))
+	for _, p := range existing.persons {
+		existingByHandle[strings.ToLower(p.Handle)] = p
+	}
+	imported := make(map[string]bool, len(bulk.Persons))
+	var persons []*directoryImportPerson
+	for _, p := range bulk.Persons {
+		key := strings.ToLower(p.Handle)
+		imported[key] = true
+		person := &directoryImportPerson{
+			handle:    p.Handle,
+			teams:     p.Teams,
+			positions: p.Positions,
+		}
+		if p.Email != nil {
+			person.email = conv.StringToSql(conv.EmptyToNil(*p.Email), maxDirectoryEmailLen)
+		}
+		ex, ok := existingByHandle[key]
+		if !ok {
+			person.active = p.Active == nil || *p.Active
+			person.onsite = p.Onsite != nil && *p.Onsite
+			persons = append(persons, person)
+			resp.Creates = append(resp.Creates, imsjson.DirectoryImportChange{
+				Kind: directoryImportKindPerson, Name: p.Handle,
+			})
+			continue
+		}
+		person.id = ex.ID
+		if p.Handle != ex.Handle {
+			person.fields = append(person.fields, "handle")
+		}
+		if p.Email == nil {
+			person.email = ex.Email
+		} else if person.email != ex.Email {
+			person.fields = append(person.fields, "email")
+		}
+		person.active = ex.Active
+		if p.Active != nil && *p.Active != ex.Active {
+			person.active = *p.Active
+			person.deactivated = !person.active
+			person.fields = append(person.fields, "active")
+		}
+		person.onsite = ex.Onsite
+		if p.Onsite != nil && *p.Onsite != ex.Onsite {
+			person.onsite = *p.Onsite
+			person.fields = append(person.fields, "onsite")
+		}
+		if p.Teams != nil && !existing.teams.sameTitles(existing.teamIDs[ex.ID], *p.Teams) {
+			person.fields = append(person.fields, "teams")
+		}
+		if p.Positions != nil && !existing.positions.sameTitles(existing.positionIDs[ex.ID], *p.Positions) {
+			person.fields = append(person.fields, "positions")
+			if ex.OnDutyPositionID.Valid {
+				onDuty := existing.positions.byID[ex.OnDutyPositionID.Int64]
+				person.signOff = !slices.ContainsFunc(*p.Positions, func(title string) bool {
+					return onDuty != nil && strings.EqualFold(title, onDuty.title)
+				})
+			}
+		}
+		person.signOff = person.signOff || (person.deactivated && ex.OnDutyPositionID.Valid)
+		if len(person.fields) == 0 {
+			resp.Unchanged++
+			continue
+		}
+		persons = append(persons, person)
+		resp.Updates = append(resp.Updates, imsjson.DirectoryImportChange{
+			Kind: directoryImportKindPerson, Name: p.Handle, Fields: person.fields,
+		})
+	}
+	emails := make(map[string]string, len(existing.persons))
+	for _, ex := range existing.persons {
+		if imported[strings.ToLower(ex.Handle)] {
+			continue
+		}
+		if ex.Email.Valid {
+			emails[strings.ToLower(ex.Email.String)] = ex.Handle
+		}
+		if opts.DeactivateMissing && ex.Active {
+			persons = append(persons, &directoryImportPerson{
+				id:          ex.ID,
+				handle:      ex.Handle,
+				email:       ex.Email,
+				onsite:      ex.Onsite,
+				deactivated: true,
+				signOff:     ex.OnDutyPositionID.Valid,
+			})
+			resp.Deactivations = append(resp.Deactivations, imsjson.DirectoryImportChange{
+				Kind: directoryImportKindPerson, Name: ex.Handle,
+			})
+		}
+	}
+	// Emails are unique too, so check that the import leaves them that way,
+	// taking into account those it doesn't change.
+	for _, p := range bulk.Persons {
+		var email string
+		if p.Email != nil {
+			email = *p.Email
+		} else if ex, ok := existingByHandle[strings.ToLower(p.Handle)]; ok {
+			email = ex.Email.String
+		}
+		if email == "" {
+			continue
+		}
+		if other, ok := emails[strings.ToLower(email)]; ok {
+			return resp, fmt.Errorf("%w: %q and %q would have the same email", errInvalidDirectoryBulk, other, p.Handle)
+		}
+		emails[strings.ToLower(email)] = p.Handle
+	}
+
+	var invitees []*directoryImportPerson
+	for _, p := range persons {
+		if opts.Invite && p.id == 0 && p.active && p.email.Valid {
+			invitees = append(invitees, p)
+		}
+	}
+	if opts.DryRun {
+		for _, p := range invitees {
+			resp.Invited = append(resp.Invited, p.handle)
+		}
+		return resp, nil
+	}
+
+	err = applyDirectoryImport(ctx, imsDBQ, existing, persons, passwordHashParams, userID)
+	if err != nil {
+		return resp, fmt.Errorf("[applyDirectoryImport]: %w", err)
+	}
+	slog.Info("Imported directory",
+		"creates", len(resp.Creates),
+		"updates", len(resp.Updates),
+		"deactivations", len(resp.Deactivations),
+	)
+	for _, p := range invitees {
+		err = mailer.send(ctx, p.id, p.handle, p.email.String, imsdb.DirectoryPasswordTokenPurposeInvite)
+		if err != nil {
+			slog.Error("Failed to send invitation", "handle", p.handle, "error", err)
+			resp.NotInvited = append(resp.NotInvited, p.handle)
+			continue
+		}
+		resp.Invited = append(resp.Invited, p.handle)
+	}
+	return resp, nil
+}
+
+// applyDirectoryImport makes the changes that importDirectory planned, setting
+// the IDs of the persons and groups that it creates.
+func applyDirectoryImport(
+	ctx context.Context,
+	imsDBQ *store.DBQ,
+	existing existingDirectory,
+	persons []*directoryImportPerson,
+	passwordHashParams *argon2id.Params,
+	userID func(personID int64) int64,
+) error {
+	now := time.Now()
+	txn, err := imsDBQ.Begin()
+	if err != nil {
+		return fmt.Errorf("[Begin]: %w", err)
+	}
+	defer rollback(txn)
+
+	for _, key := range slices.Sorted(maps.Keys(existing.teams.byTitle)) {
+		team := existing.teams.byTitle[key]
+		switch {
+		case team.created:
+			team.id, err = imsDBQ.DirectoryCreateTeam(ctx, txn, imsdb.DirectoryCreateTeamParams{
+				Title:  team.title,
+				Active: team.active,
+			})
+			if err != nil {
+				return fmt.Errorf("[DirectoryCreateTeam]: %w", err)
+			}
+		case len(team.fields) > 0:
+			err = imsDBQ.DirectoryUpdateTeam(ctx, txn, imsdb.DirectoryUpdateTeamParams{
+				Title:  team.title,
+				Active: team.active,
+				ID:     team.id,
+			})
+			if err != nil {
+				return fmt.Errorf("[DirectoryUpdateTeam]: %w", err)
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(existing.positions.byTitle)) {
+		position := existing.positions.byTitle[key]
+		switch {
+		case position.created:
+			position.id, err = imsDBQ.DirectoryCreatePosition(ctx, txn, imsdb.DirectoryCreatePositionParams{
+				Title:  position.title,
+				Active: position.active,
+			})
+			if err != nil {
+				return fmt.Errorf("[DirectoryCreatePosition]: %w", err)
+			}
+		case len(position.fields) > 0:
+			// Nobody stays on duty in a deactivated position.
+			if !position.active {
+				positionID := sql.NullInt64{Int64: position.id, Valid: true}
+				err = imsDBQ.DirectoryEndPositionShifts(ctx, txn, imsdb.DirectoryEndPositionShiftsParams{
+					OffDuty:    conv.TimeToNullFloat(now),
+					PositionID: positionID,
+				})
+				if err != nil {
+					return fmt.Errorf("[DirectoryEndPositionShifts]: %w", err)
+				}
+				err = imsDBQ.DirectorySignOffPosition(ctx, txn, positionID)
+				if err != nil {
+					return fmt.Errorf("[DirectorySignOffPosition]: %w", err)
+				}
+			}
+			err = imsDBQ.DirectoryUpdatePosition(ctx, txn, imsdb.DirectoryUpdatePositionParams{
+				Title:  position.title,
+				Active: position.active,
+				ID:     position.id,
+			})
+			if err != nil {
+				return fmt.Errorf("[DirectoryUpdatePosition]: %w", err)
+			}
+		}
+	}
+
+	for _, p := range persons {
+		if p.id == 0 {
+			// As with EditDirectoryPerson, new persons can't log in until
+			// they have a real password.
+			p.id, err = imsDBQ.DirectoryCreatePerson(ctx, txn, imsdb.DirectoryCreatePersonParams{
+				Handle:   p.handle,
+				Email:    p.email,
+				Password: argon2id.CreateHash(rand.Text(), passwordHashParams),
+				Active:   p.active,
+				Onsite:   p.onsite,
+			})
+			if err != nil {
+				return fmt.Errorf("[DirectoryCreatePerson] %v: %w", p.handle, err)
+			}
+		} else {
+			err = imsDBQ.DirectoryUpdatePerson(ctx, txn, imsdb.DirectoryUpdatePersonParams{
+				Handle: p.handle,
+				Email:  p.email,
+				Active: p.active,
+				Onsite: p.onsite,
+				ID:     p.id,
+			})
+			if err != nil {
+				return fmt.Errorf("[DirectoryUpdatePerson] %v: %w", p.handle, err)
+			}
+		}
+		if p.teams != nil {
+			err = imsDBQ.DirectoryClearPersonTeams(ctx, txn, p.id)
+			if err != nil {
+				return fmt.Errorf("[DirectoryClearPersonTeams]: %w", err)
+			}
+			for _, teamID := range existing.teams.ids(*p.teams) {
+				err = imsDBQ.DirectoryAddPersonTeam(ctx, txn, imsdb.DirectoryAddPersonTeamParams{
+					PersonID: p.id,
+					TeamID:   teamID,
+				})
+				if err != nil {
+					return fmt.Errorf("[DirectoryAddPersonTeam]: %w", err)
+				}
+			}
+		}
+		if p.positions != nil {
+			err = imsDBQ.DirectoryClearPersonPositions(ctx, txn, p.id)
+			if err != nil {
+				return fmt.Errorf("[DirectoryClearPersonPositions]: %w", err)
+			}
+			for _, positionID := range existing.positions.ids(*p.positions) {
+				err = imsDBQ.DirectoryAddPersonPosition(ctx, txn, imsdb.DirectoryAddPersonPositionParams{
+					PersonID:   p.id,
+					PositionID: positionID,
+				})
+				if err != nil {
+					return fmt.Errorf("[DirectoryAddPersonPosition]: %w", err)
+				}
+			}
+		}
+		if p.signOff {
+			err = imsDBQ.DirectoryEndPersonShifts(ctx, txn, imsdb.DirectoryEndPersonShiftsParams{
+				OffDuty:  conv.TimeToNullFloat(now),
+				PersonID: p.id,
+			})
+			if err != nil {
+				return fmt.Errorf("[DirectoryEndPersonShifts]: %w", err)
+			}
+			err = imsDBQ.DirectorySetPersonOnDuty(ctx, txn, imsdb.DirectorySetPersonOnDutyParams{ID: p.id})
+			if err != nil {
+				return fmt.Errorf("[DirectorySetPersonOnDuty]: %w", err)
+			}
+		}
+		// A deactivated person is logged out everywhere.
+		if p.deactivated {
+			err = imsDBQ.RevokeUserSessions(ctx, txn, imsdb.RevokeUserSessionsParams{
+				Revoked: conv.TimeToNullFloat(now),
+				UserID:  userID(p.id),
+			})
+			if err != nil {
+				return fmt.Errorf("[RevokeUserSessions]: %w", err)
+			}
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		return fmt.Errorf("[Commit]: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"strings"
+	"testing"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDirectoryCSV(t *testing.T) {
+	t.Parallel()
+	bulk, err := ReadDirectoryBulk(strings.NewReader(
+		"Handle, Email, Active, Teams, Positions\n"+
+			"Alpha, alpha@example.com, true, Council; Tech Team ,Dirt\n"+
+			"Bravo,,,,\n",
+	), DirectoryFormatCSV)
+	require.NoError(t, err)
+	require.Len(t, bulk.Persons, 2)
+	assert.Equal(t, imsjson.DirectoryBulkPerson{
+		Handle:    "Alpha",
+		Email:     new("alpha@example.com"),
+		Active:    new(true),
+		Teams:     &[]string{"Council", "Tech Team"},
+		Positions: &[]string{"Dirt"},
+	}, bulk.Persons[0])
+	// Empty cells clear the email, teams, and positions, but leave active
+	// alone, and the onsite column isn't there at all.
+	assert.Equal(t, imsjson.DirectoryBulkPerson{
+		Handle:    "Bravo",
+		Email:     new(""),
+		Teams:     &[]string{},
+		Positions: &[]string{},
+	}, bulk.Persons[1])
+
+	for _, bad := range []string{
+		"",
+		"email\nalpha@example.com\n",
+		"handle,rank\nAlpha,1\n",
+		"handle,handle\nAlpha,Alpha\n",
+		"handle,active\nAlpha,sometimes\n",
+		"handle,email\nAlpha\n",
+	} {
+		_, err = ReadDirectoryBulk(strings.NewReader(bad), DirectoryFormatCSV)
+		require.ErrorIs(t, err, errInvalidDirectoryBulk, bad)
+	}
+	_, err = ReadDirectoryBulk(strings.NewReader("{}"), "xml")
+	require.ErrorIs(t, err, errInvalidDirectoryBulk)
+}
+
+func TestWriteDirectoryBulkRoundTrip(t *testing.T) {
+	t.Parallel()
+	bulk := imsjson.DirectoryBulk{
+		Persons: []imsjson.DirectoryBulkPerson{
+			{
+				Handle:    "Alpha",
+				Email:     new("alpha@example.com"),
+				Active:    new(true),
+				Onsite:    new(false),
+				Teams:     &[]string{"Council", "Tech, Team"},
+				Positions: &[]string{"Dirt"},
+			},
+			{
+				Handle:    "Bravo \"B\"",
+				Email:     new(""),
+				Active:    new(false),
+				Onsite:    new(true),
+				Teams:     &[]string{},
+				Positions: &[]string{},
+			},
+		},
+		Teams:     []imsjson.DirectoryBulkGroup{{Title: "Council", Active: new(false)}},
+		Positions: []imsjson.DirectoryBulkGroup{},
+	}
+	for _, format := range []string{DirectoryFormatCSV, DirectoryFormatJSON} {
+		var sb strings.Builder
+		require.NoError(t, WriteDirectoryBulk(&sb, format, bulk))
+		read, err := ReadDirectoryBulk(strings.NewReader(sb.String()), format)
+		require.NoError(t, err)
+		assert.Equal(t, bulk.Persons, read.Persons, format)
+		if format == DirectoryFormatJSON {
+			assert.Equal(t, bulk, read)
+		}
+	}
+
+	// A title with the separator in it can only be written as JSON.
+	bulk.Persons[0].Teams = &[]string{"Council; Inner"}
+	require.Error(t, WriteDirectoryBulk(&strings.Builder{}, DirectoryFormatCSV, bulk))
+	require.NoError(t, WriteDirectoryBulk(&strings.Builder{}, DirectoryFormatJSON, bulk))
+}
+
+func TestValidateDirectoryBulk(t *testing.T) {
+	t.Parallel()
+	valid := imsjson.DirectoryBulk{
+		Persons: []imsjson.DirectoryBulkPerson{
+			{Handle: "Alpha", Teams: &[]string{"Council"}},
+			{Handle: "Bravo", Positions: &[]string{"Dirt"}},
+		},
+		Teams: []imsjson.DirectoryBulkGroup{{Title: "Council"}},
+	}
+	require.NoError(t, validateDirectoryBulk(valid))
+
+	for name, bulk := range map[string]imsjson.DirectoryBulk{
+		"empty handle": {Persons: []imsjson.DirectoryBulkPerson{{Handle: ""}}},
+		"long handle":  {Persons: []imsjson.DirectoryBulkPerson{{Handle: strings.Repeat("a", maxDirectoryHandleLen+1)}}},
+		"long email":   {Persons: []imsjson.DirectoryBulkPerson{{Handle: "A", Email: new(strings.Repeat("a", maxDirectoryEmailLen+1))}}},
+		"repeated handle": {Persons: []imsjson.DirectoryBulkPerson{
+			{Handle: "Alpha"}, {Handle: "ALPHA"},
+		}},
+		"empty title":    {Persons: []imsjson.DirectoryBulkPerson{{Handle: "A", Positions: &[]string{""}}}},
+		"long title":     {Teams: []imsjson.DirectoryBulkGroup{{Title: strings.Repeat("a", maxDirectoryTitleLen+1)}}},
+		"repeated title": {Positions: []imsjson.DirectoryBulkGroup{{Title: "Dirt"}, {Title: "dirt"}}},
+	} {
+		require.ErrorIs(t, validateDirectoryBulk(bulk), errInvalidDirectoryBulk, name)
+	}
+}
@@ -0,0 +1,317 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+// SignOnDirectoryPerson puts a person in the IMS-native directory on duty in
+// one of their positions, as Clubhouse does when a Ranger signs in to a shift.
+// A person who's already on duty in another position is signed out of it
+// first. Signing someone in to the position they're already on duty in does
+// nothing.
+type SignOnDirectoryPerson struct {
+	imsDBQ         *store.DBQ
+	userStore      *directory.UserStore
+	imsAdmins      []string
+	directoryIsIMS bool
+}
+
+func (action SignOnDirectoryPerson) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.signOnDirectoryPerson(req)
+	if errHTTP != nil {
+		errHTTP.From("[signOnDirectoryPerson]").WriteResponse(w)
+		return
+	}
+	action.userStore.Flush()
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action SignOnDirectoryPerson) signOnDirectoryPerson(req *http.Request) *herr.HTTPError {
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return errHTTP.From("[requireDirectoryAdmin]")
+	}
+	ctx := req.Context()
+	personID, err := conv.ParseInt64(req.PathValue("personId"))
+	if err != nil {
+		return herr.BadRequest("Invalid person ID", err).From("[ParseInt64]")
+	}
+	onDutyReq, errHTTP := readBodyAs[imsjson.DirectoryOnDuty](req)
+	if errHTTP != nil {
+		return errHTTP.From("[readBodyAs]")
+	}
+	positionID := onDutyReq.PositionID
+
+	person, err := action.imsDBQ.DirectoryPersonByID(ctx, action.imsDBQ, personID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return herr.NotFound("Person not found", err)
+		}
+		return herr.InternalServerError("Failed to fetch person", err).From("[DirectoryPersonByID]")
+	}
+	if !person.Active {
+		return herr.BadRequest("A deactivated person can't go on duty", nil)
+	}
+	title, active, errHTTP := findDirectoryGroup(req, action.imsDBQ, true, positionID)
+	if errHTTP != nil {
+		return errHTTP.From("[findDirectoryGroup]")
+	}
+	if !active {
+		return herr.BadRequest("Nobody can go on duty in an inactive position", nil)
+	}
+	personPositions, err := action.imsDBQ.DirectoryPersonPositions(ctx, action.imsDBQ)
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch positions", err).From("[DirectoryPersonPositions]")
+	}
+	holdsPosition := slices.ContainsFunc(personPositions, func(pp imsdb.DirectoryPersonPosition) bool {
+		return pp.PersonID == personID && pp.PositionID == positionID
+	})
+	if !holdsPosition {
+		return herr.BadRequest("The person doesn't hold that position", nil)
+	}
+
+	now := time.Now()
+	txn, err := action.imsDBQ.Begin()
+	if err != nil {
+		return herr.InternalServerError("Failed to begin transaction", err).From("[Begin]")
+	}
+	defer rollback(txn)
+	// This locks the person's row, so that concurrent sign-ins don't leave
+	// them with two shifts going.
+	onDuty, err := action.imsDBQ.DirectoryPersonOnDuty(ctx, txn, personID)
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch on-duty position", err).From("[DirectoryPersonOnDuty]")
+	}
+	if onDuty.OnDutyPositionID.Valid && onDuty.OnDutyPositionID.Int64 == positionID {
+		return nil
+	}
+	err = action.imsDBQ.DirectoryEndPersonShifts(ctx, txn, imsdb.DirectoryEndPersonShiftsParams{
+		OffDuty:  conv.TimeToNullFloat(now),
+		PersonID: personID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to end shift", err).From("[DirectoryEndPersonShifts]")
+	}
+	err = action.imsDBQ.DirectoryStartShift(ctx, txn, imsdb.DirectoryStartShiftParams{
+		PersonID:      personID,
+		PositionID:    sql.NullInt64{Int64: positionID, Valid: true},
+		PositionTitle: title,
+		OnDuty:        conv.TimeToFloat(now),
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to start shift", err).From("[DirectoryStartShift]")
+	}
+	err = action.imsDBQ.DirectorySetPersonOnDuty(ctx, txn, imsdb.DirectorySetPersonOnDutyParams{
+		OnDutyPositionID: sql.NullInt64{Int64: positionID, Valid: true},
+		OnDutySince:      conv.TimeToNullFloat(now),
+		ID:               personID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to set on-duty position", err).From("[DirectorySetPersonOnDuty]")
+	}
+	if err = txn.Commit(); err != nil {
+		return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	slog.Info("Signed in to position", "handle", person.Handle, "position", title)
+	return nil
+}
+
+// SignOffDirectoryPerson takes a person in the IMS-native directory off duty.
+// Signing off someone who isn't on duty does nothing.
+type SignOffDirectoryPerson struct {
+	imsDBQ         *store.DBQ
+	userStore      *directory.UserStore
+	imsAdmins      []string
+	directoryIsIMS bool
+}
+
+func (action SignOffDirectoryPerson) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.signOffDirectoryPerson(req)
+	if errHTTP != nil {
+		errHTTP.From("[signOffDirectoryPerson]").WriteResponse(w)
+		return
+	}
+	action.userStore.Flush()
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action SignOffDirectoryPerson) signOffDirectoryPerson(req *http.Request) *herr.HTTPError {
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return errHTTP.From("[requireDirectoryAdmin]")
+	}
+	personID, err := conv.ParseInt64(req.PathValue("personId"))
+	if err != nil {
+		return herr.BadRequest("Invalid person ID", err).From("[ParseInt64]")
+	}
+	errHTTP = signOffPerson(req.Context(), action.imsDBQ, personID, time.Now())
+	if errHTTP != nil {
+		return errHTTP.From("[signOffPerson]")
+	}
+	return nil
+}
+
+// signOffPerson ends a person's shift, if they're on one.
+func signOffPerson(ctx context.Context, imsDBQ *store.DBQ, personID int64, now time.Time) *herr.HTTPError {
+	txn, err := imsDBQ.Begin()
+	if err != nil {
+		return herr.InternalServerError("Failed to begin transaction", err).From("[Begin]")
+	}
+	defer rollback(txn)
+	_, err = imsDBQ.DirectoryPersonOnDuty(ctx, txn, personID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return herr.NotFound("Person not found", err)
+		}
+		return herr.InternalServerError("Failed to fetch on-duty position", err).From("[DirectoryPersonOnDuty]")
+	}
+	err = imsDBQ.DirectoryEndPersonShifts(ctx, txn, imsdb.DirectoryEndPersonShiftsParams{
+		OffDuty:  conv.TimeToNullFloat(now),
+		PersonID: personID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to end shift", err).From("[DirectoryEndPersonShifts]")
+	}
+	err = imsDBQ.DirectorySetPersonOnDuty(ctx, txn, imsdb.DirectorySetPersonOnDutyParams{ID: personID})
+	if err != nil {
+		return herr.InternalServerError("Failed to clear on-duty position", err).From("[DirectorySetPersonOnDuty]")
+	}
+	if err = txn.Commit(); err != nil {
+		return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	return nil
+}
+
+// signOffPosition ends the shifts of everyone on duty in a position, such as
+// when it's deactivated or about to be deleted.
+func signOffPosition(ctx context.Context, imsDBQ *store.DBQ, positionID int64, now time.Time) *herr.HTTPError {
+	txn, err := imsDBQ.Begin()
+	if err != nil {
+		return herr.InternalServerError("Failed to begin transaction", err).From("[Begin]")
+	}
+	defer rollback(txn)
+	err = imsDBQ.DirectoryEndPositionShifts(ctx, txn, imsdb.DirectoryEndPositionShiftsParams{
+		OffDuty:    conv.TimeToNullFloat(now),
+		PositionID: sql.NullInt64{Int64: positionID, Valid: true},
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to end shifts", err).From("[DirectoryEndPositionShifts]")
+	}
+	err = imsDBQ.DirectorySignOffPosition(ctx, txn, sql.NullInt64{Int64: positionID, Valid: true})
+	if err != nil {
+		return herr.InternalServerError("Failed to clear on-duty positions", err).From("[DirectorySignOffPosition]")
+	}
+	if err = txn.Commit(); err != nil {
+		return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	return nil
+}
+
+// GetDirectoryShifts is the history of people in the IMS-native directory
+// going on and off duty, for reporting. It has the shifts that overlap the
+// time range given by minTimeUnixMs and maxTimeUnixMs, which are both
+// optional, and can be narrowed to one person by personId.
+type GetDirectoryShifts struct {
+	imsDBQ         *store.DBQ
+	userStore      *directory.UserStore
+	imsAdmins      []string
+	directoryIsIMS bool
+}
+
+func (action GetDirectoryShifts) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getDirectoryShifts(req)
+	if errHTTP != nil {
+		errHTTP.From("[getDirectoryShifts]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetDirectoryShifts) getDirectoryShifts(req *http.Request) (imsjson.DirectoryShifts, *herr.HTTPError) {
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[requireDirectoryAdmin]")
+	}
+
+	// long ago
+	minTime := 1e0
+	// long from now
+	maxTime := 1e100
+
+	if req.FormValue("minTimeUnixMs") != "" {
+		minTimeUnixMs, err := conv.ParseInt64(req.FormValue("minTimeUnixMs"))
+		if err != nil {
+			return nil, herr.BadRequest("minTimeUnixMs", err).From("[ParseInt64]")
+		}
+		minTime = float64(minTimeUnixMs) / 1e3
+	}
+	if req.FormValue("maxTimeUnixMs") != "" {
+		maxTimeUnixMs, err := conv.ParseInt64(req.FormValue("maxTimeUnixMs"))
+		if err != nil {
+			return nil, herr.BadRequest("maxTimeUnixMs", err).From("[ParseInt64]")
+		}
+		maxTime = float64(maxTimeUnixMs) / 1e3
+	}
+	var personID sql.NullInt64
+	if req.FormValue("personId") != "" {
+		id, err := conv.ParseInt64(req.FormValue("personId"))
+		if err != nil {
+			return nil, herr.BadRequest("personId", err).From("[ParseInt64]")
+		}
+		personID = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	rows, err := action.imsDBQ.DirectoryShifts(req.Context(), action.imsDBQ, imsdb.DirectoryShiftsParams{
+		MaxTime:  maxTime,
+		MinTime:  sql.NullFloat64{Float64: minTime, Valid: true},
+		PersonID: personID,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch shifts", err).From("[DirectoryShifts]")
+	}
+	resp := make(imsjson.DirectoryShifts, 0, len(rows))
+	for _, row := range rows {
+		shift := imsjson.DirectoryShift{
+			ID:            row.ID,
+			PersonID:      row.PersonID,
+			Handle:        row.Handle,
+			PositionTitle: row.PositionTitle,
+			OnDuty:        conv.FloatToTime(row.OnDuty),
+			OffDuty:       conv.NullFloatToTime(row.OffDuty),
+		}
+		if row.PositionID.Valid {
+			shift.PositionID = &row.PositionID.Int64
+		}
+		resp = append(resp, shift)
+	}
+	return resp, nil
+}
@@ -341,6 +341,10 @@ func (action DeleteEvent) deleteEvent(req *http.Request) *herr.HTTPError {
 	if err != nil {
 		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventIncidentRangers]")
 	}
+	err = action.imsDBQ.DeleteEventIncidentStateChanges(ctx, txn, event.ID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventIncidentStateChanges]")
+	}
 	err = action.imsDBQ.DeleteEventIncidentIncidentTypes(ctx, txn, event.ID)
 	if err != nil {
 		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventIncidentIncidentTypes]")
@@ -349,6 +353,10 @@ func (action DeleteEvent) deleteEvent(req *http.Request) *herr.HTTPError {
 	if err != nil {
 		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventLinkedIncidents]")
 	}
+	err = action.imsDBQ.DeleteEventBreakGlass(ctx, txn, event.ID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventBreakGlass]")
+	}
 	err = action.imsDBQ.DeleteEventVisitRangers(ctx, txn, event.ID)
 	if err != nil {
 		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventVisitRangers]")
@@ -369,10 +377,30 @@ func (action DeleteEvent) deleteEvent(req *http.Request) *herr.HTTPError {
 	if err != nil {
 		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventAccessAll]")
 	}
+	err = action.imsDBQ.DeleteEventAccessHistory(ctx, txn, event.ID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventAccessHistory]")
+	}
 	err = action.imsDBQ.DeleteEventPlaces(ctx, txn, event.ID)
 	if err != nil {
 		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventPlaces]")
 	}
+	err = action.imsDBQ.DeleteEventWebhookDeliveries(ctx, txn, event.ID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventWebhookDeliveries]")
+	}
+	err = action.imsDBQ.DeleteEventWebhookTriggers(ctx, txn, event.ID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventWebhookTriggers]")
+	}
+	err = action.imsDBQ.DeleteEventWebhooks(ctx, txn, event.ID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventWebhooks]")
+	}
+	err = action.imsDBQ.DeleteEventAPITokenEvents(ctx, txn, event.ID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete event", err).From("[DeleteEventAPITokenEvents]")
+	}
 	err = action.imsDBQ.DetachChildrenFromEventGroup(ctx, txn, sql.NullInt32{Int32: event.ID, Valid: true})
 	if err != nil {
 		return herr.InternalServerError("Failed to delete event", err).From("[DetachChildrenFromEventGroup]")
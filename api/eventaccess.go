@@ -18,6 +18,8 @@ package api
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"net/http"
 	"slices"
 	"strings"
@@ -109,10 +111,11 @@ func (action GetEventAccesses) getEventsAccess(ctx context.Context) (imsjson.Eve
 
 	for _, e := range storedEvents {
 		ea := imsjson.EventAccess{
-			Readers:      []imsjson.AccessRule{},
-			Writers:      []imsjson.AccessRule{},
-			Reporters:    []imsjson.AccessRule{},
-			VisitWriters: []imsjson.AccessRule{},
+			Readers:             []imsjson.AccessRule{},
+			Writers:             []imsjson.AccessRule{},
+			Reporters:           []imsjson.AccessRule{},
+			VisitWriters:        []imsjson.AccessRule{},
+			ConfidentialReaders: []imsjson.AccessRule{},
 		}
 		for _, accessRow := range accessRowByEventID[e.ID] {
 			access := accessRow
@@ -161,6 +164,8 @@ func (action GetEventAccesses) getEventsAccess(ctx context.Context) (imsjson.Eve
 				ea.Reporters = append(ea.Reporters, rule)
 			case imsdb.EventAccessModeWriteVisits:
 				ea.VisitWriters = append(ea.VisitWriters, rule)
+			case imsdb.EventAccessModeReadConfidential:
+				ea.ConfidentialReaders = append(ea.ConfidentialReaders, rule)
 			}
 		}
 		result[e.Name] = ea
@@ -226,24 +231,25 @@ func (action GetAccessTargets) getAccessTargets(req *http.Request) (imsjson.Acce
 	return resp, nil
 }
 
-// knownTarget says whether the target of this access expression matches a known user, position, or team.
+// knownTarget says whether every target in this access expression matches a known user, position, or team.
 func knownTarget(expression string, allHandles, allPositions, allTeams map[string]bool) bool {
-	if expression == "*" {
-		return true
-	}
-	if after, ok := strings.CutPrefix(expression, "person:"); ok {
-		return allHandles[after]
-	}
-	if after, ok := strings.CutPrefix(expression, "position:"); ok {
-		return allPositions[after]
-	}
-	if after, ok := strings.CutPrefix(expression, "onduty:"); ok {
-		return allPositions[after]
-	}
-	if after, ok := strings.CutPrefix(expression, "team:"); ok {
-		return allTeams[after]
+	for _, atom := range authz.CompileAccessExpression(expression).Atoms() {
+		known := false
+		switch atom.Kind {
+		case authz.AccessKindAll:
+			known = true
+		case authz.AccessKindPerson:
+			known = allHandles[atom.Value]
+		case authz.AccessKindPosition, authz.AccessKindOnDuty:
+			known = allPositions[atom.Value]
+		case authz.AccessKindTeam:
+			known = allTeams[atom.Value]
+		}
+		if !known {
+			return false
+		}
 	}
-	return false
+	return true
 }
 
 type PostEventAccess struct {
@@ -264,7 +270,7 @@ func (action PostEventAccess) ServeHTTP(w http.ResponseWriter, req *http.Request
 }
 
 func (action PostEventAccess) postEventAccess(req *http.Request) *herr.HTTPError {
-	_, globalPermissions, errHTTP := getGlobalPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	jwtCtx, globalPermissions, errHTTP := getGlobalPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
 	if errHTTP != nil {
 		return errHTTP.From("[getGlobalPermissions]")
 	}
@@ -276,33 +282,80 @@ func (action PostEventAccess) postEventAccess(req *http.Request) *herr.HTTPError
 	if errHTTP != nil {
 		return errHTTP.From("[readBodyAs]")
 	}
+	errHTTP = action.validateExpressions(ctx, eventsAccess)
+	if errHTTP != nil {
+		return errHTTP.From("[validateExpressions]")
+	}
+	author := jwtCtx.Claims.RangerHandle()
 	for eventName, access := range eventsAccess {
 		event, errHTTP := getEvent(req, eventName, action.imsDBQ)
 		if errHTTP != nil {
 			return errHTTP.From("[readBodyAs]")
 		}
-		errHTTP = action.maybeSetAccess(ctx, event, access.Readers, imsdb.EventAccessModeRead)
+		errHTTP = action.maybeSetAccess(ctx, event, access.Readers, imsdb.EventAccessModeRead, author)
 		if errHTTP != nil {
 			return errHTTP.From("[maybeSetAccess] EventAccessModeRead")
 		}
-		errHTTP = action.maybeSetAccess(ctx, event, access.Writers, imsdb.EventAccessModeWrite)
+		errHTTP = action.maybeSetAccess(ctx, event, access.Writers, imsdb.EventAccessModeWrite, author)
 		if errHTTP != nil {
 			return errHTTP.From("[maybeSetAccess] EventAccessModeWrite")
 		}
-		errHTTP = action.maybeSetAccess(ctx, event, access.Reporters, imsdb.EventAccessModeReport)
+		errHTTP = action.maybeSetAccess(ctx, event, access.Reporters, imsdb.EventAccessModeReport, author)
 		if errHTTP != nil {
 			return errHTTP.From("[maybeSetAccess] EventAccessModeReport")
 		}
-		errHTTP = action.maybeSetAccess(ctx, event, access.VisitWriters, imsdb.EventAccessModeWriteVisits)
+		errHTTP = action.maybeSetAccess(ctx, event, access.VisitWriters, imsdb.EventAccessModeWriteVisits, author)
 		if errHTTP != nil {
 			return errHTTP.From("[maybeSetAccess] EventAccessModeReport")
 		}
+		errHTTP = action.maybeSetAccess(ctx, event, access.ConfidentialReaders, imsdb.EventAccessModeReadConfidential, author)
+		if errHTTP != nil {
+			return errHTTP.From("[maybeSetAccess] EventAccessModeReadConfidential")
+		}
+	}
+	return nil
+}
+
+// validateExpressions checks every rule's expression before any access is
+// changed. An expression that's already stored is let through as is, since
+// some from before there were operators, such as "team:Fire AND Ice", don't
+// parse now, and an admin must still be able to save the rules around them.
+func (action PostEventAccess) validateExpressions(ctx context.Context, eventsAccess imsjson.EventsAccess) *herr.HTTPError {
+	var stored map[string]bool
+	for eventName, access := range eventsAccess {
+		for _, rules := range [][]imsjson.AccessRule{
+			access.Readers, access.Writers, access.Reporters, access.VisitWriters, access.ConfidentialReaders,
+		} {
+			for _, rule := range rules {
+				_, parseErr := authz.ParseAccessExpression(rule.Expression)
+				if parseErr == nil {
+					continue
+				}
+				if stored == nil {
+					accessRows, err := action.imsDBQ.EventAccessAll(ctx, action.imsDBQ)
+					if err != nil {
+						return herr.InternalServerError("Failed to fetch EventAccess", err).From("[EventAccessAll]")
+					}
+					stored = make(map[string]bool, len(accessRows))
+					for _, row := range accessRows {
+						stored[row.EventAccess.Expression] = true
+					}
+				}
+				if stored[rule.Expression] {
+					continue
+				}
+				return herr.BadRequest(
+					fmt.Sprintf("Invalid access expression %q for event %v: %v", rule.Expression, eventName, parseErr),
+					parseErr,
+				).From("[ParseAccessExpression]")
+			}
+		}
 	}
 	return nil
 }
 
 // maybeSetAccess replaces the event's rules for one access mode with the given
-// set, leaving the event's other three modes untouched. A nil rules slice means
+// set, leaving the event's other modes untouched. A nil rules slice means
 // the caller didn't mention this mode at all, so it's left alone; an empty
 // (non-nil) slice clears the mode.
 //
@@ -314,7 +367,7 @@ func (action PostEventAccess) postEventAccess(req *http.Request) *herr.HTTPError
 // a caller that wants to move a target between modes has to post both the old
 // mode (without it) and the new mode (with it).
 func (action PostEventAccess) maybeSetAccess(
-	ctx context.Context, event imsdb.Event, rules []imsjson.AccessRule, mode imsdb.EventAccessMode,
+	ctx context.Context, event imsdb.Event, rules []imsjson.AccessRule, mode imsdb.EventAccessMode, author string,
 ) *herr.HTTPError {
 	if rules == nil {
 		return nil
@@ -341,9 +394,41 @@ func (action PostEventAccess) maybeSetAccess(
 		return herr.InternalServerError("Failed to begin transaction", err).From("[BeginTx]")
 	}
 	defer rollback(txn)
-	err = action.imsDBQ.ClearEventAccessForMode(ctx, txn,
+	errHTTP := setAccessForMode(ctx, action.imsDBQ, txn, event.ID, rules, mode, author)
+	if errHTTP != nil {
+		return errHTTP.From("[setAccessForMode]")
+	}
+	err = txn.Commit()
+	if err != nil {
+		return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	return nil
+}
+
+// setAccessForMode is the replacement done by maybeSetAccess, but within the
+// caller's transaction, so that several modes can be replaced all or nothing.
+// The caller must be holding eventAccessWriteMu.
+func setAccessForMode(
+	ctx context.Context, imsDBQ *store.DBQ, txn *sql.Tx, eventID int32,
+	rules []imsjson.AccessRule, mode imsdb.EventAccessMode, author string,
+) *herr.HTTPError {
+	beforeRows, err := imsDBQ.EventAccessForMode(ctx, txn,
+		imsdb.EventAccessForModeParams{
+			Event: eventID,
+			Mode:  mode,
+		},
+	)
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch event access", err).From("[EventAccessForMode]")
+	}
+	before := make([]storedAccessRule, 0, len(beforeRows))
+	for _, row := range beforeRows {
+		before = append(before, storedAccessRuleFromRow(row.EventAccess))
+	}
+	after := make([]storedAccessRule, 0, len(rules))
+	err = imsDBQ.ClearEventAccessForMode(ctx, txn,
 		imsdb.ClearEventAccessForModeParams{
-			Event: event.ID,
+			Event: eventID,
 			Mode:  mode,
 		},
 	)
@@ -354,9 +439,9 @@ func (action PostEventAccess) maybeSetAccess(
 		notAfter := conv.TimeToNullFloat(rule.NotAfter)
 		notBefore := conv.TimeToNullFloat(rule.NotBefore)
 
-		_, err = action.imsDBQ.AddEventAccess(ctx, txn,
+		_, err = imsDBQ.AddEventAccess(ctx, txn,
 			imsdb.AddEventAccessParams{
-				Event:       event.ID,
+				Event:       eventID,
 				Expression:  rule.Expression,
 				Mode:        mode,
 				Validity:    imsdb.EventAccessValidity(rule.Validity),
@@ -368,10 +453,17 @@ func (action PostEventAccess) maybeSetAccess(
 		if err != nil {
 			return herr.InternalServerError("Failed to add event access", err).From("[AddEventAccess]")
 		}
-	}
-	err = txn.Commit()
-	if err != nil {
-		return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		after = append(after, storedAccessRule{
+			Expression:  rule.Expression,
+			Validity:    rule.Validity,
+			NotAfter:    conv.SqlToFloat64(notAfter),
+			NotBefore:   conv.SqlToFloat64(notBefore),
+			Description: rule.Description,
+		})
+	}
+	errHTTP := addEventAccessHistory(ctx, imsDBQ, txn, eventID, mode, author, before, after)
+	if errHTTP != nil {
+		return errHTTP.From("[addEventAccessHistory]")
 	}
 	return nil
 }
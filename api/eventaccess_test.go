@@ -49,4 +49,10 @@ func TestKnownTarget(t *testing.T) {
 	// A prefix is required for anything other than the wildcard
 	assert.False(t, knownTarget("Irate", handles, positions, teams))
 	assert.False(t, knownTarget("", handles, positions, teams))
+
+	// A compound expression is known only if all of its targets are
+	assert.True(t, knownTarget("position:Dirt AND team:Green Dot", handles, positions, teams))
+	assert.True(t, knownTarget("(team:Green Dot EXCEPT person:Irate) OR onduty:Dirt", handles, positions, teams))
+	assert.False(t, knownTarget("position:Dirt AND team:No Team", handles, positions, teams))
+	assert.False(t, knownTarget("* EXCEPT person:Nobody", handles, positions, teams))
 }
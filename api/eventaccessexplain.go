@@ -0,0 +1,187 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+// ExplainEventAccess shows an admin which permissions a person has, and which
+// EVENT_ACCESS rules did or didn't give them those, for every event or just
+// the one in the event_id parameter.
+//
+// This works from the directory as it is now. The person's token carries
+// their positions, teams, onsite status, and on-duty position from when it was
+// issued, so they may need to log in again (or wait for a token refresh)
+// before what they can do catches up.
+type ExplainEventAccess struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action ExplainEventAccess) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.explainEventAccess(req)
+	if errHTTP != nil {
+		errHTTP.From("[explainEventAccess]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action ExplainEventAccess) explainEventAccess(req *http.Request) (imsjson.AccessExplanation, *herr.HTTPError) {
+	var empty imsjson.AccessExplanation
+	_, globalPermissions, errHTTP := getGlobalPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[getGlobalPermissions]")
+	}
+	if globalPermissions&authz.GlobalAdministrateEvents == 0 {
+		return empty, herr.Forbidden("The requestor does not have GlobalAdministrateEvents permission", nil)
+	}
+	ctx := req.Context()
+
+	handle := req.URL.Query().Get("handle")
+	if handle == "" {
+		return empty, herr.BadRequest("No handle was provided", nil)
+	}
+	users, err := action.userStore.GetAllUsers(ctx)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to fetch Users", err).From("[GetAllUsers]")
+	}
+	var person *directory.User
+	for _, u := range users {
+		if u.Handle == handle {
+			person = u
+			break
+		}
+	}
+	if person == nil {
+		return empty, herr.NotFound("No person has that handle", nil)
+	}
+
+	var onlyEvent *imsdb.Event
+	if eventName := req.URL.Query().Get("event_id"); eventName != "" {
+		event, errHTTP := getEvent(req, eventName, action.imsDBQ)
+		if errHTTP != nil {
+			return empty, errHTTP.From("[getEvent]")
+		}
+		onlyEvent = &event
+	}
+
+	eventRows, err := action.imsDBQ.Events(ctx, action.imsDBQ)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to fetch Events", err).From("[Events]")
+	}
+	accessRows, err := action.imsDBQ.EventAccessAll(ctx, action.imsDBQ)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to fetch EventAccess", err).From("[EventAccessAll]")
+	}
+	eventNames := make(map[int32]string, len(eventRows))
+	for _, er := range eventRows {
+		eventNames[er.Event.ID] = er.Event.Name
+	}
+	ownAccess := make(map[int32][]imsdb.EventAccess)
+	for _, ar := range accessRows {
+		ownAccess[ar.EventAccess.Event] = append(ownAccess[ar.EventAccess.Event], ar.EventAccess)
+	}
+
+	onDutyPosition := ""
+	if person.OnDutyPositionName != nil {
+		onDutyPosition = *person.OnDutyPositionName
+	}
+	resp := imsjson.AccessExplanation{
+		Handle:         person.Handle,
+		Onsite:         person.Onsite,
+		Positions:      append([]string{}, person.PositionNames...),
+		Teams:          append([]string{}, person.TeamNames...),
+		OnDutyPosition: onDutyPosition,
+		Admin:          slices.Contains(action.imsAdmins, person.Handle),
+		Events:         []imsjson.EventAccessExplanation{},
+	}
+
+	// As in permissionsByEvent, an event gets its own rules, then those of its
+	// parent group, if it has one.
+	accessByEvent := make(map[int32][]imsdb.EventAccess)
+	var explainedIDs []int32
+	now := time.Now()
+	for _, er := range eventRows {
+		event := er.Event
+		if onlyEvent != nil && event.ID != onlyEvent.ID {
+			continue
+		}
+		explanation := imsjson.EventAccessExplanation{
+			Event:   event.Name,
+			IsGroup: event.IsGroup,
+			Rules:   []imsjson.AccessRuleExplanation{},
+		}
+		explain := func(ea imsdb.EventAccess, inheritedFrom string) {
+			accessByEvent[event.ID] = append(accessByEvent[event.ID], ea)
+			mismatches := authz.ExplainPersonMatch(ea, person.Handle, person.PositionNames, person.TeamNames,
+				person.Onsite, onDutyPosition, now)
+			rule := imsjson.AccessRuleExplanation{
+				Expression:    ea.Expression,
+				Mode:          string(ea.Mode),
+				Validity:      string(ea.Validity),
+				NotBefore:     conv.NullFloatToTime(ea.NotBefore),
+				NotAfter:      conv.NullFloatToTime(ea.NotAfter),
+				InheritedFrom: inheritedFrom,
+				Matched:       len(mismatches) == 0,
+			}
+			for _, m := range mismatches {
+				rule.Mismatches = append(rule.Mismatches, string(m))
+			}
+			explanation.Rules = append(explanation.Rules, rule)
+		}
+		for _, ea := range ownAccess[event.ID] {
+			explain(ea, "")
+		}
+		if event.ParentGroup.Valid {
+			for _, ea := range ownAccess[event.ParentGroup.Int32] {
+				explain(ea, eventNames[event.ParentGroup.Int32])
+			}
+		}
+		resp.Events = append(resp.Events, explanation)
+		explainedIDs = append(explainedIDs, event.ID)
+	}
+
+	eventPermissions, personGlobalPermissions := authz.ManyEventPermissions(
+		accessByEvent,
+		action.imsAdmins,
+		person.Handle,
+		person.Onsite,
+		person.PositionNames,
+		person.TeamNames,
+		onDutyPosition,
+	)
+	resp.GlobalPermissionMask = uint16(personGlobalPermissions)
+	resp.GlobalPermissions = personGlobalPermissions.Names()
+	for i, eventID := range explainedIDs {
+		resp.Events[i].EventPermissionMask = uint16(eventPermissions[eventID])
+		resp.Events[i].EventPermissions = eventPermissions[eventID].Names()
+	}
+	return resp, nil
+}
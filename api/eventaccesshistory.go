@@ -0,0 +1,357 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+// storedAccessRule is how an EVENT_ACCESS row is kept in
+// EVENT_ACCESS_HISTORY's BEFORE_RULES and AFTER_RULES.
+type storedAccessRule struct {
+	Expression  string   `json:"expression"`
+	Validity    string   `json:"validity"`
+	NotAfter    *float64 `json:"not_after,omitempty"`
+	NotBefore   *float64 `json:"not_before,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+func storedAccessRuleFromRow(ea imsdb.EventAccess) storedAccessRule {
+	return storedAccessRule{
+		Expression:  ea.Expression,
+		Validity:    string(ea.Validity),
+		NotAfter:    conv.SqlToFloat64(ea.NotAfter),
+		NotBefore:   conv.SqlToFloat64(ea.NotBefore),
+		Description: ea.Description,
+	}
+}
+
+func (r storedAccessRule) toJSON() imsjson.AccessRule {
+	rule := imsjson.AccessRule{
+		Expression:  r.Expression,
+		Validity:    r.Validity,
+		Description: r.Description,
+	}
+	if r.NotAfter != nil {
+		rule.NotAfter = conv.FloatToTime(*r.NotAfter)
+	}
+	if r.NotBefore != nil {
+		rule.NotBefore = conv.FloatToTime(*r.NotBefore)
+	}
+	return rule
+}
+
+func storedAccessRulesToJSON(rules []storedAccessRule) []imsjson.AccessRule {
+	result := make([]imsjson.AccessRule, 0, len(rules))
+	for _, r := range rules {
+		result = append(result, r.toJSON())
+	}
+	return result
+}
+
+// addEventAccessHistory records the replacement of an Event's rules for a
+// mode, in the transaction that made it. Nothing's recorded if the rules are
+// just as they were.
+func addEventAccessHistory(
+	ctx context.Context, imsDBQ *store.DBQ, txn *sql.Tx, eventID int32, mode imsdb.EventAccessMode, author string,
+	before, after []storedAccessRule,
+) *herr.HTTPError {
+	beforeJSON, err := json.Marshal(before)
+	if err != nil {
+		return herr.InternalServerError("Failed to marshal event access", err).From("[Marshal]")
+	}
+	afterJSON, err := json.Marshal(after)
+	if err != nil {
+		return herr.InternalServerError("Failed to marshal event access", err).From("[Marshal]")
+	}
+	if bytes.Equal(beforeJSON, afterJSON) {
+		return nil
+	}
+	_, err = imsDBQ.AddEventAccessHistory(ctx, txn, imsdb.AddEventAccessHistoryParams{
+		Event:       eventID,
+		Mode:        imsdb.EventAccessHistoryMode(mode),
+		Author:      author,
+		Created:     conv.TimeToFloat(time.Now()),
+		BeforeRules: beforeJSON,
+		AfterRules:  afterJSON,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to record event access history", err).From("[AddEventAccessHistory]")
+	}
+	return nil
+}
+
+// eventAccessChange is a row of EVENT_ACCESS_HISTORY, with its rules parsed.
+type eventAccessChange struct {
+	id      int32
+	mode    imsdb.EventAccessMode
+	author  string
+	created time.Time
+	before  []storedAccessRule
+	after   []storedAccessRule
+}
+
+func fetchEventAccessHistory(ctx context.Context, imsDBQ *store.DBQ, eventID int32) ([]eventAccessChange, *herr.HTTPError) {
+	rows, err := imsDBQ.EventAccessHistory(ctx, imsDBQ, eventID)
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch event access history", err).From("[EventAccessHistory]")
+	}
+	changes := make([]eventAccessChange, 0, len(rows))
+	for _, row := range rows {
+		h := row.EventAccessHistory
+		change := eventAccessChange{
+			id:      h.ID,
+			mode:    imsdb.EventAccessMode(h.Mode),
+			author:  h.Author,
+			created: conv.FloatToTime(h.Created),
+		}
+		err = json.Unmarshal(h.BeforeRules, &change.before)
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to parse event access history", err).From("[Unmarshal]")
+		}
+		err = json.Unmarshal(h.AfterRules, &change.after)
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to parse event access history", err).From("[Unmarshal]")
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// accessRulesAt works out an Event's rules for a mode at the time at. Those
+// are the rules after the mode's last change up to then, or else the rules
+// before its first change after then. With no change either side, the mode
+// hasn't been changed since history was first kept, so its rules are those it
+// has now. The history must be oldest first.
+func accessRulesAt(
+	history []eventAccessChange, mode imsdb.EventAccessMode, current []storedAccessRule, at time.Time,
+) []storedAccessRule {
+	var last, next *eventAccessChange
+	for i := range history {
+		change := &history[i]
+		if change.mode != mode {
+			continue
+		}
+		if !change.created.After(at) {
+			last = change
+		} else if next == nil {
+			next = change
+		}
+	}
+	switch {
+	case last != nil:
+		return last.after
+	case next != nil:
+		return next.before
+	default:
+		return current
+	}
+}
+
+var accessModes = []imsdb.EventAccessMode{
+	imsdb.EventAccessModeRead,
+	imsdb.EventAccessModeWrite,
+	imsdb.EventAccessModeReport,
+	imsdb.EventAccessModeWriteVisits,
+	imsdb.EventAccessModeReadConfidential,
+}
+
+// eventAccessAt gives every mode's rules for the Event at the time at.
+func eventAccessAt(
+	ctx context.Context, imsDBQ *store.DBQ, eventID int32, history []eventAccessChange, at time.Time,
+) (map[imsdb.EventAccessMode][]storedAccessRule, *herr.HTTPError) {
+	result := make(map[imsdb.EventAccessMode][]storedAccessRule, len(accessModes))
+	for _, mode := range accessModes {
+		rows, err := imsDBQ.EventAccessForMode(ctx, imsDBQ, imsdb.EventAccessForModeParams{Event: eventID, Mode: mode})
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to fetch event access", err).From("[EventAccessForMode]")
+		}
+		current := make([]storedAccessRule, 0, len(rows))
+		for _, row := range rows {
+			current = append(current, storedAccessRuleFromRow(row.EventAccess))
+		}
+		result[mode] = accessRulesAt(history, mode, current, at)
+	}
+	return result, nil
+}
+
+type GetEventAccessHistory struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetEventAccessHistory) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getEventAccessHistory(req)
+	if errHTTP != nil {
+		errHTTP.From("[getEventAccessHistory]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetEventAccessHistory) getEventAccessHistory(req *http.Request) (imsjson.EventAccessHistory, *herr.HTTPError) {
+	var empty imsjson.EventAccessHistory
+	_, globalPermissions, errHTTP := getGlobalPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[getGlobalPermissions]")
+	}
+	if globalPermissions&authz.GlobalAdministrateEvents == 0 {
+		return empty, herr.Forbidden("The requestor does not have GlobalAdministrateEvents permission", nil)
+	}
+	ctx := req.Context()
+	event, errHTTP := getEvent(req, req.URL.Query().Get("event_id"), action.imsDBQ)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[getEvent]")
+	}
+	var at time.Time
+	if atParam := req.URL.Query().Get("at"); atParam != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, atParam)
+		if err != nil {
+			return empty, herr.BadRequest("Invalid at, which must be an RFC 3339 time", err).From("[time.Parse]")
+		}
+	}
+
+	history, errHTTP := fetchEventAccessHistory(ctx, action.imsDBQ, event.ID)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[fetchEventAccessHistory]")
+	}
+	resp := imsjson.EventAccessHistory{
+		Event:   event.Name,
+		Changes: make([]imsjson.EventAccessChange, 0, len(history)),
+	}
+	for _, change := range history {
+		resp.Changes = append(resp.Changes, imsjson.EventAccessChange{
+			ID:      change.id,
+			Mode:    string(change.mode),
+			Author:  change.author,
+			Created: change.created,
+			Before:  storedAccessRulesToJSON(change.before),
+			After:   storedAccessRulesToJSON(change.after),
+		})
+	}
+	if !at.IsZero() {
+		access, errHTTP := eventAccessAt(ctx, action.imsDBQ, event.ID, history, at)
+		if errHTTP != nil {
+			return empty, errHTTP.From("[eventAccessAt]")
+		}
+		resp.At = at
+		resp.Access = &imsjson.EventAccess{
+			Readers:             storedAccessRulesToJSON(access[imsdb.EventAccessModeRead]),
+			Writers:             storedAccessRulesToJSON(access[imsdb.EventAccessModeWrite]),
+			Reporters:           storedAccessRulesToJSON(access[imsdb.EventAccessModeReport]),
+			VisitWriters:        storedAccessRulesToJSON(access[imsdb.EventAccessModeWriteVisits]),
+			ConfidentialReaders: storedAccessRulesToJSON(access[imsdb.EventAccessModeReadConfidential]),
+		}
+	}
+	return resp, nil
+}
+
+// RestoreEventAccess puts an Event's access rules, for every mode, back as
+// they were at a time. The restore is itself recorded in the history, so it
+// can be undone in turn.
+type RestoreEventAccess struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action RestoreEventAccess) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.restoreEventAccess(req)
+	if errHTTP != nil {
+		errHTTP.From("[restoreEventAccess]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Successfully restored event access")
+}
+
+func (action RestoreEventAccess) restoreEventAccess(req *http.Request) *herr.HTTPError {
+	jwtCtx, globalPermissions, errHTTP := getGlobalPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[getGlobalPermissions]")
+	}
+	if globalPermissions&authz.GlobalAdministrateEvents == 0 {
+		return herr.Forbidden("The requestor does not have GlobalAdministrateEvents permission", nil)
+	}
+	ctx := req.Context()
+	restore, errHTTP := readBodyAs[imsjson.EventAccessRestore](req)
+	if errHTTP != nil {
+		return errHTTP.From("[readBodyAs]")
+	}
+	if restore.At.IsZero() {
+		return herr.BadRequest("No time to restore to was provided", nil)
+	}
+	if restore.At.After(time.Now()) {
+		return herr.BadRequest("The time to restore to is in the future", nil)
+	}
+	event, errHTTP := getEvent(req, restore.Event, action.imsDBQ)
+	if errHTTP != nil {
+		return errHTTP.From("[getEvent]")
+	}
+
+	// Hold the lock from reading the history until the restore's committed, so
+	// that no other change to the rules can land in between.
+	eventAccessWriteMu.Lock()
+	defer eventAccessWriteMu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	history, errHTTP := fetchEventAccessHistory(ctx, action.imsDBQ, event.ID)
+	if errHTTP != nil {
+		return errHTTP.From("[fetchEventAccessHistory]")
+	}
+	access, errHTTP := eventAccessAt(ctx, action.imsDBQ, event.ID, history, restore.At)
+	if errHTTP != nil {
+		return errHTTP.From("[eventAccessAt]")
+	}
+
+	// The restored rules are set just as if an admin had posted them all again,
+	// but in one transaction, so that a failure part way leaves every mode as
+	// it was. Those rules were valid when they were saved, and aren't checked
+	// again.
+	txn, err := action.imsDBQ.BeginTx(ctx, nil)
+	if err != nil {
+		return herr.InternalServerError("Failed to begin transaction", err).From("[BeginTx]")
+	}
+	defer rollback(txn)
+	author := jwtCtx.Claims.RangerHandle()
+	for _, mode := range accessModes {
+		errHTTP = setAccessForMode(ctx, action.imsDBQ, txn, event.ID, storedAccessRulesToJSON(access[mode]), mode, author)
+		if errHTTP != nil {
+			return errHTTP.From("[setAccessForMode] " + string(mode))
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessRulesAt(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2025, 8, 24, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	rules := func(expressions ...string) []storedAccessRule {
+		result := make([]storedAccessRule, 0, len(expressions))
+		for _, e := range expressions {
+			result = append(result, storedAccessRule{Expression: e, Validity: "always"})
+		}
+		return result
+	}
+	read, write := imsdb.EventAccessModeRead, imsdb.EventAccessModeWrite
+
+	// Writers went from A, to A and B on day 1, to B on day 3. A reader was
+	// added on day 2.
+	history := []eventAccessChange{
+		{id: 1, mode: write, created: start.Add(1 * day), before: rules("person:A"), after: rules("person:A", "person:B")},
+		{id: 2, mode: read, created: start.Add(2 * day), before: rules(), after: rules("person:C")},
+		{id: 3, mode: write, created: start.Add(3 * day), before: rules("person:A", "person:B"), after: rules("person:B")},
+	}
+	currentWriters := rules("person:B")
+	currentReaders := rules("person:C")
+
+	// Before any change, it's what the first change found.
+	assert.Equal(t, rules("person:A"), accessRulesAt(history, write, currentWriters, start))
+	assert.Equal(t, rules(), accessRulesAt(history, read, currentReaders, start))
+
+	// A change counts from the moment it was made.
+	assert.Equal(t, rules("person:A", "person:B"), accessRulesAt(history, write, currentWriters, start.Add(1*day)))
+	assert.Equal(t, rules("person:A", "person:B"), accessRulesAt(history, write, currentWriters, start.Add(2*day)))
+	assert.Equal(t, rules("person:C"), accessRulesAt(history, read, currentReaders, start.Add(2*day)))
+	assert.Equal(t, rules("person:B"), accessRulesAt(history, write, currentWriters, start.Add(4*day)))
+
+	// A mode that's never been changed has always had its current rules.
+	reporters := rules("team:D")
+	assert.Equal(t, reporters, accessRulesAt(history, imsdb.EventAccessModeReport, reporters, start))
+}
@@ -17,15 +17,47 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"slices"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/launchdarkly/eventsource"
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/actionlog"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
 )
 
-const EventSourceChannel = "imsevents"
+const (
+	// eventSourceKeepAlive is how often an idle stream gets a comment line, so
+	// that proxies along the way (e.g. Cloudflare) don't drop it as idle.
+	eventSourceKeepAlive = 20 * time.Second
+
+	// eventSourceBufferSize is how many events may be queued for a stream
+	// before it's deemed too slow to keep up. Such a stream gets closed, and the
+	// client recovers by reconnecting and refetching everything, as it would
+	// after any other gap.
+	eventSourceBufferSize = 64
+
+	// eventSourceLoadTimeout bounds how long loading the payload for an event
+	// may hold up its delivery.
+	eventSourceLoadTimeout = 10 * time.Second
+
+	// eventSourcePublishTimeout bounds how long broadcasting an event may hold
+	// up the request that made the change.
+	eventSourcePublishTimeout = 10 * time.Second
+)
 
 type IMSEventData struct {
 	EventID int32  `json:"event_id,omitzero"`
@@ -38,6 +70,14 @@ type IMSEventData struct {
 	FieldReportNumber int32 `json:"field_report_number,omitzero"`
 	VisitNumber       int32 `json:"visit_number,omitzero"`
 	InitialEvent      bool  `json:"initial_event,omitzero"`
+
+	// The updated entity, in the same shape as its GET endpoint returns it.
+	// This is left out if the entity couldn't be loaded, in which case clients
+	// should fall back to fetching it themselves.
+
+	Incident    *imsjson.Incident    `json:"incident,omitzero"`
+	FieldReport *imsjson.FieldReport `json:"field_report,omitzero"`
+	Visit       *imsjson.Visit       `json:"visit,omitzero"`
 }
 
 type IMSEvent struct {
@@ -73,61 +113,389 @@ func (e IMSEvent) Data() string {
 	return string(b)
 }
 
+// frame renders the event in the text/event-stream format. The data is JSON,
+// which never contains a raw newline, so it always fits on one "data" line.
+func (e IMSEvent) frame() []byte {
+	return fmt.Appendf(nil, "id: %v\nevent: %v\ndata: %v\n\n", e.Id(), e.Event(), e.Data())
+}
+
+// subscriber is a single connected stream. Its permissions are a snapshot from
+// when it connected, which is fine because the stream doesn't outlive the
+// access token that it was opened with.
+type subscriber struct {
+	handle      string
+	permissions map[int32]authz.EventPermissionMask
+
+	frames chan []byte
+	// dropped is closed once the EventSourcerer stops sending to this subscriber.
+	dropped chan struct{}
+}
+
+func (sub *subscriber) canReadIncidents(eventID int32) bool {
+	return sub.permissions[eventID]&authz.EventReadIncidents != 0
+}
+
+// canReadFieldReport mirrors GetFieldReport: those who can only read their own
+// Field Reports get the ones on which they've written a report entry.
+func (sub *subscriber) canReadFieldReport(eventID int32, authors []string) bool {
+	perms := sub.permissions[eventID]
+	if perms&authz.EventReadAllFieldReports != 0 {
+		return true
+	}
+	return perms&authz.EventReadOwnFieldReports != 0 && slices.Contains(authors, sub.handle)
+}
+
+func (sub *subscriber) canReadVisits(eventID int32) bool {
+	return sub.permissions[eventID]&authz.EventReadVisits != 0
+}
+
+// canRead says whether the subscriber may see an event that they'd otherwise
+// be able to, given whether it's for a confidential record.
+func (sub *subscriber) canRead(eventID int32, confidential bool) bool {
+	return !confidential || canReadConfidential(sub.permissions[eventID])
+}
+
+// EventSourcerer fans out IMS SSEs to every connected stream that is allowed
+// to see them. Changes reach it by way of a Broadcaster, which by default only
+// knows about the changes made through this server.
 type EventSourcerer struct {
-	Server    *eventsource.Server
 	IdCounter atomic.Int64
+
+	imsDBQ             *store.DBQ
+	attachmentsEnabled bool
+	broadcaster        Broadcaster
+	webhooks           *Webhooks
+	actionLogger       *actionlog.Logger
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
 }
 
-func NewEventSourcerer() *EventSourcerer {
+// NewEventSourcerer makes an EventSourcerer that loads entity payloads from
+// imsDBQ. With a nil imsDBQ, events carry only the entity numbers.
+func NewEventSourcerer(imsDBQ *store.DBQ, attachmentsEnabled bool) *EventSourcerer {
+	local := &localBroadcaster{}
 	es := &EventSourcerer{
-		Server:    eventsource.NewServer(),
-		IdCounter: atomic.Int64{},
+		imsDBQ:             imsDBQ,
+		attachmentsEnabled: attachmentsEnabled,
+		broadcaster:        local,
+		subscribers:        make(map[*subscriber]struct{}),
 	}
-	es.Server.Register(EventSourceChannel, es)
-	es.Server.ReplayAll = true
+	local.deliver = es.deliver
 	return es
 }
 
-func (es *EventSourcerer) Replay(channel, id string) chan eventsource.Event {
-	if channel != EventSourceChannel {
-		return nil
+// Broadcast switches the EventSourcerer over to b, e.g. so that it hears about
+// changes made through other IMS servers too. This must be called before the
+// server starts handling requests. b stops delivering once ctx is done.
+func (es *EventSourcerer) Broadcast(ctx context.Context, b Broadcaster) error {
+	latestID, err := b.Start(ctx, es.deliver)
+	if err != nil {
+		return fmt.Errorf("[Start]: %w", err)
+	}
+	es.IdCounter.Store(latestID)
+	es.broadcaster = b
+	return nil
+}
+
+// subscribe adds a stream for the given requestor. Its first event is always
+// the InitialEvent, which carries the most recent SSE ID, so that the client
+// can tell whether it missed anything since it was last connected.
+func (es *EventSourcerer) subscribe(handle string, permissions map[int32]authz.EventPermissionMask) *subscriber {
+	sub := &subscriber{
+		handle:      handle,
+		permissions: permissions,
+		frames:      make(chan []byte, eventSourceBufferSize),
+		dropped:     make(chan struct{}),
 	}
-	out := make(chan eventsource.Event, 1)
-	out <- IMSEvent{
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.closed {
+		close(sub.dropped)
+		return sub
+	}
+	sub.frames <- IMSEvent{
 		EventID: es.IdCounter.Load(),
 		EventData: IMSEventData{
 			InitialEvent: true,
 			Comment:      "The most recent SSE ID is provided in this message",
 		},
+	}.frame()
+	es.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (es *EventSourcerer) unsubscribe(sub *subscriber) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.dropLocked(sub)
+}
+
+// dropLocked must be called with es.mu held.
+func (es *EventSourcerer) dropLocked(sub *subscriber) {
+	if _, ok := es.subscribers[sub]; !ok {
+		return
+	}
+	delete(es.subscribers, sub)
+	close(sub.dropped)
+}
+
+// Close ends all streams, and any that are opened afterward.
+func (es *EventSourcerer) Close() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.closed = true
+	for sub := range es.subscribers {
+		es.dropLocked(sub)
+	}
+}
+
+func (es *EventSourcerer) listening() bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return len(es.subscribers) > 0
+}
+
+// publish queues data, with the given SSE ID, for each subscriber that view
+// lets see it. view returns the data as that subscriber should get it; all
+// those that get it unchanged share a single serialization.
+//
+// An ID of 0 means to use the next one from IdCounter. That's assigned under
+// the same lock as the queueing, so every stream receives its events in ID
+// order. A nonzero ID becomes the latest one, for the next InitialEvent.
+func (es *EventSourcerer) publish(id int64, data IMSEventData, view func(sub *subscriber) (IMSEventData, bool)) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if id == 0 {
+		id = es.IdCounter.Add(1)
+	} else {
+		es.IdCounter.Store(id)
+	}
+	var shared []byte
+	for sub := range es.subscribers {
+		subData, ok := view(sub)
+		if !ok {
+			continue
+		}
+		var frame []byte
+		if subData == data {
+			if shared == nil {
+				shared = IMSEvent{EventID: id, EventData: data}.frame()
+			}
+			frame = shared
+		} else {
+			frame = IMSEvent{EventID: id, EventData: subData}.frame()
+		}
+		select {
+		case sub.frames <- frame:
+		default:
+			slog.Info("Dropping an SSE subscriber that isn't keeping up", "handle", sub.handle)
+			es.dropLocked(sub)
+		}
+	}
+}
+
+// loadPayload calls load to fill in the payload of an event, unless there's
+// no one listening who'd want it. Failures are only logged, as the event is
+// still worth sending without its payload.
+func (es *EventSourcerer) loadPayload(eventID int32, load func(ctx context.Context, event imsdb.Event) *herr.HTTPError) {
+	if es.imsDBQ == nil || !es.listening() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventSourceLoadTimeout)
+	defer cancel()
+	eventRow, err := es.imsDBQ.Event(ctx, es.imsDBQ, eventID)
+	if err != nil {
+		slog.Error("Failed to fetch Event for SSE payload", "eventID", eventID, "error", err)
+		return
+	}
+	errHTTP := load(ctx, eventRow.Event)
+	if errHTTP != nil {
+		slog.Error("Failed to load SSE payload", "eventID", eventID, "error", errHTTP)
+	}
+}
+
+// SendWebhooks has the EventSourcerer queue webhook deliveries for each change
+// it's notified of. Like Broadcast, this must be called before the server
+// starts handling requests.
+func (es *EventSourcerer) SendWebhooks(wh *Webhooks) {
+	es.webhooks = wh
+}
+
+// LogConfidentialAccess has the EventSourcerer write to the action log each
+// time it sends someone a confidential record, as LogRequest does when that's
+// read through the API. Like Broadcast, this must be called before the server
+// starts handling requests.
+func (es *EventSourcerer) LogConfidentialAccess(actionLogger *actionlog.Logger) {
+	es.actionLogger = actionLogger
+}
+
+// logConfidentialPushes records that each of the handles was sent the
+// confidential record at path.
+func (es *EventSourcerer) logConfidentialPushes(handles []string, path string) {
+	if es.actionLogger == nil {
+		return
+	}
+	now := conv.TimeToFloat(time.Now())
+	for _, handle := range handles {
+		es.actionLogger.Log(context.Background(), imsdb.AddActionLogParams{
+			CreatedAt:  now,
+			ActionType: confidentialAccessActionType,
+			Method:     sql.NullString{String: "SSE", Valid: true},
+			Path:       conv.StringToSql(&path, 128),
+			UserName:   conv.StringToSql(&handle, 128),
+		})
 	}
-	close(out)
-	return out
 }
 
-func (es *EventSourcerer) notifyFieldReportUpdate(eventID int32, frNumber int32) {
+// broadcast sends data to every server's subscribers, by way of the
+// Broadcaster. A failure is only logged, as the change itself has already been
+// made, and the worst outcome is that browsers show the old version until they
+// next refetch it.
+func (es *EventSourcerer) broadcast(data IMSEventData) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventSourcePublishTimeout)
+	defer cancel()
+	errHTTP := es.broadcaster.Publish(ctx, data)
+	if errHTTP != nil {
+		slog.Error("Failed to broadcast SSE", "data", data, "error", errHTTP)
+	}
+}
+
+// deliver is where the Broadcaster hands over each event, to be sent to this
+// server's subscribers.
+func (es *EventSourcerer) deliver(id int64, data IMSEventData) {
+	switch {
+	case data.IncidentNumber > 0:
+		es.deliverIncident(id, data)
+	case data.FieldReportNumber > 0:
+		es.deliverFieldReport(id, data)
+	case data.VisitNumber > 0:
+		es.deliverVisit(id, data)
+	default:
+		slog.Error("Dropping an SSE of unknown type", "id", id, "data", data)
+	}
+}
+
+// notifyFieldReportUpdate tells subscribers and Webhooks about a change to a
+// Field Report. The triggers say what kind of change it was, for the Webhooks,
+// and default to just triggerFieldReportUpdated. The same goes for the other
+// notify functions.
+func (es *EventSourcerer) notifyFieldReportUpdate(eventID int32, frNumber int32, triggers ...webhookTrigger) {
 	if frNumber == 0 {
 		return
 	}
-	es.Server.Publish([]string{EventSourceChannel}, IMSEvent{
-		EventID: es.IdCounter.Add(1),
-		EventData: IMSEventData{
-			EventID:           eventID,
-			FieldReportNumber: frNumber,
-		},
+	data := IMSEventData{
+		EventID:           eventID,
+		FieldReportNumber: frNumber,
+	}
+	es.broadcast(data)
+	if len(triggers) == 0 {
+		triggers = []webhookTrigger{triggerFieldReportUpdated}
+	}
+	es.webhooks.queue(data, triggers)
+}
+
+func (es *EventSourcerer) deliverFieldReport(id int64, data IMSEventData) {
+	// Without the report entries, we can't tell who the authors are, so then
+	// only those who may read all Field Reports get the event. Likewise, it's
+	// only for those who may read confidential records until we know that the
+	// Field Report isn't attached to a confidential Incident.
+	var authors []string
+	confidential := true
+	es.loadPayload(data.EventID, func(ctx context.Context, event imsdb.Event) *herr.HTTPError {
+		fr, reportEntries, errHTTP := fetchFieldReport(ctx, es.imsDBQ, data.EventID, data.FieldReportNumber)
+		if errHTTP != nil {
+			return errHTTP.From("[fetchFieldReport]")
+		}
+		confidential, errHTTP = incidentConfidential(ctx, es.imsDBQ, data.EventID, fr.IncidentNumber)
+		if errHTTP != nil {
+			confidential = true
+			return errHTTP.From("[incidentConfidential]")
+		}
+		fieldReport := fieldReportToJSON(fr, reportEntries, event, es.attachmentsEnabled)
+		data.FieldReport = &fieldReport
+		for _, re := range reportEntries {
+			authors = append(authors, re.Author)
+		}
+		return nil
+	})
+	es.publishFieldReport(id, data, authors, confidential)
+}
+
+func (es *EventSourcerer) publishFieldReport(id int64, data IMSEventData, authors []string, confidential bool) {
+	var pushedTo []string
+	es.publish(id, data, func(sub *subscriber) (IMSEventData, bool) {
+		if !sub.canReadFieldReport(data.EventID, authors) || !sub.canRead(data.EventID, confidential) {
+			return data, false
+		}
+		if confidential && data.FieldReport != nil {
+			pushedTo = append(pushedTo, sub.handle)
+		}
+		return data, true
 	})
+	if len(pushedTo) > 0 {
+		es.logConfidentialPushes(pushedTo,
+			fmt.Sprintf("/ims/api/events/%v/field_reports/%d", data.FieldReport.Event, data.FieldReportNumber))
+	}
 }
 
-func (es *EventSourcerer) notifyIncidentUpdate(eventID int32, incidentNumber int32) {
+func (es *EventSourcerer) notifyIncidentUpdate(eventID int32, incidentNumber int32, triggers ...webhookTrigger) {
 	if incidentNumber == 0 {
 		return
 	}
-	es.Server.Publish([]string{EventSourceChannel}, IMSEvent{
-		EventID: es.IdCounter.Add(1),
-		EventData: IMSEventData{
-			EventID:        eventID,
-			IncidentNumber: incidentNumber,
-		},
+	data := IMSEventData{
+		EventID:        eventID,
+		IncidentNumber: incidentNumber,
+	}
+	es.broadcast(data)
+	if len(triggers) == 0 {
+		triggers = []webhookTrigger{triggerIncidentUpdated}
+	}
+	es.webhooks.queue(data, triggers)
+}
+
+func (es *EventSourcerer) deliverIncident(id int64, data IMSEventData) {
+	// As in deliverFieldReport, an Incident that wasn't loaded is taken to be
+	// confidential.
+	confidential := true
+	es.loadPayload(data.EventID, func(ctx context.Context, event imsdb.Event) *herr.HTTPError {
+		incident, errHTTP := loadIncident(ctx, es.imsDBQ, event, data.IncidentNumber, es.attachmentsEnabled)
+		if errHTTP != nil {
+			return errHTTP.From("[loadIncident]")
+		}
+		confidential = *incident.Confidential
+		data.Incident = &incident
+		return nil
 	})
+	es.publishIncident(id, data, confidential)
+}
+
+// publishIncident sends each subscriber the Incident as GetIncident would have
+// shown it to them, i.e. with linked Incidents redacted as needed.
+func (es *EventSourcerer) publishIncident(id int64, data IMSEventData, confidential bool) {
+	var pushedTo []string
+	es.publish(id, data, func(sub *subscriber) (IMSEventData, bool) {
+		if !sub.canReadIncidents(data.EventID) || !sub.canRead(data.EventID, confidential) {
+			return data, false
+		}
+		if confidential && data.Incident != nil {
+			pushedTo = append(pushedTo, sub.handle)
+		}
+		if data.Incident != nil {
+			incident, redacted := redactLinkedIncidents(*data.Incident, sub.permissions)
+			if redacted {
+				subData := data
+				subData.Incident = &incident
+				return subData, true
+			}
+		}
+		return data, true
+	})
+	if len(pushedTo) > 0 {
+		es.logConfidentialPushes(pushedTo,
+			fmt.Sprintf("/ims/api/events/%v/incidents/%d", data.Incident.Event, data.IncidentNumber))
+	}
 }
 
 func (es *EventSourcerer) notifyIncidentUpdates(eventID int32, incident1, incident2 int32) {
@@ -137,15 +505,154 @@ func (es *EventSourcerer) notifyIncidentUpdates(eventID int32, incident1, incide
 	}
 }
 
-func (es *EventSourcerer) notifyVisitUpdate(eventID int32, visitNumber int32) {
+func (es *EventSourcerer) notifyVisitUpdate(eventID int32, visitNumber int32, triggers ...webhookTrigger) {
 	if visitNumber == 0 {
 		return
 	}
-	es.Server.Publish([]string{EventSourceChannel}, IMSEvent{
-		EventID: es.IdCounter.Add(1),
-		EventData: IMSEventData{
-			EventID:     eventID,
-			VisitNumber: visitNumber,
-		},
+	data := IMSEventData{
+		EventID:     eventID,
+		VisitNumber: visitNumber,
+	}
+	es.broadcast(data)
+	if len(triggers) == 0 {
+		triggers = []webhookTrigger{triggerVisitUpdated}
+	}
+	es.webhooks.queue(data, triggers)
+}
+
+func (es *EventSourcerer) deliverVisit(id int64, data IMSEventData) {
+	// As in deliverFieldReport.
+	confidential := true
+	es.loadPayload(data.EventID, func(ctx context.Context, event imsdb.Event) *herr.HTTPError {
+		visit, errHTTP := loadVisit(ctx, es.imsDBQ, event, data.VisitNumber, es.attachmentsEnabled)
+		if errHTTP != nil {
+			return errHTTP.From("[loadVisit]")
+		}
+		confidential, errHTTP = incidentConfidential(ctx, es.imsDBQ, data.EventID, incidentRef(visit.Incident))
+		if errHTTP != nil {
+			confidential = true
+			return errHTTP.From("[incidentConfidential]")
+		}
+		data.Visit = &visit
+		return nil
+	})
+	es.publishVisit(id, data, confidential)
+}
+
+func (es *EventSourcerer) publishVisit(id int64, data IMSEventData, confidential bool) {
+	var pushedTo []string
+	es.publish(id, data, func(sub *subscriber) (IMSEventData, bool) {
+		if !sub.canReadVisits(data.EventID) || !sub.canRead(data.EventID, confidential) {
+			return data, false
+		}
+		if confidential && data.Visit != nil {
+			pushedTo = append(pushedTo, sub.handle)
+		}
+		return data, true
 	})
+	if len(pushedTo) > 0 {
+		es.logConfidentialPushes(pushedTo,
+			fmt.Sprintf("/ims/api/events/%v/visits/%d", data.Visit.Event, data.VisitNumber))
+	}
+}
+
+type GetEventSource struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+	es        *EventSourcerer
+}
+
+func (action GetEventSource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sub, expires, revoked, errHTTP := action.subscribe(req)
+	if errHTTP != nil {
+		errHTTP.From("[subscribe]").WriteResponse(w)
+		return
+	}
+	defer action.es.unsubscribe(sub)
+	streamEvents(w, req, sub, expires, revoked)
+}
+
+// subscribe gives the subscriber for the requestor, when their access ends,
+// and, for an API token, a check of whether it's since been revoked. An API
+// token that never expires gives a zero expiry time.
+func (action GetEventSource) subscribe(
+	req *http.Request,
+) (*subscriber, time.Time, func(context.Context) bool, *herr.HTTPError) {
+	jwtCtx, errHTTP := getJwtCtx(req)
+	if errHTTP != nil {
+		return nil, time.Time{}, nil, errHTTP.From("[getJwtCtx]")
+	}
+	expires, err := jwtCtx.Claims.GetExpirationTime()
+	if err != nil {
+		return nil, time.Time{}, nil, herr.Unauthorized("The access token has a bad expiration time", err).From("[GetExpirationTime]")
+	}
+	var expiresAt time.Time
+	if expires != nil {
+		expiresAt = expires.Time
+	}
+	var revoked func(context.Context) bool
+	if apiToken := jwtCtx.Claims.APIToken(); apiToken != nil {
+		revoked = func(ctx context.Context) bool {
+			return apiTokenRevoked(ctx, action.imsDBQ, apiToken.ID)
+		}
+	} else if expires == nil {
+		return nil, time.Time{}, nil, herr.Unauthorized("The access token has no expiration time", nil)
+	}
+	permsByEvent, errHTTP := permissionsByEvent(req.Context(), jwtCtx, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return nil, time.Time{}, nil, errHTTP.From("[permissionsByEvent]")
+	}
+	return action.es.subscribe(jwtCtx.Claims.RangerHandle(), permsByEvent), expiresAt, revoked, nil
+}
+
+// streamEvents writes the subscriber's events to w until the client goes away,
+// the subscriber gets dropped, or the access token expires. Ending the stream
+// at expiry bounds how stale the subscriber's permissions can get, and the
+// client just reconnects with a fresh token. An API token may not expire, so
+// its stream also ends once revoked reports that it's been revoked, which is
+// checked at each keep-alive.
+func streamEvents(
+	w http.ResponseWriter, req *http.Request, sub *subscriber, expires time.Time, revoked func(context.Context) bool,
+) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// A nil channel never fires, for a token that doesn't expire
+	var expired <-chan time.Time
+	if !expires.IsZero() {
+		expiry := time.NewTimer(time.Until(expires))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+	keepAlive := time.NewTicker(eventSourceKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var frame []byte
+		select {
+		case <-req.Context().Done():
+			return
+		case <-sub.dropped:
+			return
+		case <-expired:
+			return
+		case <-keepAlive.C:
+			if revoked != nil && revoked(req.Context()) {
+				return
+			}
+			frame = []byte(":\n\n")
+		case frame = <-sub.frames:
+		}
+		_, err := w.Write(frame)
+		if err != nil {
+			return
+		}
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
 }
@@ -17,8 +17,14 @@
 package api
 
 import (
-	"github.com/stretchr/testify/assert"
+	"encoding/json"
+	"strings"
 	"testing"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIMSEventType(t *testing.T) {
@@ -30,3 +36,207 @@ func TestIMSEventType(t *testing.T) {
 	assert.Equal(t, "InitialEvent", IMSEvent{EventData: IMSEventData{InitialEvent: true}}.Event())
 	assert.Equal(t, "UnknownEvent", IMSEvent{}.Event())
 }
+
+func TestIMSEventFrame(t *testing.T) {
+	t.Parallel()
+
+	frame := IMSEvent{EventID: 7, EventData: IMSEventData{EventID: 2, IncidentNumber: 3}}.frame()
+	assert.Equal(t, "id: 7\nevent: Incident\ndata: {\"event_id\":2,\"incident_number\":3}\n\n", string(frame))
+}
+
+// received drains whatever is queued for the subscriber, minus the InitialEvent
+// that every subscriber starts with.
+func received(t *testing.T, sub *subscriber) []IMSEventData {
+	t.Helper()
+	var result []IMSEventData
+	for {
+		select {
+		case frame := <-sub.frames:
+			_, data, ok := strings.Cut(string(frame), "data: ")
+			require.True(t, ok, string(frame))
+			var parsed IMSEventData
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(data)), &parsed))
+			if !parsed.InitialEvent {
+				result = append(result, parsed)
+			}
+		default:
+			return result
+		}
+	}
+}
+
+func TestEventSourcererFiltersByEventPermissions(t *testing.T) {
+	t.Parallel()
+	// Without a DB, no record can be loaded, so each is taken to be confidential
+	es := NewEventSourcerer(nil, false)
+
+	writer := es.subscribe("Writer", map[int32]authz.EventPermissionMask{
+		1: authz.RolesToEventPerms[authz.EventWriter] | authz.EventReadConfidential,
+	})
+	visitWriter := es.subscribe("VisitWriter", map[int32]authz.EventPermissionMask{
+		1: authz.RolesToEventPerms[authz.EventVisitWriter] | authz.EventReadConfidential,
+	})
+	otherEvent := es.subscribe("OtherEvent", map[int32]authz.EventPermissionMask{
+		2: authz.RolesToEventPerms[authz.EventWriter] | authz.EventReadConfidential,
+	})
+	noPerms := es.subscribe("NoPerms", nil)
+
+	es.notifyIncidentUpdate(1, 10)
+	es.notifyFieldReportUpdate(1, 20)
+	es.notifyVisitUpdate(1, 30)
+
+	assert.Equal(t, []IMSEventData{
+		{EventID: 1, IncidentNumber: 10},
+		{EventID: 1, FieldReportNumber: 20},
+		{EventID: 1, VisitNumber: 30},
+	}, received(t, writer))
+	assert.Equal(t, []IMSEventData{
+		{EventID: 1, VisitNumber: 30},
+	}, received(t, visitWriter))
+	assert.Empty(t, received(t, otherEvent))
+	assert.Empty(t, received(t, noPerms))
+}
+
+func TestEventSourcererOwnFieldReports(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+
+	reporterPerms := map[int32]authz.EventPermissionMask{1: authz.RolesToEventPerms[authz.EventReporter]}
+	author := es.subscribe("Author", reporterPerms)
+	nonAuthor := es.subscribe("NonAuthor", reporterPerms)
+	reader := es.subscribe("Reader", map[int32]authz.EventPermissionMask{
+		1: authz.RolesToEventPerms[authz.EventReader] | authz.EventReadConfidential,
+	})
+
+	es.publishFieldReport(0, IMSEventData{EventID: 1, FieldReportNumber: 20}, []string{"Someone", "Author"}, false)
+	// Without a payload, the authors are unknown, so only those who may read
+	// all Field Reports get to hear about it.
+	es.notifyFieldReportUpdate(1, 21)
+
+	assert.Equal(t, []IMSEventData{
+		{EventID: 1, FieldReportNumber: 20},
+	}, received(t, author))
+	assert.Empty(t, received(t, nonAuthor))
+	assert.Equal(t, []IMSEventData{
+		{EventID: 1, FieldReportNumber: 20},
+		{EventID: 1, FieldReportNumber: 21},
+	}, received(t, reader))
+}
+
+func TestEventSourcererConfidential(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+
+	confidentialReader := es.subscribe("ConfidentialReader", map[int32]authz.EventPermissionMask{
+		1: authz.RolesToEventPerms[authz.EventWriter] | authz.EventReadConfidential,
+	})
+	writer := es.subscribe("Writer", map[int32]authz.EventPermissionMask{
+		1: authz.RolesToEventPerms[authz.EventWriter],
+	})
+
+	es.publishIncident(0, IMSEventData{EventID: 1, IncidentNumber: 10}, true)
+	es.publishFieldReport(0, IMSEventData{EventID: 1, FieldReportNumber: 20}, nil, true)
+	es.publishVisit(0, IMSEventData{EventID: 1, VisitNumber: 30}, true)
+	es.publishIncident(0, IMSEventData{EventID: 1, IncidentNumber: 11}, false)
+	// Records that couldn't be loaded, as there's no DB here, might be
+	// confidential, so they're treated as such.
+	es.notifyIncidentUpdate(1, 12)
+	es.notifyFieldReportUpdate(1, 21)
+	es.notifyVisitUpdate(1, 31)
+
+	assert.Equal(t, []IMSEventData{
+		{EventID: 1, IncidentNumber: 10},
+		{EventID: 1, FieldReportNumber: 20},
+		{EventID: 1, VisitNumber: 30},
+		{EventID: 1, IncidentNumber: 11},
+		{EventID: 1, IncidentNumber: 12},
+		{EventID: 1, FieldReportNumber: 21},
+		{EventID: 1, VisitNumber: 31},
+	}, received(t, confidentialReader))
+	assert.Equal(t, []IMSEventData{
+		{EventID: 1, IncidentNumber: 11},
+	}, received(t, writer))
+}
+
+func TestEventSourcererRedactsLinkedIncidents(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+
+	readsBoth := es.subscribe("ReadsBoth", map[int32]authz.EventPermissionMask{
+		1: authz.EventReadIncidents,
+		2: authz.EventReadIncidents,
+	})
+	readsOne := es.subscribe("ReadsOne", map[int32]authz.EventPermissionMask{
+		1: authz.EventReadIncidents,
+	})
+
+	incident := imsjson.Incident{
+		EventID: 1,
+		Number:  10,
+		LinkedIncidents: &[]imsjson.LinkedIncident{
+			{EventID: 1, Number: 11, Summary: "same event"},
+			{EventID: 2, Number: 12, Summary: "other event"},
+		},
+	}
+	es.publishIncident(0, IMSEventData{EventID: 1, IncidentNumber: 10, Incident: &incident}, false)
+
+	both := received(t, readsBoth)
+	require.Len(t, both, 1)
+	assert.Equal(t, "same event", (*both[0].Incident.LinkedIncidents)[0].Summary)
+	assert.Equal(t, "other event", (*both[0].Incident.LinkedIncidents)[1].Summary)
+
+	one := received(t, readsOne)
+	require.Len(t, one, 1)
+	assert.Equal(t, "same event", (*one[0].Incident.LinkedIncidents)[0].Summary)
+	assert.Empty(t, (*one[0].Incident.LinkedIncidents)[1].Summary)
+
+	// The shared payload must not have been modified along the way.
+	assert.Equal(t, "other event", (*incident.LinkedIncidents)[1].Summary)
+}
+
+func TestEventSourcererInitialEvent(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+
+	es.notifyIncidentUpdate(1, 10)
+	es.notifyIncidentUpdate(1, 11)
+	sub := es.subscribe("Someone", nil)
+
+	frame := string(<-sub.frames)
+	assert.True(t, strings.HasPrefix(frame, "id: 2\nevent: InitialEvent\n"), frame)
+}
+
+func TestEventSourcererDropsSlowSubscriber(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+
+	perms := map[int32]authz.EventPermissionMask{1: authz.EventReadIncidents | authz.EventReadConfidential}
+	slow := es.subscribe("Slow", perms)
+	// The InitialEvent already takes up one spot in the buffer.
+	for i := range eventSourceBufferSize - 1 {
+		es.notifyIncidentUpdate(1, int32(i+1))
+	}
+	assert.True(t, es.listening())
+	select {
+	case <-slow.dropped:
+		t.Fatal("subscriber was dropped before its buffer overflowed")
+	default:
+	}
+
+	es.notifyIncidentUpdate(1, eventSourceBufferSize)
+	<-slow.dropped
+	assert.False(t, es.listening())
+}
+
+func TestEventSourcererClose(t *testing.T) {
+	t.Parallel()
+	es := NewEventSourcerer(nil, false)
+
+	before := es.subscribe("Before", nil)
+	es.Close()
+	<-before.dropped
+
+	after := es.subscribe("After", nil)
+	<-after.dropped
+	assert.False(t, es.listening())
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -45,89 +46,146 @@ type GetFieldReports struct {
 }
 
 func (action GetFieldReports) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	resp, errHTTP := action.getFieldReports(req)
+	resp, nextCursor, errHTTP := action.getFieldReports(req)
 	if errHTTP != nil {
 		errHTTP.From("[getFieldReports]").WriteResponse(w)
 		return
 	}
+	if nextCursor != "" {
+		w.Header().Set(NextCursorHeader, nextCursor)
+	}
 	mustWriteJSON(w, req, resp)
 }
-func (action GetFieldReports) getFieldReports(req *http.Request) (imsjson.FieldReports, *herr.HTTPError) {
+func (action GetFieldReports) getFieldReports(req *http.Request) (imsjson.FieldReports, string, *herr.HTTPError) {
 	resp := make(imsjson.FieldReports, 0)
 	event, jwtCtx, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
 	if errHTTP != nil {
-		return resp, errHTTP.From("[getEventPermissions]")
+		return resp, "", errHTTP.From("[getEventPermissions]")
 	}
 	if eventPermissions&(authz.EventReadAllFieldReports|authz.EventReadOwnFieldReports) == 0 {
-		return resp, herr.Forbidden("The requestor does not have permission to read Field Reports on this Event", nil)
+		return resp, "", herr.Forbidden("The requestor does not have permission to read Field Reports on this Event", nil)
 	}
 	// i.e. the user has EventReadOwnFieldReports, but not EventReadAllFieldReports
 	limitedAccess := eventPermissions&authz.EventReadAllFieldReports == 0
 
 	err := req.ParseForm()
 	if err != nil {
-		return resp, herr.BadRequest("Failed to parse form", err).From("[ParseForm]")
+		return resp, "", herr.BadRequest("Failed to parse form", err).From("[ParseForm]")
 	}
 
 	includeSystemEntries := !strings.EqualFold(req.Form.Get("exclude_system_entries"), "true")
 
-	reportEntries, err := action.imsDBQ.FieldReports_ReportEntries(
-		req.Context(),
-		action.imsDBQ,
-		imsdb.FieldReports_ReportEntriesParams{
-			Event:     event.ID,
-			Generated: includeSystemEntries,
-		},
-	)
-	if err != nil {
-		return resp, herr.InternalServerError("Failed to get FR report entries", err).From("[FieldReports_ReportEntries]")
+	params, listQ, errHTTP := fieldReportsParams(req.Form, event.ID)
+	if errHTTP != nil {
+		return resp, "", errHTTP.From("[fieldReportsParams]")
+	}
+	params.IncludeGenerated = includeSystemEntries
+	params.IncludeConfidential = canReadConfidential(eventPermissions)
+	// With limited access, the requestor may only see the Field Reports
+	// that they've written in, and the query does that filtering too.
+	if limitedAccess {
+		params.Author = sql.NullString{String: jwtCtx.Claims.RangerHandle(), Valid: true}
 	}
 
-	entriesByFR := make(map[int32][]imsdb.ReportEntry)
-	for _, row := range reportEntries {
-		entriesByFR[row.FieldReportNumber] = append(entriesByFR[row.FieldReportNumber], row.ReportEntry)
+	resp, errHTTP = fetchFieldReports(req.Context(), action.imsDBQ, event, params, action.attachmentsEnabled)
+	if errHTTP != nil {
+		return resp, "", errHTTP.From("[fetchFieldReports]")
+	}
+	errHTTP = noteConfidentialAttached(req, action.imsDBQ, event.ID, fieldReportIncidents(resp))
+	if errHTTP != nil {
+		return resp, "", errHTTP.From("[noteConfidentialAttached]")
+	}
+	if len(resp) == 0 {
+		return resp, "", nil
+	}
+	return resp, listQ.nextCursor(len(resp), resp[len(resp)-1].Number), nil
+}
+
+// fieldReportsParams reads the GetFieldReports query parameters, which are
+// those in listQuery, plus "incident". The caller sets Author and
+// IncludeGenerated.
+func fieldReportsParams(form url.Values, eventID int32) (imsdb.FieldReportsParams, listQuery, *herr.HTTPError) {
+	listQ, errHTTP := parseListQuery(form)
+	if errHTTP != nil {
+		return imsdb.FieldReportsParams{}, listQ, errHTTP.From("[parseListQuery]")
 	}
+	allIncidents, incidentNumber, errHTTP := parseIncidentFilter(form)
+	if errHTTP != nil {
+		return imsdb.FieldReportsParams{}, listQ, errHTTP.From("[parseIncidentFilter]")
+	}
+	return imsdb.FieldReportsParams{
+		Event:          eventID,
+		AllIncidents:   allIncidents,
+		IncidentNumber: incidentNumber,
+		CreatedAfter:   listQ.createdAfter,
+		CreatedBefore:  listQ.createdBefore,
+		ModifiedAfter:  listQ.modifiedAfter,
+		ModifiedBefore: listQ.modifiedBefore,
+		ChangedAfter:   beforeAllChanges,
+		AfterNumber:    listQ.afterNumber,
+		Limit:          listQ.limit,
+	}, listQ, nil
+}
 
-	storedFRs, err := action.imsDBQ.FieldReports(req.Context(), action.imsDBQ, event.ID)
+// fetchFieldReports returns the Field Reports that the FieldReports query
+// finds for params, each filled out as for GetFieldReports.
+func fetchFieldReports(ctx context.Context, imsDBQ *store.DBQ, event imsdb.Event, params imsdb.FieldReportsParams,
+	attachmentsEnabled bool,
+) (imsjson.FieldReports, *herr.HTTPError) {
+	resp := make(imsjson.FieldReports, 0)
+	storedFRs, err := imsDBQ.FieldReports(ctx, imsDBQ, params)
 	if err != nil {
 		return resp, herr.InternalServerError("Failed to fetch Field Reports", err).From("[FieldReports]")
 	}
+	if len(storedFRs) == 0 {
+		return resp, nil
+	}
+	numbers := make([]int32, len(storedFRs))
+	for i, fr := range storedFRs {
+		numbers[i] = fr.FieldReport.Number
+	}
 
-	var authorizedFRs []imsdb.FieldReportsRow
-	if limitedAccess {
-		for _, storedFR := range storedFRs {
-			entries := entriesByFR[storedFR.FieldReport.Number]
-			if containsAuthor(entries, jwtCtx.Claims.RangerHandle()) {
-				authorizedFRs = append(authorizedFRs, storedFR)
-			}
-		}
-	} else {
-		authorizedFRs = storedFRs
+	reportEntries, err := imsDBQ.FieldReports_ReportEntries(
+		ctx,
+		imsDBQ,
+		imsdb.FieldReports_ReportEntriesParams{
+			Event:              event.ID,
+			Generated:          params.IncludeGenerated,
+			FieldReportNumbers: numbers,
+		},
+	)
+	if err != nil {
+		return resp, herr.InternalServerError("Failed to get FR report entries", err).From("[FieldReports_ReportEntries]")
 	}
 
-	entryJSONsByFR := make(map[int32][]imsdb.ReportEntry)
-	for frNum, entries := range entriesByFR {
-		for _, entry := range entries {
-			entryJSONsByFR[frNum] = append(entryJSONsByFR[frNum], entry)
-		}
+	entriesByFR := make(map[int32][]imsdb.ReportEntry)
+	for _, row := range reportEntries {
+		entriesByFR[row.FieldReportNumber] = append(entriesByFR[row.FieldReportNumber], row.ReportEntry)
 	}
 
-	resp = make(imsjson.FieldReports, 0, len(authorizedFRs))
-	for _, fr := range authorizedFRs {
+	resp = make(imsjson.FieldReports, 0, len(storedFRs))
+	for _, fr := range storedFRs {
 		resp = append(
 			resp,
 			fieldReportToJSON(
 				fr.FieldReport,
-				entryJSONsByFR[fr.FieldReport.Number],
+				entriesByFR[fr.FieldReport.Number],
 				event,
-				action.attachmentsEnabled,
+				attachmentsEnabled,
 			),
 		)
 	}
-
 	return resp, nil
 }
 
+func fieldReportIncidents(fieldReports imsjson.FieldReports) []*int32 {
+	incidents := make([]*int32, len(fieldReports))
+	for i, fr := range fieldReports {
+		incidents[i] = fr.Incident
+	}
+	return incidents
+}
+
 func containsAuthor(entries []imsdb.ReportEntry, author string) bool {
 	for _, e := range entries {
 		if e.Author == author {
@@ -183,6 +241,10 @@ func (action GetFieldReport) getFieldReport(req *http.Request) (imsjson.FieldRep
 			return response, herr.Forbidden("The requestor does not have permission to access this particular Field Report", nil)
 		}
 	}
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, fr.IncidentNumber, eventPermissions)
+	if errHTTP != nil {
+		return response, errHTTP.From("[checkConfidentialIncident]")
+	}
 
 	return fieldReportToJSON(fr, reportEntries, event, action.attachmentsEnabled), nil
 }
@@ -294,11 +356,25 @@ func (action EditFieldReport) editFieldReport(req *http.Request) *herr.HTTPError
 		return herr.InternalServerError("Failed to fetch Field Report", err).From("[FieldReport]")
 	}
 	storedFR := frr.FieldReport
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, storedFR.IncidentNumber, eventPermissions)
+	if errHTTP != nil {
+		return errHTTP.From("[checkConfidentialIncident]")
+	}
 
 	// If there's an "action" in the form, we're either linking or unlinking this FR from an Incident.
 	if queryAction := req.FormValue("action"); queryAction != "" {
 		targetIncidentVal := req.FormValue("incident")
 
+		// Attaching to a confidential Incident needs the same permission as
+		// reading it. handleLinkToIncident deals with an invalid number.
+		if targetIncident, err := conv.ParseInt32(targetIncidentVal); err == nil && queryAction == "attach" {
+			errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID,
+				sql.NullInt32{Int32: targetIncident, Valid: true}, eventPermissions)
+			if errHTTP != nil {
+				return errHTTP.From("[checkConfidentialIncident]")
+			}
+		}
+
 		// TODO: get rid of this "action" framework, and just allow a standard POST, as with visit's incident field.
 		errHTTP = action.handleLinkToIncident(ctx, storedFR, event, queryAction, targetIncidentVal, author)
 		if errHTTP != nil {
@@ -408,6 +484,11 @@ func (action EditFieldReport) updateFieldReportAttempt(
 		return false, errHTTP.From("[addChangeReportEntries]")
 	}
 
+	errHTTP = recordChanges(ctx, action.imsDBQ, txn, changes{eventID: event.ID, fieldReports: []int32{storedFR.Number}})
+	if errHTTP != nil {
+		return false, errHTTP.From("[recordChanges]")
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return false, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
@@ -444,30 +525,60 @@ func (action EditFieldReport) handleLinkToIncident(
 	default:
 		return herr.BadRequest("Invalid action", fmt.Errorf("provided bad action was %v", queryAction))
 	}
-	err := action.imsDBQ.AttachFieldReportToIncident(ctx, action.imsDBQ,
-		imsdb.AttachFieldReportToIncidentParams{
-			IncidentNumber: newIncident,
-			Event:          event.ID,
-			Number:         fieldReportNumber,
-		},
-	)
-	if err != nil {
-		const mySQLErNoReferencedRow2 = 1452
-		mysqlErr, ok := errors.AsType[*mysql.MySQLError](err)
-		if ok && mysqlErr.Number == mySQLErNoReferencedRow2 {
-			return herr.NotFound("No such Incident", err).From("[AttachFieldReportToIncident]")
+	// This is a transaction only so that the change feed picks up the Field
+	// Report and both Incidents together; see recordChanges.
+	errHTTP := retryOnDeadlockErr(func() *herr.HTTPError {
+		txn, err := action.imsDBQ.Begin()
+		if err != nil {
+			return herr.InternalServerError("Failed to begin transaction", err).From("[Begin]")
 		}
-		return herr.InternalServerError("Failed to attach Field Report to incident", err).From("[AttachFieldReportToIncident]")
-	}
-	_, errHTTP := addFRReportEntry(ctx, action.imsDBQ, action.imsDBQ, event.ID, fieldReportNumber, newReportEntry{
-		author:    actor,
-		text:      entryText,
-		generated: true,
+		defer rollback(txn)
+
+		err = action.imsDBQ.AttachFieldReportToIncident(ctx, txn,
+			imsdb.AttachFieldReportToIncidentParams{
+				IncidentNumber: newIncident,
+				Event:          event.ID,
+				Number:         fieldReportNumber,
+			},
+		)
+		if err != nil {
+			const mySQLErNoReferencedRow2 = 1452
+			mysqlErr, ok := errors.AsType[*mysql.MySQLError](err)
+			if ok && mysqlErr.Number == mySQLErNoReferencedRow2 {
+				return herr.NotFound("No such Incident", err).From("[AttachFieldReportToIncident]")
+			}
+			return herr.InternalServerError("Failed to attach Field Report to incident", err).From("[AttachFieldReportToIncident]")
+		}
+		_, errHTTP := addFRReportEntry(ctx, action.imsDBQ, txn, event.ID, fieldReportNumber, newReportEntry{
+			author:    actor,
+			text:      entryText,
+			generated: true,
+		})
+		if errHTTP != nil {
+			return errHTTP.From("[addFRReportEntry]")
+		}
+		errHTTP = recordChanges(ctx, action.imsDBQ, txn, changes{
+			eventID:      event.ID,
+			incidents:    []int32{previousIncident.Int32, newIncident.Int32},
+			fieldReports: []int32{fieldReportNumber},
+		})
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
+		err = txn.Commit()
+		if err != nil {
+			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		}
+		return nil
 	})
 	if errHTTP != nil {
-		return errHTTP.From("[addFRReportEntry]")
+		return errHTTP
 	}
-	defer action.eventSource.notifyFieldReportUpdate(event.ID, fieldReportNumber)
+	triggers := []webhookTrigger{triggerFieldReportUpdated}
+	if newIncident.Valid {
+		triggers = append(triggers, triggerFieldReportAttached)
+	}
+	defer action.eventSource.notifyFieldReportUpdate(event.ID, fieldReportNumber, triggers...)
 	defer action.eventSource.notifyIncidentUpdates(event.ID, previousIncident.Int32, newIncident.Int32)
 	// #nosec G706 // log injection
 	slog.Info("Attached Field Report to newIncident",
@@ -592,6 +703,11 @@ func (action NewFieldReport) newFieldReport(req *http.Request) (frNumber int32,
 			return none, errHTTP.From("[addChangeReportEntries]")
 		}
 
+		errHTTP = recordChanges(ctx, action.imsDBQ, txn, changes{eventID: event.ID, fieldReports: []int32{fr.Number}})
+		if errHTTP != nil {
+			return none, errHTTP.From("[recordChanges]")
+		}
+
 		err = txn.Commit()
 		if err != nil {
 			return none, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
@@ -603,6 +719,6 @@ func (action NewFieldReport) newFieldReport(req *http.Request) (frNumber int32,
 	}
 
 	loc := fmt.Sprintf("/ims/api/events/%v/field_reports/%v", event.Name, fr.Number)
-	defer action.eventSource.notifyFieldReportUpdate(event.ID, fr.Number)
+	defer action.eventSource.notifyFieldReportUpdate(event.ID, fr.Number, triggerFieldReportCreated)
 	return fr.Number, loc, nil
 }
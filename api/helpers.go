@@ -288,6 +288,9 @@ func getGlobalPermissions(req *http.Request, imsDBQ *store.DBQ, userStore *direc
 func permissionsByEvent(ctx context.Context, jwtCtx JWTContext, imsDBQ *store.DBQ, userStore *directory.UserStore, imsAdmins []string) (
 	map[int32]authz.EventPermissionMask, *herr.HTTPError,
 ) {
+	if apiToken := jwtCtx.Claims.APIToken(); apiToken != nil {
+		return apiToken.PermissionsByEvent(), nil
+	}
 	// This query doesn't know about parent groups. We'll start by accumulating EventAccesses directly referencing
 	// events, then worry about parent groups below.
 	accessRows, err := imsDBQ.EventAccessAll(ctx, imsDBQ)
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"slices"
 	"strconv"
 	"strings"
@@ -46,41 +47,82 @@ type GetIncidents struct {
 }
 
 func (action GetIncidents) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	resp, errHTTP := action.getIncidents(req)
+	resp, nextCursor, errHTTP := action.getIncidents(req)
 	if errHTTP != nil {
 		errHTTP.From("[getIncidents]").WriteResponse(w)
 		return
 	}
+	if nextCursor != "" {
+		w.Header().Set(NextCursorHeader, nextCursor)
+	}
 	mustWriteJSON(w, req, resp)
 }
 
-func (action GetIncidents) getIncidents(req *http.Request) (imsjson.Incidents, *herr.HTTPError) {
-	resp := make(imsjson.Incidents, 0)
+func (action GetIncidents) getIncidents(req *http.Request) (resp imsjson.Incidents, nextCursor string, errHTTP *herr.HTTPError) {
+	resp = make(imsjson.Incidents, 0)
 	event, _, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
 	if errHTTP != nil {
-		return resp, errHTTP.From("[getEventPermissions]")
+		return resp, "", errHTTP.From("[getEventPermissions]")
 	}
 	if eventPermissions&authz.EventReadIncidents == 0 {
-		return nil, herr.Forbidden("The requestor does not have EventReadIncidents permission", nil)
+		return nil, "", herr.Forbidden("The requestor does not have EventReadIncidents permission", nil)
 	}
 	err := req.ParseForm()
 	if err != nil {
-		return nil, herr.BadRequest("Failed to parse form", err)
+		return nil, "", herr.BadRequest("Failed to parse form", err)
 	}
 	includeSystemEntries := !strings.EqualFold(req.Form.Get("exclude_system_entries"), "true")
+	params, listQ, errHTTP := incidentsParams(req.Form, event.ID)
+	if errHTTP != nil {
+		return nil, "", errHTTP.From("[incidentsParams]")
+	}
+	params.IncludeConfidential = canReadConfidential(eventPermissions)
+
+	resp, errHTTP = fetchIncidents(req.Context(), action.imsDBQ, event, params, includeSystemEntries, action.attachmentsEnabled)
+	if errHTTP != nil {
+		return resp, "", errHTTP.From("[fetchIncidents]")
+	}
+	noteConfidentialIncidents(req, resp)
+	if len(resp) == 0 {
+		return resp, "", nil
+	}
+	return resp, listQ.nextCursor(len(resp), resp[len(resp)-1].Number), nil
+}
+
+// fetchIncidents returns the Incidents that the Incidents query finds for
+// params, each filled out as for GetIncidents.
+func fetchIncidents(ctx context.Context, imsDBQ *store.DBQ, event imsdb.Event, params imsdb.IncidentsParams,
+	includeSystemEntries, attachmentsEnabled bool,
+) (imsjson.Incidents, *herr.HTTPError) {
+	resp := make(imsjson.Incidents, 0)
+
+	// The filtering and paging all happen in the Incidents query. The other
+	// queries then need only fetch the rest of the Incidents it found.
+	incidentsRows, err := imsDBQ.Incidents(ctx, imsDBQ, params)
+	if err != nil {
+		return resp, herr.InternalServerError("Failed to fetch Incidents", err).From("[Incidents]")
+	}
+	if len(incidentsRows) == 0 {
+		return resp, nil
+	}
+	numbers := make([]int32, len(incidentsRows))
+	for i, r := range incidentsRows {
+		numbers[i] = r.Incident.Number
+	}
 
-	// The Incidents and ReportEntries queries both request a lot of data, and we can query
-	// and process those results concurrently.
-	group, groupCtx := errgroup.WithContext(req.Context())
+	// The ReportEntries query requests a lot of data, and we can query and
+	// process those results concurrently with the others.
+	group, groupCtx := errgroup.WithContext(ctx)
 
 	entriesByIncident := make(map[int32][]imsdb.ReportEntry)
 	group.Go(func() error {
-		reportEntries, err := action.imsDBQ.Incidents_ReportEntries(
+		reportEntries, err := imsDBQ.Incidents_ReportEntries(
 			groupCtx,
-			action.imsDBQ,
+			imsDBQ,
 			imsdb.Incidents_ReportEntriesParams{
-				Event:     event.ID,
-				Generated: includeSystemEntries,
+				Event:           event.ID,
+				Generated:       includeSystemEntries,
+				IncidentNumbers: numbers,
 			},
 		)
 		if err != nil {
@@ -97,7 +139,10 @@ func (action GetIncidents) getIncidents(req *http.Request) (imsjson.Incidents, *
 
 	rangersByIncident := make(map[int32][]imsdb.IncidentRanger)
 	group.Go(func() error {
-		rangersRows, err := action.imsDBQ.Incidents_Rangers(groupCtx, action.imsDBQ, event.ID)
+		rangersRows, err := imsDBQ.Incidents_Rangers(groupCtx, imsDBQ, imsdb.Incidents_RangersParams{
+			Event:           event.ID,
+			IncidentNumbers: numbers,
+		})
 		if err != nil {
 			return herr.InternalServerError("Failed to fetch rangers", err).From("[Incidents_Rangers]")
 		}
@@ -107,12 +152,18 @@ func (action GetIncidents) getIncidents(req *http.Request) (imsjson.Incidents, *
 		return nil
 	})
 
-	var incidentsRows []imsdb.IncidentsRow
+	stateChangesByIncident := make(map[int32][]imsdb.IncidentStateChange)
 	group.Go(func() error {
-		var err error
-		incidentsRows, err = action.imsDBQ.Incidents(groupCtx, action.imsDBQ, event.ID)
+		stateChangeRows, err := imsDBQ.Incidents_StateChanges(groupCtx, imsDBQ, imsdb.Incidents_StateChangesParams{
+			Event:           event.ID,
+			IncidentNumbers: numbers,
+		})
 		if err != nil {
-			return herr.InternalServerError("Failed to fetch Incidents", err).From("[Incidents]")
+			return herr.InternalServerError("Failed to fetch state changes", err).From("[Incidents_StateChanges]")
+		}
+		for _, row := range stateChangeRows {
+			sc := row.IncidentStateChange
+			stateChangesByIncident[sc.IncidentNumber] = append(stateChangesByIncident[sc.IncidentNumber], sc)
 		}
 		return nil
 	})
@@ -131,7 +182,7 @@ func (action GetIncidents) getIncidents(req *http.Request) (imsjson.Incidents, *
 		// we don't bother looking up linked incidents for the GetIncidents call
 		var emptyLinkedIncidents []imsdb.Incident_LinkedIncidentsRow
 
-		incJSON, errHTTP := incidentToJSON(incidentRow, rangersByIncident[r.Incident.Number], entriesByIncident[r.Incident.Number], emptyLinkedIncidents, event, action.attachmentsEnabled)
+		incJSON, errHTTP := incidentToJSON(incidentRow, rangersByIncident[r.Incident.Number], entriesByIncident[r.Incident.Number], emptyLinkedIncidents, stateChangesByIncident[r.Incident.Number], event, attachmentsEnabled)
 		if errHTTP != nil {
 			return resp, errHTTP.From("[incidentToJSON]")
 		}
@@ -141,6 +192,63 @@ func (action GetIncidents) getIncidents(req *http.Request) (imsjson.Incidents, *
 	return resp, nil
 }
 
+// noteConfidentialIncidents notes the access if any of the Incidents is
+// confidential.
+func noteConfidentialIncidents(req *http.Request, incidents imsjson.Incidents) {
+	if slices.ContainsFunc(incidents, func(incident imsjson.Incident) bool {
+		return incident.Confidential != nil && *incident.Confidential
+	}) {
+		noteConfidentialAccess(req)
+	}
+}
+
+// incidentsParams reads the GetIncidents query parameters. Besides those in
+// listQuery, these are "state" and "priority", each of which may list several
+// values, plus "incident_type" (an ID) and "ranger" (a handle).
+func incidentsParams(form url.Values, eventID int32) (imsdb.IncidentsParams, listQuery, *herr.HTTPError) {
+	listQ, errHTTP := parseListQuery(form)
+	if errHTTP != nil {
+		return imsdb.IncidentsParams{}, listQ, errHTTP.From("[parseListQuery]")
+	}
+	params := imsdb.IncidentsParams{
+		Event:          eventID,
+		CreatedAfter:   listQ.createdAfter,
+		CreatedBefore:  listQ.createdBefore,
+		ModifiedAfter:  listQ.modifiedAfter,
+		ModifiedBefore: listQ.modifiedBefore,
+		ChangedAfter:   beforeAllChanges,
+		AfterNumber:    listQ.afterNumber,
+		Limit:          listQ.limit,
+	}
+	for _, v := range formList(form, "state") {
+		state := imsdb.IncidentState(v)
+		if !state.Valid() {
+			return params, listQ, herr.BadRequest(fmt.Sprintf("Invalid state %q", v), nil)
+		}
+		params.States = append(params.States, state)
+	}
+	params.AllStates = len(params.States) == 0
+	for _, v := range formList(form, "priority") {
+		priority, err := strconv.ParseInt(v, 10, 8)
+		if err != nil {
+			return params, listQ, herr.BadRequest(fmt.Sprintf("Invalid priority %q", v), err).From("[ParseInt]")
+		}
+		params.Priorities = append(params.Priorities, int8(priority))
+	}
+	params.AllPriorities = len(params.Priorities) == 0
+	if v := form.Get("incident_type"); v != "" {
+		typeID, err := conv.ParseInt32(v)
+		if err != nil {
+			return params, listQ, herr.BadRequest("Invalid incident_type", err).From("[ParseInt32]")
+		}
+		params.IncidentType = sql.NullInt32{Int32: typeID, Valid: true}
+	}
+	if v := form.Get("ranger"); v != "" {
+		params.RangerHandle = sql.NullString{String: v, Valid: true}
+	}
+	return params, listQ, nil
+}
+
 type GetIncident struct {
 	imsDBQ             *store.DBQ
 	userStore          *directory.UserStore
@@ -164,27 +272,55 @@ func (action GetIncident) getIncident(req *http.Request) (imsjson.Incident, *her
 	if errHTTP != nil {
 		return resp, errHTTP.From("[getEventPermissions]")
 	}
-	if eventPermissions&authz.EventReadIncidents == 0 {
-		return resp, herr.Forbidden("The requestor does not have EventReadIncidents permission on this Event", nil)
-	}
 	ctx := req.Context()
 
 	incidentNumber, err := conv.ParseInt32(req.PathValue("incidentNumber"))
 	if err != nil {
 		return resp, herr.BadRequest("Failed to parse incident number", err)
 	}
+	if eventPermissions&authz.EventReadIncidents == 0 {
+		brokeGlass, errHTTP := breakGlassActive(ctx, action.imsDBQ, event.ID, jwt.Claims.RangerHandle(), breakGlassIncident, incidentNumber)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[breakGlassActive]")
+		}
+		if !brokeGlass {
+			return resp, herr.Forbidden("The requestor does not have EventReadIncidents permission on this Event", nil)
+		}
+	}
 
-	storedRow, reportEntries, errHTTP := fetchIncident(ctx, action.imsDBQ, event.ID, incidentNumber)
+	resp, errHTTP = loadIncident(ctx, action.imsDBQ, event, incidentNumber, action.attachmentsEnabled)
 	if errHTTP != nil {
-		return resp, errHTTP.From("[fetchIncident]")
+		return resp, errHTTP.From("[loadIncident]")
+	}
+	// Break-glass access doesn't extend to confidential Incidents.
+	errHTTP = allowConfidential(req, *resp.Confidential, eventPermissions)
+	if errHTTP != nil {
+		return imsjson.Incident{}, errHTTP.From("[allowConfidential]")
 	}
 
-	permsByEvent, errHTTP := permissionsByEvent(req.Context(), jwt, action.imsDBQ, action.userStore, action.imsAdmins)
+	permsByEvent, errHTTP := permissionsByEvent(ctx, jwt, action.imsDBQ, action.userStore, action.imsAdmins)
 	if errHTTP != nil {
 		return resp, errHTTP.From("[permissionsByEvent]")
 	}
+	resp, _ = redactLinkedIncidents(resp, permsByEvent)
+	return resp, nil
+}
 
-	rangersRows, err := action.imsDBQ.Incident_Rangers(ctx, action.imsDBQ, imsdb.Incident_RangersParams{
+// loadIncident builds the full JSON representation of an Incident, as it's
+// served by GetIncident and pushed over the EventSource. The summaries of all
+// linked Incidents are included, so callers must pass the result through
+// redactLinkedIncidents for the requestor before handing it out.
+func loadIncident(ctx context.Context, imsDBQ *store.DBQ, event imsdb.Event, incidentNumber int32, attachmentsEnabled bool) (
+	imsjson.Incident, *herr.HTTPError,
+) {
+	var resp imsjson.Incident
+
+	storedRow, reportEntries, errHTTP := fetchIncident(ctx, imsDBQ, event.ID, incidentNumber)
+	if errHTTP != nil {
+		return resp, errHTTP.From("[fetchIncident]")
+	}
+
+	rangersRows, err := imsDBQ.Incident_Rangers(ctx, imsDBQ, imsdb.Incident_RangersParams{
 		Event:          event.ID,
 		IncidentNumber: incidentNumber,
 	})
@@ -196,29 +332,61 @@ func (action GetIncident) getIncident(req *http.Request) (imsjson.Incident, *her
 		rangers[i] = row.IncidentRanger
 	}
 
-	linkedIncidents, err := action.imsDBQ.Incident_LinkedIncidents(ctx, action.imsDBQ, imsdb.Incident_LinkedIncidentsParams{
+	linkedIncidents, err := imsDBQ.Incident_LinkedIncidents(ctx, imsDBQ, imsdb.Incident_LinkedIncidentsParams{
 		Event1:          event.ID,
 		IncidentNumber1: incidentNumber,
 	})
 	if err != nil {
 		return resp, herr.InternalServerError("Failed to fetch linked incidents", err)
 	}
-	for i := range linkedIncidents {
-		if permsByEvent[linkedIncidents[i].LinkedEvent]&authz.EventReadIncidents == 0 {
-			linkedIncidents[i].LinkedIncidentSummary = sql.NullString{}
-		}
+
+	stateChangeRows, err := imsDBQ.Incident_StateChanges(ctx, imsDBQ, imsdb.Incident_StateChangesParams{
+		Event:          event.ID,
+		IncidentNumber: incidentNumber,
+	})
+	if err != nil {
+		return resp, herr.InternalServerError("Failed to fetch state changes", err).From("[Incident_StateChanges]")
+	}
+	stateChanges := make([]imsdb.IncidentStateChange, len(stateChangeRows))
+	for i, row := range stateChangeRows {
+		stateChanges[i] = row.IncidentStateChange
 	}
 
-	resp, errHTTP = incidentToJSON(storedRow, rangers, reportEntries, linkedIncidents, event, action.attachmentsEnabled)
+	resp, errHTTP = incidentToJSON(storedRow, rangers, reportEntries, linkedIncidents, stateChanges, event, attachmentsEnabled)
 	if errHTTP != nil {
 		return resp, errHTTP.From("[incidentToJSON]")
 	}
 	return resp, nil
 }
 
+// redactLinkedIncidents blanks the summaries of linked Incidents in Events on
+// which the requestor doesn't have EventReadIncidents, and of confidential ones
+// in Events on which they don't have EventReadConfidential, and reports whether
+// it had to. The Incident passed in is left untouched, so it may be shared.
+func redactLinkedIncidents(incident imsjson.Incident, permsByEvent map[int32]authz.EventPermissionMask) (imsjson.Incident, bool) {
+	if incident.LinkedIncidents == nil {
+		return incident, false
+	}
+	redacted := false
+	linked := slices.Clone(*incident.LinkedIncidents)
+	for i := range linked {
+		perms := permsByEvent[linked[i].EventID]
+		readable := perms&authz.EventReadIncidents != 0 && (!linked[i].Confidential || canReadConfidential(perms))
+		if linked[i].Summary != "" && !readable {
+			linked[i].Summary = ""
+			redacted = true
+		}
+	}
+	if !redacted {
+		return incident, false
+	}
+	incident.LinkedIncidents = &linked
+	return incident, true
+}
+
 func incidentToJSON(storedRow imsdb.IncidentRow, incidentRangers []imsdb.IncidentRanger,
 	reportEntries []imsdb.ReportEntry, linkedIncidents []imsdb.Incident_LinkedIncidentsRow,
-	event imsdb.Event, attachmentsEnabled bool,
+	stateChanges []imsdb.IncidentStateChange, event imsdb.Event, attachmentsEnabled bool,
 ) (imsjson.Incident, *herr.HTTPError) {
 	var resp imsjson.Incident
 	resultEntries := make([]imsjson.ReportEntry, len(reportEntries))
@@ -229,10 +397,11 @@ func incidentToJSON(storedRow imsdb.IncidentRow, incidentRangers []imsdb.Inciden
 	linkedIncidentJson := make([]imsjson.LinkedIncident, len(linkedIncidents))
 	for i, li := range linkedIncidents {
 		linkedIncidentJson[i] = imsjson.LinkedIncident{
-			EventID:   li.LinkedEvent,
-			EventName: li.LinkedEventName,
-			Number:    li.LinkedIncident,
-			Summary:   li.LinkedIncidentSummary.String,
+			EventID:      li.LinkedEvent,
+			EventName:    li.LinkedEventName,
+			Number:       li.LinkedIncident,
+			Summary:      li.LinkedIncidentSummary.String,
+			Confidential: li.LinkedIncidentConfidential,
 		}
 	}
 
@@ -244,6 +413,15 @@ func incidentToJSON(storedRow imsdb.IncidentRow, incidentRangers []imsdb.Inciden
 		}
 	}
 
+	stateChangesJson := make([]imsjson.IncidentStateChange, len(stateChanges))
+	for i, sc := range stateChanges {
+		stateChangesJson[i] = imsjson.IncidentStateChange{
+			State:   string(sc.State),
+			Author:  sc.Author,
+			Created: conv.FloatToTime(sc.Created),
+		}
+	}
+
 	incidentTypeIDs, fieldReportNumbers, visitNumbers, err := readExtraIncidentRowFields(storedRow)
 	if err != nil {
 		return resp, herr.InternalServerError("Failed to fetch Incident details", err).From("[readExtraIncidentRowFields]")
@@ -278,6 +456,9 @@ func incidentToJSON(storedRow imsdb.IncidentRow, incidentRangers []imsdb.Inciden
 		Rangers:         &rangersJson,
 		ReportEntries:   resultEntries,
 		LinkedIncidents: &linkedIncidentJson,
+		MergedInto:      conv.SqlToInt32(storedRow.Incident.MergedInto),
+		StateChanges:    &stateChangesJson,
+		Confidential:    new(storedRow.Incident.Confidential),
 	}
 	return resp, nil
 }
@@ -345,6 +526,10 @@ func (action NewIncident) newIncident(req *http.Request) (incidentNumber int32,
 	if errHTTP != nil {
 		return 0, "", errHTTP.From("[readBodyAs]")
 	}
+	errHTTP = allowConfidential(req, newIncident.Confidential != nil && *newIncident.Confidential, eventPermissions)
+	if errHTTP != nil {
+		return 0, "", errHTTP.From("[allowConfidential]")
+	}
 
 	author := jwtCtx.Claims.RangerHandle()
 
@@ -383,7 +568,7 @@ func (action NewIncident) newIncident(req *http.Request) (incidentNumber int32,
 	newIncident.Event = event.Name
 	newIncident.Number = newIncidentNumber
 
-	errHTTP = updateIncident(ctx, action.imsDBQ, action.es, newIncident, author, event.NormalizeAddresses)
+	errHTTP = updateIncident(ctx, action.imsDBQ, action.es, newIncident, author, event.NormalizeAddresses, triggerIncidentCreated)
 	if errHTTP != nil {
 		return 0, "", errHTTP.From("[updateIncident]")
 	}
@@ -450,8 +635,11 @@ func rejectSetReplacement(newIncident imsjson.Incident) *herr.HTTPError {
 	return herr.BadRequest(msg, nil).SetExpectedError()
 }
 
+// updateIncident applies newIncident to the stored Incident. The trigger is
+// triggerIncidentCreated when this fills in a brand-new Incident, and otherwise
+// triggerIncidentUpdated.
 func updateIncident(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcerer, newIncident imsjson.Incident, author string,
-	normalizeAddresses bool,
+	normalizeAddresses bool, trigger webhookTrigger,
 ) *herr.HTTPError {
 	errHTTP := rejectSetReplacement(newIncident)
 	if errHTTP != nil {
@@ -459,7 +647,7 @@ func updateIncident(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcerer,
 	}
 	for range maxCASAttempts {
 		conflict, errHTTP := retryOnDeadlock(func() (bool, *herr.HTTPError) {
-			return updateIncidentAttempt(ctx, imsDBQ, es, newIncident, author, normalizeAddresses)
+			return updateIncidentAttempt(ctx, imsDBQ, es, newIncident, author, normalizeAddresses, trigger)
 		})
 		if errHTTP != nil {
 			return errHTTP.From("[updateIncidentAttempt]")
@@ -472,7 +660,7 @@ func updateIncident(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcerer,
 }
 
 func updateIncidentAttempt(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcerer, newIncident imsjson.Incident, author string,
-	normalizeAddresses bool,
+	normalizeAddresses bool, trigger webhookTrigger,
 ) (conflict bool, errHTTP *herr.HTTPError) {
 	storedIncidentRow, err := imsDBQ.Incident(ctx, imsDBQ,
 		imsdb.IncidentParams{
@@ -525,18 +713,40 @@ func updateIncidentAttempt(ctx context.Context, imsDBQ *store.DBQ, es *EventSour
 		}
 	}
 
+	// buildIncidentUpdate logs a state change even when the state doesn't
+	// actually move, but the history only wants real transitions.
+	triggers := []webhookTrigger{trigger}
+	if update.State != storedIncident.State {
+		triggers = append(triggers, triggerIncidentStateChanged)
+		err = imsDBQ.AddIncidentStateChange(ctx, txn, imsdb.AddIncidentStateChangeParams{
+			Event:          newIncident.EventID,
+			IncidentNumber: newIncident.Number,
+			State:          imsdb.IncidentStateChangeState(update.State),
+			Author:         author,
+			Created:        conv.TimeToFloat(time.Now()),
+		})
+		if err != nil {
+			return false, herr.InternalServerError("Failed to record state change", err).From("[AddIncidentStateChange]")
+		}
+	}
+
 	errHTTP = addChangeReportEntries(ctx, imsDBQ, txn, newIncident.EventID, newIncident.Number, author,
 		logs, newIncident.ReportEntries, addIncidentReportEntry)
 	if errHTTP != nil {
 		return false, errHTTP.From("[addChangeReportEntries]")
 	}
 
+	errHTTP = recordChanges(ctx, imsDBQ, txn, changes{eventID: newIncident.EventID, incidents: []int32{newIncident.Number}})
+	if errHTTP != nil {
+		return false, errHTTP.From("[recordChanges]")
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return false, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
 	}
 
-	es.notifyIncidentUpdate(newIncident.EventID, newIncident.Number)
+	es.notifyIncidentUpdate(newIncident.EventID, newIncident.Number, triggers...)
 
 	return false, nil
 }
@@ -558,6 +768,7 @@ func buildIncidentUpdate(stored imsdb.Incident, newIncident imsjson.Incident, no
 		LocationName:        stored.LocationName,
 		LocationAddress:     stored.LocationAddress,
 		LocationDescription: stored.LocationDescription,
+		Confidential:        stored.Confidential,
 	}
 
 	var logs []string
@@ -583,6 +794,10 @@ func buildIncidentUpdate(stored imsdb.Incident, newIncident imsjson.Incident, no
 	applyStringChange(&update.LocationName, newIncident.Location.Name, "location name", &logs)
 	applyStringChange(&update.LocationAddress, normalizedAddress(newIncident.Location.Address, normalizeAddresses), "location address", &logs)
 	applyStringChange(&update.LocationDescription, newIncident.Location.Description, "location description", &logs)
+	if newIncident.Confidential != nil && *newIncident.Confidential != stored.Confidential {
+		update.Confidential = *newIncident.Confidential
+		logs = append(logs, fmt.Sprintf("Changed confidential: %v", update.Confidential))
+	}
 
 	return update, logs
 }
@@ -631,13 +846,24 @@ func (action EditIncident) editIncident(req *http.Request) *herr.HTTPError {
 	if errHTTP != nil {
 		return errHTTP.From("[readBodyAs]")
 	}
+	// Marking an Incident confidential, or not, takes the same permission as
+	// editing a confidential one does.
+	confidential, errHTTP := incidentConfidential(ctx, action.imsDBQ, event.ID, sql.NullInt32{Int32: incidentNumber, Valid: true})
+	if errHTTP != nil {
+		return errHTTP.From("[incidentConfidential]")
+	}
+	remarking := newIncident.Confidential != nil && *newIncident.Confidential != confidential
+	errHTTP = allowConfidential(req, confidential || remarking, eventPermissions)
+	if errHTTP != nil {
+		return errHTTP.From("[allowConfidential]")
+	}
 	newIncident.Event = event.Name
 	newIncident.EventID = event.ID
 	newIncident.Number = incidentNumber
 
 	author := jwtCtx.Claims.RangerHandle()
 
-	errHTTP = updateIncident(ctx, action.imsDBQ, action.es, newIncident, author, event.NormalizeAddresses)
+	errHTTP = updateIncident(ctx, action.imsDBQ, action.es, newIncident, author, event.NormalizeAddresses, triggerIncidentUpdated)
 	if errHTTP != nil {
 		return errHTTP.From("[updateIncident]")
 	}
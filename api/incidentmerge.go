@@ -0,0 +1,469 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+// MergeIncident folds a duplicate Incident into the Incident named in the
+// path (the survivor). Everything attached to the duplicate moves over to the
+// survivor: report entries, Rangers, Incident Types, links to other Incidents,
+// Field Reports and Visits. The duplicate is then closed, and its MERGED_INTO
+// column is pointed at the survivor so that clients can redirect.
+//
+// All of that happens in one transaction, gated on the duplicate's version in
+// the same way as an edit. The survivor's own columns aren't written, so its
+// version doesn't move.
+type MergeIncident struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	es        *EventSourcerer
+	imsAdmins []string
+}
+
+func (action MergeIncident) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.mergeIncident(req)
+	if errHTTP != nil {
+		errHTTP.From("[mergeIncident]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action MergeIncident) mergeIncident(req *http.Request) *herr.HTTPError {
+	event, jwtCtx, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[getEventPermissions]")
+	}
+	if eventPermissions&authz.EventWriteIncidents == 0 {
+		return herr.Forbidden("The requestor does not have EventWriteIncidents permission for this Event", nil)
+	}
+	survivor, err := conv.ParseInt32(req.PathValue("incidentNumber"))
+	if err != nil {
+		return herr.BadRequest("Invalid Incident Number", err).From("[ParseInt32]")
+	}
+	mergeReq, errHTTP := readBodyAs[imsjson.IncidentMerge](req)
+	if errHTTP != nil {
+		return errHTTP.From("[readBodyAs]")
+	}
+	if mergeReq.Duplicate == survivor {
+		return herr.BadRequest("An Incident cannot be merged into itself", nil)
+	}
+	for _, number := range []int32{survivor, mergeReq.Duplicate} {
+		errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, sql.NullInt32{Int32: number, Valid: true}, eventPermissions)
+		if errHTTP != nil {
+			return errHTTP.From("[checkConfidentialIncident]")
+		}
+	}
+
+	m := incidentMerge{
+		imsDBQ:           action.imsDBQ,
+		event:            event,
+		survivor:         survivor,
+		duplicate:        mergeReq.Duplicate,
+		author:           jwtCtx.Claims.RangerHandle(),
+		eventPermissions: eventPermissions,
+	}
+	var result incidentMergeResult
+	for range maxCASAttempts {
+		result, errHTTP = retryOnDeadlock(func() (incidentMergeResult, *herr.HTTPError) {
+			return m.attempt(req.Context())
+		})
+		if errHTTP != nil {
+			return errHTTP.From("[attempt]")
+		}
+		if !result.conflict {
+			break
+		}
+	}
+	if result.conflict {
+		return herr.Conflict("The incident is being modified concurrently. Please try again.", nil)
+	}
+
+	action.es.notifyIncidentUpdate(event.ID, survivor)
+	if result.duplicateClosed {
+		action.es.notifyIncidentUpdate(event.ID, m.duplicate, triggerIncidentUpdated, triggerIncidentStateChanged)
+	} else {
+		action.es.notifyIncidentUpdate(event.ID, m.duplicate)
+	}
+	for _, peer := range result.linkedPeers {
+		action.es.notifyIncidentUpdate(peer.LinkedEvent, peer.LinkedIncident)
+	}
+	for _, fr := range result.fieldReports {
+		// These moved from the duplicate to the survivor.
+		action.es.notifyFieldReportUpdate(event.ID, fr, triggerFieldReportUpdated, triggerFieldReportAttached)
+	}
+	for _, visit := range result.visits {
+		action.es.notifyVisitUpdate(event.ID, visit)
+	}
+	return nil
+}
+
+// incidentMerge holds the inputs to one merge, which may need more than one
+// attempt.
+type incidentMerge struct {
+	imsDBQ           *store.DBQ
+	event            imsdb.Event
+	survivor         int32
+	duplicate        int32
+	author           string
+	eventPermissions authz.EventPermissionMask
+}
+
+// incidentMergeResult reports what a merge attempt moved, so that notifications
+// can be sent once it has committed.
+type incidentMergeResult struct {
+	conflict bool
+	// duplicateClosed is whether the merge closed the duplicate, i.e. it
+	// wasn't closed already.
+	duplicateClosed bool
+	linkedPeers     []imsdb.Incident_LinkedIncidentsRow
+	fieldReports    []int32
+	visits          []int32
+}
+
+func (m incidentMerge) attempt(ctx context.Context) (incidentMergeResult, *herr.HTTPError) {
+	var result incidentMergeResult
+	imsDBQ := m.imsDBQ
+
+	survivorRow, errHTTP := readIncidentRow(ctx, imsDBQ, incidentRelationRequest{event: m.event, number: m.survivor})
+	if errHTTP != nil {
+		return result, errHTTP.From("[readIncidentRow]")
+	}
+	duplicateRow, errHTTP := readIncidentRow(ctx, imsDBQ, incidentRelationRequest{event: m.event, number: m.duplicate})
+	if errHTTP != nil {
+		return result, errHTTP.From("[readIncidentRow]")
+	}
+	if survivorRow.Incident.MergedInto.Valid {
+		return result, herr.BadRequest(fmt.Sprintf(
+			"Incident #%v was itself merged into #%v", m.survivor, survivorRow.Incident.MergedInto.Int32), nil,
+		).SetExpectedError()
+	}
+	if duplicateRow.Incident.MergedInto.Valid {
+		return result, herr.BadRequest(fmt.Sprintf(
+			"Incident #%v was already merged into #%v", m.duplicate, duplicateRow.Incident.MergedInto.Int32), nil,
+		).SetExpectedError()
+	}
+
+	// The duplicate's entries would otherwise become readable by anyone who
+	// may read the survivor.
+	if duplicateRow.Incident.Confidential && !survivorRow.Incident.Confidential {
+		return result, herr.BadRequest(fmt.Sprintf(
+			"Incident #%v is confidential, so #%v must be marked confidential first", m.duplicate, m.survivor), nil,
+		).SetExpectedError()
+	}
+
+	survivorTypes, _, _, err := readExtraIncidentRowFields(survivorRow)
+	if err != nil {
+		return result, herr.InternalServerError("Failed to read Incident details", err).From("[readExtraIncidentRowFields]")
+	}
+	duplicateTypes, duplicateFRs, duplicateVisits, err := readExtraIncidentRowFields(duplicateRow)
+	if err != nil {
+		return result, herr.InternalServerError("Failed to read Incident details", err).From("[readExtraIncidentRowFields]")
+	}
+	// Moving a Field Report or a Visit is an edit to it, so the requestor needs
+	// permission for that too.
+	if len(duplicateFRs) > 0 && m.eventPermissions&authz.EventWriteAllFieldReports == 0 {
+		return result, herr.Forbidden("The requestor does not have EventWriteAllFieldReports permission for this Event", nil)
+	}
+	if len(duplicateVisits) > 0 && m.eventPermissions&authz.EventWriteVisits == 0 {
+		return result, herr.Forbidden("The requestor does not have EventWriteVisits permission for this Event", nil)
+	}
+
+	txn, err := imsDBQ.Begin()
+	if err != nil {
+		return result, herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+	}
+	defer rollback(txn)
+
+	// The read of the survivor above was only a plain one. Now that it's locked,
+	// make sure that it still hasn't been merged into something else.
+	survivorMergedInto, err := imsDBQ.LockMergeSurvivor(ctx, txn, imsdb.LockMergeSurvivorParams{
+		Event:  m.event.ID,
+		Number: m.survivor,
+	})
+	if err != nil {
+		return result, herr.InternalServerError("Failed to lock surviving Incident", err).From("[LockMergeSurvivor]")
+	}
+	if survivorMergedInto.Valid {
+		return result, herr.BadRequest(fmt.Sprintf(
+			"Incident #%v was itself merged into #%v", m.survivor, survivorMergedInto.Int32), nil,
+		).SetExpectedError()
+	}
+
+	// Close the duplicate first. This is the concurrency gate for the whole
+	// merge, as UpdateIncident is for an edit.
+	now := time.Now()
+	rows, err := imsDBQ.MarkIncidentMerged(ctx, txn, imsdb.MarkIncidentMergedParams{
+		Closed:     conv.TimeToNullFloat(now),
+		MergedInto: sql.NullInt32{Int32: m.survivor, Valid: true},
+		Event:      m.event.ID,
+		Number:     m.duplicate,
+		Version:    duplicateRow.Incident.Version,
+	})
+	if err != nil {
+		return result, herr.InternalServerError("Failed to close duplicate Incident", err).From("[MarkIncidentMerged]")
+	}
+	if rows == 0 {
+		result.conflict = true
+		return result, nil
+	}
+	if duplicateRow.Incident.State != imsdb.IncidentStateClosed {
+		result.duplicateClosed = true
+		err = imsDBQ.AddIncidentStateChange(ctx, txn, imsdb.AddIncidentStateChangeParams{
+			Event:          m.event.ID,
+			IncidentNumber: m.duplicate,
+			State:          imsdb.IncidentStateChangeStateClosed,
+			Author:         m.author,
+			Created:        conv.TimeToFloat(now),
+		})
+		if err != nil {
+			return result, herr.InternalServerError("Failed to record state change", err).From("[AddIncidentStateChange]")
+		}
+	}
+
+	err = imsDBQ.MoveIncidentReportEntries(ctx, txn, imsdb.MoveIncidentReportEntriesParams{
+		ToIncidentNumber:   m.survivor,
+		Event:              m.event.ID,
+		FromIncidentNumber: m.duplicate,
+	})
+	if err != nil {
+		return result, herr.InternalServerError("Failed to move report entries", err).From("[MoveIncidentReportEntries]")
+	}
+
+	errHTTP = m.moveRangers(ctx, txn)
+	if errHTTP != nil {
+		return result, errHTTP.From("[moveRangers]")
+	}
+
+	for _, typeID := range duplicateTypes {
+		if !slices.Contains(survivorTypes, typeID) {
+			err = imsDBQ.AttachIncidentTypeToIncident(ctx, txn, imsdb.AttachIncidentTypeToIncidentParams{
+				Event:          m.event.ID,
+				IncidentNumber: m.survivor,
+				IncidentType:   typeID,
+			})
+			if err != nil {
+				return result, herr.InternalServerError("Failed to add Incident Type", err).From("[AttachIncidentTypeToIncident]")
+			}
+		}
+		err = imsDBQ.DetachIncidentTypeFromIncident(ctx, txn, imsdb.DetachIncidentTypeFromIncidentParams{
+			Event:          m.event.ID,
+			IncidentNumber: m.duplicate,
+			IncidentType:   typeID,
+		})
+		if err != nil {
+			return result, herr.InternalServerError("Failed to detach Incident Type", err).From("[DetachIncidentTypeFromIncident]")
+		}
+	}
+
+	result.linkedPeers, errHTTP = m.moveLinks(ctx, txn)
+	if errHTTP != nil {
+		return result, errHTTP.From("[moveLinks]")
+	}
+
+	for _, fr := range duplicateFRs {
+		err = imsDBQ.AttachFieldReportToIncident(ctx, txn, imsdb.AttachFieldReportToIncidentParams{
+			IncidentNumber: sql.NullInt32{Int32: m.survivor, Valid: true},
+			Event:          m.event.ID,
+			Number:         fr,
+		})
+		if err != nil {
+			return result, herr.InternalServerError("Failed to attach Field Report to Incident", err).From("[AttachFieldReportToIncident]")
+		}
+		_, errHTTP = addFRReportEntry(ctx, imsDBQ, txn, m.event.ID, fr, newReportEntry{
+			author:    m.author,
+			text:      fmt.Sprintf("Attached to incident: %v", m.survivor),
+			generated: true,
+		})
+		if errHTTP != nil {
+			return result, errHTTP.From("[addFRReportEntry]")
+		}
+	}
+	result.fieldReports = duplicateFRs
+
+	for _, visit := range duplicateVisits {
+		err = imsDBQ.AttachVisitToIncident(ctx, txn, imsdb.AttachVisitToIncidentParams{
+			IncidentNumber: sql.NullInt32{Int32: m.survivor, Valid: true},
+			Event:          m.event.ID,
+			Number:         visit,
+		})
+		if err != nil {
+			return result, herr.InternalServerError("Failed to attach Visit to Incident", err).From("[AttachVisitToIncident]")
+		}
+		_, errHTTP = addVisitReportEntry(ctx, imsDBQ, txn, m.event.ID, visit, newReportEntry{
+			author:    m.author,
+			text:      fmt.Sprintf("Changed incident number: %v", m.survivor),
+			generated: true,
+		})
+		if errHTTP != nil {
+			return result, errHTTP.From("[addVisitReportEntry]")
+		}
+	}
+	result.visits = duplicateVisits
+
+	// These go in after the report entries were moved, so that each stays
+	// with the Incident it describes.
+	_, errHTTP = addIncidentReportEntry(ctx, imsDBQ, txn, m.event.ID, m.duplicate, newReportEntry{
+		author:    m.author,
+		text:      fmt.Sprintf("Merged into #%v", m.survivor),
+		generated: true,
+	})
+	if errHTTP != nil {
+		return result, errHTTP.From("[addIncidentReportEntry]")
+	}
+	_, errHTTP = addIncidentReportEntry(ctx, imsDBQ, txn, m.event.ID, m.survivor, newReportEntry{
+		author:    m.author,
+		text:      fmt.Sprintf("Merged in #%v", m.duplicate),
+		generated: true,
+	})
+	if errHTTP != nil {
+		return result, errHTTP.From("[addIncidentReportEntry]")
+	}
+
+	changed := []changes{{
+		eventID:      m.event.ID,
+		incidents:    []int32{m.survivor, m.duplicate},
+		fieldReports: result.fieldReports,
+		visits:       result.visits,
+	}}
+	for _, peer := range result.linkedPeers {
+		changed = append(changed, changes{eventID: peer.LinkedEvent, incidents: []int32{peer.LinkedIncident}})
+	}
+	errHTTP = recordChanges(ctx, imsDBQ, txn, changed...)
+	if errHTTP != nil {
+		return result, errHTTP.From("[recordChanges]")
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return result, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	return result, nil
+}
+
+// moveRangers moves the duplicate's Rangers over to the survivor. A Ranger
+// who's on both keeps the role they have on the survivor.
+func (m incidentMerge) moveRangers(ctx context.Context, txn imsdb.DBTX) *herr.HTTPError {
+	survivorRangers, err := m.imsDBQ.Incident_Rangers(ctx, txn, imsdb.Incident_RangersParams{
+		Event:          m.event.ID,
+		IncidentNumber: m.survivor,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch rangers", err).From("[Incident_Rangers]")
+	}
+	duplicateRangers, err := m.imsDBQ.Incident_Rangers(ctx, txn, imsdb.Incident_RangersParams{
+		Event:          m.event.ID,
+		IncidentNumber: m.duplicate,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch rangers", err).From("[Incident_Rangers]")
+	}
+	for _, dr := range duplicateRangers {
+		handle := dr.IncidentRanger.RangerHandle
+		onSurvivor := slices.ContainsFunc(survivorRangers, func(sr imsdb.Incident_RangersRow) bool {
+			return sr.IncidentRanger.RangerHandle == handle
+		})
+		if !onSurvivor {
+			err = m.imsDBQ.AttachRangerHandleToIncident(ctx, txn, imsdb.AttachRangerHandleToIncidentParams{
+				Event:          m.event.ID,
+				IncidentNumber: m.survivor,
+				RangerHandle:   handle,
+				Role:           dr.IncidentRanger.Role,
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to attach Ranger", err).From("[AttachRangerHandleToIncident]")
+			}
+		}
+		err = m.imsDBQ.DetachRangerHandleFromIncident(ctx, txn, imsdb.DetachRangerHandleFromIncidentParams{
+			Event:          m.event.ID,
+			IncidentNumber: m.duplicate,
+			RangerHandle:   handle,
+		})
+		if err != nil {
+			return herr.InternalServerError("Failed to detach Ranger", err).From("[DetachRangerHandleFromIncident]")
+		}
+	}
+	return nil
+}
+
+// moveLinks relinks the duplicate's linked Incidents to the survivor, and
+// returns those other Incidents. A link between the duplicate and the survivor
+// themselves is just dropped.
+func (m incidentMerge) moveLinks(ctx context.Context, txn imsdb.DBTX) ([]imsdb.Incident_LinkedIncidentsRow, *herr.HTTPError) {
+	survivorLinks, err := m.imsDBQ.Incident_LinkedIncidents(ctx, txn, imsdb.Incident_LinkedIncidentsParams{
+		Event1:          m.event.ID,
+		IncidentNumber1: m.survivor,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch linked Incidents", err).From("[Incident_LinkedIncidents]")
+	}
+	duplicateLinks, err := m.imsDBQ.Incident_LinkedIncidents(ctx, txn, imsdb.Incident_LinkedIncidentsParams{
+		Event1:          m.event.ID,
+		IncidentNumber1: m.duplicate,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch linked Incidents", err).From("[Incident_LinkedIncidents]")
+	}
+	var peers []imsdb.Incident_LinkedIncidentsRow
+	for _, dl := range duplicateLinks {
+		// Links are stored once in each direction, so both must go.
+		for _, params := range []imsdb.UnlinkIncidentsParams{
+			{Event1: m.event.ID, IncidentNumber1: m.duplicate, Event2: dl.LinkedEvent, IncidentNumber2: dl.LinkedIncident},
+			{Event1: dl.LinkedEvent, IncidentNumber1: dl.LinkedIncident, Event2: m.event.ID, IncidentNumber2: m.duplicate},
+		} {
+			err = m.imsDBQ.UnlinkIncidents(ctx, txn, params)
+			if err != nil {
+				return nil, herr.InternalServerError("Failed to unlink Incident", err).From("[UnlinkIncidents]")
+			}
+		}
+		if dl.LinkedEvent == m.event.ID && dl.LinkedIncident == m.survivor {
+			continue
+		}
+		peers = append(peers, dl)
+		alreadyLinked := slices.ContainsFunc(survivorLinks, func(sl imsdb.Incident_LinkedIncidentsRow) bool {
+			return sl.LinkedEvent == dl.LinkedEvent && sl.LinkedIncident == dl.LinkedIncident
+		})
+		if alreadyLinked {
+			continue
+		}
+		for _, params := range []imsdb.LinkIncidentsParams{
+			{Event1: m.event.ID, IncidentNumber1: m.survivor, Event2: dl.LinkedEvent, IncidentNumber2: dl.LinkedIncident},
+			{Event1: dl.LinkedEvent, IncidentNumber1: dl.LinkedIncident, Event2: m.event.ID, IncidentNumber2: m.survivor},
+		} {
+			err = m.imsDBQ.LinkIncidents(ctx, txn, params)
+			if err != nil {
+				return nil, herr.InternalServerError("Failed to link Incident", err).From("[LinkIncidents]")
+			}
+		}
+	}
+	return peers, nil
+}
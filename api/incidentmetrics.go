@@ -0,0 +1,168 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+type GetIncidentMetrics struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetIncidentMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getIncidentMetrics(req)
+	if errHTTP != nil {
+		errHTTP.From("[getIncidentMetrics]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetIncidentMetrics) getIncidentMetrics(req *http.Request) (imsjson.IncidentMetrics, *herr.HTTPError) {
+	var resp imsjson.IncidentMetrics
+	event, _, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return resp, errHTTP.From("[getEventPermissions]")
+	}
+	if eventPermissions&authz.EventReadIncidents == 0 {
+		return resp, herr.Forbidden("The requestor does not have EventReadIncidents permission on this Event", nil)
+	}
+	ctx := req.Context()
+
+	incidentRows, err := action.imsDBQ.Incidents_Created(ctx, action.imsDBQ, event.ID)
+	if err != nil {
+		return resp, herr.InternalServerError("Failed to fetch Incidents", err).From("[Incidents_Created]")
+	}
+	numbers := make([]int32, len(incidentRows))
+	for i, row := range incidentRows {
+		numbers[i] = row.Number
+	}
+	stateChangeRows, err := action.imsDBQ.Incidents_StateChanges(ctx, action.imsDBQ, imsdb.Incidents_StateChangesParams{
+		Event:           event.ID,
+		IncidentNumbers: numbers,
+	})
+	if err != nil {
+		return resp, herr.InternalServerError("Failed to fetch state changes", err).From("[Incidents_StateChanges]")
+	}
+	stateChangesByIncident := make(map[int32][]imsdb.IncidentStateChange)
+	for _, row := range stateChangeRows {
+		sc := row.IncidentStateChange
+		stateChangesByIncident[sc.IncidentNumber] = append(stateChangesByIncident[sc.IncidentNumber], sc)
+	}
+
+	var toDispatch, onScene, toClose []time.Duration
+	for _, row := range incidentRows {
+		timings := incidentStateTimings(row.Created, stateChangesByIncident[row.Number])
+		if timings.dispatched {
+			toDispatch = append(toDispatch, timings.toDispatch)
+		}
+		if timings.leftScene {
+			onScene = append(onScene, timings.onScene)
+		}
+		if timings.closed {
+			toClose = append(toClose, timings.toClose)
+		}
+	}
+
+	resp = imsjson.IncidentMetrics{
+		Event:          event.Name,
+		Incidents:      len(incidentRows),
+		TimeToDispatch: durationDistribution(toDispatch),
+		TimeOnScene:    durationDistribution(onScene),
+		TimeToClose:    durationDistribution(toClose),
+	}
+	return resp, nil
+}
+
+// incidentTimings holds the durations derived from one Incident's state
+// history. Each duration is only meaningful if its accompanying flag is set.
+type incidentTimings struct {
+	toDispatch time.Duration
+	dispatched bool
+	onScene    time.Duration
+	leftScene  bool
+	toClose    time.Duration
+	closed     bool
+}
+
+// incidentStateTimings walks an Incident's state changes, which must be in
+// chronological order. The Incident is taken to have been new from its
+// creation until the first change.
+func incidentStateTimings(created float64, changes []imsdb.IncidentStateChange) incidentTimings {
+	var result incidentTimings
+	createdTime := conv.FloatToTime(created)
+	prevState := imsdb.IncidentStateChangeStateNew
+	prevTime := createdTime
+	for _, change := range changes {
+		changeTime := conv.FloatToTime(change.Created)
+		if prevState == imsdb.IncidentStateChangeStateOnScene {
+			result.onScene += changeTime.Sub(prevTime)
+			result.leftScene = true
+		}
+		if change.State == imsdb.IncidentStateChangeStateDispatched && !result.dispatched {
+			result.toDispatch = changeTime.Sub(createdTime)
+			result.dispatched = true
+		}
+		prevState = change.State
+		prevTime = changeTime
+	}
+	// An Incident that was closed and then reopened doesn't count as closed.
+	if prevState == imsdb.IncidentStateChangeStateClosed {
+		result.toClose = prevTime.Sub(createdTime)
+		result.closed = true
+	}
+	return result
+}
+
+// durationDistribution summarizes durations, using the nearest-rank method
+// for the percentiles.
+func durationDistribution(durations []time.Duration) imsjson.DurationDistribution {
+	if len(durations) == 0 {
+		return imsjson.DurationDistribution{}
+	}
+	sorted := slices.Sorted(slices.Values(durations))
+	percentile := func(p float64) float64 {
+		rank := int(math.Ceil(p * float64(len(sorted))))
+		return sorted[max(rank-1, 0)].Seconds()
+	}
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	return imsjson.DurationDistribution{
+		Count:  len(sorted),
+		Min:    sorted[0].Seconds(),
+		Median: percentile(0.5),
+		P90:    percentile(0.9),
+		Max:    sorted[len(sorted)-1].Seconds(),
+		Mean:   total.Seconds() / float64(len(sorted)),
+	}
+}
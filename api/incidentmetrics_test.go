@@ -0,0 +1,88 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func stateChange(state imsdb.IncidentStateChangeState, created float64) imsdb.IncidentStateChange {
+	return imsdb.IncidentStateChange{State: state, Created: created}
+}
+
+func TestIncidentStateTimings(t *testing.T) {
+	t.Parallel()
+	timings := incidentStateTimings(1000, []imsdb.IncidentStateChange{
+		stateChange(imsdb.IncidentStateChangeStateOnHold, 1010),
+		stateChange(imsdb.IncidentStateChangeStateDispatched, 1060),
+		stateChange(imsdb.IncidentStateChangeStateOnScene, 1100),
+		stateChange(imsdb.IncidentStateChangeStateDispatched, 1200),
+		stateChange(imsdb.IncidentStateChangeStateOnScene, 1300),
+		stateChange(imsdb.IncidentStateChangeStateClosed, 1350),
+	})
+	assert.True(t, timings.dispatched)
+	assert.Equal(t, 60*time.Second, timings.toDispatch)
+	assert.True(t, timings.leftScene)
+	assert.Equal(t, 150*time.Second, timings.onScene)
+	assert.True(t, timings.closed)
+	assert.Equal(t, 350*time.Second, timings.toClose)
+}
+
+func TestIncidentStateTimings_incomplete(t *testing.T) {
+	t.Parallel()
+	// Never changed state at all
+	assert.Equal(t, incidentTimings{}, incidentStateTimings(1000, nil))
+
+	// Still on scene, so that stretch isn't over yet
+	timings := incidentStateTimings(1000, []imsdb.IncidentStateChange{
+		stateChange(imsdb.IncidentStateChangeStateOnScene, 1100),
+	})
+	assert.False(t, timings.dispatched)
+	assert.False(t, timings.leftScene)
+	assert.False(t, timings.closed)
+
+	// Closed, then reopened
+	timings = incidentStateTimings(1000, []imsdb.IncidentStateChange{
+		stateChange(imsdb.IncidentStateChangeStateClosed, 1100),
+		stateChange(imsdb.IncidentStateChangeStateNew, 1200),
+	})
+	assert.False(t, timings.closed)
+}
+
+func TestDurationDistribution(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, imsjson.DurationDistribution{}, durationDistribution(nil))
+
+	assert.Equal(t,
+		imsjson.DurationDistribution{Count: 1, Min: 5, Median: 5, P90: 5, Max: 5, Mean: 5},
+		durationDistribution([]time.Duration{5 * time.Second}),
+	)
+
+	var durations []time.Duration
+	for i := 10; i >= 1; i-- {
+		durations = append(durations, time.Duration(i)*time.Minute)
+	}
+	assert.Equal(t,
+		imsjson.DurationDistribution{Count: 10, Min: 60, Median: 300, P90: 540, Max: 600, Mean: 330},
+		durationDistribution(durations),
+	)
+}
@@ -90,6 +90,10 @@ func parseIncidentRelationRequest(
 	if err != nil {
 		return empty, herr.BadRequest("Invalid Incident Number", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialIncident(req, imsDBQ, event.ID, sql.NullInt32{Int32: number, Valid: true}, eventPermissions)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[checkConfidentialIncident]")
+	}
 
 	return incidentRelationRequest{
 		event:  event,
@@ -204,6 +208,11 @@ func setIncidentType(
 			return errHTTP.From("[addIncidentReportEntry]")
 		}
 
+		errHTTP = recordChanges(ctx, imsDBQ, txn, changes{eventID: relReq.event.ID, incidents: []int32{relReq.number}})
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
+
 		err = txn.Commit()
 		if err != nil {
 			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
@@ -348,6 +357,14 @@ func setIncidentLink(
 			return errHTTP.From("[addIncidentReportEntry]")
 		}
 
+		errHTTP = recordChanges(ctx, imsDBQ, txn,
+			changes{eventID: relReq.event.ID, incidents: []int32{relReq.number}},
+			changes{eventID: peerEvent.ID, incidents: []int32{peerNumber}},
+		)
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
+
 		err = txn.Commit()
 		if err != nil {
 			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
@@ -0,0 +1,164 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIToken(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName, eventID := newEventWithWriterID(t, apisAdmin)
+	otherEventName := newEventWithWriter(t, apisAdmin)
+	incident := apis.newIncidentSuccess(ctx, imsjson.Incident{Event: eventName, Summary: new("for the dashboard")})
+
+	tokenReq := imsjson.APIToken{
+		Name:              "dashboard-" + rand.NonCryptoText(),
+		Events:            []string{eventName},
+		EventPermissions:  []string{"readEventName", "readIncidents"},
+		GlobalPermissions: []string{"listEvents"},
+	}
+
+	// Only admins may make tokens
+	_, resp := apis.newAPIToken(ctx, tokenReq)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Some bad requests
+	_, resp = apisAdmin.newAPIToken(ctx, imsjson.APIToken{Name: userAliceHandle})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, resp = apisAdmin.newAPIToken(ctx, imsjson.APIToken{Name: tokenReq.Name, EventPermissions: []string{"doAnything"}})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, resp = apisAdmin.newAPIToken(ctx, imsjson.APIToken{Name: tokenReq.Name, Expires: time.Now().Add(-time.Hour)})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	created, resp := apisAdmin.newAPIToken(ctx, tokenReq)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEmpty(t, created.Token)
+	assert.Equal(t, tokenReq.Name, created.Name)
+	assert.Equal(t, userAdminHandle, created.CreatedBy)
+
+	apisToken := ApiHelper{t: t, serverURL: shared.serverURL, jwt: created.Token}
+
+	// The token can do what it was given, on its own Event
+	got, resp := apisToken.getIncident(ctx, eventName, incident)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, new("for the dashboard"), got.Summary)
+	_, resp = apisToken.getEvents(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// but nothing more, and nowhere else
+	resp = apisToken.newIncident(ctx, imsjson.Incident{Event: eventName})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	_, resp = apisToken.getIncidents(ctx, otherEventName)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, resp = apisToken.getAPITokens(ctx)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// The token can follow its Event's changes as they happen
+	events := subscribeToEventSource(ctx, t, created.Token)
+	pushedIncident := apis.newIncidentSuccess(ctx, imsjson.Incident{Event: eventName})
+	_, ok := events.await(api.IMSEventData{EventID: eventID, IncidentNumber: pushedIncident})
+	require.True(t, ok, "no SSE push for the token's Event")
+
+	// The token's requests are logged under its name, and its use is recorded
+	tokens, resp := apisAdmin.getAPITokens(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var listed imsjson.APIToken
+	for _, tok := range tokens {
+		if tok.ID == created.ID {
+			listed = tok
+		}
+	}
+	assert.Equal(t, tokenReq.Name, listed.Name)
+	assert.Empty(t, listed.Token)
+	assert.Equal(t, []string{eventName}, listed.Events)
+	assert.Equal(t, tokenReq.EventPermissions, listed.EventPermissions)
+	assert.False(t, listed.LastUsed.IsZero())
+	assert.True(t, listed.Revoked.IsZero())
+
+	longAgo := conv.FormatInt(time.Now().Add(-time.Hour).UnixMilli())
+	longFromNow := conv.FormatInt(time.Now().Add(time.Hour).UnixMilli())
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		logs, _ := apisAdmin.getActionLogs(ctx, longAgo, longFromNow)
+		found := false
+		for _, al := range logs {
+			if al.UserName == tokenReq.Name {
+				found = true
+				assert.Zero(c, al.UserID)
+			}
+		}
+		assert.True(c, found)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// A revoked token stops working straight away
+	resp = apisAdmin.revokeAPIToken(ctx, created.ID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, resp = apisToken.getIncident(ctx, eventName, incident)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	// and its event stream ends at the next keep-alive
+	select {
+	case <-events.ended:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the revoked API token's event stream is still open")
+	}
+	resp = apisAdmin.revokeAPIToken(ctx, created.ID)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// and so does a made-up one
+	apisFake := ApiHelper{t: t, serverURL: shared.serverURL, jwt: "ims_" + rand.NonCryptoText()}
+	_, resp = apisFake.getEvents(ctx)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (a ApiHelper) getAPITokens(ctx context.Context) (imsjson.APITokens, *http.Response) {
+	a.t.Helper()
+	bod, resp := a.imsGet(ctx, a.serverURL.JoinPath("/ims/api/tokens").String(), &imsjson.APITokens{})
+	return *bod.(*imsjson.APITokens), resp
+}
+
+func (a ApiHelper) newAPIToken(ctx context.Context, req imsjson.APIToken) (imsjson.APIToken, *http.Response) {
+	a.t.Helper()
+	resp := a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/tokens").String())
+	defer func() { require.NoError(a.t, resp.Body.Close()) }()
+	var created imsjson.APIToken
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(a.t, json.NewDecoder(resp.Body).Decode(&created))
+	}
+	return created, resp
+}
+
+func (a ApiHelper) revokeAPIToken(ctx context.Context, tokenID int32) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/tokens/", conv.FormatInt(tokenID)).String(), nil)
+	return resp
+}
@@ -17,13 +17,8 @@
 package integration_test
 
 import (
-	"bufio"
-	"context"
-	"encoding/json"
 	"net/http"
-	"strings"
 	"testing"
-	"time"
 
 	"github.com/burningmantech/ranger-ims-go/api"
 	imsjson "github.com/burningmantech/ranger-ims-go/json"
@@ -488,18 +483,20 @@ func TestAttachToLinkedFieldReportNotifiesParentIncident(t *testing.T) {
 	require.NoError(t, resp.Body.Close())
 	require.Equal(t, http.StatusNoContent, resp.StatusCode)
 
-	events := subscribeToEventSource(ctx, t)
+	events := subscribeToEventSource(ctx, t, apisAlice.jwt)
 
 	_, resp = apisAlice.attachFileToFieldReport(ctx, eventName, frNum, []byte("some evidence"))
 	require.NoError(t, resp.Body.Close())
 	require.Equal(t, http.StatusNoContent, resp.StatusCode)
 
-	// The SSE channel is global and other parallel tests publish to it, so match on
-	// this test's own Event ID rather than taking whatever arrives first.
+	// Other parallel tests publish to Alice's stream too, so match on this
+	// test's own Event ID rather than taking whatever arrives first.
 	wantIncident := api.IMSEventData{EventID: eventID, IncidentNumber: incidentNum}
 	wantFieldReport := api.IMSEventData{EventID: eventID, FieldReportNumber: frNum}
-	require.True(t, events.await(wantFieldReport), "no SSE push for the updated Field Report")
-	require.True(t, events.await(wantIncident), "no SSE push for the parent Incident")
+	_, ok := events.await(wantFieldReport)
+	require.True(t, ok, "no SSE push for the updated Field Report")
+	_, ok = events.await(wantIncident)
+	require.True(t, ok, "no SSE push for the parent Incident")
 }
 
 // onePixelPNG is a minimal valid PNG, used to exercise the previewable-content-type
@@ -514,62 +511,3 @@ var onePixelPNG = []byte{
 	0x00, 0x01, 0x0d, 0x0a, 0x2d, 0xb4, 0x00, 0x00,
 	0x00, 0x00, 'I', 'E', 'N', 'D', 0xae, 0x42, 0x60, 0x82,
 }
-
-// sseWatcher collects Server-Sent Events published after it was created.
-type sseWatcher struct {
-	t    *testing.T
-	seen chan api.IMSEventData
-}
-
-// subscribeToEventSource opens a streaming connection to the SSE endpoint and reads
-// pushes into a channel until the test ends.
-func subscribeToEventSource(ctx context.Context, t *testing.T) *sseWatcher {
-	t.Helper()
-
-	path := shared.serverURL.JoinPath("ims/api/eventsource").String()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
-	require.NoError(t, err)
-	// #nosec G704 // SSRF via taint analysis. We control the URLs.
-	resp, err := (&http.Client{}).Do(req)
-	require.NoError(t, err)
-	require.Equal(t, http.StatusOK, resp.StatusCode)
-	t.Cleanup(func() { _ = resp.Body.Close() })
-
-	w := &sseWatcher{t: t, seen: make(chan api.IMSEventData, 128)}
-	go func() {
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
-			if !ok {
-				continue
-			}
-			var parsed api.IMSEventData
-			err := json.Unmarshal([]byte(data), &parsed)
-			if err != nil {
-				continue
-			}
-			select {
-			case w.seen <- parsed:
-			default:
-			}
-		}
-	}()
-	return w
-}
-
-// await reports whether want shows up on the channel before a short deadline,
-// discarding unrelated pushes from other parallel tests along the way.
-func (w *sseWatcher) await(want api.IMSEventData) bool {
-	w.t.Helper()
-	deadline := time.After(15 * time.Second)
-	for {
-		select {
-		case got := <-w.seen:
-			if got == want {
-				return true
-			}
-		case <-deadline:
-			return false
-		}
-	}
-}
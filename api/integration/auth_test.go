@@ -26,7 +26,6 @@ import (
 
 	"github.com/burningmantech/ranger-ims-go/api"
 	imsjson "github.com/burningmantech/ranger-ims-go/json"
-	"github.com/burningmantech/ranger-ims-go/lib/authz"
 	"github.com/burningmantech/ranger-ims-go/lib/rand"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -215,8 +214,7 @@ func TestPostAuthMakesRefreshCookie(t *testing.T) {
 	require.NoError(t, err)
 
 	// check that the returned access token looks good
-	jwter := authz.JWTer{SecretKey: shared.cfg.Core.JWTSecret}
-	claims, err := jwter.AuthenticateJWT(response.Token)
+	claims, err := shared.jwter.AuthenticateJWT(response.Token)
 	require.NoError(t, err)
 	require.Equal(t, userAliceHandle, claims.RangerHandle())
 	require.Greater(t, response.ExpiresUnixMs, time.Now().UnixMilli())
@@ -227,7 +225,7 @@ func TestPostAuthMakesRefreshCookie(t *testing.T) {
 	require.True(t, cookie.HttpOnly)
 	require.True(t, cookie.Secure)
 	// and that it's valid
-	claims, err = jwter.AuthenticateRefreshToken(cookie.Value)
+	claims, err = shared.jwter.AuthenticateRefreshToken(cookie.Value)
 	require.NoError(t, err)
 	require.Equal(t, userAliceHandle, claims.RangerHandle())
 
@@ -235,7 +233,7 @@ func TestPostAuthMakesRefreshCookie(t *testing.T) {
 	code, refreshResp := apisNotAuthenticated.refreshAccessToken(ctx, cookie)
 	require.Equal(t, http.StatusOK, code)
 	// and confirm the new access token's validity
-	claims, err = jwter.AuthenticateJWT(refreshResp.Token)
+	claims, err = shared.jwter.AuthenticateJWT(refreshResp.Token)
 	require.NoError(t, err)
 	require.Equal(t, userAliceHandle, claims.RangerHandle())
 	// this new token should expire no earlier than the old one
@@ -0,0 +1,102 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakGlassIncident(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	// Only the admin has access to this event.
+	eventName := rand.NonCryptoText()
+	_, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.addWriter(ctx, eventName, userAdminHandle)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	num := apisAdmin.newIncidentSuccess(ctx, sampleIncident1(eventName))
+	otherNum := apisAdmin.newIncidentSuccess(ctx, sampleIncident1(eventName))
+
+	_, resp = apisAlice.getIncident(ctx, eventName, num)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// A justification is required.
+	_, resp = apisAlice.breakGlass(ctx, eventName, "incidents", num, "  ")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	// The record must exist.
+	_, resp = apisAlice.breakGlass(ctx, eventName, "incidents", 99999, "Medical follow-up for a patient")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	// Someone who can already read the Incident has no glass to break.
+	_, resp = apisAdmin.breakGlass(ctx, eventName, "incidents", num, "Medical follow-up for a patient")
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	grant, resp := apisAlice.breakGlass(ctx, eventName, "incidents", num, "Medical follow-up for a patient")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, eventName, grant.Event)
+	assert.Equal(t, &num, grant.Incident)
+	assert.Nil(t, grant.Visit)
+	assert.Equal(t, userAliceHandle, grant.Handle)
+	assert.True(t, grant.Expires.After(grant.Created))
+
+	// Alice can now read that Incident, whose timeline shows the grant, but
+	// not any other.
+	incident, resp := apisAlice.getIncident(ctx, eventName, num)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.True(t, slices.ContainsFunc(incident.ReportEntries, func(re imsjson.ReportEntry) bool {
+		return re.SystemEntry && re.Author == userAliceHandle &&
+			strings.Contains(re.Text, "Break-glass") && strings.Contains(re.Text, "Medical follow-up for a patient")
+	}))
+	_, resp = apisAlice.getIncident(ctx, eventName, otherNum)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	// Nor can she change it.
+	resp = apisAlice.updateIncident(ctx, eventName, num, imsjson.Incident{Event: eventName, Number: num, Summary: new("mine now")})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Admins can list the grants, and no one else can.
+	grants, resp := apisAdmin.getBreakGlasses(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.True(t, slices.ContainsFunc(grants, func(bg imsjson.BreakGlass) bool {
+		return bg.ID == grant.ID && bg.Event == eventName && bg.Justification == grant.Justification
+	}))
+	_, resp = apisAlice.getBreakGlasses(ctx)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
@@ -0,0 +1,100 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type outboxDelivery struct {
+	id   int64
+	data api.IMSEventData
+}
+
+// startReplica starts an OutboxBroadcaster as another IMS server would, and
+// collects what it delivers for the given Event. Other tests share the outbox,
+// so everything else is ignored.
+func startReplica(ctx context.Context, t *testing.T, eventID int32) (*api.OutboxBroadcaster, int64, <-chan outboxDelivery) {
+	t.Helper()
+	b := api.NewOutboxBroadcaster(shared.imsDBQ, 10*time.Millisecond)
+	deliveries := make(chan outboxDelivery, 64)
+	latestID, err := b.Start(ctx, func(id int64, data api.IMSEventData) {
+		if data.EventID == eventID {
+			deliveries <- outboxDelivery{id, data}
+		}
+	})
+	require.NoError(t, err)
+	return b, latestID, deliveries
+}
+
+func TestOutboxBroadcasterDeliversToAllReplicas(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	// There's no foreign key on the Event, so an unused number keeps this test
+	// to itself.
+	const eventID = 900_000_001
+
+	replica1, latest1, deliveries1 := startReplica(ctx, t, eventID)
+	replica2, latest2, deliveries2 := startReplica(ctx, t, eventID)
+
+	// Publish concurrently from both replicas.
+	var wg sync.WaitGroup
+	for i := range int32(10) {
+		wg.Go(func() {
+			replica := replica1
+			if i%2 == 1 {
+				replica = replica2
+			}
+			assert.Nil(t, replica.Publish(ctx, api.IMSEventData{EventID: eventID, IncidentNumber: i + 1}))
+		})
+	}
+	wg.Wait()
+
+	collect := func(deliveries <-chan outboxDelivery) []outboxDelivery {
+		var result []outboxDelivery
+		for range 10 {
+			select {
+			case d := <-deliveries:
+				result = append(result, d)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("only got %v deliveries", len(result))
+			}
+		}
+		return result
+	}
+	got1 := collect(deliveries1)
+	got2 := collect(deliveries2)
+
+	// Both replicas see every event, under the same IDs, in the same order.
+	assert.Equal(t, got1, got2)
+	incidents := make(map[int32]bool)
+	for i, d := range got1 {
+		assert.Greater(t, d.id, max(latest1, latest2))
+		if i > 0 {
+			assert.Greater(t, d.id, got1[i-1].id)
+		}
+		incidents[d.data.IncidentNumber] = true
+	}
+	assert.Len(t, incidents, 10)
+}
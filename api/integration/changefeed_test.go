@@ -0,0 +1,167 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"net/http"
+	"testing"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/stretchr/testify/require"
+)
+
+func fieldReportNumbers(frs imsjson.FieldReports) []int32 {
+	var result []int32
+	for _, fr := range frs {
+		result = append(result, fr.Number)
+	}
+	return result
+}
+
+func visitNumbers(visits imsjson.Visits) []int32 {
+	var result []int32
+	for _, v := range visits {
+		result = append(result, v.Number)
+	}
+	return result
+}
+
+func TestChangeFeed(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithWriter(t, apisAdmin)
+
+	// Nothing yet, but there's still a cursor
+	changes, resp := apis.getChanges(ctx, eventName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, eventName, changes.Event)
+	require.NotNil(t, changes.Incidents)
+	require.Empty(t, *changes.Incidents)
+	require.NotEmpty(t, changes.Cursor)
+	cursor := changes.Cursor
+
+	incident1 := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+	incident2 := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+	changes, resp = apis.getChanges(ctx, eventName, cursor)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{incident1, incident2}, incidentNumbers(*changes.Incidents))
+	cursor = changes.Cursor
+
+	// Nothing changed since then
+	changes, resp = apis.getChanges(ctx, eventName, cursor)
+	require.NoError(t, resp.Body.Close())
+	require.Empty(t, *changes.Incidents)
+	require.Equal(t, cursor, changes.Cursor)
+
+	// A roster change doesn't move VERSION, but it's still a change
+	resp = apis.attachRangerToIncident(ctx, eventName, incident2, "SomeRanger")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	changes, resp = apis.getChanges(ctx, eventName, cursor)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{incident2}, incidentNumbers(*changes.Incidents))
+	require.Equal(t, []imsjson.IncidentRanger{{Handle: "SomeRanger"}}, *(*changes.Incidents)[0].Rangers)
+	cursor = changes.Cursor
+
+	// A link changes both ends
+	resp = apis.linkIncident(ctx, eventName, incident1, eventName, incident2)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	changes, resp = apis.getChanges(ctx, eventName, cursor)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{incident1, incident2}, incidentNumbers(*changes.Incidents))
+	cursor = changes.Cursor
+
+	// Attaching a Field Report changes it and its Incident
+	fr := apis.newFieldReportSuccess(ctx, imsjson.FieldReport{Event: eventName, Summary: new("a field report")})
+	resp = apis.attachFieldReportToIncident(ctx, eventName, fr, incident1)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	changes, resp = apis.getChanges(ctx, eventName, cursor)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{incident1}, incidentNumbers(*changes.Incidents))
+	require.Equal(t, []int32{fr}, fieldReportNumbers(*changes.FieldReports))
+	cursor = changes.Cursor
+
+	// So does striking a report entry
+	visit := apis.newVisitSuccess(ctx, imsjson.Visit{
+		Event:         eventName,
+		ReportEntries: []imsjson.ReportEntry{{Text: "to be struck"}},
+	})
+	storedVisit, resp := apis.getVisit(ctx, eventName, visit)
+	require.NoError(t, resp.Body.Close())
+	changes, resp = apis.getChanges(ctx, eventName, cursor)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{visit}, visitNumbers(*changes.Visits))
+	cursor = changes.Cursor
+	resp = apis.updateVisitReportEntry(ctx, eventName, visit, imsjson.ReportEntry{
+		ID:       storedVisit.ReportEntries[0].ID,
+		Stricken: new(true),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	changes, resp = apis.getChanges(ctx, eventName, cursor)
+	require.NoError(t, resp.Body.Close())
+	require.Empty(t, *changes.Incidents)
+	require.Empty(t, *changes.FieldReports)
+	require.Equal(t, []int32{visit}, visitNumbers(*changes.Visits))
+
+	// Without a cursor, everything comes back
+	changes, resp = apis.getChanges(ctx, eventName, "")
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{incident1, incident2}, incidentNumbers(*changes.Incidents))
+
+	_, resp = apis.getChanges(ctx, eventName, "-5")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestChangeFeedOwnFieldReports(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithReporter(t, apisAdmin)
+
+	adminFR := apisAdmin.newFieldReportSuccess(ctx, imsjson.FieldReport{
+		Event:         eventName,
+		ReportEntries: []imsjson.ReportEntry{{Text: "the admin's"}},
+	})
+	aliceFR := apisAlice.newFieldReportSuccess(ctx, imsjson.FieldReport{
+		Event:         eventName,
+		ReportEntries: []imsjson.ReportEntry{{Text: "Alice's"}},
+	})
+
+	changes, resp := apisAdmin.getChanges(ctx, eventName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{adminFR, aliceFR}, fieldReportNumbers(*changes.FieldReports))
+
+	// A Reporter sees only their own Field Reports, and none of the rest
+	changes, resp = apisAlice.getChanges(ctx, eventName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{aliceFR}, fieldReportNumbers(*changes.FieldReports))
+	require.Nil(t, changes.Incidents)
+	require.Nil(t, changes.Visits)
+}
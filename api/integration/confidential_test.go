@@ -0,0 +1,104 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfidentialIncident(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	// Both may write, but only the admin may read confidential Incidents.
+	eventName := rand.NonCryptoText()
+	_, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Writers: []imsjson.AccessRule{
+				{Expression: "person:" + userAdminHandle, Validity: "always"},
+				{Expression: "person:" + userAliceHandle, Validity: "always"},
+			},
+		},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.addConfidentialReader(ctx, eventName, userAdminHandle)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	num := apisAdmin.newIncidentSuccess(ctx, sampleIncident1(eventName))
+	otherNum := apisAdmin.newIncidentSuccess(ctx, sampleIncident1(eventName))
+	frNum := apisAlice.newFieldReportSuccess(ctx, sampleFieldReport1(eventName))
+
+	// Alice may not make an Incident confidential, since she couldn't read it after.
+	resp = apisAlice.updateIncident(ctx, eventName, num, imsjson.Incident{Event: eventName, Number: num, Confidential: new(true)})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.updateIncident(ctx, eventName, num, imsjson.Incident{Event: eventName, Number: num, Confidential: new(true)})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	incident, resp := apisAdmin.getIncident(ctx, eventName, num)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, incident.Confidential)
+	assert.True(t, *incident.Confidential)
+	incidents, resp := apisAdmin.getIncidents(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.True(t, slices.ContainsFunc(incidents, func(i imsjson.Incident) bool { return i.Number == num }))
+
+	// To Alice, the confidential Incident might as well not be there.
+	_, resp = apisAlice.getIncident(ctx, eventName, num)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	incidents, resp = apisAlice.getIncidents(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.False(t, slices.ContainsFunc(incidents, func(i imsjson.Incident) bool { return i.Number == num }))
+	assert.True(t, slices.ContainsFunc(incidents, func(i imsjson.Incident) bool { return i.Number == otherNum }))
+	resp = apisAlice.updateIncident(ctx, eventName, num, imsjson.Incident{Event: eventName, Number: num, Summary: new("edited")})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAlice.attachFieldReportToIncident(ctx, eventName, frNum, num)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// A Field Report attached to it is hidden from her too, even though she wrote it.
+	resp = apisAdmin.attachFieldReportToIncident(ctx, eventName, frNum, num)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	_, resp = apisAlice.getFieldReport(ctx, eventName, frNum)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	_, resp = apisAdmin.getFieldReport(ctx, eventName, frNum)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
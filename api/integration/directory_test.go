@@ -19,12 +19,17 @@ package integration_test
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/burningmantech/ranger-ims-go/api"
 	"github.com/burningmantech/ranger-ims-go/conf"
@@ -32,6 +37,7 @@ import (
 	imsjson "github.com/burningmantech/ranger-ims-go/json"
 	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
 	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
 	"github.com/burningmantech/ranger-ims-go/lib/rand"
 	"github.com/burningmantech/ranger-ims-go/store/imsdb"
 	"github.com/stretchr/testify/assert"
@@ -55,14 +61,18 @@ var (
 
 // newIMSDirectoryServer starts a second IMS server, one that uses the
 // IMS-native directory (backed by the shared IMS DB container) rather than
-// the Clubhouse directory. It also bootstraps an admin user in the
+// the Clubhouse directory, or that puts the two together when configure sets
+// a composite directory. It also bootstraps an admin user in the
 // DIRECTORY_PERSON table, the way the add-user CLI command would.
-func newIMSDirectoryServer(t *testing.T, ctx context.Context) *url.URL {
+func newIMSDirectoryServer(t *testing.T, ctx context.Context, configure ...func(cfg *conf.IMSConfig)) *url.URL {
 	t.Helper()
 
 	cfg := *shared.cfg
 	cfg.Directory.Directory = conf.DirectoryTypeIMS
 	cfg.Core.Admins = []string{dirAdminHandle}
+	for _, c := range configure {
+		c(&cfg)
+	}
 
 	dirAdminOnce.Do(func() {
 		hashed := argon2id.CreateHash(dirAdminPassword, argon2id.ClubhouseParams)
@@ -77,12 +87,13 @@ func newIMSDirectoryServer(t *testing.T, ctx context.Context) *url.URL {
 	})
 	require.NoError(t, dirAdminErr)
 
-	userStore := directory.NewUserStore(
-		directory.NewIMSSource(shared.imsDBQ),
-		cfg.Directory.InMemoryCacheTTL,
-	)
+	var source directory.Source = directory.NewIMSSource(shared.imsDBQ)
+	if cfg.Directory.Directory == conf.DirectoryTypeComposite {
+		source = directory.NewCompositeSource(directory.NewClubhouseSource(shared.clubhouseDBQ), source)
+	}
+	userStore := directory.NewUserStore(source, cfg.Directory.InMemoryCacheTTL)
 	server := httptest.NewServer(
-		api.AddToMux(nil, api.NewEventSourcerer(), &cfg, shared.imsDBQ, userStore, nil, shared.actionLogger, shared.errorLogger),
+		api.AddToMux(nil, api.NewEventSourcerer(nil, false), &cfg, shared.imsDBQ, userStore, nil, shared.actionLogger, shared.errorLogger),
 	)
 	t.Cleanup(server.Close)
 	serverURL, err := url.Parse(server.URL)
@@ -282,6 +293,379 @@ func TestIMSNativeDirectory(t *testing.T) {
 	}
 }
 
+func TestCompositeDirectory(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL := newIMSDirectoryServer(t, ctx, func(cfg *conf.IMSConfig) {
+		cfg.Directory.Directory = conf.DirectoryTypeComposite
+	})
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+
+	// Clubhouse users log in as they always have.
+	statusCode, _, aliceJWT := unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: userAliceHandle,
+		Password:       userAlicePassword,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	apisAlice := ApiHelper{t: t, serverURL: serverURL, jwt: aliceJWT}
+
+	// Add a guest on a team of their own.
+	teamName := "Sheriff " + rand.NonCryptoText()
+	teamID, resp := apisAdmin.editDirectoryGroup(ctx, "teams", imsjson.DirectoryGroup{Title: &teamName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, teamID)
+	guestHandle := "Deputy " + rand.NonCryptoText()
+	guestPassword := "deputy-password-" + rand.NonCryptoText()
+	guestID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{
+		Handle:  &guestHandle,
+		TeamIDs: &[]int64{*teamID},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, guestID)
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, *guestID, guestPassword)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	statusCode, _, guestJWT := unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: guestHandle,
+		Password:       guestPassword,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	apisGuest := ApiHelper{t: t, serverURL: serverURL, jwt: guestJWT}
+
+	// A guest who claims a Clubhouse user's handle is left out of the
+	// directory, so they can't log in as that user.
+	impostorPassword := "impostor-password-" + rand.NonCryptoText()
+	impostorID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{Handle: new(userAliceHandle)})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, impostorID)
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, *impostorID, impostorPassword)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	statusCode, _, _ = unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: userAliceHandle,
+		Password:       impostorPassword,
+	})
+	require.Equal(t, http.StatusUnauthorized, statusCode)
+
+	// Both populations are in the personnel API, with the guests' IDs out of
+	// the Clubhouse's range.
+	personnel, resp := apisAlice.getPersonnel(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	byHandle := make(map[string][]imsjson.Person)
+	for _, p := range personnel {
+		byHandle[p.Handle] = append(byHandle[p.Handle], p)
+	}
+	require.Len(t, byHandle[userAliceHandle], 1)
+	assert.Less(t, byHandle[userAliceHandle][0].DirectoryID, directory.GuestIDOffset)
+	require.Len(t, byHandle[guestHandle], 1)
+	assert.Equal(t, *guestID+directory.GuestIDOffset, byHandle[guestHandle][0].DirectoryID)
+
+	// Team-based access rules cover the guests' teams.
+	eventName := "composite-event-" + rand.NonCryptoText()
+	_, resp = apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Writers: []imsjson.AccessRule{{
+				Expression: "team:" + teamName,
+				Validity:   "always",
+			}},
+		},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	guestAuth, resp := apisGuest.getAuth(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.True(t, guestAuth.EventAccess[eventName].WriteIncidents)
+	aliceAuth, resp := apisAlice.getAuth(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.False(t, aliceAuth.EventAccess[eventName].WriteIncidents)
+
+	// The impostor shares the DIRECTORY_* tables with other tests.
+	resp = apisAdmin.deleteDirectoryPerson(ctx, *impostorID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestIMSDirectoryOnDuty(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL := newIMSDirectoryServer(t, ctx)
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+
+	positionTitle := "Dirt " + rand.NonCryptoText()
+	positionID, resp := apisAdmin.editDirectoryGroup(ctx, "positions", imsjson.DirectoryGroup{Title: &positionTitle})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, positionID)
+	otherTitle := "Echelon " + rand.NonCryptoText()
+	otherID, resp := apisAdmin.editDirectoryGroup(ctx, "positions", imsjson.DirectoryGroup{Title: &otherTitle})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, otherID)
+	handle := "Shifty " + rand.NonCryptoText()
+	password := "shifty-password-" + rand.NonCryptoText()
+	personID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{
+		Handle:      &handle,
+		PositionIDs: &[]int64{*positionID},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, personID)
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, *personID, password)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	eventName := "onduty-event-" + rand.NonCryptoText()
+	_, resp = apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Writers: []imsjson.AccessRule{{
+				Expression: "onduty:" + positionTitle,
+				Validity:   "always",
+			}},
+		},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	canWrite := func() bool {
+		t.Helper()
+		statusCode, _, jwt := unauthed.postAuth(ctx, api.PostAuthRequest{
+			Identification: handle,
+			Password:       password,
+		})
+		require.Equal(t, http.StatusOK, statusCode)
+		auth, resp := ApiHelper{t: t, serverURL: serverURL, jwt: jwt}.getAuth(ctx, eventName)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+		return auth.EventAccess[eventName].WriteIncidents
+	}
+	require.False(t, canWrite())
+
+	// Nobody can go on duty in a position they don't hold.
+	resp = apisAdmin.signOnDirectoryPerson(ctx, *personID, *otherID)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Once signed in, the person matches "onduty:" rules from their next login.
+	before := time.Now()
+	resp = apisAdmin.signOnDirectoryPerson(ctx, *personID, *positionID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	dir, resp := apisAdmin.getDirectory(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	person := findDirectoryPerson(dir, *personID)
+	require.NotNil(t, person)
+	require.NotNil(t, person.OnDutyPositionID)
+	require.Equal(t, *positionID, *person.OnDutyPositionID)
+	require.False(t, person.OnDutySince.IsZero())
+	require.True(t, canWrite())
+
+	// Signing in again to the same position doesn't start another shift.
+	resp = apisAdmin.signOnDirectoryPerson(ctx, *personID, *positionID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Signing off ends the shift, and the person loses access.
+	resp = apisAdmin.signOffDirectoryPerson(ctx, *personID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.False(t, canWrite())
+	dir, resp = apisAdmin.getDirectory(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	person = findDirectoryPerson(dir, *personID)
+	require.NotNil(t, person)
+	require.Nil(t, person.OnDutyPositionID)
+
+	shifts, resp := apisAdmin.getDirectoryShifts(ctx, *personID, before.Add(-time.Minute))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, shifts, 1)
+	require.Equal(t, handle, shifts[0].Handle)
+	require.Equal(t, positionTitle, shifts[0].PositionTitle)
+	require.False(t, shifts[0].OffDuty.IsZero())
+	require.False(t, shifts[0].OffDuty.Before(shifts[0].OnDuty))
+
+	// Deleting a position ends its shifts, but they stay in the history.
+	resp = apisAdmin.signOnDirectoryPerson(ctx, *personID, *positionID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.deleteDirectoryPosition(ctx, *positionID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	shifts, resp = apisAdmin.getDirectoryShifts(ctx, *personID, before.Add(-time.Minute))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, shifts, 2)
+	for _, shift := range shifts {
+		require.Nil(t, shift.PositionID)
+		require.Equal(t, positionTitle, shift.PositionTitle)
+		require.False(t, shift.OffDuty.IsZero())
+	}
+}
+
+func TestDirectoryImportExport(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	configure, maildir := withMaildir(t)
+	serverURL := newIMSDirectoryServer(t, ctx, configure)
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+
+	// The DIRECTORY_* tables are shared with other tests, so everything here
+	// has a suffix of its own.
+	suffix := rand.NonCryptoText()
+	alpha, bravo, charlie := "Alpha "+suffix, "Bravo "+suffix, "Charlie "+suffix
+	alphaEmail := "alpha-" + suffix + "@example.com"
+	team, position := "Council "+suffix, "Dirt "+suffix
+	csvBody := "handle,email,onsite,teams,positions\n" +
+		alpha + "," + alphaEmail + ",true," + team + "," + position + "\n" +
+		bravo + ",,," + team + ",\n"
+
+	// A dry run only says what would change.
+	result, resp := apisAdmin.importDirectory(ctx, csvBody, "text/csv", "dryRun=true&invite=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, result.DryRun)
+	assert.ElementsMatch(t, []imsjson.DirectoryImportChange{
+		{Kind: "team", Name: team},
+		{Kind: "position", Name: position},
+		{Kind: "person", Name: alpha},
+		{Kind: "person", Name: bravo},
+	}, result.Creates)
+	assert.Equal(t, []string{alpha}, result.Invited)
+	dir, resp := apisAdmin.getDirectory(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.False(t, slices.ContainsFunc(dir.Persons, func(p imsjson.DirectoryPerson) bool {
+		return *p.Handle == alpha
+	}))
+
+	result, resp = apisAdmin.importDirectory(ctx, csvBody, "text/csv", "invite=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.False(t, result.DryRun)
+	assert.Len(t, result.Creates, 4)
+	assert.Equal(t, []string{alpha}, result.Invited)
+	assert.Contains(t, maildirTokens(t, maildir), alphaEmail)
+
+	// Importing the same again changes nothing.
+	result, resp = apisAdmin.importDirectory(ctx, csvBody, "text/csv", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, result.Creates)
+	assert.Empty(t, result.Updates)
+	assert.Equal(t, int32(2), result.Unchanged)
+
+	// The export has what was imported, and takes the same round trip.
+	exported, resp := apisAdmin.exportDirectory(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var alphaExport *imsjson.DirectoryBulkPerson
+	for _, p := range exported.Persons {
+		if p.Handle == alpha {
+			alphaExport = &p
+		}
+	}
+	require.NotNil(t, alphaExport)
+	assert.Equal(t, imsjson.DirectoryBulkPerson{
+		Handle:    alpha,
+		Email:     &alphaEmail,
+		Active:    new(true),
+		Onsite:    new(true),
+		Teams:     &[]string{team},
+		Positions: &[]string{position},
+	}, *alphaExport)
+	// Only this test's part of it goes back in, lest it undo other tests'.
+	ours := func(name string) bool { return strings.HasSuffix(name, suffix) }
+	exported.Persons = slices.DeleteFunc(exported.Persons, func(p imsjson.DirectoryBulkPerson) bool {
+		return !ours(p.Handle)
+	})
+	exported.Teams = slices.DeleteFunc(exported.Teams, func(g imsjson.DirectoryBulkGroup) bool { return !ours(g.Title) })
+	exported.Positions = slices.DeleteFunc(exported.Positions, func(g imsjson.DirectoryBulkGroup) bool { return !ours(g.Title) })
+	exportJSON, err := json.Marshal(exported)
+	require.NoError(t, err)
+	result, resp = apisAdmin.importDirectory(ctx, string(exportJSON), "application/json", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, result.Creates)
+	assert.Empty(t, result.Updates)
+	assert.Equal(t, int32(2), result.Unchanged)
+	csvExport, resp := apisAdmin.imsGetBodyBytes(ctx, serverURL.JoinPath("/ims/api/directory/export").String()+"?format=csv")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(csvExport), alpha+","+alphaEmail+",true,true,"+team+","+position+"\n")
+
+	// Updates are by handle, and deactivating a team is done by listing it.
+	update, err := json.Marshal(imsjson.DirectoryBulk{
+		Persons: []imsjson.DirectoryBulkPerson{
+			{Handle: strings.ToUpper(bravo), Positions: &[]string{position}},
+			{Handle: charlie},
+		},
+		Teams: []imsjson.DirectoryBulkGroup{{Title: team, Active: new(false)}},
+	})
+	require.NoError(t, err)
+	result, resp = apisAdmin.importDirectory(ctx, string(update), "application/json", "deactivateMissing=true&dryRun=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, result.Creates, imsjson.DirectoryImportChange{Kind: "person", Name: charlie})
+	assert.Contains(t, result.Updates, imsjson.DirectoryImportChange{
+		Kind: "person", Name: strings.ToUpper(bravo), Fields: []string{"handle", "positions"},
+	})
+	assert.Contains(t, result.Updates, imsjson.DirectoryImportChange{Kind: "team", Name: team, Fields: []string{"active"}})
+	assert.Contains(t, result.Deactivations, imsjson.DirectoryImportChange{Kind: "person", Name: alpha})
+
+	// Nothing is imported if any of it is wrong.
+	for _, bad := range []struct{ body, contentType string }{
+		{"handle\n" + charlie + "\n" + charlie + "\n", "text/csv"},
+		{"handle,email\n" + charlie + "," + alphaEmail + "\n", "text/csv"},
+		{"handle,rank\n" + charlie + ",1\n", "text/csv"},
+		{"{", "application/json"},
+	} {
+		_, resp = apisAdmin.importDirectory(ctx, bad.body, bad.contentType, "")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, bad.body)
+	}
+	_, resp = apisAdmin.importDirectory(ctx, csvBody, "text/plain", "")
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	_, resp = apisAdmin.importDirectory(ctx, csvBody, "text/csv", "dryRun=maybe")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	dir, resp = apisAdmin.getDirectory(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.False(t, slices.ContainsFunc(dir.Persons, func(p imsjson.DirectoryPerson) bool {
+		return *p.Handle == charlie
+	}))
+
+	// Only directory admins may import and export.
+	var bravoID int64
+	for _, p := range dir.Persons {
+		if *p.Handle == bravo {
+			bravoID = p.ID
+		}
+	}
+	require.NotZero(t, bravoID)
+	bravoPassword := "bravo-password-" + rand.NonCryptoText()
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, bravoID, bravoPassword)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	statusCode, _, bravoJWT := ApiHelper{t: t, serverURL: serverURL}.postAuth(ctx, api.PostAuthRequest{
+		Identification: bravo,
+		Password:       bravoPassword,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	apisBravo := ApiHelper{t: t, serverURL: serverURL, jwt: bravoJWT}
+	_, resp = apisBravo.importDirectory(ctx, csvBody, "text/csv", "dryRun=true")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, resp = apisBravo.exportDirectory(ctx)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
 func TestDirectoryAPIDisabledOnClubhouseDeployments(t *testing.T) {
 	t.Parallel()
 	ctx := t.Context()
@@ -576,6 +960,148 @@ func TestDirectoryPersonPassword(t *testing.T) {
 	require.Equal(t, http.StatusOK, statusCode)
 }
 
+func TestDirectoryPasswordRehash(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL := newIMSDirectoryServer(t, ctx)
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	// A person whose password was hashed with params weaker than the target,
+	// e.g. by an older version of IMS.
+	handle := "RehashPerson-" + rand.NonCryptoText()
+	password := "pw-" + rand.NonCryptoText()
+	personID, err := shared.imsDBQ.DirectoryCreatePerson(ctx, shared.imsDBQ, imsdb.DirectoryCreatePersonParams{
+		Handle:   handle,
+		Password: argon2id.CreateHash(password, argon2id.ClubhouseParams),
+		Active:   true,
+	})
+	require.NoError(t, err)
+
+	// The report counts that hash as weaker than the target. The directory is
+	// shared with other tests, so its counts are only lower bounds.
+	passwordHashesPath := serverURL.JoinPath("/ims/api/directory/password_hashes").String()
+	out, resp := apisAdmin.imsGet(ctx, passwordHashesPath, &imsjson.DirectoryPasswordHashes{})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	report := out.(*imsjson.DirectoryPasswordHashes)
+	target := shared.cfg.Core.PasswordHashParams.String()
+	assert.Equal(t, target, report.Target)
+	var clubhouseParams imsjson.DirectoryPasswordHashParams
+	for _, p := range report.Params {
+		if p.Params == argon2id.ClubhouseParams.String() {
+			clubhouseParams = p
+		}
+	}
+	assert.True(t, clubhouseParams.Weaker)
+	assert.GreaterOrEqual(t, clubhouseParams.Count, int32(1))
+
+	// Logging in replaces the hash with one made with the target params.
+	statusCode, _, _ := unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: handle,
+		Password:       password,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	persons, err := shared.imsDBQ.DirectoryActivePersons(ctx, shared.imsDBQ)
+	require.NoError(t, err)
+	var storedHash string
+	for _, p := range persons {
+		if int64(p.ID) == personID {
+			storedHash = p.Password
+		}
+	}
+	params, _, _, err := argon2id.DecodeHash(storedHash)
+	require.NoError(t, err)
+	assert.Equal(t, target, params.String())
+
+	// And the password still works, of course.
+	statusCode, _, _ = unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: handle,
+		Password:       password,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+}
+
+// requireViolations checks that a response is a 400 for breaking the given
+// rules.
+func requireViolations(t *testing.T, resp *http.Response, rules ...string) {
+	t.Helper()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var problem herr.Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	require.NoError(t, resp.Body.Close())
+	var got []string
+	for _, v := range problem.Violations {
+		got = append(got, v.Rule)
+		assert.Contains(t, problem.Detail, v.Detail)
+	}
+	assert.Equal(t, rules, got)
+}
+
+func TestDirectoryPasswordPolicy(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	// A breached-password corpus in which "correct horse battery" has been
+	// seen. Its SHA-1 is 98DECC62ECE399A22ED30D490EF333BE7FDE7385.
+	corpusDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(corpusDir, "98DEC.txt"),
+		[]byte("C62ECE399A22ED30D490EF333BE7FDE7385:42\r\n"), 0o600))
+	corpus, err := os.OpenRoot(corpusDir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = corpus.Close() })
+	serverURL := newIMSDirectoryServer(t, ctx, func(cfg *conf.IMSConfig) {
+		cfg.Core.PasswordBreachedCorpus = corpus
+	})
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	handle := "PolicyPerson-" + rand.NonCryptoText()
+	email := strings.ToLower(handle) + "@example.com"
+	personID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{Handle: &handle, Email: &email})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, personID)
+
+	// The new person has never had a password checked against the policy.
+	policyPath := serverURL.JoinPath("/ims/api/directory/password_policy").String()
+	predating := func() map[int64]imsjson.DirectoryPasswordPolicyPerson {
+		out, resp := apisAdmin.imsGet(ctx, policyPath, &imsjson.DirectoryPasswordPolicy{})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		report := out.(*imsjson.DirectoryPasswordPolicy)
+		assert.Equal(t, "min=12,max=256,identity,breached", report.Current)
+		byID := make(map[int64]imsjson.DirectoryPasswordPolicyPerson)
+		for _, p := range report.Predating {
+			byID[p.ID] = p
+		}
+		return byID
+	}
+	require.Contains(t, predating(), *personID)
+	assert.Nil(t, predating()[*personID].Policy)
+
+	// The policy's rules are all reported when they're broken.
+	requireViolations(t, apisAdmin.setDirectoryPersonPassword(ctx, *personID, "short"), "min_length")
+	requireViolations(t, apisAdmin.setDirectoryPersonPassword(ctx, *personID, strings.ToUpper(email)), "not_identity")
+	requireViolations(t, apisAdmin.setDirectoryPersonPassword(ctx, *personID, handle), "not_identity")
+	requireViolations(t, apisAdmin.setDirectoryPersonPassword(ctx, *personID, "correct horse battery"), "not_breached")
+	requireViolations(t, apisAdmin.setDirectoryPersonPassword(ctx, *personID, ""), "min_length")
+
+	// A password that follows the policy is set, and recorded as following it.
+	password := "policy-abiding-" + rand.NonCryptoText()
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, *personID, password)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.NotContains(t, predating(), *personID)
+	statusCode, _, _ := unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: handle,
+		Password:       password,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+
+	// Only admins may see the report.
+	_, resp = unauthed.imsGet(ctx, policyPath, &imsjson.DirectoryPasswordPolicy{})
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
 func TestDirectoryGroupValidationAndUpdate(t *testing.T) {
 	t.Parallel()
 	ctx := t.Context()
@@ -809,3 +1335,54 @@ func (a ApiHelper) deleteDirectoryPosition(ctx context.Context, positionID int64
 	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/directory/positions/", conv.FormatInt(positionID)).String(), nil)
 	return resp
 }
+
+func (a ApiHelper) signOnDirectoryPerson(ctx context.Context, personID, positionID int64) *http.Response {
+	a.t.Helper()
+	req := imsjson.DirectoryOnDuty{PositionID: positionID}
+	return a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/directory/persons/", conv.FormatInt(personID), "/on_duty").String())
+}
+
+func (a ApiHelper) signOffDirectoryPerson(ctx context.Context, personID int64) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/directory/persons/", conv.FormatInt(personID), "/on_duty").String(), nil)
+	return resp
+}
+
+func (a ApiHelper) getDirectoryShifts(ctx context.Context, personID int64, since time.Time) (imsjson.DirectoryShifts, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/directory/shifts")
+	path.RawQuery = url.Values{
+		"personId":      {conv.FormatInt(personID)},
+		"minTimeUnixMs": {conv.FormatInt(since.UnixMilli())},
+	}.Encode()
+	bod, resp := a.imsGet(ctx, path.String(), &imsjson.DirectoryShifts{})
+	return *bod.(*imsjson.DirectoryShifts), resp
+}
+
+func (a ApiHelper) importDirectory(ctx context.Context, body, contentType, query string) (imsjson.DirectoryImport, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/directory/import")
+	path.RawQuery = query
+	httpPost, err := http.NewRequestWithContext(ctx, http.MethodPost, path.String(), strings.NewReader(body))
+	require.NoError(a.t, err)
+	httpPost.Header.Set("Content-Type", contentType)
+	httpPost.Header.Set("Authorization", "Bearer "+a.jwt)
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	// #nosec G704 // SSRF via taint analysis. We control the URLs.
+	resp, err := client.Do(httpPost)
+	require.NoError(a.t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var result imsjson.DirectoryImport
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(a.t, json.NewDecoder(resp.Body).Decode(&result))
+	}
+	return result, resp
+}
+
+func (a ApiHelper) exportDirectory(ctx context.Context) (imsjson.DirectoryBulk, *http.Response) {
+	a.t.Helper()
+	bod, resp := a.imsGet(ctx, a.serverURL.JoinPath("/ims/api/directory/export").String(), &imsjson.DirectoryBulk{})
+	return *bod.(*imsjson.DirectoryBulk), resp
+}
@@ -69,10 +69,11 @@ func TestGetAndEditEvent(t *testing.T) {
 	require.NoError(t, resp.Body.Close())
 
 	expectedAccessResult := imsjson.EventAccess{
-		Writers:      accessReq[testEventName].Writers,
-		Readers:      []imsjson.AccessRule{},
-		Reporters:    []imsjson.AccessRule{},
-		VisitWriters: []imsjson.AccessRule{},
+		Writers:             accessReq[testEventName].Writers,
+		Readers:             []imsjson.AccessRule{},
+		Reporters:           []imsjson.AccessRule{},
+		VisitWriters:        []imsjson.AccessRule{},
+		ConfidentialReaders: []imsjson.AccessRule{},
 	}
 	expectedAccessResult.Writers[0].DebugInfo.MatchesUsers = []string{userAdminHandle}
 	expectedAccessResult.Writers[0].DebugInfo.KnownTarget = true
@@ -468,7 +469,7 @@ func TestDeleteEvent(t *testing.T) {
 	cfg := *shared.cfg
 	cfg.Core.EventDeletionEnabled = true
 	deletionServer := httptest.NewServer(
-		api.AddToMux(nil, api.NewEventSourcerer(), &cfg, shared.imsDBQ, shared.userStore, nil, shared.actionLogger, shared.errorLogger),
+		api.AddToMux(nil, api.NewEventSourcerer(nil, false), &cfg, shared.imsDBQ, shared.userStore, nil, shared.actionLogger, shared.errorLogger),
 	)
 	t.Cleanup(deletionServer.Close)
 	deletionServerURL, err := url.Parse(deletionServer.URL)
@@ -17,11 +17,16 @@
 package integration_test
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"testing"
+	"time"
 
 	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
 	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -241,6 +246,302 @@ func TestEventAccessModesAreIndependent(t *testing.T) {
 	require.Len(t, got.VisitWriters, 1)
 }
 
+// TestEventAccessCompoundExpression checks that a rule can combine targets
+// with operators, and that an expression that doesn't parse is refused without
+// changing any access.
+func TestEventAccessCompoundExpression(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	eventName := rand.NonCryptoText()
+	_, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Alice holds Nooperator, and only the admin is on Brown Dot.
+	expr := "position:Nooperator AND NOT team:Brown Dot"
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Readers: []imsjson.AccessRule{{Expression: expr, Validity: "always"}},
+		},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	accessResult, resp := apisAdmin.getAccess(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	readers := accessResult[eventName].Readers
+	require.Len(t, readers, 1)
+	assert.Equal(t, []string{userAliceHandle}, readers[0].DebugInfo.MatchesUsers)
+	assert.True(t, readers[0].DebugInfo.KnownTarget)
+
+	auth, resp := apisAlice.getAuth(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.True(t, auth.EventAccess[eventName].ReadIncidents)
+
+	// A bad expression is a 400, and the rules already there stay put.
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Readers: []imsjson.AccessRule{{Expression: "position:Nooperator AND", Validity: "always"}},
+		},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	accessResult, resp = apisAdmin.getAccess(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	readers = accessResult[eventName].Readers
+	require.Len(t, readers, 1)
+	assert.Equal(t, expr, readers[0].Expression)
+}
+
+// TestExplainEventAccess checks that an admin can see which rules give
+// someone their permissions on an event, including those from its group, and
+// why the others don't.
+func TestExplainEventAccess(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	groupName := rand.NonCryptoText()
+	groupID, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &groupName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	status, body := editEventBody(ctx, t, apisAdmin, imsjson.Event{ID: groupID, IsGroup: new(true)})
+	require.Equal(t, http.StatusNoContent, status, body)
+
+	eventName := rand.NonCryptoText()
+	eventID, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	status, body = editEventBody(ctx, t, apisAdmin, imsjson.Event{ID: eventID, ParentGroup: new(groupID)})
+	require.Equal(t, http.StatusNoContent, status, body)
+
+	// Alice holds Nooperator, and isn't on Brown Dot.
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Writers: []imsjson.AccessRule{{Expression: "team:Brown Dot", Validity: "always"}},
+			Reporters: []imsjson.AccessRule{{
+				Expression: "position:Nooperator", Validity: "always", NotAfter: time.Now().Add(-time.Hour),
+			}},
+		},
+		groupName: imsjson.EventAccess{
+			Readers: []imsjson.AccessRule{{Expression: "position:Nooperator", Validity: "always"}},
+		},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Only an admin may ask.
+	_, resp = apisAlice.explainAccess(ctx, userAliceHandle, eventName)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	_, resp = apisAdmin.explainAccess(ctx, "No Such Ranger "+rand.NonCryptoText(), eventName)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	explanation, resp := apisAdmin.explainAccess(ctx, userAliceHandle, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, userAliceHandle, explanation.Handle)
+	assert.False(t, explanation.Admin)
+	assert.Contains(t, explanation.GlobalPermissions, "listEvents")
+	assert.NotContains(t, explanation.GlobalPermissions, "administrateEvents")
+
+	require.Len(t, explanation.Events, 1)
+	got := explanation.Events[0]
+	assert.Equal(t, eventName, got.Event)
+	assert.Equal(t, uint16(authz.RolesToEventPerms[authz.EventReader]), got.EventPermissionMask)
+	assert.Contains(t, got.EventPermissions, "readIncidents")
+	assert.NotContains(t, got.EventPermissions, "writeIncidents")
+
+	rules := make(map[string]imsjson.AccessRuleExplanation)
+	for _, r := range got.Rules {
+		rules[r.Mode] = r
+	}
+	require.Len(t, rules, 3)
+	assert.False(t, rules["write"].Matched)
+	assert.Equal(t, []string{"expression"}, rules["write"].Mismatches)
+	assert.False(t, rules["report"].Matched)
+	assert.Equal(t, []string{"not_after"}, rules["report"].Mismatches)
+	assert.True(t, rules["read"].Matched)
+	assert.Empty(t, rules["read"].Mismatches)
+	assert.Equal(t, groupName, rules["read"].InheritedFrom)
+	assert.Empty(t, rules["write"].InheritedFrom)
+}
+
+// TestEventAccessHistory checks that each change to an event's rules is kept,
+// with who made it, and that the rules can be seen and restored as they were
+// at an earlier time.
+func TestEventAccessHistory(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	eventName := rand.NonCryptoText()
+	_, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	aliceWriter := imsjson.AccessRule{Expression: "person:" + userAliceHandle, Validity: "always", Description: "Dispatch"}
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{Writers: []imsjson.AccessRule{aliceWriter}},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Posting the same rules again isn't a change.
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{Writers: []imsjson.AccessRule{aliceWriter}},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	history, resp := apisAdmin.getAccessHistory(ctx, eventName, time.Time{})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, history.Changes, 1)
+	assert.Nil(t, history.Access)
+	aliceWrote := history.Changes[0]
+	assert.Equal(t, "write", aliceWrote.Mode)
+	assert.Equal(t, userAdminHandle, aliceWrote.Author)
+	assert.Empty(t, aliceWrote.Before)
+	require.Len(t, aliceWrote.After, 1)
+	assert.Equal(t, aliceWriter.Expression, aliceWrote.After[0].Expression)
+	assert.Equal(t, "Dispatch", aliceWrote.After[0].Description)
+
+	// Demote Alice to a reader.
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Writers: []imsjson.AccessRule{},
+			Readers: []imsjson.AccessRule{{Expression: aliceWriter.Expression, Validity: "always"}},
+		},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// As of when she was made a writer, she was only a writer.
+	history, resp = apisAdmin.getAccessHistory(ctx, eventName, aliceWrote.Created)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, history.Changes, 3)
+	require.NotNil(t, history.Access)
+	require.Len(t, history.Access.Writers, 1)
+	assert.Equal(t, aliceWriter.Expression, history.Access.Writers[0].Expression)
+	assert.Empty(t, history.Access.Readers)
+
+	// Only an admin may look at, or restore, the history.
+	_, resp = apisAlice.getAccessHistory(ctx, eventName, time.Time{})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAlice.restoreAccess(ctx, imsjson.EventAccessRestore{Event: eventName, At: aliceWrote.Created})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp = apisAdmin.restoreAccess(ctx, imsjson.EventAccessRestore{Event: eventName, At: aliceWrote.Created})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	accessResult, resp := apisAdmin.getAccess(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	got := accessResult[eventName]
+	require.Len(t, got.Writers, 1)
+	assert.Equal(t, aliceWriter.Expression, got.Writers[0].Expression)
+	assert.Equal(t, "Dispatch", got.Writers[0].Description)
+	assert.Empty(t, got.Readers)
+
+	// The restore is in the history too.
+	history, resp = apisAdmin.getAccessHistory(ctx, eventName, time.Time{})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	assert.Len(t, history.Changes, 5)
+}
+
+func (q casInterceptor) AddEventAccess(ctx context.Context, db imsdb.DBTX, arg imsdb.AddEventAccessParams) (int64, error) {
+	if q.addEventAccessErr != nil {
+		if err := q.addEventAccessErr(ctx, arg); err != nil {
+			return 0, err
+		}
+	}
+	return q.Querier.AddEventAccess(ctx, db, arg)
+}
+
+// TestEventAccessRestoreIsAllOrNothing checks that a restore which fails part
+// way through leaves every mode's rules as they were, including the modes that
+// were restored before the failure.
+func TestEventAccessRestoreIsAllOrNothing(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+
+	eventName := rand.NonCryptoText()
+	_, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	alice := "person:" + userAliceHandle
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{Writers: []imsjson.AccessRule{{Expression: alice, Validity: "always"}}},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	history, resp := apisAdmin.getAccessHistory(ctx, eventName, time.Time{})
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, history.Changes, 1)
+	aliceWrote := history.Changes[0].Created
+
+	// Demote Alice to a reader.
+	resp = apisAdmin.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			Writers: []imsjson.AccessRule{},
+			Readers: []imsjson.AccessRule{{Expression: alice, Validity: "always"}},
+		},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Restoring to when Alice was a writer clears the readers first, then
+	// fails when it gets to putting back the writer.
+	hookedURL := interceptedServer(t, casInterceptor{
+		addEventAccessErr: func(ctx context.Context, arg imsdb.AddEventAccessParams) error {
+			if arg.Mode == imsdb.EventAccessModeWrite {
+				return errors.New("injected failure")
+			}
+			return nil
+		},
+	})
+	hookedAdmin := ApiHelper{t: t, serverURL: hookedURL, jwt: apisAdmin.jwt}
+	resp = hookedAdmin.restoreAccess(ctx, imsjson.EventAccessRestore{Event: eventName, At: aliceWrote})
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Alice is still just a reader, and the failed restore isn't in the history.
+	accessResult, resp := apisAdmin.getAccess(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	got := accessResult[eventName]
+	assert.Empty(t, got.Writers)
+	require.Len(t, got.Readers, 1)
+	assert.Equal(t, alice, got.Readers[0].Expression)
+
+	history, resp = apisAdmin.getAccessHistory(ctx, eventName, time.Time{})
+	require.NoError(t, resp.Body.Close())
+	assert.Len(t, history.Changes, 3)
+}
+
 func TestGetAccessTargets(t *testing.T) {
 	t.Parallel()
 	ctx := t.Context()
@@ -0,0 +1,192 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/require"
+)
+
+// sseWatcher collects Server-Sent Events published after it was created.
+type sseWatcher struct {
+	t    *testing.T
+	seen chan api.IMSEventData
+	// ended is closed once the server ends the stream.
+	ended chan struct{}
+
+	// passed holds every push that await has read, including the ones that
+	// didn't match what it was waiting for.
+	passed []api.IMSEventData
+}
+
+// subscribeToEventSource opens a streaming connection to the SSE endpoint as
+// the holder of jwt, and reads pushes into a channel until the test ends.
+func subscribeToEventSource(ctx context.Context, t *testing.T, jwt string) *sseWatcher {
+	t.Helper()
+
+	path := shared.serverURL.JoinPath("ims/api/eventsource").String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	// #nosec G704 // SSRF via taint analysis. We control the URLs.
+	resp, err := (&http.Client{}).Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	w := &sseWatcher{t: t, seen: make(chan api.IMSEventData, 128), ended: make(chan struct{})}
+	go func() {
+		defer close(w.ended)
+		scanner := bufio.NewScanner(resp.Body)
+		// Pushes carry whole entities, which can outgrow the default line limit.
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var parsed api.IMSEventData
+			err := json.Unmarshal([]byte(data), &parsed)
+			if err != nil {
+				continue
+			}
+			select {
+			case w.seen <- parsed:
+			default:
+			}
+		}
+	}()
+	return w
+}
+
+// await waits a short while for a push about the same entity as want, and
+// returns it. Unrelated pushes from other parallel tests are passed over.
+func (w *sseWatcher) await(want api.IMSEventData) (api.IMSEventData, bool) {
+	w.t.Helper()
+	deadline := time.After(15 * time.Second)
+	for {
+		select {
+		case got := <-w.seen:
+			w.passed = append(w.passed, got)
+			if sameEntity(got, want) {
+				return got, true
+			}
+		case <-deadline:
+			return api.IMSEventData{}, false
+		}
+	}
+}
+
+// sawAny reports whether await has read a push about the same entity as
+// unwanted. Each stream gets its pushes in order, so anything published before
+// the push that await last returned would have been read by then.
+func (w *sseWatcher) sawAny(unwanted api.IMSEventData) bool {
+	for _, got := range w.passed {
+		if sameEntity(got, unwanted) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameEntity(a, b api.IMSEventData) bool {
+	return a.EventID == b.EventID &&
+		a.IncidentNumber == b.IncidentNumber &&
+		a.FieldReportNumber == b.FieldReportNumber &&
+		a.VisitNumber == b.VisitNumber
+}
+
+func TestEventSource_FiltersByEvent(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	// Alice is a Writer on this Event...
+	aliceEvent, aliceEventID := newEventWithWriterID(t, apisAdmin)
+
+	// ...but has no access at all to this one.
+	otherEvent := rand.NonCryptoText()
+	otherEventID, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &otherEvent})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.addWriter(ctx, otherEvent, userAdminHandle)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	events := subscribeToEventSource(ctx, t, apisAlice.jwt)
+
+	otherIncident := apisAdmin.newIncidentSuccess(ctx, sampleIncident1(otherEvent))
+	otherFieldReport := apisAdmin.newFieldReportSuccess(ctx, sampleFieldReport1(otherEvent))
+	aliceIncident := apisAlice.newIncidentSuccess(ctx, sampleIncident1(aliceEvent))
+
+	pushed, ok := events.await(api.IMSEventData{EventID: aliceEventID, IncidentNumber: aliceIncident})
+	require.True(t, ok, "no SSE push for Alice's Incident")
+	require.False(t, events.sawAny(api.IMSEventData{EventID: otherEventID, IncidentNumber: otherIncident}))
+	require.False(t, events.sawAny(api.IMSEventData{EventID: otherEventID, FieldReportNumber: otherFieldReport}))
+
+	// The push carries the same Incident that a GET returns.
+	retrieved, resp := apisAlice.getIncident(ctx, aliceEvent, aliceIncident)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, pushed.Incident)
+	require.Equal(t, retrieved, *pushed.Incident)
+}
+
+func TestEventSource_OwnFieldReports(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	// Alice is only a Reporter here, so she may read only her own Field Reports.
+	eventName := rand.NonCryptoText()
+	eventID, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.addReporter(ctx, eventName, userAliceHandle)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.addWriter(ctx, eventName, userAdminHandle)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	events := subscribeToEventSource(ctx, t, apisAlice.jwt)
+
+	adminFieldReport := apisAdmin.newFieldReportSuccess(ctx, sampleFieldReport1(eventName))
+	aliceFieldReport := apisAlice.newFieldReportSuccess(ctx, sampleFieldReport1(eventName))
+
+	pushed, ok := events.await(api.IMSEventData{EventID: eventID, FieldReportNumber: aliceFieldReport})
+	require.True(t, ok, "no SSE push for Alice's own Field Report")
+	require.False(t, events.sawAny(api.IMSEventData{EventID: eventID, FieldReportNumber: adminFieldReport}))
+
+	retrieved, resp := apisAlice.getFieldReport(ctx, eventName, aliceFieldReport)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, pushed.FieldReport)
+	require.Equal(t, retrieved, *pushed.FieldReport)
+}
@@ -182,6 +182,14 @@ func (a ApiHelper) getFieldReports(ctx context.Context, eventName string) (imsjs
 	return *bod.(*imsjson.FieldReports), resp
 }
 
+func (a ApiHelper) getFieldReportsWithQuery(ctx context.Context, eventName string, params url.Values) (imsjson.FieldReports, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events/", eventName, "/field_reports")
+	path.RawQuery = params.Encode()
+	bod, resp := a.imsGet(ctx, path.String(), &imsjson.FieldReports{})
+	return *bod.(*imsjson.FieldReports), resp
+}
+
 func (a ApiHelper) updateFieldReport(ctx context.Context, eventName string, fieldReport int32, req imsjson.FieldReport) *http.Response {
 	a.t.Helper()
 	return a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/events/", eventName, "/field_reports/", conv.FormatInt(fieldReport)).String())
@@ -354,6 +362,27 @@ func (a ApiHelper) getIncidents(ctx context.Context, eventName string) (imsjson.
 	return *bod.(*imsjson.Incidents), resp
 }
 
+func (a ApiHelper) getIncidentsWithQuery(ctx context.Context, eventName string, params url.Values) (imsjson.Incidents, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events/", eventName, "/incidents")
+	path.RawQuery = params.Encode()
+	bod, resp := a.imsGet(ctx, path.String(), &imsjson.Incidents{})
+	return *bod.(*imsjson.Incidents), resp
+}
+
+func (a ApiHelper) mergeIncident(ctx context.Context, eventName string, survivor, duplicate int32) *http.Response {
+	a.t.Helper()
+	return a.imsPost(ctx, imsjson.IncidentMerge{Duplicate: duplicate},
+		a.serverURL.JoinPath("/ims/api/events/", eventName, "/incidents/", conv.FormatInt(survivor), "/merge").String())
+}
+
+func (a ApiHelper) getIncidentMetrics(ctx context.Context, eventName string) (imsjson.IncidentMetrics, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events/", eventName, "/incident_metrics").String()
+	bod, resp := a.imsGet(ctx, path, &imsjson.IncidentMetrics{})
+	return *bod.(*imsjson.IncidentMetrics), resp
+}
+
 func (a ApiHelper) getVisits(ctx context.Context, eventName string) (imsjson.Visits, *http.Response) {
 	a.t.Helper()
 	path := a.serverURL.JoinPath(fmt.Sprint("/ims/api/events/", eventName, "/visits")).String()
@@ -361,6 +390,24 @@ func (a ApiHelper) getVisits(ctx context.Context, eventName string) (imsjson.Vis
 	return *bod.(*imsjson.Visits), resp
 }
 
+func (a ApiHelper) getVisitsWithQuery(ctx context.Context, eventName string, params url.Values) (imsjson.Visits, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events/", eventName, "/visits")
+	path.RawQuery = params.Encode()
+	bod, resp := a.imsGet(ctx, path.String(), &imsjson.Visits{})
+	return *bod.(*imsjson.Visits), resp
+}
+
+func (a ApiHelper) getChanges(ctx context.Context, eventName, cursor string) (imsjson.Changes, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events/", eventName, "/changes")
+	if cursor != "" {
+		path.RawQuery = url.Values{"cursor": {cursor}}.Encode()
+	}
+	bod, resp := a.imsGet(ctx, path.String(), &imsjson.Changes{})
+	return *bod.(*imsjson.Changes), resp
+}
+
 func (a ApiHelper) updateIncidentReportEntry(ctx context.Context, eventName string, incident int32, req imsjson.ReportEntry) *http.Response {
 	a.t.Helper()
 	return a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/events/", eventName, "/incidents/", conv.FormatInt(incident), "/report_entries/", conv.FormatInt(req.ID)).String())
@@ -456,6 +503,18 @@ func (a ApiHelper) addVisitWriter(ctx context.Context, eventName, handle string)
 	})
 }
 
+func (a ApiHelper) addConfidentialReader(ctx context.Context, eventName, handle string) *http.Response {
+	a.t.Helper()
+	return a.editAccess(ctx, imsjson.EventsAccess{
+		eventName: imsjson.EventAccess{
+			ConfidentialReaders: []imsjson.AccessRule{{
+				Expression: "person:" + handle,
+				Validity:   "always",
+			}},
+		},
+	})
+}
+
 func (a ApiHelper) editAccess(ctx context.Context, req imsjson.EventsAccess) *http.Response {
 	a.t.Helper()
 	return a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/access").String())
@@ -473,6 +532,56 @@ func (a ApiHelper) getAccessTargets(ctx context.Context) (imsjson.AccessTargets,
 	return *bod.(*imsjson.AccessTargets), resp
 }
 
+func (a ApiHelper) explainAccess(ctx context.Context, handle, eventName string) (imsjson.AccessExplanation, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/access/explain")
+	query := url.Values{"handle": {handle}}
+	if eventName != "" {
+		query.Set("event_id", eventName)
+	}
+	path.RawQuery = query.Encode()
+	bod, resp := a.imsGet(ctx, path.String(), &imsjson.AccessExplanation{})
+	return *bod.(*imsjson.AccessExplanation), resp
+}
+
+func (a ApiHelper) getAccessHistory(ctx context.Context, eventName string, at time.Time) (imsjson.EventAccessHistory, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/access/history")
+	query := url.Values{"event_id": {eventName}}
+	if !at.IsZero() {
+		query.Set("at", at.Format(time.RFC3339Nano))
+	}
+	path.RawQuery = query.Encode()
+	bod, resp := a.imsGet(ctx, path.String(), &imsjson.EventAccessHistory{})
+	return *bod.(*imsjson.EventAccessHistory), resp
+}
+
+func (a ApiHelper) restoreAccess(ctx context.Context, req imsjson.EventAccessRestore) *http.Response {
+	a.t.Helper()
+	return a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/access/restore").String())
+}
+
+func (a ApiHelper) breakGlass(
+	ctx context.Context, eventName, recordPath string, number int32, justification string,
+) (imsjson.BreakGlass, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events", eventName, recordPath, conv.FormatInt(number), "break_glass")
+	resp := a.imsPost(ctx, imsjson.BreakGlassRequest{Justification: justification}, path.String())
+	var grant imsjson.BreakGlass
+	if resp.StatusCode == http.StatusOK {
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(a.t, err)
+		require.NoError(a.t, json.Unmarshal(b, &grant))
+	}
+	return grant, resp
+}
+
+func (a ApiHelper) getBreakGlasses(ctx context.Context) ([]imsjson.BreakGlass, *http.Response) {
+	a.t.Helper()
+	bod, resp := a.imsGet(ctx, a.serverURL.JoinPath("/ims/api/break_glass").String(), &[]imsjson.BreakGlass{})
+	return *bod.(*[]imsjson.BreakGlass), resp
+}
+
 func (a ApiHelper) attachFileToIncident(ctx context.Context, eventName string, incident int32, fileBytes []byte) (int32, *http.Response) {
 	a.t.Helper()
 
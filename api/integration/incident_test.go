@@ -729,6 +729,77 @@ func TestLinkIncidentAcrossEvents(t *testing.T) {
 	require.Empty(t, *incidentB.LinkedIncidents)
 }
 
+func TestIncidentStateChangesAndMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisNonAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+
+	eventName := rand.NonCryptoText()
+	_, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Alice can't see the metrics until she has access to the event
+	_, resp = apisNonAdmin.getIncidentMetrics(ctx, eventName)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp = apisAdmin.addWriter(ctx, eventName, userAliceHandle)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	metrics, resp := apisNonAdmin.getIncidentMetrics(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, imsjson.IncidentMetrics{Event: eventName}, metrics)
+
+	num := apisNonAdmin.newIncidentSuccess(ctx, imsjson.Incident{Event: eventName})
+	incident, resp := apisNonAdmin.getIncident(ctx, eventName, num)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, incident.StateChanges)
+	require.Empty(t, *incident.StateChanges)
+
+	for _, state := range []string{"dispatched", "on_scene", "on_scene", "closed"} {
+		resp = apisNonAdmin.updateIncident(ctx, eventName, num, imsjson.Incident{State: state})
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	// The repeated on_scene wasn't a change, so it isn't in the history
+	incident, resp = apisNonAdmin.getIncident(ctx, eventName, num)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, incident.StateChanges)
+	var states []string
+	for _, sc := range *incident.StateChanges {
+		states = append(states, sc.State)
+		require.Equal(t, userAliceHandle, sc.Author)
+		require.WithinDuration(t, time.Now(), sc.Created, 5*time.Minute)
+	}
+	require.Equal(t, []string{"dispatched", "on_scene", "closed"}, states)
+
+	// The list endpoint carries the same history
+	incidents, resp := apisNonAdmin.getIncidents(ctx, eventName)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, incidents, 1)
+	require.Equal(t, incident.StateChanges, incidents[0].StateChanges)
+
+	// A second Incident that's never been touched counts toward the total,
+	// but not toward any of the distributions.
+	_ = apisNonAdmin.newIncidentSuccess(ctx, imsjson.Incident{Event: eventName})
+
+	metrics, resp = apisNonAdmin.getIncidentMetrics(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, eventName, metrics.Event)
+	require.Equal(t, 2, metrics.Incidents)
+	require.Equal(t, 1, metrics.TimeToDispatch.Count)
+	require.Equal(t, 1, metrics.TimeOnScene.Count)
+	require.Equal(t, 1, metrics.TimeToClose.Count)
+	require.GreaterOrEqual(t, metrics.TimeToClose.Max, metrics.TimeToDispatch.Max)
+}
+
 // requireEqualIncident is a hacky way of checking two incident responses are the same.
 // It does not consider ReportEntries.
 func requireEqualIncident(t *testing.T, before, after imsjson.Incident) {
@@ -766,6 +837,7 @@ func requireEqualIncident(t *testing.T, before, after imsjson.Incident) {
 	before.FieldReports, after.FieldReports = nil, nil
 	before.Visits, after.Visits = nil, nil
 	before.LinkedIncidents, after.LinkedIncidents = nil, nil
+	before.StateChanges, after.StateChanges = nil, nil
 
 	require.Equal(t, before, after)
 }
@@ -0,0 +1,209 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeIncident(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithWriter(t, apisAdmin)
+
+	typeName := rand.NonCryptoText()
+	typeID, resp := apisAdmin.editType(ctx, imsjson.IncidentType{Name: &typeName})
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, typeID)
+
+	survivor := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+	duplicate := apis.newIncidentSuccess(ctx, imsjson.Incident{
+		Event:         eventName,
+		ReportEntries: []imsjson.ReportEntry{{Text: "the duplicate's own entry"}},
+	})
+	peer := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+
+	// Give the duplicate one of everything
+	resp = apis.attachRangerToIncident(ctx, eventName, duplicate, "SomeRanger")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apis.attachTypeToIncident(ctx, eventName, duplicate, *typeID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apis.linkIncident(ctx, eventName, duplicate, eventName, peer)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apis.linkIncident(ctx, eventName, duplicate, eventName, survivor)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	fr := apis.newFieldReportSuccess(ctx, imsjson.FieldReport{Event: eventName, Summary: new("a field report")})
+	resp = apis.attachFieldReportToIncident(ctx, eventName, fr, duplicate)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	visit := apis.newVisitSuccess(ctx, imsjson.Visit{Event: eventName, Incident: &duplicate})
+
+	// Some bad requests
+	resp = apis.mergeIncident(ctx, eventName, survivor, survivor)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apis.mergeIncident(ctx, eventName, survivor, 99999)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp = apis.mergeIncident(ctx, eventName, survivor, duplicate)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	merged, resp := apis.getIncident(ctx, eventName, duplicate)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "closed", merged.State)
+	require.NotNil(t, merged.MergedInto)
+	require.Equal(t, survivor, *merged.MergedInto)
+	require.Len(t, merged.ReportEntries, 1)
+	require.Equal(t, "Merged into #"+conv.FormatInt(survivor), lastReportEntryText(t, merged))
+	require.Empty(t, *merged.Rangers)
+	require.Empty(t, *merged.IncidentTypeIDs)
+	require.Empty(t, *merged.LinkedIncidents)
+	require.Empty(t, *merged.FieldReports)
+	require.Empty(t, *merged.Visits)
+
+	kept, resp := apis.getIncident(ctx, eventName, survivor)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Nil(t, kept.MergedInto)
+	require.Equal(t, "Merged in #"+conv.FormatInt(duplicate), lastReportEntryText(t, kept))
+	require.True(t, slices.ContainsFunc(kept.ReportEntries, func(re imsjson.ReportEntry) bool {
+		return re.Text == "the duplicate's own entry"
+	}))
+	require.Equal(t, []imsjson.IncidentRanger{{Handle: "SomeRanger"}}, *kept.Rangers)
+	require.Equal(t, []int32{*typeID}, *kept.IncidentTypeIDs)
+	require.Len(t, *kept.LinkedIncidents, 1)
+	require.Equal(t, peer, (*kept.LinkedIncidents)[0].Number)
+	require.Equal(t, []int32{fr}, *kept.FieldReports)
+	require.Equal(t, []int32{visit}, *kept.Visits)
+
+	// The peer's link now points at the survivor
+	peerIncident, resp := apis.getIncident(ctx, eventName, peer)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, *peerIncident.LinkedIncidents, 1)
+	require.Equal(t, survivor, (*peerIncident.LinkedIncidents)[0].Number)
+
+	// A merged Incident can't be merged again, nor can anything be merged into it
+	resp = apis.mergeIncident(ctx, eventName, survivor, duplicate)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apis.mergeIncident(ctx, eventName, duplicate, peer)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestMergeIncidentChainConcurrently(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithWriter(t, apisAdmin)
+
+	hasEntry := func(incident imsjson.Incident, text string) bool {
+		return slices.ContainsFunc(incident.ReportEntries, func(re imsjson.ReportEntry) bool {
+			return re.Text == text
+		})
+	}
+
+	for range 5 {
+		a := apis.newIncidentSuccess(ctx, imsjson.Incident{
+			Event:         eventName,
+			ReportEntries: []imsjson.ReportEntry{{Text: "a's own entry"}},
+		})
+		b := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+		c := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+
+		// Merge A into B at the same time as B into C
+		var aIntoB, bIntoC int
+		var wg sync.WaitGroup
+		wg.Go(func() {
+			resp := apis.mergeIncident(ctx, eventName, b, a)
+			aIntoB = resp.StatusCode
+			_ = resp.Body.Close()
+		})
+		wg.Go(func() {
+			resp := apis.mergeIncident(ctx, eventName, c, b)
+			bIntoC = resp.StatusCode
+			_ = resp.Body.Close()
+		})
+		wg.Wait()
+
+		// B into C always works. A into B only works if it got there first.
+		require.Equal(t, http.StatusNoContent, bIntoC)
+		require.Contains(t, []int{http.StatusNoContent, http.StatusBadRequest}, aIntoB)
+
+		// Either way, A's entry mustn't be left behind on B, which is now closed
+		incidentB, resp := apis.getIncident(ctx, eventName, b)
+		require.NoError(t, resp.Body.Close())
+		require.NotNil(t, incidentB.MergedInto)
+		require.Equal(t, c, *incidentB.MergedInto)
+		require.False(t, hasEntry(incidentB, "a's own entry"))
+
+		incidentA, resp := apis.getIncident(ctx, eventName, a)
+		require.NoError(t, resp.Body.Close())
+		incidentC, resp := apis.getIncident(ctx, eventName, c)
+		require.NoError(t, resp.Body.Close())
+		require.Nil(t, incidentC.MergedInto)
+		if aIntoB == http.StatusNoContent {
+			require.NotNil(t, incidentA.MergedInto)
+			require.Equal(t, b, *incidentA.MergedInto)
+			require.True(t, hasEntry(incidentC, "a's own entry"))
+		} else {
+			require.Nil(t, incidentA.MergedInto)
+			require.True(t, hasEntry(incidentA, "a's own entry"))
+		}
+	}
+}
+
+func TestMergeIncidentAuthorization(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	notAuthenticated := ApiHelper{t: t, serverURL: shared.serverURL, jwt: ""}
+
+	eventName := rand.NonCryptoText()
+	_, resp := apisAdmin.createEvent(ctx, imsjson.Event{Name: &eventName})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp = notAuthenticated.mergeIncident(ctx, eventName, 1, 2)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAlice.mergeIncident(ctx, eventName, 1, 2)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
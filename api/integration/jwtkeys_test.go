@@ -0,0 +1,93 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateJWTKey(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	key, err := api.RotateJWTKey(ctx, shared.imsDBQ, shared.cfg.Core.MasterKey,
+		authz.AlgorithmEdDSA, shared.cfg.Core.RefreshTokenLifetime)
+	require.NoError(t, err)
+
+	// The new key's public half gets published, for other services to verify
+	// IMS's JWTs with. The server may take a few seconds to notice it.
+	apisNotAuthenticated := ApiHelper{t: t, serverURL: shared.serverURL, jwt: ""}
+	var published imsjson.JWK
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		jwks, resp := apisNotAuthenticated.imsGet(ctx, shared.serverURL.JoinPath("/ims/api/auth/jwks").String(), &imsjson.JWKS{})
+		require.Equal(c, http.StatusOK, resp.StatusCode)
+		keys := jwks.(*imsjson.JWKS).Keys
+		i := slices.IndexFunc(keys, func(k imsjson.JWK) bool { return k.KeyID == key.ID })
+		require.GreaterOrEqual(c, i, 0)
+		published = keys[i]
+	}, 10*time.Second, 500*time.Millisecond)
+	assert.Equal(t, "OKP", published.KeyType)
+	assert.Equal(t, "Ed25519", published.Curve)
+	assert.Equal(t, authz.AlgorithmEdDSA, published.Algorithm)
+	x, err := base64.RawURLEncoding.DecodeString(published.X)
+	require.NoError(t, err)
+	assert.Equal(t, key.PublicKey(), ed25519.PublicKey(x))
+
+	// A JWT signed with the new key is good for the API, since it's one that any
+	// of the servers may now have signed.
+	token, err := authz.JWTer{Keys: authz.NewKeyRing("unused", nil,
+		func(context.Context) ([]authz.SigningKey, error) {
+			return []authz.SigningKey{key}, nil
+		},
+		time.Hour,
+	)}.CreateAccessToken(userAliceHandle, 0, nil, nil, true, nil, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	auth, resp := ApiHelper{t: t, serverURL: shared.serverURL, jwt: token}.getAuth(ctx, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, auth.Authenticated)
+	assert.Equal(t, userAliceHandle, auth.User)
+
+	// Another service can check it with just the published key.
+	claims := authz.IMSClaims{}
+	_, err = jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return ed25519.PublicKey(x), nil
+	}, jwt.WithValidMethods([]string{authz.AlgorithmEdDSA}))
+	require.NoError(t, err)
+	assert.Equal(t, userAliceHandle, claims.RangerHandle())
+
+	// JWTs signed with IMS_JWT_SECRET before the rotation are still good.
+	token, err = authz.JWTer{SecretKey: shared.cfg.Core.JWTSecret}.CreateAccessToken(
+		userAliceHandle, 0, nil, nil, true, nil, time.Now().Add(time.Hour),
+	)
+	require.NoError(t, err)
+	auth, resp = ApiHelper{t: t, serverURL: shared.serverURL, jwt: token}.getAuth(ctx, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, auth.Authenticated)
+}
@@ -0,0 +1,167 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/stretchr/testify/require"
+)
+
+func incidentNumbers(incidents imsjson.Incidents) []int32 {
+	var result []int32
+	for _, inc := range incidents {
+		result = append(result, inc.Number)
+	}
+	return result
+}
+
+func TestGetIncidentsFilteredAndPaged(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithWriter(t, apisAdmin)
+
+	first := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+	second := apis.newIncidentSuccess(ctx, imsjson.Incident{
+		Event:    eventName,
+		State:    "on_scene",
+		Priority: imsjson.IncidentPriorityHigh,
+	})
+	third := apis.newIncidentSuccess(ctx, imsjson.Incident{
+		Event:    eventName,
+		State:    "closed",
+		Priority: imsjson.IncidentPriorityLow,
+	})
+	resp := apis.attachRangerToIncident(ctx, eventName, third, "SomeRanger")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// No filter at all
+	incidents, resp := apis.getIncidentsWithQuery(ctx, eventName, url.Values{})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{first, second, third}, incidentNumbers(incidents))
+	require.Empty(t, resp.Header.Get(api.NextCursorHeader))
+
+	incidents, resp = apis.getIncidentsWithQuery(ctx, eventName, url.Values{"state": {"new,closed"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{first, third}, incidentNumbers(incidents))
+
+	incidents, resp = apis.getIncidentsWithQuery(ctx, eventName, url.Values{"priority": {"5", "1"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{second, third}, incidentNumbers(incidents))
+
+	incidents, resp = apis.getIncidentsWithQuery(ctx, eventName, url.Values{"ranger": {"SomeRanger"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{third}, incidentNumbers(incidents))
+	require.Equal(t, []imsjson.IncidentRanger{{Handle: "SomeRanger"}}, *incidents[0].Rangers)
+
+	incidents, resp = apis.getIncidentsWithQuery(ctx, eventName, url.Values{"created_after": {"2999-01-01T00:00:00Z"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Empty(t, incidents)
+
+	// Page through two at a time
+	incidents, resp = apis.getIncidentsWithQuery(ctx, eventName, url.Values{"limit": {"2"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{first, second}, incidentNumbers(incidents))
+	cursor := resp.Header.Get(api.NextCursorHeader)
+	require.NotEmpty(t, cursor)
+	incidents, resp = apis.getIncidentsWithQuery(ctx, eventName, url.Values{"limit": {"2"}, "cursor": {cursor}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []int32{third}, incidentNumbers(incidents))
+	require.Empty(t, resp.Header.Get(api.NextCursorHeader))
+
+	// Some bad requests
+	for _, params := range []url.Values{
+		{"state": {"bogus"}},
+		{"priority": {"high"}},
+		{"limit": {"0"}},
+		{"cursor": {"-1"}},
+		{"modified_before": {"yesterday"}},
+	} {
+		_, resp = apis.getIncidentsWithQuery(ctx, eventName, params)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, params)
+		require.NoError(t, resp.Body.Close())
+	}
+}
+
+func TestGetFieldReportsAndVisitsFiltered(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithWriter(t, apisAdmin)
+
+	incident := apis.newIncidentSuccess(ctx, typelessIncident(eventName))
+	attachedFR := apis.newFieldReportSuccess(ctx, imsjson.FieldReport{Event: eventName, Summary: new("attached")})
+	resp := apis.attachFieldReportToIncident(ctx, eventName, attachedFR, incident)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	looseFR := apis.newFieldReportSuccess(ctx, imsjson.FieldReport{Event: eventName, Summary: new("loose")})
+
+	frs, resp := apis.getFieldReportsWithQuery(ctx, eventName, url.Values{"incident": {conv.FormatInt(incident)}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, frs, 1)
+	require.Equal(t, attachedFR, frs[0].Number)
+
+	frs, resp = apis.getFieldReportsWithQuery(ctx, eventName, url.Values{"incident": {"none"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, frs, 1)
+	require.Equal(t, looseFR, frs[0].Number)
+
+	frs, resp = apis.getFieldReportsWithQuery(ctx, eventName, url.Values{"limit": {"1"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, frs, 1)
+	require.Equal(t, conv.FormatInt(attachedFR), resp.Header.Get(api.NextCursorHeader))
+
+	attachedVisit := apis.newVisitSuccess(ctx, imsjson.Visit{Event: eventName, Incident: &incident})
+	looseVisit := apis.newVisitSuccess(ctx, imsjson.Visit{Event: eventName})
+
+	visits, resp := apis.getVisitsWithQuery(ctx, eventName, url.Values{"incident": {conv.FormatInt(incident)}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, visits, 1)
+	require.Equal(t, attachedVisit, visits[0].Number)
+
+	visits, resp = apis.getVisitsWithQuery(ctx, eventName, url.Values{"incident": {"none"}, "cursor": {conv.FormatInt(attachedVisit)}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, visits, 1)
+	require.Equal(t, looseVisit, visits[0].Number)
+
+	_, resp = apis.getVisitsWithQuery(ctx, eventName, url.Values{"incident": {"some"}})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
@@ -0,0 +1,203 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Each of these tests logs in from its own made-up client address, since every
+// test in this package really comes from the same one, and the other tests
+// need to be able to keep logging in from it.
+
+func TestLoginThrottleIdentification(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	address := "throttle-" + rand.NonCryptoText()
+	// Throttles are kept by lowercased identification.
+	identification := "nobody-" + strings.ToLower(rand.NonCryptoText())
+
+	// The first few failures are free
+	for range 3 {
+		code, _ := apisAdmin.postAuthFrom(ctx, address, identification, "wrong")
+		require.Equal(t, http.StatusUnauthorized, code)
+	}
+	// but then there's a wait before the next try
+	code, retryAfter := apisAdmin.postAuthFrom(ctx, address, identification, "wrong")
+	require.Equal(t, http.StatusTooManyRequests, code)
+	require.Equal(t, 1, retryAfter)
+	// which applies to this identification from anywhere
+	code, _ = apisAdmin.postAuthFrom(ctx, "elsewhere-"+rand.NonCryptoText(), identification, "wrong")
+	require.Equal(t, http.StatusTooManyRequests, code)
+
+	throttle := apisAdmin.findLoginThrottle(ctx, "identification", identification)
+	require.Equal(t, int32(3), throttle.Failures)
+	require.Zero(t, throttle.LockedUntil)
+
+	// Skip ahead to just short of a lockout, after the wait is over
+	_, err := shared.imsDBQ.ExecContext(ctx,
+		"update LOGIN_THROTTLE set FAILURES = ?, LAST_FAILURE = ? where ID = ?",
+		shared.cfg.Core.LoginLockoutFailures-1, conv.TimeToFloat(time.Now().Add(-time.Hour)), throttle.ID,
+	)
+	require.NoError(t, err)
+	before := time.Now()
+	code, _ = apisAdmin.postAuthFrom(ctx, address, identification, "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// That locked the identification
+	throttle = apisAdmin.findLoginThrottle(ctx, "identification", identification)
+	require.Equal(t, shared.cfg.Core.LoginLockoutFailures, throttle.Failures)
+	require.WithinDuration(t, before.Add(shared.cfg.Core.LoginLockoutDuration), throttle.LockedUntil, time.Minute)
+	code, retryAfter = apisAdmin.postAuthFrom(ctx, address, identification, "wrong")
+	require.Equal(t, http.StatusTooManyRequests, code)
+	require.Greater(t, retryAfter, 60)
+
+	// and the lockout went in the action log
+	logs, resp := apisAdmin.getActionLogs(ctx,
+		conv.FormatInt(before.Add(-time.Second).UnixMilli()), conv.FormatInt(time.Now().Add(time.Second).UnixMilli()),
+	)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var lockoutLog *imsjson.ActionLog
+	for _, log := range logs {
+		if log.ActionType == "login_lockout" && log.UserName == identification {
+			lockoutLog = &log
+		}
+	}
+	require.NotNil(t, lockoutLog)
+	assert.Equal(t, address, lockoutLog.ClientAddress)
+
+	// Once a lockout's over, the failures before it no longer count
+	_, err = shared.imsDBQ.ExecContext(ctx,
+		"update LOGIN_THROTTLE set LOCKED_UNTIL = ?, LAST_FAILURE = ? where ID = ?",
+		conv.TimeToFloat(time.Now().Add(-time.Minute)), conv.TimeToFloat(time.Now().Add(-time.Hour)), throttle.ID,
+	)
+	require.NoError(t, err)
+	code, _ = apisAdmin.postAuthFrom(ctx, address, identification, "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+	afterLockout := apisAdmin.findLoginThrottle(ctx, "identification", identification)
+	require.Equal(t, int32(1), afterLockout.Failures)
+	require.Zero(t, afterLockout.LockedUntil)
+
+	// Only admins can see or clear lockouts
+	_, resp = apisAlice.getLoginThrottles(ctx)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = apisAlice.deleteLoginThrottle(ctx, throttle.ID)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Clearing it lets the identification try again
+	resp = apisAdmin.deleteLoginThrottle(ctx, throttle.ID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = apisAdmin.deleteLoginThrottle(ctx, throttle.ID)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	code, _ = apisAdmin.postAuthFrom(ctx, address, identification, "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestLoginThrottleAddress(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	address := "throttle-" + rand.NonCryptoText()
+
+	// Guessing at lots of different identifications from one address is
+	// allowed for a while
+	for range 20 {
+		code, _ := apisAdmin.postAuthFrom(ctx, address, "nobody-"+rand.NonCryptoText(), "wrong")
+		require.Equal(t, http.StatusUnauthorized, code)
+	}
+	// but then that address has to wait, even for a real user
+	code, retryAfter := apisAdmin.postAuthFrom(ctx, address, userAliceHandle, userAlicePassword)
+	require.Equal(t, http.StatusTooManyRequests, code)
+	require.Equal(t, 1, retryAfter)
+
+	throttle := apisAdmin.findLoginThrottle(ctx, "address", address)
+	require.Equal(t, int32(20), throttle.Failures)
+	// Addresses are never locked out
+	require.Zero(t, throttle.LockedUntil)
+}
+
+// postAuthFrom tries to log in from the given client address, and gives the
+// status code and Retry-After header.
+func (a ApiHelper) postAuthFrom(ctx context.Context, address, identification, password string) (int, int) {
+	a.t.Helper()
+	// #nosec G117 // Test credentials
+	postBody, err := json.Marshal(api.PostAuthRequest{
+		Identification: identification,
+		Password:       password,
+	})
+	require.NoError(a.t, err)
+	httpPost, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		a.serverURL.JoinPath("/ims/api/auth").String(), bytes.NewReader(postBody))
+	require.NoError(a.t, err)
+	httpPost.Header.Set("Content-Type", "application/json")
+	httpPost.Header.Set("X-Forwarded-For", address)
+	client := &http.Client{Timeout: 10 * time.Second}
+	// #nosec G704 // SSRF via taint analysis. We control the URL.
+	resp, err := client.Do(httpPost)
+	require.NoError(a.t, err)
+	require.NoError(a.t, resp.Body.Close())
+	retryAfter := 0
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		retryAfter, err = strconv.Atoi(v)
+		require.NoError(a.t, err)
+	}
+	return resp.StatusCode, retryAfter
+}
+
+func (a ApiHelper) findLoginThrottle(ctx context.Context, kind, subject string) imsjson.LoginThrottle {
+	a.t.Helper()
+	throttles, resp := a.getLoginThrottles(ctx)
+	require.Equal(a.t, http.StatusOK, resp.StatusCode)
+	for _, throttle := range throttles {
+		if throttle.Kind == kind && throttle.Subject == subject {
+			return throttle
+		}
+	}
+	require.FailNow(a.t, "no such login throttle", subject)
+	return imsjson.LoginThrottle{}
+}
+
+func (a ApiHelper) getLoginThrottles(ctx context.Context) (imsjson.LoginThrottles, *http.Response) {
+	a.t.Helper()
+	var throttles imsjson.LoginThrottles
+	_, resp := a.imsGet(ctx, a.serverURL.JoinPath("/ims/api/login_throttles").String(), &throttles)
+	return throttles, resp
+}
+
+func (a ApiHelper) deleteLoginThrottle(ctx context.Context, throttleID int64) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/login_throttles", conv.FormatInt(throttleID)).String(), nil)
+	return resp
+}
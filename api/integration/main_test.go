@@ -37,10 +37,13 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 //go:embed clubhousedb_test_seed.sql
@@ -60,7 +63,9 @@ var shared struct {
 	cfg          *conf.IMSConfig
 	imsDBQ       *store.DBQ
 	userStore    *directory.UserStore
+	clubhouseDBQ *directory.DBQ
 	es           *api.EventSourcerer
+	jwter        authz.JWTer
 	testServer   *httptest.Server
 	serverURL    *url.URL
 	actionLogger *actionlog.Logger
@@ -145,10 +150,22 @@ func setup(ctx context.Context, tempDir string) {
 
 	shared.cfg = conf.DefaultIMS()
 	shared.cfg.Core.JWTSecret = "jwtsecret-" + rand.NonCryptoText()
+	shared.cfg.Core.MasterKey = "masterkey-" + rand.NonCryptoText()
 	shared.cfg.Core.Admins = []string{userAdminHandle}
 	// 100 KiB, much lower than we'd use outside tests, since we want to test error cases
 	// when requests are too large.
 	shared.cfg.Core.MaxRequestBytes = 100 << 10
+	// The tests pose as clients at different addresses through X-Forwarded-For
+	shared.cfg.Core.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	shared.cfg.Core.BreakGlassDuration = time.Hour
+	shared.cfg.Core.BreakGlassEligible = "*"
+	must(os.Mkdir(filepath.Join(tempDir, "mail"), 0o750))
+	mailRoot, err := os.OpenRoot(filepath.Join(tempDir, "mail"))
+	must(err)
+	shared.cfg.Mail.Type = conf.MailMaildir
+	shared.cfg.Mail.Maildir = mailRoot
+	shared.cfg.Mail.From = "IMS <ims@example.com>"
+	shared.cfg.Mail.PublicURL = "https://ims.example.com"
 	shared.cfg.AttachmentsStore.Type = conf.AttachmentsStoreLocal
 	shared.cfg.AttachmentsStore.Local = conf.LocalAttachments{
 		Dir: tempRoot,
@@ -167,7 +184,6 @@ func setup(ctx context.Context, tempDir string) {
 		APIKey: "bmapikey-" + rand.NonCryptoText(),
 	}
 	must(shared.cfg.Validate())
-	shared.es = api.NewEventSourcerer()
 
 	// Do IMS and Clubhouse DB setup in parallel, since the container startup takes a few seconds each
 	g := errgroup.Group{}
@@ -196,9 +212,9 @@ func setup(ctx context.Context, tempDir string) {
 		if err != nil {
 			return err
 		}
-		clubhouseDBQ := directory.NewDBQ(clubhouseDB, chqueries.New())
+		shared.clubhouseDBQ = directory.NewDBQ(clubhouseDB, chqueries.New())
 		shared.userStore = directory.NewUserStore(
-			directory.NewClubhouseSource(clubhouseDBQ),
+			directory.NewClubhouseSource(shared.clubhouseDBQ),
 			shared.cfg.Directory.InMemoryCacheTTL,
 		)
 		return nil
@@ -227,6 +243,12 @@ func setup(ctx context.Context, tempDir string) {
 
 	shared.actionLogger = actionlog.NewLogger(ctx, shared.imsDBQ, shared.cfg.Core.ActionLogEnabled, true)
 	shared.errorLogger = errorlog.NewLogger(ctx, shared.imsDBQ, shared.cfg.Core.ErrorLogEnabled, true)
+	shared.es = api.NewEventSourcerer(shared.imsDBQ, shared.cfg.AttachmentsStore.Type != conf.AttachmentsStoreNone)
+	webhooks := api.NewWebhooks(shared.imsDBQ, shared.cfg.Core.MasterKey, shared.cfg.AttachmentsStore.Type != conf.AttachmentsStoreNone, shared.cfg.Core.WebhookMaxAttempts)
+	webhooks.Start(ctx)
+	shared.es.SendWebhooks(webhooks)
+	shared.es.LogConfidentialAccess(shared.actionLogger)
+	shared.jwter = authz.JWTer{Keys: api.NewKeyRing(shared.cfg, shared.imsDBQ)}
 	mux := api.AddToMux(nil, shared.es, shared.cfg, shared.imsDBQ, shared.userStore, nil, shared.actionLogger, shared.errorLogger)
 	mux.Handle(http.MethodGet+" "+panicPath, api.Adapt(
 		http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
@@ -234,7 +256,7 @@ func setup(ctx context.Context, tempDir string) {
 		}),
 		api.RecordErrors(shared.errorLogger),
 		api.RecoverFromPanic(),
-		api.RequireAuthN(authz.JWTer{SecretKey: shared.cfg.Core.JWTSecret}),
+		api.RequireAuthN(shared.jwter, shared.imsDBQ),
 		api.LogRequest(false, shared.actionLogger, shared.userStore),
 	))
 	shared.testServer = httptest.NewServer(mux)
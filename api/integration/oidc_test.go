@@ -0,0 +1,266 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/oidc/oidctest"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newOIDCServer starts an IMS server that lets people log in through a fake
+// OIDC provider, which is also returned. People are matched by the handle in
+// handleClaim, unless that's empty. The server uses the shared directory,
+// unless it's given another.
+func newOIDCServer(t *testing.T, handleClaim string, userStore *directory.UserStore) (*url.URL, *oidctest.Provider) {
+	t.Helper()
+	idp := oidctest.NewProvider("ims-test", "ims-test-secret")
+	t.Cleanup(idp.Close)
+
+	// The server's own URL goes into its config, so the mux has to come after
+	// the server.
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+	}))
+	t.Cleanup(server.Close)
+	cfg := *shared.cfg
+	cfg.OIDC.Issuer = idp.Issuer()
+	cfg.OIDC.ClientID = idp.ClientID
+	cfg.OIDC.ClientSecret = idp.ClientSecret
+	cfg.OIDC.RedirectURL = server.URL + "/ims/api/auth/oidc/callback"
+	cfg.OIDC.HandleClaim = handleClaim
+	require.NoError(t, cfg.Validate())
+	if userStore == nil {
+		userStore = shared.userStore
+	}
+	handler = api.AddToMux(nil, api.NewEventSourcerer(nil, false), &cfg, shared.imsDBQ, userStore, nil, shared.actionLogger, shared.errorLogger)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return serverURL, idp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL, idp := newOIDCServer(t, "", nil)
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	// A handle claim isn't trusted, unless the server is set up to.
+	idp.LogInAs(map[string]any{"sub": "alice-sub", "preferred_username": userAdminHandle})
+	location, refreshCookie := oidcLogIn(t, ctx, serverURL, "")
+	assert.NotEmpty(t, location.Query().Get("oidc_failed"))
+	require.Nil(t, refreshCookie)
+
+	// People are matched by their verified email.
+	idp.LogInAs(map[string]any{"sub": "alice-sub", "email": userAliceEmail, "email_verified": true})
+	location, refreshCookie = oidcLogIn(t, ctx, serverURL, "/ims/app/events")
+	assert.Equal(t, "/ims/auth/login", location.Path)
+	assert.Equal(t, "1", location.Query().Get("oidc"))
+	assert.Equal(t, "/ims/app/events", location.Query().Get("o"))
+	require.NotNil(t, refreshCookie)
+
+	// The login page swaps the refresh cookie for an access token.
+	statusCode, refreshed := unauthed.refreshAccessToken(ctx, refreshCookie)
+	require.Equal(t, http.StatusOK, statusCode)
+	apis := ApiHelper{t: t, serverURL: serverURL, jwt: refreshed.Token}
+	auth, resp := apis.getAuth(ctx, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, auth.Authenticated)
+	assert.Equal(t, userAliceHandle, auth.User)
+
+	// But not by an unverified one.
+	idp.LogInAs(map[string]any{"sub": "admin-sub", "email": userAdminEmail})
+	location, refreshCookie = oidcLogIn(t, ctx, serverURL, "")
+	assert.NotEmpty(t, location.Query().Get("oidc_failed"))
+	require.Nil(t, refreshCookie)
+
+	// Nor is anyone let in who isn't in the directory.
+	idp.LogInAs(map[string]any{"sub": "nobody-sub", "email": "nobody@example.com", "email_verified": true})
+	location, refreshCookie = oidcLogIn(t, ctx, serverURL, "")
+	assert.NotEmpty(t, location.Query().Get("oidc_failed"))
+	require.Nil(t, refreshCookie)
+}
+
+func TestOIDCLoginByHandleClaim(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL, idp := newOIDCServer(t, "preferred_username", nil)
+
+	// The handle claim is matched case-insensitively.
+	idp.LogInAs(map[string]any{"sub": "alice-sub", "preferred_username": "ALICETESTRANGER"})
+	_, refreshCookie := oidcLogIn(t, ctx, serverURL, "")
+	require.NotNil(t, refreshCookie)
+
+	idp.LogInAs(map[string]any{"sub": "nobody-sub", "preferred_username": "NotARanger"})
+	location, refreshCookie := oidcLogIn(t, ctx, serverURL, "")
+	assert.NotEmpty(t, location.Query().Get("oidc_failed"))
+	require.Nil(t, refreshCookie)
+}
+
+// TestOIDCLoginRefusesSecondFactor checks that someone who must give a TOTP
+// code can't get around it by logging in through the provider.
+func TestOIDCLoginRefusesSecondFactor(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	dirServerURL := newIMSDirectoryServer(t, ctx)
+	apisAdmin := ApiHelper{t: t, serverURL: dirServerURL, jwt: dirAdminJWT(t, ctx, dirServerURL)}
+
+	handle := "OIDCTOTPPerson-" + rand.NonCryptoText()
+	email := handle + "@example.com"
+	_, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{
+		Handle:       &handle,
+		Email:        &email,
+		TOTPRequired: new(true),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	userStore := directory.NewUserStore(directory.NewIMSSource(shared.imsDBQ), shared.cfg.Directory.InMemoryCacheTTL)
+	serverURL, idp := newOIDCServer(t, "", userStore)
+	idp.LogInAs(map[string]any{"sub": "totp-sub", "email": email, "email_verified": true})
+	location, refreshCookie := oidcLogIn(t, ctx, serverURL, "")
+	assert.Contains(t, location.Query().Get("oidc_failed"), "TOTP")
+	require.Nil(t, refreshCookie)
+}
+
+func TestOIDCCallbackNeedsItsLogin(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL, idp := newOIDCServer(t, "", nil)
+	idp.LogInAs(map[string]any{"sub": "alice-sub", "email": userAliceEmail, "email_verified": true})
+
+	loginCookie, authURL := oidcStart(t, ctx, serverURL, "")
+	callbackURL := oidcAuthorize(t, ctx, authURL)
+
+	// Without the login cookie, the callback doesn't know of any login.
+	location, refreshCookie := oidcCallback(t, ctx, callbackURL, nil)
+	assert.NotEmpty(t, location.Query().Get("oidc_failed"))
+	require.Nil(t, refreshCookie)
+
+	// The state must be the one that went to the provider.
+	tampered := *callbackURL
+	q := tampered.Query()
+	q.Set("state", "some other state")
+	tampered.RawQuery = q.Encode()
+	location, refreshCookie = oidcCallback(t, ctx, &tampered, loginCookie)
+	assert.NotEmpty(t, location.Query().Get("oidc_failed"))
+	require.Nil(t, refreshCookie)
+
+	// A login cookie from another login is no good either.
+	otherCookie, _ := oidcStart(t, ctx, serverURL, "")
+	location, refreshCookie = oidcCallback(t, ctx, callbackURL, otherCookie)
+	assert.NotEmpty(t, location.Query().Get("oidc_failed"))
+	require.Nil(t, refreshCookie)
+
+	// With everything right, it works.
+	_, refreshCookie = oidcCallback(t, ctx, callbackURL, loginCookie)
+	require.NotNil(t, refreshCookie)
+}
+
+func TestOIDCDisabledByDefault(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: ""}
+	_, resp := apis.imsGet(ctx, shared.serverURL.JoinPath("/ims/api/auth/oidc/login").String(), nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// oidcLogIn does the whole OIDC login the way a browser would, and gives
+// where IMS finally sends the browser, and the refresh cookie if there is one.
+func oidcLogIn(t *testing.T, ctx context.Context, serverURL *url.URL, redirect string) (*url.URL, *http.Cookie) {
+	t.Helper()
+	loginCookie, authURL := oidcStart(t, ctx, serverURL, redirect)
+	return oidcCallback(t, ctx, oidcAuthorize(t, ctx, authURL), loginCookie)
+}
+
+// The cookies are all Secure, and the test servers aren't HTTPS, so a cookie
+// jar wouldn't send them. These go step by step, passing the cookies along
+// by hand.
+
+func oidcStart(t *testing.T, ctx context.Context, serverURL *url.URL, redirect string) (*http.Cookie, *url.URL) {
+	t.Helper()
+	u := serverURL.JoinPath("/ims/api/auth/oidc/login")
+	if redirect != "" {
+		u.RawQuery = url.Values{"o": {redirect}}.Encode()
+	}
+	resp := noRedirectGet(t, ctx, u, nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location, err := resp.Location()
+	require.NoError(t, err)
+	return findCookie(resp, "ims_oidc_login"), location
+}
+
+func oidcAuthorize(t *testing.T, ctx context.Context, authURL *url.URL) *url.URL {
+	t.Helper()
+	resp := noRedirectGet(t, ctx, authURL, nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location, err := resp.Location()
+	require.NoError(t, err)
+	return location
+}
+
+func oidcCallback(t *testing.T, ctx context.Context, callbackURL *url.URL, loginCookie *http.Cookie) (*url.URL, *http.Cookie) {
+	t.Helper()
+	resp := noRedirectGet(t, ctx, callbackURL, loginCookie)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	location, err := resp.Location()
+	require.NoError(t, err)
+	return location, findCookie(resp, authz.RefreshTokenCookieName)
+}
+
+func noRedirectGet(t *testing.T, ctx context.Context, u *url.URL, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	require.NoError(t, err)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	client := &http.Client{
+		Timeout:       10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	// #nosec G704 // SSRF via taint analysis. We control the URLs.
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp
+}
+
+// findCookie gives the named cookie that the response sets, ignoring any that
+// it deletes.
+func findCookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name && c.MaxAge >= 0 && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	"github.com/burningmantech/ranger-ims-go/conf"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var passwordLinkRegexp = regexp.MustCompile(`https://ims\.example\.com/ims/auth/password#token=(\S+)`)
+
+// withMaildir configures a server to send its emails into a new Maildir, and
+// gives the Maildir's path.
+func withMaildir(t *testing.T) (configure func(cfg *conf.IMSConfig), dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	root, err := os.OpenRoot(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = root.Close() })
+	return func(cfg *conf.IMSConfig) {
+		cfg.Mail.Type = conf.MailMaildir
+		cfg.Mail.Maildir = root
+		cfg.Mail.From = "IMS <ims@example.com>"
+		cfg.Mail.PublicURL = "https://ims.example.com"
+	}, dir
+}
+
+// maildirTokens gives the password tokens from the emails in a Maildir, by
+// recipient address.
+func maildirTokens(t require.TestingT, dir string) map[string]string {
+	tokens := make(map[string]string)
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if os.IsNotExist(err) {
+		return tokens
+	}
+	require.NoError(t, err)
+	for _, entry := range entries {
+		raw, err := os.ReadFile(filepath.Join(dir, "new", entry.Name()))
+		require.NoError(t, err)
+		msg, err := netmail.ReadMessage(bytes.NewReader(raw))
+		require.NoError(t, err)
+		to, err := netmail.ParseAddress(msg.Header.Get("To"))
+		require.NoError(t, err)
+		body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+		require.NoError(t, err)
+		match := passwordLinkRegexp.FindSubmatch(body)
+		require.NotNil(t, match, string(body))
+		tokens[to.Address] = string(match[1])
+	}
+	return tokens
+}
+
+func (a ApiHelper) invitePerson(ctx context.Context, personID int64) *http.Response {
+	a.t.Helper()
+	return a.imsPost(ctx, struct{}{}, a.serverURL.JoinPath("/ims/api/directory/persons/", conv.FormatInt(personID), "/invite").String())
+}
+
+func (a ApiHelper) requestPasswordReset(ctx context.Context, identification string) *http.Response {
+	a.t.Helper()
+	req := api.PasswordResetRequest{Identification: identification}
+	return a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/auth/password_reset").String())
+}
+
+func (a ApiHelper) setPasswordWithToken(ctx context.Context, token, password string) *http.Response {
+	a.t.Helper()
+	req := api.PasswordTokenRequest{Token: token, Password: password}
+	return a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/auth/password").String())
+}
+
+func TestPasswordInvitation(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	configure, maildir := withMaildir(t)
+	serverURL := newIMSDirectoryServer(t, ctx, configure)
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	handle := "Invitee-" + rand.NonCryptoText()
+	email := handle + "@example.com"
+	personID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{
+		Handle: &handle,
+		Email:  &email,
+		Active: new(true),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, personID)
+
+	// Only admins may send invitations.
+	resp = unauthed.invitePerson(ctx, *personID)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.invitePerson(ctx, 999999999)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp = apisAdmin.invitePerson(ctx, *personID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	token := maildirTokens(t, maildir)[email]
+	require.NotEmpty(t, token)
+
+	// The password must be long enough.
+	resp = unauthed.setPasswordWithToken(ctx, token, "short")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// A bogus token is no good.
+	password := "invited-" + rand.NonCryptoText()
+	resp = unauthed.setPasswordWithToken(ctx, "bogus", password)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp = unauthed.setPasswordWithToken(ctx, token, password)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	statusCode, _, _ := unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: handle,
+		Password:       password,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+
+	// The token only works once.
+	resp = unauthed.setPasswordWithToken(ctx, token, "another-"+rand.NonCryptoText())
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	configure, maildir := withMaildir(t)
+	serverURL := newIMSDirectoryServer(t, ctx, configure)
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	handle := "Resetter-" + rand.NonCryptoText()
+	email := handle + "@example.com"
+	personID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{
+		Handle: &handle,
+		Email:  &email,
+		Active: new(true),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	oldPassword := "old-" + rand.NonCryptoText()
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, *personID, oldPassword)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Someone who isn't in the directory gets the same answer as anyone else,
+	// but no email.
+	resp = unauthed.requestPasswordReset(ctx, "nobody-"+rand.NonCryptoText())
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp = unauthed.requestPasswordReset(ctx, email)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// The email is sent in the background.
+	var token string
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		tokens := maildirTokens(c, maildir)
+		assert.Len(c, tokens, 1)
+		token = tokens[email]
+		assert.NotEmpty(c, token)
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// Asking again so soon sends nothing. The emails are sent one at a time,
+	// so once someone else's reset has arrived, the second one for this
+	// person would have too.
+	resp = unauthed.requestPasswordReset(ctx, email)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	otherHandle := "Other-" + rand.NonCryptoText()
+	otherEmail := otherHandle + "@example.com"
+	_, resp = apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{
+		Handle: &otherHandle,
+		Email:  &otherEmail,
+		Active: new(true),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = unauthed.requestPasswordReset(ctx, otherEmail)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.NotEmpty(c, maildirTokens(c, maildir)[otherEmail])
+	}, 10*time.Second, 50*time.Millisecond)
+	entries, err := os.ReadDir(filepath.Join(maildir, "new"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, token, maildirTokens(t, maildir)[email])
+
+	newPassword := "new-" + rand.NonCryptoText()
+	resp = unauthed.setPasswordWithToken(ctx, token, newPassword)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	statusCode, _, _ := unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: handle,
+		Password:       oldPassword,
+	})
+	require.Equal(t, http.StatusUnauthorized, statusCode)
+	statusCode, _, _ = unauthed.postAuth(ctx, api.PostAuthRequest{
+		Identification: handle,
+		Password:       newPassword,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+}
+
+func TestPasswordEmailsDisabledWithoutMail(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL := newIMSDirectoryServer(t, ctx)
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	resp := apisAdmin.invitePerson(ctx, 1)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = unauthed.requestPasswordReset(ctx, dirAdminHandle)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
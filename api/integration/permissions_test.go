@@ -17,9 +17,10 @@
 package integration_test
 
 import (
-	"io"
+	"bufio"
 	"net/http"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -326,26 +327,40 @@ func TestPublicAPIs_RequireNoAuthn(t *testing.T) {
 	}
 }
 
-func TestEventSource_RequiresNoAuthn(t *testing.T) {
+func TestEventSource_RequiresAuthn(t *testing.T) {
 	t.Parallel()
 	ctx := t.Context()
 
 	path := shared.serverURL.JoinPath("ims/api/eventsource")
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path.String(), nil)
-	require.NoError(t, err)
 	client := http.Client{Timeout: 10 * time.Second}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path.String(), nil)
+	require.NoError(t, err)
 	// #nosec G704 // SSRF via taint analysis.
 	resp, err := client.Do(req)
 	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, path.String(), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+jwtForAlice(t, ctx))
+	// #nosec G704 // SSRF via taint analysis.
+	resp, err = client.Do(req)
+	require.NoError(t, err)
 	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
 
 	// The response body will keep streaming until the test ends, so we can just read
-	// a prefix of the expect response to know that things look good.
-	expectedFirstBytes := []byte("id: 0\nevent: InitialEvent")
-	buf := make([]byte, len(expectedFirstBytes))
-	_, err = io.ReadFull(resp.Body, buf)
+	// the first frame to know that things look good. Its ID is the most recent one,
+	// which depends on what other tests have done by now.
+	reader := bufio.NewReader(resp.Body)
+	idLine, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(idLine, "id: "), idLine)
+	eventLine, err := reader.ReadString('\n')
 	require.NoError(t, err)
+	require.Equal(t, "event: InitialEvent\n", eventLine)
 	require.NoError(t, resp.Body.Close())
 }
 
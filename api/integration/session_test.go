@@ -0,0 +1,274 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionRotation(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisNotAuthenticated := ApiHelper{t: t, serverURL: shared.serverURL, jwt: ""}
+
+	// Logging in starts a session
+	firstCookie, jwt := apisNotAuthenticated.logIn(ctx, userAliceHandle, userAlicePassword)
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwt}
+	session := apisAlice.currentSession(ctx, firstCookie)
+	require.Equal(t, userAliceHandle, session.UserHandle)
+	require.Equal(t, "Go-http-client/1.1", session.UserAgent)
+	require.NotEmpty(t, session.ClientAddress)
+	require.True(t, session.Expires.After(time.Now()))
+
+	// Refreshing swaps in a new refresh token for the same session
+	code, secondCookie := apisNotAuthenticated.refreshSession(ctx, firstCookie)
+	require.Equal(t, http.StatusOK, code)
+	require.NotNil(t, secondCookie)
+	require.NotEqual(t, firstCookie.Value, secondCookie.Value)
+	require.Equal(t, session.ID, apisAlice.currentSession(ctx, secondCookie).ID)
+
+	// The replaced token still works for a little while, in case other tabs are
+	// refreshing at the same moment, but it doesn't get replaced again
+	code, cookie := apisNotAuthenticated.refreshSession(ctx, firstCookie)
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, cookie)
+
+	// Once that while is over, use of the replaced token means it was stolen,
+	// so the whole session gets revoked
+	_, err := shared.imsDBQ.ExecContext(ctx,
+		"update `SESSION` set `ROTATED` = ? where `ID` = ?",
+		conv.TimeToFloat(time.Now().Add(-time.Hour)), session.ID,
+	)
+	require.NoError(t, err)
+	code, _ = apisNotAuthenticated.refreshSession(ctx, firstCookie)
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = apisNotAuthenticated.refreshSession(ctx, secondCookie)
+	require.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestRevokeOwnSession(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisNotAuthenticated := ApiHelper{t: t, serverURL: shared.serverURL, jwt: ""}
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+
+	cookie, jwt := apisNotAuthenticated.logIn(ctx, userAliceHandle, userAlicePassword)
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwt}
+	session := apisAlice.currentSession(ctx, cookie)
+
+	// Alice can't revoke the admin's sessions, and can't list everyone's
+	adminCookie, _ := apisNotAuthenticated.logIn(ctx, userAdminHandle, userAdminPassword)
+	adminSession := apisAdmin.currentSession(ctx, adminCookie)
+	resp := apisAlice.revokeOwnSession(ctx, adminSession.ID)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	_, resp = apisAlice.getSessions(ctx, 0)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = apisAlice.revokeSession(ctx, adminSession.ID)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = apisAlice.revokeUserSessions(ctx, adminSession.UserID)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Alice can revoke her own session, after which it can't be refreshed
+	resp = apisAlice.revokeOwnSession(ctx, session.ID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	code, _ := apisNotAuthenticated.refreshSession(ctx, cookie)
+	require.Equal(t, http.StatusUnauthorized, code)
+	resp = apisAlice.revokeOwnSession(ctx, session.ID)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The admin can see and revoke anyone's session
+	cookie, _ = apisNotAuthenticated.logIn(ctx, userAliceHandle, userAlicePassword)
+	session = apisAlice.currentSession(ctx, cookie)
+	sessions, resp := apisAdmin.getSessions(ctx, session.UserID)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, sessionIDs(sessions), session.ID)
+	for _, s := range sessions {
+		require.Equal(t, session.UserID, s.UserID)
+	}
+	resp = apisAdmin.revokeSession(ctx, session.ID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	code, _ = apisNotAuthenticated.refreshSession(ctx, cookie)
+	require.Equal(t, http.StatusUnauthorized, code)
+	sessions, _ = apisAdmin.getSessions(ctx, session.UserID)
+	require.NotContains(t, sessionIDs(sessions), session.ID)
+}
+
+// TestRevokeAllSessions isn't run in parallel, since it logs Alice out of every
+// session, including those belonging to other tests.
+//
+//nolint:paralleltest
+func TestRevokeAllSessions(t *testing.T) {
+	ctx := t.Context()
+
+	apisNotAuthenticated := ApiHelper{t: t, serverURL: shared.serverURL, jwt: ""}
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+
+	// Alice logs out everywhere
+	cookie1, jwt := apisNotAuthenticated.logIn(ctx, userAliceHandle, userAlicePassword)
+	cookie2, _ := apisNotAuthenticated.logIn(ctx, userAliceEmail, userAlicePassword)
+	apisAlice := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwt}
+	require.Len(t, apisAlice.getOwnSessions(ctx), 2)
+	resp := apisAlice.revokeOwnSessions(ctx)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Empty(t, apisAlice.getOwnSessions(ctx))
+	for _, cookie := range []*http.Cookie{cookie1, cookie2} {
+		code, _ := apisNotAuthenticated.refreshSession(ctx, cookie)
+		require.Equal(t, http.StatusUnauthorized, code)
+	}
+
+	// The admin logs Alice out everywhere
+	cookie, _ := apisNotAuthenticated.logIn(ctx, userAliceHandle, userAlicePassword)
+	session := apisAlice.currentSession(ctx, cookie)
+	resp = apisAdmin.revokeUserSessions(ctx, session.UserID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	code, _ := apisNotAuthenticated.refreshSession(ctx, cookie)
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Empty(t, apisAlice.getOwnSessions(ctx))
+}
+
+func sessionIDs(sessions imsjson.Sessions) []int64 {
+	var ids []int64
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+// logIn logs in, and gives the refresh cookie and access token.
+func (a ApiHelper) logIn(ctx context.Context, identification, password string) (*http.Cookie, string) {
+	a.t.Helper()
+	resp := a.imsPost(ctx, api.PostAuthRequest{
+		Identification: identification,
+		Password:       password,
+	}, a.serverURL.JoinPath("/ims/api/auth").String())
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(a.t, err)
+	require.NoError(a.t, resp.Body.Close())
+	require.Equal(a.t, http.StatusOK, resp.StatusCode)
+	var response api.PostAuthResponse
+	require.NoError(a.t, json.Unmarshal(b, &response))
+	cookie, err := http.ParseSetCookie(resp.Header.Get("Set-Cookie"))
+	require.NoError(a.t, err)
+	return cookie, response.Token
+}
+
+// refreshSession uses a refresh cookie, and gives the cookie that replaces it,
+// if there is one.
+func (a ApiHelper) refreshSession(ctx context.Context, refreshCookie *http.Cookie) (int, *http.Cookie) {
+	a.t.Helper()
+	httpPost, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		a.serverURL.JoinPath("/ims/api/auth/refresh").String(), bytes.NewReader([]byte("{}")))
+	require.NoError(a.t, err)
+	httpPost.Header.Set("Content-Type", "application/json")
+	httpPost.AddCookie(refreshCookie)
+	client := &http.Client{Timeout: 10 * time.Second}
+	// #nosec G704 // SSRF via taint analysis.
+	resp, err := client.Do(httpPost)
+	require.NoError(a.t, err)
+	require.NoError(a.t, resp.Body.Close())
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == authz.RefreshTokenCookieName {
+			return resp.StatusCode, cookie
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// currentSession gives the session that the refresh cookie belongs to.
+func (a ApiHelper) currentSession(ctx context.Context, refreshCookie *http.Cookie) imsjson.Session {
+	a.t.Helper()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		a.serverURL.JoinPath("/ims/api/auth/sessions").String(), nil)
+	require.NoError(a.t, err)
+	httpReq.Header.Set("Authorization", "Bearer "+a.jwt)
+	httpReq.AddCookie(refreshCookie)
+	client := &http.Client{Timeout: 10 * time.Second}
+	// #nosec G704 // SSRF via taint analysis.
+	resp, err := client.Do(httpReq)
+	require.NoError(a.t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(a.t, err)
+	require.NoError(a.t, resp.Body.Close())
+	require.Equal(a.t, http.StatusOK, resp.StatusCode)
+	var sessions imsjson.Sessions
+	require.NoError(a.t, json.Unmarshal(b, &sessions))
+	for _, s := range sessions {
+		if s.Current {
+			return s
+		}
+	}
+	require.FailNow(a.t, "no current session")
+	return imsjson.Session{}
+}
+
+func (a ApiHelper) getOwnSessions(ctx context.Context) imsjson.Sessions {
+	a.t.Helper()
+	var sessions imsjson.Sessions
+	_, resp := a.imsGet(ctx, a.serverURL.JoinPath("/ims/api/auth/sessions").String(), &sessions)
+	require.Equal(a.t, http.StatusOK, resp.StatusCode)
+	return sessions
+}
+
+func (a ApiHelper) revokeOwnSessions(ctx context.Context) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/auth/sessions").String(), nil)
+	return resp
+}
+
+func (a ApiHelper) revokeOwnSession(ctx context.Context, sessionID int64) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/auth/sessions", conv.FormatInt(sessionID)).String(), nil)
+	return resp
+}
+
+func (a ApiHelper) getSessions(ctx context.Context, userID int64) (imsjson.Sessions, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/sessions").String()
+	if userID != 0 {
+		path += fmt.Sprintf("?user_id=%d", userID)
+	}
+	var sessions imsjson.Sessions
+	_, resp := a.imsGet(ctx, path, &sessions)
+	return sessions, resp
+}
+
+func (a ApiHelper) revokeSession(ctx context.Context, sessionID int64) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/sessions", conv.FormatInt(sessionID)).String(), nil)
+	return resp
+}
+
+func (a ApiHelper) revokeUserSessions(ctx context.Context, userID int64) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/users", conv.FormatInt(userID), "sessions").String(), nil)
+	return resp
+}
@@ -0,0 +1,339 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/burningmantech/ranger-ims-go/lib/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPRequiredAtLogin(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL := newIMSDirectoryServer(t, ctx)
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	handle := "TOTPPerson-" + rand.NonCryptoText()
+	password := "pw-" + rand.NonCryptoText()
+	personID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{
+		Handle:       &handle,
+		TOTPRequired: new(true),
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.NotNil(t, personID)
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, *personID, password)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	logIn := api.PostAuthRequest{Identification: handle, Password: password}
+
+	// The right password alone isn't enough. This person must enroll first.
+	statusCode, challenge := unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "totp_enroll", challenge.SecondFactor)
+	require.Empty(t, challenge.Token)
+	require.NotEmpty(t, challenge.SecondFactorToken)
+	require.NotNil(t, challenge.TOTPEnrollment)
+	assert.Contains(t, challenge.TOTPEnrollment.URI, "otpauth://totp/")
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(challenge.TOTPEnrollment.Secret)
+	require.NoError(t, err)
+
+	// Giving the password again keeps the same pending secret.
+	statusCode, again := unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, challenge.TOTPEnrollment.Secret, again.TOTPEnrollment.Secret)
+
+	// A wrong code doesn't finish enrollment.
+	statusCode, _ = unauthed.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		SecondFactorToken: challenge.SecondFactorToken,
+		TOTPCode:          imsjson.TOTPCode{Code: wrongTOTPCode(secret, time.Now())},
+	})
+	require.Equal(t, http.StatusUnauthorized, statusCode)
+
+	// A made-up second factor token is no good.
+	statusCode, _ = unauthed.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		SecondFactorToken: "not a token",
+		TOTPCode:          imsjson.TOTPCode{Code: totp.Code(secret, time.Now())},
+	})
+	require.Equal(t, http.StatusUnauthorized, statusCode)
+
+	// The right code finishes enrollment and logs in, and gives recovery codes.
+	enrolledAt := time.Now()
+	statusCode, loggedIn := unauthed.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		SecondFactorToken: challenge.SecondFactorToken,
+		TOTPCode:          imsjson.TOTPCode{Code: totp.Code(secret, enrolledAt)},
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.NotEmpty(t, loggedIn.Token)
+	require.Len(t, loggedIn.RecoveryCodes, 10)
+	recoveryCodes := loggedIn.RecoveryCodes
+
+	dir, resp := apisAdmin.getDirectory(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	person := findDirectoryPerson(dir, *personID)
+	require.NotNil(t, person)
+	assert.True(t, person.TOTPEnrolled)
+	assert.True(t, *person.TOTPRequired)
+
+	// Now the password leads to a TOTP challenge.
+	statusCode, challenge = unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "totp", challenge.SecondFactor)
+	require.Nil(t, challenge.TOTPEnrollment)
+
+	// The code that was used to enroll can't be used again.
+	statusCode, _ = unauthed.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		SecondFactorToken: challenge.SecondFactorToken,
+		TOTPCode:          imsjson.TOTPCode{Code: totp.Code(secret, enrolledAt)},
+	})
+	require.Equal(t, http.StatusUnauthorized, statusCode)
+
+	// The next code works, allowing for a little clock skew.
+	statusCode, loggedIn = unauthed.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		SecondFactorToken: challenge.SecondFactorToken,
+		TOTPCode:          imsjson.TOTPCode{Code: totp.Code(secret, enrolledAt.Add(totp.Period))},
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.NotEmpty(t, loggedIn.Token)
+	require.Empty(t, loggedIn.RecoveryCodes)
+
+	// A recovery code works once, however it's formatted.
+	statusCode, challenge = unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	recoveryCode := strings.ToUpper(strings.ReplaceAll(recoveryCodes[0], "-", " "))
+	statusCode, loggedIn = unauthed.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		SecondFactorToken: challenge.SecondFactorToken,
+		TOTPCode:          imsjson.TOTPCode{RecoveryCode: recoveryCode},
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.NotEmpty(t, loggedIn.Token)
+	statusCode, _ = unauthed.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		SecondFactorToken: challenge.SecondFactorToken,
+		TOTPCode:          imsjson.TOTPCode{RecoveryCode: recoveryCodes[0]},
+	})
+	require.Equal(t, http.StatusUnauthorized, statusCode)
+
+	// The person can't turn off TOTP that an admin requires of them.
+	apisPerson := ApiHelper{t: t, serverURL: serverURL, jwt: loggedIn.Token}
+	status, resp := apisPerson.getOwnTOTP(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, imsjson.TOTPStatus{Enrolled: true, Required: true, RecoveryCodesLeft: 9}, status)
+	resp = apisPerson.disableOwnTOTP(ctx, imsjson.TOTPCode{RecoveryCode: recoveryCodes[1]})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// When an admin resets their TOTP, they must enroll afresh.
+	resp = apisAdmin.resetDirectoryPersonTOTP(ctx, *personID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	statusCode, challenge = unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "totp_enroll", challenge.SecondFactor)
+	require.NotEqual(t, totp.EncodeSecret(secret), challenge.TOTPEnrollment.Secret)
+
+	// Only directory admins may reset someone's TOTP.
+	resp = apisPerson.resetDirectoryPersonTOTP(ctx, *personID)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestTOTPSelfEnrollment(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	serverURL := newIMSDirectoryServer(t, ctx)
+	apisAdmin := ApiHelper{t: t, serverURL: serverURL, jwt: dirAdminJWT(t, ctx, serverURL)}
+	unauthed := ApiHelper{t: t, serverURL: serverURL, jwt: ""}
+
+	handle := "TOTPSelf-" + rand.NonCryptoText()
+	password := "pw-" + rand.NonCryptoText()
+	personID, resp := apisAdmin.editDirectoryPerson(ctx, imsjson.DirectoryPerson{Handle: &handle})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apisAdmin.setDirectoryPersonPassword(ctx, *personID, password)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	logIn := api.PostAuthRequest{Identification: handle, Password: password}
+
+	// Without TOTP, the password is enough.
+	statusCode, loggedIn := unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.NotEmpty(t, loggedIn.Token)
+	require.Empty(t, loggedIn.SecondFactor)
+	apisPerson := ApiHelper{t: t, serverURL: serverURL, jwt: loggedIn.Token}
+
+	status, resp := apisPerson.getOwnTOTP(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, imsjson.TOTPStatus{}, status)
+
+	// Enroll, and confirm with a code from the new secret.
+	enrollment, resp := apisPerson.startOwnTOTP(ctx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+	_, resp = apisPerson.confirmOwnTOTP(ctx, imsjson.TOTPCode{Code: wrongTOTPCode(secret, time.Now())})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	enrolledAt := time.Now()
+	codes, resp := apisPerson.confirmOwnTOTP(ctx, imsjson.TOTPCode{Code: totp.Code(secret, enrolledAt)})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, codes.RecoveryCodes, 10)
+
+	// Enrolling again needs TOTP to be turned off first.
+	_, resp = apisPerson.startOwnTOTP(ctx)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// Login now needs a second factor.
+	statusCode, challenge := unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "totp", challenge.SecondFactor)
+	require.Empty(t, challenge.Token)
+
+	// New recovery codes replace the old ones.
+	newCodes, resp := apisPerson.replaceOwnRecoveryCodes(ctx, imsjson.TOTPCode{Code: totp.Code(secret, enrolledAt.Add(totp.Period))})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, newCodes.RecoveryCodes, 10)
+	resp = apisPerson.disableOwnTOTP(ctx, imsjson.TOTPCode{RecoveryCode: codes.RecoveryCodes[0]})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Turning TOTP off takes a valid recovery code, and the password is then
+	// enough again.
+	resp = apisPerson.disableOwnTOTP(ctx, imsjson.TOTPCode{RecoveryCode: newCodes.RecoveryCodes[0]})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	statusCode, loggedIn = unauthed.postAuthChallenge(ctx, logIn)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.NotEmpty(t, loggedIn.Token)
+}
+
+func TestTOTPUnavailableOnClubhouseDeployments(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	_, resp := apisAdmin.getOwnTOTP(ctx)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	statusCode, _ := apisAdmin.postSecondFactor(ctx, api.PostAuthSecondFactorRequest{
+		TOTPCode: imsjson.TOTPCode{Code: "123456"},
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+// wrongTOTPCode gives a code that's not valid for the secret at any step near
+// the given time.
+func wrongTOTPCode(secret []byte, t time.Time) string {
+	valid := map[string]bool{}
+	for skew := -1; skew <= 1; skew++ {
+		valid[totp.Code(secret, t.Add(time.Duration(skew)*totp.Period))] = true
+	}
+	for i := 0; ; i++ {
+		code := fmt.Sprintf("%06d", i)
+		if !valid[code] {
+			return code
+		}
+	}
+}
+
+// postAuthChallenge logs in, and gives the whole response, whether that's
+// a token or a second factor challenge.
+func (a ApiHelper) postAuthChallenge(ctx context.Context, req api.PostAuthRequest) (int, api.PostAuthResponse) {
+	a.t.Helper()
+	return a.decodeAuthResponse(a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/auth").String()))
+}
+
+func (a ApiHelper) postSecondFactor(ctx context.Context, req api.PostAuthSecondFactorRequest) (int, api.PostAuthResponse) {
+	a.t.Helper()
+	return a.decodeAuthResponse(a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/auth/second_factor").String()))
+}
+
+func (a ApiHelper) decodeAuthResponse(resp *http.Response) (int, api.PostAuthResponse) {
+	a.t.Helper()
+	var response api.PostAuthResponse
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(a.t, resp.Body.Close())
+	require.NoError(a.t, err)
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(a.t, json.Unmarshal(b, &response))
+	}
+	return resp.StatusCode, response
+}
+
+func (a ApiHelper) getOwnTOTP(ctx context.Context) (imsjson.TOTPStatus, *http.Response) {
+	a.t.Helper()
+	bod, resp := a.imsGet(ctx, a.serverURL.JoinPath("/ims/api/auth/totp").String(), &imsjson.TOTPStatus{})
+	return *bod.(*imsjson.TOTPStatus), resp
+}
+
+func (a ApiHelper) startOwnTOTP(ctx context.Context) (imsjson.TOTPEnrollment, *http.Response) {
+	a.t.Helper()
+	var enrollment imsjson.TOTPEnrollment
+	resp := a.imsPost(ctx, struct{}{}, a.serverURL.JoinPath("/ims/api/auth/totp").String())
+	a.decodeBody(resp, &enrollment)
+	return enrollment, resp
+}
+
+func (a ApiHelper) confirmOwnTOTP(ctx context.Context, code imsjson.TOTPCode) (imsjson.RecoveryCodes, *http.Response) {
+	a.t.Helper()
+	var codes imsjson.RecoveryCodes
+	resp := a.imsPost(ctx, code, a.serverURL.JoinPath("/ims/api/auth/totp/confirm").String())
+	a.decodeBody(resp, &codes)
+	return codes, resp
+}
+
+func (a ApiHelper) replaceOwnRecoveryCodes(ctx context.Context, code imsjson.TOTPCode) (imsjson.RecoveryCodes, *http.Response) {
+	a.t.Helper()
+	var codes imsjson.RecoveryCodes
+	resp := a.imsPost(ctx, code, a.serverURL.JoinPath("/ims/api/auth/totp/recovery_codes").String())
+	a.decodeBody(resp, &codes)
+	return codes, resp
+}
+
+func (a ApiHelper) disableOwnTOTP(ctx context.Context, code imsjson.TOTPCode) *http.Response {
+	a.t.Helper()
+	return a.imsPost(ctx, code, a.serverURL.JoinPath("/ims/api/auth/totp/disable").String())
+}
+
+func (a ApiHelper) resetDirectoryPersonTOTP(ctx context.Context, personID int64) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/directory/persons/", conv.FormatInt(personID), "/totp").String(), nil)
+	return resp
+}
+
+// decodeBody reads a successful response's JSON body into v, and closes it.
+func (a ApiHelper) decodeBody(resp *http.Response, v any) {
+	a.t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(a.t, resp.Body.Close())
+	require.NoError(a.t, err)
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(a.t, json.Unmarshal(b, v))
+	}
+}
@@ -346,7 +346,8 @@ func TestVisitVersionLifecycleAndReassignment(t *testing.T) {
 // between an edit's read of the stored record and its version-guarded UPDATE
 // (the interleaving where a concurrent writer causes a CAS conflict), or
 // between a creation's number allocation and its INSERT (the interleaving
-// where a concurrent creator claims the same number). A nil hook leaves the
+// where a concurrent creator claims the same number). It can also make a query
+// fail outright, to check that nothing's left half done. A nil hook leaves the
 // corresponding query untouched.
 type casInterceptor struct {
 	imsdb.Querier
@@ -357,6 +358,7 @@ type casInterceptor struct {
 	beforeCreateIncident    func(ctx context.Context, arg imsdb.CreateIncidentParams)
 	beforeCreateFieldReport func(ctx context.Context, arg imsdb.CreateFieldReportParams)
 	beforeCreateVisit       func(ctx context.Context, arg imsdb.CreateVisitParams)
+	addEventAccessErr       func(ctx context.Context, arg imsdb.AddEventAccessParams) error
 }
 
 func (q casInterceptor) UpdateIncident(ctx context.Context, db imsdb.DBTX, arg imsdb.UpdateIncidentParams) (int64, error) {
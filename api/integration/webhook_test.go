@@ -0,0 +1,257 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package integration_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver stands in for the system at the other end of a Webhook. It
+// answers every delivery with the given status code.
+func webhookReceiver(t *testing.T, statusCode int) (*httptest.Server, <-chan receivedWebhook) {
+	t.Helper()
+	received := make(chan receivedWebhook, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		received <- receivedWebhook{header: req.Header.Clone(), body: body}
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func awaitWebhook(t *testing.T, received <-chan receivedWebhook) receivedWebhook {
+	t.Helper()
+	select {
+	case r := <-received:
+		return r
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for a webhook delivery")
+		return receivedWebhook{}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithWriter(t, apisAdmin)
+	receiver, received := webhookReceiver(t, http.StatusOK)
+
+	// Webhooks are for admins only
+	_, resp := apis.getWebhooks(ctx, eventName)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	webhookReq := imsjson.Webhook{
+		URL:      new(receiver.URL + "/hooks/ims"),
+		Secret:   new("a-webhook-secret-for-tests"),
+		Triggers: &[]string{"incident.created", "incident.state_changed"},
+	}
+	_, resp = apis.editWebhook(ctx, eventName, webhookReq)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Some bad requests
+	_, resp = apisAdmin.editWebhook(ctx, eventName, imsjson.Webhook{URL: webhookReq.URL, Secret: new("short")})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, resp = apisAdmin.editWebhook(ctx, eventName, imsjson.Webhook{
+		URL: webhookReq.URL, Secret: webhookReq.Secret, Triggers: &[]string{"incident.exploded"},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	webhookID, resp := apisAdmin.editWebhook(ctx, eventName, webhookReq)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NotZero(t, webhookID)
+
+	webhooks, resp := apisAdmin.getWebhooks(ctx, eventName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, webhooks, 1)
+	assert.Equal(t, webhookID, webhooks[0].ID)
+	assert.Equal(t, webhookReq.URL, webhooks[0].URL)
+	assert.Equal(t, webhookReq.Triggers, webhooks[0].Triggers)
+	assert.Equal(t, new(true), webhooks[0].Enabled)
+	// The secret is never given back
+	assert.Nil(t, webhooks[0].Secret)
+	// and it isn't stored in the clear either.
+	var storedSecret []byte
+	err := shared.imsDBQ.QueryRowContext(ctx,
+		"select SECRET from WEBHOOK where ID = ?", webhookID).Scan(&storedSecret)
+	require.NoError(t, err)
+	assert.NotContains(t, string(storedSecret), *webhookReq.Secret)
+
+	// Creating an Incident fires incident.created
+	incident := apis.newIncidentSuccess(ctx, imsjson.Incident{Event: eventName, Summary: new("the webhook incident")})
+	r := awaitWebhook(t, received)
+	assert.Equal(t, "incident.created", r.header.Get("IMS-Webhook-Trigger"))
+	assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+	mac := hmac.New(sha256.New, []byte(*webhookReq.Secret))
+	_, _ = mac.Write([]byte(r.header.Get("IMS-Webhook-Timestamp") + "."))
+	_, _ = mac.Write(r.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.header.Get("IMS-Webhook-Signature"))
+	var payload imsjson.WebhookPayload
+	require.NoError(t, json.Unmarshal(r.body, &payload))
+	assert.Equal(t, "incident.created", payload.Trigger)
+	assert.Equal(t, eventName, payload.Event)
+	require.NotNil(t, payload.Incident)
+	assert.Equal(t, incident, payload.Incident.Number)
+	assert.Equal(t, new("the webhook incident"), payload.Incident.Summary)
+
+	// An update that leaves the state alone fires nothing this Webhook wants,
+	// but a change of state does.
+	resp = apis.updateIncident(ctx, eventName, incident, imsjson.Incident{Event: eventName, Summary: new("renamed")})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp = apis.updateIncident(ctx, eventName, incident, imsjson.Incident{Event: eventName, State: "on_hold"})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	r = awaitWebhook(t, received)
+	assert.Equal(t, "incident.state_changed", r.header.Get("IMS-Webhook-Trigger"))
+	require.NoError(t, json.Unmarshal(r.body, &payload))
+	assert.Equal(t, "on_hold", payload.Incident.State)
+	assert.Equal(t, new("renamed"), payload.Incident.Summary)
+
+	// Both deliveries are in the log, which names the Incident and has a digest
+	// of what was sent, but not the body itself.
+	lastDigest := sha256.Sum256(r.body)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		deliveries, resp := apisAdmin.getWebhookDeliveries(ctx, eventName, webhookID)
+		require.Equal(c, http.StatusOK, resp.StatusCode)
+		require.Len(c, deliveries, 2)
+		for _, d := range deliveries {
+			assert.Equal(c, "delivered", d.Status)
+			assert.Equal(c, int32(1), d.Attempts)
+			assert.Equal(c, int32(http.StatusOK), d.LastStatusCode)
+			assert.Equal(c, incident, d.Incident)
+			assert.Len(c, d.BodyDigest, 64)
+		}
+		assert.Equal(c, hex.EncodeToString(lastDigest[:]), deliveries[0].BodyDigest)
+	}, 10*time.Second, 50*time.Millisecond)
+	_, resp = apis.getWebhookDeliveries(ctx, eventName, webhookID)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// A disabled Webhook hears nothing
+	webhookReq = imsjson.Webhook{ID: webhookID, Enabled: new(false)}
+	_, resp = apisAdmin.editWebhook(ctx, eventName, webhookReq)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_ = apis.newIncidentSuccess(ctx, imsjson.Incident{Event: eventName})
+	deliveries, _ := apisAdmin.getWebhookDeliveries(ctx, eventName, webhookID)
+	assert.Len(t, deliveries, 2)
+
+	resp = apisAdmin.deleteWebhook(ctx, eventName, webhookID)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	webhooks, _ = apisAdmin.getWebhooks(ctx, eventName)
+	assert.Empty(t, webhooks)
+}
+
+func TestWebhookDeliveryFailure(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	apisAdmin := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAdmin(ctx, t)}
+	apis := ApiHelper{t: t, serverURL: shared.serverURL, jwt: jwtForAlice(t, ctx)}
+	eventName := newEventWithWriter(t, apisAdmin)
+	receiver, received := webhookReceiver(t, http.StatusServiceUnavailable)
+
+	webhookID, resp := apisAdmin.editWebhook(ctx, eventName, imsjson.Webhook{
+		URL:      new(receiver.URL),
+		Secret:   new("a-webhook-secret-for-tests"),
+		Triggers: &[]string{"visit.created"},
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	_ = apis.newVisitSuccess(ctx, imsjson.Visit{Event: eventName})
+	_ = awaitWebhook(t, received)
+
+	// The failed attempt is recorded, and another is scheduled for later
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		deliveries, resp := apisAdmin.getWebhookDeliveries(ctx, eventName, webhookID)
+		require.Equal(c, http.StatusOK, resp.StatusCode)
+		require.Len(c, deliveries, 1)
+		d := deliveries[0]
+		assert.Equal(c, "pending", d.Status)
+		assert.Equal(c, int32(1), d.Attempts)
+		assert.Equal(c, int32(http.StatusServiceUnavailable), d.LastStatusCode)
+		assert.NotEmpty(c, d.LastError)
+		assert.True(c, d.NextAttempt.After(d.LastAttempt))
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// Only a dead delivery can be retried
+	deliveries, _ := apisAdmin.getWebhookDeliveries(ctx, eventName, webhookID)
+	require.Len(t, deliveries, 1)
+	resp = apisAdmin.retryWebhookDelivery(ctx, eventName, webhookID, deliveries[0].ID)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func (a ApiHelper) getWebhooks(ctx context.Context, eventName string) (imsjson.Webhooks, *http.Response) {
+	a.t.Helper()
+	bod, resp := a.imsGet(ctx, a.serverURL.JoinPath("/ims/api/events/", eventName, "/webhooks").String(), &imsjson.Webhooks{})
+	return *bod.(*imsjson.Webhooks), resp
+}
+
+func (a ApiHelper) editWebhook(ctx context.Context, eventName string, req imsjson.Webhook) (int32, *http.Response) {
+	a.t.Helper()
+	resp := a.imsPost(ctx, req, a.serverURL.JoinPath("/ims/api/events/", eventName, "/webhooks").String())
+	require.NoError(a.t, resp.Body.Close())
+	if resp.StatusCode != http.StatusCreated {
+		return 0, resp
+	}
+	webhookID, err := conv.ParseInt32(resp.Header.Get("IMS-Webhook-ID"))
+	require.NoError(a.t, err)
+	return webhookID, resp
+}
+
+func (a ApiHelper) deleteWebhook(ctx context.Context, eventName string, webhookID int32) *http.Response {
+	a.t.Helper()
+	_, resp := a.imsDelete(ctx, a.serverURL.JoinPath("/ims/api/events/", eventName, "/webhooks/", conv.FormatInt(webhookID)).String(), nil)
+	return resp
+}
+
+func (a ApiHelper) getWebhookDeliveries(ctx context.Context, eventName string, webhookID int32) (imsjson.WebhookDeliveries, *http.Response) {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events/", eventName, "/webhooks/", conv.FormatInt(webhookID), "/deliveries").String()
+	bod, resp := a.imsGet(ctx, path, &imsjson.WebhookDeliveries{})
+	return *bod.(*imsjson.WebhookDeliveries), resp
+}
+
+func (a ApiHelper) retryWebhookDelivery(ctx context.Context, eventName string, webhookID int32, deliveryID int64) *http.Response {
+	a.t.Helper()
+	path := a.serverURL.JoinPath("/ims/api/events/", eventName, "/webhooks/", conv.FormatInt(webhookID),
+		"/deliveries/", conv.FormatInt(deliveryID), "/retry").String()
+	resp := a.imsPost(ctx, nil, path)
+	require.NoError(a.t, resp.Body.Close())
+	return resp
+}
@@ -0,0 +1,146 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/conf"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/seal"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+// jwtKeyAdditionalData binds a sealed JWT_KEY secret to its key ID, so that
+// it's no good if copied to another row.
+func jwtKeyAdditionalData(keyID string) []byte {
+	return []byte("JWT_KEY.SECRET " + keyID)
+}
+
+// NewKeyRing makes the KeyRing that an IMS server signs and verifies JWTs with.
+// That has the keys in the JWT_KEY table, if there's a database to hold them.
+func NewKeyRing(cfg *conf.IMSConfig, imsDBQ *store.DBQ) *authz.KeyRing {
+	if cfg.Store.Type != conf.DBStoreTypeMaria {
+		return authz.NewKeyRing(cfg.Core.JWTSecret, cfg.Core.JWTPreviousSecrets, nil, cfg.Core.RefreshTokenLifetime)
+	}
+	return authz.NewKeyRing(cfg.Core.JWTSecret, cfg.Core.JWTPreviousSecrets,
+		func(ctx context.Context) ([]authz.SigningKey, error) {
+			return loadJWTKeys(ctx, imsDBQ, cfg.Core.MasterKey, cfg.Core.RefreshTokenLifetime)
+		},
+		cfg.Core.RefreshTokenLifetime,
+	)
+}
+
+// loadJWTKeys gives the JWT_KEYs that are in use. A key that was retired longer
+// ago than the retention has no unexpired JWTs left, so it's left out.
+func loadJWTKeys(ctx context.Context, imsDBQ *store.DBQ, masterKey string, retention time.Duration) ([]authz.SigningKey, error) {
+	retiredSince := time.Now().Add(-retention)
+	rows, err := imsDBQ.JWTKeys(ctx, imsDBQ, conv.TimeToNullFloat(retiredSince))
+	if err != nil {
+		return nil, fmt.Errorf("[JWTKeys]: %w", err)
+	}
+	keys := make([]authz.SigningKey, 0, len(rows))
+	for _, row := range rows {
+		secret, err := seal.Open(masterKey, row.Secret, jwtKeyAdditionalData(row.ID))
+		if err != nil {
+			return nil, fmt.Errorf("[seal.Open] key %v: %w", row.ID, err)
+		}
+		key := authz.SigningKey{
+			ID:        row.ID,
+			Algorithm: row.Algorithm,
+			Secret:    secret,
+			Created:   conv.FloatToTime(row.Created),
+		}
+		if row.Retired.Valid {
+			key.Retired = conv.FloatToTime(row.Retired.Float64)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RotateJWTKey makes a new JWT_KEY for every server to sign with, and retires
+// the one they were signing with before. Keys that were retired longer ago than
+// the retention are deleted, as there are no unexpired JWTs left that they'd
+// be needed for.
+func RotateJWTKey(ctx context.Context, imsDBQ *store.DBQ, masterKey, algorithm string, retention time.Duration) (authz.SigningKey, error) {
+	key, err := authz.NewSigningKey(algorithm)
+	if err != nil {
+		return authz.SigningKey{}, fmt.Errorf("[NewSigningKey]: %w", err)
+	}
+	sealed, err := seal.Seal(masterKey, key.Secret, jwtKeyAdditionalData(key.ID))
+	if err != nil {
+		return authz.SigningKey{}, fmt.Errorf("[seal.Seal]: %w", err)
+	}
+	now := time.Now()
+	txn, err := imsDBQ.Begin()
+	if err != nil {
+		return authz.SigningKey{}, fmt.Errorf("[Begin]: %w", err)
+	}
+	defer rollback(txn)
+	err = imsDBQ.RetireJWTKeys(ctx, txn, conv.TimeToNullFloat(now))
+	if err != nil {
+		return authz.SigningKey{}, fmt.Errorf("[RetireJWTKeys]: %w", err)
+	}
+	err = imsDBQ.CreateJWTKey(ctx, txn, imsdb.CreateJWTKeyParams{
+		ID:        key.ID,
+		Algorithm: key.Algorithm,
+		Secret:    sealed,
+		Created:   conv.TimeToFloat(now),
+	})
+	if err != nil {
+		return authz.SigningKey{}, fmt.Errorf("[CreateJWTKey]: %w", err)
+	}
+	err = imsDBQ.PruneJWTKeys(ctx, txn, conv.TimeToNullFloat(now.Add(-retention)))
+	if err != nil {
+		return authz.SigningKey{}, fmt.Errorf("[PruneJWTKeys]: %w", err)
+	}
+	err = txn.Commit()
+	if err != nil {
+		return authz.SigningKey{}, fmt.Errorf("[Commit]: %w", err)
+	}
+	return key, nil
+}
+
+// GetJWKS publishes the public keys of the EdDSA JWT_KEYs, so that other
+// services can verify IMS's JWTs without sharing a secret with it. It's empty
+// unless an EdDSA key has been rotated in.
+type GetJWKS struct {
+	keys *authz.KeyRing
+}
+
+func (action GetJWKS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	jwks := imsjson.JWKS{Keys: []imsjson.JWK{}}
+	for _, k := range action.keys.PublicKeys() {
+		jwks.Keys = append(jwks.Keys, imsjson.JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(k.Key),
+			KeyID:     k.ID,
+			Algorithm: authz.AlgorithmEdDSA,
+			Use:       "sig",
+		})
+	}
+	mustWriteJSON(w, req, jwks)
+}
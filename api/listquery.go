@@ -0,0 +1,134 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+)
+
+// NextCursorHeader is set on a response from GetIncidents, GetFieldReports or
+// GetVisits when there may be more results than the requested limit. Its value
+// goes in the "cursor" parameter of the request for the next page.
+const NextCursorHeader = "IMS-Next-Cursor"
+
+// listQuery holds the query parameters shared by the GetIncidents,
+// GetFieldReports and GetVisits endpoints. All of it gets applied in SQL.
+//
+// The cursor is simply the number of the last record on the previous page,
+// since each of those lists is ordered by number. Clients should treat it as
+// opaque all the same.
+type listQuery struct {
+	createdAfter   float64
+	createdBefore  float64
+	modifiedAfter  float64
+	modifiedBefore float64
+	afterNumber    int32
+	limit          int32
+}
+
+func parseListQuery(form url.Values) (listQuery, *herr.HTTPError) {
+	q := listQuery{
+		// long ago
+		createdAfter:  0,
+		modifiedAfter: 0,
+		// long from now
+		createdBefore:  1e100,
+		modifiedBefore: 1e100,
+		limit:          math.MaxInt32,
+	}
+	for _, bound := range []struct {
+		param string
+		dst   *float64
+	}{
+		{"created_after", &q.createdAfter},
+		{"created_before", &q.createdBefore},
+		{"modified_after", &q.modifiedAfter},
+		{"modified_before", &q.modifiedBefore},
+	} {
+		if v := form.Get(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, herr.BadRequest(fmt.Sprintf("Invalid %v, which must be an RFC 3339 time", bound.param), err).From("[time.Parse]")
+			}
+			*bound.dst = conv.TimeToFloat(t)
+		}
+	}
+	if v := form.Get("cursor"); v != "" {
+		afterNumber, err := conv.ParseInt32(v)
+		if err != nil || afterNumber < 0 {
+			return q, herr.BadRequest("Invalid cursor", err).From("[ParseInt32]")
+		}
+		q.afterNumber = afterNumber
+	}
+	if v := form.Get("limit"); v != "" {
+		limit, err := conv.ParseInt32(v)
+		if err != nil || limit <= 0 {
+			return q, herr.BadRequest("Invalid limit, which must be a positive integer", err).From("[ParseInt32]")
+		}
+		q.limit = limit
+	}
+	return q, nil
+}
+
+// nextCursor returns the cursor for the page after the one whose last record
+// had number lastNumber, or "" if that page wasn't full, and so was the last.
+func (q listQuery) nextCursor(pageLength int, lastNumber int32) string {
+	if pageLength < int(q.limit) {
+		return ""
+	}
+	return conv.FormatInt(lastNumber)
+}
+
+// formList reads a list-valued query parameter, which may be given more than
+// once, as a comma-separated list, or both.
+func formList(form url.Values, key string) []string {
+	var result []string
+	for _, v := range form[key] {
+		for item := range strings.SplitSeq(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// parseIncidentFilter reads the "incident" parameter that GetFieldReports and
+// GetVisits take, which is either an Incident number, or "none" for records
+// that aren't attached to any Incident. all is true when there's no filter.
+func parseIncidentFilter(form url.Values) (all bool, incident sql.NullInt32, errHTTP *herr.HTTPError) {
+	v := form.Get("incident")
+	switch v {
+	case "":
+		return true, sql.NullInt32{}, nil
+	case "none":
+		return false, sql.NullInt32{}, nil
+	}
+	num, err := conv.ParseInt32(v)
+	if err != nil {
+		return false, sql.NullInt32{}, herr.BadRequest("Invalid incident, which must be a number or \"none\"", err).From("[ParseInt32]")
+	}
+	return false, sql.NullInt32{Int32: num, Valid: true}, nil
+}
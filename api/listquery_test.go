@@ -0,0 +1,123 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"database/sql"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListQuery(t *testing.T) {
+	t.Parallel()
+	q, errHTTP := parseListQuery(url.Values{})
+	require.Nil(t, errHTTP)
+	assert.Equal(t, listQuery{createdBefore: 1e100, modifiedBefore: 1e100, limit: math.MaxInt32}, q)
+
+	q, errHTTP = parseListQuery(url.Values{
+		"created_after":   {"2025-08-24T10:00:00Z"},
+		"modified_before": {"2025-08-25T10:00:00-07:00"},
+		"cursor":          {"17"},
+		"limit":           {"25"},
+	})
+	require.Nil(t, errHTTP)
+	assert.Equal(t, conv.TimeToFloat(time.Date(2025, 8, 24, 10, 0, 0, 0, time.UTC)), q.createdAfter)
+	assert.Equal(t, conv.TimeToFloat(time.Date(2025, 8, 25, 17, 0, 0, 0, time.UTC)), q.modifiedBefore)
+	assert.Equal(t, int32(17), q.afterNumber)
+	assert.Equal(t, int32(25), q.limit)
+
+	for _, bad := range []url.Values{
+		{"created_after": {"1756029600"}},
+		{"cursor": {"abc"}},
+		{"cursor": {"-3"}},
+		{"limit": {"0"}},
+	} {
+		_, errHTTP = parseListQuery(bad)
+		assert.NotNil(t, errHTTP, bad)
+	}
+}
+
+func TestListQueryNextCursor(t *testing.T) {
+	t.Parallel()
+	q := listQuery{limit: 3}
+	assert.Equal(t, "", q.nextCursor(2, 10))
+	assert.Equal(t, "10", q.nextCursor(3, 10))
+}
+
+func TestFormList(t *testing.T) {
+	t.Parallel()
+	form := url.Values{"state": {"new, on_hold", "closed", ""}}
+	assert.Equal(t, []string{"new", "on_hold", "closed"}, formList(form, "state"))
+	assert.Nil(t, formList(form, "priority"))
+}
+
+func TestParseIncidentFilter(t *testing.T) {
+	t.Parallel()
+	all, incident, errHTTP := parseIncidentFilter(url.Values{})
+	require.Nil(t, errHTTP)
+	assert.True(t, all)
+
+	all, incident, errHTTP = parseIncidentFilter(url.Values{"incident": {"none"}})
+	require.Nil(t, errHTTP)
+	assert.False(t, all)
+	assert.Equal(t, sql.NullInt32{}, incident)
+
+	all, incident, errHTTP = parseIncidentFilter(url.Values{"incident": {"12"}})
+	require.Nil(t, errHTTP)
+	assert.False(t, all)
+	assert.Equal(t, sql.NullInt32{Int32: 12, Valid: true}, incident)
+
+	_, _, errHTTP = parseIncidentFilter(url.Values{"incident": {"twelve"}})
+	assert.NotNil(t, errHTTP)
+}
+
+func TestIncidentsParams(t *testing.T) {
+	t.Parallel()
+	params, _, errHTTP := incidentsParams(url.Values{}, 4)
+	require.Nil(t, errHTTP)
+	assert.Equal(t, int32(4), params.Event)
+	assert.Equal(t, true, params.AllStates)
+	assert.Equal(t, true, params.AllPriorities)
+	assert.False(t, params.IncidentType.Valid)
+	assert.False(t, params.RangerHandle.Valid)
+
+	params, _, errHTTP = incidentsParams(url.Values{
+		"state":         {"new,dispatched"},
+		"priority":      {"1", "5"},
+		"incident_type": {"9"},
+		"ranger":        {"Hubcap"},
+	}, 4)
+	require.Nil(t, errHTTP)
+	assert.Equal(t, false, params.AllStates)
+	assert.Equal(t, []imsdb.IncidentState{imsdb.IncidentStateNew, imsdb.IncidentStateDispatched}, params.States)
+	assert.Equal(t, false, params.AllPriorities)
+	assert.Equal(t, []int8{1, 5}, params.Priorities)
+	assert.Equal(t, sql.NullInt32{Int32: 9, Valid: true}, params.IncidentType)
+	assert.Equal(t, sql.NullString{String: "Hubcap", Valid: true}, params.RangerHandle)
+
+	_, _, errHTTP = incidentsParams(url.Values{"state": {"sleeping"}}, 4)
+	assert.NotNil(t, errHTTP)
+	_, _, errHTTP = incidentsParams(url.Values{"priority": {"300"}}, 4)
+	assert.NotNil(t, errHTTP)
+}
@@ -0,0 +1,383 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/actionlog"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// loginFailureMemory is how long a failed login counts against its
+	// identification and address. A failure after a longer quiet spell
+	// starts the count over.
+	loginFailureMemory = 24 * time.Hour
+
+	// loginBackoffBase is the wait after the first failure that isn't free.
+	// It doubles with each failure after that.
+	loginBackoffBase = time.Second
+
+	// loginThrottleSubjectMaxLength is the size of LOGIN_THROTTLE.SUBJECT.
+	// Longer identifications and addresses are cut down to fit, which at
+	// worst has a few of them share a count.
+	loginThrottleSubjectMaxLength = 256
+
+	// loginLockoutActionType is the ACTION_LOG ACTION_TYPE for an
+	// identification getting locked.
+	loginLockoutActionType = "login_lockout"
+)
+
+// loginBackoff is how failed logins are slowed down, for one kind of
+// LOGIN_THROTTLE subject.
+type loginBackoff struct {
+	// freeFailures is how many failures there can be before there's any wait.
+	freeFailures int32
+	// maxWait caps the wait between attempts.
+	maxWait time.Duration
+}
+
+var loginBackoffs = map[imsdb.LoginThrottleKind]loginBackoff{
+	imsdb.LoginThrottleKindIdentification: {freeFailures: 3, maxWait: 5 * time.Minute},
+	// Lots of Rangers can log in from one address, e.g. from the HQ network,
+	// so an address gets a lot more leeway than an identification.
+	imsdb.LoginThrottleKindAddress: {freeFailures: 20, maxWait: time.Minute},
+}
+
+// wait is how long a subject with this many recent failures must wait after
+// the last one before trying again.
+func (b loginBackoff) wait(failures int32) time.Duration {
+	if failures < b.freeFailures {
+		return 0
+	}
+	// Cap the doubling before it overflows. It'd have been capped by maxWait
+	// long before then anyway.
+	doublings := min(failures-b.freeFailures, 30)
+	return min(loginBackoffBase<<doublings, b.maxWait)
+}
+
+// loginThrottledError is the internal error when a login attempt isn't allowed
+// yet. PostAuth uses it for the Retry-After header.
+type loginThrottledError struct {
+	retryAfter time.Duration
+}
+
+func (e loginThrottledError) Error() string {
+	return fmt.Sprintf("login throttled for another %v", e.retryAfter)
+}
+
+// loginThrottle slows down password guessing. It counts failed logins for
+// each identification (a handle or email) and for each client address, and
+// makes either wait longer and longer between attempts after a few failures.
+// An identification that keeps failing gets locked out for a while.
+type loginThrottle struct {
+	imsDBQ       *store.DBQ
+	actionLogger *actionlog.Logger
+	// lockoutFailures is how many failures lock out an identification, or 0
+	// if identifications are never locked out.
+	lockoutFailures int32
+	lockoutDuration time.Duration
+	// trustedProxies are the only peers whose forwarding headers count.
+	trustedProxies []netip.Prefix
+}
+
+// address gives the client address to count failed logins against. Unlike
+// clientAddress, which is only for the logs, this ignores the forwarding
+// headers unless the request came through a trusted proxy, since anyone else
+// could make up a new address for each guess.
+func (lt loginThrottle) address(req *http.Request) string {
+	peer, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	if !lt.trusted(peer.Addr()) {
+		return peer.Addr().Unmap().String()
+	}
+	if connectingIP := strings.TrimSpace(req.Header.Get("CF-Connecting-IP")); connectingIP != "" {
+		return connectingIP
+	}
+	// Each proxy appends the address it heard from, so the client is the
+	// rightmost one that isn't another of our proxies, or else the leftmost.
+	client := peer.Addr().Unmap().String()
+	forwardedFor := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwardedFor[i])
+		if hop == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(hop)
+		if err != nil || !lt.trusted(addr) {
+			return hop
+		}
+		client = addr.Unmap().String()
+	}
+	return client
+}
+
+func (lt loginThrottle) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range lt.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginThrottleSubject gives the identification to count failed logins
+// against. That's the person's handle when the identification matched someone,
+// so that switching between a handle and an email doesn't get twice the tries.
+func loginThrottleSubject(identification string, matchedPerson *directory.User) string {
+	if matchedPerson != nil {
+		return strings.ToLower(matchedPerson.Handle)
+	}
+	return strings.ToLower(strings.TrimSpace(identification))
+}
+
+// loginThrottleKey cuts a subject down to what LOGIN_THROTTLE.SUBJECT holds,
+// without leaving half a character at the end.
+func loginThrottleKey(subject string) string {
+	if len(subject) <= loginThrottleSubjectMaxLength {
+		return subject
+	}
+	return strings.ToValidUTF8(subject[:loginThrottleSubjectMaxLength], "")
+}
+
+// check returns an error if a login attempt for this identification, or from
+// this client address, isn't allowed yet.
+func (lt loginThrottle) check(ctx context.Context, subject, address string, now time.Time) *herr.HTTPError {
+	subject, address = loginThrottleKey(subject), loginThrottleKey(address)
+	var retryAfter time.Duration
+	locked := false
+	for kind, s := range map[imsdb.LoginThrottleKind]string{
+		imsdb.LoginThrottleKindIdentification: subject,
+		imsdb.LoginThrottleKindAddress:        address,
+	} {
+		row, err := lt.imsDBQ.LoginThrottle(ctx, lt.imsDBQ, imsdb.LoginThrottleParams{Kind: kind, Subject: s})
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return herr.InternalServerError("Failed to fetch login throttle", err).From("[LoginThrottle]")
+		}
+		if row.LockedUntil.Valid {
+			wait := conv.FloatToTime(row.LockedUntil.Float64).Sub(now)
+			if wait <= 0 {
+				// The lockout's over, and so are the failures that led to it
+				continue
+			}
+			locked = true
+			retryAfter = max(retryAfter, wait)
+		}
+		if wait := conv.FloatToTime(row.LastFailure).Add(loginBackoffs[kind].wait(row.Failures)).Sub(now); wait > 0 {
+			retryAfter = max(retryAfter, wait)
+		}
+	}
+	if retryAfter <= 0 {
+		return nil
+	}
+	internalErr := loginThrottledError{retryAfter: retryAfter}
+	if locked {
+		return herr.TooManyRequests(
+			"Too many failed logins. This account is locked for now. Try again later, or ask an admin to unlock it.",
+			internalErr,
+		).SetExpectedError()
+	}
+	return herr.TooManyRequests(
+		fmt.Sprintf("Too many failed logins. Try again in %v.", retryAfter.Round(time.Second)),
+		internalErr,
+	).SetExpectedError()
+}
+
+// recordFailure counts a failed login against the identification and client
+// address, and locks out the identification if it's failed too many times.
+func (lt loginThrottle) recordFailure(req *http.Request, subject, address string, userID sql.NullInt64, now time.Time) *herr.HTTPError {
+	ctx := req.Context()
+	subject, address = loginThrottleKey(subject), loginThrottleKey(address)
+	for kind, s := range map[imsdb.LoginThrottleKind]string{
+		imsdb.LoginThrottleKindIdentification: subject,
+		imsdb.LoginThrottleKindAddress:        address,
+	} {
+		err := lt.imsDBQ.RecordLoginFailure(ctx, lt.imsDBQ, imsdb.RecordLoginFailureParams{
+			Kind:        kind,
+			Subject:     s,
+			Now:         conv.TimeToFloat(now),
+			ResetBefore: conv.TimeToFloat(now.Add(-loginFailureMemory)),
+		})
+		if err != nil {
+			return herr.InternalServerError("Failed to record failed login", err).From("[RecordLoginFailure]")
+		}
+	}
+	if lt.lockoutFailures <= 0 {
+		return nil
+	}
+
+	row, err := lt.imsDBQ.LoginThrottle(ctx, lt.imsDBQ, imsdb.LoginThrottleParams{
+		Kind:    imsdb.LoginThrottleKindIdentification,
+		Subject: subject,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch login throttle", err).From("[LoginThrottle]")
+	}
+	if row.Failures < lt.lockoutFailures {
+		return nil
+	}
+	locked, err := lt.imsDBQ.LockLogin(ctx, lt.imsDBQ, imsdb.LockLoginParams{
+		LockedUntil: conv.TimeToNullFloat(now.Add(lt.lockoutDuration)),
+		ID:          row.ID,
+		Now:         conv.TimeToNullFloat(now),
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to lock login", err).From("[LockLogin]")
+	}
+	if locked == 0 {
+		// Someone else got there first.
+		return nil
+	}
+	// #nosec G706 // log injection
+	slog.Warn("Locked out an identification after too many failed logins",
+		"identification", subject, "failures", row.Failures, "address", address)
+	lt.actionLogger.Log(ctx, imsdb.AddActionLogParams{
+		CreatedAt:     conv.TimeToFloat(now),
+		ActionType:    loginLockoutActionType,
+		Method:        conv.StringToSql(&req.Method, 128),
+		Path:          conv.StringToSql(&req.URL.Path, 128),
+		Referrer:      conv.StringToSql(requestReferrer(req), 128),
+		UserID:        userID,
+		UserName:      conv.StringToSql(&subject, 128),
+		ClientAddress: conv.StringToSql(&address, 128),
+		HttpStatus:    sql.NullInt16{Int16: http.StatusUnauthorized, Valid: true},
+	})
+	return nil
+}
+
+// recordSuccess forgets the identification's failed logins. The client
+// address's failures still count, since one successful login there says
+// nothing about the other identifications being tried from it.
+func (lt loginThrottle) recordSuccess(ctx context.Context, subject string, now time.Time) {
+	err := lt.imsDBQ.ClearLoginThrottle(ctx, lt.imsDBQ, imsdb.ClearLoginThrottleParams{
+		Kind:    imsdb.LoginThrottleKindIdentification,
+		Subject: loginThrottleKey(subject),
+	})
+	if err != nil {
+		slog.Error("Failed to clear login throttle", "error", err)
+	}
+	err = lt.imsDBQ.PruneLoginThrottles(ctx, lt.imsDBQ, imsdb.PruneLoginThrottlesParams{
+		FailedBefore: conv.TimeToFloat(now.Add(-loginFailureMemory)),
+		Now:          conv.TimeToNullFloat(now),
+	})
+	if err != nil {
+		slog.Error("Failed to prune login throttles", "error", err)
+	}
+}
+
+// GetLoginThrottles lists the identifications and client addresses that have
+// recently failed to log in, including any that are locked out.
+type GetLoginThrottles struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetLoginThrottles) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getLoginThrottles(req)
+	if errHTTP != nil {
+		errHTTP.From("[getLoginThrottles]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetLoginThrottles) getLoginThrottles(req *http.Request) (imsjson.LoginThrottles, *herr.HTTPError) {
+	errHTTP := requireAccountAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[requireAccountAdmin]")
+	}
+	now := time.Now()
+	rows, err := action.imsDBQ.ActiveLoginThrottles(req.Context(), action.imsDBQ, imsdb.ActiveLoginThrottlesParams{
+		FailedSince: conv.TimeToFloat(now.Add(-loginFailureMemory)),
+		Now:         conv.TimeToNullFloat(now),
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch login throttles", err).From("[ActiveLoginThrottles]")
+	}
+	resp := make(imsjson.LoginThrottles, 0, len(rows))
+	for _, row := range rows {
+		lt := imsjson.LoginThrottle{
+			ID:          row.ID,
+			Kind:        string(row.Kind),
+			Subject:     row.Subject,
+			Failures:    row.Failures,
+			LastFailure: conv.FloatToTime(row.LastFailure),
+		}
+		if lockedUntil := conv.NullFloatToTime(row.LockedUntil); lockedUntil.After(now) {
+			lt.LockedUntil = lockedUntil
+		}
+		resp = append(resp, lt)
+	}
+	return resp, nil
+}
+
+// DeleteLoginThrottle forgets the failed logins of an identification or client
+// address, which unlocks it.
+type DeleteLoginThrottle struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action DeleteLoginThrottle) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.deleteLoginThrottle(req)
+	if errHTTP != nil {
+		errHTTP.From("[deleteLoginThrottle]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action DeleteLoginThrottle) deleteLoginThrottle(req *http.Request) *herr.HTTPError {
+	errHTTP := requireAccountAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[requireAccountAdmin]")
+	}
+	throttleID, err := conv.ParseInt64(req.PathValue("throttleId"))
+	if err != nil {
+		return herr.BadRequest("Invalid login throttle ID", err).From("[ParseInt64]")
+	}
+	rows, err := action.imsDBQ.DeleteLoginThrottle(req.Context(), action.imsDBQ, throttleID)
+	if err != nil {
+		return herr.InternalServerError("Failed to delete login throttle", err).From("[DeleteLoginThrottle]")
+	}
+	if rows == 0 {
+		return herr.NotFound("No such login throttle", nil)
+	}
+	return nil
+}
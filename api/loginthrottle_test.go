@@ -0,0 +1,80 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginBackoffWait(t *testing.T) {
+	t.Parallel()
+
+	b := loginBackoff{freeFailures: 3, maxWait: time.Minute}
+	assert.Zero(t, b.wait(0))
+	assert.Zero(t, b.wait(2))
+	assert.Equal(t, time.Second, b.wait(3))
+	assert.Equal(t, 2*time.Second, b.wait(4))
+	assert.Equal(t, 32*time.Second, b.wait(8))
+	assert.Equal(t, time.Minute, b.wait(9))
+	// Way past where the doubling would overflow
+	assert.Equal(t, time.Minute, b.wait(1000))
+}
+
+func TestLoginThrottleAddress(t *testing.T) {
+	t.Parallel()
+
+	lt := loginThrottle{trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	req := func(remoteAddr string, headers ...string) string {
+		r := httptest.NewRequest("POST", "/ims/api/auth", nil)
+		r.RemoteAddr = remoteAddr
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Add(headers[i], headers[i+1])
+		}
+		return lt.address(r)
+	}
+
+	// Straight from the client, the headers are made up
+	assert.Equal(t, "203.0.113.9", req("203.0.113.9:1234"))
+	assert.Equal(t, "203.0.113.9", req("203.0.113.9:1234", "X-Forwarded-For", "198.51.100.1"))
+	assert.Equal(t, "203.0.113.9", req("203.0.113.9:1234", "CF-Connecting-IP", "198.51.100.1"))
+
+	// Through a trusted proxy, they're believed
+	assert.Equal(t, "198.51.100.1", req("10.1.2.3:1234", "CF-Connecting-IP", "198.51.100.1"))
+	assert.Equal(t, "198.51.100.1", req("10.1.2.3:1234", "X-Forwarded-For", "198.51.100.1"))
+	// but only as far back as the first hop that isn't one of ours
+	assert.Equal(t, "198.51.100.1", req("10.1.2.3:1234", "X-Forwarded-For", "192.0.2.7, 198.51.100.1, 10.4.5.6"))
+	assert.Equal(t, "198.51.100.1", req("10.1.2.3:1234",
+		"X-Forwarded-For", "192.0.2.7", "X-Forwarded-For", "198.51.100.1"))
+	assert.Equal(t, "10.1.2.3", req("10.1.2.3:1234"))
+	assert.Equal(t, "10.4.5.6", req("[::ffff:10.1.2.3]:1234", "X-Forwarded-For", "10.4.5.6"))
+}
+
+func TestLoginThrottleKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "alice", loginThrottleKey("alice"))
+	assert.Len(t, loginThrottleKey(strings.Repeat("a", 1000)), loginThrottleSubjectMaxLength)
+	// A multibyte character that doesn't fit is dropped whole
+	key := loginThrottleKey(strings.Repeat("a", loginThrottleSubjectMaxLength-1) + "é")
+	assert.Equal(t, strings.Repeat("a", loginThrottleSubjectMaxLength-1), key)
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/burningmantech/ranger-ims-go/lib/authz"
 	"github.com/burningmantech/ranger-ims-go/lib/conv"
 	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/lib/oidc"
 	"github.com/burningmantech/ranger-ims-go/store"
 	"github.com/burningmantech/ranger-ims-go/store/actionlog"
 	"github.com/burningmantech/ranger-ims-go/store/errorlog"
@@ -54,11 +55,14 @@ func AddToMux(
 		mux = http.NewServeMux()
 	}
 
-	jwter := authz.JWTer{SecretKey: cfg.Core.JWTSecret}
+	jwter := authz.JWTer{Keys: NewKeyRing(cfg, db)}
 	attachmentsEnabled := cfg.AttachmentsStore.Type != conf.AttachmentsStoreNone
+	directoryIsIMS := cfg.Directory.Directory.IncludesIMS()
+	mailer := newPasswordMailer(db, cfg.Mail)
+	passwordPolicy := cfg.Core.PasswordPolicy()
 
 	// authed registers a route wrapped in the standard middleware stack for an
-	// authenticated endpoint: error logging, panic recovery, JWT
+	// authenticated endpoint: error logging, panic recovery, JWT or API token
 	// authentication, action logging, and a request-size limit. logAction
 	// controls whether the request is written to the action log. Using this for
 	// every authenticated route makes it impossible to silently forget
@@ -68,7 +72,7 @@ func AddToMux(
 			handler,
 			RecordErrors(errorLogger),
 			RecoverFromPanic(),
-			RequireAuthN(jwter),
+			RequireAuthN(jwter, db),
 			LogRequest(logAction, actionLogger, userStore),
 			LimitRequestBytes(cfg.Core.MaxRequestBytes),
 		))
@@ -89,21 +93,76 @@ func AddToMux(
 	authed("GET /ims/api/access", GetEventAccesses{db, userStore, cfg.Core.Admins}, true)
 	authed("GET /ims/api/access_targets", GetAccessTargets{db, userStore, cfg.Core.Admins}, true)
 	authed("POST /ims/api/access", PostEventAccess{db, userStore, cfg.Core.Admins}, true)
+	authed("GET /ims/api/access/explain", ExplainEventAccess{db, userStore, cfg.Core.Admins}, true)
+	authed("GET /ims/api/access/history", GetEventAccessHistory{db, userStore, cfg.Core.Admins}, true)
+	authed("POST /ims/api/access/restore", RestoreEventAccess{db, userStore, cfg.Core.Admins}, true)
+	authed("GET /ims/api/break_glass", GetBreakGlasses{db, userStore, cfg.Core.Admins}, true)
 	authed("GET /ims/api/actionlogs", GetActionLogs{db, userStore, cfg.Core.Admins}, true)
 	authed("GET /ims/api/errorlogs", GetErrorLogs{db, userStore, cfg.Core.Admins}, true)
 
 	// This endpoint does not require authentication, nor does it even consider
 	// the request's Authorization header, because the point of this is to make
 	// a new JWT.
-	unauthed("POST /ims/api/auth",
-		PostAuth{
+	postAuth := PostAuth{
+		db,
+		userStore,
+		jwter,
+		cfg.Core.AccessTokenLifetime,
+		cfg.Core.RefreshTokenLifetime,
+		loginThrottle{
+			db,
+			actionLogger,
+			cfg.Core.LoginLockoutFailures,
+			cfg.Core.LoginLockoutDuration,
+			cfg.Core.TrustedProxies,
+		},
+		directoryIsIMS,
+		cfg.Core.MasterKey,
+		cfg.Core.PasswordHashParams,
+	}
+	unauthed("POST /ims/api/auth", postAuth, true)
+
+	// This endpoint does not require authentication either, since it's the
+	// second step of logging in. It takes the short-lived token that the first
+	// step gave instead.
+	unauthed("POST /ims/api/auth/second_factor", PostAuthSecondFactor{postAuth}, true)
+
+	// These endpoints don't require authentication either, since they're for
+	// people who can't log in yet, or have forgotten how. The second takes the
+	// token from an invitation or password reset email instead.
+	unauthed("POST /ims/api/auth/password_reset", RequestPasswordReset{userStore, directoryIsIMS, mailer}, true)
+	unauthed("POST /ims/api/auth/password",
+		SetPasswordWithToken{
 			db,
 			userStore,
-			cfg.Core.JWTSecret,
-			cfg.Core.AccessTokenLifetime,
-			cfg.Core.RefreshTokenLifetime,
+			directoryIsIMS,
+			cfg.Core.PasswordHashParams,
+			passwordPolicy,
 		}, true)
 
+	// These endpoints don't require authentication either, since they're how
+	// someone logs in through the OIDC provider instead of with a password.
+	if cfg.OIDC.Enabled() {
+		provider := oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+			HandleClaim:  cfg.OIDC.HandleClaim,
+		})
+		unauthed("GET /ims/api/auth/oidc/login", OIDCLogin{provider, cfg.Core.MasterKey}, true)
+		unauthed("GET /ims/api/auth/oidc/callback",
+			OIDCCallback{
+				db,
+				userStore,
+				jwter,
+				cfg.Core.MasterKey,
+				cfg.Core.RefreshTokenLifetime,
+				provider,
+				postAuth.throttle,
+			}, true)
+	}
+
 	// This endpoint does not require authentication or authorization, by design.
 	unauthed("GET /ims/api/auth",
 		GetAuth{
@@ -114,7 +173,7 @@ func AddToMux(
 			attachmentsEnabled,
 			cfg.Core.EventDeletionEnabled,
 			cfg.BurningManAPI.Enabled(),
-		}, true, OptionalAuthN(jwter))
+		}, true, OptionalAuthN(jwter, db))
 
 	// This endpoint does not require authentication, nor does it even consider
 	// the request's Authorization header, because the point of this is to make
@@ -123,14 +182,29 @@ func AddToMux(
 		RefreshAccessToken{
 			db,
 			userStore,
-			cfg.Core.JWTSecret,
+			jwter,
 			cfg.Core.AccessTokenLifetime,
 		}, false)
 
+	// This endpoint does not require authentication, since it's for services
+	// that verify IMS's JWTs, which needn't be logged in to IMS themselves.
+	unauthed("GET /ims/api/auth/jwks", GetJWKS{jwter.Keys}, false)
+	authed("GET /ims/api/auth/sessions", GetOwnSessions{db}, false)
+	authed("DELETE /ims/api/auth/sessions", RevokeOwnSessions{db}, true)
+	authed("DELETE /ims/api/auth/sessions/{sessionId}", RevokeOwnSession{db}, true)
+	authed("GET /ims/api/auth/totp", GetOwnTOTP{db, userStore}, false)
+	authed("POST /ims/api/auth/totp", StartOwnTOTP{db, userStore, cfg.Core.MasterKey}, true)
+	authed("POST /ims/api/auth/totp/confirm", ConfirmOwnTOTP{db, userStore, cfg.Core.MasterKey}, true)
+	authed("POST /ims/api/auth/totp/disable", DisableOwnTOTP{db, userStore, cfg.Core.MasterKey}, true)
+	authed("POST /ims/api/auth/totp/recovery_codes", ReplaceOwnRecoveryCodes{db, userStore, cfg.Core.MasterKey}, true)
+
 	authed("GET /ims/api/events/{eventName}/incidents", GetIncidents{db, userStore, cfg.Core.Admins, attachmentsEnabled}, false)
 	authed("POST /ims/api/events/{eventName}/incidents", NewIncident{db, userStore, es, cfg.Core.Admins}, true)
+	authed("GET /ims/api/events/{eventName}/incident_metrics", GetIncidentMetrics{db, userStore, cfg.Core.Admins}, false)
 	authed("GET /ims/api/events/{eventName}/incidents/{incidentNumber}", GetIncident{db, userStore, cfg.Core.Admins, attachmentsEnabled}, false)
 	authed("POST /ims/api/events/{eventName}/incidents/{incidentNumber}", EditIncident{db, userStore, es, cfg.Core.Admins}, true)
+	authed("POST /ims/api/events/{eventName}/incidents/{incidentNumber}/break_glass", NewBreakGlass{db, userStore, es, cfg.Core.Admins, cfg.Core.BreakGlassDuration, cfg.Core.BreakGlassEligible, mailer, breakGlassIncident}, true)
+	authed("POST /ims/api/events/{eventName}/incidents/{incidentNumber}/merge", MergeIncident{db, userStore, es, cfg.Core.Admins}, true)
 	authed("GET /ims/api/events/{eventName}/incidents/{incidentNumber}/attachments/{attachmentNumber}", GetIncidentAttachment{db, userStore, cfg.AttachmentsStore, s3Client, cfg.Core.Admins}, true)
 	authed("POST /ims/api/events/{eventName}/incidents/{incidentNumber}/attachments", AttachToIncident{db, userStore, es, cfg.AttachmentsStore, s3Client, cfg.Core.Admins}, true)
 	authed("POST /ims/api/events/{eventName}/incidents/{incidentNumber}/rangers/{rangerName}", AttachRangerToIncident{db, userStore, es, cfg.Core.Admins}, true)
@@ -153,12 +227,21 @@ func AddToMux(
 	authed("GET /ims/api/events/{eventName}/visits/{visitNumber}", GetVisit{db, userStore, cfg.Core.Admins, attachmentsEnabled}, false)
 	authed("POST /ims/api/events/{eventName}/visits", NewVisit{db, userStore, es, cfg.Core.Admins}, false)
 	authed("POST /ims/api/events/{eventName}/visits/{visitNumber}", EditVisit{db, userStore, es, cfg.Core.Admins}, false)
+	authed("POST /ims/api/events/{eventName}/visits/{visitNumber}/break_glass", NewBreakGlass{db, userStore, es, cfg.Core.Admins, cfg.Core.BreakGlassDuration, cfg.Core.BreakGlassEligible, mailer, breakGlassVisit}, true)
 	authed("POST /ims/api/events/{eventName}/visits/{visitNumber}/rangers/{rangerName}", AttachRangerToVisit{db, userStore, es, cfg.Core.Admins}, true)
 	authed("DELETE /ims/api/events/{eventName}/visits/{visitNumber}/rangers/{rangerName}", DetachRangerFromVisit{db, userStore, es, cfg.Core.Admins}, true)
 	authed("GET /ims/api/events/{eventName}/visits/{visitNumber}/attachments/{attachmentNumber}", GetVisitAttachment{db, userStore, cfg.AttachmentsStore, s3Client, cfg.Core.Admins}, true)
 	authed("POST /ims/api/events/{eventName}/visits/{visitNumber}/attachments", AttachToVisit{db, userStore, es, cfg.AttachmentsStore, s3Client, cfg.Core.Admins}, true)
 	authed("POST /ims/api/events/{eventName}/visits/{visitNumber}/report_entries/{reportEntryId}", EditVisitReportEntry{db, userStore, es, cfg.Core.Admins}, true)
 
+	authed("GET /ims/api/events/{eventName}/changes", GetChanges{db, userStore, cfg.Core.Admins, attachmentsEnabled}, false)
+
+	authed("GET /ims/api/events/{eventName}/webhooks", GetWebhooks{db, userStore, cfg.Core.Admins}, true)
+	authed("POST /ims/api/events/{eventName}/webhooks", EditWebhook{db, userStore, cfg.Core.Admins, cfg.Core.MasterKey}, true)
+	authed("DELETE /ims/api/events/{eventName}/webhooks/{webhookId}", DeleteWebhook{db, userStore, cfg.Core.Admins}, true)
+	authed("GET /ims/api/events/{eventName}/webhooks/{webhookId}/deliveries", GetWebhookDeliveries{db, userStore, cfg.Core.Admins}, true)
+	authed("POST /ims/api/events/{eventName}/webhooks/{webhookId}/deliveries/{deliveryId}/retry", RetryWebhookDelivery{db, userStore, cfg.Core.Admins}, true)
+
 	authed("GET /ims/api/events/{eventName}/places", GetPlaces{db, userStore, cfg.Core.Admins, cfg.Core.CacheControlShort}, true)
 	authed("POST /ims/api/events/{eventName}/places", UpdatePlaces{db, userStore, cfg.Core.Admins, cfg.Core.CacheControlShort}, true)
 	authed("POST /ims/api/events/{eventName}/places/import", ImportPlaces{db, userStore, cfg.Core.Admins, cfg.BurningManAPI}, true)
@@ -167,6 +250,16 @@ func AddToMux(
 	authed("POST /ims/api/events", EditEvent{db, userStore, cfg.Core.Admins}, true)
 	authed("DELETE /ims/api/events/{eventName}", DeleteEvent{db, userStore, cfg.Core.Admins, cfg.Core.EventDeletionEnabled}, true)
 
+	authed("GET /ims/api/tokens", GetAPITokens{db, userStore, cfg.Core.Admins}, true)
+	authed("POST /ims/api/tokens", NewAPIToken{db, userStore, cfg.Core.Admins}, true)
+	authed("DELETE /ims/api/tokens/{tokenId}", RevokeAPIToken{db, userStore, cfg.Core.Admins}, true)
+
+	authed("GET /ims/api/sessions", GetSessions{db, userStore, cfg.Core.Admins}, true)
+	authed("DELETE /ims/api/sessions/{sessionId}", RevokeSession{db, userStore, cfg.Core.Admins}, true)
+	authed("DELETE /ims/api/users/{userId}/sessions", RevokeUserSessions{db, userStore, cfg.Core.Admins}, true)
+	authed("GET /ims/api/login_throttles", GetLoginThrottles{db, userStore, cfg.Core.Admins}, true)
+	authed("DELETE /ims/api/login_throttles/{throttleId}", DeleteLoginThrottle{db, userStore, cfg.Core.Admins}, true)
+
 	authed("GET /ims/api/search", GetSearch{db, userStore, cfg.Core.Admins}, false)
 
 	authed("GET /ims/api/incident_types", GetIncidentTypes{db, userStore, cfg.Core.Admins, cfg.Core.CacheControlShort}, false)
@@ -176,20 +269,27 @@ func AddToMux(
 
 	// Admin management of the IMS-native user directory. These endpoints
 	// reject all requests unless the deployment uses IMS_DIRECTORY=ims.
-	directoryIsIMS := cfg.Directory.Directory == conf.DirectoryTypeIMS
 	authed("GET /ims/api/directory", GetDirectory{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
-	authed("POST /ims/api/directory/persons", EditDirectoryPerson{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
-	authed("POST /ims/api/directory/persons/{personId}/password", SetDirectoryPersonPassword{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
+	authed("GET /ims/api/directory/export", ExportDirectory{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
+	authed("POST /ims/api/directory/import", ImportDirectory{db, userStore, cfg.Core.Admins, directoryIsIMS, cfg.Core.PasswordHashParams, mailer}, true)
+	authed("GET /ims/api/directory/password_hashes", GetDirectoryPasswordHashes{db, userStore, cfg.Core.Admins, directoryIsIMS, cfg.Core.PasswordHashParams}, false)
+	authed("GET /ims/api/directory/password_policy", GetDirectoryPasswordPolicy{db, userStore, cfg.Core.Admins, directoryIsIMS, passwordPolicy}, false)
+	authed("POST /ims/api/directory/persons", EditDirectoryPerson{db, userStore, cfg.Core.Admins, directoryIsIMS, cfg.Core.PasswordHashParams}, true)
+	authed("POST /ims/api/directory/persons/{personId}/password", SetDirectoryPersonPassword{db, userStore, cfg.Core.Admins, directoryIsIMS, cfg.Core.PasswordHashParams, passwordPolicy}, true)
+	authed("POST /ims/api/directory/persons/{personId}/invite", InviteDirectoryPerson{db, userStore, cfg.Core.Admins, directoryIsIMS, mailer}, true)
+	authed("DELETE /ims/api/directory/persons/{personId}/totp", ResetDirectoryPersonTOTP{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
 	authed("DELETE /ims/api/directory/persons/{personId}", DeleteDirectoryPerson{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
+	authed("POST /ims/api/directory/persons/{personId}/on_duty", SignOnDirectoryPerson{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
+	authed("DELETE /ims/api/directory/persons/{personId}/on_duty", SignOffDirectoryPerson{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
+	authed("GET /ims/api/directory/shifts", GetDirectoryShifts{db, userStore, cfg.Core.Admins, directoryIsIMS}, false)
 	authed("POST /ims/api/directory/teams", EditDirectoryTeam{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
 	authed("DELETE /ims/api/directory/teams/{teamId}", DeleteDirectoryTeam{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
 	authed("POST /ims/api/directory/positions", EditDirectoryPosition{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
 	authed("DELETE /ims/api/directory/positions/{positionId}", DeleteDirectoryPosition{db, userStore, cfg.Core.Admins, directoryIsIMS}, true)
 
-	// The SSE stream only carries notification metadata (event and record
-	// numbers), not record contents; clients fetch the actual data through the
-	// authenticated endpoints above.
-	unauthed("GET /ims/api/eventsource", es.Server.Handler(EventSourceChannel), false)
+	// The SSE stream pushes record contents, so each stream only gets the
+	// updates that its requestor could have fetched through the endpoints above.
+	authed("GET /ims/api/eventsource", GetEventSource{db, userStore, cfg.Core.Admins, es}, false)
 
 	authed("GET /ims/api/debug/buildinfo", GetBuildInfo{db, userStore, cfg.Core.Admins}, true)
 	authed("GET /ims/api/debug/runtimemetrics", GetRuntimeMetrics{db, userStore, cfg.Core.Admins}, true)
@@ -333,7 +433,11 @@ func LogRequest(enable bool, actionLogger *actionlog.Logger, userStore *director
 			jwtCtx, _ := r.Context().Value(JWTContextKey).(JWTContext)
 			if jwtCtx.Claims != nil {
 				username = conv.StringToSql(new(jwtCtx.Claims.RangerHandle()), 128)
-				userID = sql.NullInt64{Int64: jwtCtx.Claims.DirectoryID(), Valid: true}
+				// An API token acts under its own name, and isn't anyone in
+				// the directory.
+				if jwtCtx.Claims.APIToken() == nil {
+					userID = sql.NullInt64{Int64: jwtCtx.Claims.DirectoryID(), Valid: true}
+				}
 				if posID := jwtCtx.Claims.RangerOnDutyPosition(); posID != nil {
 					positionID = sql.NullInt64{Int64: *posID, Valid: true}
 					positions, _, _ := userStore.GetPositionsAndTeams(r.Context())
@@ -345,16 +449,23 @@ func LogRequest(enable bool, actionLogger *actionlog.Logger, userStore *director
 			}
 			writ.setUser(userID, positionID, username, positionName)
 
+			// A request that touched a confidential record is always logged.
+			r, confidential := withConfidentialAccess(r)
+
 			next.ServeHTTP(writ, r)
 
-			if enable {
+			if enable || confidential.touched.Load() {
+				actionType := "api"
+				if confidential.touched.Load() {
+					actionType = confidentialAccessActionType
+				}
 				referrer := requestReferrer(r)
 				remoteAddr := clientAddress(r)
 				actionLogger.Log(
 					r.Context(),
 					imsdb.AddActionLogParams{
 						CreatedAt:      conv.TimeToFloat(time.Now()),
-						ActionType:     "api",
+						ActionType:     actionType,
 						Method:         conv.StringToSql(&r.Method, 128),
 						Path:           conv.StringToSql(&r.URL.Path, 128),
 						Referrer:       conv.StringToSql(referrer, 128),
@@ -469,11 +580,20 @@ type JWTContext struct {
 	Error  error
 }
 
-func OptionalAuthN(j authz.JWTer) Adapter {
+// authenticate checks the request's bearer token, which is either a JWT or,
+// if imsDBQ is provided, an API token.
+func authenticate(r *http.Request, j authz.JWTer, imsDBQ *store.DBQ) (*authz.IMSClaims, error) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if imsDBQ != nil && authz.IsAPIToken(bearer) {
+		return authenticateAPIToken(r.Context(), imsDBQ, bearer)
+	}
+	return j.AuthenticateJWT(bearer)
+}
+
+func OptionalAuthN(j authz.JWTer, imsDBQ *store.DBQ) Adapter {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			header := r.Header.Get("Authorization")
-			claims, err := j.AuthenticateJWT(strings.TrimPrefix(header, "Bearer "))
+			claims, err := authenticate(r, j, imsDBQ)
 			ctx := context.WithValue(r.Context(), JWTContextKey, JWTContext{
 				Claims: claims,
 				Error:  err,
@@ -483,11 +603,12 @@ func OptionalAuthN(j authz.JWTer) Adapter {
 	}
 }
 
-func RequireAuthN(j authz.JWTer) Adapter {
+// RequireAuthN rejects any request without a valid JWT or, if imsDBQ is
+// provided, API token.
+func RequireAuthN(j authz.JWTer, imsDBQ *store.DBQ) Adapter {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			header := r.Header.Get("Authorization")
-			claims, err := j.AuthenticateJWT(strings.TrimPrefix(header, "Bearer "))
+			claims, err := authenticate(r, j, imsDBQ)
 			if err != nil || claims == nil {
 				herr.Unauthorized("Invalid Authorization token", err).WriteResponse(w)
 				return
@@ -0,0 +1,275 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/lib/oidc"
+	"github.com/burningmantech/ranger-ims-go/lib/seal"
+	"github.com/burningmantech/ranger-ims-go/store"
+)
+
+const (
+	// oidcLoginCookieName is the cookie that carries an OIDC login from
+	// OIDCLogin to OIDCCallback, by way of the provider.
+	oidcLoginCookieName = "ims_oidc_login"
+	oidcLoginCookiePath = "/ims/api/auth/oidc/"
+
+	// oidcLoginLifetime is how long someone has to log in at the provider.
+	oidcLoginLifetime = 10 * time.Minute
+
+	// oidcLoginPage is where the browser ends up after an OIDC login. The page
+	// swaps the new refresh cookie for an access token.
+	oidcLoginPage = "/ims/auth/login"
+)
+
+// oidcStateAdditionalData binds a sealed login cookie to its use, so that
+// nothing else sealed under the master key can pass for one.
+var oidcStateAdditionalData = []byte("oidc-state")
+
+// oidcLoginState is what IMS must remember between sending someone to the
+// provider and their coming back. It's kept in a sealed cookie, rather than
+// the database, so that a login that's never finished leaves nothing behind.
+type oidcLoginState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Redirect string    `json:"redirect"`
+	Expires  time.Time `json:"expires"`
+}
+
+// OIDCLogin starts a login through the OIDC provider, by sending the browser
+// there.
+type OIDCLogin struct {
+	provider  *oidc.Provider
+	masterKey string
+}
+
+func (action OIDCLogin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	authURL, cookie, errHTTP := action.oidcLogin(req)
+	if errHTTP != nil {
+		oidcLoginFailed(w, req, errHTTP.From("[oidcLogin]"))
+		return
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+func (action OIDCLogin) oidcLogin(req *http.Request) (string, *http.Cookie, *herr.HTTPError) {
+	now := time.Now()
+	login := oidcLoginState{
+		State:    rand.Text(),
+		Nonce:    rand.Text(),
+		Verifier: oidc.NewVerifier(),
+		// This is only passed back to the login page, which checks it before
+		// following it.
+		Redirect: req.URL.Query().Get("o"),
+		Expires:  now.Add(oidcLoginLifetime),
+	}
+	authURL, err := action.provider.AuthCodeURL(req.Context(), login.State, login.Nonce, login.Verifier)
+	if err != nil {
+		return "", nil, herr.New(http.StatusBadGateway, "Failed to reach the login provider", err).From("[AuthCodeURL]")
+	}
+	plaintext, err := json.Marshal(login)
+	if err != nil {
+		return "", nil, herr.InternalServerError("Failed to start login", err).From("[Marshal]")
+	}
+	sealed, err := seal.Seal(action.masterKey, plaintext, oidcStateAdditionalData)
+	if err != nil {
+		return "", nil, herr.InternalServerError("Failed to start login", err).From("[seal.Seal]")
+	}
+	return authURL, &http.Cookie{
+		Name:     oidcLoginCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(sealed),
+		Path:     oidcLoginCookiePath,
+		MaxAge:   int(oidcLoginLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// The provider's redirect back to us is a cross-site navigation, which
+		// strict would leave the cookie off of.
+		SameSite: http.SameSiteLaxMode,
+	}, nil
+}
+
+// OIDCCallback is where the OIDC provider sends the browser back to. It
+// finishes the login, starting a session just as PostAuth does.
+type OIDCCallback struct {
+	imsDBQ               *store.DBQ
+	userStore            *directory.UserStore
+	jwter                authz.JWTer
+	masterKey            string
+	refreshTokenDuration time.Duration
+	provider             *oidc.Provider
+	throttle             loginThrottle
+}
+
+func (action OIDCCallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// The login cookie is single-use, whatever happens next.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookieName,
+		Path:     oidcLoginCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	redirect, cookie, errHTTP := action.oidcCallback(req)
+	if errHTTP != nil {
+		oidcLoginFailed(w, req, errHTTP.From("[oidcCallback]"))
+		return
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, req, oidcLoginPage+"?"+url.Values{"oidc": {"1"}, "o": {redirect}}.Encode(), http.StatusSeeOther)
+}
+
+func (action OIDCCallback) oidcCallback(req *http.Request) (string, *http.Cookie, *herr.HTTPError) {
+	ctx := req.Context()
+	now := time.Now()
+	login, errHTTP := action.openLoginCookie(req, now)
+	if errHTTP != nil {
+		return "", nil, errHTTP.From("[openLoginCookie]")
+	}
+	q := req.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(login.State)) != 1 {
+		return "", nil, herr.BadRequest("Login state mismatch. Try logging in again.", nil)
+	}
+	if providerErr := q.Get("error"); providerErr != "" {
+		return "", nil, herr.Unauthorized("The login provider refused the login",
+			errors.New(providerErr+": "+q.Get("error_description")))
+	}
+
+	identity, err := action.provider.Exchange(ctx, q.Get("code"), login.Nonce, login.Verifier, now)
+	if err != nil {
+		return "", nil, herr.Unauthorized("The login provider's response wasn't valid", err).From("[Exchange]")
+	}
+
+	rangers, err := action.userStore.GetAllUsers(ctx)
+	if err != nil {
+		return "", nil, herr.InternalServerError("Failed to fetch personnel", err).From("[GetRangers]")
+	}
+	matchedPerson := matchOIDCIdentity(rangers, identity)
+	if matchedPerson == nil {
+		return "", nil, herr.Forbidden("No IMS user matches that login",
+			errors.New("no user for OIDC subject "+identity.Subject))
+	}
+
+	// An identification that's locked out after failed password logins stays
+	// locked out here too.
+	errHTTP = action.throttle.check(ctx, loginThrottleSubject("", matchedPerson), action.throttle.address(req), now)
+	if errHTTP != nil {
+		return "", nil, errHTTP.From("[check]")
+	}
+	errHTTP = action.refuseSecondFactor(ctx, matchedPerson)
+	if errHTTP != nil {
+		return "", nil, errHTTP.From("[refuseSecondFactor]")
+	}
+
+	cookie, errHTTP := startSession(req, action.imsDBQ, action.jwter, matchedPerson, action.refreshTokenDuration)
+	if errHTTP != nil {
+		return "", nil, errHTTP.From("[startSession]")
+	}
+	// #nosec G706 // log injection
+	slog.Info("Successful OIDC login for Ranger", "identification", matchedPerson.Handle, "subject", identity.Subject)
+	return login.Redirect, cookie, nil
+}
+
+// refuseSecondFactor turns away someone who has, or must set up, TOTP. This
+// callback has no way to ask for a TOTP code, and the provider's own login
+// can't stand in for a second factor that IMS requires.
+func (action OIDCCallback) refuseSecondFactor(ctx context.Context, matchedPerson *directory.User) *herr.HTTPError {
+	personID, ok := action.userStore.IMSPersonID(matchedPerson.ID)
+	if !ok {
+		return nil
+	}
+	person, errHTTP := fetchPersonTOTP(ctx, action.imsDBQ, personID)
+	if errHTTP != nil {
+		return errHTTP.From("[fetchPersonTOTP]")
+	}
+	if person.TotpConfirmed || person.TotpRequired {
+		return herr.Forbidden("This account needs a TOTP code, so log in with a password instead", nil).
+			SetExpectedError()
+	}
+	return nil
+}
+
+func (action OIDCCallback) openLoginCookie(req *http.Request, now time.Time) (oidcLoginState, *herr.HTTPError) {
+	var empty oidcLoginState
+	cookie, err := req.Cookie(oidcLoginCookieName)
+	if err != nil {
+		return empty, herr.BadRequest("No login in progress. Try logging in again.", err).From("[Cookie]")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return empty, herr.BadRequest("Invalid login cookie", err).From("[DecodeString]")
+	}
+	plaintext, err := seal.Open(action.masterKey, sealed, oidcStateAdditionalData)
+	if err != nil {
+		return empty, herr.BadRequest("Invalid login cookie", err).From("[seal.Open]")
+	}
+	var login oidcLoginState
+	err = json.Unmarshal(plaintext, &login)
+	if err != nil {
+		return empty, herr.BadRequest("Invalid login cookie", err).From("[Unmarshal]")
+	}
+	if now.After(login.Expires) {
+		return empty, herr.BadRequest("Login took too long. Try logging in again.", nil)
+	}
+	return login, nil
+}
+
+// matchOIDCIdentity finds the directory user for an OIDC identity, by handle
+// first, if the server is set up to trust a handle claim, then by email. The
+// provider only gives an email if it has verified it.
+func matchOIDCIdentity(rangers map[int64]*directory.User, identity oidc.Identity) *directory.User {
+	if identity.Handle != "" {
+		for _, person := range rangers {
+			if person.Handle != "" && strings.EqualFold(person.Handle, identity.Handle) {
+				return person
+			}
+		}
+	}
+	if identity.Email != "" {
+		for _, person := range rangers {
+			if person.Email != "" && strings.EqualFold(person.Email, identity.Email) {
+				return person
+			}
+		}
+	}
+	return nil
+}
+
+// oidcLoginFailed sends the browser back to the login page, since it got to
+// the OIDC endpoints by navigation, not by fetch, and there's no page around
+// to show an error response.
+func oidcLoginFailed(w http.ResponseWriter, req *http.Request, errHTTP *herr.HTTPError) {
+	slog.Error("OIDC login failed", "error", errHTTP)
+	http.Redirect(w, req, oidcLoginPage+"?"+url.Values{"oidc_failed": {errHTTP.ResponseMessage}}.Encode(), http.StatusSeeOther)
+}
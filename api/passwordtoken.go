@@ -0,0 +1,440 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/conf"
+	"github.com/burningmantech/ranger-ims-go/directory"
+	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
+	"github.com/burningmantech/ranger-ims-go/lib/authn"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/lib/mail"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// passwordResetInterval is the least time between password reset emails to
+	// one person, so that no one can flood someone's inbox by asking for resets
+	// over and over.
+	passwordResetInterval = 5 * time.Minute
+
+	// passwordTokenRetention is how long tokens are kept around after they've
+	// expired.
+	passwordTokenRetention = 30 * 24 * time.Hour
+
+	// mailSendTimeout bounds how long sending one email may take.
+	mailSendTimeout = 30 * time.Second
+
+	// mailQueueLength is how many background emails may be waiting to be
+	// sent. Any more than that are dropped, so that a flood of requests can't
+	// pile up goroutines or connections to the mail server.
+	mailQueueLength = 64
+
+	// passwordPagePath is the web page that the links in the emails go to. The
+	// token goes in the URL's fragment, which browsers never send to a server,
+	// so that it stays out of access logs and Referer headers.
+	passwordPagePath = "/ims/auth/password"
+)
+
+// passwordMailer sends the invitation and password reset emails for the
+// IMS-native directory. Each has a link with a single-use token in it, which
+// SetPasswordWithToken takes in exchange for a new password.
+type passwordMailer struct {
+	imsDBQ         *store.DBQ
+	sender         mail.Sender
+	publicURL      string
+	inviteLifetime time.Duration
+	resetLifetime  time.Duration
+
+	// queue holds the emails waiting to be sent in the background, which one
+	// worker sends in turn.
+	queue       chan func(context.Context)
+	startWorker sync.Once
+}
+
+// newPasswordMailer gives a passwordMailer that sends mail as configured, or
+// nil if sending mail is switched off.
+func newPasswordMailer(imsDBQ *store.DBQ, cfg conf.Mail) *passwordMailer {
+	var sender mail.Sender
+	switch cfg.Type {
+	case conf.MailSMTP:
+		sender = mail.SMTPSender{
+			Addr:     net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(int(cfg.SMTP.Port))),
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.From,
+		}
+	case conf.MailMaildir:
+		sender = mail.MaildirSender{Dir: cfg.Maildir, From: cfg.From}
+	default:
+		return nil
+	}
+	return &passwordMailer{
+		imsDBQ:         imsDBQ,
+		sender:         sender,
+		publicURL:      cfg.PublicURL,
+		inviteLifetime: cfg.InviteLifetime,
+		resetLifetime:  cfg.ResetLifetime,
+		queue:          make(chan func(context.Context), mailQueueLength),
+	}
+}
+
+// background queues up a job that sends mail, to be run apart from the
+// request that asked for it. It gives false, having dropped the job, if the
+// queue is full.
+func (m *passwordMailer) background(job func(ctx context.Context)) bool {
+	m.startWorker.Do(func() {
+		go func() {
+			for job := range m.queue {
+				job(context.Background())
+			}
+		}()
+	})
+	select {
+	case m.queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func hashPasswordToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// send makes a new token for the person, which replaces any they've been sent
+// before, and emails them a link with it.
+func (m *passwordMailer) send(
+	ctx context.Context, personID int64, handle, email string, purpose imsdb.DirectoryPasswordTokenPurpose,
+) error {
+	lifetime := m.resetLifetime
+	if purpose == imsdb.DirectoryPasswordTokenPurposeInvite {
+		lifetime = m.inviteLifetime
+	}
+	now := time.Now()
+	expires := now.Add(lifetime)
+	token := rand.Text()
+
+	txn, err := m.imsDBQ.Begin()
+	if err != nil {
+		return fmt.Errorf("[Begin]: %w", err)
+	}
+	defer rollback(txn)
+	err = m.imsDBQ.DirectoryUsePersonPasswordTokens(ctx, txn, imsdb.DirectoryUsePersonPasswordTokensParams{
+		Used:     conv.TimeToNullFloat(now),
+		PersonID: personID,
+	})
+	if err != nil {
+		return fmt.Errorf("[DirectoryUsePersonPasswordTokens]: %w", err)
+	}
+	err = m.imsDBQ.DirectoryCreatePasswordToken(ctx, txn, imsdb.DirectoryCreatePasswordTokenParams{
+		PersonID:  personID,
+		Purpose:   purpose,
+		TokenHash: hashPasswordToken(token),
+		Created:   conv.TimeToFloat(now),
+		Expires:   conv.TimeToFloat(expires),
+	})
+	if err != nil {
+		return fmt.Errorf("[DirectoryCreatePasswordToken]: %w", err)
+	}
+	if err = txn.Commit(); err != nil {
+		return fmt.Errorf("[Commit]: %w", err)
+	}
+	// Sending is as good a time as any to clear out long-dead tokens.
+	err = m.imsDBQ.DirectoryPrunePasswordTokens(ctx, m.imsDBQ, conv.TimeToFloat(now.Add(-passwordTokenRetention)))
+	if err != nil {
+		slog.Error("Failed to prune password tokens", "error", err)
+	}
+
+	link := m.publicURL + passwordPagePath + "#token=" + token
+	until := expires.UTC().Format("Monday, January 2 at 15:04 MST")
+	msg := mail.Message{To: email}
+	if purpose == imsdb.DirectoryPasswordTokenPurposeInvite {
+		msg.Subject = "Your IMS account"
+		msg.Body = fmt.Sprintf("Hello %v,\n\n"+
+			"An account has been made for you in the Ranger Incident Management\n"+
+			"System (IMS). To start using it, choose your password here:\n\n"+
+			"%v\n\n"+
+			"This link works once, and only until %v.\n",
+			handle, link, until)
+	} else {
+		msg.Subject = "Reset your IMS password"
+		msg.Body = fmt.Sprintf("Hello %v,\n\n"+
+			"Someone, hopefully you, asked to reset the password for your account\n"+
+			"in the Ranger Incident Management System (IMS). To choose a new one,\n"+
+			"go here:\n\n"+
+			"%v\n\n"+
+			"This link works once, and only until %v. If you didn't ask for this,\n"+
+			"you can ignore this email, and your password will stay as it is.\n",
+			handle, link, until)
+	}
+	ctx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+	defer cancel()
+	if err = m.sender.Send(ctx, msg); err != nil {
+		return fmt.Errorf("[Send]: %w", err)
+	}
+	return nil
+}
+
+// InviteDirectoryPerson emails someone in the IMS-native directory a link to
+// choose their own password, so that an admin needn't set it for them.
+type InviteDirectoryPerson struct {
+	imsDBQ         *store.DBQ
+	userStore      *directory.UserStore
+	imsAdmins      []string
+	directoryIsIMS bool
+	mailer         *passwordMailer
+}
+
+func (action InviteDirectoryPerson) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.inviteDirectoryPerson(req)
+	if errHTTP != nil {
+		errHTTP.From("[inviteDirectoryPerson]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action InviteDirectoryPerson) inviteDirectoryPerson(req *http.Request) *herr.HTTPError {
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return errHTTP.From("[requireDirectoryAdmin]")
+	}
+	if action.mailer == nil {
+		return herr.New(http.StatusServiceUnavailable, "This server isn't configured to send mail", nil)
+	}
+	ctx := req.Context()
+	personID, err := conv.ParseInt64(req.PathValue("personId"))
+	if err != nil {
+		return herr.BadRequest("Invalid person ID", err).From("[ParseInt64]")
+	}
+	person, err := action.imsDBQ.DirectoryPersonByID(ctx, action.imsDBQ, personID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return herr.NotFound("Person not found", err)
+		}
+		return herr.InternalServerError("Failed to fetch person", err).From("[DirectoryPersonByID]")
+	}
+	if !person.Active {
+		return herr.BadRequest("Person is inactive", nil)
+	}
+	if !person.Email.Valid {
+		return herr.BadRequest("Person has no email address", nil)
+	}
+	err = action.mailer.send(ctx, person.ID, person.Handle, person.Email.String, imsdb.DirectoryPasswordTokenPurposeInvite)
+	if err != nil {
+		return herr.InternalServerError("Failed to send invitation", err).From("[send]")
+	}
+	return nil
+}
+
+// RequestPasswordReset emails someone in the IMS-native directory a link to
+// choose a new password, should they have forgotten theirs.
+type RequestPasswordReset struct {
+	userStore      *directory.UserStore
+	directoryIsIMS bool
+	mailer         *passwordMailer
+}
+
+type PasswordResetRequest struct {
+	// Identification is a handle or email, as for PostAuthRequest.
+	Identification string `json:"identification"`
+}
+
+func (action RequestPasswordReset) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.requestPasswordReset(req)
+	if errHTTP != nil {
+		errHTTP.From("[requestPasswordReset]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action RequestPasswordReset) requestPasswordReset(req *http.Request) *herr.HTTPError {
+	if !action.directoryIsIMS || action.mailer == nil {
+		return herr.New(http.StatusServiceUnavailable, "Password resets aren't available on this server", nil)
+	}
+	vals, errHTTP := readBodyAs[PasswordResetRequest](req)
+	if errHTTP != nil {
+		return errHTTP.From("[readBodyAs]")
+	}
+	users, err := action.userStore.GetAllUsers(req.Context())
+	if err != nil {
+		return herr.InternalServerError("Failed to fetch personnel", err).From("[GetAllUsers]")
+	}
+	// The response is the same whether or not anyone matched, and the email
+	// is sent in the background, so that this can't be used to find out who
+	// has an account.
+	person := matchUser(users, vals.Identification)
+	if person == nil || person.Email == "" {
+		slog.Info("Not sending a password reset to an unknown identification")
+		return nil
+	}
+	personID, ok := action.userStore.IMSPersonID(person.ID)
+	if !ok {
+		// e.g. a Clubhouse person in a composite directory, whose password
+		// isn't IMS's to reset.
+		slog.Info("Not sending a password reset to someone outside the IMS-native directory", "identification", person.Handle)
+		return nil
+	}
+	queued := action.mailer.background(func(ctx context.Context) {
+		action.sendReset(ctx, person, personID)
+	})
+	if !queued {
+		slog.Warn("Dropped a password reset, as the mail queue is full", "identification", person.Handle)
+	}
+	return nil
+}
+
+func (action RequestPasswordReset) sendReset(ctx context.Context, person *directory.User, personID int64) {
+	now := time.Now()
+	claimed, err := action.mailer.imsDBQ.DirectoryClaimPasswordReset(ctx, action.mailer.imsDBQ,
+		imsdb.DirectoryClaimPasswordResetParams{
+			Now:   conv.TimeToNullFloat(now),
+			ID:    personID,
+			Since: conv.TimeToNullFloat(now.Add(-passwordResetInterval)),
+		})
+	if err != nil {
+		slog.Error("Failed to claim a password reset", "identification", person.Handle, "error", err)
+		return
+	}
+	if claimed == 0 {
+		slog.Info("Not sending another password reset so soon", "identification", person.Handle)
+		return
+	}
+	err = action.mailer.send(ctx, personID, person.Handle, person.Email, imsdb.DirectoryPasswordTokenPurposeReset)
+	if err != nil {
+		slog.Error("Failed to send password reset", "identification", person.Handle, "error", err)
+		return
+	}
+	slog.Info("Sent password reset", "identification", person.Handle)
+}
+
+// SetPasswordWithToken sets someone's password, given a token from an
+// invitation or password reset email. It also logs them out everywhere, as
+// whoever knew their old password may have been the reason for the reset.
+type SetPasswordWithToken struct {
+	imsDBQ             *store.DBQ
+	userStore          *directory.UserStore
+	directoryIsIMS     bool
+	passwordHashParams *argon2id.Params
+	passwordPolicy     authn.PasswordPolicy
+}
+
+type PasswordTokenRequest struct {
+	Token string `json:"token"`
+	// #nosec G117 // Exported secret field
+	Password string `json:"password"`
+}
+
+func (action SetPasswordWithToken) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.setPasswordWithToken(req)
+	if errHTTP != nil {
+		errHTTP.From("[setPasswordWithToken]").WriteResponse(w)
+		return
+	}
+	action.userStore.Flush()
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action SetPasswordWithToken) setPasswordWithToken(req *http.Request) *herr.HTTPError {
+	if !action.directoryIsIMS {
+		return herr.New(http.StatusServiceUnavailable, "Setting passwords isn't available on this server", nil)
+	}
+	ctx := req.Context()
+	vals, errHTTP := readBodyAs[PasswordTokenRequest](req)
+	if errHTTP != nil {
+		return errHTTP.From("[readBodyAs]")
+	}
+
+	const invalidLink = "This link is invalid, has expired, or has already been used"
+	token, err := action.imsDBQ.DirectoryPasswordTokenByHash(ctx, action.imsDBQ, hashPasswordToken(vals.Token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return herr.BadRequest(invalidLink, err).SetExpectedError()
+		}
+		return herr.InternalServerError("Failed to fetch token", err).From("[DirectoryPasswordTokenByHash]")
+	}
+	now := time.Now()
+	if token.Used.Valid || !conv.FloatToTime(token.Expires).After(now) || !token.Active {
+		return herr.BadRequest(invalidLink, nil).SetExpectedError()
+	}
+	errHTTP = checkPassword(action.passwordPolicy, vals.Password, token.Handle, token.Email.String)
+	if errHTTP != nil {
+		return errHTTP.From("[checkPassword]")
+	}
+
+	hashed := authn.Hash(vals.Password, action.passwordHashParams)
+	txn, err := action.imsDBQ.Begin()
+	if err != nil {
+		return herr.InternalServerError("Failed to begin transaction", err).From("[Begin]")
+	}
+	defer rollback(txn)
+	// This only succeeds for one of any concurrent uses of the token.
+	used, err := action.imsDBQ.DirectoryUsePasswordToken(ctx, txn, imsdb.DirectoryUsePasswordTokenParams{
+		Used: conv.TimeToNullFloat(now),
+		ID:   token.ID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to use token", err).From("[DirectoryUsePasswordToken]")
+	}
+	if used == 0 {
+		return herr.BadRequest(invalidLink, nil).SetExpectedError()
+	}
+	err = action.imsDBQ.DirectorySetPersonPassword(ctx, txn, imsdb.DirectorySetPersonPasswordParams{
+		Password:       hashed,
+		PasswordPolicy: sql.NullString{String: action.passwordPolicy.String(), Valid: true},
+		ID:             token.PersonID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to set password", err).From("[DirectorySetPersonPassword]")
+	}
+	err = action.imsDBQ.DirectoryUsePersonPasswordTokens(ctx, txn, imsdb.DirectoryUsePersonPasswordTokensParams{
+		Used:     conv.TimeToNullFloat(now),
+		PersonID: token.PersonID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to use tokens", err).From("[DirectoryUsePersonPasswordTokens]")
+	}
+	if err = txn.Commit(); err != nil {
+		return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	slog.Info("Password set with an emailed token", "identification", token.Handle, "purpose", token.Purpose)
+
+	errHTTP = revokeUserSessions(ctx, action.imsDBQ, action.userStore.UserID(token.PersonID))
+	if errHTTP != nil {
+		return errHTTP.From("[revokeUserSessions]")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordMailerBackground(t *testing.T) {
+	t.Parallel()
+	m := &passwordMailer{queue: make(chan func(context.Context), 1)}
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	require.True(t, m.background(func(context.Context) {
+		close(started)
+		<-unblock
+	}))
+	<-started
+
+	// The worker is busy, so one more job fits in the queue, and the next
+	// is dropped.
+	ran := make(chan struct{})
+	require.True(t, m.background(func(context.Context) { close(ran) }))
+	require.False(t, m.background(func(context.Context) { t.Error("dropped job ran") }))
+
+	close(unblock)
+	<-ran
+}
@@ -43,7 +43,10 @@ type rangerRoster struct {
 	attach         func(ctx context.Context, dbtx imsdb.DBTX, eventID, number int32, rangerHandle string, role sql.NullString) error
 	currentRole    func(ctx context.Context, dbtx imsdb.DBTX, eventID, number int32, rangerHandle string) (sql.NullString, bool, error)
 	addReportEntry func(ctx context.Context, dbtx imsdb.DBTX, eventID, number int32, entry newReportEntry) (int32, *herr.HTTPError)
-	notifyUpdate   func(eventID, number int32)
+	notifyUpdate   func(eventID, number int32, triggers ...webhookTrigger)
+	changes        func(eventID, number int32) changes
+	// checkConfidential is checkConfidentialIncident or checkConfidentialVisit.
+	checkConfidential func(req *http.Request, eventID, number int32, eventPermissions authz.EventPermissionMask) *herr.HTTPError
 }
 
 func incidentRangerRoster(imsDBQ *store.DBQ, es *EventSourcerer) rangerRoster {
@@ -86,6 +89,12 @@ func incidentRangerRoster(imsDBQ *store.DBQ, es *EventSourcerer) rangerRoster {
 			return addIncidentReportEntry(ctx, imsDBQ, dbtx, eventID, number, entry)
 		},
 		notifyUpdate: es.notifyIncidentUpdate,
+		changes: func(eventID, number int32) changes {
+			return changes{eventID: eventID, incidents: []int32{number}}
+		},
+		checkConfidential: func(req *http.Request, eventID, number int32, eventPermissions authz.EventPermissionMask) *herr.HTTPError {
+			return checkConfidentialIncident(req, imsDBQ, eventID, sql.NullInt32{Int32: number, Valid: true}, eventPermissions)
+		},
 	}
 }
 
@@ -129,6 +138,12 @@ func visitRangerRoster(imsDBQ *store.DBQ, es *EventSourcerer) rangerRoster {
 			return addVisitReportEntry(ctx, imsDBQ, dbtx, eventID, number, entry)
 		},
 		notifyUpdate: es.notifyVisitUpdate,
+		changes: func(eventID, number int32) changes {
+			return changes{eventID: eventID, visits: []int32{number}}
+		},
+		checkConfidential: func(req *http.Request, eventID, number int32, eventPermissions authz.EventPermissionMask) *herr.HTTPError {
+			return checkConfidentialVisit(req, imsDBQ, eventID, number, eventPermissions)
+		},
 	}
 }
 
@@ -164,6 +179,10 @@ func parseRangerRosterRequest(
 	if rangerName == "" {
 		return empty, herr.BadRequest("Empty Ranger Name", nil)
 	}
+	errHTTP = roster.checkConfidential(req, event.ID, number, eventPermissions)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[checkConfidential]")
+	}
 
 	return rangerRosterRequest{
 		event:      event,
@@ -253,6 +272,10 @@ func attachRanger(
 		if errHTTP != nil {
 			return errHTTP.From("[addReportEntry]")
 		}
+		errHTTP = recordChanges(ctx, imsDBQ, txn, roster.changes(rosterReq.event.ID, rosterReq.number))
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
 		err = txn.Commit()
 		if err != nil {
 			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
@@ -303,6 +326,11 @@ func detachRanger(
 			return errHTTP.From("[addReportEntry]")
 		}
 
+		errHTTP = recordChanges(ctx, imsDBQ, txn, roster.changes(rosterReq.event.ID, rosterReq.number))
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
+
 		err = txn.Commit()
 		if err != nil {
 			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
@@ -18,6 +18,7 @@ package api
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strings"
@@ -198,6 +199,10 @@ func (action EditFieldReportReportEntry) editFieldReportEntry(req *http.Request)
 	if err != nil {
 		return herr.BadRequest("Failed to parse fieldReportNumber", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialFieldReport(req, action.imsDBQ, event.ID, fieldReportNumber, eventPermissions)
+	if errHTTP != nil {
+		return errHTTP.From("[checkConfidentialFieldReport]")
+	}
 	reportEntryId, err := conv.ParseInt32(req.PathValue("reportEntryId"))
 	if err != nil {
 		return herr.BadRequest("Failed to parse reportEntryId", err).From("[ParseInt32]")
@@ -253,6 +258,10 @@ func (action EditFieldReportReportEntry) editFieldReportEntry(req *http.Request)
 		if errHTTP != nil {
 			return errHTTP.From("[addFRReportEntry]")
 		}
+		errHTTP = recordChanges(ctx, action.imsDBQ, txn, changes{eventID: event.ID, fieldReports: []int32{fieldReportNumber}})
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
 		err = txn.Commit()
 		if err != nil {
 			return herr.InternalServerError("Error committing transaction", err).From("[Commit]")
@@ -300,6 +309,10 @@ func (action EditIncidentReportEntry) editIncidentReportEntry(req *http.Request)
 	if err != nil {
 		return herr.BadRequest("Failed to parse incidentNumber", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, sql.NullInt32{Int32: incidentNumber, Valid: true}, eventPermissions)
+	if errHTTP != nil {
+		return errHTTP.From("[checkConfidentialIncident]")
+	}
 	reportEntryId, err := conv.ParseInt32(req.PathValue("reportEntryId"))
 	if err != nil {
 		return herr.BadRequest("Failed to parse reportEntryId", err).From("[ParseInt32]")
@@ -345,6 +358,10 @@ func (action EditIncidentReportEntry) editIncidentReportEntry(req *http.Request)
 		if errHTTP != nil {
 			return errHTTP.From("[addIncidentReportEntry]")
 		}
+		errHTTP = recordChanges(ctx, action.imsDBQ, txn, changes{eventID: event.ID, incidents: []int32{incidentNumber}})
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
 		err = txn.Commit()
 		if err != nil {
 			return herr.InternalServerError("Error committing transaction", err).From("[Commit]")
@@ -391,6 +408,10 @@ func (action EditVisitReportEntry) editVisitReportEntry(req *http.Request) *herr
 	if err != nil {
 		return herr.BadRequest("Failed to parse visitNumber", err).From("[ParseInt32]")
 	}
+	errHTTP = checkConfidentialVisit(req, action.imsDBQ, event.ID, visitNumber, eventPermissions)
+	if errHTTP != nil {
+		return errHTTP.From("[checkConfidentialVisit]")
+	}
 	reportEntryId, err := conv.ParseInt32(req.PathValue("reportEntryId"))
 	if err != nil {
 		return herr.BadRequest("Failed to parse reportEntryId", err).From("[ParseInt32]")
@@ -444,6 +465,10 @@ func (action EditVisitReportEntry) editVisitReportEntry(req *http.Request) *herr
 		if errHTTP != nil {
 			return errHTTP.From("[addVisitReportEntry]")
 		}
+		errHTTP = recordChanges(ctx, action.imsDBQ, txn, changes{eventID: event.ID, visits: []int32{visitNumber}})
+		if errHTTP != nil {
+			return errHTTP.From("[recordChanges]")
+		}
 		err = txn.Commit()
 		if err != nil {
 			return herr.InternalServerError("Error committing transaction", err).From("[Commit]")
@@ -136,7 +136,7 @@ func (action GetSearch) getSearch(req *http.Request) (imsjson.SearchResults, *he
 	if err != nil {
 		return resp, herr.InternalServerError("Failed to fetch Events", err).From("[Events]")
 	}
-	var incidentEventIDs, fieldReportEventIDs, visitEventIDs []int32
+	var incidentEventIDs, fieldReportEventIDs, visitEventIDs, confidentialEventIDs []int32
 	for _, e := range events {
 		if e.Event.IsGroup {
 			continue
@@ -155,6 +155,9 @@ func (action GetSearch) getSearch(req *http.Request) (imsjson.SearchResults, *he
 		if perms&authz.EventReadVisits != 0 {
 			visitEventIDs = append(visitEventIDs, e.Event.ID)
 		}
+		if canReadConfidential(perms) {
+			confidentialEventIDs = append(confidentialEventIDs, e.Event.ID)
+		}
 	}
 
 	// The search queries scan every readable event's records, and regexp
@@ -207,16 +210,20 @@ func (action GetSearch) getSearch(req *http.Request) (imsjson.SearchResults, *he
 	if searchIncidents && len(incidentEventIDs) > 0 {
 		started := time.Now()
 		rows, err := action.imsDBQ.SearchIncidents(ctx, action.imsDBQ, imsdb.SearchIncidentsParams{
-			TextLike:   textLike,
-			TextRegexp: textRegexp,
-			EventIds:   incidentEventIDs,
-			Limit:      limit,
+			TextLike:             textLike,
+			TextRegexp:           textRegexp,
+			EventIds:             incidentEventIDs,
+			ConfidentialEventIds: confidentialEventIDs,
+			Limit:                limit,
 		})
 		incidentStat = searchQueryStat{ran: true, elapsed: time.Since(started), rows: len(rows), err: err}
 		if err != nil {
 			return resp, searchQueryError(ctx, "Incidents", err).From("[SearchIncidents]")
 		}
 		for _, row := range rows {
+			if row.Confidential {
+				noteConfidentialAccess(req)
+			}
 			resp.Hits = append(resp.Hits, imsjson.SearchResult{
 				Kind:    imsjson.SearchResultKindIncident,
 				Event:   row.EventName,
@@ -233,16 +240,20 @@ func (action GetSearch) getSearch(req *http.Request) (imsjson.SearchResults, *he
 	if searchFieldReports && len(fieldReportEventIDs) > 0 {
 		started := time.Now()
 		rows, err := action.imsDBQ.SearchFieldReports(ctx, action.imsDBQ, imsdb.SearchFieldReportsParams{
-			TextLike:   textLike,
-			TextRegexp: textRegexp,
-			EventIds:   fieldReportEventIDs,
-			Limit:      limit,
+			TextLike:             textLike,
+			TextRegexp:           textRegexp,
+			EventIds:             fieldReportEventIDs,
+			ConfidentialEventIds: confidentialEventIDs,
+			Limit:                limit,
 		})
 		fieldReportStat = searchQueryStat{ran: true, elapsed: time.Since(started), rows: len(rows), err: err}
 		if err != nil {
 			return resp, searchQueryError(ctx, "Field Reports", err).From("[SearchFieldReports]")
 		}
 		for _, row := range rows {
+			if row.IncidentConfidential {
+				noteConfidentialAccess(req)
+			}
 			resp.Hits = append(resp.Hits, imsjson.SearchResult{
 				Kind:     imsjson.SearchResultKindFieldReport,
 				Event:    row.EventName,
@@ -260,16 +271,20 @@ func (action GetSearch) getSearch(req *http.Request) (imsjson.SearchResults, *he
 	if searchVisits && len(visitEventIDs) > 0 {
 		started := time.Now()
 		rows, err := action.imsDBQ.SearchVisits(ctx, action.imsDBQ, imsdb.SearchVisitsParams{
-			TextLike:   textLike,
-			TextRegexp: textRegexp,
-			EventIds:   visitEventIDs,
-			Limit:      limit,
+			TextLike:             textLike,
+			TextRegexp:           textRegexp,
+			EventIds:             visitEventIDs,
+			ConfidentialEventIds: confidentialEventIDs,
+			Limit:                limit,
 		})
 		visitStat = searchQueryStat{ran: true, elapsed: time.Since(started), rows: len(rows), err: err}
 		if err != nil {
 			return resp, searchQueryError(ctx, "Visits", err).From("[SearchVisits]")
 		}
 		for _, row := range rows {
+			if row.IncidentConfidential {
+				noteConfidentialAccess(req)
+			}
 			summary := row.GuestPreferredName.String
 			if summary == "" {
 				summary = row.GuestLegalName.String
@@ -0,0 +1,467 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// sessionRotationGrace is how long a session's previous refresh token
+	// still works after it's been replaced. Several tabs of one browser share
+	// a refresh cookie, and may all refresh at once. Only the first gets to
+	// replace the token; the others are let through, without replacing it
+	// again. Outside of this window, use of a replaced token is taken to mean
+	// that it was stolen, and the session is revoked.
+	sessionRotationGrace = time.Minute
+
+	// sessionRetention is how long sessions are kept around after they've
+	// expired.
+	sessionRetention = 30 * 24 * time.Hour
+
+	maxSessionUserAgentLen     = 512
+	maxSessionClientAddressLen = 128
+)
+
+// startSession records a new session for someone who's just logged in, and
+// gives the cookie holding its refresh token.
+func startSession(
+	req *http.Request,
+	imsDBQ *store.DBQ,
+	jwter authz.JWTer,
+	user *directory.User,
+	lifetime time.Duration,
+) (*http.Cookie, *herr.HTTPError) {
+	ctx := req.Context()
+	now := time.Now()
+	expires := now.Add(lifetime)
+	refreshToken, err := jwter.CreateRefreshToken(user.Handle, user.ID, expires)
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to create refresh token", err).From("[CreateRefreshToken]")
+	}
+	userAgent := req.UserAgent()
+	remoteAddr := clientAddress(req)
+	_, err = imsDBQ.CreateSession(ctx, imsDBQ, imsdb.CreateSessionParams{
+		UserID:        user.ID,
+		UserHandle:    user.Handle,
+		TokenHash:     authz.HashRefreshToken(refreshToken),
+		UserAgent:     conv.StringToSql(conv.EmptyToNil(userAgent), maxSessionUserAgentLen),
+		ClientAddress: conv.StringToSql(conv.EmptyToNil(remoteAddr), maxSessionClientAddressLen),
+		Created:       conv.TimeToFloat(now),
+		LastUsed:      conv.TimeToFloat(now),
+		Expires:       conv.TimeToFloat(expires),
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to create session", err).From("[CreateSession]")
+	}
+	// Logins are as good a time as any to clear out long-dead sessions.
+	err = imsDBQ.PruneSessions(ctx, imsDBQ, conv.TimeToFloat(now.Add(-sessionRetention)))
+	if err != nil {
+		slog.Error("Failed to prune sessions", "error", err)
+	}
+	return refreshTokenCookie(refreshToken, expires, now), nil
+}
+
+// continueSession checks the refresh token against its session, and replaces
+// the token with a new one. It gives the cookie holding the new token, which
+// is nil if the token shouldn't be replaced this time (see
+// sessionRotationGrace).
+func continueSession(
+	ctx context.Context,
+	imsDBQ *store.DBQ,
+	jwter authz.JWTer,
+	refreshToken string,
+	claims *authz.IMSClaims,
+) (*http.Cookie, *herr.HTTPError) {
+	tokenHash := authz.HashRefreshToken(refreshToken)
+	session, err := imsDBQ.SessionByTokenHash(ctx, imsDBQ, imsdb.SessionByTokenHashParams{
+		TokenHash:         tokenHash,
+		PreviousTokenHash: sql.NullString{String: tokenHash, Valid: true},
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, herr.Unauthorized("Session not found", err).From("[SessionByTokenHash]")
+		}
+		return nil, herr.InternalServerError("Failed to fetch session", err).From("[SessionByTokenHash]")
+	}
+	now := time.Now()
+	if session.Revoked.Valid {
+		return nil, herr.Unauthorized("Session has been revoked", nil).SetExpectedError()
+	}
+	if !conv.FloatToTime(session.Expires).After(now) {
+		return nil, herr.Unauthorized("Session has expired", nil).SetExpectedError()
+	}
+	if session.UserID != claims.DirectoryID() {
+		return nil, herr.Unauthorized("Session belongs to someone else", nil)
+	}
+
+	if session.TokenHash != tokenHash {
+		// This token has already been replaced.
+		if session.Rotated.Valid && now.Sub(conv.FloatToTime(session.Rotated.Float64)) <= sessionRotationGrace {
+			touchSession(ctx, imsDBQ, session.ID, now)
+			return nil, nil
+		}
+		slog.Warn("A replaced refresh token was used again, so revoking its session",
+			"session", session.ID, "ranger", session.UserHandle)
+		_, err = imsDBQ.RevokeSession(ctx, imsDBQ, imsdb.RevokeSessionParams{
+			Revoked: conv.TimeToNullFloat(now),
+			ID:      session.ID,
+		})
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to revoke session", err).From("[RevokeSession]")
+		}
+		return nil, herr.Unauthorized("Refresh token has already been used", nil)
+	}
+
+	expires := conv.FloatToTime(session.Expires)
+	newToken, err := jwter.CreateRefreshToken(session.UserHandle, session.UserID, expires)
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to create refresh token", err).From("[CreateRefreshToken]")
+	}
+	rows, err := imsDBQ.RotateSession(ctx, imsDBQ, imsdb.RotateSessionParams{
+		NewTokenHash: authz.HashRefreshToken(newToken),
+		Rotated:      conv.TimeToNullFloat(now),
+		LastUsed:     conv.TimeToFloat(now),
+		ID:           session.ID,
+		OldTokenHash: tokenHash,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to rotate session", err).From("[RotateSession]")
+	}
+	if rows == 0 {
+		// Another request replaced this same token just now.
+		return nil, nil
+	}
+	return refreshTokenCookie(newToken, expires, now), nil
+}
+
+func touchSession(ctx context.Context, imsDBQ *store.DBQ, sessionID int64, now time.Time) {
+	err := imsDBQ.TouchSession(ctx, imsDBQ, imsdb.TouchSessionParams{
+		LastUsed: conv.TimeToFloat(now),
+		ID:       sessionID,
+	})
+	if err != nil {
+		slog.Error("Failed to record session use", "session", sessionID, "error", err)
+	}
+}
+
+func refreshTokenCookie(refreshToken string, expires, now time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     authz.RefreshTokenCookieName,
+		Value:    refreshToken,
+		Path:     "/",
+		MaxAge:   int(expires.Sub(now).Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// We only ever read this cookie on POSTs to the refresh endpoint,
+		// so strict is fine.
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// currentSessionID gives the ID of the session whose refresh cookie came with
+// the request, or 0 if there's no such session.
+func currentSessionID(req *http.Request, imsDBQ *store.DBQ) int64 {
+	refreshCookie, err := req.Cookie(authz.RefreshTokenCookieName)
+	if err != nil {
+		return 0
+	}
+	tokenHash := authz.HashRefreshToken(refreshCookie.Value)
+	session, err := imsDBQ.SessionByTokenHash(req.Context(), imsDBQ, imsdb.SessionByTokenHashParams{
+		TokenHash:         tokenHash,
+		PreviousTokenHash: sql.NullString{String: tokenHash, Valid: true},
+	})
+	if err != nil {
+		return 0
+	}
+	return session.ID
+}
+
+// EndSession revokes the session whose refresh cookie came with the request,
+// if there is one. It's for the logout page, which then clears the cookie.
+func EndSession(imsDBQ *store.DBQ) func(req *http.Request) {
+	return func(req *http.Request) {
+		sessionID := currentSessionID(req, imsDBQ)
+		if sessionID == 0 {
+			return
+		}
+		_, err := imsDBQ.RevokeSession(req.Context(), imsDBQ, imsdb.RevokeSessionParams{
+			Revoked: conv.TimeToNullFloat(time.Now()),
+			ID:      sessionID,
+		})
+		if err != nil {
+			slog.Error("Failed to revoke session on logout", "session", sessionID, "error", err)
+		}
+	}
+}
+
+func revokeUserSessions(ctx context.Context, imsDBQ *store.DBQ, userID int64) *herr.HTTPError {
+	err := imsDBQ.RevokeUserSessions(ctx, imsDBQ, imsdb.RevokeUserSessionsParams{
+		Revoked: conv.TimeToNullFloat(time.Now()),
+		UserID:  userID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to revoke sessions", err).From("[RevokeUserSessions]")
+	}
+	return nil
+}
+
+func activeSessions(req *http.Request, imsDBQ *store.DBQ, userID sql.NullInt64) (imsjson.Sessions, *herr.HTTPError) {
+	rows, err := imsDBQ.ActiveSessions(req.Context(), imsDBQ, imsdb.ActiveSessionsParams{
+		UserID: userID,
+		Now:    conv.TimeToFloat(time.Now()),
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch sessions", err).From("[ActiveSessions]")
+	}
+	currentID := currentSessionID(req, imsDBQ)
+	resp := make(imsjson.Sessions, 0, len(rows))
+	for _, s := range rows {
+		resp = append(resp, imsjson.Session{
+			ID:            s.ID,
+			UserID:        s.UserID,
+			UserHandle:    s.UserHandle,
+			UserAgent:     s.UserAgent.String,
+			ClientAddress: s.ClientAddress.String,
+			Created:       conv.FloatToTime(s.Created),
+			LastUsed:      conv.FloatToTime(s.LastUsed),
+			Expires:       conv.FloatToTime(s.Expires),
+			Current:       s.ID == currentID,
+		})
+	}
+	return resp, nil
+}
+
+// sessionOwner gives the directory ID of the person making the request. API
+// tokens don't have sessions.
+func sessionOwner(req *http.Request) (int64, *herr.HTTPError) {
+	jwtCtx, errHTTP := getJwtCtx(req)
+	if errHTTP != nil {
+		return 0, errHTTP.From("[getJwtCtx]")
+	}
+	if jwtCtx.Claims.APIToken() != nil {
+		return 0, herr.Forbidden("API tokens don't have sessions", nil)
+	}
+	return jwtCtx.Claims.DirectoryID(), nil
+}
+
+// requireAccountAdmin checks that the requestor may manage anyone's logins,
+// i.e. their sessions and login lockouts.
+func requireAccountAdmin(req *http.Request, imsDBQ *store.DBQ, userStore *directory.UserStore, imsAdmins []string) *herr.HTTPError {
+	_, globalPermissions, errHTTP := getGlobalPermissions(req, imsDBQ, userStore, imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[getGlobalPermissions]")
+	}
+	if globalPermissions&authz.GlobalAdministrateDirectory == 0 {
+		return herr.Forbidden("The requestor does not have GlobalAdministrateDirectory permission", nil)
+	}
+	return nil
+}
+
+// GetOwnSessions lists the requestor's own active sessions.
+type GetOwnSessions struct {
+	imsDBQ *store.DBQ
+}
+
+func (action GetOwnSessions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getOwnSessions(req)
+	if errHTTP != nil {
+		errHTTP.From("[getOwnSessions]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetOwnSessions) getOwnSessions(req *http.Request) (imsjson.Sessions, *herr.HTTPError) {
+	userID, errHTTP := sessionOwner(req)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[sessionOwner]")
+	}
+	return activeSessions(req, action.imsDBQ, sql.NullInt64{Int64: userID, Valid: true})
+}
+
+// RevokeOwnSessions logs the requestor out everywhere, including from the
+// session the request came from.
+type RevokeOwnSessions struct {
+	imsDBQ *store.DBQ
+}
+
+func (action RevokeOwnSessions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.revokeOwnSessions(req)
+	if errHTTP != nil {
+		errHTTP.From("[revokeOwnSessions]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action RevokeOwnSessions) revokeOwnSessions(req *http.Request) *herr.HTTPError {
+	userID, errHTTP := sessionOwner(req)
+	if errHTTP != nil {
+		return errHTTP.From("[sessionOwner]")
+	}
+	return revokeUserSessions(req.Context(), action.imsDBQ, userID)
+}
+
+// RevokeOwnSession logs the requestor out of one of their sessions.
+type RevokeOwnSession struct {
+	imsDBQ *store.DBQ
+}
+
+func (action RevokeOwnSession) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.revokeOwnSession(req)
+	if errHTTP != nil {
+		errHTTP.From("[revokeOwnSession]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action RevokeOwnSession) revokeOwnSession(req *http.Request) *herr.HTTPError {
+	userID, errHTTP := sessionOwner(req)
+	if errHTTP != nil {
+		return errHTTP.From("[sessionOwner]")
+	}
+	sessionID, err := conv.ParseInt64(req.PathValue("sessionId"))
+	if err != nil {
+		return herr.BadRequest("Invalid session ID", err).From("[ParseInt64]")
+	}
+	rows, err := action.imsDBQ.RevokeUserSession(req.Context(), action.imsDBQ, imsdb.RevokeUserSessionParams{
+		Revoked: conv.TimeToNullFloat(time.Now()),
+		ID:      sessionID,
+		UserID:  userID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to revoke session", err).From("[RevokeUserSession]")
+	}
+	if rows == 0 {
+		return herr.NotFound("No such active session", nil)
+	}
+	return nil
+}
+
+// GetSessions lists everyone's active sessions, or just those of the person
+// in the optional "user_id" query parameter.
+type GetSessions struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetSessions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getSessions(req)
+	if errHTTP != nil {
+		errHTTP.From("[getSessions]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetSessions) getSessions(req *http.Request) (imsjson.Sessions, *herr.HTTPError) {
+	errHTTP := requireAccountAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[requireAccountAdmin]")
+	}
+	var userID sql.NullInt64
+	if userIDParam := req.FormValue("user_id"); userIDParam != "" {
+		id, err := conv.ParseInt64(userIDParam)
+		if err != nil {
+			return nil, herr.BadRequest("Invalid user_id", err).From("[ParseInt64]")
+		}
+		userID = sql.NullInt64{Int64: id, Valid: true}
+	}
+	return activeSessions(req, action.imsDBQ, userID)
+}
+
+// RevokeSession logs anyone out of one of their sessions.
+type RevokeSession struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action RevokeSession) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.revokeSession(req)
+	if errHTTP != nil {
+		errHTTP.From("[revokeSession]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action RevokeSession) revokeSession(req *http.Request) *herr.HTTPError {
+	errHTTP := requireAccountAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[requireAccountAdmin]")
+	}
+	sessionID, err := conv.ParseInt64(req.PathValue("sessionId"))
+	if err != nil {
+		return herr.BadRequest("Invalid session ID", err).From("[ParseInt64]")
+	}
+	rows, err := action.imsDBQ.RevokeSession(req.Context(), action.imsDBQ, imsdb.RevokeSessionParams{
+		Revoked: conv.TimeToNullFloat(time.Now()),
+		ID:      sessionID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to revoke session", err).From("[RevokeSession]")
+	}
+	if rows == 0 {
+		return herr.NotFound("No such active session", nil)
+	}
+	return nil
+}
+
+// RevokeUserSessions logs someone out everywhere.
+type RevokeUserSessions struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action RevokeUserSessions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.revokeUserSessions(req)
+	if errHTTP != nil {
+		errHTTP.From("[revokeUserSessions]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action RevokeUserSessions) revokeUserSessions(req *http.Request) *herr.HTTPError {
+	errHTTP := requireAccountAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[requireAccountAdmin]")
+	}
+	userID, err := conv.ParseInt64(req.PathValue("userId"))
+	if err != nil {
+		return herr.BadRequest("Invalid user ID", err).From("[ParseInt64]")
+	}
+	return revokeUserSessions(req.Context(), action.imsDBQ, userID)
+}
@@ -0,0 +1,674 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/lib/seal"
+	"github.com/burningmantech/ranger-ims-go/lib/totp"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// totpIssuer is the name that authenticator apps show alongside IMS codes.
+	totpIssuer = "Ranger IMS"
+
+	// recoveryCodeCount is how many recovery codes a person gets at a time.
+	recoveryCodeCount = 10
+
+	// The values for PostAuthResponse.SecondFactor.
+	secondFactorTOTP       = "totp"
+	secondFactorTOTPEnroll = "totp_enroll"
+)
+
+// totpAdditionalData binds a sealed TOTP secret to its person, so that it's no
+// good if copied to someone else's row.
+func totpAdditionalData(personID int64) []byte {
+	return []byte("DIRECTORY_PERSON.TOTP_SECRET " + conv.FormatInt(personID))
+}
+
+func openTOTPSecret(masterKey string, person imsdb.DirectoryPersonTOTPRow) ([]byte, *herr.HTTPError) {
+	if !person.TotpSecret.Valid {
+		return nil, herr.InternalServerError("No TOTP secret", nil)
+	}
+	secret, err := seal.Open(masterKey, []byte(person.TotpSecret.String), totpAdditionalData(person.ID))
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to decrypt TOTP secret. Get in touch with the tech team.", err).
+			From("[seal.Open]")
+	}
+	return secret, nil
+}
+
+func fetchPersonTOTP(ctx context.Context, imsDBQ *store.DBQ, personID int64) (imsdb.DirectoryPersonTOTPRow, *herr.HTTPError) {
+	person, err := imsDBQ.DirectoryPersonTOTP(ctx, imsDBQ, personID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return person, herr.NotFound("Person not found", err).From("[DirectoryPersonTOTP]")
+		}
+		return person, herr.InternalServerError("Failed to fetch TOTP enrollment", err).From("[DirectoryPersonTOTP]")
+	}
+	return person, nil
+}
+
+// startTOTPEnrollment gives the person a new TOTP secret. It isn't used until
+// they've confirmed that their authenticator app has it.
+func startTOTPEnrollment(
+	ctx context.Context, imsDBQ *store.DBQ, masterKey string, personID int64, handle string,
+) (*imsjson.TOTPEnrollment, *herr.HTTPError) {
+	secret := totp.NewSecret()
+	sealed, err := seal.Seal(masterKey, secret, totpAdditionalData(personID))
+	if err != nil {
+		return nil, herr.InternalServerError("TOTP isn't available. Get in touch with the tech team.", err).
+			From("[seal.Seal]")
+	}
+	err = imsDBQ.DirectoryStartPersonTOTP(ctx, imsDBQ, imsdb.DirectoryStartPersonTOTPParams{
+		TotpSecret: sql.NullString{String: string(sealed), Valid: true},
+		ID:         personID,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to start TOTP enrollment", err).From("[DirectoryStartPersonTOTP]")
+	}
+	return totpEnrollment(handle, secret), nil
+}
+
+func totpEnrollment(handle string, secret []byte) *imsjson.TOTPEnrollment {
+	return &imsjson.TOTPEnrollment{
+		Secret: totp.EncodeSecret(secret),
+		URI:    totp.URI(totpIssuer, handle, secret),
+	}
+}
+
+// confirmTOTPEnrollment checks a code against the person's new TOTP secret. If
+// it's right, the secret comes into use, and the person gets their recovery
+// codes. A wrong code gives no recovery codes and no error.
+func confirmTOTPEnrollment(
+	ctx context.Context, imsDBQ *store.DBQ, masterKey string, person imsdb.DirectoryPersonTOTPRow, code string, now time.Time,
+) ([]string, *herr.HTTPError) {
+	if person.TotpConfirmed {
+		return nil, herr.Conflict("Already enrolled in TOTP", nil)
+	}
+	if !person.TotpSecret.Valid {
+		return nil, herr.BadRequest("TOTP enrollment hasn't been started", nil)
+	}
+	secret, errHTTP := openTOTPSecret(masterKey, person)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[openTOTPSecret]")
+	}
+	step, ok := totp.Validate(secret, code, now, -1)
+	if !ok {
+		return nil, nil
+	}
+	return retryOnDeadlock(func() ([]string, *herr.HTTPError) {
+		txn, err := imsDBQ.Begin()
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+		}
+		defer rollback(txn)
+		confirmed, err := imsDBQ.DirectoryConfirmPersonTOTP(ctx, txn, imsdb.DirectoryConfirmPersonTOTPParams{
+			Step: sql.NullInt64{Int64: step, Valid: true},
+			ID:   person.ID,
+		})
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to confirm TOTP enrollment", err).From("[DirectoryConfirmPersonTOTP]")
+		}
+		if confirmed == 0 {
+			return nil, herr.Conflict("TOTP enrollment changed in the meantime. Try again.", nil)
+		}
+		recoveryCodes, errHTTP := replaceRecoveryCodes(ctx, imsDBQ, txn, person.ID)
+		if errHTTP != nil {
+			return nil, errHTTP.From("[replaceRecoveryCodes]")
+		}
+		if err = txn.Commit(); err != nil {
+			return nil, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		}
+		return recoveryCodes, nil
+	})
+}
+
+// verifySecondFactor checks a TOTP code or recovery code for someone who's
+// enrolled in TOTP, and uses it up if it's right.
+func verifySecondFactor(
+	ctx context.Context, imsDBQ *store.DBQ, masterKey string, person imsdb.DirectoryPersonTOTPRow, code imsjson.TOTPCode, now time.Time,
+) (bool, *herr.HTTPError) {
+	if !person.TotpConfirmed {
+		return false, herr.BadRequest("Not enrolled in TOTP", nil)
+	}
+	switch {
+	case code.Code != "" && code.RecoveryCode != "":
+		return false, herr.BadRequest("Give either a TOTP code or a recovery code, not both", nil)
+	case code.Code != "":
+		secret, errHTTP := openTOTPSecret(masterKey, person)
+		if errHTTP != nil {
+			return false, errHTTP.From("[openTOTPSecret]")
+		}
+		lastStep := int64(-1)
+		if person.TotpLastStep.Valid {
+			lastStep = person.TotpLastStep.Int64
+		}
+		step, ok := totp.Validate(secret, code.Code, now, lastStep)
+		if !ok {
+			return false, nil
+		}
+		// Another request may have used this same code just now.
+		used, err := imsDBQ.DirectoryUsePersonTOTPStep(ctx, imsDBQ, imsdb.DirectoryUsePersonTOTPStepParams{
+			Step: sql.NullInt64{Int64: step, Valid: true},
+			ID:   person.ID,
+		})
+		if err != nil {
+			return false, herr.InternalServerError("Failed to use TOTP code", err).From("[DirectoryUsePersonTOTPStep]")
+		}
+		return used == 1, nil
+	case code.RecoveryCode != "":
+		used, err := imsDBQ.DirectoryUseRecoveryCode(ctx, imsDBQ, imsdb.DirectoryUseRecoveryCodeParams{
+			Used:     conv.TimeToNullFloat(now),
+			PersonID: person.ID,
+			CodeHash: hashRecoveryCode(code.RecoveryCode),
+		})
+		if err != nil {
+			return false, herr.InternalServerError("Failed to use recovery code", err).From("[DirectoryUseRecoveryCode]")
+		}
+		if used == 1 {
+			slog.Info("Recovery code used", "person", person.Handle)
+		}
+		return used == 1, nil
+	default:
+		return false, herr.BadRequest("A TOTP code or recovery code is required", nil)
+	}
+}
+
+// replaceRecoveryCodes gives the person a fresh set of recovery codes, and
+// gets rid of any old ones.
+func replaceRecoveryCodes(ctx context.Context, imsDBQ *store.DBQ, dbtx imsdb.DBTX, personID int64) ([]string, *herr.HTTPError) {
+	err := imsDBQ.DirectoryClearRecoveryCodes(ctx, dbtx, personID)
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to clear recovery codes", err).From("[DirectoryClearRecoveryCodes]")
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code := newRecoveryCode()
+		err = imsDBQ.DirectoryAddRecoveryCode(ctx, dbtx, imsdb.DirectoryAddRecoveryCodeParams{
+			PersonID: personID,
+			CodeHash: hashRecoveryCode(code),
+		})
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to add recovery code", err).From("[DirectoryAddRecoveryCode]")
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// newRecoveryCode makes a code like "abcde-fgh23", which has 50 random bits.
+func newRecoveryCode() string {
+	text := strings.ToLower(rand.Text())
+	return text[:5] + "-" + text[5:10]
+}
+
+// hashRecoveryCode gives the form of a recovery code that's stored. Recovery
+// codes are random enough that a plain SHA-256 is fine, as for API tokens.
+// Case, spaces, and dashes don't matter.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// secondFactorChallenge gives the response for someone who's given the right
+// password, but must still give a second factor. It's nil if they don't need
+// to give one.
+func (action PostAuth) secondFactorChallenge(
+	ctx context.Context, matchedPerson *directory.User, personID int64, now time.Time,
+) (*PostAuthResponse, *herr.HTTPError) {
+	person, errHTTP := fetchPersonTOTP(ctx, action.imsDBQ, personID)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[fetchPersonTOTP]")
+	}
+	if !person.TotpConfirmed && !person.TotpRequired {
+		return nil, nil
+	}
+	token, err := action.jwter.CreateSecondFactorToken(
+		matchedPerson.Handle, matchedPerson.ID, now.Add(authz.SecondFactorTokenLifetime),
+	)
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to create second factor token", err).From("[CreateSecondFactorToken]")
+	}
+	resp := &PostAuthResponse{
+		SecondFactor:      secondFactorTOTP,
+		SecondFactorToken: token,
+	}
+	if person.TotpConfirmed {
+		return resp, nil
+	}
+
+	// This person must enroll before they can log in. Any secret they were
+	// given on an earlier try is kept, in case their app already has it.
+	resp.SecondFactor = secondFactorTOTPEnroll
+	if person.TotpSecret.Valid {
+		secret, errHTTP := openTOTPSecret(action.masterKey, person)
+		if errHTTP == nil {
+			resp.TOTPEnrollment = totpEnrollment(matchedPerson.Handle, secret)
+			return resp, nil
+		}
+		slog.Error("Failed to reuse pending TOTP secret, so making a new one", "error", errHTTP)
+	}
+	resp.TOTPEnrollment, errHTTP = startTOTPEnrollment(ctx, action.imsDBQ, action.masterKey, person.ID, matchedPerson.Handle)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[startTOTPEnrollment]")
+	}
+	return resp, nil
+}
+
+// PostAuthSecondFactor is the second step of logging in, for someone who must
+// give a second factor. It takes the token that PostAuth gave for the right
+// password, along with a TOTP code or recovery code, and gives what PostAuth
+// would otherwise have given.
+type PostAuthSecondFactor struct {
+	postAuth PostAuth
+}
+
+type PostAuthSecondFactorRequest struct {
+	SecondFactorToken string `json:"second_factor_token"`
+	imsjson.TOTPCode
+}
+
+func (action PostAuthSecondFactor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, cookie, errHTTP := action.postAuthSecondFactor(req)
+	if errHTTP != nil {
+		if throttled, ok := errors.AsType[loginThrottledError](errHTTP); ok {
+			w.Header().Set("Retry-After", conv.FormatInt(int64(math.Ceil(throttled.retryAfter.Seconds()))))
+		}
+		errHTTP.From("[postAuthSecondFactor]").WriteResponse(w)
+		return
+	}
+	http.SetCookie(w, cookie)
+	mustWriteJSON(w, req, resp)
+}
+
+func (action PostAuthSecondFactor) postAuthSecondFactor(req *http.Request) (PostAuthResponse, *http.Cookie, *herr.HTTPError) {
+	var empty PostAuthResponse
+	ctx := req.Context()
+	if !action.postAuth.directoryIsIMS {
+		return empty, nil, herr.BadRequest("This deployment has no second factors", nil)
+	}
+	vals, errHTTP := readBodyAs[PostAuthSecondFactorRequest](req)
+	if errHTTP != nil {
+		return empty, nil, errHTTP.From("[readBodyAs]")
+	}
+	claims, err := action.postAuth.jwter.AuthenticateSecondFactorToken(vals.SecondFactorToken)
+	if err != nil {
+		return empty, nil, herr.Unauthorized("Login expired. Log in again.", err).From("[AuthenticateSecondFactorToken]")
+	}
+
+	rangers, err := action.postAuth.userStore.GetAllUsers(ctx)
+	if err != nil {
+		return empty, nil, herr.InternalServerError("Failed to fetch personnel", err).From("[GetRangers]")
+	}
+	var matchedPerson *directory.User
+	for _, ranger := range rangers {
+		if ranger.Handle == claims.RangerHandle() && ranger.ID == claims.DirectoryID() {
+			matchedPerson = ranger
+			break
+		}
+	}
+	if matchedPerson == nil {
+		return empty, nil, herr.Unauthorized("User not found", nil)
+	}
+
+	now := time.Now()
+	throttleSubject := loginThrottleSubject(matchedPerson.Handle, matchedPerson)
+	remoteAddr := action.postAuth.throttle.address(req)
+	errHTTP = action.postAuth.throttle.check(ctx, throttleSubject, remoteAddr, now)
+	if errHTTP != nil {
+		return empty, nil, errHTTP.From("[check]")
+	}
+
+	personID, ok := action.postAuth.userStore.IMSPersonID(matchedPerson.ID)
+	if !ok {
+		return empty, nil, herr.BadRequest("This person has no second factors", nil)
+	}
+	person, errHTTP := fetchPersonTOTP(ctx, action.postAuth.imsDBQ, personID)
+	if errHTTP != nil {
+		return empty, nil, errHTTP.From("[fetchPersonTOTP]")
+	}
+	var recoveryCodes []string
+	switch {
+	case person.TotpConfirmed:
+		ok, errHTTP = verifySecondFactor(ctx, action.postAuth.imsDBQ, action.postAuth.masterKey, person, vals.TOTPCode, now)
+		if errHTTP != nil {
+			return empty, nil, errHTTP.From("[verifySecondFactor]")
+		}
+	case person.TotpRequired:
+		recoveryCodes, errHTTP = confirmTOTPEnrollment(ctx, action.postAuth.imsDBQ, action.postAuth.masterKey, person, vals.Code, now)
+		if errHTTP != nil {
+			return empty, nil, errHTTP.From("[confirmTOTPEnrollment]")
+		}
+		ok = recoveryCodes != nil
+	default:
+		// An admin must have reset this person's TOTP since they gave their
+		// password, so that password is all they need now.
+		ok = true
+	}
+	if !ok {
+		// Wrong codes count as failed logins, so that codes can't be guessed
+		// any faster than passwords.
+		errHTTP = action.postAuth.throttle.recordFailure(
+			req, throttleSubject, remoteAddr, sql.NullInt64{Int64: matchedPerson.ID, Valid: true}, now,
+		)
+		if errHTTP != nil {
+			return empty, nil, errHTTP.From("[recordFailure]")
+		}
+		return empty, nil, herr.Unauthorized("Failed login attempt (bad second factor)", nil)
+	}
+
+	resp, cookie, errHTTP := action.postAuth.logIn(req, matchedPerson, throttleSubject, now)
+	if errHTTP != nil {
+		return empty, nil, errHTTP.From("[logIn]")
+	}
+	resp.RecoveryCodes = recoveryCodes
+	return resp, cookie, nil
+}
+
+// requireOwnTOTP checks that the requestor is someone in the IMS-native
+// directory, which is the only place that TOTP enrollments are kept, and
+// gives their enrollment.
+func requireOwnTOTP(req *http.Request, imsDBQ *store.DBQ, userStore *directory.UserStore) (imsdb.DirectoryPersonTOTPRow, *herr.HTTPError) {
+	var empty imsdb.DirectoryPersonTOTPRow
+	userID, errHTTP := sessionOwner(req)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[sessionOwner]")
+	}
+	personID, ok := userStore.IMSPersonID(userID)
+	if !ok {
+		return empty, herr.Forbidden("TOTP is only available with the IMS-native directory", nil)
+	}
+	person, errHTTP := fetchPersonTOTP(req.Context(), imsDBQ, personID)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[fetchPersonTOTP]")
+	}
+	return person, nil
+}
+
+// GetOwnTOTP gives the requestor's TOTP enrollment status.
+type GetOwnTOTP struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+}
+
+func (action GetOwnTOTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getOwnTOTP(req)
+	if errHTTP != nil {
+		errHTTP.From("[getOwnTOTP]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetOwnTOTP) getOwnTOTP(req *http.Request) (imsjson.TOTPStatus, *herr.HTTPError) {
+	var empty imsjson.TOTPStatus
+	person, errHTTP := requireOwnTOTP(req, action.imsDBQ, action.userStore)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[requireOwnTOTP]")
+	}
+	left, err := action.imsDBQ.DirectoryUnusedRecoveryCodes(req.Context(), action.imsDBQ, person.ID)
+	if err != nil {
+		return empty, herr.InternalServerError("Failed to count recovery codes", err).From("[DirectoryUnusedRecoveryCodes]")
+	}
+	return imsjson.TOTPStatus{
+		Enrolled:          person.TotpConfirmed,
+		Required:          person.TotpRequired,
+		RecoveryCodesLeft: left,
+	}, nil
+}
+
+// StartOwnTOTP begins the requestor's TOTP enrollment, which they then
+// finish with ConfirmOwnTOTP.
+type StartOwnTOTP struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	masterKey string
+}
+
+func (action StartOwnTOTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.startOwnTOTP(req)
+	if errHTTP != nil {
+		errHTTP.From("[startOwnTOTP]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action StartOwnTOTP) startOwnTOTP(req *http.Request) (*imsjson.TOTPEnrollment, *herr.HTTPError) {
+	person, errHTTP := requireOwnTOTP(req, action.imsDBQ, action.userStore)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[requireOwnTOTP]")
+	}
+	if person.TotpConfirmed {
+		return nil, herr.Conflict("Already enrolled in TOTP. Turn it off before enrolling again.", nil)
+	}
+	return startTOTPEnrollment(req.Context(), action.imsDBQ, action.masterKey, person.ID, person.Handle)
+}
+
+// ConfirmOwnTOTP finishes the requestor's TOTP enrollment, given a code from
+// their authenticator app, and gives their recovery codes.
+type ConfirmOwnTOTP struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	masterKey string
+}
+
+func (action ConfirmOwnTOTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.confirmOwnTOTP(req)
+	if errHTTP != nil {
+		errHTTP.From("[confirmOwnTOTP]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action ConfirmOwnTOTP) confirmOwnTOTP(req *http.Request) (imsjson.RecoveryCodes, *herr.HTTPError) {
+	var empty imsjson.RecoveryCodes
+	person, errHTTP := requireOwnTOTP(req, action.imsDBQ, action.userStore)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[requireOwnTOTP]")
+	}
+	code, errHTTP := readBodyAs[imsjson.TOTPCode](req)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[readBodyAs]")
+	}
+	recoveryCodes, errHTTP := confirmTOTPEnrollment(req.Context(), action.imsDBQ, action.masterKey, person, code.Code, time.Now())
+	if errHTTP != nil {
+		return empty, errHTTP.From("[confirmTOTPEnrollment]")
+	}
+	if recoveryCodes == nil {
+		return empty, herr.BadRequest("Wrong TOTP code. Check your authenticator app's clock, and try again.", nil)
+	}
+	slog.Info("Enrolled in TOTP", "person", person.Handle)
+	return imsjson.RecoveryCodes{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableOwnTOTP turns off TOTP for the requestor, given a current code or
+// recovery code. It's not allowed for someone who an admin requires to use
+// TOTP.
+type DisableOwnTOTP struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	masterKey string
+}
+
+func (action DisableOwnTOTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.disableOwnTOTP(req)
+	if errHTTP != nil {
+		errHTTP.From("[disableOwnTOTP]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action DisableOwnTOTP) disableOwnTOTP(req *http.Request) *herr.HTTPError {
+	ctx := req.Context()
+	person, errHTTP := requireOwnTOTP(req, action.imsDBQ, action.userStore)
+	if errHTTP != nil {
+		return errHTTP.From("[requireOwnTOTP]")
+	}
+	if person.TotpRequired {
+		return herr.Forbidden("An admin requires you to use TOTP", nil)
+	}
+	code, errHTTP := readBodyAs[imsjson.TOTPCode](req)
+	if errHTTP != nil {
+		return errHTTP.From("[readBodyAs]")
+	}
+	// Someone who started but never finished enrolling has nothing to prove.
+	if person.TotpConfirmed {
+		ok, errHTTP := verifySecondFactor(ctx, action.imsDBQ, action.masterKey, person, code, time.Now())
+		if errHTTP != nil {
+			return errHTTP.From("[verifySecondFactor]")
+		}
+		if !ok {
+			return herr.BadRequest("Wrong TOTP code or recovery code", nil)
+		}
+	}
+	errHTTP = resetTOTP(ctx, action.imsDBQ, person.ID)
+	if errHTTP != nil {
+		return errHTTP.From("[resetTOTP]")
+	}
+	slog.Info("Turned off TOTP", "person", person.Handle)
+	return nil
+}
+
+// ReplaceOwnRecoveryCodes gives the requestor a fresh set of recovery codes,
+// given a current code or recovery code.
+type ReplaceOwnRecoveryCodes struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	masterKey string
+}
+
+func (action ReplaceOwnRecoveryCodes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.replaceOwnRecoveryCodes(req)
+	if errHTTP != nil {
+		errHTTP.From("[replaceOwnRecoveryCodes]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action ReplaceOwnRecoveryCodes) replaceOwnRecoveryCodes(req *http.Request) (imsjson.RecoveryCodes, *herr.HTTPError) {
+	var empty imsjson.RecoveryCodes
+	ctx := req.Context()
+	person, errHTTP := requireOwnTOTP(req, action.imsDBQ, action.userStore)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[requireOwnTOTP]")
+	}
+	code, errHTTP := readBodyAs[imsjson.TOTPCode](req)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[readBodyAs]")
+	}
+	ok, errHTTP := verifySecondFactor(ctx, action.imsDBQ, action.masterKey, person, code, time.Now())
+	if errHTTP != nil {
+		return empty, errHTTP.From("[verifySecondFactor]")
+	}
+	if !ok {
+		return empty, herr.BadRequest("Wrong TOTP code or recovery code", nil)
+	}
+	recoveryCodes, errHTTP := replaceRecoveryCodes(ctx, action.imsDBQ, action.imsDBQ, person.ID)
+	if errHTTP != nil {
+		return empty, errHTTP.From("[replaceRecoveryCodes]")
+	}
+	return imsjson.RecoveryCodes{RecoveryCodes: recoveryCodes}, nil
+}
+
+// resetTOTP unenrolls a person from TOTP, and gets rid of their recovery codes.
+// If they're required to use TOTP, they'll enroll again the next time they
+// log in.
+func resetTOTP(ctx context.Context, imsDBQ *store.DBQ, personID int64) *herr.HTTPError {
+	return retryOnDeadlockErr(func() *herr.HTTPError {
+		txn, err := imsDBQ.Begin()
+		if err != nil {
+			return herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+		}
+		defer rollback(txn)
+		err = imsDBQ.DirectoryResetPersonTOTP(ctx, txn, personID)
+		if err != nil {
+			return herr.InternalServerError("Failed to reset TOTP", err).From("[DirectoryResetPersonTOTP]")
+		}
+		err = imsDBQ.DirectoryClearRecoveryCodes(ctx, txn, personID)
+		if err != nil {
+			return herr.InternalServerError("Failed to clear recovery codes", err).From("[DirectoryClearRecoveryCodes]")
+		}
+		if err = txn.Commit(); err != nil {
+			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		}
+		return nil
+	})
+}
+
+// ResetDirectoryPersonTOTP is for an admin to unenroll someone from TOTP, e.g.
+// when they've lost both their authenticator app and their recovery codes.
+type ResetDirectoryPersonTOTP struct {
+	imsDBQ         *store.DBQ
+	userStore      *directory.UserStore
+	imsAdmins      []string
+	directoryIsIMS bool
+}
+
+func (action ResetDirectoryPersonTOTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.resetDirectoryPersonTOTP(req)
+	if errHTTP != nil {
+		errHTTP.From("[resetDirectoryPersonTOTP]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action ResetDirectoryPersonTOTP) resetDirectoryPersonTOTP(req *http.Request) *herr.HTTPError {
+	errHTTP := requireDirectoryAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins, action.directoryIsIMS)
+	if errHTTP != nil {
+		return errHTTP.From("[requireDirectoryAdmin]")
+	}
+	personID, err := conv.ParseInt64(req.PathValue("personId"))
+	if err != nil {
+		return herr.BadRequest("Invalid person ID", err).From("[ParseInt64]")
+	}
+	person, errHTTP := fetchPersonTOTP(req.Context(), action.imsDBQ, personID)
+	if errHTTP != nil {
+		return errHTTP.From("[fetchPersonTOTP]")
+	}
+	errHTTP = resetTOTP(req.Context(), action.imsDBQ, person.ID)
+	if errHTTP != nil {
+		return errHTTP.From("[resetTOTP]")
+	}
+	slog.Info("Admin reset TOTP", "person", person.Handle)
+	return nil
+}
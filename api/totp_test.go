@@ -0,0 +1,47 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRecoveryCode(t *testing.T) {
+	t.Parallel()
+
+	seen := map[string]bool{}
+	for range 100 {
+		code := newRecoveryCode()
+		assert.Regexp(t, regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`), code)
+		assert.False(t, seen[code])
+		seen[code] = true
+	}
+}
+
+func TestHashRecoveryCodeIgnoresFormatting(t *testing.T) {
+	t.Parallel()
+
+	want := hashRecoveryCode("abcde-fgh23")
+	assert.Len(t, want, 64)
+	assert.Equal(t, want, hashRecoveryCode("abcdefgh23"))
+	assert.Equal(t, want, hashRecoveryCode("ABCDE FGH23"))
+	assert.Equal(t, want, hashRecoveryCode(" abcde - fgh23 "))
+	assert.NotEqual(t, want, hashRecoveryCode("abcde-fgh24"))
+}
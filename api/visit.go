@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -45,41 +46,112 @@ type GetVisits struct {
 }
 
 func (action GetVisits) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	resp, errHTTP := action.getVisits(req)
+	resp, nextCursor, errHTTP := action.getVisits(req)
 	if errHTTP != nil {
 		errHTTP.From("[getVisits]").WriteResponse(w)
 		return
 	}
+	if nextCursor != "" {
+		w.Header().Set(NextCursorHeader, nextCursor)
+	}
 	mustWriteJSON(w, req, resp)
 }
 
-func (action GetVisits) getVisits(req *http.Request) (imsjson.Visits, *herr.HTTPError) {
+func (action GetVisits) getVisits(req *http.Request) (imsjson.Visits, string, *herr.HTTPError) {
 	resp := make(imsjson.Visits, 0)
 	event, _, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
 	if errHTTP != nil {
-		return resp, errHTTP.From("[getEventPermissions]")
+		return resp, "", errHTTP.From("[getEventPermissions]")
 	}
 	if eventPermissions&authz.EventReadVisits == 0 {
-		return nil, herr.Forbidden("The requestor does not have EventReadVisits permission", nil)
+		return nil, "", herr.Forbidden("The requestor does not have EventReadVisits permission", nil)
 	}
 	err := req.ParseForm()
 	if err != nil {
-		return nil, herr.BadRequest("Failed to parse form", err)
+		return nil, "", herr.BadRequest("Failed to parse form", err)
 	}
 	includeSystemEntries := !strings.EqualFold(req.Form.Get("exclude_system_entries"), "true")
 
-	// The Visits and ReportEntries queries both request a lot of data, and we can query
-	// and process those results concurrently.
-	group, groupCtx := errgroup.WithContext(req.Context())
+	params, listQ, errHTTP := visitsParams(req.Form, event.ID)
+	if errHTTP != nil {
+		return nil, "", errHTTP.From("[visitsParams]")
+	}
+
+	params.IncludeConfidential = canReadConfidential(eventPermissions)
+
+	resp, errHTTP = fetchVisits(req.Context(), action.imsDBQ, event, params, includeSystemEntries, action.attachmentsEnabled)
+	if errHTTP != nil {
+		return resp, "", errHTTP.From("[fetchVisits]")
+	}
+	errHTTP = noteConfidentialAttached(req, action.imsDBQ, event.ID, visitIncidents(resp))
+	if errHTTP != nil {
+		return resp, "", errHTTP.From("[noteConfidentialAttached]")
+	}
+	if len(resp) == 0 {
+		return resp, "", nil
+	}
+	return resp, listQ.nextCursor(len(resp), resp[len(resp)-1].Number), nil
+}
+
+// visitsParams reads the GetVisits query parameters, which are those in
+// listQuery, plus "incident".
+func visitsParams(form url.Values, eventID int32) (imsdb.VisitsParams, listQuery, *herr.HTTPError) {
+	listQ, errHTTP := parseListQuery(form)
+	if errHTTP != nil {
+		return imsdb.VisitsParams{}, listQ, errHTTP.From("[parseListQuery]")
+	}
+	allIncidents, incidentNumber, errHTTP := parseIncidentFilter(form)
+	if errHTTP != nil {
+		return imsdb.VisitsParams{}, listQ, errHTTP.From("[parseIncidentFilter]")
+	}
+	return imsdb.VisitsParams{
+		Event:          eventID,
+		AllIncidents:   allIncidents,
+		IncidentNumber: incidentNumber,
+		CreatedAfter:   listQ.createdAfter,
+		CreatedBefore:  listQ.createdBefore,
+		ModifiedAfter:  listQ.modifiedAfter,
+		ModifiedBefore: listQ.modifiedBefore,
+		ChangedAfter:   beforeAllChanges,
+		AfterNumber:    listQ.afterNumber,
+		Limit:          listQ.limit,
+	}, listQ, nil
+}
+
+// fetchVisits returns the Visits that the Visits query finds for params, each
+// filled out as for GetVisits.
+func fetchVisits(ctx context.Context, imsDBQ *store.DBQ, event imsdb.Event, params imsdb.VisitsParams,
+	includeSystemEntries, attachmentsEnabled bool,
+) (imsjson.Visits, *herr.HTTPError) {
+	resp := make(imsjson.Visits, 0)
+
+	// The filtering and paging all happen in the Visits query. The other
+	// queries then need only fetch the rest of the Visits it found.
+	visitsRows, err := imsDBQ.Visits(ctx, imsDBQ, params)
+	if err != nil {
+		return resp, herr.InternalServerError("Failed to fetch Visits", err).From("[Visits]")
+	}
+	if len(visitsRows) == 0 {
+		return resp, nil
+	}
+	numbers := make([]int32, len(visitsRows))
+	for i, r := range visitsRows {
+		numbers[i] = r.Visit.Number
+	}
+
+	// The ReportEntries query requests a lot of data, and we can query and
+	// process those results concurrently with the rangers.
+	group, groupCtx := errgroup.WithContext(ctx)
 
 	entriesByVisit := make(map[int32][]imsdb.ReportEntry)
 	group.Go(func() error {
-		reportEntries, err := action.imsDBQ.Visits_ReportEntries(
+		reportEntries, err := imsDBQ.Visits_ReportEntries(
 			groupCtx,
-			action.imsDBQ,
+			imsDBQ,
 			imsdb.Visits_ReportEntriesParams{
-				Event:     event.ID,
-				Generated: includeSystemEntries,
+				Event:        event.ID,
+				Generated:    includeSystemEntries,
+				VisitNumbers: numbers,
 			},
 		)
 		if err != nil {
@@ -96,7 +168,10 @@ func (action GetVisits) getVisits(req *http.Request) (imsjson.Visits, *herr.HTTP
 
 	rangersByVisit := make(map[int32][]imsdb.VisitRanger)
 	group.Go(func() error {
-		rangersRows, err := action.imsDBQ.Visits_Rangers(groupCtx, action.imsDBQ, event.ID)
+		rangersRows, err := imsDBQ.Visits_Rangers(groupCtx, imsDBQ, imsdb.Visits_RangersParams{
+			Event:        event.ID,
+			VisitNumbers: numbers,
+		})
 		if err != nil {
 			return herr.InternalServerError("Failed to fetch rangers", err).From("[Visits_Rangers]")
 		}
@@ -105,16 +180,6 @@ func (action GetVisits) getVisits(req *http.Request) (imsjson.Visits, *herr.HTTP
 		}
 		return nil
 	})
-
-	var visitsRows []imsdb.VisitsRow
-	group.Go(func() error {
-		var err error
-		visitsRows, err = action.imsDBQ.Visits(groupCtx, action.imsDBQ, event.ID)
-		if err != nil {
-			return herr.InternalServerError("Failed to fetch Visits", err).From("[Visits]")
-		}
-		return nil
-	})
 	err = group.Wait()
 	if err != nil {
 		return resp, herr.AsHTTPError(err)
@@ -125,7 +190,7 @@ func (action GetVisits) getVisits(req *http.Request) (imsjson.Visits, *herr.HTTP
 		// query row structs currently have the same fields in the same order.
 		visitRow := imsdb.VisitRow(r)
 
-		visitJSON, errHTTP := visitToJSON(visitRow, rangersByVisit[r.Visit.Number], entriesByVisit[r.Visit.Number], event, action.attachmentsEnabled)
+		visitJSON, errHTTP := visitToJSON(visitRow, rangersByVisit[r.Visit.Number], entriesByVisit[r.Visit.Number], event, attachmentsEnabled)
 		if errHTTP != nil {
 			return resp, errHTTP.From("[visitToJSON]")
 		}
@@ -154,26 +219,59 @@ func (action GetVisit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (action GetVisit) getVisit(req *http.Request) (imsjson.Visit, *herr.HTTPError) {
 	var resp imsjson.Visit
 
-	event, _, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	event, jwt, eventPermissions, errHTTP := getEventPermissions(req, action.imsDBQ, action.userStore, action.imsAdmins)
 	if errHTTP != nil {
 		return resp, errHTTP.From("[getEventPermissions]")
 	}
-	if eventPermissions&authz.EventReadVisits == 0 {
-		return resp, herr.Forbidden("The requestor does not have EventReadVisits permission on this Event", nil)
-	}
 	ctx := req.Context()
 
 	visitNumber, err := conv.ParseInt32(req.PathValue("visitNumber"))
 	if err != nil {
 		return resp, herr.BadRequest("Failed to parse visit number", err)
 	}
+	if eventPermissions&authz.EventReadVisits == 0 {
+		brokeGlass, errHTTP := breakGlassActive(ctx, action.imsDBQ, event.ID, jwt.Claims.RangerHandle(), breakGlassVisit, visitNumber)
+		if errHTTP != nil {
+			return resp, errHTTP.From("[breakGlassActive]")
+		}
+		if !brokeGlass {
+			return resp, herr.Forbidden("The requestor does not have EventReadVisits permission on this Event", nil)
+		}
+	}
 
-	storedRow, reportEntries, errHTTP := fetchVisit(ctx, action.imsDBQ, event.ID, visitNumber)
+	resp, errHTTP = loadVisit(ctx, action.imsDBQ, event, visitNumber, action.attachmentsEnabled)
+	if errHTTP != nil {
+		return resp, errHTTP.From("[loadVisit]")
+	}
+	// Break-glass access doesn't extend to Visits on confidential Incidents.
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, incidentRef(resp.Incident), eventPermissions)
+	if errHTTP != nil {
+		return resp, errHTTP.From("[checkConfidentialIncident]")
+	}
+	return resp, nil
+}
+
+func visitIncidents(visits imsjson.Visits) []*int32 {
+	incidents := make([]*int32, len(visits))
+	for i, v := range visits {
+		incidents[i] = v.Incident
+	}
+	return incidents
+}
+
+// loadVisit builds the full JSON representation of a Visit, as it's served by
+// GetVisit and pushed over the EventSource.
+func loadVisit(ctx context.Context, imsDBQ *store.DBQ, event imsdb.Event, visitNumber int32, attachmentsEnabled bool) (
+	imsjson.Visit, *herr.HTTPError,
+) {
+	var resp imsjson.Visit
+
+	storedRow, reportEntries, errHTTP := fetchVisit(ctx, imsDBQ, event.ID, visitNumber)
 	if errHTTP != nil {
 		return resp, errHTTP.From("[fetchVisit]")
 	}
 
-	rangersRows, err := action.imsDBQ.Visit_Rangers(ctx, action.imsDBQ, imsdb.Visit_RangersParams{
+	rangersRows, err := imsDBQ.Visit_Rangers(ctx, imsDBQ, imsdb.Visit_RangersParams{
 		Event:       event.ID,
 		VisitNumber: visitNumber,
 	})
@@ -185,7 +283,7 @@ func (action GetVisit) getVisit(req *http.Request) (imsjson.Visit, *herr.HTTPErr
 		rangers[i] = row.VisitRanger
 	}
 
-	resp, errHTTP = visitToJSON(storedRow, rangers, reportEntries, event, action.attachmentsEnabled)
+	resp, errHTTP = visitToJSON(storedRow, rangers, reportEntries, event, attachmentsEnabled)
 	if errHTTP != nil {
 		return resp, errHTTP.From("[visitToJSON]")
 	}
@@ -320,6 +418,10 @@ func (action NewVisit) newVisit(req *http.Request) (visitNumber int32, location
 	if errHTTP != nil {
 		return 0, "", errHTTP.From("[readBodyAs]")
 	}
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, incidentRef(newVisit.Incident), eventPermissions)
+	if errHTTP != nil {
+		return 0, "", errHTTP.From("[checkConfidentialIncident]")
+	}
 
 	author := jwtCtx.Claims.RangerHandle()
 
@@ -352,7 +454,7 @@ func (action NewVisit) newVisit(req *http.Request) (visitNumber int32, location
 	newVisit.Event = event.Name
 	newVisit.Number = newVisitNumber
 
-	errHTTP = updateVisit(ctx, action.imsDBQ, action.es, newVisit, author, event.NormalizeAddresses)
+	errHTTP = updateVisit(ctx, action.imsDBQ, action.es, newVisit, author, event.NormalizeAddresses, triggerVisitCreated)
 	if errHTTP != nil {
 		return 0, "", errHTTP.From("[updateVisit]")
 	}
@@ -360,12 +462,14 @@ func (action NewVisit) newVisit(req *http.Request) (visitNumber int32, location
 	return newVisit.Number, fmt.Sprintf("/ims/api/events/%v/visits/%d", event.Name, newVisit.Number), nil
 }
 
+// updateVisit applies newVisit to the stored Visit. As with updateIncident, the
+// trigger says whether this is a new Visit.
 func updateVisit(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcerer, newVisit imsjson.Visit, author string,
-	normalizeAddresses bool,
+	normalizeAddresses bool, trigger webhookTrigger,
 ) *herr.HTTPError {
 	for range maxCASAttempts {
 		conflict, errHTTP := retryOnDeadlock(func() (bool, *herr.HTTPError) {
-			return updateVisitAttempt(ctx, imsDBQ, es, newVisit, author, normalizeAddresses)
+			return updateVisitAttempt(ctx, imsDBQ, es, newVisit, author, normalizeAddresses, trigger)
 		})
 		if errHTTP != nil {
 			return errHTTP.From("[updateVisitAttempt]")
@@ -378,7 +482,7 @@ func updateVisit(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcerer, new
 }
 
 func updateVisitAttempt(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcerer, newVisit imsjson.Visit, author string,
-	normalizeAddresses bool,
+	normalizeAddresses bool, trigger webhookTrigger,
 ) (conflict bool, errHTTP *herr.HTTPError) {
 	storedVisitRow, err := imsDBQ.Visit(ctx, imsDBQ,
 		imsdb.VisitParams{
@@ -442,12 +546,26 @@ func updateVisitAttempt(ctx context.Context, imsDBQ *store.DBQ, es *EventSourcer
 		return false, errHTTP.From("[addChangeReportEntries]")
 	}
 
+	changed := changes{eventID: storedVisit.Event, visits: []int32{storedVisit.Number}}
+	// Each Incident lists its Visits, so a move changes both Incidents too.
+	if update.IncidentNumber != storedVisit.IncidentNumber {
+		changed.incidents = []int32{storedVisit.IncidentNumber.Int32, update.IncidentNumber.Int32}
+	}
+	errHTTP = recordChanges(ctx, imsDBQ, txn, changed)
+	if errHTTP != nil {
+		return false, errHTTP.From("[recordChanges]")
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return false, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
 	}
 
-	es.notifyVisitUpdate(storedVisit.Event, storedVisit.Number)
+	triggers := []webhookTrigger{trigger}
+	if !storedVisit.DepartureTime.Valid && update.DepartureTime.Valid {
+		triggers = append(triggers, triggerVisitDeparted)
+	}
+	es.notifyVisitUpdate(storedVisit.Event, storedVisit.Number, triggers...)
 	es.notifyIncidentUpdates(storedVisit.Event, storedVisit.IncidentNumber.Int32, update.IncidentNumber.Int32)
 
 	return false, nil
@@ -605,9 +723,18 @@ func (action EditVisit) editVisit(req *http.Request) *herr.HTTPError {
 	newVisit.EventID = event.ID
 	newVisit.Number = visitNumber
 
+	errHTTP = checkConfidentialVisit(req, action.imsDBQ, event.ID, visitNumber, eventPermissions)
+	if errHTTP != nil {
+		return errHTTP.From("[checkConfidentialVisit]")
+	}
+	errHTTP = checkConfidentialIncident(req, action.imsDBQ, event.ID, incidentRef(newVisit.Incident), eventPermissions)
+	if errHTTP != nil {
+		return errHTTP.From("[checkConfidentialIncident]")
+	}
+
 	author := jwtCtx.Claims.RangerHandle()
 
-	errHTTP = updateVisit(ctx, action.imsDBQ, action.es, newVisit, author, event.NormalizeAddresses)
+	errHTTP = updateVisit(ctx, action.imsDBQ, action.es, newVisit, author, event.NormalizeAddresses, triggerVisitUpdated)
 	if errHTTP != nil {
 		return errHTTP.From("[updateVisit]")
 	}
@@ -0,0 +1,479 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/lib/seal"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// minWebhookSecretLength is short enough for any sensible secret, and long
+	// enough to rule out the likes of "secret".
+	minWebhookSecretLength = 16
+	// maxWebhookSecretLength leaves room in WEBHOOK.SECRET for the sealing.
+	maxWebhookSecretLength = 128
+
+	// webhookDeliveriesLimit is how many deliveries GetWebhookDeliveries
+	// returns, newest first.
+	webhookDeliveriesLimit = 100
+)
+
+// requireWebhookAdmin returns the Event from the request path, so long as the
+// requestor may administer its Webhooks. That takes the same permission as
+// administering the Event itself.
+func requireWebhookAdmin(
+	req *http.Request, imsDBQ *store.DBQ, userStore *directory.UserStore, imsAdmins []string,
+) (imsdb.Event, *herr.HTTPError) {
+	_, globalPermissions, errHTTP := getGlobalPermissions(req, imsDBQ, userStore, imsAdmins)
+	if errHTTP != nil {
+		return imsdb.Event{}, errHTTP.From("[getGlobalPermissions]")
+	}
+	if globalPermissions&authz.GlobalAdministrateEvents == 0 {
+		return imsdb.Event{}, herr.Forbidden("The requestor does not have GlobalAdministrateEvents permission", nil)
+	}
+	event, errHTTP := getEvent(req, req.PathValue("eventName"), imsDBQ)
+	if errHTTP != nil {
+		return imsdb.Event{}, errHTTP.From("[getEvent]")
+	}
+	return event, nil
+}
+
+// webhookSecretAdditionalData binds a sealed WEBHOOK secret to its Webhook, so
+// that it's no good if copied to another row.
+func webhookSecretAdditionalData(webhookID int32) []byte {
+	return []byte("WEBHOOK.SECRET " + conv.FormatInt(webhookID))
+}
+
+// getWebhook returns the Webhook from the request path, which must belong to
+// the Event.
+func getWebhook(req *http.Request, imsDBQ *store.DBQ, event imsdb.Event) (imsdb.Webhook, *herr.HTTPError) {
+	webhookID, err := conv.ParseInt32(req.PathValue("webhookId"))
+	if err != nil {
+		return imsdb.Webhook{}, herr.BadRequest("Invalid Webhook ID", err).From("[ParseInt32]")
+	}
+	row, err := imsDBQ.Webhook(req.Context(), imsDBQ, imsdb.WebhookParams{
+		Event: event.ID,
+		ID:    webhookID,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return imsdb.Webhook{}, herr.NotFound("Webhook not found", err).From("[Webhook]")
+		}
+		return imsdb.Webhook{}, herr.InternalServerError("Failed to fetch Webhook", err).From("[Webhook]")
+	}
+	return row.Webhook, nil
+}
+
+type GetWebhooks struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetWebhooks) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getWebhooks(req)
+	if errHTTP != nil {
+		errHTTP.From("[getWebhooks]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetWebhooks) getWebhooks(req *http.Request) (imsjson.Webhooks, *herr.HTTPError) {
+	event, errHTTP := requireWebhookAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[requireWebhookAdmin]")
+	}
+	rows, err := action.imsDBQ.Webhooks(req.Context(), action.imsDBQ, event.ID)
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch Webhooks", err).From("[Webhooks]")
+	}
+	resp := make(imsjson.Webhooks, 0, len(rows))
+	for _, row := range rows {
+		triggers, err := unmarshalByteSlice[[]string](row.TriggerTypes)
+		if err != nil {
+			return nil, herr.InternalServerError("Failed to read Webhook triggers", err).From("[unmarshalByteSlice]")
+		}
+		resp = append(resp, imsjson.Webhook{
+			ID:       row.Webhook.ID,
+			URL:      &row.Webhook.Url,
+			Triggers: &triggers,
+			Enabled:  &row.Webhook.Enabled,
+			Created:  conv.FloatToTime(row.Webhook.Created),
+		})
+	}
+	return resp, nil
+}
+
+// EditWebhook creates a Webhook, if the request has no ID, and otherwise
+// updates that Webhook. Fields left out of an update are left as they were,
+// and a Triggers field replaces all the Webhook's triggers.
+type EditWebhook struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+	masterKey string
+}
+
+func (action EditWebhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	newID, errHTTP := action.editWebhook(req)
+	if errHTTP != nil {
+		errHTTP.From("[editWebhook]").WriteResponse(w)
+		return
+	}
+	if newID != 0 {
+		w.Header().Set("IMS-Webhook-ID", strconv.Itoa(int(newID)))
+		herr.WriteCreatedResponse(w, http.StatusText(http.StatusCreated))
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action EditWebhook) editWebhook(req *http.Request) (newWebhookID int32, errHTTP *herr.HTTPError) {
+	event, errHTTP := requireWebhookAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return 0, errHTTP.From("[requireWebhookAdmin]")
+	}
+	editRequest, errHTTP := readBodyAs[imsjson.Webhook](req)
+	if errHTTP != nil {
+		return 0, errHTTP.From("[readBodyAs]")
+	}
+	errHTTP = validateWebhook(editRequest)
+	if errHTTP != nil {
+		return 0, errHTTP.From("[validateWebhook]")
+	}
+	ctx := req.Context()
+
+	var stored imsdb.Webhook
+	if editRequest.ID == 0 {
+		if editRequest.URL == nil || editRequest.Secret == nil {
+			return 0, herr.BadRequest("A new Webhook needs a URL and a secret", nil)
+		}
+		stored = imsdb.Webhook{
+			Event:   event.ID,
+			Enabled: true,
+			Created: conv.TimeToFloat(time.Now()),
+		}
+	} else {
+		row, err := action.imsDBQ.Webhook(ctx, action.imsDBQ, imsdb.WebhookParams{
+			Event: event.ID,
+			ID:    editRequest.ID,
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, herr.NotFound("Webhook not found", err).From("[Webhook]")
+			}
+			return 0, herr.InternalServerError("Failed to fetch Webhook", err).From("[Webhook]")
+		}
+		stored = row.Webhook
+	}
+	if editRequest.URL != nil {
+		stored.Url = *editRequest.URL
+	}
+	if editRequest.Enabled != nil {
+		stored.Enabled = *editRequest.Enabled
+	}
+
+	return retryOnDeadlock(func() (int32, *herr.HTTPError) {
+		return saveWebhook(ctx, action.imsDBQ, action.masterKey, stored, editRequest.Secret, editRequest.Triggers)
+	})
+}
+
+// validateWebhook checks whichever fields the request includes.
+func validateWebhook(webhook imsjson.Webhook) *herr.HTTPError {
+	if webhook.URL != nil {
+		u, err := url.Parse(*webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return herr.BadRequest("A Webhook URL must be an absolute http or https URL", err)
+		}
+	}
+	if webhook.Secret != nil && len(*webhook.Secret) < minWebhookSecretLength {
+		return herr.BadRequest(fmt.Sprintf("A Webhook secret must be at least %v characters long", minWebhookSecretLength), nil)
+	}
+	if webhook.Secret != nil && len(*webhook.Secret) > maxWebhookSecretLength {
+		return herr.BadRequest(fmt.Sprintf("A Webhook secret must be at most %v characters long", maxWebhookSecretLength), nil)
+	}
+	if webhook.Triggers != nil {
+		for _, trigger := range *webhook.Triggers {
+			if !webhookTrigger(trigger).Valid() {
+				return herr.BadRequest("Unknown Webhook trigger: "+trigger, nil)
+			}
+		}
+	}
+	return nil
+}
+
+// saveWebhook writes the Webhook, which is created if it has no ID, along with
+// its secret and triggers, if those are to change. It returns the ID of a new
+// Webhook.
+func saveWebhook(
+	ctx context.Context, imsDBQ *store.DBQ, masterKey string, webhook imsdb.Webhook, secret *string, triggers *[]string,
+) (int32, *herr.HTTPError) {
+	txn, err := imsDBQ.Begin()
+	if err != nil {
+		return 0, herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+	}
+	defer rollback(txn)
+
+	var newID int32
+	if webhook.ID == 0 {
+		id, err := imsDBQ.CreateWebhook(ctx, txn, imsdb.CreateWebhookParams{
+			Event:   webhook.Event,
+			Url:     webhook.Url,
+			Enabled: webhook.Enabled,
+			Created: webhook.Created,
+		})
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to create Webhook", err).From("[CreateWebhook]")
+		}
+		newID = conv.MustInt32(id)
+		webhook.ID = newID
+	} else {
+		err = imsDBQ.UpdateWebhook(ctx, txn, imsdb.UpdateWebhookParams{
+			Url:     webhook.Url,
+			Enabled: webhook.Enabled,
+			Event:   webhook.Event,
+			ID:      webhook.ID,
+		})
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to update Webhook", err).From("[UpdateWebhook]")
+		}
+	}
+
+	if secret != nil {
+		sealed, err := seal.Seal(masterKey, []byte(*secret), webhookSecretAdditionalData(webhook.ID))
+		if err != nil {
+			return 0, herr.InternalServerError("Webhooks aren't available. Get in touch with the tech team.", err).
+				From("[seal.Seal]")
+		}
+		err = imsDBQ.SetWebhookSecret(ctx, txn, imsdb.SetWebhookSecretParams{
+			Secret: sql.NullString{String: string(sealed), Valid: true},
+			ID:     webhook.ID,
+		})
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to set Webhook secret", err).From("[SetWebhookSecret]")
+		}
+	}
+
+	if triggers != nil {
+		err = imsDBQ.ClearWebhookTriggers(ctx, txn, webhook.ID)
+		if err != nil {
+			return 0, herr.InternalServerError("Failed to clear Webhook triggers", err).From("[ClearWebhookTriggers]")
+		}
+		added := make(map[string]bool)
+		for _, trigger := range *triggers {
+			if added[trigger] {
+				continue
+			}
+			added[trigger] = true
+			err = imsDBQ.AddWebhookTrigger(ctx, txn, imsdb.AddWebhookTriggerParams{
+				Webhook:     webhook.ID,
+				TriggerType: webhookTrigger(trigger),
+			})
+			if err != nil {
+				return 0, herr.InternalServerError("Failed to add Webhook trigger", err).From("[AddWebhookTrigger]")
+			}
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return 0, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	return newID, nil
+}
+
+// DeleteWebhook deletes a Webhook, along with its deliveries, whether they
+// were sent or not.
+type DeleteWebhook struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action DeleteWebhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.deleteWebhook(req)
+	if errHTTP != nil {
+		errHTTP.From("[deleteWebhook]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action DeleteWebhook) deleteWebhook(req *http.Request) *herr.HTTPError {
+	event, errHTTP := requireWebhookAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[requireWebhookAdmin]")
+	}
+	webhook, errHTTP := getWebhook(req, action.imsDBQ, event)
+	if errHTTP != nil {
+		return errHTTP.From("[getWebhook]")
+	}
+	ctx := req.Context()
+	return retryOnDeadlockErr(func() *herr.HTTPError {
+		txn, err := action.imsDBQ.Begin()
+		if err != nil {
+			return herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+		}
+		defer rollback(txn)
+		err = action.imsDBQ.DeleteWebhookDeliveries(ctx, txn, webhook.ID)
+		if err != nil {
+			return herr.InternalServerError("Failed to delete Webhook", err).From("[DeleteWebhookDeliveries]")
+		}
+		err = action.imsDBQ.ClearWebhookTriggers(ctx, txn, webhook.ID)
+		if err != nil {
+			return herr.InternalServerError("Failed to delete Webhook", err).From("[ClearWebhookTriggers]")
+		}
+		err = action.imsDBQ.DeleteWebhook(ctx, txn, imsdb.DeleteWebhookParams{
+			Event: event.ID,
+			ID:    webhook.ID,
+		})
+		if err != nil {
+			return herr.InternalServerError("Failed to delete Webhook", err).From("[DeleteWebhook]")
+		}
+		err = txn.Commit()
+		if err != nil {
+			return herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+		}
+		return nil
+	})
+}
+
+// GetWebhookDeliveries is the delivery log for a Webhook, newest first. The
+// "status" parameter limits it to deliveries with that status, e.g. "dead".
+type GetWebhookDeliveries struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action GetWebhookDeliveries) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, errHTTP := action.getWebhookDeliveries(req)
+	if errHTTP != nil {
+		errHTTP.From("[getWebhookDeliveries]").WriteResponse(w)
+		return
+	}
+	mustWriteJSON(w, req, resp)
+}
+
+func (action GetWebhookDeliveries) getWebhookDeliveries(req *http.Request) (imsjson.WebhookDeliveries, *herr.HTTPError) {
+	event, errHTTP := requireWebhookAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[requireWebhookAdmin]")
+	}
+	webhook, errHTTP := getWebhook(req, action.imsDBQ, event)
+	if errHTTP != nil {
+		return nil, errHTTP.From("[getWebhook]")
+	}
+	var status imsdb.NullWebhookDeliveryStatus
+	if v := req.FormValue("status"); v != "" {
+		status = imsdb.NullWebhookDeliveryStatus{WebhookDeliveryStatus: imsdb.WebhookDeliveryStatus(v), Valid: true}
+		if !status.WebhookDeliveryStatus.Valid() {
+			return nil, herr.BadRequest("Invalid status", nil)
+		}
+	}
+	rows, err := action.imsDBQ.WebhookDeliveries(req.Context(), action.imsDBQ, imsdb.WebhookDeliveriesParams{
+		Webhook: webhook.ID,
+		Status:  status,
+		Limit:   webhookDeliveriesLimit,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch Webhook deliveries", err).From("[WebhookDeliveries]")
+	}
+	resp := make(imsjson.WebhookDeliveries, 0, len(rows))
+	for _, d := range rows {
+		delivery := imsjson.WebhookDelivery{
+			ID:             d.ID,
+			Trigger:        d.TriggerType,
+			Status:         string(d.Status),
+			Attempts:       d.Attempts,
+			Created:        conv.FloatToTime(d.Created),
+			LastAttempt:    conv.NullFloatToTime(d.LastAttempt),
+			LastStatusCode: d.LastStatusCode.Int32,
+			LastError:      d.LastError.String,
+			Incident:       d.IncidentNumber.Int32,
+			FieldReport:    d.FieldReportNumber.Int32,
+			Visit:          d.VisitNumber.Int32,
+			BodyDigest:     d.BodyDigest.String,
+		}
+		if d.Status == imsdb.WebhookDeliveryStatusPending {
+			delivery.NextAttempt = conv.FloatToTime(d.NextAttempt)
+		}
+		resp = append(resp, delivery)
+	}
+	return resp, nil
+}
+
+// RetryWebhookDelivery sends a dead delivery around again, with a fresh set of
+// attempts. This is for when the receiver has been fixed.
+type RetryWebhookDelivery struct {
+	imsDBQ    *store.DBQ
+	userStore *directory.UserStore
+	imsAdmins []string
+}
+
+func (action RetryWebhookDelivery) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	errHTTP := action.retryWebhookDelivery(req)
+	if errHTTP != nil {
+		errHTTP.From("[retryWebhookDelivery]").WriteResponse(w)
+		return
+	}
+	herr.WriteNoContentResponse(w, "Success")
+}
+
+func (action RetryWebhookDelivery) retryWebhookDelivery(req *http.Request) *herr.HTTPError {
+	event, errHTTP := requireWebhookAdmin(req, action.imsDBQ, action.userStore, action.imsAdmins)
+	if errHTTP != nil {
+		return errHTTP.From("[requireWebhookAdmin]")
+	}
+	webhook, errHTTP := getWebhook(req, action.imsDBQ, event)
+	if errHTTP != nil {
+		return errHTTP.From("[getWebhook]")
+	}
+	deliveryID, err := conv.ParseInt64(req.PathValue("deliveryId"))
+	if err != nil {
+		return herr.BadRequest("Invalid delivery ID", err).From("[ParseInt64]")
+	}
+	rows, err := action.imsDBQ.RetryWebhookDelivery(req.Context(), action.imsDBQ, imsdb.RetryWebhookDeliveryParams{
+		NextAttempt: conv.TimeToFloat(time.Now()),
+		Webhook:     webhook.ID,
+		ID:          deliveryID,
+	})
+	if err != nil {
+		return herr.InternalServerError("Failed to retry Webhook delivery", err).From("[RetryWebhookDelivery]")
+	}
+	if rows == 0 {
+		return herr.NotFound("No such dead delivery for this Webhook", nil)
+	}
+	return nil
+}
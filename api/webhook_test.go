@@ -0,0 +1,91 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignWebhook(t *testing.T) {
+	t.Parallel()
+	body := []byte(`{"trigger":"incident.created"}`)
+	mac := hmac.New(sha256.New, []byte("some-webhook-secret"))
+	_, _ = mac.Write([]byte("1700000000." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	assert.Equal(t, want, signWebhook([]byte("some-webhook-secret"), 1700000000, body))
+	// The timestamp and secret are both part of what's signed.
+	assert.NotEqual(t, want, signWebhook([]byte("some-webhook-secret"), 1700000001, body))
+	assert.NotEqual(t, want, signWebhook([]byte("another-webhook-secret"), 1700000000, body))
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	t.Parallel()
+	// Allow for the jitter, which takes off up to half.
+	within := func(d, want time.Duration) {
+		t.Helper()
+		assert.GreaterOrEqual(t, d, want/2)
+		assert.Less(t, d, want)
+	}
+	within(webhookBackoff(1), webhookBackoffBase)
+	within(webhookBackoff(2), 2*webhookBackoffBase)
+	within(webhookBackoff(4), 8*webhookBackoffBase)
+	within(webhookBackoff(50), webhookBackoffMax)
+}
+
+func TestValidateWebhook(t *testing.T) {
+	t.Parallel()
+	good := imsjson.Webhook{
+		URL:      new("https://example.com/hooks/ims"),
+		Secret:   new("0123456789abcdef"),
+		Triggers: &[]string{"incident.created", "field_report.attached", "visit.departed"},
+	}
+	require.Nil(t, validateWebhook(good))
+	// An update may leave out any field.
+	require.Nil(t, validateWebhook(imsjson.Webhook{ID: 1}))
+
+	for _, rawURL := range []string{"ftp://example.com/", "/relative/path", "https://", "::nope"} {
+		wh := good
+		wh.URL = new(rawURL)
+		errHTTP := validateWebhook(wh)
+		require.NotNil(t, errHTTP, rawURL)
+		assert.Equal(t, http.StatusBadRequest, errHTTP.Code)
+	}
+
+	short := good
+	short.Secret = new("too-short")
+	require.NotNil(t, validateWebhook(short))
+	long := good
+	long.Secret = new(strings.Repeat("x", maxWebhookSecretLength+1))
+	require.NotNil(t, validateWebhook(long))
+
+	badTrigger := good
+	badTrigger.Triggers = &[]string{"incident.created", "incident.deleted"}
+	errHTTP := validateWebhook(badTrigger)
+	require.NotNil(t, errHTTP)
+	assert.Contains(t, errHTTP.Error(), "incident.deleted")
+}
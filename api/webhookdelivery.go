@@ -0,0 +1,463 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/herr"
+	"github.com/burningmantech/ranger-ims-go/lib/rand"
+	"github.com/burningmantech/ranger-ims-go/lib/seal"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+)
+
+const (
+	// webhookPollInterval is how often each server's worker looks for
+	// deliveries that are due.
+	webhookPollInterval = 2 * time.Second
+
+	// webhookBatchSize is how many deliveries a worker takes at once. They're
+	// sent concurrently, so one slow receiver doesn't hold up the rest.
+	webhookBatchSize = 20
+
+	// webhookRequestTimeout bounds each attempt at a delivery.
+	webhookRequestTimeout = 10 * time.Second
+
+	// webhookLease is how long a worker has to finish an attempt, before the
+	// delivery is deemed to be abandoned (e.g. because the server went down)
+	// and another worker may take it. It must be well over
+	// webhookRequestTimeout.
+	webhookLease = 2 * time.Minute
+
+	// webhookBackoffBase and webhookBackoffMax bound the wait after a failed
+	// attempt, which doubles with each one.
+	webhookBackoffBase = 30 * time.Second
+	webhookBackoffMax  = 6 * time.Hour
+
+	// webhookLogRetention is how long finished deliveries stay in the log.
+	webhookLogRetention = 30 * 24 * time.Hour
+	webhookPrunePeriod  = time.Hour
+
+	// webhookQueueTimeout bounds how long queueing deliveries may hold up the
+	// request that made the change.
+	webhookQueueTimeout = 10 * time.Second
+
+	// webhookMaxErrorLength is the size of WEBHOOK_DELIVERY.LAST_ERROR.
+	webhookMaxErrorLength = 1024
+)
+
+// webhookTrigger is a kind of change that a Webhook may subscribe to.
+type webhookTrigger = imsdb.WebhookTriggerTriggerType
+
+// A record's creation fires only its "created" trigger. Any later change fires
+// its "updated" trigger, along with any more specific ones that apply.
+const (
+	triggerIncidentCreated      = imsdb.WebhookTriggerTriggerTypeIncidentcreated
+	triggerIncidentUpdated      = imsdb.WebhookTriggerTriggerTypeIncidentupdated
+	triggerIncidentStateChanged = imsdb.WebhookTriggerTriggerTypeIncidentstateChanged
+	triggerFieldReportCreated   = imsdb.WebhookTriggerTriggerTypeFieldReportcreated
+	triggerFieldReportUpdated   = imsdb.WebhookTriggerTriggerTypeFieldReportupdated
+	triggerFieldReportAttached  = imsdb.WebhookTriggerTriggerTypeFieldReportattached
+	triggerVisitCreated         = imsdb.WebhookTriggerTriggerTypeVisitcreated
+	triggerVisitUpdated         = imsdb.WebhookTriggerTriggerTypeVisitupdated
+	triggerVisitDeparted        = imsdb.WebhookTriggerTriggerTypeVisitdeparted
+)
+
+// Webhooks queues up deliveries for the Webhooks that want to hear about a
+// change, and runs the worker that sends them.
+//
+// The queue is the WEBHOOK_DELIVERY table, so it survives restarts, and every
+// IMS server's worker draws from it. A delivery only names the record that
+// changed, and its payload is built from the record as it is for each attempt,
+// so that no copy of the record is kept for the sake of the log, beyond the
+// reach of redaction or confidentiality. Each delivery is retried with exponential
+// backoff, until it either gets a 2xx response or runs out of attempts, at
+// which point it's marked as dead. Admins can see all of this through
+// GetWebhookDeliveries, and can send a dead delivery around again with
+// RetryWebhookDelivery.
+type Webhooks struct {
+	imsDBQ             *store.DBQ
+	masterKey          string
+	attachmentsEnabled bool
+	maxAttempts        int32
+	client             *http.Client
+}
+
+func NewWebhooks(imsDBQ *store.DBQ, masterKey string, attachmentsEnabled bool, maxAttempts int32) *Webhooks {
+	return &Webhooks{
+		imsDBQ:             imsDBQ,
+		masterKey:          masterKey,
+		attachmentsEnabled: attachmentsEnabled,
+		maxAttempts:        maxAttempts,
+		client: &http.Client{
+			// A redirect counts as a failure, rather than being followed. The
+			// admin who registered the URL should fix it instead.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Start runs the worker until ctx is done.
+func (wh *Webhooks) Start(ctx context.Context) {
+	go wh.work(ctx)
+}
+
+// queue adds a delivery for each enabled Webhook on the Event that wants to
+// hear about any of the triggers. If there's at least one such Webhook, the
+// record is loaded to check that it isn't confidential. Failures are only
+// logged, since the change itself has already been made.
+//
+// A nil Webhooks queues nothing.
+func (wh *Webhooks) queue(data IMSEventData, triggers []webhookTrigger) {
+	if wh == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookQueueTimeout)
+	defer cancel()
+	errHTTP := wh.queueAttempt(ctx, data, triggers)
+	if errHTTP != nil {
+		slog.Error("Failed to queue webhook deliveries", "data", data, "triggers", triggers, "error", errHTTP)
+	}
+}
+
+func (wh *Webhooks) queueAttempt(ctx context.Context, data IMSEventData, triggers []webhookTrigger) *herr.HTTPError {
+	var checked bool
+	for _, trigger := range triggers {
+		hooks, err := wh.imsDBQ.WebhooksForTrigger(ctx, wh.imsDBQ, imsdb.WebhooksForTriggerParams{
+			Event:       data.EventID,
+			TriggerType: trigger,
+		})
+		if err != nil {
+			return herr.InternalServerError("Failed to fetch Webhooks", err).From("[WebhooksForTrigger]")
+		}
+		if len(hooks) == 0 {
+			continue
+		}
+		if !checked {
+			eventRow, err := wh.imsDBQ.Event(ctx, wh.imsDBQ, data.EventID)
+			if err != nil {
+				return herr.InternalServerError("Failed to fetch Event", err).From("[Event]")
+			}
+			_, confidential, errHTTP := wh.loadPayload(ctx, eventRow.Event, data)
+			if errHTTP != nil {
+				return errHTTP.From("[loadPayload]")
+			}
+			// A webhook's receiver isn't anyone who holds EventReadConfidential,
+			// so confidential records aren't sent anywhere.
+			if confidential {
+				return nil
+			}
+			checked = true
+		}
+		now := time.Now()
+		for _, hook := range hooks {
+			err = wh.imsDBQ.AddWebhookDelivery(ctx, wh.imsDBQ, imsdb.AddWebhookDeliveryParams{
+				Webhook:           hook.Webhook.ID,
+				Event:             data.EventID,
+				TriggerType:       string(trigger),
+				IncidentNumber:    sql.NullInt32{Int32: data.IncidentNumber, Valid: data.IncidentNumber > 0},
+				FieldReportNumber: sql.NullInt32{Int32: data.FieldReportNumber, Valid: data.FieldReportNumber > 0},
+				VisitNumber:       sql.NullInt32{Int32: data.VisitNumber, Valid: data.VisitNumber > 0},
+				NextAttempt:       conv.TimeToFloat(now),
+				Created:           conv.TimeToFloat(now),
+			})
+			if err != nil {
+				return herr.InternalServerError("Failed to add webhook delivery", err).From("[AddWebhookDelivery]")
+			}
+		}
+	}
+	return nil
+}
+
+// loadPayload fills in the record that changed, as it is now, and says whether
+// that record is confidential.
+func (wh *Webhooks) loadPayload(ctx context.Context, event imsdb.Event, data IMSEventData) (
+	imsjson.WebhookPayload, bool, *herr.HTTPError,
+) {
+	payload := imsjson.WebhookPayload{
+		Event:   event.Name,
+		EventID: event.ID,
+	}
+	var confidential bool
+	switch {
+	case data.IncidentNumber > 0:
+		incident, errHTTP := loadIncident(ctx, wh.imsDBQ, event, data.IncidentNumber, wh.attachmentsEnabled)
+		if errHTTP != nil {
+			return payload, false, errHTTP.From("[loadIncident]")
+		}
+		payload.Incident = &incident
+		confidential = *incident.Confidential
+	case data.FieldReportNumber > 0:
+		fr, reportEntries, errHTTP := fetchFieldReport(ctx, wh.imsDBQ, event.ID, data.FieldReportNumber)
+		if errHTTP != nil {
+			return payload, false, errHTTP.From("[fetchFieldReport]")
+		}
+		fieldReport := fieldReportToJSON(fr, reportEntries, event, wh.attachmentsEnabled)
+		payload.FieldReport = &fieldReport
+		confidential, errHTTP = incidentConfidential(ctx, wh.imsDBQ, event.ID, fr.IncidentNumber)
+		if errHTTP != nil {
+			return payload, false, errHTTP.From("[incidentConfidential]")
+		}
+	case data.VisitNumber > 0:
+		visit, errHTTP := loadVisit(ctx, wh.imsDBQ, event, data.VisitNumber, wh.attachmentsEnabled)
+		if errHTTP != nil {
+			return payload, false, errHTTP.From("[loadVisit]")
+		}
+		payload.Visit = &visit
+		confidential, errHTTP = incidentConfidential(ctx, wh.imsDBQ, event.ID, incidentRef(visit.Incident))
+		if errHTTP != nil {
+			return payload, false, errHTTP.From("[incidentConfidential]")
+		}
+	}
+	return payload, confidential, nil
+}
+
+func (wh *Webhooks) work(ctx context.Context) {
+	pollTicker := time.NewTicker(webhookPollInterval)
+	defer pollTicker.Stop()
+	pruneTicker := time.NewTicker(webhookPrunePeriod)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pruneTicker.C:
+			cutoff := conv.TimeToFloat(time.Now().Add(-webhookLogRetention))
+			err := wh.imsDBQ.PruneWebhookDeliveries(ctx, wh.imsDBQ, cutoff)
+			if err != nil {
+				slog.Error("Failed to prune webhook deliveries", "error", err)
+			}
+		case <-pollTicker.C:
+			wh.sendDue(ctx)
+		}
+	}
+}
+
+// sendDue sends batches of due deliveries until there are none left.
+func (wh *Webhooks) sendDue(ctx context.Context) {
+	for {
+		due, errHTTP := retryOnDeadlock(func() ([]imsdb.DueWebhookDeliveriesRow, *herr.HTTPError) {
+			return wh.takeDue(ctx)
+		})
+		if errHTTP != nil {
+			slog.Error("Failed to take due webhook deliveries", "error", errHTTP)
+			return
+		}
+		var wg sync.WaitGroup
+		for _, d := range due {
+			wg.Go(func() {
+				wh.send(ctx, d)
+			})
+		}
+		wg.Wait()
+		if len(due) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// takeDue leases a batch of due deliveries to this worker. The rows are taken
+// with SKIP LOCKED, so that concurrent workers get different batches instead
+// of waiting on each other.
+func (wh *Webhooks) takeDue(ctx context.Context) ([]imsdb.DueWebhookDeliveriesRow, *herr.HTTPError) {
+	txn, err := wh.imsDBQ.Begin()
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to start transaction", err).From("[Begin]")
+	}
+	defer rollback(txn)
+	now := time.Now()
+	due, err := wh.imsDBQ.DueWebhookDeliveries(ctx, txn, imsdb.DueWebhookDeliveriesParams{
+		NextAttempt: conv.TimeToFloat(now),
+		Limit:       webhookBatchSize,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to fetch due webhook deliveries", err).From("[DueWebhookDeliveries]")
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	ids := make([]int64, 0, len(due))
+	for _, d := range due {
+		ids = append(ids, d.WebhookDelivery.ID)
+	}
+	err = wh.imsDBQ.LeaseWebhookDeliveries(ctx, txn, imsdb.LeaseWebhookDeliveriesParams{
+		NextAttempt: conv.TimeToFloat(now.Add(webhookLease)),
+		Ids:         ids,
+	})
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to lease webhook deliveries", err).From("[LeaseWebhookDeliveries]")
+	}
+	err = txn.Commit()
+	if err != nil {
+		return nil, herr.InternalServerError("Failed to commit transaction", err).From("[Commit]")
+	}
+	return due, nil
+}
+
+// send makes one attempt at a delivery, and records how it went.
+func (wh *Webhooks) send(ctx context.Context, due imsdb.DueWebhookDeliveriesRow) {
+	d := due.WebhookDelivery
+	now := time.Now()
+	attempt := imsdb.RecordWebhookAttemptParams{
+		ID:          d.ID,
+		Status:      imsdb.WebhookDeliveryStatusDelivered,
+		NextAttempt: conv.TimeToFloat(now),
+		LastAttempt: conv.TimeToNullFloat(now),
+	}
+	body, err := wh.buildBody(ctx, d)
+	if err == nil {
+		digest := sha256.Sum256(body)
+		attempt.BodyDigest = sql.NullString{String: hex.EncodeToString(digest[:]), Valid: true}
+		var statusCode int32
+		statusCode, err = wh.post(ctx, due, body, now)
+		attempt.LastStatusCode = sql.NullInt32{Int32: statusCode, Valid: statusCode != 0}
+	}
+	if err != nil {
+		attempt.LastError = conv.StringToSql(new(err.Error()), webhookMaxErrorLength)
+		attempts := d.Attempts + 1
+		switch {
+		case errors.Is(err, errWebhookRecordConfidential):
+			attempt.Status = imsdb.WebhookDeliveryStatusDead
+		case attempts >= wh.maxAttempts:
+			attempt.Status = imsdb.WebhookDeliveryStatusDead
+			slog.Warn("Webhook delivery ran out of attempts",
+				"delivery", d.ID, "webhook", d.Webhook, "attempts", attempts, "error", err)
+		default:
+			attempt.Status = imsdb.WebhookDeliveryStatusPending
+			attempt.NextAttempt = conv.TimeToFloat(now.Add(webhookBackoff(attempts)))
+		}
+	}
+	err = wh.imsDBQ.RecordWebhookAttempt(ctx, wh.imsDBQ, attempt)
+	if err != nil {
+		// The lease will run out, and then the delivery will be attempted again.
+		slog.Error("Failed to record webhook attempt", "delivery", d.ID, "error", err)
+	}
+}
+
+// errWebhookRecordConfidential is why a delivery is given up on, if its record
+// was made confidential after the delivery was queued.
+var errWebhookRecordConfidential = errors.New("the record is now confidential, so it isn't sent anywhere")
+
+// buildBody makes the payload for an attempt at a delivery, from the record as
+// it is now.
+func (wh *Webhooks) buildBody(ctx context.Context, d imsdb.WebhookDelivery) ([]byte, error) {
+	eventRow, err := wh.imsDBQ.Event(ctx, wh.imsDBQ, d.Event)
+	if err != nil {
+		return nil, fmt.Errorf("[Event]: %w", err)
+	}
+	payload, confidential, errHTTP := wh.loadPayload(ctx, eventRow.Event, IMSEventData{
+		EventID:           d.Event,
+		IncidentNumber:    d.IncidentNumber.Int32,
+		FieldReportNumber: d.FieldReportNumber.Int32,
+		VisitNumber:       d.VisitNumber.Int32,
+	})
+	if errHTTP != nil {
+		return nil, fmt.Errorf("[loadPayload]: %w", errHTTP)
+	}
+	if confidential {
+		return nil, errWebhookRecordConfidential
+	}
+	payload.Trigger = d.TriggerType
+	payload.Timestamp = conv.FloatToTime(d.Created)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("[Marshal]: %w", err)
+	}
+	return body, nil
+}
+
+// post sends the delivery, returning the response's status code, if there
+// was a response. Anything but a 2xx status is an error.
+func (wh *Webhooks) post(ctx context.Context, due imsdb.DueWebhookDeliveriesRow, body []byte, now time.Time) (int32, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookRequestTimeout)
+	defer cancel()
+	d := due.WebhookDelivery
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, due.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("[NewRequestWithContext]: %w", err)
+	}
+	// The secret is only ever in the clear for as long as it takes to sign.
+	secret, err := seal.Open(wh.masterKey, []byte(due.Secret.String), webhookSecretAdditionalData(d.Webhook))
+	if err != nil {
+		return 0, fmt.Errorf("[seal.Open]: %w", err)
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ranger-ims-go webhooks")
+	req.Header.Set("IMS-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("IMS-Webhook-Trigger", d.TriggerType)
+	req.Header.Set("IMS-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("IMS-Webhook-Signature", signWebhook(secret, timestamp, body))
+	// #nosec G704 // SSRF via taint analysis. Only admins can set webhook URLs.
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("[Do]: %w", err)
+	}
+	defer shut(resp.Body)
+	// Read a little of the body, so that the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	// #nosec G115 // HTTP status codes are three digits
+	statusCode := int32(resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusCode, fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	return statusCode, nil
+}
+
+// signWebhook gives the IMS-Webhook-Signature header value for a delivery.
+// It's an HMAC-SHA256, keyed with the Webhook's secret, of the timestamp, a
+// ".", and then the body. Including the timestamp lets receivers reject old
+// deliveries that are being replayed.
+func signWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after the given number of failed
+// attempts, before trying again.
+func webhookBackoff(failedAttempts int32) time.Duration {
+	backoff := webhookBackoffBase
+	for range failedAttempts - 1 {
+		backoff *= 2
+		if backoff >= webhookBackoffMax {
+			backoff = webhookBackoffMax
+			break
+		}
+	}
+	return rand.Jitter(backoff)
+}
@@ -46,7 +46,8 @@ func main() {
 	const versionRef = "0123456789abcdef"
 
 	fixtures := map[string]templ.Component{
-		"login.html":             template.Login(deployment, versionName, versionRef),
+		"login.html":             template.Login(deployment, versionName, versionRef, true, false),
+		"password.html":          template.Password(deployment, versionName, versionRef, 12),
 		"root.html":              template.Root(deployment, versionName, versionRef),
 		"admin_directory.html":   template.AdminDirectory(deployment, versionName, versionRef),
 		"admin_types.html":       template.AdminTypes(deployment, versionName, versionRef),
@@ -44,8 +44,12 @@ var addUserCmd = &cobra.Command{
 		"first user, then add their handle to IMS_ADMINS.\n\n" +
 		"If a user with the given handle already exists, their password (and email,\n" +
 		"if provided) is updated, and the user is marked active.\n\n" +
+		"With --require-totp, the user must enroll in TOTP the next time they log in.\n" +
+		"Any TOTP enrollment they already have is reset, which is also how to let an\n" +
+		"admin back in who has lost their authenticator app and recovery codes.\n\n" +
 		"The password is read from an interactive prompt, or from stdin\n" +
-		"with --password-stdin.",
+		"with --password-stdin. It must meet the same password policy as any\n" +
+		"other (see IMS_PASSWORD_MIN_LENGTH and IMS_PASSWORD_BREACHED_CORPUS).",
 	RunE: runAddUser,
 }
 
@@ -55,6 +59,7 @@ var (
 	addUserEmail         string
 	addUserOnsite        bool
 	addUserPasswordStdin bool
+	addUserRequireTOTP   bool
 )
 
 func init() {
@@ -71,6 +76,8 @@ func init() {
 		"Mark the user as onsite (relevant only to 'onsite' validity access rules)")
 	addUserCmd.Flags().BoolVar(&addUserPasswordStdin, "password-stdin", false,
 		"Read the password from stdin rather than prompting for it")
+	addUserCmd.Flags().BoolVar(&addUserRequireTOTP, "require-totp", false,
+		"Make the user enroll in TOTP the next time they log in (requires IMS_MASTER_KEY)")
 	_ = addUserCmd.MarkFlagRequired("handle")
 }
 
@@ -81,21 +88,38 @@ func runAddUser(cmd *cobra.Command, args []string) error {
 	}
 
 	imsCfg := mustApplyEnvConfig(conf.DefaultIMS(), addUserEnvFilename)
-	if imsCfg.Directory.Directory != conf.DirectoryTypeIMS {
+	if !imsCfg.Directory.Directory.IncludesIMS() {
 		return fmt.Errorf("add-user manages the IMS-native directory, but this deployment's "+
-			"IMS_DIRECTORY is %q. Set IMS_DIRECTORY=ims to use the IMS-native directory",
+			"IMS_DIRECTORY is %q. Set IMS_DIRECTORY=ims or composite to use the IMS-native directory",
 			imsCfg.Directory.Directory)
 	}
 	if imsCfg.Store.Type != conf.DBStoreTypeMaria {
 		return fmt.Errorf("add-user requires a MariaDB IMS datastore, but this deployment's "+
 			"store type is %q", imsCfg.Store.Type)
 	}
+	if addUserRequireTOTP && imsCfg.Core.MasterKey == "" {
+		return errors.New("--require-totp needs IMS_MASTER_KEY to be set, since TOTP secrets " +
+			"are encrypted with it")
+	}
 
 	password, err := readPassword(addUserPasswordStdin)
 	if err != nil {
 		return fmt.Errorf("[readPassword]: %w", err)
 	}
-	hashed := argon2id.CreateHash(password, argon2id.SecondRecommendedParams)
+	policy := imsCfg.Core.PasswordPolicy()
+	violations, err := policy.Check(password, addUserHandle, addUserEmail)
+	if err != nil {
+		return fmt.Errorf("[Check]: %w", err)
+	}
+	if len(violations) > 0 {
+		messages := make([]string, 0, len(violations))
+		for _, v := range violations {
+			messages = append(messages, v.Message)
+		}
+		return fmt.Errorf("that password isn't allowed: %v", strings.Join(messages, "; "))
+	}
+	hashed := argon2id.CreateHash(password, imsCfg.Core.PasswordHashParams)
+	passwordPolicy := sql.NullString{String: policy.String(), Valid: true}
 
 	imsDB, err := store.SqlDB(ctx, imsCfg.Store, true)
 	if err != nil {
@@ -104,16 +128,18 @@ func runAddUser(cmd *cobra.Command, args []string) error {
 	defer func() { _ = imsDB.Close() }()
 	imsDBQ := store.NewDBQ(imsDB, imsdb.New())
 
+	var personID int64
 	existing, err := imsDBQ.DirectoryPersonByHandle(ctx, imsDBQ, addUserHandle)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		email := addUserEmail
-		_, err = imsDBQ.DirectoryCreatePerson(ctx, imsDBQ, imsdb.DirectoryCreatePersonParams{
-			Handle:   addUserHandle,
-			Email:    sql.NullString{String: email, Valid: email != ""},
-			Password: hashed,
-			Active:   true,
-			Onsite:   addUserOnsite,
+		personID, err = imsDBQ.DirectoryCreatePerson(ctx, imsDBQ, imsdb.DirectoryCreatePersonParams{
+			Handle:         addUserHandle,
+			Email:          sql.NullString{String: email, Valid: email != ""},
+			Password:       hashed,
+			PasswordPolicy: passwordPolicy,
+			Active:         true,
+			Onsite:         addUserOnsite,
 		})
 		if err != nil {
 			return fmt.Errorf("[DirectoryCreatePerson]: %w", err)
@@ -141,18 +167,53 @@ func runAddUser(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("[DirectoryUpdatePerson]: %w", err)
 		}
 		err = imsDBQ.DirectorySetPersonPassword(ctx, imsDBQ, imsdb.DirectorySetPersonPasswordParams{
-			Password: hashed,
-			ID:       existing.ID,
+			Password:       hashed,
+			PasswordPolicy: passwordPolicy,
+			ID:             existing.ID,
 		})
 		if err != nil {
 			return fmt.Errorf("[DirectorySetPersonPassword]: %w", err)
 		}
+		personID = existing.ID
 		cmd.Printf("Updated existing user %v\n", addUserHandle)
 	}
+	if addUserRequireTOTP {
+		err = requireTOTP(ctx, imsDBQ, personID)
+		if err != nil {
+			return fmt.Errorf("[requireTOTP]: %w", err)
+		}
+		cmd.Printf("User %v must enroll in TOTP the next time they log in\n", addUserHandle)
+	}
 	cmd.Printf("To make this user an IMS administrator, add %q to IMS_ADMINS\n", addUserHandle)
 	return nil
 }
 
+// requireTOTP resets any TOTP enrollment the person has, and makes them enroll
+// afresh the next time they log in.
+func requireTOTP(ctx context.Context, imsDBQ *store.DBQ, personID int64) error {
+	txn, err := imsDBQ.Begin()
+	if err != nil {
+		return fmt.Errorf("[Begin]: %w", err)
+	}
+	defer func() { _ = txn.Rollback() }()
+	err = imsDBQ.DirectoryResetPersonTOTP(ctx, txn, personID)
+	if err != nil {
+		return fmt.Errorf("[DirectoryResetPersonTOTP]: %w", err)
+	}
+	err = imsDBQ.DirectoryClearRecoveryCodes(ctx, txn, personID)
+	if err != nil {
+		return fmt.Errorf("[DirectoryClearRecoveryCodes]: %w", err)
+	}
+	err = imsDBQ.DirectorySetPersonTOTPRequired(ctx, txn, imsdb.DirectorySetPersonTOTPRequiredParams{
+		TotpRequired: true,
+		ID:           personID,
+	})
+	if err != nil {
+		return fmt.Errorf("[DirectorySetPersonTOTPRequired]: %w", err)
+	}
+	return txn.Commit()
+}
+
 func readPassword(fromStdin bool) (string, error) {
 	if fromStdin {
 		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
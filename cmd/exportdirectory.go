@@ -0,0 +1,102 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	"github.com/burningmantech/ranger-ims-go/conf"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+	"github.com/spf13/cobra"
+)
+
+var exportDirectoryCmd = &cobra.Command{
+	Use:   "export-directory",
+	Short: "Write out the IMS-native directory's users, teams, and positions",
+	Long: "Write out the IMS-native directory's users, teams, and positions\n\n" +
+		"This writes every user in the IMS-native directory, active or not, as CSV or\n" +
+		"JSON, in a form that import-directory takes back. A CSV has only the users,\n" +
+		"with the titles of their teams and positions, whereas JSON also has whether\n" +
+		"each team and position is active. Passwords and TOTP secrets are never written.",
+	RunE: runExportDirectory,
+}
+
+var (
+	exportDirectoryEnvFilename string
+	exportDirectoryFile        string
+	exportDirectoryFormat      string
+)
+
+func init() {
+	rootCmd.AddCommand(exportDirectoryCmd)
+
+	exportDirectoryCmd.Flags().StringVar(&exportDirectoryEnvFilename, envfileFlagName, envFileDefaultName,
+		"An env file from which to load IMS server configuration. "+
+			"Defaults to '.env' in the current directory")
+	exportDirectoryCmd.Flags().StringVar(&exportDirectoryFile, "file", "-",
+		"The file to write, or '-' for stdout")
+	exportDirectoryCmd.Flags().StringVar(&exportDirectoryFormat, "format", "",
+		"The file's format, either csv or json. Defaults to the file's extension, or csv")
+}
+
+func runExportDirectory(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	imsCfg := mustApplyEnvConfig(conf.DefaultIMS(), exportDirectoryEnvFilename)
+	if err := requireIMSDirectory("export-directory", imsCfg); err != nil {
+		return err
+	}
+	format, err := directoryFormat(exportDirectoryFormat, exportDirectoryFile)
+	if err != nil {
+		return err
+	}
+
+	imsDB, err := store.SqlDB(ctx, imsCfg.Store, true)
+	if err != nil {
+		return fmt.Errorf("[store.SqlDB]: %w", err)
+	}
+	defer func() { _ = imsDB.Close() }()
+	imsDBQ := store.NewDBQ(imsDB, imsdb.New())
+
+	bulk, err := api.ExportDirectoryBulk(ctx, imsDBQ)
+	if err != nil {
+		return fmt.Errorf("[ExportDirectoryBulk]: %w", err)
+	}
+	out := io.Writer(os.Stdout)
+	if exportDirectoryFile != "-" {
+		// The file has email addresses in it, so keep it to its owner.
+		f, err := os.OpenFile(exportDirectoryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return fmt.Errorf("[OpenFile]: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+	err = api.WriteDirectoryBulk(out, format, bulk)
+	if err != nil {
+		return fmt.Errorf("[WriteDirectoryBulk]: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	"github.com/burningmantech/ranger-ims-go/conf"
+	imsjson "github.com/burningmantech/ranger-ims-go/json"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+	"github.com/spf13/cobra"
+)
+
+var importDirectoryCmd = &cobra.Command{
+	Use:   "import-directory",
+	Short: "Create and update users, teams, and positions in the IMS-native directory in bulk",
+	Long: "Create and update users, teams, and positions in the IMS-native directory in bulk\n\n" +
+		"This reads a CSV or JSON file of users, such as one from export-directory, and\n" +
+		"makes the IMS-native directory match it. Users are matched by handle, and teams\n" +
+		"and positions by title. Those that don't exist yet are created, and those that\n" +
+		"do are updated, so importing the same file twice changes nothing the second\n" +
+		"time. A CSV needs a handle column, and may also have email, active, onsite,\n" +
+		"teams, and positions columns, with teams and positions separated by \";\".\n" +
+		"Columns that are left out, like empty active and onsite cells, leave those\n" +
+		"fields as they are.\n\n" +
+		"With --dry-run, nothing is changed, and the changes are only listed. With\n" +
+		"--deactivate-missing, active users who aren't in the file are deactivated.\n" +
+		"With --invite, new users with email addresses are emailed an invitation to\n" +
+		"choose their password (see IMS_MAIL). Otherwise, they can't log in until an\n" +
+		"admin sets their password.\n\n" +
+		"A running IMS server may take up to IMS_DIRECTORY_CACHE_TTL to see the changes.",
+	RunE: runImportDirectory,
+}
+
+var (
+	importDirectoryEnvFilename       string
+	importDirectoryFile              string
+	importDirectoryFormat            string
+	importDirectoryDryRun            bool
+	importDirectoryDeactivateMissing bool
+	importDirectoryInvite            bool
+)
+
+func init() {
+	rootCmd.AddCommand(importDirectoryCmd)
+
+	importDirectoryCmd.Flags().StringVar(&importDirectoryEnvFilename, envfileFlagName, envFileDefaultName,
+		"An env file from which to load IMS server configuration. "+
+			"Defaults to '.env' in the current directory")
+	importDirectoryCmd.Flags().StringVar(&importDirectoryFile, "file", "",
+		"The file to import, or '-' for stdin")
+	importDirectoryCmd.Flags().StringVar(&importDirectoryFormat, "format", "",
+		"The file's format, either csv or json. Defaults to the file's extension, or csv")
+	importDirectoryCmd.Flags().BoolVar(&importDirectoryDryRun, "dry-run", false,
+		"List the changes the import would make, without making them")
+	importDirectoryCmd.Flags().BoolVar(&importDirectoryDeactivateMissing, "deactivate-missing", false,
+		"Deactivate active users who aren't in the file")
+	importDirectoryCmd.Flags().BoolVar(&importDirectoryInvite, "invite", false,
+		"Email new users an invitation to choose their password (requires IMS_MAIL)")
+	_ = importDirectoryCmd.MarkFlagRequired("file")
+}
+
+func runImportDirectory(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	imsCfg := mustApplyEnvConfig(conf.DefaultIMS(), importDirectoryEnvFilename)
+	if err := requireIMSDirectory("import-directory", imsCfg); err != nil {
+		return err
+	}
+	if importDirectoryInvite && !imsCfg.Mail.Enabled() {
+		return errors.New("--invite needs IMS_MAIL to be set, so that invitations can be sent")
+	}
+	format, err := directoryFormat(importDirectoryFormat, importDirectoryFile)
+	if err != nil {
+		return err
+	}
+	in := io.Reader(os.Stdin)
+	if importDirectoryFile != "-" {
+		f, err := os.Open(importDirectoryFile)
+		if err != nil {
+			return fmt.Errorf("[Open]: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		in = f
+	}
+	bulk, err := api.ReadDirectoryBulk(in, format)
+	if err != nil {
+		return fmt.Errorf("[ReadDirectoryBulk]: %w", err)
+	}
+
+	imsDB, err := store.SqlDB(ctx, imsCfg.Store, true)
+	if err != nil {
+		return fmt.Errorf("[store.SqlDB]: %w", err)
+	}
+	defer func() { _ = imsDB.Close() }()
+	imsDBQ := store.NewDBQ(imsDB, imsdb.New())
+
+	result, err := api.ImportDirectoryBulk(ctx, imsDBQ, imsCfg, bulk, api.DirectoryImportOptions{
+		DryRun:            importDirectoryDryRun,
+		DeactivateMissing: importDirectoryDeactivateMissing,
+		Invite:            importDirectoryInvite,
+	})
+	if err != nil {
+		return fmt.Errorf("[ImportDirectoryBulk]: %w", err)
+	}
+	printDirectoryImport(cmd, result)
+	return nil
+}
+
+func printDirectoryImport(cmd *cobra.Command, result imsjson.DirectoryImport) {
+	// verb gives "Created", or "Would create" for a dry run.
+	verb := func(done, dryRun string) string {
+		if result.DryRun {
+			return dryRun
+		}
+		return done
+	}
+	if result.DryRun {
+		cmd.Println("This is a dry run, so nothing has been changed.")
+	}
+	for _, c := range result.Creates {
+		cmd.Printf("%v %v %v\n", verb("Created", "Would create"), c.Kind, c.Name)
+	}
+	for _, c := range result.Updates {
+		cmd.Printf("%v %v %v (%v)\n", verb("Updated", "Would update"), c.Kind, c.Name, strings.Join(c.Fields, ", "))
+	}
+	for _, c := range result.Deactivations {
+		cmd.Printf("%v %v %v\n", verb("Deactivated", "Would deactivate"), c.Kind, c.Name)
+	}
+	for _, handle := range result.Invited {
+		cmd.Printf("%v %v\n", verb("Invited", "Would invite"), handle)
+	}
+	for _, handle := range result.NotInvited {
+		cmd.Printf("Failed to invite %v\n", handle)
+	}
+	cmd.Printf("%v created, %v updated, %v deactivated, and %v users unchanged\n",
+		len(result.Creates), len(result.Updates), len(result.Deactivations), result.Unchanged)
+}
+
+// requireIMSDirectory checks that a command that works on the IMS-native
+// directory has one to work on.
+func requireIMSDirectory(command string, imsCfg *conf.IMSConfig) error {
+	if !imsCfg.Directory.Directory.IncludesIMS() {
+		return fmt.Errorf("%v works on the IMS-native directory, but this deployment's "+
+			"IMS_DIRECTORY is %q. Set IMS_DIRECTORY=ims or composite to use the IMS-native directory",
+			command, imsCfg.Directory.Directory)
+	}
+	if imsCfg.Store.Type != conf.DBStoreTypeMaria {
+		return fmt.Errorf("%v requires a MariaDB IMS datastore, but this deployment's "+
+			"store type is %q", command, imsCfg.Store.Type)
+	}
+	return nil
+}
+
+// directoryFormat gives the format of a directory import or export file,
+// from the --format flag, or else from the file's extension.
+func directoryFormat(format, filename string) (string, error) {
+	if format == "" {
+		format = api.DirectoryFormatCSV
+		if strings.EqualFold(filepath.Ext(filename), ".json") {
+			format = api.DirectoryFormatJSON
+		}
+	}
+	format = strings.ToLower(format)
+	if format != api.DirectoryFormatCSV && format != api.DirectoryFormatJSON {
+		return "", fmt.Errorf("--format must be csv or json, not %q", format)
+	}
+	return format, nil
+}
@@ -0,0 +1,93 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/burningmantech/ranger-ims-go/api"
+	"github.com/burningmantech/ranger-ims-go/conf"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/burningmantech/ranger-ims-go/store"
+	"github.com/burningmantech/ranger-ims-go/store/imsdb"
+	"github.com/spf13/cobra"
+)
+
+var rotateJWTKeyCmd = &cobra.Command{
+	Use:   "rotate-jwt-key",
+	Short: "Start signing JWTs with a new key",
+	Long: "Start signing JWTs with a new key\n\n" +
+		"This makes a new JWT signing key in the IMS database, which every IMS server\n" +
+		"starts signing with within a minute, without needing a restart. The key they\n" +
+		"were signing with before is kept for verifying the JWTs it already signed,\n" +
+		"until those have expired, so no one gets logged out.\n\n" +
+		"With --algorithm=EdDSA, the new key is an Ed25519 key, whose public half is\n" +
+		"published at /ims/api/auth/jwks, so that other services can verify IMS's\n" +
+		"JWTs without sharing a secret with it.\n\n" +
+		"Keys are encrypted with IMS_MASTER_KEY, so that must be set. Before the first\n" +
+		"rotation, JWTs are signed with IMS_JWT_SECRET, which is kept for verifying\n" +
+		"the JWTs it signed.",
+	RunE: runRotateJWTKey,
+}
+
+var (
+	rotateJWTKeyEnvFilename string
+	rotateJWTKeyAlgorithm   string
+)
+
+func init() {
+	rootCmd.AddCommand(rotateJWTKeyCmd)
+
+	rotateJWTKeyCmd.Flags().StringVar(&rotateJWTKeyEnvFilename, envfileFlagName, envFileDefaultName,
+		"An env file from which to load IMS server configuration. "+
+			"Defaults to '.env' in the current directory")
+	rotateJWTKeyCmd.Flags().StringVar(&rotateJWTKeyAlgorithm, "algorithm", authz.AlgorithmHS256,
+		"The new key's signing algorithm, either HS256 or EdDSA")
+}
+
+func runRotateJWTKey(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	imsCfg := mustApplyEnvConfig(conf.DefaultIMS(), rotateJWTKeyEnvFilename)
+	if imsCfg.Store.Type != conf.DBStoreTypeMaria {
+		return fmt.Errorf("rotate-jwt-key requires a MariaDB IMS datastore, but this deployment's "+
+			"store type is %q", imsCfg.Store.Type)
+	}
+	if imsCfg.Core.MasterKey == "" {
+		return errors.New("rotate-jwt-key needs IMS_MASTER_KEY to be set, since JWT signing keys " +
+			"are encrypted with it")
+	}
+
+	imsDB, err := store.SqlDB(ctx, imsCfg.Store, true)
+	if err != nil {
+		return fmt.Errorf("[store.SqlDB]: %w", err)
+	}
+	defer func() { _ = imsDB.Close() }()
+	imsDBQ := store.NewDBQ(imsDB, imsdb.New())
+
+	key, err := api.RotateJWTKey(ctx, imsDBQ, imsCfg.Core.MasterKey, rotateJWTKeyAlgorithm, imsCfg.Core.RefreshTokenLifetime)
+	if err != nil {
+		return fmt.Errorf("[RotateJWTKey]: %w", err)
+	}
+	cmd.Printf("Rotated in %v JWT signing key %v\n", key.Algorithm, key.ID)
+	return nil
+}
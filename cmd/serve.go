@@ -35,6 +35,7 @@ import (
 	"github.com/burningmantech/ranger-ims-go/directory"
 	chqueries "github.com/burningmantech/ranger-ims-go/directory/clubhousedb"
 	"github.com/burningmantech/ranger-ims-go/lib/attachment"
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
 	"github.com/burningmantech/ranger-ims-go/lib/conv"
 	"github.com/burningmantech/ranger-ims-go/store"
 	"github.com/burningmantech/ranger-ims-go/store/actionlog"
@@ -101,6 +102,12 @@ func runServerInternal(
 // is running and able to accept connections.
 func mustStartServer(ctx context.Context, unvalidatedCfg *conf.IMSConfig, printConfig bool) *http.Server {
 	must(unvalidatedCfg.Validate())
+	if unvalidatedCfg.Core.BreakGlassDuration > 0 {
+		_, err := authz.ParseAccessExpression(unvalidatedCfg.Core.BreakGlassEligible)
+		if err != nil {
+			must(fmt.Errorf("invalid IMS_BREAK_GLASS_ELIGIBLE: %w", err))
+		}
+	}
 	imsCfg := unvalidatedCfg
 	configureLogger(imsCfg)
 	tuneMemoryLimit("/sys/fs/cgroup/memory/memory.stat")
@@ -115,11 +122,22 @@ func mustStartServer(ctx context.Context, unvalidatedCfg *conf.IMSConfig, printC
 	imsDBQ := store.NewDBQ(imsDB, imsdb.New())
 
 	var directorySource directory.Source
-	if imsCfg.Directory.Directory == conf.DirectoryTypeIMS {
+	switch imsCfg.Directory.Directory {
+	case conf.DirectoryTypeIMS:
 		// The IMS-native directory lives in the IMS database itself,
 		// so there's no separate directory database to connect to.
 		directorySource = directory.NewIMSSource(imsDBQ)
-	} else {
+	case conf.DirectoryTypeLDAP:
+		directorySource = directory.NewLDAPSource(imsCfg.Directory.LDAP, imsCfg.Core.Deployment == conf.DeploymentTypeDev)
+	case conf.DirectoryTypeComposite:
+		// Clubhouse people, plus guest accounts in the IMS-native directory.
+		clubhouseDB, err := directory.MariaDB(ctx, imsCfg.Directory)
+		must(err)
+		directorySource = directory.NewCompositeSource(
+			directory.NewClubhouseSource(directory.NewDBQ(clubhouseDB, chqueries.New())),
+			directory.NewIMSSource(imsDBQ),
+		)
+	default:
 		clubhouseDB, err := directory.MariaDB(ctx, imsCfg.Directory)
 		must(err)
 		directorySource = directory.NewClubhouseSource(directory.NewDBQ(clubhouseDB, chqueries.New()))
@@ -134,10 +152,19 @@ func mustStartServer(ctx context.Context, unvalidatedCfg *conf.IMSConfig, printC
 	actionLogger := actionlog.NewLogger(ctx, imsDBQ, imsCfg.Core.ActionLogEnabled, false)
 	errorLogger := errorlog.NewLogger(ctx, imsDBQ, imsCfg.Core.ErrorLogEnabled, false)
 
-	eventSource := api.NewEventSourcerer()
+	eventSource := api.NewEventSourcerer(imsDBQ, imsCfg.AttachmentsStore.Type != conf.AttachmentsStoreNone)
+	if imsCfg.Core.SSEBroadcast == conf.SSEBroadcastMariaDB {
+		must(eventSource.Broadcast(ctx, api.NewOutboxBroadcaster(imsDBQ, imsCfg.Core.SSEPollInterval)))
+	}
+	if imsCfg.Store.Type == conf.DBStoreTypeMaria {
+		webhooks := api.NewWebhooks(imsDBQ, imsCfg.Core.MasterKey, imsCfg.AttachmentsStore.Type != conf.AttachmentsStoreNone, imsCfg.Core.WebhookMaxAttempts)
+		webhooks.Start(ctx)
+		eventSource.SendWebhooks(webhooks)
+	}
+	eventSource.LogConfidentialAccess(actionLogger)
 	mux := http.NewServeMux()
 	api.AddToMux(mux, eventSource, imsCfg, imsDBQ, userStore, s3Client, actionLogger, errorLogger)
-	web.AddToMux(mux, imsCfg)
+	web.AddToMux(mux, imsCfg, api.EndSession(imsDBQ))
 
 	s := &http.Server{
 		Handler:     mux,
@@ -151,7 +178,7 @@ func mustStartServer(ctx context.Context, unvalidatedCfg *conf.IMSConfig, printC
 	s.RegisterOnShutdown(func() {
 		actionLogger.Close()
 		errorLogger.Close()
-		eventSource.Server.Close()
+		eventSource.Close()
 	})
 
 	listener, err := net.Listen("tcp", net.JoinHostPort(imsCfg.Core.Host, conv.FormatInt(imsCfg.Core.Port)))
@@ -19,9 +19,11 @@ package cmd
 import (
 	"fmt"
 	"github.com/burningmantech/ranger-ims-go/conf"
+	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
 	"github.com/burningmantech/ranger-ims-go/lib/conv"
 	"github.com/joho/godotenv"
 	"log/slog"
+	"net/netip"
 	"os"
 	"strings"
 	"time"
@@ -96,12 +98,128 @@ func mustApplyEnvConfig(baseCfg *conf.IMSConfig, envFileName string) *conf.IMSCo
 	if v, ok := lookupEnv("IMS_EVENT_DELETION_ENABLED"); ok {
 		baseCfg.Core.EventDeletionEnabled = strings.EqualFold(v, "true")
 	}
+	if v, ok := lookupEnv("IMS_SSE_BROADCAST"); ok {
+		baseCfg.Core.SSEBroadcast = conf.SSEBroadcastType(strings.ToLower(v))
+	}
+	if v, ok := lookupEnv("IMS_SSE_POLL_INTERVAL"); ok {
+		dur, err := time.ParseDuration(v)
+		must(err)
+		baseCfg.Core.SSEPollInterval = dur
+	}
+	if v, ok := lookupEnv("IMS_WEBHOOK_MAX_ATTEMPTS"); ok {
+		baseCfg.Core.WebhookMaxAttempts, err = conv.ParseInt32(v)
+		must(err)
+	}
+	if v, ok := lookupEnv("IMS_LOGIN_LOCKOUT_FAILURES"); ok {
+		baseCfg.Core.LoginLockoutFailures, err = conv.ParseInt32(v)
+		must(err)
+	}
+	if v, ok := lookupEnv("IMS_LOGIN_LOCKOUT_DURATION"); ok {
+		dur, err := time.ParseDuration(v)
+		must(err)
+		baseCfg.Core.LoginLockoutDuration = dur
+	}
+	if v, ok := lookupEnv("IMS_TRUSTED_PROXIES"); ok {
+		baseCfg.Core.TrustedProxies = nil
+		for p := range strings.SplitSeq(v, ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				// A lone address is a prefix of just that address
+				addr, addrErr := netip.ParseAddr(p)
+				if addrErr != nil {
+					must(fmt.Errorf("invalid IMS_TRUSTED_PROXIES entry %q: %w", p, err))
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			baseCfg.Core.TrustedProxies = append(baseCfg.Core.TrustedProxies, prefix.Masked())
+		}
+	}
+	if v, ok := lookupEnv("IMS_BREAK_GLASS_DURATION"); ok {
+		dur, err := time.ParseDuration(v)
+		must(err)
+		baseCfg.Core.BreakGlassDuration = dur
+	}
+	if v, ok := lookupEnv("IMS_BREAK_GLASS_ELIGIBLE"); ok {
+		baseCfg.Core.BreakGlassEligible = v
+	}
+	if v, ok := lookupEnv("IMS_PASSWORD_HASH_PARAMS"); ok {
+		params, err := argon2id.ParseParams(v)
+		must(err)
+		baseCfg.Core.PasswordHashParams = params
+	}
 	if v, ok := lookupEnv("IMS_BM_API_URL"); ok {
 		baseCfg.BurningManAPI.URL = strings.TrimSuffix(v, "/")
 	}
 	if v, ok := lookupEnv("IMS_BM_API_KEY"); ok {
 		baseCfg.BurningManAPI.APIKey = v
 	}
+	if v, ok := lookupEnv("IMS_OIDC_ISSUER"); ok {
+		baseCfg.OIDC.Issuer = v
+	}
+	if v, ok := lookupEnv("IMS_OIDC_CLIENT_ID"); ok {
+		baseCfg.OIDC.ClientID = v
+	}
+	if v, ok := lookupEnv("IMS_OIDC_CLIENT_SECRET"); ok {
+		baseCfg.OIDC.ClientSecret = v
+	}
+	if v, ok := lookupEnv("IMS_OIDC_REDIRECT_URL"); ok {
+		baseCfg.OIDC.RedirectURL = v
+	}
+	if v, ok := lookupEnv("IMS_OIDC_HANDLE_CLAIM"); ok {
+		baseCfg.OIDC.HandleClaim = v
+	}
+	if v, ok := lookupEnv("IMS_PASSWORD_MIN_LENGTH"); ok {
+		baseCfg.Core.PasswordMinLength, err = conv.ParseInt32(v)
+		must(err)
+	}
+	if v, ok := lookupEnv("IMS_PASSWORD_BREACHED_CORPUS"); ok {
+		root, err := os.OpenRoot(v)
+		must(err)
+		baseCfg.Core.PasswordBreachedCorpus = root
+	}
+	if v, ok := lookupEnv("IMS_MAIL"); ok {
+		baseCfg.Mail.Type = conf.MailType(strings.ToLower(v))
+	}
+	if v, ok := lookupEnv("IMS_MAIL_FROM"); ok {
+		baseCfg.Mail.From = v
+	}
+	if v, ok := lookupEnv("IMS_MAIL_PUBLIC_URL"); ok {
+		baseCfg.Mail.PublicURL = strings.TrimSuffix(v, "/")
+	}
+	if v, ok := lookupEnv("IMS_MAIL_SMTP_HOST"); ok {
+		baseCfg.Mail.SMTP.Host = v
+	}
+	if v, ok := lookupEnv("IMS_MAIL_SMTP_PORT"); ok {
+		baseCfg.Mail.SMTP.Port, err = conv.ParseInt32(v)
+		must(err)
+	}
+	if v, ok := lookupEnv("IMS_MAIL_SMTP_USERNAME"); ok {
+		baseCfg.Mail.SMTP.Username = v
+	}
+	if v, ok := lookupEnv("IMS_MAIL_SMTP_PASSWORD"); ok {
+		baseCfg.Mail.SMTP.Password = v
+	}
+	if v, ok := lookupEnv("IMS_MAIL_MAILDIR"); ok {
+		err = os.MkdirAll(v, 0750)
+		must(err)
+		root, err := os.OpenRoot(v)
+		must(err)
+		baseCfg.Mail.Maildir = root
+	}
+	if v, ok := lookupEnv("IMS_MAIL_INVITE_LIFETIME"); ok {
+		dur, err := time.ParseDuration(v)
+		must(err)
+		baseCfg.Mail.InviteLifetime = dur
+	}
+	if v, ok := lookupEnv("IMS_MAIL_RESET_LIFETIME"); ok {
+		dur, err := time.ParseDuration(v)
+		must(err)
+		baseCfg.Mail.ResetLifetime = dur
+	}
 	if v, ok := lookupEnv("IMS_DIRECTORY"); ok {
 		baseCfg.Directory.Directory = conf.DirectoryType(strings.ToLower(v))
 	}
@@ -111,6 +229,12 @@ func mustApplyEnvConfig(baseCfg *conf.IMSConfig, envFileName string) *conf.IMSCo
 	if v, ok := lookupEnv("IMS_JWT_SECRET"); ok {
 		baseCfg.Core.JWTSecret = v
 	}
+	if v, ok := lookupEnv("IMS_JWT_PREVIOUS_SECRETS"); ok {
+		baseCfg.Core.JWTPreviousSecrets = strings.Split(v, ",")
+	}
+	if v, ok := lookupEnv("IMS_MASTER_KEY"); ok {
+		baseCfg.Core.MasterKey = v
+	}
 	if v, ok := lookupEnv("IMS_DB_STORE_TYPE"); ok {
 		baseCfg.Store.Type = conf.DBStoreType(strings.ToLower(v))
 	}
@@ -142,6 +266,50 @@ func mustApplyEnvConfig(baseCfg *conf.IMSConfig, envFileName string) *conf.IMSCo
 	if v, ok := lookupEnv("IMS_DMS_PASSWORD"); ok {
 		baseCfg.Directory.ClubhouseDB.Password = v
 	}
+	if v, ok := lookupEnv("IMS_LDAP_URL"); ok {
+		baseCfg.Directory.LDAP.URL = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_START_TLS"); ok {
+		baseCfg.Directory.LDAP.StartTLS = strings.EqualFold(v, "true")
+	}
+	if v, ok := lookupEnv("IMS_LDAP_BIND_DN"); ok {
+		baseCfg.Directory.LDAP.BindDN = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_BIND_PASSWORD"); ok {
+		baseCfg.Directory.LDAP.BindPassword = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_BASE_DN"); ok {
+		baseCfg.Directory.LDAP.BaseDN = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_USER_FILTER"); ok {
+		baseCfg.Directory.LDAP.UserFilter = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_USER_ID_ATTRIBUTE"); ok {
+		baseCfg.Directory.LDAP.UserIDAttribute = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_HANDLE_ATTRIBUTE"); ok {
+		baseCfg.Directory.LDAP.HandleAttribute = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_EMAIL_ATTRIBUTE"); ok {
+		baseCfg.Directory.LDAP.EmailAttribute = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_TEAM_FILTER"); ok {
+		baseCfg.Directory.LDAP.TeamFilter = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_POSITION_FILTER"); ok {
+		baseCfg.Directory.LDAP.PositionFilter = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_GROUP_NAME_ATTRIBUTE"); ok {
+		baseCfg.Directory.LDAP.GroupNameAttribute = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_GROUP_MEMBER_ATTRIBUTE"); ok {
+		baseCfg.Directory.LDAP.GroupMemberAttribute = v
+	}
+	if v, ok := lookupEnv("IMS_LDAP_TIMEOUT"); ok {
+		dur, err := time.ParseDuration(v)
+		must(err)
+		baseCfg.Directory.LDAP.Timeout = dur
+	}
 	if v, ok := lookupEnv("IMS_ATTACHMENTS_STORE"); ok {
 		baseCfg.AttachmentsStore.Type = conf.AttachmentsStoreType(v)
 	}
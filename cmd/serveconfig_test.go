@@ -19,6 +19,7 @@ package cmd
 import (
 	"github.com/burningmantech/ranger-ims-go/conf"
 	"github.com/stretchr/testify/assert"
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -32,6 +33,7 @@ import (
 // is unaffected by environment variables changing later.
 func TestMustApplyEnvConfig(t *testing.T) {
 	tempDir := t.TempDir()
+	mailDir := t.TempDir()
 	t.Setenv("IMS_HOSTNAME", "host")
 	t.Setenv("IMS_PORT", "1234")
 	t.Setenv("IMS_PASSWORD", "password")
@@ -45,9 +47,37 @@ func TestMustApplyEnvConfig(t *testing.T) {
 	t.Setenv("IMS_ACTION_LOG_ENABLED", "true")
 	t.Setenv("IMS_ERROR_LOG_ENABLED", "false")
 	t.Setenv("IMS_EVENT_DELETION_ENABLED", "true")
+	t.Setenv("IMS_SSE_BROADCAST", "MariaDB")
+	t.Setenv("IMS_SSE_POLL_INTERVAL", "250ms")
+	t.Setenv("IMS_WEBHOOK_MAX_ATTEMPTS", "3")
+	t.Setenv("IMS_LOGIN_LOCKOUT_FAILURES", "5")
+	t.Setenv("IMS_LOGIN_LOCKOUT_DURATION", "30m")
+	t.Setenv("IMS_TRUSTED_PROXIES", "173.245.48.0/20, 10.1.2.3")
+	t.Setenv("IMS_BREAK_GLASS_DURATION", "2h")
+	t.Setenv("IMS_BREAK_GLASS_ELIGIBLE", "position:Shift Lead")
+	t.Setenv("IMS_PASSWORD_HASH_PARAMS", "m=131072,t=4,p=2")
+	t.Setenv("IMS_OIDC_ISSUER", "https://idp.example.com")
+	t.Setenv("IMS_OIDC_CLIENT_ID", "ims-client")
+	t.Setenv("IMS_OIDC_CLIENT_SECRET", "ims-secret")
+	t.Setenv("IMS_OIDC_REDIRECT_URL", "https://ims.example.com/ims/api/auth/oidc/callback")
+	t.Setenv("IMS_OIDC_HANDLE_CLAIM", "nickname")
+	t.Setenv("IMS_PASSWORD_MIN_LENGTH", "16")
+	t.Setenv("IMS_PASSWORD_BREACHED_CORPUS", tempDir)
+	t.Setenv("IMS_MAIL", "Maildir")
+	t.Setenv("IMS_MAIL_FROM", "IMS <ims@example.com>")
+	t.Setenv("IMS_MAIL_PUBLIC_URL", "https://ims.example.com/")
+	t.Setenv("IMS_MAIL_SMTP_HOST", "smtp.example.com")
+	t.Setenv("IMS_MAIL_SMTP_PORT", "2525")
+	t.Setenv("IMS_MAIL_SMTP_USERNAME", "mailer")
+	t.Setenv("IMS_MAIL_SMTP_PASSWORD", "mailpass")
+	t.Setenv("IMS_MAIL_MAILDIR", mailDir)
+	t.Setenv("IMS_MAIL_INVITE_LIFETIME", "48h")
+	t.Setenv("IMS_MAIL_RESET_LIFETIME", "20m")
 	t.Setenv("IMS_DIRECTORY", "clubhousedb")
 	t.Setenv("IMS_ADMINS", "alice,bob")
 	t.Setenv("IMS_JWT_SECRET", "shhh")
+	t.Setenv("IMS_JWT_PREVIOUS_SECRETS", "old,older")
+	t.Setenv("IMS_MASTER_KEY", "sealed")
 	t.Setenv("IMS_DB_HOST_NAME", "db")
 	t.Setenv("IMS_DB_STORE_TYPE", "mariadb")
 	t.Setenv("IMS_DB_HOST_PORT", "555")
@@ -58,6 +88,20 @@ func TestMustApplyEnvConfig(t *testing.T) {
 	t.Setenv("IMS_DMS_DATABASE", "rangerz")
 	t.Setenv("IMS_DMS_USERNAME", "me2")
 	t.Setenv("IMS_DMS_PASSWORD", "woo")
+	t.Setenv("IMS_LDAP_URL", "ldap://ldap.example.com")
+	t.Setenv("IMS_LDAP_START_TLS", "true")
+	t.Setenv("IMS_LDAP_BIND_DN", "cn=ims,dc=example,dc=org")
+	t.Setenv("IMS_LDAP_BIND_PASSWORD", "ldappass")
+	t.Setenv("IMS_LDAP_BASE_DN", "dc=example,dc=org")
+	t.Setenv("IMS_LDAP_USER_FILTER", "(objectClass=inetOrgPerson)")
+	t.Setenv("IMS_LDAP_USER_ID_ATTRIBUTE", "uidNumber")
+	t.Setenv("IMS_LDAP_HANDLE_ATTRIBUTE", "displayName")
+	t.Setenv("IMS_LDAP_EMAIL_ATTRIBUTE", "email")
+	t.Setenv("IMS_LDAP_TEAM_FILTER", "(ou=teams)")
+	t.Setenv("IMS_LDAP_POSITION_FILTER", "(ou=positions)")
+	t.Setenv("IMS_LDAP_GROUP_NAME_ATTRIBUTE", "description")
+	t.Setenv("IMS_LDAP_GROUP_MEMBER_ATTRIBUTE", "memberUid")
+	t.Setenv("IMS_LDAP_TIMEOUT", "3s")
 	t.Setenv("IMS_ATTACHMENTS_STORE", "local")
 	t.Setenv("IMS_ATTACHMENTS_LOCAL_DIR", tempDir)
 	t.Setenv("AWS_ACCESS_KEY_ID", "my name")
@@ -83,9 +127,61 @@ func TestMustApplyEnvConfig(t *testing.T) {
 	assert.True(t, conf.DefaultIMS().Core.ErrorLogEnabled)
 	assert.False(t, cfg.Core.ErrorLogEnabled)
 	assert.True(t, cfg.Core.EventDeletionEnabled)
+	assert.Equal(t, conf.SSEBroadcastMariaDB, cfg.Core.SSEBroadcast)
+	assert.Equal(t, 250*time.Millisecond, cfg.Core.SSEPollInterval)
+	assert.Equal(t, int32(3), cfg.Core.WebhookMaxAttempts)
+	assert.Equal(t, int32(5), cfg.Core.LoginLockoutFailures)
+	assert.Equal(t, 30*time.Minute, cfg.Core.LoginLockoutDuration)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("173.245.48.0/20"),
+		netip.MustParsePrefix("10.1.2.3/32"),
+	}, cfg.Core.TrustedProxies)
+	assert.Equal(t, 2*time.Hour, cfg.Core.BreakGlassDuration)
+	assert.Equal(t, "position:Shift Lead", cfg.Core.BreakGlassEligible)
+	assert.Equal(t, "m=131072,t=4,p=2", cfg.Core.PasswordHashParams.String())
+	assert.Equal(t, conf.OIDC{
+		Issuer:       "https://idp.example.com",
+		ClientID:     "ims-client",
+		ClientSecret: "ims-secret",
+		RedirectURL:  "https://ims.example.com/ims/api/auth/oidc/callback",
+		HandleClaim:  "nickname",
+	}, cfg.OIDC)
+	assert.Equal(t, int32(16), cfg.Core.PasswordMinLength)
+	assert.Equal(t, tempDir, cfg.Core.PasswordBreachedCorpus.Name())
+	assert.Equal(t, "min=16,max=256,identity,breached", cfg.Core.PasswordPolicy().String())
+	assert.Equal(t, conf.MailMaildir, cfg.Mail.Type)
+	assert.Equal(t, "IMS <ims@example.com>", cfg.Mail.From)
+	assert.Equal(t, "https://ims.example.com", cfg.Mail.PublicURL)
+	assert.Equal(t, conf.SMTPMail{
+		Host:     "smtp.example.com",
+		Port:     2525,
+		Username: "mailer",
+		Password: "mailpass",
+	}, cfg.Mail.SMTP)
+	assert.Equal(t, mailDir, cfg.Mail.Maildir.Name())
+	assert.Equal(t, 48*time.Hour, cfg.Mail.InviteLifetime)
+	assert.Equal(t, 20*time.Minute, cfg.Mail.ResetLifetime)
 	assert.Equal(t, conf.DirectoryTypeClubhouseDB, cfg.Directory.Directory)
+	assert.Equal(t, conf.LDAP{
+		URL:                  "ldap://ldap.example.com",
+		StartTLS:             true,
+		BindDN:               "cn=ims,dc=example,dc=org",
+		BindPassword:         "ldappass",
+		BaseDN:               "dc=example,dc=org",
+		UserFilter:           "(objectClass=inetOrgPerson)",
+		UserIDAttribute:      "uidNumber",
+		HandleAttribute:      "displayName",
+		EmailAttribute:       "email",
+		TeamFilter:           "(ou=teams)",
+		PositionFilter:       "(ou=positions)",
+		GroupNameAttribute:   "description",
+		GroupMemberAttribute: "memberUid",
+		Timeout:              3 * time.Second,
+	}, cfg.Directory.LDAP)
 	assert.Equal(t, []string{"alice", "bob"}, cfg.Core.Admins)
 	assert.Equal(t, "shhh", cfg.Core.JWTSecret)
+	assert.Equal(t, []string{"old", "older"}, cfg.Core.JWTPreviousSecrets)
+	assert.Equal(t, "sealed", cfg.Core.MasterKey)
 	assert.Equal(t, conf.DBStoreTypeMaria, cfg.Store.Type)
 	assert.Equal(t, "db", cfg.Store.MariaDB.HostName)
 	assert.Equal(t, int32(555), cfg.Store.MariaDB.HostPort)
@@ -20,15 +20,24 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
+	"github.com/burningmantech/ranger-ims-go/lib/authn"
 	"github.com/burningmantech/ranger-ims-go/lib/redact"
 )
 
 // mib is the number of bytes in 1 MiB.
 const mib = 1 << 20
 
+// passwordMaxLength is the most bytes a password in the IMS-native directory
+// may have.
+const passwordMaxLength = 256
+
 // DefaultIMS is the base configuration used for the IMS server.
 // It gets overridden by values in .env, if present, then the result
 // of that gets overridden by environment variables. See mustApplyEnvConfig
@@ -48,6 +57,13 @@ func DefaultIMS() *IMSConfig {
 			MaxRequestBytes:      100 * mib,
 			ActionLogEnabled:     true,
 			ErrorLogEnabled:      true,
+			SSEBroadcast:         SSEBroadcastLocal,
+			SSEPollInterval:      time.Second,
+			WebhookMaxAttempts:   8,
+			LoginLockoutFailures: 10,
+			LoginLockoutDuration: 15 * time.Minute,
+			PasswordHashParams:   argon2id.SecondRecommendedParams,
+			PasswordMinLength:    12,
 		},
 		Store: DBStore{
 			Type: DBStoreTypeMaria,
@@ -66,6 +82,15 @@ func DefaultIMS() *IMSConfig {
 				Hostname: "localhost:3306",
 				Database: "rangers",
 			},
+			LDAP: LDAP{
+				UserFilter:           "(objectClass=person)",
+				UserIDAttribute:      "entryUUID",
+				HandleAttribute:      "uid",
+				EmailAttribute:       "mail",
+				GroupNameAttribute:   "cn",
+				GroupMemberAttribute: "member",
+				Timeout:              10 * time.Second,
+			},
 			InMemoryCacheTTL: 5 * time.Minute,
 		},
 		AttachmentsStore: AttachmentsStore{
@@ -74,6 +99,14 @@ func DefaultIMS() *IMSConfig {
 		BurningManAPI: BurningManAPI{
 			URL: "https://api.burningman.org",
 		},
+		Mail: Mail{
+			Type: MailNone,
+			SMTP: SMTPMail{
+				Port: 587,
+			},
+			InviteLifetime: 7 * 24 * time.Hour,
+			ResetLifetime:  time.Hour,
+		},
 	}
 }
 
@@ -89,21 +122,79 @@ func (c *IMSConfig) Validate() error {
 
 	// User directory
 	errs = append(errs, c.Directory.Directory.Validate())
-	if c.Directory.Directory != DirectoryTypeClubhouseDB {
+	if c.Directory.Directory != DirectoryTypeClubhouseDB && c.Directory.Directory != DirectoryTypeComposite {
 		c.Directory.ClubhouseDB = ClubhouseDB{}
 	}
+	if c.Directory.Directory == DirectoryTypeLDAP {
+		if c.Directory.LDAP.URL == "" || c.Directory.LDAP.BaseDN == "" {
+			errs = append(errs, errors.New("LDAP directory requires a URL and a base DN"))
+		}
+		if c.Directory.LDAP.UserIDAttribute == "" || c.Directory.LDAP.HandleAttribute == "" {
+			errs = append(errs, errors.New("LDAP directory requires a user ID attribute and a handle attribute"))
+		}
+		// Passwords are checked by binding as their users, so they'd otherwise
+		// cross the network in the clear.
+		if c.Core.Deployment != DeploymentTypeDev && !c.Directory.LDAP.Encrypted() {
+			errs = append(errs, errors.New("LDAP directory requires an ldaps:// URL or StartTLS outside of dev"))
+		}
+	} else {
+		c.Directory.LDAP = LDAP{}
+	}
 
 	// Deployment
 	errs = append(errs, c.Core.Deployment.Validate())
 	if c.Core.Deployment != DeploymentTypeDev {
-		if c.Directory.Directory != DirectoryTypeClubhouseDB && c.Directory.Directory != DirectoryTypeIMS {
-			errs = append(errs, errors.New("non-dev environments must use a ClubhouseDB or IMS directory"))
+		if c.Directory.Directory == DirectoryTypeNoOp {
+			errs = append(errs, errors.New("non-dev environments must use a ClubhouseDB, IMS, LDAP, or composite directory"))
 		}
 		if c.Store.Type != DBStoreTypeMaria {
 			errs = append(errs, errors.New("non-dev environments must use a MariaDB datastore"))
 		}
 	}
 
+	// Server-sent events
+	errs = append(errs, c.Core.SSEBroadcast.Validate())
+	if c.Core.SSEBroadcast == SSEBroadcastMariaDB {
+		if c.Store.Type != DBStoreTypeMaria {
+			errs = append(errs, errors.New("mariadb SSE broadcast requires a MariaDB datastore"))
+		}
+		if c.Core.SSEPollInterval <= 0 {
+			errs = append(errs, errors.New("mariadb SSE broadcast requires a positive poll interval"))
+		}
+	}
+
+	// Webhooks
+	if c.Core.WebhookMaxAttempts < 1 {
+		errs = append(errs, errors.New("webhooks need at least one attempt per delivery"))
+	}
+
+	// Login throttling
+	if c.Core.LoginLockoutFailures < 0 {
+		errs = append(errs, errors.New("login lockout failures can't be negative"))
+	}
+	if c.Core.LoginLockoutFailures > 0 && c.Core.LoginLockoutDuration <= 0 {
+		errs = append(errs, errors.New("login lockout requires a positive lockout duration"))
+	}
+
+	// Password hashing
+	if c.Core.PasswordHashParams == nil {
+		errs = append(errs, errors.New("password hash params are required"))
+	}
+	if c.Core.PasswordMinLength < 1 {
+		errs = append(errs, errors.New("password min length must be positive"))
+	}
+
+	// Break-glass access. The expression is parsed when the server starts.
+	if c.Core.BreakGlassDuration < 0 {
+		errs = append(errs, errors.New("break-glass duration can't be negative"))
+	}
+	if c.Core.BreakGlassDuration > 0 && strings.TrimSpace(c.Core.BreakGlassEligible) == "" {
+		errs = append(errs, errors.New("break-glass access requires an eligibility expression"))
+	}
+	if c.Core.BreakGlassDuration > 0 && !c.Mail.Enabled() {
+		errs = append(errs, errors.New("break-glass access requires mail, so that the admins are told of it"))
+	}
+
 	// Attachments store
 	errs = append(errs, c.AttachmentsStore.Type.Validate())
 	if c.AttachmentsStore.Type == AttachmentsStoreLocal {
@@ -126,6 +217,31 @@ func (c *IMSConfig) Validate() error {
 		c.AttachmentsStore.Local = LocalAttachments{}
 	}
 
+	// OpenID Connect
+	if c.OIDC.Enabled() && c.OIDC.RedirectURL == "" {
+		errs = append(errs, errors.New("OIDC login requires a redirect URL"))
+	}
+	if c.OIDC.Enabled() && c.Core.MasterKey == "" {
+		errs = append(errs, errors.New("OIDC login requires a master key"))
+	}
+
+	// Mail
+	errs = append(errs, c.Mail.Type.Validate())
+	if c.Mail.Enabled() {
+		if c.Mail.From == "" || c.Mail.PublicURL == "" {
+			errs = append(errs, errors.New("sending mail requires a From address and a public URL"))
+		}
+		if c.Mail.InviteLifetime <= 0 || c.Mail.ResetLifetime <= 0 {
+			errs = append(errs, errors.New("sending mail requires positive invite and reset lifetimes"))
+		}
+	}
+	if c.Mail.Type == MailSMTP && c.Mail.SMTP.Host == "" {
+		errs = append(errs, errors.New("smtp mail requires a host"))
+	}
+	if c.Mail.Type == MailMaildir && c.Mail.Maildir == nil {
+		errs = append(errs, errors.New("maildir mail requires a directory"))
+	}
+
 	// Assorted other validations
 	if c.Core.AccessTokenLifetime > c.Core.RefreshTokenLifetime {
 		errs = append(errs, errors.New("access token lifetime should not be greater than refresh token lifetime"))
@@ -147,6 +263,8 @@ type IMSConfig struct {
 	Store            DBStore
 	Directory        Directory
 	BurningManAPI    BurningManAPI
+	OIDC             OIDC
+	Mail             Mail
 }
 
 type DirectoryType string
@@ -156,10 +274,16 @@ type DeploymentType string
 
 type DBStoreType string
 
+type SSEBroadcastType string
+
+type MailType string
+
 // All these consts should have lowercase values to allow case-insensitive matching.
 const (
 	DirectoryTypeClubhouseDB DirectoryType        = "clubhousedb"
 	DirectoryTypeIMS         DirectoryType        = "ims"
+	DirectoryTypeLDAP        DirectoryType        = "ldap"
+	DirectoryTypeComposite   DirectoryType        = "composite"
 	DirectoryTypeNoOp        DirectoryType        = "noop"
 	AttachmentsStoreLocal    AttachmentsStoreType = "local"
 	AttachmentsStoreS3       AttachmentsStoreType = "s3"
@@ -170,6 +294,11 @@ const (
 	DeploymentTypeProduction DeploymentType       = "production"
 	DBStoreTypeMaria         DBStoreType          = "mariadb"
 	DBStoreTypeNoOp          DBStoreType          = "noop"
+	SSEBroadcastLocal        SSEBroadcastType     = "local"
+	SSEBroadcastMariaDB      SSEBroadcastType     = "mariadb"
+	MailNone                 MailType             = "none"
+	MailSMTP                 MailType             = "smtp"
+	MailMaildir              MailType             = "maildir"
 )
 
 func (d DBStoreType) Validate() error {
@@ -183,13 +312,19 @@ func (d DBStoreType) Validate() error {
 
 func (d DirectoryType) Validate() error {
 	switch d {
-	case DirectoryTypeClubhouseDB, DirectoryTypeIMS, DirectoryTypeNoOp:
+	case DirectoryTypeClubhouseDB, DirectoryTypeIMS, DirectoryTypeLDAP, DirectoryTypeComposite, DirectoryTypeNoOp:
 		return nil
 	default:
 		return fmt.Errorf("unknown directory type %v", d)
 	}
 }
 
+// IncludesIMS reports whether the directory has users from the IMS-native
+// directory, which IMS manages itself.
+func (d DirectoryType) IncludesIMS() bool {
+	return d == DirectoryTypeIMS || d == DirectoryTypeComposite
+}
+
 func (a AttachmentsStoreType) Validate() error {
 	switch a {
 	case AttachmentsStoreLocal, AttachmentsStoreS3, AttachmentsStoreNone:
@@ -199,6 +334,24 @@ func (a AttachmentsStoreType) Validate() error {
 	}
 }
 
+func (s SSEBroadcastType) Validate() error {
+	switch s {
+	case SSEBroadcastLocal, SSEBroadcastMariaDB:
+		return nil
+	default:
+		return fmt.Errorf("unknown SSE broadcast type %v", s)
+	}
+}
+
+func (m MailType) Validate() error {
+	switch m {
+	case MailNone, MailSMTP, MailMaildir:
+		return nil
+	default:
+		return fmt.Errorf("unknown mail type %v", m)
+	}
+}
+
 func (d DeploymentType) Validate() error {
 	switch d {
 	case DeploymentTypeDev, DeploymentTypeStaging, DeploymentTypeProduction, DeploymentTypeTraining:
@@ -216,8 +369,12 @@ type ConfigCore struct {
 	Admins               []string
 	MasterKey            string `redact:"true"`
 	// #nosec G117 // Exported secret struct field
-	JWTSecret  string `redact:"true"`
-	Deployment DeploymentType
+	JWTSecret string `redact:"true"`
+	// JWTPreviousSecrets are secrets that JWTs were once signed with. They're
+	// only used to verify JWTs, so that JWTSecret can be changed without logging
+	// everyone out. Drop them once the JWTs they signed have expired.
+	JWTPreviousSecrets []string `redact:"true"`
+	Deployment         DeploymentType
 
 	// CacheControlShort is the duration we set in various responses' Cache-Control headers
 	// for resources that aren't expected to change often, but still do change (e.g. the list of
@@ -247,6 +404,74 @@ type ConfigCore struct {
 	// test events. It should stay false in production, where such a destructive operation
 	// shouldn't be needed.
 	EventDeletionEnabled bool
+
+	// SSEBroadcast is how IMS servers tell each other about changes, for their
+	// server-sent event streams. "local" is for a single server, which needs no
+	// telling. Use "mariadb" when there are several behind a load balancer, and
+	// they'll share the events through the IMS database.
+	SSEBroadcast SSEBroadcastType
+
+	// SSEPollInterval is how often each server checks the IMS database for
+	// events, when SSEBroadcast is "mariadb". This is about how long it can take
+	// a change to reach browsers connected to the other servers.
+	SSEPollInterval time.Duration
+
+	// WebhookMaxAttempts is how many times IMS tries to make a webhook delivery,
+	// backing off exponentially in between, before giving up on it. With the
+	// default of 8, the last attempt comes up to about an hour after the first.
+	WebhookMaxAttempts int32
+
+	// LoginLockoutFailures is how many failed logins in a row it takes to lock
+	// a handle or email, so that no one can log in with it for the
+	// LoginLockoutDuration (or until an admin unlocks it). Set this to 0 to
+	// never lock anyone out. Failed logins are slowed down either way.
+	LoginLockoutFailures int32
+	LoginLockoutDuration time.Duration
+
+	// TrustedProxies are the addresses of the proxies in front of IMS, such as
+	// Cloudflare's or a load balancer's. Login throttling only believes the
+	// CF-Connecting-IP and X-Forwarded-For headers on requests from these, as
+	// anyone else could set them to get a fresh address for each guess.
+	TrustedProxies []netip.Prefix
+
+	// PasswordHashParams are the argon2id parameters for the IMS-native
+	// directory's password hashes. A hash made with weaker ones is replaced
+	// the next time its password is used to log in.
+	PasswordHashParams *argon2id.Params
+
+	// PasswordMinLength is the fewest characters that a password in the
+	// IMS-native directory may have.
+	PasswordMinLength int32
+
+	// PasswordBreachedCorpus is a local copy of the Have I Been Pwned
+	// breached-password corpus, as saved by its downloader in one file per
+	// hash prefix. When it's set, passwords that appear in it are refused.
+	PasswordBreachedCorpus *os.Root
+
+	// BreakGlassDuration is how long break-glass access lasts: that's when
+	// someone without read access to an Event reads one of its Incidents or
+	// Visits anyway, giving a reason, and the admins are emailed. It's 0 by
+	// default, which switches break-glass access off, and it can only be
+	// switched on when mail is.
+	BreakGlassDuration time.Duration
+
+	// BreakGlassEligible is an EVENT_ACCESS expression of who may break the
+	// glass, such as "position:Shift Lead OR team:Council". It must be set
+	// when break-glass access is switched on, since "*" is never assumed.
+	BreakGlassEligible string
+}
+
+// PasswordPolicy is what's required of every password that's set in the
+// IMS-native directory.
+func (c ConfigCore) PasswordPolicy() authn.PasswordPolicy {
+	policy := authn.PasswordPolicy{
+		MinLength: int(c.PasswordMinLength),
+		MaxLength: passwordMaxLength,
+	}
+	if c.PasswordBreachedCorpus != nil {
+		policy.Breached = authn.NewBreachedCorpus(c.PasswordBreachedCorpus)
+	}
+	return policy
 }
 
 // BurningManAPI configures IMS's access to the public Burning Man API, which
@@ -265,6 +490,65 @@ func (b BurningManAPI) Enabled() bool {
 	return b.URL != "" && b.APIKey != ""
 }
 
+// OIDC configures login through an OpenID Connect identity provider, such as
+// the one Clubhouse uses, as an alternative to typing a password into IMS.
+// It's optional: without an Issuer and ClientID, it's switched off.
+type OIDC struct {
+	// Issuer is the provider's issuer URL, under which its discovery document
+	// is found.
+	Issuer   string
+	ClientID string
+	// #nosec G117 // Exported secret struct field
+	ClientSecret string `redact:"true"`
+	// RedirectURL is IMS's OIDC callback, exactly as registered with the
+	// provider, e.g. "https://ims.example.com/ims/api/auth/oidc/callback".
+	RedirectURL string
+	// HandleClaim is the ID token claim that holds a Ranger's handle, if
+	// people are to be matched to the directory by it. That's only safe for a
+	// provider whose users can't pick that claim for themselves, so it's off
+	// by default, and people are matched only by their verified email.
+	HandleClaim string
+}
+
+// Enabled reports whether people can log in through the OIDC provider.
+func (o OIDC) Enabled() bool {
+	return o.Issuer != "" && o.ClientID != ""
+}
+
+// Mail configures the emails that IMS sends, which are the invitations and
+// password resets for the IMS-native directory. It's optional: without a
+// Type other than "none", those are switched off, and admins set everyone's
+// password by hand.
+type Mail struct {
+	// Type is "smtp" to send through an SMTP server, or "maildir" to drop the
+	// emails into a local Maildir instead, which is handy for development.
+	Type MailType
+	// From is who the emails are from, e.g. "Ranger IMS <ims@example.com>".
+	From string
+	// PublicURL is where people reach IMS, e.g. "https://ims.example.com".
+	// The links in the emails start with it.
+	PublicURL string
+	SMTP      SMTPMail
+	Maildir   *os.Root
+	// InviteLifetime and ResetLifetime are how long the links in invitation
+	// and password reset emails are good for.
+	InviteLifetime time.Duration
+	ResetLifetime  time.Duration
+}
+
+// Enabled reports whether IMS can send emails.
+func (m Mail) Enabled() bool {
+	return m.Type == MailSMTP || m.Type == MailMaildir
+}
+
+type SMTPMail struct {
+	Host     string
+	Port     int32
+	Username string
+	// #nosec G117 // Exported secret struct field
+	Password string `redact:"true"`
+}
+
 type DBStore struct {
 	Type    DBStoreType
 	MariaDB DBStoreMaria
@@ -283,6 +567,7 @@ type DBStoreMaria struct {
 type Directory struct {
 	Directory        DirectoryType
 	ClubhouseDB      ClubhouseDB
+	LDAP             LDAP
 	InMemoryCacheTTL time.Duration
 }
 
@@ -301,6 +586,53 @@ type ClubhouseDB struct {
 	MaxOpenConns int32
 }
 
+// LDAP configures an LDAP or Active Directory server as the user directory,
+// which is used when Directory is "ldap". Users are the entries that match
+// UserFilter, and teams and positions are the groups that match TeamFilter and
+// PositionFilter. Passwords are checked by binding as the user, so IMS never
+// sees a password hash.
+type LDAP struct {
+	// URL is e.g. "ldaps://ldap.example.com" or "ldap://ldap.example.com:389".
+	URL string
+	// StartTLS upgrades an ldap:// connection to TLS.
+	StartTLS bool
+	// BindDN and BindPassword are the service account that IMS searches the
+	// directory as.
+	BindDN string
+	// #nosec G117 // Exported secret struct field
+	BindPassword string `redact:"true"`
+	// BaseDN is the subtree in which users and groups are searched for.
+	BaseDN     string
+	UserFilter string
+	// UserIDAttribute is the attribute that holds each user's unique, unchanging
+	// ID, such as "entryUUID" (the default), "objectGUID" on Active Directory,
+	// or a numeric one like "uidNumber". A numeric ID is used as it is, and any
+	// other is made into a number.
+	UserIDAttribute string
+	HandleAttribute string
+	EmailAttribute  string
+	// TeamFilter and PositionFilter find the groups that are teams and the
+	// ones that are positions. Either may be empty, for no such groups.
+	TeamFilter     string
+	PositionFilter string
+	// GroupNameAttribute names each group. GroupMemberAttribute lists its
+	// members, by DN (as "member" does) or by handle (as "memberUid" does).
+	GroupNameAttribute   string
+	GroupMemberAttribute string
+	// Timeout bounds each round of calls to the server.
+	Timeout time.Duration
+}
+
+// Encrypted reports whether the connection to the server uses TLS, either
+// from the start with ldaps:// or by upgrading an ldap:// one with StartTLS.
+func (l LDAP) Encrypted() bool {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, "ldaps") || (strings.EqualFold(u.Scheme, "ldap") && l.StartTLS)
+}
+
 type LocalAttachments struct {
 	Dir *os.Root
 }
@@ -22,6 +22,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestPrintRedacted(t *testing.T) {
@@ -43,6 +44,16 @@ func TestPrintRedacted(t *testing.T) {
 				Password: "clubhouse password",
 			},
 		},
+		OIDC: conf.OIDC{
+			ClientID:     "oidc client",
+			ClientSecret: "oidc secret",
+		},
+		Mail: conf.Mail{
+			SMTP: conf.SMTPMail{
+				Username: "smtp username",
+				Password: "smtp password",
+			},
+		},
 	}
 
 	redacted := cfg.PrintRedacted()
@@ -52,6 +63,10 @@ func TestPrintRedacted(t *testing.T) {
 	assert.NotContains(t, redacted, "user password")
 	assert.Contains(t, redacted, "clubhouse username")
 	assert.NotContains(t, redacted, "clubhouse password")
+	assert.Contains(t, redacted, "oidc client")
+	assert.NotContains(t, redacted, "oidc secret")
+	assert.Contains(t, redacted, "smtp username")
+	assert.NotContains(t, redacted, "smtp password")
 }
 
 func TestValidateBase(t *testing.T) {
@@ -79,6 +94,46 @@ func TestValidateDirectory(t *testing.T) {
 	cfg := conf.DefaultIMS()
 	cfg.Directory.Directory = "invalid type"
 	require.Error(t, cfg.Validate())
+
+	// An LDAP directory needs a server and a base DN
+	cfg = conf.DefaultIMS()
+	cfg.Directory.Directory = conf.DirectoryTypeLDAP
+	require.Error(t, cfg.Validate())
+	cfg.Directory.LDAP.URL = "ldaps://ldap.example.com"
+	cfg.Directory.LDAP.BaseDN = "dc=example,dc=org"
+	require.NoError(t, cfg.Validate())
+	// and something to know each user by
+	cfg.Directory.LDAP.UserIDAttribute = ""
+	require.Error(t, cfg.Validate())
+	cfg.Directory.LDAP.UserIDAttribute = "entryUUID"
+	require.NoError(t, cfg.Validate())
+	cfg.Core.Deployment = conf.DeploymentTypeProduction
+	require.NoError(t, cfg.Validate())
+
+	// Outside of dev, the connection must be encrypted
+	cfg.Directory.LDAP.URL = "ldap://ldap.example.com"
+	require.Error(t, cfg.Validate())
+	cfg.Directory.LDAP.StartTLS = true
+	require.NoError(t, cfg.Validate())
+	cfg.Directory.LDAP.StartTLS = false
+	cfg.Core.Deployment = conf.DeploymentTypeDev
+	require.NoError(t, cfg.Validate())
+
+	// Other directories have no use for the LDAP settings
+	cfg = conf.DefaultIMS()
+	cfg.Directory.LDAP.URL = "ldaps://ldap.example.com"
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, conf.LDAP{}, cfg.Directory.LDAP)
+
+	// A composite directory keeps the Clubhouse settings, for its primary
+	cfg = conf.DefaultIMS()
+	cfg.Directory.Directory = conf.DirectoryTypeComposite
+	cfg.Directory.ClubhouseDB.Hostname = "clubhouse.example.com"
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, "clubhouse.example.com", cfg.Directory.ClubhouseDB.Hostname)
+	assert.True(t, cfg.Directory.Directory.IncludesIMS())
+	assert.True(t, conf.DirectoryTypeIMS.IncludesIMS())
+	assert.False(t, conf.DirectoryTypeClubhouseDB.IncludesIMS())
 }
 
 func TestValidateNonDevDeployment(t *testing.T) {
@@ -131,3 +186,135 @@ func TestValidateAttachmentsStore(t *testing.T) {
 	cfg.AttachmentsStore.Type = "invalid type"
 	require.Error(t, cfg.Validate())
 }
+
+func TestValidateSSEBroadcast(t *testing.T) {
+	t.Parallel()
+
+	cfg := conf.DefaultIMS()
+	cfg.Core.SSEBroadcast = conf.SSEBroadcastMariaDB
+	require.NoError(t, cfg.Validate())
+
+	cfg = conf.DefaultIMS()
+	cfg.Core.SSEBroadcast = "invalid type"
+	require.Error(t, cfg.Validate())
+
+	// the MariaDB broadcast needs the IMS database to be in MariaDB
+	cfg = conf.DefaultIMS()
+	cfg.Core.SSEBroadcast = conf.SSEBroadcastMariaDB
+	cfg.Store.Type = conf.DBStoreTypeNoOp
+	require.Error(t, cfg.Validate())
+
+	// and it can't poll without an interval
+	cfg = conf.DefaultIMS()
+	cfg.Core.SSEBroadcast = conf.SSEBroadcastMariaDB
+	cfg.Core.SSEPollInterval = 0
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidateWebhookMaxAttempts(t *testing.T) {
+	t.Parallel()
+
+	cfg := conf.DefaultIMS()
+	cfg.Core.WebhookMaxAttempts = 1
+	require.NoError(t, cfg.Validate())
+
+	cfg.Core.WebhookMaxAttempts = 0
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidateBreakGlass(t *testing.T) {
+	t.Parallel()
+
+	// Break-glass access is off by default
+	cfg := conf.DefaultIMS()
+	assert.Zero(t, cfg.Core.BreakGlassDuration)
+	require.NoError(t, cfg.Validate())
+
+	cfg.Core.BreakGlassDuration = -time.Minute
+	require.Error(t, cfg.Validate())
+
+	// Switching it on needs an explicit expression of who's eligible
+	cfg.Core.BreakGlassDuration = time.Hour
+	cfg.Mail.Type = conf.MailSMTP
+	cfg.Mail.From = "IMS <ims@example.com>"
+	cfg.Mail.PublicURL = "https://ims.example.com"
+	cfg.Mail.SMTP.Host = "smtp.example.com"
+	require.Error(t, cfg.Validate())
+	cfg.Core.BreakGlassEligible = "  "
+	require.Error(t, cfg.Validate())
+	cfg.Core.BreakGlassEligible = "position:Shift Lead"
+	require.NoError(t, cfg.Validate())
+
+	// and a way to tell the admins about it
+	cfg.Mail.Type = conf.MailNone
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidateLoginLockout(t *testing.T) {
+	t.Parallel()
+
+	cfg := conf.DefaultIMS()
+	require.NoError(t, cfg.Validate())
+
+	// No lockouts, so no need for a lockout duration
+	cfg.Core.LoginLockoutFailures = 0
+	cfg.Core.LoginLockoutDuration = 0
+	require.NoError(t, cfg.Validate())
+
+	cfg.Core.LoginLockoutFailures = 5
+	require.Error(t, cfg.Validate())
+
+	cfg.Core.LoginLockoutDuration = time.Minute
+	require.NoError(t, cfg.Validate())
+
+	cfg.Core.LoginLockoutFailures = -1
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidateOIDC(t *testing.T) {
+	t.Parallel()
+
+	cfg := conf.DefaultIMS()
+	assert.False(t, cfg.OIDC.Enabled())
+
+	cfg.OIDC.Issuer = "https://idp.example.com"
+	cfg.OIDC.ClientID = "ims"
+	assert.True(t, cfg.OIDC.Enabled())
+	require.Error(t, cfg.Validate())
+
+	cfg.OIDC.RedirectURL = "https://ims.example.com/ims/api/auth/oidc/callback"
+	require.Error(t, cfg.Validate())
+
+	cfg.Core.MasterKey = "some master key"
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidateMail(t *testing.T) {
+	t.Parallel()
+
+	cfg := conf.DefaultIMS()
+	assert.False(t, cfg.Mail.Enabled())
+	require.NoError(t, cfg.Validate())
+
+	cfg.Mail.Type = "pigeon"
+	require.Error(t, cfg.Validate())
+
+	cfg.Mail.Type = conf.MailSMTP
+	assert.True(t, cfg.Mail.Enabled())
+	require.Error(t, cfg.Validate())
+	cfg.Mail.From = "IMS <ims@example.com>"
+	cfg.Mail.PublicURL = "https://ims.example.com"
+	require.Error(t, cfg.Validate())
+	cfg.Mail.SMTP.Host = "smtp.example.com"
+	require.NoError(t, cfg.Validate())
+
+	cfg.Mail.Type = conf.MailMaildir
+	require.Error(t, cfg.Validate())
+	dir, err := os.OpenRoot(t.TempDir())
+	require.NoError(t, err)
+	cfg.Mail.Maildir = dir
+	require.NoError(t, cfg.Validate())
+
+	cfg.Mail.ResetLifetime = 0
+	require.Error(t, cfg.Validate())
+}
@@ -0,0 +1,161 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// GuestIDOffset is added to the IDs of the guests' users, teams, and
+// positions in a CompositeSource, so that they never collide with the primary
+// source's. Clubhouse IDs are nowhere near this big, and the sum still fits
+// in a JavaScript number.
+const GuestIDOffset int64 = 1 << 40
+
+// CompositeSource is a directory Source that unions a primary Source, i.e. a
+// Clubhouse database, with guest accounts from the IMS-native directory, such
+// as for outside agencies that aren't in Clubhouse. It is used when
+// IMS_DIRECTORY is "composite".
+//
+// The primary's IDs are kept as they are, and the guests' are moved up by
+// GuestIDOffset. Teams and positions from both sides are kept, even when
+// their names are the same, so an event access rule for a name covers both.
+// When a guest has the handle or email of a primary user, the primary user
+// wins and the guest is left out, as the guest could otherwise log in as them.
+type CompositeSource struct {
+	primary Source
+	guests  Source
+}
+
+var (
+	_ Source   = (*CompositeSource)(nil)
+	_ imsUsers = (*CompositeSource)(nil)
+)
+
+// NewCompositeSource unions the primary Source with the guests, which are
+// normally an IMSSource.
+func NewCompositeSource(primary, guests Source) *CompositeSource {
+	return &CompositeSource{primary: primary, guests: guests}
+}
+
+func (s *CompositeSource) FetchUsers(ctx context.Context) (map[int64]*User, error) {
+	var errs []error
+	primaryUsers, err := s.primary.FetchUsers(ctx)
+	errs = append(errs, err)
+	guestUsers, err := s.guests.FetchUsers(ctx)
+	errs = append(errs, err)
+	err = errors.Join(errs...)
+	if err != nil {
+		return nil, fmt.Errorf("[FetchUsers] primary, guests: %w", err)
+	}
+
+	m := make(map[int64]*User, len(primaryUsers)+len(guestUsers))
+	taken := make(map[string]bool, 2*len(primaryUsers))
+	for id, user := range primaryUsers {
+		if id >= GuestIDOffset {
+			slog.Warn("Skipping directory user with an ID in the guest range", "handle", user.Handle, "id", id)
+			continue
+		}
+		m[id] = user
+		taken[strings.ToLower(user.Handle)] = true
+		if user.Email != "" {
+			taken[strings.ToLower(user.Email)] = true
+		}
+	}
+	// Guests are gone through in ID order, so that it's always the same one
+	// that's kept, should guests conflict among themselves.
+	for _, id := range slices.Sorted(maps.Keys(guestUsers)) {
+		guest := *guestUsers[id]
+		handle, email := strings.ToLower(guest.Handle), strings.ToLower(guest.Email)
+		if taken[handle] || (email != "" && taken[email]) {
+			slog.Warn("Skipping guest whose handle or email is already in the directory", "handle", guest.Handle)
+			continue
+		}
+		taken[handle] = true
+		if email != "" {
+			taken[email] = true
+		}
+		guest.ID += GuestIDOffset
+		guest.PositionIDs = offsetIDs(guest.PositionIDs)
+		guest.TeamIDs = offsetIDs(guest.TeamIDs)
+		if guest.OnDutyPositionID != nil {
+			guest.OnDutyPositionID = new(*guest.OnDutyPositionID + GuestIDOffset)
+		}
+		m[guest.ID] = &guest
+	}
+	return m, nil
+}
+
+func (s *CompositeSource) FetchPositions(ctx context.Context) (map[int64]string, error) {
+	return s.union(ctx, Source.FetchPositions)
+}
+
+func (s *CompositeSource) FetchTeams(ctx context.Context) (map[int64]string, error) {
+	return s.union(ctx, Source.FetchTeams)
+}
+
+func (s *CompositeSource) union(
+	ctx context.Context, fetch func(Source, context.Context) (map[int64]string, error),
+) (map[int64]string, error) {
+	var errs []error
+	primary, err := fetch(s.primary, ctx)
+	errs = append(errs, err)
+	guests, err := fetch(s.guests, ctx)
+	errs = append(errs, err)
+	err = errors.Join(errs...)
+	if err != nil {
+		return nil, fmt.Errorf("[fetch] primary, guests: %w", err)
+	}
+	m := make(map[int64]string, len(primary)+len(guests))
+	for id, name := range primary {
+		if id < GuestIDOffset {
+			m[id] = name
+		}
+	}
+	for id, name := range guests {
+		m[id+GuestIDOffset] = name
+	}
+	return m, nil
+}
+
+func (s *CompositeSource) imsPersonID(userID int64) (int64, bool) {
+	if userID < GuestIDOffset {
+		return 0, false
+	}
+	return userID - GuestIDOffset, true
+}
+
+func (s *CompositeSource) userID(imsPersonID int64) int64 {
+	return imsPersonID + GuestIDOffset
+}
+
+func offsetIDs(ids []int64) []int64 {
+	if ids == nil {
+		return nil
+	}
+	offset := make([]int64, len(ids))
+	for i, id := range ids {
+		offset[i] = id + GuestIDOffset
+	}
+	return offset
+}
@@ -0,0 +1,166 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package directory_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/directory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSource is a directory Source with fixed contents.
+type fakeSource struct {
+	users     map[int64]*directory.User
+	positions map[int64]string
+	teams     map[int64]string
+	err       error
+}
+
+func (s fakeSource) FetchUsers(context.Context) (map[int64]*directory.User, error) {
+	return s.users, s.err
+}
+
+func (s fakeSource) FetchPositions(context.Context) (map[int64]string, error) {
+	return s.positions, s.err
+}
+
+func (s fakeSource) FetchTeams(context.Context) (map[int64]string, error) {
+	return s.teams, s.err
+}
+
+func newFakeSources() (primary, guests fakeSource) {
+	primary = fakeSource{
+		users: map[int64]*directory.User{
+			1: {ID: 1, Handle: "Tool", Email: "tool@example.com", TeamIDs: []int64{1}, PositionIDs: []int64{1}},
+			2: {ID: 2, Handle: "Hardware"},
+		},
+		positions: map[int64]string{1: "Operator"},
+		teams:     map[int64]string{1: "Council"},
+	}
+	guests = fakeSource{
+		users: map[int64]*directory.User{
+			1: {ID: 1, Handle: "Deputy Dawg", Email: "dawg@sheriff.example", TeamIDs: []int64{2}, PositionIDs: []int64{1}},
+			// Same handle as a primary user, but in a different case.
+			2: {ID: 2, Handle: "TOOL"},
+			// Same email as a primary user.
+			3: {ID: 3, Handle: "Impostor", Email: "Tool@Example.com"},
+		},
+		positions: map[int64]string{1: "Deputy"},
+		teams:     map[int64]string{1: "Council", 2: "Sheriff"},
+	}
+	return primary, guests
+}
+
+func TestCompositeSourceFetch(t *testing.T) {
+	t.Parallel()
+	primary, guests := newFakeSources()
+	source := directory.NewCompositeSource(primary, guests)
+	ctx := t.Context()
+
+	users, err := source.FetchUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+	assert.Equal(t, "Tool", users[1].Handle)
+	assert.Equal(t, []int64{1}, users[1].TeamIDs)
+	assert.Equal(t, "Hardware", users[2].Handle)
+	dawg := users[1+directory.GuestIDOffset]
+	require.NotNil(t, dawg)
+	assert.Equal(t, "Deputy Dawg", dawg.Handle)
+	assert.Equal(t, 1+directory.GuestIDOffset, dawg.ID)
+	assert.Equal(t, []int64{2 + directory.GuestIDOffset}, dawg.TeamIDs)
+	assert.Equal(t, []int64{1 + directory.GuestIDOffset}, dawg.PositionIDs)
+	// The guest source's own users are left alone.
+	assert.Equal(t, int64(1), guests.users[1].ID)
+	assert.Equal(t, []int64{2}, guests.users[1].TeamIDs)
+
+	positions, err := source.FetchPositions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int64]string{
+		1:                           "Operator",
+		1 + directory.GuestIDOffset: "Deputy",
+	}, positions)
+
+	teams, err := source.FetchTeams(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int64]string{
+		1:                           "Council",
+		1 + directory.GuestIDOffset: "Council",
+		2 + directory.GuestIDOffset: "Sheriff",
+	}, teams)
+}
+
+func TestCompositeSourcePrimaryInGuestRange(t *testing.T) {
+	t.Parallel()
+	primary, guests := newFakeSources()
+	primary.users[directory.GuestIDOffset] = &directory.User{ID: directory.GuestIDOffset, Handle: "Too Big"}
+	primary.teams[directory.GuestIDOffset+1] = "Too Big"
+	source := directory.NewCompositeSource(primary, guests)
+
+	users, err := source.FetchUsers(t.Context())
+	require.NoError(t, err)
+	for _, user := range users {
+		assert.NotEqual(t, "Too Big", user.Handle)
+	}
+	teams, err := source.FetchTeams(t.Context())
+	require.NoError(t, err)
+	// The guests' Council team wins over the primary's team with its ID.
+	assert.Equal(t, "Council", teams[directory.GuestIDOffset+1])
+}
+
+func TestCompositeSourceErrors(t *testing.T) {
+	t.Parallel()
+	primary, guests := newFakeSources()
+	guests.err = errors.New("no database")
+	source := directory.NewCompositeSource(primary, guests)
+	ctx := t.Context()
+
+	_, err := source.FetchUsers(ctx)
+	require.ErrorIs(t, err, guests.err)
+	_, err = source.FetchPositions(ctx)
+	require.ErrorIs(t, err, guests.err)
+	_, err = source.FetchTeams(ctx)
+	require.ErrorIs(t, err, guests.err)
+}
+
+func TestUserStoreIMSPersonID(t *testing.T) {
+	t.Parallel()
+	primary, guests := newFakeSources()
+
+	store := directory.NewUserStore(directory.NewCompositeSource(primary, guests), time.Minute)
+	personID, ok := store.IMSPersonID(7 + directory.GuestIDOffset)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), personID)
+	_, ok = store.IMSPersonID(7)
+	assert.False(t, ok)
+	assert.Equal(t, 7+directory.GuestIDOffset, store.UserID(7))
+
+	store = directory.NewUserStore(directory.NewIMSSource(nil), time.Minute)
+	personID, ok = store.IMSPersonID(7)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), personID)
+	assert.Equal(t, int64(7), store.UserID(7))
+
+	store = directory.NewUserStore(primary, time.Minute)
+	_, ok = store.IMSPersonID(7)
+	assert.False(t, ok)
+	assert.Equal(t, int64(7), store.UserID(7))
+}
@@ -40,6 +40,25 @@ type Source interface {
 	FetchTeams(ctx context.Context) (map[int64]string, error)
 }
 
+// PasswordVerifier is a Source that checks passwords itself, rather than
+// giving out password hashes in User.Password, e.g. because it has none to
+// give.
+type PasswordVerifier interface {
+	// VerifyPassword reports whether the password is the user's.
+	VerifyPassword(ctx context.Context, user *User, password string) (bool, error)
+}
+
+// imsUsers is a Source whose users are, at least in part, people in the
+// IMS-native directory's tables, which is where their TOTP enrollments,
+// password tokens, and such are kept.
+type imsUsers interface {
+	// imsPersonID gives the DIRECTORY_PERSON ID of a user, if they're from
+	// the IMS-native directory.
+	imsPersonID(userID int64) (personID int64, ok bool)
+	// userID gives the user ID of a DIRECTORY_PERSON.
+	userID(imsPersonID int64) int64
+}
+
 type UserStore struct {
 	source        Source
 	userCache     *cache.InMemory[map[int64]*User]
@@ -92,6 +111,32 @@ func (store *UserStore) Flush() {
 	store.teamCache.Invalidate()
 }
 
+// PasswordVerifier gives the Source, if it checks passwords itself.
+func (store *UserStore) PasswordVerifier() (PasswordVerifier, bool) {
+	verifier, ok := store.source.(PasswordVerifier)
+	return verifier, ok
+}
+
+// IMSPersonID gives the IMS-native directory's ID for a user, i.e. their
+// DIRECTORY_PERSON ID, if they're from the IMS-native directory at all.
+func (store *UserStore) IMSPersonID(userID int64) (int64, bool) {
+	ims, ok := store.source.(imsUsers)
+	if !ok {
+		return 0, false
+	}
+	return ims.imsPersonID(userID)
+}
+
+// UserID gives the user ID of someone in the IMS-native directory, from their
+// DIRECTORY_PERSON ID. It's the ID that's in their JWTs and sessions.
+func (store *UserStore) UserID(imsPersonID int64) int64 {
+	ims, ok := store.source.(imsUsers)
+	if !ok {
+		return imsPersonID
+	}
+	return ims.userID(imsPersonID)
+}
+
 func (store *UserStore) GetAllUsers(ctx context.Context) (map[int64]*User, error) {
 	users, err := store.userCache.Get(ctx)
 	if err != nil {
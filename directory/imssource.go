@@ -33,13 +33,17 @@ const IMSUserStatus = "active"
 // which live in the IMS database. It is used when a deployment has no
 // Clubhouse database, i.e. when IMS_DIRECTORY is "ims".
 //
-// Users from this source never have an on-duty position, so "onduty:"
-// access expressions never match them.
+// A user is on duty in a position when a directory admin has signed them in
+// to it, and for as long as the position is active. "onduty:" access
+// expressions match them then, as they would a Clubhouse user on shift.
 type IMSSource struct {
 	imsDBQ *store.DBQ
 }
 
-var _ Source = (*IMSSource)(nil)
+var (
+	_ Source   = (*IMSSource)(nil)
+	_ imsUsers = (*IMSSource)(nil)
+)
 
 func NewIMSSource(imsDBQ *store.DBQ) *IMSSource {
 	return &IMSSource{imsDBQ: imsDBQ}
@@ -89,6 +93,15 @@ func (s *IMSSource) FetchUsers(ctx context.Context) (map[int64]*User, error) {
 			person.PositionNames = append(person.PositionNames, positionName)
 		}
 	}
+	for _, person := range persons {
+		if !person.OnDutyPositionID.Valid {
+			continue
+		}
+		if positionName, ok := positions[person.OnDutyPositionID.Int64]; ok {
+			m[person.ID].OnDutyPositionID = &person.OnDutyPositionID.Int64
+			m[person.ID].OnDutyPositionName = &positionName
+		}
+	}
 	for _, pt := range personTeams {
 		person, personOK := m[pt.PersonID]
 		teamName, teamOK := teams[pt.TeamID]
@@ -123,3 +136,13 @@ func (s *IMSSource) FetchTeams(ctx context.Context) (map[int64]string, error) {
 	}
 	return teams, nil
 }
+
+// The IMS-native directory's users have the same IDs in IMS as in its tables.
+
+func (s *IMSSource) imsPersonID(userID int64) (int64, bool) {
+	return userID, true
+}
+
+func (s *IMSSource) userID(imsPersonID int64) int64 {
+	return imsPersonID
+}
@@ -0,0 +1,317 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+
+	"github.com/burningmantech/ranger-ims-go/conf"
+	"github.com/burningmantech/ranger-ims-go/lib/conv"
+	"github.com/burningmantech/ranger-ims-go/lib/ldap"
+)
+
+// LDAPUserStatus is the status reported for every user from an LDAP
+// directory, which has no Clubhouse-style status taxonomy.
+const LDAPUserStatus = "active"
+
+// ldapPageSize is how many entries are asked for at a time. It's within
+// Active Directory's default MaxPageSize of 1000.
+const ldapPageSize = 500
+
+// LDAPSource is a directory Source backed by an LDAP or Active Directory
+// server. It is used when IMS_DIRECTORY is "ldap".
+//
+// LDAP won't give out password hashes, so users from this source have no
+// Password. Instead, the source is a PasswordVerifier, which checks a
+// password by binding to the server as its user.
+//
+// Users from this source are never onsite and never have an on-duty position,
+// since LDAP has no notion of either. Group membership isn't nested: a user is
+// only on a team or in a position when they're listed as a member of its group.
+type LDAPSource struct {
+	cfg conf.LDAP
+	// allowPlaintext lets the source use an unencrypted connection, which is
+	// only for development.
+	allowPlaintext bool
+}
+
+var (
+	_ Source           = (*LDAPSource)(nil)
+	_ PasswordVerifier = (*LDAPSource)(nil)
+)
+
+// NewLDAPSource gives a source for the server in cfg. Unless allowPlaintext
+// is set, it won't connect without TLS.
+func NewLDAPSource(cfg conf.LDAP, allowPlaintext bool) *LDAPSource {
+	return &LDAPSource{cfg: cfg, allowPlaintext: allowPlaintext}
+}
+
+func (s *LDAPSource) FetchUsers(ctx context.Context) (map[int64]*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("[connect]: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	userAttributes := []string{s.cfg.HandleAttribute}
+	if s.cfg.EmailAttribute != "" {
+		userAttributes = append(userAttributes, s.cfg.EmailAttribute)
+	}
+	if s.cfg.UserIDAttribute != "" {
+		userAttributes = append(userAttributes, s.cfg.UserIDAttribute)
+	}
+	entries, err := s.search(ctx, conn, s.cfg.UserFilter, userAttributes)
+	if err != nil {
+		return nil, fmt.Errorf("[search] users: %w", err)
+	}
+	groupAttributes := []string{s.cfg.GroupNameAttribute, s.cfg.GroupMemberAttribute}
+	var errs []error
+	teamGroups, err := s.search(ctx, conn, s.cfg.TeamFilter, groupAttributes)
+	errs = append(errs, err)
+	positionGroups, err := s.search(ctx, conn, s.cfg.PositionFilter, groupAttributes)
+	errs = append(errs, err)
+	err = errors.Join(errs...)
+	if err != nil {
+		return nil, fmt.Errorf("[search] teams, positions: %w", err)
+	}
+
+	m := make(map[int64]*User, len(entries))
+	byDN := make(map[string]*User, len(entries))
+	byHandle := make(map[string]*User, len(entries))
+	for _, entry := range entries {
+		handle := entry.Get(s.cfg.HandleAttribute)
+		if handle == "" {
+			// There'd be no way to log in as them, nor to refer to them.
+			continue
+		}
+		id, err := s.userID(entry)
+		if err != nil {
+			slog.Warn("Skipping LDAP user without a usable ID", "dn", entry.DN, "error", err)
+			continue
+		}
+		if _, ok := m[id]; ok {
+			slog.Warn("Skipping LDAP user with a duplicate ID", "dn", entry.DN, "id", id)
+			continue
+		}
+		user := &User{
+			ID:     id,
+			Handle: handle,
+			Status: LDAPUserStatus,
+		}
+		if s.cfg.EmailAttribute != "" {
+			user.Email = entry.Get(s.cfg.EmailAttribute)
+		}
+		m[id] = user
+		byDN[ldap.NormalizeDN(entry.DN)] = user
+		byHandle[strings.ToLower(handle)] = user
+	}
+
+	// A group's members are listed by DN, or, for a posixGroup's memberUid,
+	// by handle.
+	members := func(group ldap.Entry) []*User {
+		var users []*User
+		for _, member := range group.Values(s.cfg.GroupMemberAttribute) {
+			if user, ok := byDN[ldap.NormalizeDN(member)]; ok {
+				users = append(users, user)
+			} else if user, ok = byHandle[strings.ToLower(member)]; ok {
+				users = append(users, user)
+			}
+		}
+		return users
+	}
+	for _, group := range teamGroups {
+		name := group.Get(s.cfg.GroupNameAttribute)
+		if name == "" {
+			continue
+		}
+		for _, user := range members(group) {
+			user.TeamIDs = append(user.TeamIDs, dnID(group.DN))
+			user.TeamNames = append(user.TeamNames, name)
+		}
+	}
+	for _, group := range positionGroups {
+		name := group.Get(s.cfg.GroupNameAttribute)
+		if name == "" {
+			continue
+		}
+		for _, user := range members(group) {
+			user.PositionIDs = append(user.PositionIDs, dnID(group.DN))
+			user.PositionNames = append(user.PositionNames, name)
+		}
+	}
+	return m, nil
+}
+
+func (s *LDAPSource) FetchPositions(ctx context.Context) (map[int64]string, error) {
+	return s.fetchGroupNames(ctx, s.cfg.PositionFilter)
+}
+
+func (s *LDAPSource) FetchTeams(ctx context.Context) (map[int64]string, error) {
+	return s.fetchGroupNames(ctx, s.cfg.TeamFilter)
+}
+
+// VerifyPassword finds the user's entry by their handle, then binds as it with
+// the password. Only a server that rejects the password gives false without an
+// error; one that can't be reached gives an error.
+func (s *LDAPSource) VerifyPassword(ctx context.Context, user *User, password string) (bool, error) {
+	if password == "" {
+		return false, nil
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return false, fmt.Errorf("[connect]: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	filter := fmt.Sprintf("(&%v(%v=%v))",
+		parenthesize(s.cfg.UserFilter), s.cfg.HandleAttribute, ldap.EscapeFilter(user.Handle),
+	)
+	// "1.1" asks for no attributes at all (RFC 4511 section 4.5.1.8).
+	entries, err := s.search(ctx, conn, filter, []string{"1.1"})
+	if err != nil {
+		return false, fmt.Errorf("[search]: %w", err)
+	}
+	if len(entries) != 1 {
+		// Either they've left the directory since it was last fetched, or
+		// their handle is ambiguous. Neither can be logged into.
+		slog.Warn("No unique LDAP user for handle", "handle", user.Handle, "matches", len(entries))
+		return false, nil
+	}
+	err = conn.Bind(ctx, entries[0].DN, password)
+	if ldap.IsInvalidCredentials(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("[Bind]: %w", err)
+	}
+	return true, nil
+}
+
+func (s *LDAPSource) fetchGroupNames(ctx context.Context, filter string) (map[int64]string, error) {
+	if filter == "" {
+		return map[int64]string{}, nil
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("[connect]: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	groups, err := s.search(ctx, conn, filter, []string{s.cfg.GroupNameAttribute})
+	if err != nil {
+		return nil, fmt.Errorf("[search]: %w", err)
+	}
+	names := make(map[int64]string, len(groups))
+	for _, group := range groups {
+		if name := group.Get(s.cfg.GroupNameAttribute); name != "" {
+			names[dnID(group.DN)] = name
+		}
+	}
+	return names, nil
+}
+
+// userID gives the user's ID from UserIDAttribute. A numeric value is the ID,
+// and any other, such as an entryUUID, is hashed into one.
+func (s *LDAPSource) userID(entry ldap.Entry) (int64, error) {
+	value := entry.Get(s.cfg.UserIDAttribute)
+	if value == "" {
+		return 0, fmt.Errorf("no %v", s.cfg.UserIDAttribute)
+	}
+	if id, err := conv.ParseInt64(value); err == nil {
+		return id, nil
+	}
+	return hashID(value), nil
+}
+
+// dnID makes a stable ID out of a DN, for a group, which has no ID attribute
+// of its own.
+func dnID(dn string) int64 {
+	return hashID(ldap.NormalizeDN(dn))
+}
+
+// hashID makes a stable ID out of a string. It fits within 53 bits, so that it
+// survives the trip through a JavaScript number.
+func hashID(s string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return int64(h.Sum64() & (1<<53 - 1))
+}
+
+// connect dials the server and binds as the service account. Without a bind
+// password, the connection stays anonymous, for servers that allow that.
+func (s *LDAPSource) connect(ctx context.Context) (*ldap.Conn, error) {
+	if !s.allowPlaintext && !s.cfg.Encrypted() {
+		return nil, errors.New("refusing to connect to LDAP without ldaps:// or StartTLS")
+	}
+	conn, err := ldap.Dial(ctx, s.cfg.URL, ldap.DialOptions{StartTLS: s.cfg.StartTLS})
+	if err != nil {
+		return nil, fmt.Errorf("[Dial]: %w", err)
+	}
+	if s.cfg.BindPassword != "" {
+		if err = conn.Bind(ctx, s.cfg.BindDN, s.cfg.BindPassword); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("[Bind] service account: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// search finds the entries under BaseDN that match the filter, or none if
+// the filter is empty.
+func (s *LDAPSource) search(ctx context.Context, conn *ldap.Conn, filter string, attributes []string) ([]ldap.Entry, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	entries, err := conn.Search(ctx, ldap.SearchRequest{
+		BaseDN:     s.cfg.BaseDN,
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     filter,
+		Attributes: attributes,
+		PageSize:   ldapPageSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[Search]: %w", err)
+	}
+	return entries, nil
+}
+
+func (s *LDAPSource) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cfg.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.cfg.Timeout)
+}
+
+// parenthesize wraps a filter in parentheses, if it isn't already, so that it
+// can be combined with others.
+func parenthesize(filter string) string {
+	filter = strings.TrimSpace(filter)
+	if strings.HasPrefix(filter, "(") {
+		return filter
+	}
+	return "(" + filter + ")"
+}
@@ -0,0 +1,217 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package directory_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/conf"
+	"github.com/burningmantech/ranger-ims-go/directory"
+	"github.com/burningmantech/ranger-ims-go/lib/ldap/ldaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLDAPServer(t *testing.T) (*ldaptest.Server, conf.LDAP) {
+	t.Helper()
+	s := ldaptest.NewServer()
+	t.Cleanup(s.Close)
+	s.AddEntry("cn=ims,ou=services,dc=example,dc=org", "service secret", map[string][]string{
+		"objectClass": {"applicationProcess"},
+	})
+	s.AddEntry("uid=tool,ou=people,dc=example,dc=org", "tool password", map[string][]string{
+		"objectClass":    {"inetOrgPerson"},
+		"uid":            {"Tool"},
+		"mail":           {"tool@example.com"},
+		"employeeNumber": {"101"},
+		"entryUUID":      {"9f1c2b9e-3b8a-4d52-8e0f-5a2f6a3c1d01"},
+	})
+	s.AddEntry("uid=hardware,ou=people,dc=example,dc=org", "hardware password", map[string][]string{
+		"objectClass":    {"inetOrgPerson"},
+		"uid":            {"Hardware"},
+		"employeeNumber": {"102"},
+		"entryUUID":      {"4be0643f-1d98-473a-9dc4-a0f6b7e2c5a2"},
+	})
+	// Not a person, so not a user.
+	s.AddEntry("cn=printer,ou=devices,dc=example,dc=org", "", map[string][]string{
+		"objectClass": {"device"},
+		"uid":         {"printer"},
+	})
+	s.AddEntry("cn=Council,ou=teams,ou=groups,dc=example,dc=org", "", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"Council"},
+		"member":      {"uid=tool, ou=people, dc=example, dc=org", "uid=departed,ou=people,dc=example,dc=org"},
+	})
+	s.AddEntry("cn=Operator,ou=positions,ou=groups,dc=example,dc=org", "", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"Operator"},
+		"member":      {"UID=Tool,OU=People,DC=Example,DC=Org", "uid=hardware,ou=people,dc=example,dc=org"},
+	})
+	return s, conf.LDAP{
+		URL:                  s.URL,
+		BindDN:               "cn=ims,ou=services,dc=example,dc=org",
+		BindPassword:         "service secret",
+		BaseDN:               "dc=example,dc=org",
+		UserFilter:           "(objectClass=inetOrgPerson)",
+		UserIDAttribute:      "employeeNumber",
+		HandleAttribute:      "uid",
+		EmailAttribute:       "mail",
+		TeamFilter:           "(&(objectClass=groupOfNames)(cn=*))",
+		PositionFilter:       "(cn=Operator)",
+		GroupNameAttribute:   "cn",
+		GroupMemberAttribute: "member",
+		Timeout:              5 * time.Second,
+	}
+}
+
+func TestLDAPSourceFetch(t *testing.T) {
+	t.Parallel()
+	_, cfg := newLDAPServer(t)
+	// Every group matches the team filter, so Operator is a team as well as a
+	// position.
+	source := directory.NewLDAPSource(cfg, true)
+	ctx := t.Context()
+
+	users, err := source.FetchUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	tool := users[101]
+	require.NotNil(t, tool)
+	assert.Equal(t, "Tool", tool.Handle)
+	assert.Equal(t, "tool@example.com", tool.Email)
+	assert.Equal(t, directory.LDAPUserStatus, tool.Status)
+	assert.False(t, tool.Onsite)
+	assert.Empty(t, tool.Password)
+	slices.Sort(tool.TeamNames)
+	assert.Equal(t, []string{"Council", "Operator"}, tool.TeamNames)
+	assert.Equal(t, []string{"Operator"}, tool.PositionNames)
+	hardware := users[102]
+	require.NotNil(t, hardware)
+	assert.Empty(t, hardware.Email)
+	assert.Equal(t, []string{"Operator"}, hardware.TeamNames)
+	assert.Equal(t, []string{"Operator"}, hardware.PositionNames)
+
+	positions, err := source.FetchPositions(ctx)
+	require.NoError(t, err)
+	require.Len(t, positions, 1)
+	assert.Equal(t, tool.PositionIDs[0], hardware.PositionIDs[0])
+	assert.Equal(t, "Operator", positions[tool.PositionIDs[0]])
+
+	teams, err := source.FetchTeams(ctx)
+	require.NoError(t, err)
+	assert.Len(t, teams, 2)
+	for i, id := range tool.TeamIDs {
+		assert.Equal(t, tool.TeamNames[i], teams[id])
+	}
+}
+
+func TestLDAPSourceNonNumericIDs(t *testing.T) {
+	t.Parallel()
+	_, cfg := newLDAPServer(t)
+	cfg.UserIDAttribute = "entryUUID"
+	cfg.PositionFilter = ""
+	source := directory.NewLDAPSource(cfg, true)
+
+	users, err := source.FetchUsers(t.Context())
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	for id, user := range users {
+		assert.Equal(t, id, user.ID)
+		// IDs must be safe as JavaScript numbers.
+		assert.Positive(t, id)
+		assert.Less(t, id, int64(1)<<53)
+		assert.Empty(t, user.PositionIDs)
+	}
+	// They're stable from one fetch to the next.
+	again, err := source.FetchUsers(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, users, again)
+
+	positions, err := source.FetchPositions(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, positions)
+}
+
+func TestLDAPSourceSkipsUsersWithoutIDs(t *testing.T) {
+	t.Parallel()
+	_, cfg := newLDAPServer(t)
+	// There'd be nothing stable to know them by
+	cfg.UserIDAttribute = "uidNumber"
+
+	users, err := directory.NewLDAPSource(cfg, true).FetchUsers(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, users)
+}
+
+func TestLDAPSourceVerifyPassword(t *testing.T) {
+	t.Parallel()
+	_, cfg := newLDAPServer(t)
+	source := directory.NewLDAPSource(cfg, true)
+	ctx := t.Context()
+	users, err := source.FetchUsers(ctx)
+	require.NoError(t, err)
+	tool := users[101]
+
+	ok, err := source.VerifyPassword(ctx, tool, "tool password")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = source.VerifyPassword(ctx, tool, "hardware password")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// An empty password would be an anonymous bind, which always succeeds.
+	ok, err = source.VerifyPassword(ctx, tool, "")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// A handle can't be used to search for someone else.
+	ok, err = source.VerifyPassword(ctx, &directory.User{Handle: "*"}, "tool password")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// A bad service account is an error, not a wrong password.
+	cfg.BindPassword = "wrong"
+	_, err = directory.NewLDAPSource(cfg, true).VerifyPassword(ctx, tool, "tool password")
+	require.Error(t, err)
+}
+
+func TestUserStorePasswordVerifier(t *testing.T) {
+	t.Parallel()
+	_, cfg := newLDAPServer(t)
+	store := directory.NewUserStore(directory.NewLDAPSource(cfg, true), time.Minute)
+	verifier, ok := store.PasswordVerifier()
+	require.True(t, ok)
+	assert.NotNil(t, verifier)
+
+	store = directory.NewUserStore(directory.NewIMSSource(nil), time.Minute)
+	_, ok = store.PasswordVerifier()
+	assert.False(t, ok)
+}
+
+func TestLDAPSourceRequiresTLS(t *testing.T) {
+	t.Parallel()
+	// The test server only speaks plain LDAP
+	_, cfg := newLDAPServer(t)
+
+	_, err := directory.NewLDAPSource(cfg, false).FetchUsers(t.Context())
+	require.Error(t, err)
+	_, err = directory.NewLDAPSource(cfg, false).VerifyPassword(t.Context(), &directory.User{Handle: "Tool"}, "tool password")
+	require.Error(t, err)
+}
@@ -0,0 +1,49 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+import "time"
+
+type APITokens []APIToken
+
+// APIToken is a long-lived credential for an integration or service account.
+// It acts under its own Name, with only the listed permissions, and only on
+// the listed Events.
+type APIToken struct {
+	ID   int32  `json:"id"`
+	Name string `json:"name"`
+	// Token is the credential itself. It's returned only once, in response to
+	// the request that created it, since IMS keeps only a hash of it.
+	Token string `json:"token,omitzero"`
+	// Events are the names of the Events that the token may act on.
+	Events []string `json:"events"`
+	// EventPermissions are the token's permissions on each of its Events,
+	// e.g. "readIncidents".
+	EventPermissions []string `json:"event_permissions"`
+	// GlobalPermissions are the token's permissions that aren't specific to
+	// any Event, e.g. "listEvents".
+	GlobalPermissions []string `json:"global_permissions"`
+	// Expires is optional. A token with none lasts until it's revoked.
+	Expires time.Time `json:"expires,omitzero"`
+
+	// The rest are read-only fields.
+
+	Created   time.Time `json:"created,omitzero"`
+	CreatedBy string    `json:"created_by,omitzero"`
+	LastUsed  time.Time `json:"last_used,omitzero"`
+	Revoked   time.Time `json:"revoked,omitzero"`
+}
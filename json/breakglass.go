@@ -0,0 +1,38 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+import "time"
+
+// BreakGlassRequest asks for break-glass access to an Incident or Visit.
+type BreakGlassRequest struct {
+	// Justification is why the requestor needs to read the record, which the
+	// admins are told, and which goes on the record's timeline.
+	Justification string `json:"justification"`
+}
+
+// BreakGlass is a grant of break-glass access to one Incident or Visit.
+type BreakGlass struct {
+	ID            int32     `json:"id"`
+	Event         string    `json:"event"`
+	Incident      *int32    `json:"incident,omitempty"`
+	Visit         *int32    `json:"visit,omitempty"`
+	Handle        string    `json:"handle"`
+	Justification string    `json:"justification"`
+	Created       time.Time `json:"created"`
+	Expires       time.Time `json:"expires"`
+}
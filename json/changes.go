@@ -0,0 +1,30 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+// Changes is what's changed in an Event since some earlier Changes, as far as
+// the requestor is allowed to see. A list is absent, rather than empty, when
+// the requestor may not read that kind of record at all.
+type Changes struct {
+	Event        string        `json:"event"`
+	Incidents    *Incidents    `json:"incidents,omitzero"`
+	FieldReports *FieldReports `json:"field_reports,omitzero"`
+	Visits       *Visits       `json:"visits,omitzero"`
+	// Cursor goes in the "cursor" parameter of the next request for changes
+	// to this Event. Clients should treat it as opaque.
+	Cursor string `json:"cursor"`
+}
@@ -16,6 +16,8 @@
 
 package json
 
+import "time"
+
 // Directory is the admin view of the IMS-native user directory.
 type Directory struct {
 	Persons   []DirectoryPerson `json:"persons"`
@@ -34,6 +36,15 @@ type DirectoryPerson struct {
 	Onsite      *bool    `json:"onsite"`
 	TeamIDs     *[]int64 `json:"team_ids"`
 	PositionIDs *[]int64 `json:"position_ids"`
+	// TOTPRequired makes the person enroll in TOTP the next time they log
+	// in, if they haven't already.
+	TOTPRequired *bool `json:"totp_required"`
+	// TOTPEnrolled is read-only. Admins reset it through its own endpoint.
+	TOTPEnrolled bool `json:"totp_enrolled"`
+	// OnDutyPositionID and OnDutySince are read-only. Admins sign people in
+	// and out of positions through their own endpoints.
+	OnDutyPositionID *int64    `json:"on_duty_position_id"`
+	OnDutySince      time.Time `json:"on_duty_since,omitzero"`
 }
 
 // DirectoryGroup is a team or position in the IMS-native directory.
@@ -43,8 +54,122 @@ type DirectoryGroup struct {
 	Active *bool   `json:"active"`
 }
 
+// DirectoryOnDuty is the request body for signing a person in to a position.
+type DirectoryOnDuty struct {
+	PositionID int64 `json:"position_id"`
+}
+
+// DirectoryShift is a stretch of time that a person in the IMS-native
+// directory spent on duty in a position.
+type DirectoryShift struct {
+	ID       int64  `json:"id"`
+	PersonID int64  `json:"person_id"`
+	Handle   string `json:"handle"`
+	// PositionID is null if the position has since been deleted.
+	PositionID *int64 `json:"position_id"`
+	// PositionTitle is the position's title as it was at the time.
+	PositionTitle string    `json:"position_title"`
+	OnDuty        time.Time `json:"on_duty"`
+	// OffDuty is unset for a shift that's still going.
+	OffDuty time.Time `json:"off_duty,omitzero"`
+}
+
+type DirectoryShifts []DirectoryShift
+
+// DirectoryBulk is the IMS-native directory as it's imported and exported in
+// bulk. It refers to teams and positions by title rather than ID, and persons
+// are matched by handle, so that it can be kept in a spreadsheet or carried
+// from one deployment to another. Pointer fields are optional on import,
+// meaning "leave unchanged" for a person, team, or position that exists.
+type DirectoryBulk struct {
+	Persons []DirectoryBulkPerson `json:"persons"`
+	// Teams and Positions need only list those whose active state matters.
+	// Any that a person is in but that don't exist yet are made active.
+	Teams     []DirectoryBulkGroup `json:"teams"`
+	Positions []DirectoryBulkGroup `json:"positions"`
+}
+
+type DirectoryBulkPerson struct {
+	Handle string `json:"handle"`
+	// Email is "" for a person with no email address.
+	Email     *string   `json:"email"`
+	Active    *bool     `json:"active"`
+	Onsite    *bool     `json:"onsite"`
+	Teams     *[]string `json:"teams"`
+	Positions *[]string `json:"positions"`
+}
+
+type DirectoryBulkGroup struct {
+	Title  string `json:"title"`
+	Active *bool  `json:"active"`
+}
+
+// DirectoryImport is what a bulk import changed, or for a dry run, what it
+// would have changed.
+type DirectoryImport struct {
+	DryRun        bool                    `json:"dry_run"`
+	Creates       []DirectoryImportChange `json:"creates"`
+	Updates       []DirectoryImportChange `json:"updates"`
+	Deactivations []DirectoryImportChange `json:"deactivations"`
+	// Unchanged counts the persons that were already as imported.
+	Unchanged int32 `json:"unchanged"`
+	// Invited are the handles of the new persons who were emailed an
+	// invitation, and NotInvited those whose invitation couldn't be sent.
+	Invited    []string `json:"invited"`
+	NotInvited []string `json:"not_invited"`
+}
+
+type DirectoryImportChange struct {
+	// Kind is "person", "team", or "position".
+	Kind string `json:"kind"`
+	// Name is the person's handle, or the team's or position's title.
+	Name string `json:"name"`
+	// Fields are the names of the fields that an update changes, such as
+	// "email" or "positions".
+	Fields []string `json:"fields,omitempty"`
+}
+
 // DirectoryPersonPassword is the request body for setting a person's password.
 type DirectoryPersonPassword struct {
 	// #nosec G117 // Exported secret field
 	Password string `json:"password"`
 }
+
+// DirectoryPasswordHashes counts the IMS-native directory's password hashes by
+// the argon2id params they were made with.
+type DirectoryPasswordHashes struct {
+	// Target is the params that passwords are hashed with now, such as
+	// "m=65536,t=3,p=4".
+	Target string                        `json:"target"`
+	Params []DirectoryPasswordHashParams `json:"params"`
+}
+
+type DirectoryPasswordHashParams struct {
+	// Params is of the same form as Target, or "unknown" for a hash that can't
+	// be decoded.
+	Params string `json:"params"`
+	Count  int32  `json:"count"`
+	// Weaker is whether these are weaker than Target, in which case they'll be
+	// replaced as people log in.
+	Weaker bool `json:"weaker"`
+}
+
+// DirectoryPasswordPolicy is the IMS-native directory's password policy, and
+// the people whose passwords weren't checked against it.
+type DirectoryPasswordPolicy struct {
+	// Current describes the policy's rules, such as
+	// "min=12,max=256,identity,breached".
+	Current string `json:"current"`
+	// Predating are the people whose passwords were set before the current
+	// policy came into force, or who have never set one.
+	Predating []DirectoryPasswordPolicyPerson `json:"predating"`
+}
+
+type DirectoryPasswordPolicyPerson struct {
+	ID     int64  `json:"id"`
+	Handle string `json:"handle"`
+	Active bool   `json:"active"`
+	// Policy is of the same form as Current, for the policy that the person's
+	// password was checked against, or null if it never was.
+	Policy *string `json:"policy"`
+}
@@ -50,6 +50,9 @@ type EventAccess struct {
 	Writers      []AccessRule `json:"writers"`
 	Reporters    []AccessRule `json:"reporters"`
 	VisitWriters []AccessRule `json:"visit_writers"`
+	// ConfidentialReaders may also read confidential Incidents, in addition to
+	// whatever else they may read under the other modes.
+	ConfidentialReaders []AccessRule `json:"confidential_readers"`
 }
 
 // AccessTargets lists the names that are valid targets for AccessRule
@@ -59,3 +62,74 @@ type AccessTargets struct {
 	Positions []string `json:"positions"`
 	Teams     []string `json:"teams"`
 }
+
+// AccessExplanation is why a person has the permissions they do, as worked
+// out from the directory and EVENT_ACCESS rules as they are now.
+type AccessExplanation struct {
+	Handle         string   `json:"handle"`
+	Onsite         bool     `json:"onsite"`
+	Positions      []string `json:"positions"`
+	Teams          []string `json:"teams"`
+	OnDutyPosition string   `json:"on_duty_position,omitempty"`
+	// Admin is whether the person is one of the IMS admins, which is where
+	// their administrative GlobalPermissions come from.
+	Admin                bool                     `json:"admin"`
+	GlobalPermissionMask uint16                   `json:"global_permission_mask"`
+	GlobalPermissions    []string                 `json:"global_permissions"`
+	Events               []EventAccessExplanation `json:"events"`
+}
+
+type EventAccessExplanation struct {
+	Event string `json:"event"`
+	// IsGroup is set for an event group, whose rules are there to be
+	// inherited by its events, since a group has no incidents of its own.
+	IsGroup             bool                    `json:"is_group,omitzero"`
+	EventPermissionMask uint16                  `json:"event_permission_mask"`
+	EventPermissions    []string                `json:"event_permissions"`
+	Rules               []AccessRuleExplanation `json:"rules"`
+}
+
+type AccessRuleExplanation struct {
+	Expression string    `json:"expression"`
+	Mode       string    `json:"mode"`
+	Validity   string    `json:"validity"`
+	NotBefore  time.Time `json:"not_before,omitzero"`
+	NotAfter   time.Time `json:"not_after,omitzero"`
+	// InheritedFrom is the name of the event group the rule belongs to, for a
+	// rule that the event inherits from its group.
+	InheritedFrom string `json:"inherited_from,omitempty"`
+	Matched       bool   `json:"matched"`
+	// Mismatches are all the reasons the rule doesn't match: "expression",
+	// "validity" (for an onsite rule when the person isn't onsite),
+	// "not_before", or "not_after".
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// EventAccessChange is one replacement of an Event's rules for one mode.
+type EventAccessChange struct {
+	ID      int32        `json:"id"`
+	Mode    string       `json:"mode"`
+	Author  string       `json:"author"`
+	Created time.Time    `json:"created"`
+	Before  []AccessRule `json:"before"`
+	After   []AccessRule `json:"after"`
+}
+
+// EventAccessHistory is every change to an Event's access rules, oldest
+// first.
+type EventAccessHistory struct {
+	Event   string              `json:"event"`
+	Changes []EventAccessChange `json:"changes"`
+
+	// At and Access are set when the history is asked for as of a time. Then
+	// Access holds the rules the Event had at that time.
+	At     time.Time    `json:"at,omitzero"`
+	Access *EventAccess `json:"access,omitempty"`
+}
+
+// EventAccessRestore asks for an Event's access rules to be put back as they
+// were at a time.
+type EventAccessRestore struct {
+	Event string    `json:"event"`
+	At    time.Time `json:"at"`
+}
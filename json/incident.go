@@ -57,6 +57,10 @@ type Incident struct {
 	Priority int8      `json:"priority"`
 	Summary  *string   `json:"summary"`
 	Location Location  `json:"location"`
+	// Confidential is whether only those with EventReadConfidential may read
+	// the Incident, and the Field Reports and Visits attached to it. Only they
+	// may change it, too.
+	Confidential *bool `json:"confidential,omitempty"`
 	// These five are response-only. Each is mutated one member at a time
 	// through its own endpoint, so that concurrent writers don't undo each
 	// other; sending any of the first four on an edit is a 400.
@@ -66,6 +70,26 @@ type Incident struct {
 	LinkedIncidents *[]LinkedIncident `json:"linked_incidents,omitzero"`
 	Rangers         *[]IncidentRanger `json:"rangers"`
 	ReportEntries   []ReportEntry     `json:"report_entries"`
+	// MergedInto is set on an Incident that was merged into another, and
+	// gives the other Incident's number. It's response-only.
+	MergedInto *int32 `json:"merged_into,omitzero"`
+	// StateChanges is response-only too, and is ignored on an edit. It's
+	// written as a side effect of changing State.
+	StateChanges *[]IncidentStateChange `json:"state_changes,omitzero"`
+}
+
+// IncidentMerge is the body of a request to merge a duplicate Incident into
+// the Incident named in the request's path.
+type IncidentMerge struct {
+	Duplicate int32 `json:"duplicate"`
+}
+
+// IncidentStateChange records one change to an Incident's State. The initial
+// state of "new" isn't included; it's implied by the Incident's Created time.
+type IncidentStateChange struct {
+	State   string    `json:"state"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
 }
 
 type IncidentRanger struct {
@@ -78,4 +102,7 @@ type LinkedIncident struct {
 	EventID   int32  `json:"event_id"`
 	Number    int32  `json:"number"`
 	Summary   string `json:"summary,omitempty"`
+	// Confidential is whether the linked Incident is confidential. Its summary
+	// is left out for those who may not read it.
+	Confidential bool `json:"confidential,omitempty"`
 }
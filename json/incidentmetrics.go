@@ -0,0 +1,44 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+// IncidentMetrics summarizes how long an Event's Incidents spent moving
+// through their states.
+type IncidentMetrics struct {
+	Event     string `json:"event"`
+	Incidents int    `json:"incidents"`
+	// TimeToDispatch runs from an Incident's creation to the first time it
+	// was dispatched.
+	TimeToDispatch DurationDistribution `json:"time_to_dispatch"`
+	// TimeOnScene is the total time an Incident spent on_scene, counting only
+	// the stretches that have ended.
+	TimeOnScene DurationDistribution `json:"time_on_scene"`
+	// TimeToClose runs from an Incident's creation to its most recent close,
+	// for Incidents that are currently closed.
+	TimeToClose DurationDistribution `json:"time_to_close"`
+}
+
+// DurationDistribution describes a set of durations, all in seconds. The
+// fields other than Count are zero when Count is.
+type DurationDistribution struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min_seconds"`
+	Median float64 `json:"median_seconds"`
+	P90    float64 `json:"p90_seconds"`
+	Max    float64 `json:"max_seconds"`
+	Mean   float64 `json:"mean_seconds"`
+}
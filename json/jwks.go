@@ -0,0 +1,34 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+// JWKS is a JSON Web Key Set (RFC 7517), which has the public keys that
+// services other than IMS can verify IMS's JWTs with.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a single public key. IMS only publishes Ed25519 keys (RFC 8037),
+// since its HS256 keys are secret.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
@@ -0,0 +1,34 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+import "time"
+
+type LoginThrottles []LoginThrottle
+
+// LoginThrottle is the recent failed logins for one identification (a handle
+// or email) or one client address.
+type LoginThrottle struct {
+	ID int64 `json:"id"`
+	// Kind is either "identification" or "address".
+	Kind        string    `json:"kind"`
+	Subject     string    `json:"subject"`
+	Failures    int32     `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// LockedUntil is set if this identification is locked out.
+	LockedUntil time.Time `json:"locked_until,omitzero"`
+}
@@ -0,0 +1,36 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+import "time"
+
+type Sessions []Session
+
+// Session is one login, which lasts for as long as its refresh token can still
+// be used to get new access tokens.
+type Session struct {
+	ID            int64     `json:"id"`
+	UserID        int64     `json:"user_id"`
+	UserHandle    string    `json:"user_handle"`
+	UserAgent     string    `json:"user_agent,omitzero"`
+	ClientAddress string    `json:"client_address,omitzero"`
+	Created       time.Time `json:"created"`
+	LastUsed      time.Time `json:"last_used"`
+	Expires       time.Time `json:"expires"`
+	// Current is whether this is the session of the request that fetched it.
+	Current bool `json:"current,omitzero"`
+}
@@ -0,0 +1,46 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+// TOTPEnrollment is what an authenticator app needs to be set up for TOTP.
+type TOTPEnrollment struct {
+	// Secret is for typing into the app by hand.
+	Secret string `json:"secret"`
+	// URI is the otpauth:// URI, for showing as a QR code.
+	URI string `json:"uri"`
+}
+
+// TOTPStatus is someone's own view of their TOTP enrollment.
+type TOTPStatus struct {
+	Enrolled bool `json:"enrolled"`
+	// Required is whether an admin requires this person to use TOTP, in which
+	// case they can't turn it off themselves.
+	Required          bool  `json:"required"`
+	RecoveryCodesLeft int64 `json:"recovery_codes_left"`
+}
+
+// TOTPCode is a second factor. Exactly one of its fields should be set.
+type TOTPCode struct {
+	Code         string `json:"code,omitzero"`
+	RecoveryCode string `json:"recovery_code,omitzero"`
+}
+
+// RecoveryCodes are single-use codes that can be used in place of TOTP codes.
+// They're only ever shown once.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
@@ -0,0 +1,78 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package json
+
+import "time"
+
+type Webhooks []Webhook
+
+// Webhook is an admin's subscription to some kinds of change to an Event's
+// records, each of which gets POSTed to the URL.
+type Webhook struct {
+	ID int32 `json:"id"`
+	// URL is where deliveries get POSTed.
+	URL *string `json:"url"`
+	// Secret is the HMAC key for signing deliveries. It's only ever sent by
+	// the client, and is never returned by the server.
+	Secret *string `json:"secret,omitempty"`
+	// Triggers are the kinds of change that the Webhook wants to hear about,
+	// e.g. "incident.created".
+	Triggers *[]string `json:"triggers"`
+	Enabled  *bool     `json:"enabled"`
+	// Created is a read-only field.
+	Created time.Time `json:"created,omitzero"`
+}
+
+type WebhookDeliveries []WebhookDelivery
+
+// WebhookDelivery is one change that a Webhook was told about, or is yet to
+// be, along with how that's been going.
+type WebhookDelivery struct {
+	ID      int64  `json:"id"`
+	Trigger string `json:"trigger"`
+	// Status is "pending" until the delivery either succeeds ("delivered")
+	// or runs out of attempts ("dead").
+	Status         string    `json:"status"`
+	Attempts       int32     `json:"attempts"`
+	Created        time.Time `json:"created"`
+	NextAttempt    time.Time `json:"next_attempt,omitzero"`
+	LastAttempt    time.Time `json:"last_attempt,omitzero"`
+	LastStatusCode int32     `json:"last_status_code,omitzero"`
+	LastError      string    `json:"last_error,omitzero"`
+	// One of Incident, FieldReport, and Visit is the number of the record that
+	// changed.
+	Incident    int32 `json:"incident,omitzero"`
+	FieldReport int32 `json:"field_report,omitzero"`
+	Visit       int32 `json:"visit,omitzero"`
+	// BodyDigest is the hex SHA-256 of what the last attempt POSTed. The body
+	// itself isn't kept, as it's built from the record for each attempt.
+	BodyDigest string `json:"body_digest,omitzero"`
+}
+
+// WebhookPayload is the body of a webhook delivery. The record that changed is
+// included in the same shape as its GET endpoint returns it, as of when the
+// delivery is attempted. That may take in later changes too, if the delivery
+// had to be retried. Timestamp is the time of the change.
+type WebhookPayload struct {
+	Trigger     string       `json:"trigger"`
+	Event       string       `json:"event"`
+	EventID     int32        `json:"event_id"`
+	Timestamp   time.Time    `json:"timestamp"`
+	Incident    *Incident    `json:"incident,omitzero"`
+	FieldReport *FieldReport `json:"field_report,omitzero"`
+	Visit       *Visit       `json:"visit,omitzero"`
+}
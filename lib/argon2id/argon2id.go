@@ -146,6 +146,39 @@ type Params struct {
 	KeyLength uint32
 }
 
+// String gives the cost parameters in the form they take in a hash, e.g.
+// "m=65536,t=3,p=4".
+func (p *Params) String() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", p.MemoryKiB, p.Iterations, p.Parallelism)
+}
+
+// ParseParams parses cost parameters in the form that String gives. The salt
+// and key lengths aren't part of that, so they're set to the recommended 16
+// and 32 bytes.
+func ParseParams(s string) (*Params, error) {
+	params := &Params{SaltLength: 16, KeyLength: 32}
+	_, err := fmt.Sscanf(s, "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Iterations, &params.Parallelism)
+	if err != nil || params.String() != s {
+		return nil, fmt.Errorf("argon2id: params %q are not of the form m=65536,t=3,p=4", s)
+	}
+	// These are the minimums that RFC 9106 allows.
+	if params.Iterations < 1 || params.Parallelism < 1 || params.MemoryKiB < 8*uint32(params.Parallelism) {
+		return nil, fmt.Errorf("argon2id: params %q are too small", s)
+	}
+	return params, nil
+}
+
+// WeakerThan reports whether a hash made with p is weaker than one made with
+// target, i.e. whether it uses less of any of memory, iterations, salt, or key.
+// Such a hash is due to be rehashed with target. Parallelism isn't considered,
+// since it spreads out the work rather than adding to it.
+func (p *Params) WeakerThan(target *Params) bool {
+	return p.MemoryKiB < target.MemoryKiB ||
+		p.Iterations < target.Iterations ||
+		p.SaltLength < target.SaltLength ||
+		p.KeyLength < target.KeyLength
+}
+
 // CreateHash returns an Argon2id hash of a plain-text password using the
 // provided algorithm parameters. The returned hash follows the format used by
 // the Argon2 reference C implementation and contains the base64-encoded Argon2id
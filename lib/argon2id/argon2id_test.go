@@ -125,3 +125,35 @@ func TestPHPExample(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, match)
 }
+
+func TestParseParams(t *testing.T) {
+	t.Parallel()
+
+	params, err := ParseParams("m=65536,t=3,p=4")
+	require.NoError(t, err)
+	assert.Equal(t, *SecondRecommendedParams, *params)
+	assert.Equal(t, "m=65536,t=3,p=4", params.String())
+
+	for _, bad := range []string{"", "m=65536,t=3", "m=65536,t=3,p=4,x=1", "m=+65536,t=3,p=4", "m=65536,t=0,p=4", "m=16,t=3,p=4"} {
+		_, err = ParseParams(bad)
+		assert.Errorf(t, err, "params %q should not parse", bad)
+	}
+}
+
+func TestWeakerThan(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, ClubhouseParams.WeakerThan(SecondRecommendedParams))
+	assert.True(t, DevelopmentParams.WeakerThan(SecondRecommendedParams))
+	assert.False(t, SecondRecommendedParams.WeakerThan(SecondRecommendedParams))
+	assert.False(t, PHPDefaultParams.WeakerThan(SecondRecommendedParams))
+
+	// More memory doesn't make up for fewer iterations.
+	assert.True(t, FirstRecommendedParams.WeakerThan(SecondRecommendedParams))
+
+	// Parallelism doesn't count either way.
+	moreParallel := *SecondRecommendedParams
+	moreParallel.Parallelism = 8
+	assert.False(t, moreParallel.WeakerThan(SecondRecommendedParams))
+	assert.False(t, SecondRecommendedParams.WeakerThan(&moreParallel))
+}
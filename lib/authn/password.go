@@ -31,13 +31,25 @@ import (
 // the server gets killed.
 var argonLocker sync.Mutex
 
-func Verify(password, storedValue string) (isValid bool, err error) {
+// Verify checks a password against its stored hash. It also gives the params
+// that the hash was made with, so that the caller can tell whether it's due to
+// be rehashed.
+func Verify(password, storedValue string) (isValid bool, params *argon2id.Params, err error) {
 	if !strings.HasPrefix(storedValue, "$argon2id") {
-		return false, errors.New("unsupported non-argon2id stored password")
+		return false, nil, errors.New("unsupported non-argon2id stored password")
 	}
 	argonLocker.Lock()
 	defer argonLocker.Unlock()
-	return argon2id.ComparePasswordAndHash(password, storedValue)
+	return argon2id.CheckHash(password, storedValue)
+}
+
+// Hash gives a new hash of the password, made with the given params. Like
+// Verify, this takes turns with other hashing, so that logins don't use more
+// memory than one hash needs.
+func Hash(password string, params *argon2id.Params) string {
+	argonLocker.Lock()
+	defer argonLocker.Unlock()
+	return argon2id.CreateHash(password, params)
 }
 
 func NewSaltedArgon2idDevOnly(password string) string {
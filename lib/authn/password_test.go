@@ -19,6 +19,7 @@ package authn_test
 import (
 	"testing"
 
+	"github.com/burningmantech/ranger-ims-go/lib/argon2id"
 	"github.com/burningmantech/ranger-ims-go/lib/authn"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -28,18 +29,29 @@ func TestVerify_success(t *testing.T) {
 	t.Parallel()
 	hash := authn.NewSaltedArgon2idDevOnly("my password 123")
 
-	isValid, err := authn.Verify("my password wrong", hash)
+	isValid, _, err := authn.Verify("my password wrong", hash)
 	require.NoError(t, err)
 	assert.False(t, isValid)
 
-	isValid, err = authn.Verify("my password 123", hash)
+	isValid, params, err := authn.Verify("my password 123", hash)
 	require.NoError(t, err)
 	assert.True(t, isValid)
+	assert.Equal(t, *argon2id.DevelopmentParams, *params)
+}
+
+func TestHash(t *testing.T) {
+	t.Parallel()
+	hash := authn.Hash("my password 123", argon2id.ClubhouseParams)
+
+	isValid, params, err := authn.Verify("my password 123", hash)
+	require.NoError(t, err)
+	assert.True(t, isValid)
+	assert.Equal(t, *argon2id.ClubhouseParams, *params)
 }
 
 func TestVerify_failure(t *testing.T) {
 	t.Parallel()
-	isValid, err := authn.Verify("some password", "this is not an argon2id hash")
+	isValid, _, err := authn.Verify("some password", "this is not an argon2id hash")
 	assert.False(t, isValid)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "unsupported non-argon2id stored password")
@@ -0,0 +1,158 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authn
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505 // The breached-password corpus is keyed by SHA-1
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// PasswordRule is one of the rules of a PasswordPolicy.
+type PasswordRule string
+
+const (
+	RuleMinLength   PasswordRule = "min_length"
+	RuleMaxLength   PasswordRule = "max_length"
+	RuleNotIdentity PasswordRule = "not_identity"
+	RuleNotBreached PasswordRule = "not_breached"
+)
+
+// PasswordViolation is a rule that a password breaks, with a message for the
+// person who chose it.
+type PasswordViolation struct {
+	Rule    PasswordRule
+	Message string
+}
+
+// PasswordPolicy is what it takes for a password to be acceptable in the
+// IMS-native directory.
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password may have.
+	MinLength int
+	// MaxLength is the most bytes a password may have.
+	MaxLength int
+	// Breached, if set, is checked for passwords that are known to have
+	// appeared in data breaches.
+	Breached *BreachedCorpus
+}
+
+// String describes the policy's rules, such as "min=12,max=256,identity,breached".
+// It's recorded alongside each password that's checked against the policy, so
+// that admins can tell which passwords were set before it came into force.
+func (p PasswordPolicy) String() string {
+	s := fmt.Sprintf("min=%v,max=%v,identity", p.MinLength, p.MaxLength)
+	if p.Breached != nil {
+		s += ",breached"
+	}
+	return s
+}
+
+// Check gives every rule that the password breaks, or none if it's acceptable.
+// The identities are what the password's owner is known by, i.e. their handle
+// and email, none of which the password may be.
+func (p PasswordPolicy) Check(password string, identities ...string) ([]PasswordViolation, error) {
+	var violations []PasswordViolation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("Password must be at least %v characters", p.MinLength),
+		})
+	}
+	if len(password) > p.MaxLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleMaxLength,
+			Message: "Password is too long",
+		})
+	}
+	for _, identity := range identities {
+		if identity != "" && strings.EqualFold(strings.TrimSpace(password), identity) {
+			violations = append(violations, PasswordViolation{
+				Rule:    RuleNotIdentity,
+				Message: "Password must not be your handle or email",
+			})
+			break
+		}
+	}
+	if p.Breached != nil && password != "" {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return nil, fmt.Errorf("[Contains]: %w", err)
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Rule:    RuleNotBreached,
+				Message: "Password has appeared in a data breach, so it's likely to be guessed",
+			})
+		}
+	}
+	return violations, nil
+}
+
+// BreachedCorpus is a local copy of a breached-password corpus, in the
+// k-anonymity form that Have I Been Pwned serves and that its downloader
+// saves. The passwords' uppercase hex SHA-1 hashes are split among files named
+// for the first five characters, e.g. "21BD1.txt", each of which has lines of
+// the other 35 characters, a colon, and how many times the password was seen.
+//
+// https://haveibeenpwned.com/API/v3#SearchingPwnedPasswordsByRange
+type BreachedCorpus struct {
+	dir *os.Root
+}
+
+func NewBreachedCorpus(dir *os.Root) *BreachedCorpus {
+	return &BreachedCorpus{dir: dir}
+}
+
+// Contains is whether the password is in the corpus. Missing range files are
+// taken to mean that no password in that range was breached.
+func (c *BreachedCorpus) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password)) // #nosec G401 // This is a lookup key, not a password hash
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := c.dir.Open(prefix + ".txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = c.dir.Open(prefix)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("[Open]: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Padded responses from the API include made-up entries with a count
+		// of zero, which aren't breached passwords at all.
+		if strings.EqualFold(lineSuffix, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return false, fmt.Errorf("[Scan]: %w", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,120 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authn_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/burningmantech/ranger-ims-go/lib/authn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCorpus makes a breached-password corpus in which "correct horse battery"
+// has been seen, and "padded password" is only a zero-count padding entry.
+func testCorpus(t *testing.T) *authn.BreachedCorpus {
+	t.Helper()
+	dir := t.TempDir()
+	// SHA-1("correct horse battery") = 98DECC62ECE399A22ED30D490EF333BE7FDE7385
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "98DEC.txt"), []byte(
+		"000000000000000000000000000000000AB:3\r\n"+
+			"c62ece399a22ed30d490ef333be7fde7385:42\r\n",
+	), 0o600))
+	// SHA-1("padded password") = CB094E085112B3C894FA5537C63A178CC3D3ECCC, in a
+	// range file without the .txt extension.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CB094"), []byte(
+		"E085112B3C894FA5537C63A178CC3D3ECCC:0\n",
+	), 0o600))
+	root, err := os.OpenRoot(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = root.Close() })
+	return authn.NewBreachedCorpus(root)
+}
+
+func rules(violations []authn.PasswordViolation) []authn.PasswordRule {
+	var r []authn.PasswordRule
+	for _, v := range violations {
+		r = append(r, v.Rule)
+	}
+	return r
+}
+
+func TestBreachedCorpus(t *testing.T) {
+	t.Parallel()
+	corpus := testCorpus(t)
+
+	breached, err := corpus.Contains("correct horse battery")
+	require.NoError(t, err)
+	assert.True(t, breached)
+
+	// A padding entry isn't a breached password.
+	breached, err = corpus.Contains("padded password")
+	require.NoError(t, err)
+	assert.False(t, breached)
+
+	// Neither is one whose range file doesn't exist.
+	breached, err = corpus.Contains("Tr0ub4dor&3 unique")
+	require.NoError(t, err)
+	assert.False(t, breached)
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	t.Parallel()
+	policy := authn.PasswordPolicy{MinLength: 12, MaxLength: 256, Breached: testCorpus(t)}
+
+	violations, err := policy.Check("Tr0ub4dor&3 unique", "Tool", "tool@example.com")
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+
+	violations, err = policy.Check("short", "Tool")
+	require.NoError(t, err)
+	assert.Equal(t, []authn.PasswordRule{authn.RuleMinLength}, rules(violations))
+	assert.Equal(t, "Password must be at least 12 characters", violations[0].Message)
+
+	// Length is in characters, not bytes.
+	violations, err = policy.Check(strings.Repeat("✨", 11))
+	require.NoError(t, err)
+	assert.Equal(t, []authn.PasswordRule{authn.RuleMinLength}, rules(violations))
+
+	violations, err = policy.Check(strings.Repeat("p", 257))
+	require.NoError(t, err)
+	assert.Equal(t, []authn.PasswordRule{authn.RuleMaxLength}, rules(violations))
+
+	violations, err = policy.Check("Tool@Example.com", "Tool", "tool@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []authn.PasswordRule{authn.RuleNotIdentity}, rules(violations))
+
+	violations, err = policy.Check("correct horse battery", "Tool")
+	require.NoError(t, err)
+	assert.Equal(t, []authn.PasswordRule{authn.RuleNotBreached}, rules(violations))
+
+	// Every broken rule is reported.
+	violations, err = policy.Check("toolhandle", "ToolHandle")
+	require.NoError(t, err)
+	assert.Equal(t, []authn.PasswordRule{authn.RuleMinLength, authn.RuleNotIdentity}, rules(violations))
+}
+
+func TestPasswordPolicyString(t *testing.T) {
+	t.Parallel()
+	policy := authn.PasswordPolicy{MinLength: 12, MaxLength: 256}
+	assert.Equal(t, "min=12,max=256,identity", policy.String())
+	policy.Breached = testCorpus(t)
+	assert.Equal(t, "min=12,max=256,identity,breached", policy.String())
+}
@@ -0,0 +1,88 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAPIToken(t *testing.T) {
+	t.Parallel()
+	token := NewAPIToken()
+	assert.True(t, IsAPIToken(token))
+	assert.NotEqual(t, token, NewAPIToken())
+	assert.Equal(t, HashAPIToken(token), HashAPIToken(token))
+	assert.Len(t, HashAPIToken(token), 64)
+	assert.NotEqual(t, HashAPIToken(token), HashAPIToken(NewAPIToken()))
+
+	// JWTs are never mistaken for API tokens
+	jwt, err := JWTer{SecretKey: "some secret"}.CreateAccessToken("Hubcap", 1, nil, nil, true, nil, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.False(t, IsAPIToken(jwt))
+}
+
+func TestPermissionNames(t *testing.T) {
+	t.Parallel()
+	eventNames := writerPerm.Names()
+	assert.Contains(t, eventNames, "writeIncidents")
+	eventPerms, err := ParseEventPermissions(eventNames)
+	require.NoError(t, err)
+	assert.Equal(t, writerPerm, eventPerms)
+
+	globalNames := adminGlobalPerms.Names()
+	assert.Contains(t, globalNames, "administrateEvents")
+	globalPerms, err := ParseGlobalPermissions(globalNames)
+	require.NoError(t, err)
+	assert.Equal(t, adminGlobalPerms, globalPerms)
+
+	assert.Empty(t, EventNoPermissions.Names())
+	_, err = ParseEventPermissions([]string{"readIncidents", "doAnything"})
+	require.Error(t, err)
+	_, err = ParseGlobalPermissions([]string{"readIncidents"})
+	require.Error(t, err)
+}
+
+func TestAPITokenPermissions(t *testing.T) {
+	t.Parallel()
+	// The token's name is an admin's handle, but that counts for nothing.
+	claims := IMSClaims{}.WithRangerHandle(testAdmins[0]).WithAPIToken(&APIToken{
+		ID:                1,
+		Events:            []int32{10, 11},
+		EventPermissions:  EventReadEventName | EventReadIncidents,
+		GlobalPermissions: GlobalListEvents,
+	})
+
+	for _, eventID := range []int32{10, 11} {
+		eventPerms, globalPerms, err := EventPermissions(t.Context(), &eventID, nil, nil, testAdmins, claims)
+		require.NoError(t, err)
+		assert.Equal(t, EventReadEventName|EventReadIncidents, eventPerms[eventID])
+		assert.Equal(t, GlobalListEvents, globalPerms)
+	}
+	otherEvent := int32(12)
+	eventPerms, _, err := EventPermissions(t.Context(), &otherEvent, nil, nil, testAdmins, claims)
+	require.NoError(t, err)
+	assert.Equal(t, EventNoPermissions, eventPerms[otherEvent])
+
+	assert.Equal(t, map[int32]EventPermissionMask{
+		10: EventReadEventName | EventReadIncidents,
+		11: EventReadEventName | EventReadIncidents,
+	}, claims.APIToken().PermissionsByEvent())
+}
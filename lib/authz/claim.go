@@ -26,10 +26,12 @@ import (
 const compactIntBase = 62
 
 // TokenType values for the "tok" claim. These distinguish access tokens from
-// refresh tokens, so that one can never be used in place of the other.
+// refresh tokens and second factor challenges, so that none can ever be used
+// in place of another.
 const (
-	TokenTypeAccess  = "access"
-	TokenTypeRefresh = "refresh"
+	TokenTypeAccess       = "access"
+	TokenTypeRefresh      = "refresh"
+	TokenTypeSecondFactor = "second_factor"
 )
 
 type IMSClaims struct {
@@ -41,6 +43,10 @@ type IMSClaims struct {
 	Onsite         bool   `json:"ons"`
 	OnDutyPosition *int64 `json:"dut,omitempty"`
 	TokenType      string `json:"tok,omitempty"`
+
+	// apiToken is set only for requests authenticated by an API token, rather
+	// than by a JWT. It's never part of a JWT.
+	apiToken *APIToken
 }
 
 func unmarshalBigInt(s string) *big.Int {
@@ -85,6 +91,11 @@ func (c IMSClaims) WithExpiration(t time.Time) IMSClaims {
 	return c
 }
 
+func (c IMSClaims) WithID(id string) IMSClaims {
+	c.ID = id
+	return c
+}
+
 func (c IMSClaims) WithIssuedAt(t time.Time) IMSClaims {
 	c.IssuedAt = jwt.NewNumericDate(t)
 	return c
@@ -130,6 +141,11 @@ func (c IMSClaims) WithTokenType(tokenType string) IMSClaims {
 	return c
 }
 
+func (c IMSClaims) WithAPIToken(t *APIToken) IMSClaims {
+	c.apiToken = t
+	return c
+}
+
 func (c IMSClaims) RangerHandle() string {
 	return c.Handle
 }
@@ -163,3 +179,9 @@ func (c IMSClaims) DirectoryID() int64 {
 func (c IMSClaims) RangerOnDutyPosition() *int64 {
 	return c.OnDutyPosition
 }
+
+// APIToken gives the scope of the API token that the request was authenticated
+// with, or nil if it was authenticated as a person.
+func (c IMSClaims) APIToken() *APIToken {
+	return c.apiToken
+}
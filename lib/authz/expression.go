@@ -0,0 +1,421 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authz
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// AccessAtom is the simplest kind of EVENT_ACCESS expression: "*", which is
+// everyone, or a Kind and Value, such as "team:Green Dot".
+type AccessAtom struct {
+	// Kind is "*", or one of the AccessKind* constants.
+	Kind  string
+	Value string
+}
+
+const (
+	AccessKindAll      = "*"
+	AccessKindPerson   = "person"
+	AccessKindPosition = "position"
+	AccessKindTeam     = "team"
+	AccessKindOnDuty   = "onduty"
+)
+
+var accessKinds = []string{AccessKindPerson, AccessKindPosition, AccessKindTeam, AccessKindOnDuty}
+
+// AccessExpression is a parsed EVENT_ACCESS expression. That's either an
+// AccessAtom, or atoms combined with these operators, from the tightest
+// binding to the loosest:
+//
+//   - NOT x: x doesn't match.
+//   - x AND y: both match. x EXCEPT y is the same as x AND NOT y.
+//   - x OR y: either matches.
+//
+// Parentheses group as usual, and the operators must be in capitals, so
+// "position:Dirt Ranger AND team:Green Dot" is a position and a team, but
+// "team:Rock and Roll" is only a team. Names run up to the next operator or
+// unmatched closing parenthesis. A name with one of those in it can be put in
+// double quotes, such as team:"Fire AND Ice", with \" and \\ for a quote or a
+// backslash in it.
+type AccessExpression struct {
+	root accessNode
+}
+
+// AccessSubject is someone to be matched against an AccessExpression.
+type AccessSubject struct {
+	Handle    string
+	Positions []string
+	Teams     []string
+	// OnDutyPosition is "" when they're off duty.
+	OnDutyPosition string
+}
+
+// Matches is whether the expression matches the subject.
+func (e AccessExpression) Matches(subject AccessSubject) bool {
+	return e.root.matches(subject)
+}
+
+// Atoms are all the atoms in the expression, in order.
+func (e AccessExpression) Atoms() []AccessAtom {
+	var atoms []AccessAtom
+	e.root.atoms(&atoms)
+	return atoms
+}
+
+// IsCompound is whether the expression is more than a single atom.
+func (e AccessExpression) IsCompound() bool {
+	_, ok := e.root.(atomNode)
+	return !ok
+}
+
+// AccessExpressionError is why an expression couldn't be parsed.
+type AccessExpressionError struct {
+	// Offset is where in the expression, in bytes, the problem is.
+	Offset  int
+	Message string
+}
+
+func (e *AccessExpressionError) Error() string {
+	return fmt.Sprintf("%v, at character %v", e.Message, e.Offset+1)
+}
+
+// ParseAccessExpression parses an EVENT_ACCESS expression, failing with an
+// *AccessExpressionError for one that isn't valid.
+func ParseAccessExpression(s string) (AccessExpression, error) {
+	p := &accessParser{s: s}
+	p.skipSpace()
+	if p.done() {
+		return AccessExpression{}, p.errorf("the expression is empty")
+	}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return AccessExpression{}, err
+	}
+	if !p.done() {
+		if p.peek() == ')' {
+			return AccessExpression{}, p.errorf("there's a ')' without a '(' to match it")
+		}
+		return AccessExpression{}, p.errorf("expected AND, OR, or EXCEPT, but found %q", p.rest())
+	}
+	return AccessExpression{root: root}, nil
+}
+
+// parsedAccessExpressions holds the expressions that CompileAccessExpression
+// has already parsed. There are only as many as there are distinct rules, and
+// the same ones are matched against every user, over and over.
+var parsedAccessExpressions sync.Map
+
+// CompileAccessExpression parses a stored expression, and never fails. Stored
+// expressions were all single atoms before there were operators, and some of
+// those, such as "team:Fire AND Ice", don't parse now. Those are taken as the atom they were
+// always taken as, so that they keep granting what they did. An expression
+// that's neither is an atom of no kind, which matches no one.
+func CompileAccessExpression(s string) AccessExpression {
+	if e, ok := parsedAccessExpressions.Load(s); ok {
+		return e.(AccessExpression)
+	}
+	e, err := ParseAccessExpression(s)
+	if err != nil {
+		atom := AccessAtom{}
+		if s == AccessKindAll {
+			atom.Kind = AccessKindAll
+		} else if kind, value, ok := strings.Cut(s, ":"); ok && slices.Contains(accessKinds, kind) {
+			atom = AccessAtom{Kind: kind, Value: value}
+		}
+		e = AccessExpression{root: atomNode(atom)}
+	}
+	parsedAccessExpressions.Store(s, e)
+	return e
+}
+
+type accessNode interface {
+	matches(subject AccessSubject) bool
+	atoms(atoms *[]AccessAtom)
+}
+
+type atomNode AccessAtom
+
+func (n atomNode) matches(subject AccessSubject) bool {
+	switch n.Kind {
+	case AccessKindAll:
+		return true
+	case AccessKindPerson:
+		return subject.Handle == n.Value
+	case AccessKindPosition:
+		return slices.Contains(subject.Positions, n.Value)
+	case AccessKindTeam:
+		return slices.Contains(subject.Teams, n.Value)
+	case AccessKindOnDuty:
+		return subject.OnDutyPosition == n.Value
+	default:
+		return false
+	}
+}
+
+func (n atomNode) atoms(atoms *[]AccessAtom) {
+	*atoms = append(*atoms, AccessAtom(n))
+}
+
+type notNode struct{ x accessNode }
+
+func (n notNode) matches(subject AccessSubject) bool { return !n.x.matches(subject) }
+func (n notNode) atoms(atoms *[]AccessAtom)          { n.x.atoms(atoms) }
+
+type andNode struct{ x, y accessNode }
+
+func (n andNode) matches(subject AccessSubject) bool {
+	return n.x.matches(subject) && n.y.matches(subject)
+}
+func (n andNode) atoms(atoms *[]AccessAtom) { n.x.atoms(atoms); n.y.atoms(atoms) }
+
+type orNode struct{ x, y accessNode }
+
+func (n orNode) matches(subject AccessSubject) bool {
+	return n.x.matches(subject) || n.y.matches(subject)
+}
+func (n orNode) atoms(atoms *[]AccessAtom) { n.x.atoms(atoms); n.y.atoms(atoms) }
+
+const (
+	opAnd    = "AND"
+	opOr     = "OR"
+	opNot    = "NOT"
+	opExcept = "EXCEPT"
+
+	// maxAccessExpressionDepth bounds the nesting of parentheses and NOTs, so
+	// that no expression can run the parser out of stack.
+	maxAccessExpressionDepth = 32
+)
+
+// accessParser is a recursive descent parser for AccessExpressions.
+type accessParser struct {
+	s   string
+	pos int
+}
+
+func (p *accessParser) errorf(format string, args ...any) error {
+	return &AccessExpressionError{Offset: p.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *accessParser) done() bool   { return p.pos >= len(p.s) }
+func (p *accessParser) peek() byte   { return p.s[p.pos] }
+func (p *accessParser) rest() string { return p.s[p.pos:] }
+
+func (p *accessParser) skipSpace() {
+	for !p.done() && isAccessSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func isAccessSpace(b byte) bool {
+	return b < 0x80 && unicode.IsSpace(rune(b))
+}
+
+// keywordAt gives the operator that's at offset i, if there's one that's a
+// word on its own there.
+func (p *accessParser) keywordAt(i int) string {
+	for _, op := range []string{opAnd, opOr, opNot, opExcept} {
+		end := i + len(op)
+		if !strings.HasPrefix(p.s[i:], op) {
+			continue
+		}
+		if end == len(p.s) || isAccessSpace(p.s[end]) || p.s[end] == '(' || p.s[end] == ')' {
+			return op
+		}
+	}
+	return ""
+}
+
+// accept consumes the operator if it's next.
+func (p *accessParser) accept(op string) bool {
+	if p.done() || p.keywordAt(p.pos) != op {
+		return false
+	}
+	p.pos += len(op)
+	p.skipSpace()
+	return true
+}
+
+func (p *accessParser) parseOr(depth int) (accessNode, error) {
+	x, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(opOr) {
+		y, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		x = orNode{x, y}
+	}
+	return x, nil
+}
+
+func (p *accessParser) parseAnd(depth int) (accessNode, error) {
+	x, err := p.parseNot(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept(opAnd):
+			y, err := p.parseNot(depth)
+			if err != nil {
+				return nil, err
+			}
+			x = andNode{x, y}
+		case p.accept(opExcept):
+			y, err := p.parseNot(depth)
+			if err != nil {
+				return nil, err
+			}
+			x = andNode{x, notNode{y}}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *accessParser) parseNot(depth int) (accessNode, error) {
+	if depth > maxAccessExpressionDepth {
+		return nil, p.errorf("the expression is nested too deeply")
+	}
+	if p.accept(opNot) {
+		x, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x}, nil
+	}
+	if p.done() {
+		return nil, p.errorf("the expression ends where a person, position, team, or * was expected")
+	}
+	if p.peek() == '(' {
+		p.pos++
+		p.skipSpace()
+		x, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.done() || p.peek() != ')' {
+			return nil, p.errorf("a '(' is missing its ')'")
+		}
+		p.pos++
+		p.skipSpace()
+		return x, nil
+	}
+	return p.parseAtom()
+}
+
+func (p *accessParser) parseAtom() (accessNode, error) {
+	start := p.pos
+	if op := p.keywordAt(p.pos); op != "" {
+		return nil, p.errorf("found %v where a person, position, team, or * was expected", op)
+	}
+	if p.peek() == '*' {
+		p.pos++
+		p.skipSpace()
+		return atomNode{Kind: AccessKindAll}, nil
+	}
+	colon := strings.IndexByte(p.rest(), ':')
+	kind := ""
+	if colon >= 0 {
+		kind = p.s[p.pos : p.pos+colon]
+	}
+	if !slices.Contains(accessKinds, kind) {
+		return nil, p.errorf("expected *, or one of %v followed by a colon, but found %q",
+			strings.Join(accessKinds, ":, ")+":", p.rest())
+	}
+	p.pos += colon + 1
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		p.pos = start
+		return nil, p.errorf("%v: has no name after it", kind)
+	}
+	return atomNode{Kind: kind, Value: value}, nil
+}
+
+// parseValue reads a name, which is either in double quotes or runs up to the
+// next operator or unmatched ')'. Any parentheses in an unquoted name must be
+// balanced.
+func (p *accessParser) parseValue() (string, error) {
+	if !p.done() && p.peek() == '"' {
+		var sb strings.Builder
+		p.pos++
+		for {
+			if p.done() {
+				return "", p.errorf("a quoted name is missing its closing quote")
+			}
+			c := p.peek()
+			p.pos++
+			switch c {
+			case '"':
+				p.skipSpace()
+				return sb.String(), nil
+			case '\\':
+				if p.done() {
+					return "", p.errorf("a quoted name is missing its closing quote")
+				}
+				sb.WriteByte(p.peek())
+				p.pos++
+			default:
+				sb.WriteByte(c)
+			}
+		}
+	}
+	start := p.pos
+	end := p.pos
+	depth := 0
+	for !p.done() {
+		c := p.peek()
+		if c == ')' && depth == 0 {
+			break
+		}
+		// An operator has to be a word of its own.
+		if isAccessSpace(c) {
+			i := p.pos
+			for i < len(p.s) && isAccessSpace(p.s[i]) {
+				i++
+			}
+			if i < len(p.s) && depth == 0 && p.keywordAt(i) != "" {
+				p.pos = i
+				break
+			}
+			p.pos = i
+			continue
+		}
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		p.pos++
+		end = p.pos
+	}
+	if depth > 0 {
+		return "", p.errorf("a name has a '(' without a ')' to match it; put the name in double quotes")
+	}
+	return p.s[start:end], nil
+}
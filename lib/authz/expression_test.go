@@ -0,0 +1,135 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccessExpressionAtoms(t *testing.T) {
+	t.Parallel()
+	for expr, want := range map[string][]AccessAtom{
+		"*":                    {{Kind: AccessKindAll}},
+		"person:Hubcap":        {{Kind: AccessKindPerson, Value: "Hubcap"}},
+		"position:Dirt Ranger": {{Kind: AccessKindPosition, Value: "Dirt Ranger"}},
+		"team:Rock and Roll":   {{Kind: AccessKindTeam, Value: "Rock and Roll"}},
+		"onduty:Ranger (HQ)":   {{Kind: AccessKindOnDuty, Value: "Ranger (HQ)"}},
+		`team:"Fire AND Ice"`:  {{Kind: AccessKindTeam, Value: "Fire AND Ice"}},
+		`person:"Say \"Hi\""`:  {{Kind: AccessKindPerson, Value: `Say "Hi"`}},
+		"position:Dirt Ranger AND team:Green Dot": {
+			{Kind: AccessKindPosition, Value: "Dirt Ranger"},
+			{Kind: AccessKindTeam, Value: "Green Dot"},
+		},
+		"(team:Council EXCEPT person:X) OR NOT onduty:Operator": {
+			{Kind: AccessKindTeam, Value: "Council"},
+			{Kind: AccessKindPerson, Value: "X"},
+			{Kind: AccessKindOnDuty, Value: "Operator"},
+		},
+	} {
+		e, err := ParseAccessExpression(expr)
+		require.NoError(t, err, expr)
+		assert.Equal(t, want, e.Atoms(), expr)
+		assert.Equal(t, len(want) > 1, e.IsCompound(), expr)
+	}
+}
+
+func TestParseAccessExpressionErrors(t *testing.T) {
+	t.Parallel()
+	for expr, wantOffset := range map[string]int{
+		"":                            0,
+		"   ":                         3,
+		"Hubcap":                      0,
+		"**":                          1,
+		"person:":                     0,
+		"place:Center Camp":           0,
+		"team:Council AND":            16,
+		"AND team:Council":            0,
+		"(team:Council":               13,
+		"team:Council)":               12,
+		"team:Council (HQ":            16,
+		`team:"Council`:               13,
+		"team:Council NOT person:X":   13,
+		"team:Council AND OR team:X":  17,
+		"position:A OR OR position:B": 14,
+	} {
+		_, err := ParseAccessExpression(expr)
+		var exprErr *AccessExpressionError
+		require.ErrorAs(t, err, &exprErr, expr)
+		assert.Equal(t, wantOffset, exprErr.Offset, "%q: %v", expr, err)
+	}
+
+	deep := ""
+	for range maxAccessExpressionDepth + 1 {
+		deep += "NOT "
+	}
+	_, err := ParseAccessExpression(deep + "*")
+	require.ErrorContains(t, err, "nested too deeply")
+}
+
+func TestAccessExpressionMatches(t *testing.T) {
+	t.Parallel()
+	hubcap := AccessSubject{Handle: "Hubcap", Positions: []string{"Dirt Ranger"}, Teams: []string{"Green Dot", "Council"}}
+	xavier := AccessSubject{Handle: "X", Teams: []string{"Council"}, OnDutyPosition: "Dirt Ranger"}
+	nobody := AccessSubject{Handle: "Nobody"}
+
+	matches := func(expr string, subject AccessSubject) bool {
+		e, err := ParseAccessExpression(expr)
+		require.NoError(t, err, expr)
+		return e.Matches(subject)
+	}
+
+	assert.True(t, matches("position:Dirt Ranger AND team:Green Dot", hubcap))
+	assert.False(t, matches("position:Dirt Ranger AND team:Green Dot", xavier))
+
+	assert.True(t, matches("team:Council EXCEPT person:X", hubcap))
+	assert.False(t, matches("team:Council EXCEPT person:X", xavier))
+
+	assert.True(t, matches("person:Nobody OR onduty:Dirt Ranger", xavier))
+	assert.True(t, matches("person:Nobody OR onduty:Dirt Ranger", nobody))
+	assert.False(t, matches("person:Nobody OR onduty:Dirt Ranger", hubcap))
+
+	// NOT binds tighter than AND, which binds tighter than OR
+	assert.True(t, matches("NOT team:Council", nobody))
+	assert.True(t, matches("person:Nobody OR team:Council AND NOT person:X", hubcap))
+	assert.False(t, matches("person:Nobody OR team:Council AND NOT person:X", xavier))
+	assert.True(t, matches("person:Nobody OR team:Council AND NOT person:X", nobody))
+	assert.False(t, matches("(person:Nobody OR team:Council) AND NOT person:X", xavier))
+	assert.True(t, matches("* EXCEPT (person:X OR person:Nobody)", hubcap))
+	assert.False(t, matches("* EXCEPT (person:X OR person:Nobody)", nobody))
+}
+
+func TestCompileAccessExpressionLegacy(t *testing.T) {
+	t.Parallel()
+	fireAndIce := AccessSubject{Teams: []string{"Fire AND Ice"}}
+
+	// Stored before there were operators, this doesn't parse now, but it
+	// still grants what it always did.
+	e := CompileAccessExpression("team:Fire AND Ice")
+	assert.Equal(t, []AccessAtom{{Kind: AccessKindTeam, Value: "Fire AND Ice"}}, e.Atoms())
+	assert.True(t, e.Matches(fireAndIce))
+
+	// An empty onduty: was always a match for everyone who's off duty.
+	assert.True(t, CompileAccessExpression("onduty:").Matches(AccessSubject{}))
+	assert.False(t, CompileAccessExpression("onduty:").Matches(AccessSubject{OnDutyPosition: "Dirt Ranger"}))
+
+	// Anything else that doesn't parse matches no one.
+	assert.False(t, CompileAccessExpression("**").Matches(fireAndIce))
+	assert.Equal(t, []AccessAtom{{}}, CompileAccessExpression("Hubcap").Atoms())
+}
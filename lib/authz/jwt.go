@@ -22,15 +22,25 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// JWTer makes and checks IMS's JWTs. With only a SecretKey, it signs them all
+// with that, using HS256. With a KeyRing, it uses the keys in that instead, and
+// SecretKey is ignored.
 type JWTer struct {
 	SecretKey string
+	Keys      *KeyRing
+}
+
+func (j JWTer) keyRing() *KeyRing {
+	if j.Keys != nil {
+		return j.Keys
+	}
+	return NewKeyRing(j.SecretKey, nil, nil, 0)
 }
 
 func (j JWTer) createJWT(claims IMSClaims) (string, error) {
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
-		SignedString([]byte(j.SecretKey))
+	token, err := j.keyRing().sign(claims)
 	if err != nil {
-		return "", fmt.Errorf("[SignedString]: %w", err)
+		return "", fmt.Errorf("[sign]: %w", err)
 	}
 	return token, nil
 }
@@ -40,9 +50,8 @@ func (j JWTer) authenticateJWT(jwtStr, wantTokenType string) (*IMSClaims, error)
 		return nil, errors.New("no JWT string provided")
 	}
 	claims := IMSClaims{}
-	tok, err := jwt.ParseWithClaims(jwtStr, &claims, func(token *jwt.Token) (any, error) {
-		return []byte(j.SecretKey), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	tok, err := jwt.ParseWithClaims(jwtStr, &claims, j.keyRing().keyFunc,
+		jwt.WithValidMethods([]string{AlgorithmHS256, AlgorithmEdDSA}))
 	if err != nil {
 		return nil, fmt.Errorf("[jwt.Parse]: %w", err)
 	}
@@ -132,4 +132,19 @@ func TestTokenTypesAreNotInterchangeable(t *testing.T) {
 	_, err = jwter.AuthenticateRefreshToken(accessToken)
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "token type")
+
+	// A second factor token is good for nothing else, and nothing else is
+	// good for it
+	secondFactorToken, err := jwter.CreateSecondFactorToken("Hardware", 12345, time.Now().Add(1*time.Hour))
+	require.NoError(t, err)
+	_, err = jwter.AuthenticateSecondFactorToken(secondFactorToken)
+	require.NoError(t, err)
+	_, err = jwter.AuthenticateJWT(secondFactorToken)
+	require.ErrorContains(t, err, "token type")
+	_, err = jwter.AuthenticateRefreshToken(secondFactorToken)
+	require.ErrorContains(t, err, "token type")
+	_, err = jwter.AuthenticateSecondFactorToken(accessToken)
+	require.ErrorContains(t, err, "token type")
+	_, err = jwter.AuthenticateSecondFactorToken(refreshToken)
+	require.ErrorContains(t, err, "token type")
 }
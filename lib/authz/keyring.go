@@ -0,0 +1,312 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authz
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// These are the algorithms that a SigningKey may use.
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+const (
+	// keyRingReloadInterval is how often a KeyRing reloads its keys, which is
+	// about how long it takes every server to start signing with a new key.
+	keyRingReloadInterval = time.Minute
+
+	// keyRingMissInterval is how often a KeyRing may reload its keys early,
+	// e.g. because it's been given a JWT signed by a key it doesn't know yet.
+	keyRingMissInterval = 5 * time.Second
+
+	// keyRingLoadTimeout bounds how long loading the keys may hold up the
+	// request that needed them.
+	keyRingLoadTimeout = 10 * time.Second
+)
+
+// SigningKey is a key that IMS signs JWTs with, or once did and still accepts
+// JWTs from.
+type SigningKey struct {
+	// ID goes in the "kid" header of every JWT the key signs.
+	ID string
+	// Algorithm is AlgorithmHS256 or AlgorithmEdDSA.
+	Algorithm string
+	// Secret is the HS256 secret, or the seed of the Ed25519 private key.
+	Secret []byte
+	// Created is when the key was made.
+	Created time.Time
+	// Retired is when the key was replaced as the one to sign with, or zero if
+	// it hasn't been. A retired key is kept only to verify the JWTs it signed.
+	Retired time.Time
+}
+
+// NewSigningKey makes a new random key, with a random ID.
+func NewSigningKey(algorithm string) (SigningKey, error) {
+	switch algorithm {
+	case AlgorithmHS256, AlgorithmEdDSA:
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported JWT signing algorithm %q", algorithm)
+	}
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return SigningKey{
+		ID:        rand.Text(),
+		Algorithm: algorithm,
+		Secret:    secret,
+		Created:   time.Now(),
+	}, nil
+}
+
+func (k SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == AlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodHS256
+}
+
+func (k SigningKey) signingKey() any {
+	if k.Algorithm == AlgorithmEdDSA {
+		return ed25519.NewKeyFromSeed(k.Secret)
+	}
+	return k.Secret
+}
+
+func (k SigningKey) verificationKey() any {
+	if k.Algorithm == AlgorithmEdDSA {
+		return k.PublicKey()
+	}
+	return k.Secret
+}
+
+// PublicKey gives the public half of an EdDSA key, or nil for an HS256 key,
+// which has no public half.
+func (k SigningKey) PublicKey() ed25519.PublicKey {
+	if k.Algorithm != AlgorithmEdDSA || len(k.Secret) != ed25519.SeedSize {
+		return nil
+	}
+	return ed25519.NewKeyFromSeed(k.Secret).Public().(ed25519.PublicKey)
+}
+
+// KeyLoader gives the SigningKeys that are currently in use, newest first. It
+// should leave out retired keys once all the JWTs they signed have expired.
+type KeyLoader func(ctx context.Context) ([]SigningKey, error)
+
+// KeyRing holds the keys that a JWTer signs and verifies with. These are the
+// configured secrets, which are always HS256, and any keys from a KeyLoader,
+// which are reloaded every so often, so that a key can be rotated without
+// restarting the server.
+//
+// JWTs are signed with the newest loaded key that hasn't been retired, and
+// get that key's ID as their "kid". Without such a key, they're signed with
+// the first configured secret, and get no "kid", as they did before there
+// were KeyRings. JWTs without a "kid" stop being accepted once the oldest
+// loaded key is older than the longest that any JWT is good for, since every
+// JWT signed with a secret has expired by then.
+type KeyRing struct {
+	secrets       []string
+	load          KeyLoader
+	tokenLifetime time.Duration
+
+	mu            sync.Mutex
+	keys          []SigningKey
+	loading       bool
+	loadedAt      time.Time
+	loadedEarlyAt time.Time
+	// firstLoad is closed once the keys have been loaded, or failed to load,
+	// for the first time.
+	firstLoad     chan struct{}
+	firstLoadOnce sync.Once
+}
+
+// NewKeyRing makes a KeyRing that signs with secret, unless load gives it a
+// key to sign with instead. The previousSecrets are only used to verify JWTs,
+// e.g. so that the secret can be changed without logging everyone out. load
+// may be nil, to use only the secrets. tokenLifetime is the longest that any
+// JWT is good for.
+func NewKeyRing(secret string, previousSecrets []string, load KeyLoader, tokenLifetime time.Duration) *KeyRing {
+	return &KeyRing{
+		secrets:       append([]string{secret}, previousSecrets...),
+		load:          load,
+		tokenLifetime: tokenLifetime,
+		firstLoad:     make(chan struct{}),
+	}
+}
+
+// loaded gives the keys from the KeyLoader, reloading them first if they're
+// due to be. With early set, they're reloaded even if they're not due, unless
+// that was already done within the last keyRingMissInterval. When reloading
+// fails, the keys that were loaded before are kept.
+//
+// The KeyLoader is called without holding the lock, so that a slow database
+// holds up only the one caller that's reloading. Everyone else carries on
+// with the keys that were loaded before, except before the first load, when
+// there are none to go on.
+func (r *KeyRing) loaded(early bool) []SigningKey {
+	if r.load == nil {
+		return nil
+	}
+	r.mu.Lock()
+	now := time.Now()
+	due := false
+	switch {
+	case r.loading:
+	case now.Sub(r.loadedAt) >= keyRingReloadInterval:
+		due = true
+	case early && now.Sub(r.loadedEarlyAt) >= keyRingMissInterval:
+		r.loadedEarlyAt = now
+		due = true
+	}
+	if !due {
+		r.mu.Unlock()
+		<-r.firstLoad
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.keys
+	}
+	// This counts as a load even if it fails, so that a failing KeyLoader isn't
+	// called for every JWT.
+	r.loadedAt = now
+	r.loading = true
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), keyRingLoadTimeout)
+	defer cancel()
+	keys, err := r.load(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loading = false
+	r.firstLoadOnce.Do(func() { close(r.firstLoad) })
+	if err != nil {
+		slog.Error("Failed to load JWT signing keys", "error", err)
+		return r.keys
+	}
+	r.keys = keys
+	return r.keys
+}
+
+// secretsRetired is whether JWTs signed with the secrets have all expired,
+// because keys have been loaded for longer than any JWT is good for. A retired
+// key is only pruned once it's been retired that long, so the oldest loaded key
+// is at least that old whenever an even older one has been pruned.
+func (r *KeyRing) secretsRetired(keys []SigningKey) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	oldest := keys[0].Created
+	for _, k := range keys[1:] {
+		if k.Created.Before(oldest) {
+			oldest = k.Created
+		}
+	}
+	return time.Since(oldest) > r.tokenLifetime
+}
+
+// PublicKey is the public half of an EdDSA SigningKey.
+type PublicKey struct {
+	ID  string
+	Key ed25519.PublicKey
+}
+
+// PublicKeys gives the EdDSA keys that JWTs are currently being signed or
+// verified with, for publishing as a JWKS.
+func (r *KeyRing) PublicKeys() []PublicKey {
+	var public []PublicKey
+	// A downstream service fetches these when it sees a "kid" it doesn't know,
+	// so they should be as fresh as the ones used for verifying.
+	for _, k := range r.loaded(true) {
+		if pub := k.PublicKey(); pub != nil {
+			public = append(public, PublicKey{ID: k.ID, Key: pub})
+		}
+	}
+	return public
+}
+
+func (r *KeyRing) sign(claims IMSClaims) (string, error) {
+	for _, k := range r.loaded(false) {
+		if !k.Retired.IsZero() {
+			continue
+		}
+		token := jwt.NewWithClaims(k.method(), claims)
+		token.Header["kid"] = k.ID
+		signed, err := token.SignedString(k.signingKey())
+		if err != nil {
+			return "", fmt.Errorf("[SignedString]: %w", err)
+		}
+		return signed, nil
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(r.secrets[0]))
+	if err != nil {
+		return "", fmt.Errorf("[SignedString]: %w", err)
+	}
+	return signed, nil
+}
+
+// keyFunc finds the key to verify a JWT with, for jwt.Parse.
+func (r *KeyRing) keyFunc(token *jwt.Token) (any, error) {
+	kidVal, hasKID := token.Header["kid"]
+	if !hasKID {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("a JWT without a key ID must use HS256")
+		}
+		if r.secretsRetired(r.loaded(false)) {
+			return nil, errors.New("JWTs without a key ID are no longer accepted")
+		}
+		keys := jwt.VerificationKeySet{}
+		for _, secret := range r.secrets {
+			keys.Keys = append(keys.Keys, []byte(secret))
+		}
+		return keys, nil
+	}
+	kid, ok := kidVal.(string)
+	if !ok || kid == "" {
+		return nil, errors.New("the JWT's key ID is invalid")
+	}
+	key, ok := findKey(r.loaded(false), kid)
+	if !ok {
+		// The key may have been made since the keys were last loaded, e.g. if
+		// it was rotated in and another server has already signed with it.
+		key, ok = findKey(r.loaded(true), kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("key %q is for %v, not %v", kid, key.Algorithm, token.Method.Alg())
+	}
+	return key.verificationKey(), nil
+}
+
+func findKey(keys []SigningKey, id string) (SigningKey, bool) {
+	for _, k := range keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return SigningKey{}, false
+}
@@ -0,0 +1,264 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authz_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/lib/authz"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeys stands in for the database that a KeyRing loads its keys from.
+type fakeKeys struct {
+	mu    sync.Mutex
+	keys  []authz.SigningKey
+	loads int
+}
+
+func (f *fakeKeys) load(_ context.Context) ([]authz.SigningKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loads++
+	return f.keys, nil
+}
+
+// rotate makes a new key to sign with, as the rotate-jwt-key command does.
+func (f *fakeKeys) rotate(t *testing.T, algorithm string) authz.SigningKey {
+	t.Helper()
+	key, err := authz.NewSigningKey(algorithm)
+	require.NoError(t, err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.keys {
+		if f.keys[i].Retired.IsZero() {
+			f.keys[i].Retired = time.Now()
+		}
+	}
+	f.keys = append([]authz.SigningKey{key}, f.keys...)
+	return key
+}
+
+func accessToken(t *testing.T, jwter authz.JWTer) string {
+	t.Helper()
+	token, err := jwter.CreateAccessToken("Hardware", 12345, nil, nil, true, nil, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	return token
+}
+
+func keyID(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &authz.IMSClaims{})
+	require.NoError(t, err)
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyRingSignsWithSecretUntilThereIsAKey(t *testing.T) {
+	t.Parallel()
+	keys := &fakeKeys{}
+	jwter := authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, keys.load, time.Hour)}
+
+	// With no keys loaded, it's just like a JWTer with only a SecretKey, so the
+	// two can verify each other's JWTs.
+	token := accessToken(t, jwter)
+	assert.Empty(t, keyID(t, token))
+	_, err := authz.JWTer{SecretKey: "some-secret"}.AuthenticateJWT(token)
+	require.NoError(t, err)
+	_, err = jwter.AuthenticateJWT(accessToken(t, authz.JWTer{SecretKey: "some-secret"}))
+	require.NoError(t, err)
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	t.Parallel()
+	keys := &fakeKeys{}
+	first := keys.rotate(t, authz.AlgorithmHS256)
+	jwter := authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, keys.load, time.Hour)}
+
+	signedByFirst := accessToken(t, jwter)
+	assert.Equal(t, first.ID, keyID(t, signedByFirst))
+	_, err := jwter.AuthenticateJWT(signedByFirst)
+	require.NoError(t, err)
+
+	// Another server rotates in a new key and signs with it. This server hears
+	// about the new key as soon as it sees a JWT that was signed with it.
+	second := keys.rotate(t, authz.AlgorithmEdDSA)
+	otherServer := authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, keys.load, time.Hour)}
+	signedBySecond := accessToken(t, otherServer)
+	assert.Equal(t, second.ID, keyID(t, signedBySecond))
+	_, err = jwter.AuthenticateJWT(signedBySecond)
+	require.NoError(t, err)
+
+	// The retired key still verifies the JWTs it signed, but this server now
+	// signs with the new key.
+	_, err = jwter.AuthenticateJWT(signedByFirst)
+	require.NoError(t, err)
+	assert.Equal(t, second.ID, keyID(t, accessToken(t, jwter)))
+
+	// A JWT signed with the configured secret from before any rotation is
+	// still good too.
+	_, err = jwter.AuthenticateJWT(accessToken(t, authz.JWTer{SecretKey: "some-secret"}))
+	require.NoError(t, err)
+
+	// Only the EdDSA key has a public half.
+	public := jwter.Keys.PublicKeys()
+	require.Len(t, public, 1)
+	assert.Equal(t, second.ID, public[0].ID)
+	assert.Equal(t, second.PublicKey(), public[0].Key)
+}
+
+func TestKeyRingPreviousSecrets(t *testing.T) {
+	t.Parallel()
+	jwter := authz.JWTer{Keys: authz.NewKeyRing("new-secret", []string{"old-secret"}, nil, time.Hour)}
+
+	_, err := jwter.AuthenticateJWT(accessToken(t, authz.JWTer{SecretKey: "old-secret"}))
+	require.NoError(t, err)
+	_, err = authz.JWTer{SecretKey: "new-secret"}.AuthenticateJWT(accessToken(t, jwter))
+	require.NoError(t, err)
+	_, err = jwter.AuthenticateJWT(accessToken(t, authz.JWTer{SecretKey: "other-secret"}))
+	require.ErrorContains(t, err, "signature is invalid")
+}
+
+func TestKeyRingRejectsBadKeyIDs(t *testing.T) {
+	t.Parallel()
+	keys := &fakeKeys{}
+	key := keys.rotate(t, authz.AlgorithmHS256)
+	jwter := authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, keys.load, time.Hour)}
+	claims := authz.IMSClaims{}.
+		WithExpiration(time.Now().Add(time.Hour)).
+		WithTokenType(authz.TokenTypeAccess).
+		WithRangerHandle("Hardware")
+
+	// An unknown key ID may make the KeyRing reload its keys early, but not on
+	// every JWT, lest anyone be able to hammer the database with made-up ones.
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	unknown.Header["kid"] = "nonexistent"
+	signed, err := unknown.SignedString(key.Secret)
+	require.NoError(t, err)
+	for range 3 {
+		_, err = jwter.AuthenticateJWT(signed)
+		require.ErrorContains(t, err, "unknown key ID")
+	}
+	assert.Equal(t, 2, keys.loads)
+
+	// A JWT must use the algorithm of the key it names.
+	edKey := keys.rotate(t, authz.AlgorithmEdDSA)
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	confused.Header["kid"] = edKey.ID
+	signed, err = confused.SignedString([]byte(edKey.PublicKey()))
+	require.NoError(t, err)
+	_, err = authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, keys.load, time.Hour)}.AuthenticateJWT(signed)
+	require.ErrorContains(t, err, "is for EdDSA")
+
+	// A JWT without a key ID must be signed with one of the secrets.
+	noKID := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	signed, err = noKID.SignedString(ed25519.NewKeyFromSeed(edKey.Secret))
+	require.NoError(t, err)
+	_, err = jwter.AuthenticateJWT(signed)
+	require.ErrorContains(t, err, "must use HS256")
+}
+
+func TestKeyRingStopsAcceptingSecrets(t *testing.T) {
+	t.Parallel()
+	keys := &fakeKeys{}
+	key := keys.rotate(t, authz.AlgorithmEdDSA)
+	jwter := authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, keys.load, time.Hour)}
+	signedBySecret := accessToken(t, authz.JWTer{SecretKey: "some-secret"})
+
+	// JWTs signed with the secret may have been signed just before the key was
+	// made, so they're good until they could all have expired.
+	_, err := jwter.AuthenticateJWT(signedBySecret)
+	require.NoError(t, err)
+
+	keys.mu.Lock()
+	keys.keys[0].Created = key.Created.Add(-2 * time.Hour)
+	keys.mu.Unlock()
+	jwter = authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, keys.load, time.Hour)}
+	_, err = jwter.AuthenticateJWT(signedBySecret)
+	require.ErrorContains(t, err, "no longer accepted")
+
+	// JWTs signed with the key are still good.
+	_, err = jwter.AuthenticateJWT(accessToken(t, jwter))
+	require.NoError(t, err)
+}
+
+func TestKeyRingLoadsWithoutBlocking(t *testing.T) {
+	t.Parallel()
+	keys := &fakeKeys{}
+	key := keys.rotate(t, authz.AlgorithmHS256)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var slow atomic.Bool
+	load := func(ctx context.Context) ([]authz.SigningKey, error) {
+		if slow.Load() {
+			close(started)
+			<-unblock
+		}
+		return keys.load(ctx)
+	}
+	jwter := authz.JWTer{Keys: authz.NewKeyRing("some-secret", nil, load, time.Hour)}
+	token := accessToken(t, jwter)
+	assert.Equal(t, key.ID, keyID(t, token))
+
+	// An unknown key ID makes the KeyRing reload its keys, which here waits on
+	// a slow database.
+	slow.Store(true)
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, authz.IMSClaims{}.
+		WithExpiration(time.Now().Add(time.Hour)).
+		WithTokenType(authz.TokenTypeAccess).
+		WithRangerHandle("Hardware"))
+	unknown.Header["kid"] = "nonexistent"
+	signed, err := unknown.SignedString(key.Secret)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		_, err := jwter.AuthenticateJWT(signed)
+		assert.ErrorContains(t, err, "unknown key ID")
+	})
+	<-started
+
+	// Meanwhile, JWTs are still signed and verified with the keys that were
+	// loaded before.
+	_, err = jwter.AuthenticateJWT(accessToken(t, jwter))
+	require.NoError(t, err)
+	close(unblock)
+	wg.Wait()
+}
+
+func TestNewSigningKey(t *testing.T) {
+	t.Parallel()
+	_, err := authz.NewSigningKey("RS256")
+	require.ErrorContains(t, err, "unsupported")
+
+	a, err := authz.NewSigningKey(authz.AlgorithmEdDSA)
+	require.NoError(t, err)
+	b, err := authz.NewSigningKey(authz.AlgorithmEdDSA)
+	require.NoError(t, err)
+	assert.NotEqual(t, a.ID, b.ID)
+	assert.NotEqual(t, a.PublicKey(), b.PublicKey())
+
+	hs, err := authz.NewSigningKey(authz.AlgorithmHS256)
+	require.NoError(t, err)
+	assert.Nil(t, hs.PublicKey())
+}
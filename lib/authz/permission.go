@@ -20,7 +20,6 @@ import (
 	"context"
 	"fmt"
 	"slices"
-	"strings"
 	"time"
 
 	"github.com/burningmantech/ranger-ims-go/directory"
@@ -37,18 +36,20 @@ const (
 )
 
 const (
-	modeRead        = imsdb.EventAccessModeRead
-	modeWrite       = imsdb.EventAccessModeWrite
-	modeReport      = imsdb.EventAccessModeReport
-	modeWriteVisits = imsdb.EventAccessModeWriteVisits
+	modeRead             = imsdb.EventAccessModeRead
+	modeWrite            = imsdb.EventAccessModeWrite
+	modeReport           = imsdb.EventAccessModeReport
+	modeWriteVisits      = imsdb.EventAccessModeWriteVisits
+	modeReadConfidential = imsdb.EventAccessModeReadConfidential
 )
 
 var (
 	modeToRole = map[imsdb.EventAccessMode]Role{
-		modeRead:        EventReader,
-		modeWrite:       EventWriter,
-		modeReport:      EventReporter,
-		modeWriteVisits: EventVisitWriter,
+		modeRead:             EventReader,
+		modeWrite:            EventWriter,
+		modeReport:           EventReporter,
+		modeWriteVisits:      EventVisitWriter,
+		modeReadConfidential: EventConfidentialReader,
 	}
 )
 
@@ -58,7 +59,11 @@ const (
 	EventReader          Role = "EventReader"
 	EventWriter          Role = "EventWriter"
 	EventVisitWriter     Role = "EventVisitWriter"
-	Administrator        Role = "Administrator"
+	// EventConfidentialReader may read confidential Incidents, and the Field
+	// Reports and Visits attached to them, as long as they may read the
+	// Incidents, Field Reports, or Visits in the first place.
+	EventConfidentialReader Role = "EventConfidentialReader"
+	Administrator           Role = "Administrator"
 )
 
 type GlobalPermissionMask uint16
@@ -82,6 +87,7 @@ const (
 	EventReadPlaces
 	EventReadVisits
 	EventWriteVisits
+	EventReadConfidential
 )
 
 const (
@@ -103,10 +109,11 @@ var RolesToGlobalPerms = map[Role]GlobalPermissionMask{
 }
 
 var RolesToEventPerms = map[Role]EventPermissionMask{
-	EventReporter:    EventReadEventName | EventReadOwnFieldReports | EventWriteOwnFieldReports | EventReadPlaces,
-	EventReader:      EventReadEventName | EventReadIncidents | EventReadOwnFieldReports | EventReadAllFieldReports | EventReadVisits | EventReadPlaces,
-	EventWriter:      EventReadEventName | EventReadIncidents | EventWriteIncidents | EventReadAllFieldReports | EventReadOwnFieldReports | EventWriteAllFieldReports | EventWriteOwnFieldReports | EventReadVisits | EventWriteVisits | EventReadPlaces,
-	EventVisitWriter: EventReadEventName | EventReadVisits | EventWriteVisits | EventReadPlaces,
+	EventReporter:           EventReadEventName | EventReadOwnFieldReports | EventWriteOwnFieldReports | EventReadPlaces,
+	EventReader:             EventReadEventName | EventReadIncidents | EventReadOwnFieldReports | EventReadAllFieldReports | EventReadVisits | EventReadPlaces,
+	EventWriter:             EventReadEventName | EventReadIncidents | EventWriteIncidents | EventReadAllFieldReports | EventReadOwnFieldReports | EventWriteAllFieldReports | EventWriteOwnFieldReports | EventReadVisits | EventWriteVisits | EventReadPlaces,
+	EventVisitWriter:        EventReadEventName | EventReadVisits | EventWriteVisits | EventReadPlaces,
+	EventConfidentialReader: EventReadConfidential,
 }
 
 func EventPermissions(
@@ -117,6 +124,10 @@ func EventPermissions(
 	imsAdmins []string,
 	claims IMSClaims,
 ) (eventPermissions map[int32]EventPermissionMask, globalPermissions GlobalPermissionMask, err error) {
+	if apiToken := claims.APIToken(); apiToken != nil {
+		eventPermissions, globalPermissions = apiToken.permissions(eventID)
+		return eventPermissions, globalPermissions, nil
+	}
 	accessByEvent := make(map[int32][]imsdb.EventAccess)
 	if eventID != nil {
 		// If the eventID is the ID for an event group, this query returns no rows.
@@ -163,6 +174,26 @@ func EventPermissions(
 	return eventPermissions, globalPermissions, nil
 }
 
+// ClaimsSubject gives the AccessSubject for the person with these claims, so
+// that an access expression can be matched against them.
+func ClaimsSubject(ctx context.Context, userStore *directory.UserStore, claims IMSClaims) (AccessSubject, error) {
+	allPositions, allTeams, err := userStore.GetPositionsAndTeams(ctx)
+	if err != nil {
+		return AccessSubject{}, fmt.Errorf("[GetPositionsAndTeams]: %w", err)
+	}
+	subject := AccessSubject{Handle: claims.RangerHandle()}
+	for _, posID := range claims.RangerPositions() {
+		subject.Positions = append(subject.Positions, allPositions[posID])
+	}
+	for _, teamID := range claims.RangerTeams() {
+		subject.Teams = append(subject.Teams, allTeams[teamID])
+	}
+	if onDutyPositionID := claims.RangerOnDutyPosition(); onDutyPositionID != nil {
+		subject.OnDutyPosition = allPositions[*onDutyPositionID]
+	}
+	return subject, nil
+}
+
 func ManyEventPermissions(
 	accessByEvent map[int32][]imsdb.EventAccess, // eventID as key
 	imsAdmins []string,
@@ -202,31 +233,49 @@ func PersonMatches(
 	onsite bool,
 	onDutyPosition string,
 ) bool {
-	if ea.NotAfter.Valid && conv.FloatToTime(ea.NotAfter.Float64).Before(time.Now()) {
-		return false
-	}
-	if ea.NotBefore.Valid && conv.FloatToTime(ea.NotBefore.Float64).After(time.Now()) {
-		return false
-	}
-	matchExpr := false
-	if ea.Expression == "*" {
-		matchExpr = true
-	}
-	if strings.HasPrefix(ea.Expression, "person:") &&
-		strings.TrimPrefix(ea.Expression, "person:") == handle {
-		matchExpr = true
-	}
-	if strings.HasPrefix(ea.Expression, "position:") &&
-		slices.Contains(positions, strings.TrimPrefix(ea.Expression, "position:")) {
-		matchExpr = true
+	return len(ExplainPersonMatch(ea, handle, positions, teams, onsite, onDutyPosition, time.Now())) == 0
+}
+
+// AccessMismatch is a reason that an EVENT_ACCESS rule doesn't match someone.
+type AccessMismatch string
+
+const (
+	// MismatchNotAfter is a rule whose NotAfter time has passed.
+	MismatchNotAfter AccessMismatch = "not_after"
+	// MismatchNotBefore is a rule whose NotBefore time hasn't come yet.
+	MismatchNotBefore AccessMismatch = "not_before"
+	// MismatchExpression is a rule whose expression doesn't match the person.
+	MismatchExpression AccessMismatch = "expression"
+	// MismatchValidity is an onsite rule, and the person isn't onsite.
+	MismatchValidity AccessMismatch = "validity"
+)
+
+// ExplainPersonMatch gives every reason that the rule doesn't match the
+// person at the time now. There are none when it does match.
+func ExplainPersonMatch(
+	ea imsdb.EventAccess,
+	handle string,
+	positions []string,
+	teams []string,
+	onsite bool,
+	onDutyPosition string,
+	now time.Time,
+) []AccessMismatch {
+	var mismatches []AccessMismatch
+	if ea.NotAfter.Valid && conv.FloatToTime(ea.NotAfter.Float64).Before(now) {
+		mismatches = append(mismatches, MismatchNotAfter)
 	}
-	if strings.HasPrefix(ea.Expression, "onduty:") &&
-		onDutyPosition == strings.TrimPrefix(ea.Expression, "onduty:") {
-		matchExpr = true
+	if ea.NotBefore.Valid && conv.FloatToTime(ea.NotBefore.Float64).After(now) {
+		mismatches = append(mismatches, MismatchNotBefore)
 	}
-	if strings.HasPrefix(ea.Expression, "team:") &&
-		slices.Contains(teams, strings.TrimPrefix(ea.Expression, "team:")) {
-		matchExpr = true
+	matchExpr := CompileAccessExpression(ea.Expression).Matches(AccessSubject{
+		Handle:         handle,
+		Positions:      positions,
+		Teams:          teams,
+		OnDutyPosition: onDutyPosition,
+	})
+	if !matchExpr {
+		mismatches = append(mismatches, MismatchExpression)
 	}
 	matchValidity := false
 	if ea.Validity == validityAlways {
@@ -235,5 +284,8 @@ func PersonMatches(
 	if ea.Validity == validityOnsite && onsite {
 		matchValidity = true
 	}
-	return matchExpr && matchValidity
+	if !matchValidity {
+		mismatches = append(mismatches, MismatchValidity)
+	}
+	return mismatches
 }
@@ -257,6 +257,39 @@ func TestManyEventPermissions_oneExpressionManyModesExpiry(t *testing.T) {
 	require.Equal(t, EventNoPermissions, permissions[123]&EventWriteVisits)
 }
 
+// TestManyEventPermissions_readConfidential checks that the confidential mode
+// only adds to the other modes, rather than being a way to read on its own.
+func TestManyEventPermissions_readConfidential(t *testing.T) {
+	t.Parallel()
+	accessByEvent := make(map[int32][]imsdb.EventAccess)
+	addPerm(accessByEvent, 123, "person:Hardware", modeWrite, validityAlways)
+	addPerm(accessByEvent, 123, "person:Hardware", modeReadConfidential, validityAlways)
+	addPerm(accessByEvent, 123, "person:Loosy", modeReadConfidential, validityAlways)
+
+	permissions, _ := ManyEventPermissions(
+		accessByEvent,
+		testAdmins,
+		"Hardware",
+		true,
+		[]string{},
+		[]string{},
+		"",
+	)
+	require.Equal(t, writerPerm|EventReadConfidential, permissions[123])
+
+	permissions, _ = ManyEventPermissions(
+		accessByEvent,
+		testAdmins,
+		"Loosy",
+		true,
+		[]string{},
+		[]string{},
+		"",
+	)
+	require.Equal(t, EventReadConfidential, permissions[123])
+	require.Equal(t, EventNoPermissions, permissions[123]&EventReadIncidents)
+}
+
 func TestManyEventPermissions_positionRules(t *testing.T) {
 	t.Parallel()
 	accessByEvent := make(map[int32][]imsdb.EventAccess)
@@ -352,3 +385,30 @@ func TestManyEventPermissions_wildcardValidity(t *testing.T) {
 	require.Equal(t, EventNoPermissions, permissions[123])
 	require.Equal(t, authenticatedUserPerms, globalPermissions)
 }
+
+func TestExplainPersonMatch(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	past := conv.TimeToNullFloat(now.Add(-1 * time.Hour))
+	future := conv.TimeToNullFloat(now.Add(1 * time.Hour))
+	noTime := sql.NullFloat64{Valid: false}
+
+	explain := func(expr string, validity imsdb.EventAccessValidity, notAfter, notBefore sql.NullFloat64, onsite bool) []AccessMismatch {
+		ea := imsdb.EventAccess{Expression: expr, Mode: modeRead, Validity: validity, NotAfter: notAfter, NotBefore: notBefore}
+		return ExplainPersonMatch(ea, "Runner", []string{"Dirt"}, []string{"Running Squad"}, onsite, "", now)
+	}
+
+	require.Empty(t, explain("position:Dirt", validityAlways, noTime, noTime, false))
+	require.Empty(t, explain("team:Running Squad", validityOnsite, future, past, true))
+
+	require.Equal(t, []AccessMismatch{MismatchExpression}, explain("person:Swimmer", validityAlways, noTime, noTime, false))
+	require.Equal(t, []AccessMismatch{MismatchValidity}, explain("*", validityOnsite, noTime, noTime, false))
+	require.Equal(t, []AccessMismatch{MismatchNotAfter}, explain("*", validityAlways, past, noTime, false))
+	require.Equal(t, []AccessMismatch{MismatchNotBefore}, explain("*", validityAlways, noTime, future, false))
+
+	// Every reason is given, not only the first.
+	require.Equal(t,
+		[]AccessMismatch{MismatchNotAfter, MismatchNotBefore, MismatchExpression, MismatchValidity},
+		explain("team:Swimming Squad", validityOnsite, past, future, false),
+	)
+}
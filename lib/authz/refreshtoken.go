@@ -17,6 +17,7 @@
 package authz
 
 import (
+	"crypto/rand"
 	"strconv"
 	"time"
 )
@@ -32,12 +33,12 @@ const RefreshTokenCookieName = "refresh_token"
 // CreateRefreshToken creates a refresh token, which the client can use to request new access tokens,
 // based on any updated claims from the UserStore. It's an implementation detail that this is a JWT;
 // its "tok" claim marks it as a refresh token, so it cannot be used as an access token.
-// Ideally a refresh token is supposed to be persisted, so that it can be
-// invalidated from the server side. As a stopgap before we have such a per-user persistence component,
-// we instead rely on the security of JWT signing.
+// A refresh token is only good for as long as its server-side session is (see HashRefreshToken),
+// and each has a random ID, so that no two are ever the same.
 func (j JWTer) CreateRefreshToken(rangerName string, clubhouseID int64, expiration time.Time) (string, error) {
 	return j.createJWT(
 		IMSClaims{}.
+			WithID(rand.Text()).
 			WithIssuedAt(time.Now()).
 			WithExpiration(expiration).
 			WithIssuer("ims").
@@ -55,3 +56,9 @@ func (j JWTer) CreateRefreshToken(rangerName string, clubhouseID int64, expirati
 func (j JWTer) AuthenticateRefreshToken(refreshToken string) (*IMSClaims, error) {
 	return j.authenticateJWT(refreshToken, TokenTypeRefresh)
 }
+
+// HashRefreshToken gives the form of a refresh token that's stored in its
+// session. As with API tokens, a plain SHA-256 is enough.
+func HashRefreshToken(refreshToken string) string {
+	return hashToken(refreshToken)
+}
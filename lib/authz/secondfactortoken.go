@@ -0,0 +1,47 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package authz
+
+import (
+	"strconv"
+	"time"
+)
+
+// SecondFactorTokenLifetime is how long someone has between giving their
+// password and giving their second factor.
+const SecondFactorTokenLifetime = 5 * time.Minute
+
+// CreateSecondFactorToken creates the token that's handed out in place of an
+// access token, when someone who has given the right password must still give
+// a second factor. It vouches for the password only, and is good for nothing
+// but exchanging, along with the second factor, for an access token.
+func (j JWTer) CreateSecondFactorToken(rangerName string, directoryID int64, expiration time.Time) (string, error) {
+	return j.createJWT(
+		IMSClaims{}.
+			WithIssuedAt(time.Now()).
+			WithExpiration(expiration).
+			WithIssuer("ims").
+			WithTokenType(TokenTypeSecondFactor).
+			WithRangerHandle(rangerName).
+			WithSubject(strconv.FormatInt(directoryID, 10)),
+	)
+}
+
+// AuthenticateSecondFactorToken validates a token from CreateSecondFactorToken.
+func (j JWTer) AuthenticateSecondFactorToken(token string) (*IMSClaims, error) {
+	return j.authenticateJWT(token, TokenTypeSecondFactor)
+}
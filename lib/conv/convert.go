@@ -46,6 +46,13 @@ func SqlToInt32(v sql.NullInt32) *int32 {
 	return nil
 }
 
+func SqlToFloat64(v sql.NullFloat64) *float64 {
+	if v.Valid {
+		return &v.Float64
+	}
+	return nil
+}
+
 func ParseInt32(s string) (int32, error) {
 	i, err := strconv.ParseInt(s, 10, 32)
 	if err != nil {
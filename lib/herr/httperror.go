@@ -36,6 +36,9 @@ type HTTPError struct {
 	// ExpectedError indicates that this error should happen in normal operation.
 	// It's just used to tell IMS not to bother logging this error.
 	ExpectedError bool
+	// Violations are the rules that the request broke, if that's what's wrong
+	// with it.
+	Violations []Violation
 }
 
 func (e *HTTPError) Error() string {
@@ -100,6 +103,11 @@ func PreconditionFailed(userMessage string, err error) *HTTPError {
 	return New(http.StatusPreconditionFailed, userMessage, err)
 }
 
+// TooManyRequests returns an http.StatusTooManyRequests HTTPError.
+func TooManyRequests(userMessage string, err error) *HTTPError {
+	return New(http.StatusTooManyRequests, userMessage, err)
+}
+
 // From wraps the InternalErr using fmt.Sprintf. This should be used to specify
 // the name of a function that returned an error. See httperror_test.go for
 // examples of wrapping.
@@ -109,6 +117,7 @@ func (e *HTTPError) From(source string) *HTTPError {
 		Code:            e.Code,
 		ResponseMessage: e.ResponseMessage,
 		ExpectedError:   e.ExpectedError,
+		Violations:      e.Violations,
 	}
 }
 
@@ -117,6 +126,13 @@ func (e *HTTPError) SetExpectedError() *HTTPError {
 	return e
 }
 
+// SetViolations records the rules that the request broke, which are included
+// in the response.
+func (e *HTTPError) SetViolations(violations []Violation) *HTTPError {
+	e.Violations = violations
+	return e
+}
+
 func (e *HTTPError) Unwrap() error {
 	return e.InternalErr
 }
@@ -143,9 +159,10 @@ func (e *HTTPError) WriteResponse(w http.ResponseWriter) {
 	}
 
 	p := Problem{
-		Status:    e.Code,
-		Detail:    e.ResponseMessage,
-		Timestamp: time.Now().UTC(),
+		Status:     e.Code,
+		Detail:     e.ResponseMessage,
+		Timestamp:  time.Now().UTC(),
+		Violations: e.Violations,
 	}
 
 	// Write headers, write status, write body
@@ -119,6 +119,24 @@ func TestWriteResponse(t *testing.T) {
 	})
 }
 
+func TestWriteResponseViolations(t *testing.T) {
+	t.Parallel()
+	rec := httptest.NewRecorder()
+	violations := []Violation{{Rule: "min_length", Detail: "Too short"}}
+	errHTTP := BadRequest("Too short", nil).SetViolations(violations).From("[checkPassword]")
+	errHTTP.WriteResponse(rec)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	problem := Problem{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal(t, violations, problem.Violations)
+
+	// Most problems have none, and the field is left out.
+	rec = httptest.NewRecorder()
+	BadRequest("Bad", nil).WriteResponse(rec)
+	assert.NotContains(t, rec.Body.String(), "violations")
+}
+
 var errInternal = errors.New("something bad")
 
 func inner() *HTTPError {
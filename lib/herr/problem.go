@@ -40,4 +40,16 @@ type Problem struct {
 
 	// Timestamp is the time at which the Problem was created.
 	Timestamp time.Time `json:"timestamp"`
+
+	// Violations are the rules that the request broke, for a request that was
+	// rejected for breaking any, such as a password that's too weak.
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// Violation is a rule that a request broke.
+type Violation struct {
+	// Rule is a short, stable name for the rule, such as "min_length".
+	Rule string `json:"rule"`
+	// Detail is a human-readable explanation of how the rule was broken.
+	Detail string `json:"detail"`
 }
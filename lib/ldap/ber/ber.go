@@ -0,0 +1,298 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package ber encodes and decodes the subset of ASN.1 Basic Encoding Rules
+// that LDAP uses (RFC 4511 section 5.1): definite lengths, and tag numbers
+// below 31, so that every identifier is a single octet.
+package ber
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Class is the class bits of a Packet's identifier octet.
+type Class byte
+
+const (
+	ClassUniversal   Class = 0x00
+	ClassApplication Class = 0x40
+	ClassContext     Class = 0x80
+)
+
+// Universal tag numbers.
+const (
+	TagBoolean     = 0x01
+	TagInteger     = 0x02
+	TagOctetString = 0x04
+	TagNull        = 0x05
+	TagEnumerated  = 0x0a
+	TagSequence    = 0x10
+	TagSet         = 0x11
+)
+
+const constructedBit = 0x20
+
+// maxPacketLen bounds a single Packet, so that a confused or hostile peer
+// can't make us allocate without limit.
+const maxPacketLen = 64 << 20
+
+// Packet is one BER element. A constructed Packet has Children, and a
+// primitive one has a Value.
+type Packet struct {
+	Class       Class
+	Constructed bool
+	Tag         byte
+	Value       []byte
+	Children    []*Packet
+}
+
+// NewSequence makes a universal SEQUENCE of the children.
+func NewSequence(children ...*Packet) *Packet {
+	return NewConstructed(ClassUniversal, TagSequence, children...)
+}
+
+// NewSet makes a universal SET of the children.
+func NewSet(children ...*Packet) *Packet {
+	return NewConstructed(ClassUniversal, TagSet, children...)
+}
+
+// NewConstructed makes a constructed Packet with the given class and tag.
+func NewConstructed(class Class, tag byte, children ...*Packet) *Packet {
+	return &Packet{Class: class, Constructed: true, Tag: tag, Children: children}
+}
+
+// NewPrimitive makes a primitive Packet with the given class, tag, and value.
+func NewPrimitive(class Class, tag byte, value []byte) *Packet {
+	return &Packet{Class: class, Tag: tag, Value: value}
+}
+
+// NewString makes a universal OCTET STRING.
+func NewString(s string) *Packet {
+	return NewPrimitive(ClassUniversal, TagOctetString, []byte(s))
+}
+
+// NewInteger makes a universal INTEGER.
+func NewInteger(i int64) *Packet {
+	return NewPrimitive(ClassUniversal, TagInteger, encodeInt(i))
+}
+
+// NewEnumerated makes a universal ENUMERATED.
+func NewEnumerated(i int64) *Packet {
+	return NewPrimitive(ClassUniversal, TagEnumerated, encodeInt(i))
+}
+
+// NewBoolean makes a universal BOOLEAN.
+func NewBoolean(b bool) *Packet {
+	if b {
+		return NewPrimitive(ClassUniversal, TagBoolean, []byte{0xff})
+	}
+	return NewPrimitive(ClassUniversal, TagBoolean, []byte{0x00})
+}
+
+// Is reports whether the Packet has the given class and tag.
+func (p *Packet) Is(class Class, tag byte) bool {
+	return p.Class == class && p.Tag == tag
+}
+
+// String gives the Packet's value as a string, as for an OCTET STRING.
+func (p *Packet) String() string {
+	return string(p.Value)
+}
+
+// Int gives the Packet's value as an integer, as for an INTEGER or ENUMERATED.
+func (p *Packet) Int() (int64, error) {
+	if len(p.Value) == 0 || len(p.Value) > 8 {
+		return 0, fmt.Errorf("integer of %v bytes", len(p.Value))
+	}
+	// Sign-extend from the first byte.
+	i := int64(int8(p.Value[0]))
+	for _, b := range p.Value[1:] {
+		i = i<<8 | int64(b)
+	}
+	return i, nil
+}
+
+// Bool gives the Packet's value as a BOOLEAN.
+func (p *Packet) Bool() (bool, error) {
+	if len(p.Value) != 1 {
+		return false, fmt.Errorf("boolean of %v bytes", len(p.Value))
+	}
+	return p.Value[0] != 0, nil
+}
+
+func encodeInt(i int64) []byte {
+	// Big-endian two's complement, in as few bytes as keep the sign.
+	b := []byte{byte(i)}
+	for i >>= 8; ; i >>= 8 {
+		last := b[0]
+		if (i == 0 && last&0x80 == 0) || (i == -1 && last&0x80 != 0) {
+			return b
+		}
+		b = append([]byte{byte(i)}, b...)
+	}
+}
+
+// Bytes encodes the Packet.
+func (p *Packet) Bytes() []byte {
+	content := p.Value
+	if p.Constructed {
+		content = nil
+		for _, child := range p.Children {
+			content = append(content, child.Bytes()...)
+		}
+	}
+	identifier := byte(p.Class) | p.Tag
+	if p.Constructed {
+		identifier |= constructedBit
+	}
+	out := []byte{identifier}
+	out = append(out, encodeLength(len(content))...)
+	return append(out, content...)
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Read reads one Packet from r.
+func Read(r *bufio.Reader) (*Packet, error) {
+	identifier, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("[ReadByte]: %w", err)
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return nil, fmt.Errorf("[readLength]: %w", err)
+	}
+	content := make([]byte, length)
+	if _, err = io.ReadFull(r, content); err != nil {
+		return nil, fmt.Errorf("[ReadFull]: %w", err)
+	}
+	return build(identifier, content)
+}
+
+// Decode decodes the one Packet that is all of b.
+func Decode(b []byte) (*Packet, error) {
+	p, rest, err := decode(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%v trailing bytes", len(rest))
+	}
+	return p, nil
+}
+
+func decode(b []byte) (p *Packet, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("truncated packet")
+	}
+	identifier := b[0]
+	length, n, err := parseLength(b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	b = b[1+n:]
+	if length > len(b) {
+		return nil, nil, errors.New("truncated packet")
+	}
+	p, err = build(identifier, b[:length])
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, b[length:], nil
+}
+
+func build(identifier byte, content []byte) (*Packet, error) {
+	if identifier&0x1f == 0x1f {
+		return nil, errors.New("multi-byte tags are unsupported")
+	}
+	p := &Packet{
+		Class:       Class(identifier & 0xc0),
+		Constructed: identifier&constructedBit != 0,
+		Tag:         identifier & 0x1f,
+	}
+	if !p.Constructed {
+		p.Value = content
+		return p, nil
+	}
+	for len(content) > 0 {
+		child, rest, err := decode(content)
+		if err != nil {
+			return nil, err
+		}
+		p.Children = append(p.Children, child)
+		content = rest
+	}
+	return p, nil
+}
+
+func readLength(r *bufio.Reader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first&0x80 == 0 {
+		return int(first), nil
+	}
+	n := int(first & 0x7f)
+	if n == 0 || n > 4 {
+		return 0, fmt.Errorf("unsupported length of %v bytes", n)
+	}
+	length := 0
+	for range n {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	if length > maxPacketLen {
+		return 0, fmt.Errorf("packet of %v bytes is too long", length)
+	}
+	return length, nil
+}
+
+func parseLength(b []byte) (length, n int, err error) {
+	first := b[0]
+	if first&0x80 == 0 {
+		return int(first), 1, nil
+	}
+	n = int(first & 0x7f)
+	if n == 0 || n > 4 {
+		return 0, 0, fmt.Errorf("unsupported length of %v bytes", n)
+	}
+	if len(b) < 1+n {
+		return 0, 0, errors.New("truncated length")
+	}
+	for _, c := range b[1 : 1+n] {
+		length = length<<8 | int(c)
+	}
+	if length > maxPacketLen {
+		return 0, 0, fmt.Errorf("packet of %v bytes is too long", length)
+	}
+	return length, 1 + n, nil
+}
@@ -0,0 +1,81 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ber_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/burningmantech/ranger-ims-go/lib/ldap/ber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntegerRoundTrip(t *testing.T) {
+	t.Parallel()
+	for _, i := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40, -1 << 40} {
+		p, err := ber.Decode(ber.NewInteger(i).Bytes())
+		require.NoError(t, err)
+		got, err := p.Int()
+		require.NoError(t, err)
+		assert.Equal(t, i, got)
+	}
+	// Positive numbers with the top bit set need a leading zero byte.
+	assert.Equal(t, []byte{0x02, 0x02, 0x00, 0x80}, ber.NewInteger(128).Bytes())
+}
+
+func TestConstructedRoundTrip(t *testing.T) {
+	t.Parallel()
+	long := string(bytes.Repeat([]byte("x"), 300))
+	p := ber.NewSequence(
+		ber.NewInteger(7),
+		ber.NewConstructed(ber.ClassApplication, 3,
+			ber.NewString(long),
+			ber.NewBoolean(true),
+			ber.NewPrimitive(ber.ClassContext, 7, []byte("uid")),
+		),
+	)
+	encoded := p.Bytes()
+	// The 300-byte string has a two-byte long-form length.
+	assert.Contains(t, string(encoded), "\x04\x82\x01\x2c")
+
+	got, err := ber.Read(bufio.NewReader(bytes.NewReader(encoded)))
+	require.NoError(t, err)
+	assert.Equal(t, p, got)
+
+	op := got.Children[1]
+	assert.True(t, op.Is(ber.ClassApplication, 3))
+	assert.True(t, op.Constructed)
+	assert.Equal(t, long, op.Children[0].String())
+	b, err := op.Children[1].Bool()
+	require.NoError(t, err)
+	assert.True(t, b)
+	assert.True(t, op.Children[2].Is(ber.ClassContext, 7))
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	t.Parallel()
+	_, err := ber.Decode([]byte{0x30, 0x05, 0x02, 0x01})
+	require.Error(t, err)
+	_, err = ber.Decode([]byte{0x02, 0x01, 0x01, 0x00})
+	require.Error(t, err)
+	_, err = ber.Decode([]byte{0x1f, 0x01, 0x00})
+	require.Error(t, err)
+	_, err = ber.Read(bufio.NewReader(bytes.NewReader([]byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff})))
+	require.Error(t, err)
+}
@@ -0,0 +1,266 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/burningmantech/ranger-ims-go/lib/ldap/ber"
+)
+
+// Filter choice tags, all in the context class (RFC 4511 section 4.5.1).
+const (
+	FilterAnd             = 0
+	FilterOr              = 1
+	FilterNot             = 2
+	FilterEqualityMatch   = 3
+	FilterSubstrings      = 4
+	FilterGreaterOrEqual  = 5
+	FilterLessOrEqual     = 6
+	FilterPresent         = 7
+	FilterApproxMatch     = 8
+	FilterExtensibleMatch = 9
+)
+
+// Tags within a SubstringFilter and a MatchingRuleAssertion.
+const (
+	SubstringInitial = 0
+	SubstringAny     = 1
+	SubstringFinal   = 2
+
+	MatchingRule = 1
+	MatchingType = 2
+	MatchValue   = 3
+	DNAttributes = 4
+)
+
+// EscapeFilter escapes a value for use in a filter, such as a handle that
+// someone typed in, so that it can't change the filter's meaning.
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := range len(value) {
+		c := value[i]
+		switch c {
+		case '*', '(', ')', '\\', 0:
+			_, _ = fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter turns a filter from the string form of RFC 4515 into the
+// BER form that's sent to the server.
+func compileFilter(s string) (*ber.Packet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		// RFC 4515 requires the parentheses, but people often leave them off
+		// a simple filter like "objectClass=person".
+		s = "(" + s + ")"
+	}
+	p, rest, err := parseFilter(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", s, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid filter %q: trailing %q", s, rest)
+	}
+	return p, nil
+}
+
+// parseFilter parses one parenthesized filter from the start of s.
+func parseFilter(s string) (p *ber.Packet, rest string, err error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("expected '('")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("unexpected end")
+	}
+	switch s[0] {
+	case '&', '|':
+		tag := byte(FilterAnd)
+		if s[0] == '|' {
+			tag = FilterOr
+		}
+		p = ber.NewConstructed(ber.ClassContext, tag)
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			var child *ber.Packet
+			child, s, err = parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			p.Children = append(p.Children, child)
+		}
+	case '!':
+		var child *ber.Packet
+		child, s, err = parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		p = ber.NewConstructed(ber.ClassContext, FilterNot, child)
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", errors.New("expected ')'")
+		}
+		p, err = parseItem(s[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		s = s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", errors.New("expected ')'")
+	}
+	return p, s[1:], nil
+}
+
+// parseItem parses a filter that isn't an and, or, or not, without its
+// parentheses, e.g. "uid=tool".
+func parseItem(s string) (*ber.Packet, error) {
+	eq := strings.IndexByte(s, '=')
+	if eq < 1 {
+		return nil, fmt.Errorf("no attribute and '=' in %q", s)
+	}
+	rawValue := s[eq+1:]
+	attr := s[:eq]
+	var tag byte
+	switch attr[len(attr)-1] {
+	case '~':
+		tag = FilterApproxMatch
+	case '>':
+		tag = FilterGreaterOrEqual
+	case '<':
+		tag = FilterLessOrEqual
+	case ':':
+		return parseExtensible(attr[:len(attr)-1], rawValue)
+	default:
+		tag = FilterEqualityMatch
+	}
+	if tag != FilterEqualityMatch {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("no attribute in %q", s)
+	}
+	if tag == FilterEqualityMatch && rawValue == "*" {
+		return ber.NewPrimitive(ber.ClassContext, FilterPresent, []byte(attr)), nil
+	}
+	if tag == FilterEqualityMatch && strings.Contains(rawValue, "*") {
+		return parseSubstrings(attr, rawValue)
+	}
+	value, err := unescapeValue(rawValue)
+	if err != nil {
+		return nil, err
+	}
+	return ber.NewConstructed(ber.ClassContext, tag, ber.NewString(attr), ber.NewString(value)), nil
+}
+
+func parseSubstrings(attr, rawValue string) (*ber.Packet, error) {
+	parts := strings.Split(rawValue, "*")
+	substrings := ber.NewSequence()
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		value, err := unescapeValue(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(SubstringAny)
+		switch i {
+		case 0:
+			tag = SubstringInitial
+		case len(parts) - 1:
+			tag = SubstringFinal
+		}
+		substrings.Children = append(substrings.Children, ber.NewPrimitive(ber.ClassContext, tag, []byte(value)))
+	}
+	return ber.NewConstructed(ber.ClassContext, FilterSubstrings, ber.NewString(attr), substrings), nil
+}
+
+// parseExtensible parses an extensible match, such as the one that Active
+// Directory uses for bit flags: "userAccountControl:1.2.840.113556.1.4.803:=2".
+// lhs is everything before the ":=".
+func parseExtensible(lhs, rawValue string) (*ber.Packet, error) {
+	parts := strings.Split(lhs, ":")
+	attr := parts[0]
+	dnAttributes := false
+	rule := ""
+	for _, part := range parts[1:] {
+		switch {
+		case strings.EqualFold(part, "dn") && !dnAttributes && rule == "":
+			dnAttributes = true
+		case part != "" && rule == "":
+			rule = part
+		default:
+			return nil, fmt.Errorf("invalid extensible match %q", lhs)
+		}
+	}
+	if attr == "" && rule == "" {
+		return nil, fmt.Errorf("extensible match %q needs an attribute or a matching rule", lhs)
+	}
+	value, err := unescapeValue(rawValue)
+	if err != nil {
+		return nil, err
+	}
+	p := ber.NewConstructed(ber.ClassContext, FilterExtensibleMatch)
+	if rule != "" {
+		p.Children = append(p.Children, ber.NewPrimitive(ber.ClassContext, MatchingRule, []byte(rule)))
+	}
+	if attr != "" {
+		p.Children = append(p.Children, ber.NewPrimitive(ber.ClassContext, MatchingType, []byte(attr)))
+	}
+	p.Children = append(p.Children, ber.NewPrimitive(ber.ClassContext, MatchValue, []byte(value)))
+	if dnAttributes {
+		p.Children = append(p.Children, ber.NewPrimitive(ber.ClassContext, DNAttributes, []byte{0xff}))
+	}
+	return p, nil
+}
+
+// unescapeValue undoes the \XX hex escapes in a filter's assertion value.
+func unescapeValue(s string) (string, error) {
+	if strings.ContainsAny(s, "()") {
+		return "", fmt.Errorf("unescaped parenthesis in %q", s)
+	}
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("truncated escape in %q", s)
+		}
+		decoded, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,461 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package ldap is a small LDAPv3 client (RFC 4511), with just what IMS needs
+// to use an LDAP or Active Directory server as its user directory: simple
+// binds, paged searches, and TLS, either from the start (ldaps://) or through
+// StartTLS.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/lib/ldap/ber"
+)
+
+// Protocol op tags, all in the application class (RFC 4511 section 4.2 on).
+const (
+	opBindRequest       = 0
+	opBindResponse      = 1
+	opUnbindRequest     = 2
+	opSearchRequest     = 3
+	opSearchResultEntry = 4
+	opSearchResultDone  = 5
+	opSearchResultRef   = 19
+	opExtendedRequest   = 23
+	opExtendedResponse  = 24
+)
+
+// Context-class tags within messages and ops.
+const (
+	tagControls             = 0
+	tagSimpleAuthentication = 0
+	tagExtendedRequestName  = 0
+)
+
+const (
+	protocolVersion = 3
+	startTLSOID     = "1.3.6.1.4.1.1466.20037"
+	pagedResultsOID = "1.2.840.113556.1.4.319"
+)
+
+// Result codes (RFC 4511 appendix A) that IMS cares about.
+const (
+	ResultSuccess            = 0
+	ResultInvalidCredentials = 49
+)
+
+// Scope is how much of the tree below a SearchRequest's BaseDN is searched.
+type Scope int64
+
+const (
+	ScopeBaseObject   Scope = 0
+	ScopeSingleLevel  Scope = 1
+	ScopeWholeSubtree Scope = 2
+)
+
+// ErrEmptyPassword is from a Bind without a password. LDAP servers take such
+// a bind as an "unauthenticated" one, and let it succeed whatever the DN, so
+// it must never be mistaken for a password check.
+var ErrEmptyPassword = errors.New("bind with an empty password")
+
+// Error is an unsuccessful LDAP result.
+type Error struct {
+	ResultCode int64
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("LDAP result code %v: %v", e.ResultCode, e.Message)
+}
+
+// IsInvalidCredentials is whether err is from a Bind with the wrong DN or
+// password.
+func IsInvalidCredentials(err error) bool {
+	ldapErr, ok := errors.AsType[*Error](err)
+	return ok && ldapErr.ResultCode == ResultInvalidCredentials
+}
+
+// Entry is one result of a search. Attribute names are lowercased, since
+// LDAP compares them without regard to case.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get gives the first value of the attribute, or "" if it has none.
+func (e Entry) Get(attribute string) string {
+	values := e.Attributes[strings.ToLower(attribute)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values gives all the values of the attribute.
+func (e Entry) Values(attribute string) []string {
+	return e.Attributes[strings.ToLower(attribute)]
+}
+
+// NormalizeDN makes DNs that differ only in case, or in the spaces around
+// their commas, equal. That's not all that makes DNs equivalent, but it's
+// what's seen in practice.
+func NormalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(part))
+	}
+	return strings.Join(parts, ",")
+}
+
+type SearchRequest struct {
+	BaseDN string
+	Scope  Scope
+	// Filter is in the string form of RFC 4515, e.g. "(&(objectClass=person)(uid=tool))".
+	Filter     string
+	Attributes []string
+	// PageSize, if positive, has the server return the results in pages of
+	// this many entries (RFC 2696). Active Directory won't return more than
+	// 1000 entries from a search without it.
+	PageSize int
+}
+
+// DialOptions are how to secure the connection.
+type DialOptions struct {
+	// StartTLS upgrades an ldap:// connection to TLS before anything else is
+	// sent. It's not needed for ldaps://, which uses TLS from the start.
+	StartTLS bool
+	// TLSConfig is for the TLS connection. Without one, the server's
+	// certificate is checked against the system's roots.
+	TLSConfig *tls.Config
+}
+
+// Conn is a connection to an LDAP server. It does one operation at a time.
+type Conn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int64
+}
+
+// Dial connects to the server at rawURL, which is of the form
+// "ldap://host:port" or "ldaps://host:port".
+func Dial(ctx context.Context, rawURL string, opts DialOptions) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("[Parse]: %w", err)
+	}
+	host := u.Hostname()
+	tlsConfig := opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	var netConn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		port := u.Port()
+		if port == "" {
+			port = "389"
+		}
+		netConn, err = (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	case "ldaps":
+		if opts.StartTLS {
+			return nil, errors.New("StartTLS is for ldap:// URLs, not ldaps://")
+		}
+		port := u.Port()
+		if port == "" {
+			port = "636"
+		}
+		netConn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[DialContext]: %w", err)
+	}
+	c := &Conn{conn: netConn, r: bufio.NewReader(netConn)}
+	if opts.StartTLS {
+		if err = c.startTLS(ctx, tlsConfig); err != nil {
+			_ = netConn.Close()
+			return nil, fmt.Errorf("[startTLS]: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	_, _ = c.send(ber.NewPrimitive(ber.ClassApplication, opUnbindRequest, nil))
+	if err := c.conn.Close(); err != nil {
+		return fmt.Errorf("[Close]: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) startTLS(ctx context.Context, tlsConfig *tls.Config) error {
+	defer c.watch(ctx)()
+	op := ber.NewConstructed(ber.ClassApplication, opExtendedRequest,
+		ber.NewPrimitive(ber.ClassContext, tagExtendedRequestName, []byte(startTLSOID)),
+	)
+	id, err := c.send(op)
+	if err != nil {
+		return fmt.Errorf("[send]: %w", err)
+	}
+	resp, _, err := c.receive(id)
+	if err != nil {
+		return fmt.Errorf("[receive]: %w", err)
+	}
+	if !resp.Is(ber.ClassApplication, opExtendedResponse) {
+		return fmt.Errorf("unexpected response op %v to StartTLS", resp.Tag)
+	}
+	if err = resultError(resp); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("[HandshakeContext]: %w", err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Bind authenticates the connection as dn, with a simple bind. A wrong DN or
+// password gives an error for which IsInvalidCredentials is true.
+func (c *Conn) Bind(ctx context.Context, dn, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	defer c.watch(ctx)()
+	op := ber.NewConstructed(ber.ClassApplication, opBindRequest,
+		ber.NewInteger(protocolVersion),
+		ber.NewString(dn),
+		ber.NewPrimitive(ber.ClassContext, tagSimpleAuthentication, []byte(password)),
+	)
+	id, err := c.send(op)
+	if err != nil {
+		return fmt.Errorf("[send]: %w", err)
+	}
+	resp, _, err := c.receive(id)
+	if err != nil {
+		return fmt.Errorf("[receive]: %w", err)
+	}
+	if !resp.Is(ber.ClassApplication, opBindResponse) {
+		return fmt.Errorf("unexpected response op %v to bind", resp.Tag)
+	}
+	return resultError(resp)
+}
+
+// Search gives all the entries that match the request.
+func (c *Conn) Search(ctx context.Context, req SearchRequest) ([]Entry, error) {
+	filter, err := compileFilter(req.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("[compileFilter]: %w", err)
+	}
+	attributes := ber.NewSequence()
+	for _, a := range req.Attributes {
+		attributes.Children = append(attributes.Children, ber.NewString(a))
+	}
+	defer c.watch(ctx)()
+
+	var entries []Entry
+	var cookie []byte
+	for {
+		op := ber.NewConstructed(ber.ClassApplication, opSearchRequest,
+			ber.NewString(req.BaseDN),
+			ber.NewEnumerated(int64(req.Scope)),
+			// Never dereference aliases, no size limit, no time limit, and
+			// values as well as types.
+			ber.NewEnumerated(0),
+			ber.NewInteger(0),
+			ber.NewInteger(0),
+			ber.NewBoolean(false),
+			filter,
+			attributes,
+		)
+		var controls []*ber.Packet
+		if req.PageSize > 0 {
+			// The control isn't critical, so that a server that can't page
+			// just gives everything at once.
+			controls = append(controls, ber.NewSequence(
+				ber.NewString(pagedResultsOID),
+				ber.NewString(string(ber.NewSequence(
+					ber.NewInteger(int64(req.PageSize)),
+					ber.NewString(string(cookie)),
+				).Bytes())),
+			))
+		}
+		id, err := c.send(op, controls...)
+		if err != nil {
+			return nil, fmt.Errorf("[send]: %w", err)
+		}
+		cookie = nil
+		for {
+			resp, respControls, err := c.receive(id)
+			if err != nil {
+				return nil, fmt.Errorf("[receive]: %w", err)
+			}
+			if resp.Is(ber.ClassApplication, opSearchResultEntry) {
+				entry, err := parseEntry(resp)
+				if err != nil {
+					return nil, fmt.Errorf("[parseEntry]: %w", err)
+				}
+				entries = append(entries, entry)
+				continue
+			}
+			if resp.Is(ber.ClassApplication, opSearchResultRef) {
+				// Referrals to other servers aren't followed.
+				continue
+			}
+			if !resp.Is(ber.ClassApplication, opSearchResultDone) {
+				return nil, fmt.Errorf("unexpected response op %v to search", resp.Tag)
+			}
+			if err = resultError(resp); err != nil {
+				return nil, err
+			}
+			cookie, err = pagedResultsCookie(respControls)
+			if err != nil {
+				return nil, fmt.Errorf("[pagedResultsCookie]: %w", err)
+			}
+			break
+		}
+		if len(cookie) == 0 {
+			return entries, nil
+		}
+	}
+}
+
+// watch makes any blocked read or write on the connection fail once ctx is
+// done. Call the function it gives when the operation is over.
+func (c *Conn) watch(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.conn.SetDeadline(time.Now())
+	})
+	return func() {
+		stop()
+		_ = c.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (c *Conn) send(op *ber.Packet, controls ...*ber.Packet) (int64, error) {
+	c.messageID++
+	msg := ber.NewSequence(ber.NewInteger(c.messageID), op)
+	if len(controls) > 0 {
+		msg.Children = append(msg.Children, ber.NewConstructed(ber.ClassContext, tagControls, controls...))
+	}
+	if _, err := c.conn.Write(msg.Bytes()); err != nil {
+		return 0, fmt.Errorf("[Write]: %w", err)
+	}
+	return c.messageID, nil
+}
+
+// receive reads the next message, which must be a response to the message
+// with the given ID, and gives its protocol op and controls.
+func (c *Conn) receive(id int64) (op *ber.Packet, controls []*ber.Packet, err error) {
+	msg, err := ber.Read(c.r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[Read]: %w", err)
+	}
+	if !msg.Is(ber.ClassUniversal, ber.TagSequence) || len(msg.Children) < 2 {
+		return nil, nil, errors.New("malformed message")
+	}
+	gotID, err := msg.Children[0].Int()
+	if err != nil {
+		return nil, nil, fmt.Errorf("[Int]: %w", err)
+	}
+	op = msg.Children[1]
+	if gotID == 0 {
+		// Most likely a notice of disconnection (RFC 4511 section 4.4.1).
+		return nil, nil, fmt.Errorf("server disconnected: %w", resultError(op))
+	}
+	if gotID != id {
+		return nil, nil, fmt.Errorf("response to message %v while awaiting %v", gotID, id)
+	}
+	if len(msg.Children) > 2 && msg.Children[2].Is(ber.ClassContext, tagControls) {
+		controls = msg.Children[2].Children
+	}
+	return op, controls, nil
+}
+
+// resultError gives the error for an LDAPResult, or nil if it's a success.
+func resultError(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return errors.New("malformed result")
+	}
+	code, err := op.Children[0].Int()
+	if err != nil {
+		return fmt.Errorf("[Int]: %w", err)
+	}
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{ResultCode: code, Message: op.Children[2].String()}
+}
+
+func parseEntry(op *ber.Packet) (Entry, error) {
+	if len(op.Children) < 2 {
+		return Entry{}, errors.New("malformed entry")
+	}
+	entry := Entry{
+		DN:         op.Children[0].String(),
+		Attributes: make(map[string][]string),
+	}
+	for _, attr := range op.Children[1].Children {
+		if len(attr.Children) < 2 {
+			return Entry{}, errors.New("malformed attribute")
+		}
+		name := strings.ToLower(attr.Children[0].String())
+		for _, v := range attr.Children[1].Children {
+			entry.Attributes[name] = append(entry.Attributes[name], v.String())
+		}
+	}
+	return entry, nil
+}
+
+// pagedResultsCookie gives the cookie for the next page of a paged search,
+// or nil if there are no more pages.
+func pagedResultsCookie(controls []*ber.Packet) ([]byte, error) {
+	for _, control := range controls {
+		if len(control.Children) < 2 || control.Children[0].String() != pagedResultsOID {
+			continue
+		}
+		value := control.Children[len(control.Children)-1]
+		searchControlValue, err := ber.Decode(value.Value)
+		if err != nil {
+			return nil, fmt.Errorf("[Decode]: %w", err)
+		}
+		if len(searchControlValue.Children) < 2 {
+			return nil, errors.New("malformed paged results control")
+		}
+		return searchControlValue.Children[1].Value, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,228 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ldap_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/lib/ldap"
+	"github.com/burningmantech/ranger-ims-go/lib/ldap/ldaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	baseDN    = "dc=example,dc=org"
+	serviceDN = "cn=ims,ou=services,dc=example,dc=org"
+)
+
+func testServer(t *testing.T) *ldaptest.Server {
+	t.Helper()
+	s := ldaptest.NewServer()
+	t.Cleanup(s.Close)
+	s.AddEntry(serviceDN, "service secret", map[string][]string{
+		"objectClass": {"applicationProcess"},
+		"cn":          {"ims"},
+	})
+	s.AddEntry("uid=tool,ou=people,dc=example,dc=org", "tool password", map[string][]string{
+		"objectClass": {"person", "inetOrgPerson"},
+		"uid":         {"Tool"},
+		"mail":        {"tool@example.com"},
+		"cn":          {"Tool (Ranger)"},
+	})
+	s.AddEntry("uid=hardware,ou=people,dc=example,dc=org", "", map[string][]string{
+		"objectClass":    {"person"},
+		"uid":            {"Hardware"},
+		"employeeNumber": {"42"},
+	})
+	return s
+}
+
+func dial(t *testing.T, s *ldaptest.Server) *ldap.Conn {
+	t.Helper()
+	conn, err := ldap.Dial(t.Context(), s.URL, ldap.DialOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func dns(entries []ldap.Entry) []string {
+	var d []string
+	for _, e := range entries {
+		d = append(d, e.DN)
+	}
+	slices.Sort(d)
+	return d
+}
+
+func TestBind(t *testing.T) {
+	t.Parallel()
+	s := testServer(t)
+	conn := dial(t, s)
+	ctx := t.Context()
+
+	require.NoError(t, conn.Bind(ctx, "uid=tool,ou=people,dc=example,dc=org", "tool password"))
+
+	err := conn.Bind(ctx, "uid=tool,ou=people,dc=example,dc=org", "wrong password")
+	require.Error(t, err)
+	assert.True(t, ldap.IsInvalidCredentials(err))
+
+	err = conn.Bind(ctx, "uid=nobody,ou=people,dc=example,dc=org", "tool password")
+	assert.True(t, ldap.IsInvalidCredentials(err))
+
+	// An empty password would be an unauthenticated bind, which the server
+	// would allow, so it's refused before it's sent.
+	err = conn.Bind(ctx, "uid=tool,ou=people,dc=example,dc=org", "")
+	require.ErrorIs(t, err, ldap.ErrEmptyPassword)
+}
+
+func TestSearch(t *testing.T) {
+	t.Parallel()
+	s := testServer(t)
+	conn := dial(t, s)
+	ctx := t.Context()
+
+	// The server only answers searches from a bound connection.
+	_, err := conn.Search(ctx, ldap.SearchRequest{BaseDN: baseDN, Scope: ldap.ScopeWholeSubtree, Filter: "(uid=*)"})
+	require.Error(t, err)
+	require.NoError(t, conn.Bind(ctx, serviceDN, "service secret"))
+
+	entries, err := conn.Search(ctx, ldap.SearchRequest{
+		BaseDN:     baseDN,
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     "(&(objectClass=person)(uid=tool))",
+		Attributes: []string{"uid", "mail"},
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "uid=tool,ou=people,dc=example,dc=org", entries[0].DN)
+	assert.Equal(t, "Tool", entries[0].Get("UID"))
+	assert.Equal(t, []string{"tool@example.com"}, entries[0].Values("mail"))
+	// Only the requested attributes are returned.
+	assert.Empty(t, entries[0].Get("cn"))
+
+	for filter, want := range map[string][]string{
+		"objectClass=person": {
+			"uid=hardware,ou=people,dc=example,dc=org",
+			"uid=tool,ou=people,dc=example,dc=org",
+		},
+		"(|(uid=hardware)(mail=tool@*))": {
+			"uid=hardware,ou=people,dc=example,dc=org",
+			"uid=tool,ou=people,dc=example,dc=org",
+		},
+		"(&(objectClass=person)(!(employeeNumber=*)))": {"uid=tool,ou=people,dc=example,dc=org"},
+		"(cn=*\\28Ranger\\29)":                         {"uid=tool,ou=people,dc=example,dc=org"},
+		"(cn=T*l*ger*)":                                {"uid=tool,ou=people,dc=example,dc=org"},
+		"(employeeNumber>=40)":                         {"uid=hardware,ou=people,dc=example,dc=org"},
+		"(uid=" + ldap.EscapeFilter("*") + ")":         nil,
+	} {
+		entries, err = conn.Search(ctx, ldap.SearchRequest{BaseDN: baseDN, Scope: ldap.ScopeWholeSubtree, Filter: filter})
+		require.NoError(t, err, filter)
+		assert.Equal(t, want, dns(entries), filter)
+	}
+
+	// Scopes.
+	entries, err = conn.Search(ctx, ldap.SearchRequest{BaseDN: "ou=people," + baseDN, Scope: ldap.ScopeSingleLevel, Filter: "(objectClass=*)"})
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	entries, err = conn.Search(ctx, ldap.SearchRequest{BaseDN: serviceDN, Scope: ldap.ScopeBaseObject, Filter: "(objectClass=*)"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{serviceDN}, dns(entries))
+}
+
+func TestSearchPaged(t *testing.T) {
+	t.Parallel()
+	s := ldaptest.NewServer()
+	t.Cleanup(s.Close)
+	s.AddEntry(serviceDN, "service secret", nil)
+	for i := range 25 {
+		s.AddEntry(fmt.Sprintf("uid=ranger%v,dc=example,dc=org", i), "", map[string][]string{
+			"objectClass": {"person"},
+		})
+	}
+	conn := dial(t, s)
+	ctx := t.Context()
+	require.NoError(t, conn.Bind(ctx, serviceDN, "service secret"))
+
+	entries, err := conn.Search(ctx, ldap.SearchRequest{
+		BaseDN:   baseDN,
+		Scope:    ldap.ScopeWholeSubtree,
+		Filter:   "(objectClass=person)",
+		PageSize: 10,
+	})
+	require.NoError(t, err)
+	assert.Len(t, entries, 25)
+	assert.Equal(t, 3, s.Searches())
+}
+
+func TestSearchInvalidFilter(t *testing.T) {
+	t.Parallel()
+	s := testServer(t)
+	conn := dial(t, s)
+	for _, filter := range []string{
+		"(uid=tool",
+		"(&(uid=tool)",
+		"(uid=tool))",
+		"(=tool)",
+		"(uid=to(ol)",
+		"(uid=\\zz)",
+		"(uid=tool\\2)",
+		"(:=x)",
+	} {
+		_, err := conn.Search(t.Context(), ldap.SearchRequest{BaseDN: baseDN, Filter: filter})
+		require.Error(t, err, filter)
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "Tool", ldap.EscapeFilter("Tool"))
+	assert.Equal(t, `\2a\29\28uid=\5c\00`, ldap.EscapeFilter("*)(uid=\\\x00"))
+}
+
+func TestContextDone(t *testing.T) {
+	t.Parallel()
+	// A server that never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, _ = io.Copy(io.Discard, conn)
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := ldap.Dial(t.Context(), "ldap://"+listener.Addr().String(), ldap.DialOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	require.Error(t, conn.Bind(ctx, serviceDN, "service secret"))
+}
+
+func TestNormalizeDN(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "uid=tool,ou=people,dc=example,dc=org", ldap.NormalizeDN("UID=Tool, ou=People ,dc=example,DC=org"))
+}
@@ -0,0 +1,404 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package ldaptest is a fake LDAP server, for testing IMS's LDAP directory
+// without a real one.
+package ldaptest
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/burningmantech/ranger-ims-go/lib/ldap"
+	"github.com/burningmantech/ranger-ims-go/lib/ldap/ber"
+)
+
+// Protocol op tags and result codes, as in package ldap.
+const (
+	opBindRequest       = 0
+	opBindResponse      = 1
+	opUnbindRequest     = 2
+	opSearchRequest     = 3
+	opSearchResultEntry = 4
+	opSearchResultDone  = 5
+	opExtendedRequest   = 23
+	opExtendedResponse  = 24
+
+	resultSuccess                 = 0
+	resultProtocolError           = 2
+	resultInsufficientAccessRight = 50
+
+	pagedResultsOID = "1.2.840.113556.1.4.319"
+)
+
+// Server is an in-process LDAP server over plain TCP. It does simple binds,
+// and searches with any filter but an extensible match, paging the results if
+// asked to. As with a real directory, searches need an authenticated bind, but
+// a bind with an empty password succeeds as an unauthenticated one.
+type Server struct {
+	// URL is the server's address, e.g. "ldap://127.0.0.1:12345".
+	URL string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	entries   []ldap.Entry
+	passwords map[string]string
+	searches  int
+	conns     map[net.Conn]struct{}
+}
+
+// NewServer starts a server with no entries. Close it when done.
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		URL:       "ldap://" + listener.Addr().String(),
+		listener:  listener,
+		passwords: map[string]string{},
+		conns:     map[net.Conn]struct{}{},
+	}
+	s.wg.Go(s.serve)
+	return s
+}
+
+// Close stops the server and drops all its connections.
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// AddEntry adds an entry to the directory. If password isn't empty, the entry
+// can bind with it.
+func (s *Server) AddEntry(dn, password string, attributes map[string][]string) {
+	entry := ldap.Entry{DN: dn, Attributes: map[string][]string{}}
+	for name, values := range attributes {
+		entry.Attributes[strings.ToLower(name)] = values
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	if password != "" {
+		s.passwords[ldap.NormalizeDN(dn)] = password
+	}
+}
+
+// Searches is how many search requests the server has answered, counting
+// each page of a paged search.
+func (s *Server) Searches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.searches
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Go(func() {
+			defer func() {
+				_ = conn.Close()
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			s.serveConn(conn)
+		})
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	bound := false
+	for {
+		msg, err := ber.Read(r)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id, err := msg.Children[0].Int()
+		if err != nil {
+			return
+		}
+		op := msg.Children[1]
+		var controls []*ber.Packet
+		if len(msg.Children) > 2 {
+			controls = msg.Children[2].Children
+		}
+		var responses []response
+		switch {
+		case op.Is(ber.ClassApplication, opBindRequest):
+			var resp *ber.Packet
+			resp, bound = s.bind(op)
+			responses = append(responses, response{op: resp})
+		case op.Is(ber.ClassApplication, opUnbindRequest):
+			return
+		case op.Is(ber.ClassApplication, opSearchRequest):
+			responses = s.search(op, controls, bound)
+		case op.Is(ber.ClassApplication, opExtendedRequest):
+			// That includes StartTLS, which this server doesn't do.
+			responses = append(responses, response{
+				op: result(opExtendedResponse, resultProtocolError, "unsupported extended operation"),
+			})
+		default:
+			return
+		}
+		for _, resp := range responses {
+			out := ber.NewSequence(ber.NewInteger(id), resp.op)
+			if len(resp.controls) > 0 {
+				out.Children = append(out.Children, ber.NewConstructed(ber.ClassContext, 0, resp.controls...))
+			}
+			if _, err = conn.Write(out.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// response is a protocol op to send, with its controls.
+type response struct {
+	op       *ber.Packet
+	controls []*ber.Packet
+}
+
+func (s *Server) bind(op *ber.Packet) (resp *ber.Packet, bound bool) {
+	if len(op.Children) < 3 {
+		return result(opBindResponse, resultProtocolError, "malformed bind"), false
+	}
+	dn, password := op.Children[1].String(), op.Children[2].String()
+	if password == "" {
+		return result(opBindResponse, resultSuccess, ""), false
+	}
+	s.mu.Lock()
+	want, ok := s.passwords[ldap.NormalizeDN(dn)]
+	s.mu.Unlock()
+	if !ok || want != password {
+		return result(opBindResponse, ldap.ResultInvalidCredentials, "invalid credentials"), false
+	}
+	return result(opBindResponse, resultSuccess, ""), true
+}
+
+func (s *Server) search(op *ber.Packet, controls []*ber.Packet, bound bool) []response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.searches++
+	if !bound {
+		return []response{{op: result(opSearchResultDone, resultInsufficientAccessRight, "bind first")}}
+	}
+	if len(op.Children) < 8 {
+		return []response{{op: result(opSearchResultDone, resultProtocolError, "malformed search")}}
+	}
+	baseDN := ldap.NormalizeDN(op.Children[0].String())
+	scope, _ := op.Children[1].Int()
+	filter := op.Children[6]
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, strings.ToLower(a.String()))
+	}
+
+	var matches []ldap.Entry
+	for _, entry := range s.entries {
+		if inScope(ldap.NormalizeDN(entry.DN), baseDN, ldap.Scope(scope)) && matchFilter(filter, entry) {
+			matches = append(matches, entry)
+		}
+	}
+
+	var pageControl *ber.Packet
+	if pageSize, offset, ok := pagedResults(controls); ok {
+		end := min(offset+pageSize, len(matches))
+		offset = min(offset, end)
+		cookie := ""
+		if end < len(matches) {
+			cookie = strconv.Itoa(end)
+		}
+		matches = matches[offset:end]
+		pageControl = ber.NewSequence(
+			ber.NewString(pagedResultsOID),
+			ber.NewString(string(ber.NewSequence(ber.NewInteger(0), ber.NewString(cookie)).Bytes())),
+		)
+	}
+
+	var responses []response
+	for _, entry := range matches {
+		responses = append(responses, response{op: entryPacket(entry, attributes)})
+	}
+	done := response{op: result(opSearchResultDone, resultSuccess, "")}
+	if pageControl != nil {
+		done.controls = []*ber.Packet{pageControl}
+	}
+	return append(responses, done)
+}
+
+// pagedResults gives the page size and the offset of the page that's wanted,
+// if the search was paged.
+func pagedResults(controls []*ber.Packet) (pageSize, offset int, ok bool) {
+	for _, control := range controls {
+		if len(control.Children) < 2 || control.Children[0].String() != pagedResultsOID {
+			continue
+		}
+		value, err := ber.Decode(control.Children[len(control.Children)-1].Value)
+		if err != nil || len(value.Children) < 2 {
+			return 0, 0, false
+		}
+		size, err := value.Children[0].Int()
+		if err != nil || size <= 0 {
+			return 0, 0, false
+		}
+		offset, _ = strconv.Atoi(value.Children[1].String())
+		return int(size), offset, true
+	}
+	return 0, 0, false
+}
+
+func entryPacket(entry ldap.Entry, attributes []string) *ber.Packet {
+	all := len(attributes) == 0 || slices.Contains(attributes, "*")
+	list := ber.NewSequence()
+	for name, values := range entry.Attributes {
+		if !all && !slices.Contains(attributes, name) {
+			continue
+		}
+		set := ber.NewSet()
+		for _, v := range values {
+			set.Children = append(set.Children, ber.NewString(v))
+		}
+		list.Children = append(list.Children, ber.NewSequence(ber.NewString(name), set))
+	}
+	return ber.NewConstructed(ber.ClassApplication, opSearchResultEntry, ber.NewString(entry.DN), list)
+}
+
+func result(tag byte, code int64, message string) *ber.Packet {
+	return ber.NewConstructed(ber.ClassApplication, tag,
+		ber.NewEnumerated(code),
+		ber.NewString(""),
+		ber.NewString(message),
+	)
+}
+
+func inScope(dn, baseDN string, scope ldap.Scope) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == baseDN
+	case ldap.ScopeSingleLevel:
+		_, parent, _ := strings.Cut(dn, ",")
+		return parent == baseDN
+	default:
+		return dn == baseDN || baseDN == "" || strings.HasSuffix(dn, ","+baseDN)
+	}
+}
+
+// matchFilter evaluates a filter in BER form. Values are compared without
+// regard to case, as for most attributes of a real directory.
+func matchFilter(filter *ber.Packet, entry ldap.Entry) bool {
+	if filter.Class != ber.ClassContext {
+		return false
+	}
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !matchFilter(filter.Children[0], entry)
+	case ldap.FilterPresent:
+		return len(entry.Values(filter.String())) > 0
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		want := strings.ToLower(filter.Children[1].String())
+		for _, v := range entry.Values(filter.Children[0].String()) {
+			v = strings.ToLower(v)
+			switch filter.Tag {
+			case ldap.FilterGreaterOrEqual:
+				if v >= want {
+					return true
+				}
+			case ldap.FilterLessOrEqual:
+				if v <= want {
+					return true
+				}
+			default:
+				if v == want {
+					return true
+				}
+			}
+		}
+		return false
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		for _, v := range entry.Values(filter.Children[0].String()) {
+			if matchSubstrings(strings.ToLower(v), filter.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+func matchSubstrings(v string, substrings []*ber.Packet) bool {
+	for _, sub := range substrings {
+		part := strings.ToLower(sub.String())
+		switch sub.Tag {
+		case ldap.SubstringInitial:
+			if !strings.HasPrefix(v, part) {
+				return false
+			}
+			v = v[len(part):]
+		case ldap.SubstringFinal:
+			if !strings.HasSuffix(v, part) {
+				return false
+			}
+			v = v[:len(v)-len(part)]
+		default:
+			i := strings.Index(v, part)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(part):]
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package mail sends the few emails that IMS sends, such as invitations and
+// password resets for the IMS-native directory. A Sender either hands them to
+// an SMTP server, or drops them into a Maildir, for development and tests.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender sends Messages.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// bytes gives the message in RFC 5322 form, ready to be sent.
+func (m Message) bytes(from string, now time.Time) ([]byte, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("[ParseAddress] from: %w", err)
+	}
+	toAddr, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("[ParseAddress] to: %w", err)
+	}
+	// The headers are otherwise all encoded, but a newline in the subject
+	// could still start a header of its own.
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return nil, errors.New("subject must be one line")
+	}
+	_, domain, _ := strings.Cut(fromAddr.Address, "@")
+
+	var b bytes.Buffer
+	header := func(name, value string) {
+		_, _ = fmt.Fprintf(&b, "%v: %v\r\n", name, value)
+	}
+	header("From", fromAddr.String())
+	header("To", toAddr.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%v@%v>", rand.Text(), domain))
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "quoted-printable")
+	b.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	body := strings.ReplaceAll(m.Body, "\r\n", "\n")
+	_, _ = qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	if err = qp.Close(); err != nil {
+		return nil, fmt.Errorf("[Close]: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// SMTPSender sends Messages through an SMTP server. It requires STARTTLS,
+// except for a relay on localhost, where there's no network to protect the
+// messages from, and only authenticates if there's a Username.
+type SMTPSender struct {
+	// Addr is the server's host and port, e.g. "smtp.example.com:587".
+	Addr     string
+	Username string
+	// #nosec G117 // Exported secret struct field
+	Password string
+	// From is the address the Messages are from, e.g. "IMS <ims@example.com>".
+	From string
+}
+
+func (s SMTPSender) Send(ctx context.Context, msg Message) error {
+	data, err := msg.bytes(s.From, time.Now())
+	if err != nil {
+		return fmt.Errorf("[bytes]: %w", err)
+	}
+	fromAddr, _ := mail.ParseAddress(s.From)
+	toAddr, _ := mail.ParseAddress(msg.To)
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("[SplitHostPort]: %w", err)
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("[DialContext]: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("[NewClient]: %w", err)
+	}
+	defer func() { _ = client.Close() }()
+	// The messages carry password reset links, so they mustn't cross the
+	// network in the clear, nor be downgraded to that by someone in between
+	// who strips the STARTTLS offer.
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			return fmt.Errorf("[StartTLS]: %w", err)
+		}
+	} else if !localRelay(host) {
+		return fmt.Errorf("SMTP server %v doesn't offer STARTTLS", host)
+	}
+	if s.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted
+		// connection to anywhere but localhost.
+		err = client.Auth(smtp.PlainAuth("", s.Username, s.Password, host))
+		if err != nil {
+			return fmt.Errorf("[Auth]: %w", err)
+		}
+	}
+	if err = client.Mail(fromAddr.Address); err != nil {
+		return fmt.Errorf("[Mail]: %w", err)
+	}
+	if err = client.Rcpt(toAddr.Address); err != nil {
+		return fmt.Errorf("[Rcpt]: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("[Data]: %w", err)
+	}
+	if _, err = w.Write(data); err != nil {
+		return fmt.Errorf("[Write]: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("[Close]: %w", err)
+	}
+	if err = client.Quit(); err != nil {
+		return fmt.Errorf("[Quit]: %w", err)
+	}
+	return nil
+}
+
+// localRelay reports whether host is this machine.
+func localRelay(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// MaildirSender delivers Messages into a Maildir, rather than sending them
+// anywhere. Each one ends up as a file in the "new" subdirectory, which any
+// mail client that reads Maildirs can open.
+//
+// https://cr.yp.to/proto/maildir.html
+type MaildirSender struct {
+	Dir *os.Root
+	// From is the address the Messages are from, e.g. "IMS <ims@example.com>".
+	From string
+}
+
+func (s MaildirSender) Send(_ context.Context, msg Message) error {
+	now := time.Now()
+	data, err := msg.bytes(s.From, now)
+	if err != nil {
+		return fmt.Errorf("[bytes]: %w", err)
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err = s.Dir.MkdirAll(sub, 0o750); err != nil {
+			return fmt.Errorf("[MkdirAll]: %w", err)
+		}
+	}
+	// A message is written to tmp, then moved to new, so that no one reading
+	// new ever sees half of one.
+	name := fmt.Sprintf("%v.%v.ims", now.UnixNano(), rand.Text())
+	err = s.Dir.WriteFile(path.Join("tmp", name), data, 0o640)
+	if err != nil {
+		return fmt.Errorf("[WriteFile]: %w", err)
+	}
+	err = s.Dir.Rename(path.Join("tmp", name), path.Join("new", name))
+	if err != nil {
+		return fmt.Errorf("[Rename]: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package mail_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/burningmantech/ranger-ims-go/lib/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMessage = mail.Message{
+	To:      "Tool <tool@example.com>",
+	Subject: "Welcome to IMS ✨",
+	Body:    "Hello Tool,\n\nSet your password here: https://ims.example.com/ims/auth/password#token=abc\n",
+}
+
+// requireTestMessage checks that raw is testMessage, as sent by IMS.
+func requireTestMessage(t *testing.T, raw []byte) {
+	t.Helper()
+	msg, err := netmail.ReadMessage(bytes.NewReader(raw))
+	require.NoError(t, err)
+	assert.Equal(t, `"IMS" <ims@example.com>`, msg.Header.Get("From"))
+	assert.Equal(t, `"Tool" <tool@example.com>`, msg.Header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, testMessage.Subject, subject)
+	assert.True(t, strings.HasSuffix(msg.Header.Get("Message-ID"), "@example.com>"))
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	require.NoError(t, err)
+	assert.Equal(t, testMessage.Body, strings.ReplaceAll(string(body), "\r\n", "\n"))
+}
+
+func TestMaildirSender(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	root, err := os.OpenRoot(dir)
+	require.NoError(t, err)
+	sender := mail.MaildirSender{Dir: root, From: "IMS <ims@example.com>"}
+
+	require.NoError(t, sender.Send(t.Context(), testMessage))
+	require.NoError(t, sender.Send(t.Context(), testMessage))
+
+	tmp, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+	delivered, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	require.Len(t, delivered, 2)
+	raw, err := os.ReadFile(filepath.Join(dir, "new", delivered[0].Name()))
+	require.NoError(t, err)
+	requireTestMessage(t, raw)
+}
+
+func TestSendRejectsBadMessages(t *testing.T) {
+	t.Parallel()
+	root, err := os.OpenRoot(t.TempDir())
+	require.NoError(t, err)
+	sender := mail.MaildirSender{Dir: root, From: "IMS <ims@example.com>"}
+
+	msg := testMessage
+	msg.Subject = "Hello\r\nBcc: everyone@example.com"
+	require.ErrorContains(t, sender.Send(t.Context(), msg), "subject must be one line")
+
+	msg = testMessage
+	msg.To = "not an address"
+	require.ErrorContains(t, sender.Send(t.Context(), msg), "to")
+
+	sender.From = ""
+	require.ErrorContains(t, sender.Send(t.Context(), testMessage), "from")
+}
+
+// fakeSMTPServer accepts one message, without any TLS or authentication, and
+// gives its envelope and data.
+func fakeSMTPServer(t *testing.T) (addr string, received <-chan []string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	out := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = fmt.Fprintf(conn, "%v\r\n", s) }
+		var lines []string
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb, _, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				reply("250 fake")
+			case "MAIL", "RCPT":
+				lines = append(lines, line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					dataLine, err := r.ReadString('\n')
+					if err != nil || dataLine == ".\r\n" {
+						break
+					}
+					data.WriteString(dataLine)
+				}
+				lines = append(lines, data.String())
+				reply("250 OK")
+			case "QUIT":
+				reply("221 bye")
+				out <- lines
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), out
+}
+
+func TestSMTPSender(t *testing.T) {
+	t.Parallel()
+	addr, received := fakeSMTPServer(t)
+	sender := mail.SMTPSender{Addr: addr, From: "IMS <ims@example.com>"}
+
+	require.NoError(t, sender.Send(t.Context(), testMessage))
+
+	lines := <-received
+	require.Len(t, lines, 3)
+	assert.Equal(t, "MAIL FROM:<ims@example.com>", lines[0])
+	assert.Equal(t, "RCPT TO:<tool@example.com>", lines[1])
+	requireTestMessage(t, []byte(lines[2]))
+}
@@ -0,0 +1,36 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package mail
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalRelay(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, localRelay("localhost"))
+	assert.True(t, localRelay("LOCALHOST"))
+	assert.True(t, localRelay("127.0.0.1"))
+	assert.True(t, localRelay("::1"))
+
+	assert.False(t, localRelay("smtp.example.com"))
+	assert.False(t, localRelay("localhost.example.com"))
+	assert.False(t, localRelay("192.0.2.25"))
+}
@@ -0,0 +1,329 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package oidc is a small OpenID Connect relying party, just big enough for
+// IMS to log people in through an identity provider, using the authorization
+// code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// maxResponseBytes caps how much we'll read from the provider. Discovery
+// documents and key sets are a few KiB.
+const maxResponseBytes = 1 << 20
+
+// requestTimeout bounds a single call to the provider. Someone is waiting on
+// the other end of the login page for each of these.
+const requestTimeout = 15 * time.Second
+
+// clockSkew is how far the provider's clock may be from ours.
+const clockSkew = time.Minute
+
+// keyRefetchInterval is the least time between fetches of the provider's
+// keys. A token signed with an unknown key makes us fetch them again, since
+// the provider may have rotated, but we don't want to do that on every bad
+// token.
+const keyRefetchInterval = time.Minute
+
+// signingMethods are the ID token algorithms we accept. Notably, "none" and
+// the HMAC ones aren't here.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+type Config struct {
+	// Issuer is the provider's issuer URL, under which its discovery document
+	// is found.
+	Issuer string
+	// ClientID and ClientSecret are what the provider knows IMS by. The
+	// secret may be empty, for a public client.
+	ClientID string
+	// #nosec G117 // Exported secret struct field
+	ClientSecret string
+	// RedirectURL is IMS's callback URL, exactly as registered with the
+	// provider.
+	RedirectURL string
+	// HandleClaim is the ID token claim that holds a person's handle, e.g.
+	// "preferred_username".
+	HandleClaim string
+}
+
+// Identity is who an ID token says someone is.
+type Identity struct {
+	Subject string
+	// Handle is from the Config's HandleClaim, and may be empty.
+	Handle string
+	// Email is only set if the provider says it's verified.
+	Email string
+}
+
+// Provider is an OpenID Connect provider. Its discovery document and keys
+// are fetched on first use, so that IMS can start while the provider is down.
+type Provider struct {
+	cfg        Config
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	discovery   *discovery
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewProvider(cfg Config) *Provider {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &Provider{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// NewVerifier makes a PKCE code verifier, which is kept by IMS while its
+// Challenge goes to the provider.
+func NewVerifier() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Challenge gives the S256 PKCE code challenge for a verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL gives the URL to send someone to, for them to log in at the
+// provider. The provider will send them back to the RedirectURL with the
+// state, and with a code for Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", fmt.Errorf("[getDiscovery]: %w", err)
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("[url.Parse]: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", Challenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange trades the code from the provider's redirect for an ID token, and
+// verifies that token. The nonce and verifier must be the ones that went into
+// AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string, now time.Time) (Identity, error) {
+	var empty Identity
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return empty, fmt.Errorf("[getDiscovery]: %w", err)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return empty, fmt.Errorf("[NewRequestWithContext]: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		// RFC 6749 section 2.3.1 wants these form-encoded first.
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	var tokenResp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &tokenResp)
+	if err != nil {
+		return empty, fmt.Errorf("[do]: %w", err)
+	}
+	if status != http.StatusOK || tokenResp.Error != "" {
+		return empty, fmt.Errorf("token endpoint returned %v: %v %v", status, tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	if tokenResp.IDToken == "" {
+		return empty, errors.New("token endpoint returned no ID token")
+	}
+	return p.Verify(ctx, tokenResp.IDToken, nonce, now)
+}
+
+// Verify checks an ID token's signature, issuer, audience, expiry, and nonce,
+// and gives the identity in it.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string, now time.Time) (Identity, error) {
+	var empty Identity
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return empty, fmt.Errorf("[getDiscovery]: %w", err)
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims,
+		func(token *jwt.Token) (any, error) {
+			kid, _ := token.Header["kid"].(string)
+			return p.key(ctx, kid, now)
+		},
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	if err != nil {
+		return empty, fmt.Errorf("[ParseWithClaims]: %w", err)
+	}
+	// The nonce ties the token to the login that IMS started, so that a token
+	// from some other login can't be slipped in.
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return empty, errors.New("ID token has the wrong nonce")
+	}
+	// With more than one audience, the token must say it was issued to us.
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.cfg.ClientID {
+			return empty, errors.New("ID token was issued to another party")
+		}
+	}
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return empty, errors.New("ID token has no subject")
+	}
+	identity := Identity{Subject: subject}
+	if p.cfg.HandleClaim != "" {
+		identity.Handle, _ = claims[p.cfg.HandleClaim].(string)
+	}
+	if verified, _ := claims["email_verified"].(bool); verified {
+		identity.Email, _ = claims["email"].(string)
+	}
+	return identity, nil
+}
+
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("[NewRequestWithContext]: %w", err)
+	}
+	d := &discovery{}
+	status, err := p.do(req, d)
+	if err != nil {
+		return nil, fmt.Errorf("[do]: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %v", status)
+	}
+	// OpenID Connect Discovery section 4.3
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery is for issuer %q, not %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery is missing an endpoint")
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// key gives the provider's public key with the given ID. If there's no such
+// key, the provider's keys are fetched again, in case it has rotated them.
+func (p *Provider) key(ctx context.Context, kid string, now time.Time) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if now.Sub(p.keysFetched) < keyRefetchInterval {
+		return nil, fmt.Errorf("no provider key with ID %q", kid)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("[NewRequestWithContext]: %w", err)
+	}
+	var set jwkSet
+	status, err := p.do(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("[do]: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %v", status)
+	}
+	p.keys = set.publicKeys()
+	p.keysFetched = now
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no provider key with ID %q", kid)
+	}
+	return key, nil
+}
+
+// do sends the request, and decodes the JSON response into v. It gives the
+// response status, since the token endpoint sends JSON with its errors too.
+func (p *Provider) do(req *http.Request, v any) (int, error) {
+	// #nosec G704 // SSRF via taint analysis. The URLs are from our own config
+	// and the provider's discovery document.
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("[Do]: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return 0, fmt.Errorf("[ReadAll]: %w", err)
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("[Unmarshal]: %w", err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,167 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package oidc_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/burningmantech/ranger-ims-go/lib/oidc"
+	"github.com/burningmantech/ranger-ims-go/lib/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const redirectURL = "https://ims.example.com/ims/api/auth/oidc/callback"
+
+func newProviders(t *testing.T, clientSecret string) (*oidctest.Provider, *oidc.Provider) {
+	t.Helper()
+	idp := oidctest.NewProvider("ims", clientSecret)
+	t.Cleanup(idp.Close)
+	rp := oidc.NewProvider(oidc.Config{
+		Issuer:       idp.Issuer() + "/",
+		ClientID:     "ims",
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		HandleClaim:  "preferred_username",
+	})
+	return idp, rp
+}
+
+// authorize does what the browser would: it follows the AuthCodeURL to the
+// provider, and gives the code and state that the provider redirects back
+// with.
+func authorize(t *testing.T, rp *oidc.Provider, state, nonce, verifier string) (code, gotState string) {
+	t.Helper()
+	authURL, err := rp.AuthCodeURL(t.Context(), state, nonce, verifier)
+	require.NoError(t, err)
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, authURL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, redirectURL, location.Scheme+"://"+location.Host+location.Path)
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestLogin(t *testing.T) {
+	t.Parallel()
+	for _, clientSecret := range []string{"", "s3cret:with/odd&chars"} {
+		idp, rp := newProviders(t, clientSecret)
+		idp.LogInAs(map[string]any{
+			"sub":                "1234",
+			"preferred_username": "Hubcap",
+			"email":              "hubcap@example.com",
+			"email_verified":     true,
+		})
+		verifier := oidc.NewVerifier()
+		code, state := authorize(t, rp, "the-state", "the-nonce", verifier)
+		assert.Equal(t, "the-state", state)
+
+		identity, err := rp.Exchange(t.Context(), code, "the-nonce", verifier, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, oidc.Identity{Subject: "1234", Handle: "Hubcap", Email: "hubcap@example.com"}, identity)
+
+		// Codes are single-use.
+		_, err = rp.Exchange(t.Context(), code, "the-nonce", verifier, time.Now())
+		require.Error(t, err)
+	}
+}
+
+func TestLoginUnverifiedEmail(t *testing.T) {
+	t.Parallel()
+	idp, rp := newProviders(t, "")
+	idp.LogInAs(map[string]any{"sub": "1234", "email": "hubcap@example.com"})
+	verifier := oidc.NewVerifier()
+	code, _ := authorize(t, rp, "state", "nonce", verifier)
+	identity, err := rp.Exchange(t.Context(), code, "nonce", verifier, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, oidc.Identity{Subject: "1234"}, identity)
+}
+
+func TestLoginWrongVerifier(t *testing.T) {
+	t.Parallel()
+	idp, rp := newProviders(t, "")
+	idp.LogInAs(map[string]any{"sub": "1234"})
+	code, _ := authorize(t, rp, "state", "nonce", oidc.NewVerifier())
+	_, err := rp.Exchange(t.Context(), code, "nonce", oidc.NewVerifier(), time.Now())
+	require.ErrorContains(t, err, "PKCE")
+}
+
+func TestLoginWrongNonce(t *testing.T) {
+	t.Parallel()
+	idp, rp := newProviders(t, "")
+	idp.LogInAs(map[string]any{"sub": "1234"})
+	verifier := oidc.NewVerifier()
+	code, _ := authorize(t, rp, "state", "nonce", verifier)
+	_, err := rp.Exchange(t.Context(), code, "another nonce", verifier, time.Now())
+	require.ErrorContains(t, err, "nonce")
+}
+
+func TestLoginRejectsBadTokens(t *testing.T) {
+	t.Parallel()
+	tests := map[string]func(jwt.MapClaims){
+		"expired":          func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":        func(c jwt.MapClaims) { delete(c, "exp") },
+		"wrong audience":   func(c jwt.MapClaims) { c["aud"] = "someone-else" },
+		"wrong issuer":     func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"issued in future": func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() },
+		"no subject":       func(c jwt.MapClaims) { delete(c, "sub") },
+		"other azp":        func(c jwt.MapClaims) { c["aud"] = []string{"ims", "other"}; c["azp"] = "other" },
+	}
+	for name, edit := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			idp, rp := newProviders(t, "")
+			idp.LogInAs(map[string]any{"sub": "1234"})
+			idp.EditTokens(edit)
+			verifier := oidc.NewVerifier()
+			code, _ := authorize(t, rp, "state", "nonce", verifier)
+			_, err := rp.Exchange(t.Context(), code, "nonce", verifier, time.Now())
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestVerifyRejectsForgedToken(t *testing.T) {
+	t.Parallel()
+	_, rp := newProviders(t, "")
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "1234", "nonce": "nonce", "aud": "ims", "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("guessable"))
+	require.NoError(t, err)
+	_, err = rp.Verify(t.Context(), forged, "nonce", time.Now())
+	require.Error(t, err)
+}
+
+func TestChallenge(t *testing.T) {
+	t.Parallel()
+	// RFC 7636 appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		oidc.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+	assert.Len(t, oidc.NewVerifier(), 43)
+	assert.NotEqual(t, oidc.NewVerifier(), oidc.NewVerifier())
+}
@@ -32,6 +32,8 @@ func ToBytes(pointerToStruct any) []byte {
 
 const nestIndent = "    "
 
+var stringerType = reflect.TypeFor[fmt.Stringer]()
+
 func toBuffer(w *bytesBuffer, v reflect.Value, indent string) {
 	s := v
 	typeOfT := s.Type()
@@ -71,9 +73,10 @@ func writeSliceFields(w *bytesBuffer, fieldName string, fieldVal reflect.Value,
 	x1 := reflect.ValueOf(fieldVal.Interface())
 	sliceElemType := fieldVal.Type().Elem()
 
-	// If it's a slice of structs, we'll need to descend into each of those structs
-	switch sliceElemType.Kind() {
-	case reflect.Struct:
+	// If it's a slice of structs, we'll need to descend into each of those structs,
+	// unless they know how to print themselves (e.g. netip.Prefix)
+	switch {
+	case sliceElemType.Kind() == reflect.Struct && !sliceElemType.Implements(stringerType):
 		if x1.Len() == 0 {
 			w.fprintf("%v%v[]: [empty]\n", indent, fieldName)
 		}
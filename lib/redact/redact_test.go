@@ -21,6 +21,7 @@ import (
 	"github.com/burningmantech/ranger-ims-go/lib/redact"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net/netip"
 	"os"
 	"strings"
 	"testing"
@@ -36,6 +37,7 @@ type ExampleType struct {
 	Dir1        *os.Root
 	Dir2        *os.Root
 	SomeStruct  struct{}
+	Prefixes    []netip.Prefix
 }
 
 type Secret struct {
@@ -61,6 +63,10 @@ func TestToBytes(t *testing.T) {
 		},
 		Secrets: []Secret{{}, {}},
 		Dir2:    root,
+		Prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"),
+		},
 	}
 	expected := fmt.Sprintf(`
 SomeString = This is a string
@@ -76,6 +82,7 @@ MoreSecrets[]: [empty]
 Dir1 = <nil>
 Dir2 = %v
 SomeStruct is zero value
+Prefixes = [10.0.0.0/8 ::1/128]
 `, root.Name())
 	b := redact.ToBytes(&e)
 	assert.Equal(t, strings.TrimSpace(expected), strings.TrimSpace(string(b)))
@@ -0,0 +1,80 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package seal encrypts small secrets that IMS needs to keep in its database,
+// but mustn't keep there in the clear, under the deployment's master key
+// (IMS_MASTER_KEY).
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// keyInfo is the HKDF info for the key that's derived from the master key.
+// Changing this would make everything sealed so far unreadable.
+const keyInfo = "ranger-ims seal v1"
+
+// ErrNoMasterKey is returned when there's no master key to seal with.
+var ErrNoMasterKey = errors.New("no master key is configured (set IMS_MASTER_KEY)")
+
+// Seal encrypts and authenticates the plaintext. The additional data isn't
+// stored, but the same must be given to Open. It's for binding the sealed
+// value to its place in the database, so that it can't be copied elsewhere.
+func Seal(masterKey string, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	// The random nonce goes on the front.
+	return aead.Seal(nil, nil, plaintext, additionalData), nil
+}
+
+// Open decrypts what Seal encrypted.
+func Open(masterKey string, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nil, sealed, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("[Open]: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(masterKey string) (cipher.AEAD, error) {
+	if masterKey == "" {
+		return nil, ErrNoMasterKey
+	}
+	key, err := hkdf.Key(sha256.New, []byte(masterKey), nil, keyInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("[hkdf.Key]: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("[aes.NewCipher]: %w", err)
+	}
+	aead, err := cipher.NewGCMWithRandomNonce(block)
+	if err != nil {
+		return nil, fmt.Errorf("[cipher.NewGCMWithRandomNonce]: %w", err)
+	}
+	return aead, nil
+}
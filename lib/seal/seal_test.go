@@ -0,0 +1,63 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package seal_test
+
+import (
+	"testing"
+
+	"github.com/burningmantech/ranger-ims-go/lib/seal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealAndOpen(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("the secret")
+	sealed, err := seal.Seal("master key", secret, []byte("person 1"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "the secret")
+
+	opened, err := seal.Open("master key", sealed, []byte("person 1"))
+	require.NoError(t, err)
+	assert.Equal(t, secret, opened)
+
+	// Sealing the same thing again gives something different
+	again, err := seal.Seal("master key", secret, []byte("person 1"))
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again)
+
+	// It can't be opened with another key, or for another place
+	_, err = seal.Open("other key", sealed, []byte("person 1"))
+	require.Error(t, err)
+	_, err = seal.Open("master key", sealed, []byte("person 2"))
+	require.Error(t, err)
+
+	// nor if it's been tampered with
+	sealed[len(sealed)-1] ^= 1
+	_, err = seal.Open("master key", sealed, []byte("person 1"))
+	require.Error(t, err)
+}
+
+func TestSealWithoutMasterKey(t *testing.T) {
+	t.Parallel()
+
+	_, err := seal.Seal("", []byte("the secret"), nil)
+	require.ErrorIs(t, err, seal.ErrNoMasterKey)
+	_, err = seal.Open("", []byte("whatever"), nil)
+	require.ErrorIs(t, err, seal.ErrNoMasterKey)
+}
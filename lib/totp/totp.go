@@ -0,0 +1,133 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package totp implements the time-based one-time passwords of RFC 6238, as
+// used by authenticator apps for two-factor authentication.
+//
+// IMS only issues the common authenticator app settings: HMAC-SHA1, six
+// digits, and a thirty second period.
+//
+// https://www.rfc-editor.org/rfc/rfc6238
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // #nosec G505 // RFC 6238's default, and still sound as an HMAC
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is the length of a code.
+	Digits = 6
+	// Period is how long each code lasts.
+	Period = 30 * time.Second
+
+	// secretBytes is the length of a secret. RFC 4226 recommends 160 bits.
+	secretBytes = 20
+
+	// skewSteps is how many periods either side of the current one are also
+	// accepted, to allow for clock drift and slow typists.
+	skewSteps = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret makes a new random secret.
+func NewSecret() []byte {
+	secret := make([]byte, secretBytes)
+	_, _ = rand.Read(secret)
+	return secret
+}
+
+// EncodeSecret gives the secret in the base32 form that people can type into
+// an authenticator app.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URI gives the otpauth:// URI for an authenticator app to scan, usually as a
+// QR code.
+//
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func URI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", EncodeSecret(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(int(Period.Seconds())))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// Step gives the number of the period that t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code gives the code for the period that t falls in.
+func Code(secret []byte, t time.Time) string {
+	return code(sha1.New, secret, Step(t), Digits)
+}
+
+// Validate checks a code against the periods around now, and gives the
+// period it matched. A period no later than lastStep is never matched, so that
+// a code can't be used twice. Pass -1 for lastStep if no code has been used.
+func Validate(secret []byte, userCode string, now time.Time, lastStep int64) (step int64, ok bool) {
+	userCode = strings.ReplaceAll(strings.TrimSpace(userCode), " ", "")
+	if len(userCode) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for s := current - skewSteps; s <= current+skewSteps; s++ {
+		if s <= lastStep {
+			continue
+		}
+		want := code(sha1.New, secret, s, Digits)
+		if subtle.ConstantTimeCompare([]byte(want), []byte(userCode)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// code is the HOTP value (RFC 4226) for the counter, which for TOTP is the
+// period number.
+func code(h func() hash.Hash, secret []byte, counter int64, digits int) string {
+	mac := hmac.New(h, secret)
+	_ = binary.Write(mac, binary.BigEndian, uint64(counter))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, truncated%mod)
+}
@@ -0,0 +1,138 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package totp
+
+import (
+	"crypto/sha1" // #nosec G505 // The RFC's test vectors
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRFC6238Vectors checks against the test vectors in RFC 6238, appendix B.
+// The RFC uses a different seed for each hash function, each of which is the
+// ASCII digits "1234567890" repeated out to the hash's length.
+func TestRFC6238Vectors(t *testing.T) {
+	t.Parallel()
+
+	seed20 := []byte("12345678901234567890")
+	seed32 := []byte("12345678901234567890123456789012")
+	seed64 := []byte("1234567890123456789012345678901234567890123456789012345678901234")
+
+	vectors := []struct {
+		unix   int64
+		sha1   string
+		sha256 string
+		sha512 string
+	}{
+		{59, "94287082", "46119246", "90693936"},
+		{1111111109, "07081804", "68084774", "25091201"},
+		{1111111111, "14050471", "67062674", "99943326"},
+		{1234567890, "89005924", "91819424", "93441116"},
+		{2000000000, "69279037", "90698825", "38618901"},
+		{20000000000, "65353130", "77737706", "47863826"},
+	}
+	for _, v := range vectors {
+		step := Step(time.Unix(v.unix, 0))
+		for _, c := range []struct {
+			h    func() hash.Hash
+			seed []byte
+			want string
+		}{
+			{sha1.New, seed20, v.sha1},
+			{sha256.New, seed32, v.sha256},
+			{sha512.New, seed64, v.sha512},
+		} {
+			assert.Equal(t, c.want, code(c.h, c.seed, step, 8), "time %v", v.unix)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	t.Parallel()
+
+	// The last six digits of the RFC's SHA-1 vector.
+	assert.Equal(t, "287082", Code([]byte("12345678901234567890"), time.Unix(59, 0)))
+	assert.Equal(t, "005924", Code([]byte("12345678901234567890"), time.Unix(1234567890, 0)))
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	secret := NewSecret()
+	now := time.Unix(1_700_000_000, 0)
+	current := Step(now)
+
+	step, ok := Validate(secret, Code(secret, now), now, -1)
+	require.True(t, ok)
+	assert.Equal(t, current, step)
+
+	// Codes from the periods either side still work
+	step, ok = Validate(secret, Code(secret, now.Add(-Period)), now, -1)
+	require.True(t, ok)
+	assert.Equal(t, current-1, step)
+	step, ok = Validate(secret, Code(secret, now.Add(Period)), now, -1)
+	require.True(t, ok)
+	assert.Equal(t, current+1, step)
+
+	// but not from further out
+	_, ok = Validate(secret, Code(secret, now.Add(-2*Period)), now, -1)
+	assert.False(t, ok)
+	_, ok = Validate(secret, Code(secret, now.Add(2*Period)), now, -1)
+	assert.False(t, ok)
+
+	// A code can't be used again
+	_, ok = Validate(secret, Code(secret, now), now, current)
+	assert.False(t, ok)
+	// nor can an older one, once a newer one has been used
+	_, ok = Validate(secret, Code(secret, now.Add(-Period)), now, current)
+	assert.False(t, ok)
+
+	// Spaces are fine, but other junk isn't
+	c := Code(secret, now)
+	_, ok = Validate(secret, " "+c[:3]+" "+c[3:], now, -1)
+	assert.True(t, ok)
+	_, ok = Validate(secret, c+"0", now, -1)
+	assert.False(t, ok)
+	_, ok = Validate(secret, "", now, -1)
+	assert.False(t, ok)
+
+	// and another secret's code doesn't work
+	_, ok = Validate(NewSecret(), c, now, -1)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("12345678901234567890")
+	u, err := url.Parse(URI("IMS", "Alice", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/IMS:Alice", u.Path)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", u.Query().Get("secret"))
+	assert.Equal(t, "IMS", u.Query().Get("issuer"))
+	assert.Equal(t, "6", u.Query().Get("digits"))
+	assert.Equal(t, "30", u.Query().Get("period"))
+}
@@ -27,6 +27,58 @@ set
 where ID = ?
 ;
 
+-- The queries below support the change feed. Each write to an Incident,
+-- Field Report or Visit locks the records it touched, then takes the next
+-- CHANGE_SEQ for their Event and stamps it on them, as the last thing it does
+-- before committing. See INCIDENT.CHANGE_SEQ.
+
+-- name: LockIncidentsForChange :many
+select NUMBER from INCIDENT
+where EVENT = sqlc.arg(event)
+    and NUMBER in (sqlc.slice(numbers))
+order by NUMBER
+for update;
+
+-- name: LockFieldReportsForChange :many
+select NUMBER from FIELD_REPORT
+where EVENT = sqlc.arg(event)
+    and NUMBER in (sqlc.slice(numbers))
+order by NUMBER
+for update;
+
+-- name: LockVisitsForChange :many
+select NUMBER from VISIT
+where EVENT = sqlc.arg(event)
+    and NUMBER in (sqlc.slice(numbers))
+order by NUMBER
+for update;
+
+-- name: NextEventChangeSeq :execlastid
+update `EVENT`
+set CHANGE_SEQ = last_insert_id(CHANGE_SEQ + 1)
+where ID = ?;
+
+-- name: EventChangeSeq :one
+select CHANGE_SEQ from `EVENT` where ID = ?;
+
+-- name: StampIncidentsChange :exec
+update INCIDENT
+set CHANGE_SEQ = sqlc.arg(change_seq)
+where EVENT = sqlc.arg(event)
+    and NUMBER in (sqlc.slice(numbers));
+
+-- name: StampFieldReportsChange :exec
+update FIELD_REPORT
+set CHANGE_SEQ = sqlc.arg(change_seq)
+where EVENT = sqlc.arg(event)
+    and NUMBER in (sqlc.slice(numbers));
+
+-- name: StampVisitsChange :exec
+update VISIT
+set CHANGE_SEQ = sqlc.arg(change_seq)
+where EVENT = sqlc.arg(event)
+    and NUMBER in (sqlc.slice(numbers));
+
 -- The DeleteEvent* queries below support full deletion of an Event and all
 -- rows associated with it. They must run in the order used by the DeleteEvent
 -- API handler, so that no foreign key constraint is violated along the way.
@@ -54,6 +106,9 @@ delete from REPORT_ENTRY where ID in (sqlc.slice(ids));
 -- name: DeleteEventIncidentRangers :exec
 delete from INCIDENT__RANGER where EVENT = ?;
 
+-- name: DeleteEventIncidentStateChanges :exec
+delete from INCIDENT__STATE_CHANGE where EVENT = ?;
+
 -- name: DeleteEventIncidentIncidentTypes :exec
 delete from INCIDENT__INCIDENT_TYPE where EVENT = ?;
 
@@ -70,12 +125,18 @@ delete from VISIT where EVENT = ?;
 -- name: DeleteEventFieldReports :exec
 delete from FIELD_REPORT where EVENT = ?;
 
+-- name: DeleteEventBreakGlass :exec
+delete from BREAK_GLASS where EVENT = ?;
+
 -- name: DeleteEventIncidents :exec
 delete from INCIDENT where EVENT = ?;
 
 -- name: DeleteEventAccessAll :exec
 delete from EVENT_ACCESS where EVENT = ?;
 
+-- name: DeleteEventAccessHistory :exec
+delete from EVENT_ACCESS_HISTORY where EVENT = ?;
+
 -- name: DeleteEventPlaces :exec
 delete from PLACE where EVENT = ?;
 
@@ -122,6 +183,24 @@ where EVENT = ? and MODE = ?;
 insert into EVENT_ACCESS (EVENT, EXPRESSION, MODE, VALIDITY, NOT_AFTER, NOT_BEFORE, DESCRIPTION)
 values (?, ?, ?, ?, ?, ?, ?);
 
+-- name: EventAccessForMode :many
+select sqlc.embed(ea)
+from EVENT_ACCESS ea
+where ea.EVENT = ? and ea.MODE = ?
+order by ea.ID
+;
+
+-- name: AddEventAccessHistory :execlastid
+insert into EVENT_ACCESS_HISTORY (EVENT, MODE, AUTHOR, CREATED, BEFORE_RULES, AFTER_RULES)
+values (?, ?, ?, ?, ?, ?);
+
+-- name: EventAccessHistory :many
+select sqlc.embed(eah)
+from EVENT_ACCESS_HISTORY eah
+where eah.EVENT = ?
+order by eah.CREATED, eah.ID
+;
+
 -- name: CreateIncident :execlastid
 insert into INCIDENT (
     EVENT,
@@ -150,18 +229,79 @@ update INCIDENT set
     SUMMARY = ?,
     LOCATION_NAME = ?,
     LOCATION_ADDRESS = ?,
-    LOCATION_DESCRIPTION = ?
+    LOCATION_DESCRIPTION = ?,
+    CONFIDENTIAL = ?
+where
+    EVENT = ?
+    and NUMBER = ?
+    and VERSION = ?
+;
+
+-- Like UpdateIncident, this is guarded by VERSION, and it bumps VERSION so
+-- that zero rows affected reliably means a stale version or a missing row.
+-- name: MarkIncidentMerged :execrows
+update INCIDENT set
+    VERSION = VERSION + 1,
+    STATE = 'closed',
+    CLOSED = ?,
+    MERGED_INTO = ?
 where
     EVENT = ?
     and NUMBER = ?
     and VERSION = ?
 ;
 
+-- Taken in the merge's transaction, so that the survivor can't itself be
+-- merged away while the duplicate's records are moving onto it.
+-- name: LockMergeSurvivor :one
+select MERGED_INTO
+from INCIDENT
+where EVENT = ? and NUMBER = ?
+for update;
+
+-- name: MoveIncidentReportEntries :exec
+update INCIDENT__REPORT_ENTRY
+set INCIDENT_NUMBER = sqlc.arg(to_incident_number)
+where
+    EVENT = sqlc.arg(event)
+    and INCIDENT_NUMBER = sqlc.arg(from_incident_number)
+;
+
 -- name: IncidentVersion :one
 select VERSION
 from INCIDENT
 where EVENT = ? and NUMBER = ?;
 
+-- name: IncidentConfidential :one
+select CONFIDENTIAL
+from INCIDENT
+where EVENT = ? and NUMBER = ?;
+
+-- name: ConfidentialIncidentNumbers :many
+select NUMBER
+from INCIDENT
+where EVENT = ? and CONFIDENTIAL;
+
+-- name: FieldReportConfidential :one
+select exists (
+    select 1 from INCIDENT ci
+    where ci.EVENT = fr.EVENT
+        and ci.NUMBER = fr.INCIDENT_NUMBER
+        and ci.CONFIDENTIAL
+)
+from FIELD_REPORT fr
+where fr.EVENT = ? and fr.NUMBER = ?;
+
+-- name: VisitConfidential :one
+select exists (
+    select 1 from INCIDENT ci
+    where ci.EVENT = v.EVENT
+        and ci.NUMBER = v.INCIDENT_NUMBER
+        and ci.CONFIDENTIAL
+)
+from VISIT v
+where v.EVENT = ? and v.NUMBER = ?;
+
 -- name: Incident :one
 select
     sqlc.embed(i),
@@ -187,6 +327,9 @@ from INCIDENT i
 where i.EVENT = ?
     and i.NUMBER = ?;
 
+-- The filters and the NUMBER cursor here are for GetIncidents. The
+-- Incidents_* queries that fetch the rest of each Incident take the numbers
+-- this returned, so that they needn't repeat all the filtering.
 -- name: Incidents :many
 select
     sqlc.embed(i),
@@ -211,9 +354,61 @@ select
 from
     INCIDENT i
 where
-    i.EVENT = ?
+    i.EVENT = sqlc.arg(event)
+    and (sqlc.arg(all_states) or i.STATE in (sqlc.slice(states)))
+    and (sqlc.arg(all_priorities) or i.PRIORITY in (sqlc.slice(priorities)))
+    and (
+        sqlc.narg(incident_type) is null
+        or exists (
+            select 1 from INCIDENT__INCIDENT_TYPE iit
+            where iit.EVENT = i.EVENT
+                and iit.INCIDENT_NUMBER = i.NUMBER
+                and iit.INCIDENT_TYPE = sqlc.narg(incident_type)
+        )
+    )
+    and (
+        sqlc.narg(ranger_handle) is null
+        or exists (
+            select 1 from INCIDENT__RANGER ir
+            where ir.EVENT = i.EVENT
+                and ir.INCIDENT_NUMBER = i.NUMBER
+                and ir.RANGER_HANDLE = sqlc.narg(ranger_handle)
+        )
+    )
+    and (sqlc.arg(include_confidential) or not i.CONFIDENTIAL)
+    and i.CREATED >= sqlc.arg(created_after)
+    and i.CREATED <= sqlc.arg(created_before)
+    -- These two bound the last_modified time that the API reports, which is
+    -- the latest of CREATED and the report entries' times.
+    and (
+        i.CREATED >= sqlc.arg(modified_after)
+        or exists (
+            select 1
+            from INCIDENT__REPORT_ENTRY ire
+                join REPORT_ENTRY re
+                    on re.ID = ire.REPORT_ENTRY
+            where ire.EVENT = i.EVENT
+                and ire.INCIDENT_NUMBER = i.NUMBER
+                and re.CREATED >= sqlc.arg(modified_after)
+        )
+    )
+    and i.CREATED <= sqlc.arg(modified_before)
+    and not exists (
+        select 1
+        from INCIDENT__REPORT_ENTRY ire
+            join REPORT_ENTRY re
+                on re.ID = ire.REPORT_ENTRY
+        where ire.EVENT = i.EVENT
+            and ire.INCIDENT_NUMBER = i.NUMBER
+            and re.CREATED > sqlc.arg(modified_before)
+    )
+    and i.CHANGE_SEQ > sqlc.arg(changed_after)
+    and i.NUMBER > sqlc.arg(after_number)
 group by
-    i.NUMBER;
+    i.NUMBER
+order by
+    i.NUMBER
+limit ?;
 
 -- name: Incidents_Rangers :many
 select
@@ -221,7 +416,8 @@ select
 from
     INCIDENT__RANGER ir
 where
-    ir.EVENT = ?;
+    ir.EVENT = ?
+    and ir.INCIDENT_NUMBER in (sqlc.slice(incident_numbers));
 
 -- name: Incident_Rangers :many
 select
@@ -232,12 +428,46 @@ where
     ir.EVENT = ?
     and ir.INCIDENT_NUMBER = ?;
 
+-- name: Incidents_StateChanges :many
+select
+    sqlc.embed(isc)
+from
+    INCIDENT__STATE_CHANGE isc
+where
+    isc.EVENT = ?
+    and isc.INCIDENT_NUMBER in (sqlc.slice(incident_numbers))
+order by isc.CREATED, isc.ID;
+
+-- name: Incident_StateChanges :many
+select
+    sqlc.embed(isc)
+from
+    INCIDENT__STATE_CHANGE isc
+where
+    isc.EVENT = ?
+    and isc.INCIDENT_NUMBER = ?
+order by isc.CREATED, isc.ID;
+
+-- name: Incidents_Created :many
+select
+    i.NUMBER,
+    i.CREATED
+from
+    INCIDENT i
+where
+    i.EVENT = ?;
+
+-- name: AddIncidentStateChange :exec
+insert into INCIDENT__STATE_CHANGE (EVENT, INCIDENT_NUMBER, STATE, AUTHOR, CREATED)
+values (?, ?, ?, ?, ?);
+
 -- name: Incident_LinkedIncidents :many
 select
     ili.EVENT_2 as LINKED_EVENT,
     e.NAME as LINKED_EVENT_NAME,
     ili.INCIDENT_NUMBER_2 as LINKED_INCIDENT,
-    i2.SUMMARY as LINKED_INCIDENT_SUMMARY
+    i2.SUMMARY as LINKED_INCIDENT_SUMMARY,
+    i2.CONFIDENTIAL as LINKED_INCIDENT_CONFIDENTIAL
 from
     INCIDENT__LINKED_INCIDENT ili
     join `EVENT` e
@@ -261,6 +491,7 @@ from
 where
     ire.EVENT = ?
     and re.GENERATED <= ?
+    and ire.INCIDENT_NUMBER in (sqlc.slice(incident_numbers))
 ;
 
 -- name: Incident_ReportEntries :many
@@ -285,10 +516,70 @@ select sqlc.embed(it)
 from INCIDENT_TYPE it
 where it.ID = ?;
 
+-- The filters and the NUMBER cursor here are for GetFieldReports, as with
+-- Incidents. The author filter is for a requestor who may only read their own
+-- Field Reports, and it must agree with the containsAuthor check on a single
+-- Field Report.
 -- name: FieldReports :many
 select sqlc.embed(fr)
 from FIELD_REPORT fr
-where fr.EVENT = ?;
+where fr.EVENT = sqlc.arg(event)
+    and (sqlc.arg(all_incidents) or fr.INCIDENT_NUMBER <=> sqlc.narg(incident_number))
+    and (
+        sqlc.narg(author) is null
+        or exists (
+            select 1
+            from FIELD_REPORT__REPORT_ENTRY fre
+                join REPORT_ENTRY re
+                    on re.ID = fre.REPORT_ENTRY
+            where fre.EVENT = fr.EVENT
+                and fre.FIELD_REPORT_NUMBER = fr.NUMBER
+                and re.AUTHOR = sqlc.narg(author)
+                and re.GENERATED <= sqlc.arg(include_generated)
+        )
+    )
+    -- A Field Report attached to a confidential Incident is as confidential
+    -- as the Incident is.
+    and (
+        sqlc.arg(include_confidential)
+        or not exists (
+            select 1 from INCIDENT ci
+            where ci.EVENT = fr.EVENT
+                and ci.NUMBER = fr.INCIDENT_NUMBER
+                and ci.CONFIDENTIAL
+        )
+    )
+    and fr.CREATED >= sqlc.arg(created_after)
+    and fr.CREATED <= sqlc.arg(created_before)
+    -- These two bound the last_modified time that the API reports, which is
+    -- the latest of CREATED and the report entries' times.
+    and (
+        fr.CREATED >= sqlc.arg(modified_after)
+        or exists (
+            select 1
+            from FIELD_REPORT__REPORT_ENTRY fre
+                join REPORT_ENTRY re
+                    on re.ID = fre.REPORT_ENTRY
+            where fre.EVENT = fr.EVENT
+                and fre.FIELD_REPORT_NUMBER = fr.NUMBER
+                and re.CREATED >= sqlc.arg(modified_after)
+        )
+    )
+    and fr.CREATED <= sqlc.arg(modified_before)
+    and not exists (
+        select 1
+        from FIELD_REPORT__REPORT_ENTRY fre
+            join REPORT_ENTRY re
+                on re.ID = fre.REPORT_ENTRY
+        where fre.EVENT = fr.EVENT
+            and fre.FIELD_REPORT_NUMBER = fr.NUMBER
+            and re.CREATED > sqlc.arg(modified_before)
+    )
+    and fr.CHANGE_SEQ > sqlc.arg(changed_after)
+    and fr.NUMBER > sqlc.arg(after_number)
+order by
+    fr.NUMBER
+limit ?;
 
 -- name: FieldReport :one
 select sqlc.embed(fr)
@@ -307,6 +598,7 @@ from
 where
     irre.EVENT = ?
     and re.GENERATED <= ?
+    and irre.FIELD_REPORT_NUMBER in (sqlc.slice(field_report_numbers))
 ;
 
 -- name: FieldReport_ReportEntries :many
@@ -612,15 +904,58 @@ where
     s.EVENT = ?
     and s.NUMBER = ?;
 
+-- The filters and the NUMBER cursor here are for GetVisits, as with Incidents.
 -- name: Visits :many
 select
     sqlc.embed(s)
 from
     VISIT s
 where
-    s.EVENT = ?
+    s.EVENT = sqlc.arg(event)
+    and (sqlc.arg(all_incidents) or s.INCIDENT_NUMBER <=> sqlc.narg(incident_number))
+    -- As with FieldReports.
+    and (
+        sqlc.arg(include_confidential)
+        or not exists (
+            select 1 from INCIDENT ci
+            where ci.EVENT = s.EVENT
+                and ci.NUMBER = s.INCIDENT_NUMBER
+                and ci.CONFIDENTIAL
+        )
+    )
+    and s.CREATED >= sqlc.arg(created_after)
+    and s.CREATED <= sqlc.arg(created_before)
+    -- These two bound the last_modified time that the API reports, which is
+    -- the latest of CREATED and the report entries' times.
+    and (
+        s.CREATED >= sqlc.arg(modified_after)
+        or exists (
+            select 1
+            from VISIT__REPORT_ENTRY sre
+                join REPORT_ENTRY re
+                    on re.ID = sre.REPORT_ENTRY
+            where sre.EVENT = s.EVENT
+                and sre.VISIT_NUMBER = s.NUMBER
+                and re.CREATED >= sqlc.arg(modified_after)
+        )
+    )
+    and s.CREATED <= sqlc.arg(modified_before)
+    and not exists (
+        select 1
+        from VISIT__REPORT_ENTRY sre
+            join REPORT_ENTRY re
+                on re.ID = sre.REPORT_ENTRY
+        where sre.EVENT = s.EVENT
+            and sre.VISIT_NUMBER = s.NUMBER
+            and re.CREATED > sqlc.arg(modified_before)
+    )
+    and s.CHANGE_SEQ > sqlc.arg(changed_after)
+    and s.NUMBER > sqlc.arg(after_number)
 group by
-    s.NUMBER;
+    s.NUMBER
+order by
+    s.NUMBER
+limit ?;
 
 -- name: Visits_Rangers :many
 select
@@ -628,7 +963,8 @@ select
 from
     VISIT__RANGER sr
 where
-    sr.EVENT = ?;
+    sr.EVENT = ?
+    and sr.VISIT_NUMBER in (sqlc.slice(visit_numbers));
 
 -- name: Visit_Rangers :many
 select
@@ -675,6 +1011,7 @@ from
 where
     sre.EVENT = ?
     and re.GENERATED <= ?
+    and sre.VISIT_NUMBER in (sqlc.slice(visit_numbers))
 ;
 
 -- This doesn't use "MAX" because sqlc can't figure out the type for aggregations :(.
@@ -688,7 +1025,7 @@ order by 1 desc
 limit 1;
 
 -- name: DirectoryActivePersons :many
-select ID, HANDLE, EMAIL, PASSWORD, ONSITE
+select ID, HANDLE, EMAIL, PASSWORD, ONSITE, ON_DUTY_POSITION_ID
 from DIRECTORY_PERSON
 where ACTIVE;
 
@@ -705,9 +1042,15 @@ select PERSON_ID, POSITION_ID from DIRECTORY_PERSON__POSITION;
 select PERSON_ID, TEAM_ID from DIRECTORY_PERSON__TEAM;
 
 -- name: DirectoryAllPersons :many
-select ID, HANDLE, EMAIL, ACTIVE, ONSITE
+select ID, HANDLE, EMAIL, ACTIVE, ONSITE, TOTP_CONFIRMED, TOTP_REQUIRED, ON_DUTY_POSITION_ID, ON_DUTY_SINCE
 from DIRECTORY_PERSON;
 
+-- name: DirectoryPasswordHashes :many
+select PASSWORD from DIRECTORY_PERSON;
+
+-- name: DirectoryPasswordPolicies :many
+select ID, HANDLE, ACTIVE, PASSWORD_POLICY from DIRECTORY_PERSON;
+
 -- name: DirectoryAllPositions :many
 select ID, TITLE, ACTIVE from DIRECTORY_POSITION;
 
@@ -720,8 +1063,8 @@ from DIRECTORY_PERSON
 where HANDLE = ?;
 
 -- name: DirectoryCreatePerson :execlastid
-insert into DIRECTORY_PERSON (HANDLE, EMAIL, PASSWORD, ACTIVE, ONSITE)
-values (?, ?, ?, ?, ?);
+insert into DIRECTORY_PERSON (HANDLE, EMAIL, PASSWORD, PASSWORD_POLICY, ACTIVE, ONSITE)
+values (?, ?, ?, ?, ?, ?);
 
 -- name: DirectoryUpdatePerson :exec
 update DIRECTORY_PERSON
@@ -734,9 +1077,16 @@ where ID = ?;
 
 -- name: DirectorySetPersonPassword :exec
 update DIRECTORY_PERSON
-set PASSWORD = ?
+set PASSWORD = ?, PASSWORD_POLICY = ?
 where ID = ?;
 
+-- DirectoryRehashPersonPassword replaces a password hash with a stronger one of
+-- the same password, unless the password has been changed in the meantime.
+-- name: DirectoryRehashPersonPassword :execrows
+update DIRECTORY_PERSON
+set PASSWORD = sqlc.arg(new_password)
+where ID = sqlc.arg(id) and PASSWORD = sqlc.arg(old_password);
+
 -- name: DirectoryDeletePerson :exec
 delete from DIRECTORY_PERSON where ID = ?;
 
@@ -779,6 +1129,140 @@ select ID, HANDLE, EMAIL, ACTIVE, ONSITE
 from DIRECTORY_PERSON
 where ID = ?;
 
+-- name: DirectoryPersonOnDuty :one
+select ON_DUTY_POSITION_ID, ON_DUTY_SINCE
+from DIRECTORY_PERSON
+where ID = ?
+for update;
+
+-- name: DirectorySetPersonOnDuty :exec
+update DIRECTORY_PERSON
+set ON_DUTY_POSITION_ID = ?, ON_DUTY_SINCE = ?
+where ID = ?;
+
+-- DirectorySignOffPosition takes everyone who's on duty in a position off
+-- duty, such as when it's about to be deleted.
+-- name: DirectorySignOffPosition :exec
+update DIRECTORY_PERSON
+set ON_DUTY_POSITION_ID = null, ON_DUTY_SINCE = null
+where ON_DUTY_POSITION_ID = ?;
+
+-- name: DirectoryStartShift :exec
+insert into DIRECTORY_SHIFT (PERSON_ID, POSITION_ID, POSITION_TITLE, ON_DUTY)
+values (?, ?, ?, ?);
+
+-- name: DirectoryEndPersonShifts :exec
+update DIRECTORY_SHIFT
+set OFF_DUTY = ?
+where PERSON_ID = ? and OFF_DUTY is null;
+
+-- name: DirectoryEndPositionShifts :exec
+update DIRECTORY_SHIFT
+set OFF_DUTY = ?
+where POSITION_ID = ? and OFF_DUTY is null;
+
+-- DirectoryShifts finds the shifts that overlap the time range, including
+-- those still going, of just the one person if person_id isn't null.
+-- name: DirectoryShifts :many
+select s.ID, s.PERSON_ID, p.HANDLE, s.POSITION_ID, s.POSITION_TITLE, s.ON_DUTY, s.OFF_DUTY
+from DIRECTORY_SHIFT s
+join DIRECTORY_PERSON p on p.ID = s.PERSON_ID
+where s.ON_DUTY <= sqlc.arg(max_time)
+    and (s.OFF_DUTY is null or s.OFF_DUTY >= sqlc.arg(min_time))
+    and (sqlc.narg(person_id) is null or s.PERSON_ID = sqlc.narg(person_id))
+order by s.ON_DUTY, s.ID;
+
+-- name: DirectoryPersonTOTP :one
+select ID, HANDLE, TOTP_SECRET, TOTP_CONFIRMED, TOTP_LAST_STEP, TOTP_REQUIRED
+from DIRECTORY_PERSON
+where ID = ?;
+
+-- DirectoryStartPersonTOTP gives a person a new TOTP secret, which isn't used
+-- until they've confirmed it.
+-- name: DirectoryStartPersonTOTP :exec
+update DIRECTORY_PERSON
+set TOTP_SECRET = ?, TOTP_CONFIRMED = false, TOTP_LAST_STEP = null
+where ID = ?;
+
+-- name: DirectoryConfirmPersonTOTP :execrows
+update DIRECTORY_PERSON
+set TOTP_CONFIRMED = true, TOTP_LAST_STEP = sqlc.arg(step)
+where ID = sqlc.arg(id)
+    and TOTP_SECRET is not null
+    and not TOTP_CONFIRMED;
+
+-- DirectoryUsePersonTOTPStep records the use of a TOTP code, unless a code
+-- from that period or a later one has already been used.
+-- name: DirectoryUsePersonTOTPStep :execrows
+update DIRECTORY_PERSON
+set TOTP_LAST_STEP = sqlc.arg(step)
+where ID = sqlc.arg(id)
+    and TOTP_CONFIRMED
+    and (TOTP_LAST_STEP is null or TOTP_LAST_STEP < sqlc.arg(step));
+
+-- name: DirectoryResetPersonTOTP :exec
+update DIRECTORY_PERSON
+set TOTP_SECRET = null, TOTP_CONFIRMED = false, TOTP_LAST_STEP = null
+where ID = ?;
+
+-- name: DirectorySetPersonTOTPRequired :exec
+update DIRECTORY_PERSON
+set TOTP_REQUIRED = ?
+where ID = ?;
+
+-- name: DirectoryClearRecoveryCodes :exec
+delete from DIRECTORY_RECOVERY_CODE where PERSON_ID = ?;
+
+-- name: DirectoryAddRecoveryCode :exec
+insert into DIRECTORY_RECOVERY_CODE (PERSON_ID, CODE_HASH) values (?, ?);
+
+-- name: DirectoryUseRecoveryCode :execrows
+update DIRECTORY_RECOVERY_CODE
+set USED = ?
+where PERSON_ID = ? and CODE_HASH = ? and USED is null;
+
+-- name: DirectoryUnusedRecoveryCodes :one
+select count(*)
+from DIRECTORY_RECOVERY_CODE
+where PERSON_ID = ? and USED is null;
+
+-- name: DirectoryCreatePasswordToken :exec
+insert into DIRECTORY_PASSWORD_TOKEN (PERSON_ID, PURPOSE, TOKEN_HASH, CREATED, EXPIRES)
+values (?, ?, ?, ?, ?);
+
+-- DirectoryPasswordTokenByHash finds a token, along with the person it's for.
+-- name: DirectoryPasswordTokenByHash :one
+select t.ID, t.PERSON_ID, t.PURPOSE, t.EXPIRES, t.USED, p.HANDLE, p.EMAIL, p.ACTIVE
+from DIRECTORY_PASSWORD_TOKEN t
+join DIRECTORY_PERSON p on p.ID = t.PERSON_ID
+where t.TOKEN_HASH = ?;
+
+-- name: DirectoryUsePasswordToken :execrows
+update DIRECTORY_PASSWORD_TOKEN
+set USED = ?
+where ID = ? and USED is null;
+
+-- DirectoryUsePersonPasswordTokens marks all of a person's tokens used, so
+-- that only the newest one works.
+-- name: DirectoryUsePersonPasswordTokens :exec
+update DIRECTORY_PASSWORD_TOKEN
+set USED = ?
+where PERSON_ID = ? and USED is null;
+
+-- DirectoryClaimPasswordReset records that the person is being sent a
+-- password reset, unless they were already sent one since the given time.
+-- Checking and recording in one statement means that concurrent requests
+-- can't both pass the check.
+-- name: DirectoryClaimPasswordReset :execrows
+update DIRECTORY_PERSON
+set PASSWORD_RESET_SENT = sqlc.arg(now)
+where ID = sqlc.arg(id)
+    and (PASSWORD_RESET_SENT is null or PASSWORD_RESET_SENT <= sqlc.arg(since));
+
+-- name: DirectoryPrunePasswordTokens :exec
+delete from DIRECTORY_PASSWORD_TOKEN
+where EXPIRES < ?;
+
 -- The Search* queries below power the cross-event search API. Each matches
 -- either a case-insensitive LIKE pattern (the handler escapes user input and
 -- wraps it in "%") or a REGEXP pattern, scoped to the events the requestor may
@@ -801,6 +1285,7 @@ select
     i.PRIORITY,
     i.SUMMARY,
     i.LOCATION_NAME,
+    i.CONFIDENTIAL,
     coalesce((
         select re.TEXT
         from INCIDENT__REPORT_ENTRY ire
@@ -816,6 +1301,9 @@ select
     ), '') as MATCHED_ENTRY_TEXT
 from INCIDENT i
 where i.EVENT in (sqlc.slice(event_ids))
+    -- Confidential Incidents are only found in the Events whose confidential
+    -- Incidents the requestor may read.
+    and (not i.CONFIDENTIAL or i.EVENT in (sqlc.slice(confidential_event_ids)))
     and (
         (i.SUMMARY like sqlc.narg(text_like) or regexp_instr(i.SUMMARY, sqlc.narg(text_regexp)) > 0)
         or (i.LOCATION_NAME like sqlc.narg(text_like) or regexp_instr(i.LOCATION_NAME, sqlc.narg(text_regexp)) > 0)
@@ -869,6 +1357,12 @@ select
     fr.CREATED,
     fr.SUMMARY,
     fr.INCIDENT_NUMBER,
+    exists (
+        select 1 from INCIDENT ci
+        where ci.EVENT = fr.EVENT
+            and ci.NUMBER = fr.INCIDENT_NUMBER
+            and ci.CONFIDENTIAL
+    ) as INCIDENT_CONFIDENTIAL,
     coalesce((
         select re.TEXT
         from FIELD_REPORT__REPORT_ENTRY frre
@@ -884,6 +1378,16 @@ select
     ), '') as MATCHED_ENTRY_TEXT
 from FIELD_REPORT fr
 where fr.EVENT in (sqlc.slice(event_ids))
+    -- As with SearchIncidents, for those attached to a confidential Incident.
+    and (
+        fr.EVENT in (sqlc.slice(confidential_event_ids))
+        or not exists (
+            select 1 from INCIDENT ci
+            where ci.EVENT = fr.EVENT
+                and ci.NUMBER = fr.INCIDENT_NUMBER
+                and ci.CONFIDENTIAL
+        )
+    )
     and (
         (fr.SUMMARY like sqlc.narg(text_like) or regexp_instr(fr.SUMMARY, sqlc.narg(text_regexp)) > 0)
         or exists (
@@ -929,6 +1433,12 @@ select
     v.GUEST_PREFERRED_NAME,
     v.GUEST_LEGAL_NAME,
     v.GUEST_CAMP_NAME,
+    exists (
+        select 1 from INCIDENT ci
+        where ci.EVENT = v.EVENT
+            and ci.NUMBER = v.INCIDENT_NUMBER
+            and ci.CONFIDENTIAL
+    ) as INCIDENT_CONFIDENTIAL,
     coalesce((
         select re.TEXT
         from VISIT__REPORT_ENTRY vre
@@ -944,6 +1454,16 @@ select
     ), '') as MATCHED_ENTRY_TEXT
 from VISIT v
 where v.EVENT in (sqlc.slice(event_ids))
+    -- As with SearchFieldReports.
+    and (
+        v.EVENT in (sqlc.slice(confidential_event_ids))
+        or not exists (
+            select 1 from INCIDENT ci
+            where ci.EVENT = v.EVENT
+                and ci.NUMBER = v.INCIDENT_NUMBER
+                and ci.CONFIDENTIAL
+        )
+    )
     and (
         (v.GUEST_PREFERRED_NAME like sqlc.narg(text_like) or regexp_instr(v.GUEST_PREFERRED_NAME, sqlc.narg(text_regexp)) > 0)
         or (v.GUEST_LEGAL_NAME like sqlc.narg(text_like) or regexp_instr(v.GUEST_LEGAL_NAME, sqlc.narg(text_regexp)) > 0)
@@ -974,3 +1494,365 @@ where v.EVENT in (sqlc.slice(event_ids))
 order by v.EVENT desc, v.NUMBER desc
 limit ?
 ;
+
+-- name: NextSSEID :execlastid
+update SSE_SEQUENCE
+set ID = last_insert_id(ID + 1)
+where true;
+
+-- name: LatestSSEID :one
+select ID from SSE_SEQUENCE;
+
+-- name: AddSSEOutboxEntry :exec
+insert into SSE_OUTBOX (
+    ID, EVENT, INCIDENT_NUMBER, FIELD_REPORT_NUMBER, VISIT_NUMBER, CREATED
+)
+values (?, ?, ?, ?, ?, ?);
+
+-- name: SSEOutboxEntries :many
+select *
+from SSE_OUTBOX
+where ID > ?
+order by ID
+limit ?;
+
+-- name: PruneSSEOutbox :exec
+delete from SSE_OUTBOX
+where CREATED < ?;
+
+-- name: Webhooks :many
+select sqlc.embed(w),
+    (
+        select coalesce(json_arrayagg(wt.TRIGGER_TYPE), "[]")
+        from WEBHOOK__TRIGGER wt
+        where wt.WEBHOOK = w.ID
+    ) as TRIGGER_TYPES
+from WEBHOOK w
+where w.EVENT = ?
+order by w.ID;
+
+-- name: Webhook :one
+select sqlc.embed(w)
+from WEBHOOK w
+where w.EVENT = ? and w.ID = ?;
+
+-- name: WebhooksForTrigger :many
+select sqlc.embed(w)
+from WEBHOOK w
+    join WEBHOOK__TRIGGER wt
+        on wt.WEBHOOK = w.ID
+where w.EVENT = ?
+    and w.ENABLED
+    and w.SECRET is not null
+    and wt.TRIGGER_TYPE = ?;
+
+-- name: CreateWebhook :execlastid
+insert into WEBHOOK (EVENT, URL, ENABLED, CREATED)
+values (?, ?, ?, ?);
+
+-- name: UpdateWebhook :exec
+update WEBHOOK
+set URL = ?, ENABLED = ?
+where EVENT = ? and ID = ?;
+
+-- The secret is set apart from the rest, since it's sealed with the Webhook's
+-- ID, which a new Webhook doesn't have until it's been created.
+-- name: SetWebhookSecret :exec
+update WEBHOOK
+set SECRET = ?
+where ID = ?;
+
+-- name: AddWebhookTrigger :exec
+insert into WEBHOOK__TRIGGER (WEBHOOK, TRIGGER_TYPE)
+values (?, ?);
+
+-- name: ClearWebhookTriggers :exec
+delete from WEBHOOK__TRIGGER where WEBHOOK = ?;
+
+-- name: DeleteWebhookDeliveries :exec
+delete from WEBHOOK_DELIVERY where WEBHOOK = ?;
+
+-- name: DeleteWebhook :exec
+delete from WEBHOOK where EVENT = ? and ID = ?;
+
+-- name: DeleteEventWebhookDeliveries :exec
+delete from WEBHOOK_DELIVERY where EVENT = ?;
+
+-- name: DeleteEventWebhookTriggers :exec
+delete wt
+from WEBHOOK__TRIGGER wt
+    join WEBHOOK w
+        on w.ID = wt.WEBHOOK
+where w.EVENT = ?;
+
+-- name: DeleteEventWebhooks :exec
+delete from WEBHOOK where EVENT = ?;
+
+-- name: AddWebhookDelivery :exec
+insert into WEBHOOK_DELIVERY (
+    WEBHOOK, EVENT, TRIGGER_TYPE, INCIDENT_NUMBER, FIELD_REPORT_NUMBER, VISIT_NUMBER,
+    STATUS, NEXT_ATTEMPT, CREATED
+)
+values (?, ?, ?, ?, ?, ?, 'pending', ?, ?);
+
+-- name: WebhookDeliveries :many
+select *
+from WEBHOOK_DELIVERY
+where WEBHOOK = ?
+    and (sqlc.narg(status) is null or STATUS = sqlc.narg(status))
+order by ID desc
+limit ?;
+
+-- Each server's worker takes the due deliveries that no other worker has
+-- locked. It must then push their NEXT_ATTEMPT out, before committing, so
+-- that nobody else takes them while they're being sent. A disabled Webhook's
+-- deliveries wait, still pending, until it's enabled again.
+-- name: DueWebhookDeliveries :many
+select sqlc.embed(d), w.URL, w.SECRET
+from WEBHOOK_DELIVERY d
+    join WEBHOOK w
+        on w.ID = d.WEBHOOK
+where d.STATUS = 'pending'
+    and d.NEXT_ATTEMPT <= ?
+    and w.ENABLED
+    and w.SECRET is not null
+order by d.NEXT_ATTEMPT
+limit ?
+for update skip locked;
+
+-- name: LeaseWebhookDeliveries :exec
+update WEBHOOK_DELIVERY
+set NEXT_ATTEMPT = ?
+where ID in (sqlc.slice(ids));
+
+-- name: RecordWebhookAttempt :exec
+update WEBHOOK_DELIVERY
+set STATUS = ?,
+    ATTEMPTS = ATTEMPTS + 1,
+    NEXT_ATTEMPT = ?,
+    LAST_ATTEMPT = ?,
+    LAST_STATUS_CODE = ?,
+    LAST_ERROR = ?,
+    BODY_DIGEST = coalesce(?, BODY_DIGEST)
+where ID = ?;
+
+-- name: RetryWebhookDelivery :execrows
+update WEBHOOK_DELIVERY
+set STATUS = 'pending', ATTEMPTS = 0, NEXT_ATTEMPT = ?
+where WEBHOOK = ? and ID = ? and STATUS = 'dead';
+
+-- name: PruneWebhookDeliveries :exec
+delete from WEBHOOK_DELIVERY
+where STATUS != 'pending' and CREATED < ?;
+
+-- name: APITokens :many
+select sqlc.embed(t),
+    (
+        select coalesce(json_arrayagg(e.NAME), "[]")
+        from API_TOKEN__EVENT te
+            join EVENT e
+                on e.ID = te.EVENT
+        where te.API_TOKEN = t.ID
+    ) as EVENT_NAMES
+from API_TOKEN t
+order by t.ID;
+
+-- name: APITokenByHash :one
+select sqlc.embed(t),
+    (
+        select coalesce(json_arrayagg(te.EVENT), "[]")
+        from API_TOKEN__EVENT te
+        where te.API_TOKEN = t.ID
+    ) as EVENT_IDS
+from API_TOKEN t
+where t.TOKEN_HASH = ?;
+
+-- name: CreateAPIToken :execlastid
+insert into API_TOKEN (
+    NAME, TOKEN_HASH, EVENT_PERMISSIONS, GLOBAL_PERMISSIONS, CREATED, CREATED_BY, EXPIRES
+)
+values (?, ?, ?, ?, ?, ?, ?);
+
+-- name: AddAPITokenEvent :exec
+insert into API_TOKEN__EVENT (API_TOKEN, EVENT)
+values (?, ?);
+
+-- name: RevokeAPIToken :execrows
+update API_TOKEN
+set REVOKED = ?
+where ID = ? and REVOKED is null;
+
+-- name: APITokenActive :one
+select count(*)
+from API_TOKEN
+where ID = ?
+    and REVOKED is null;
+
+-- LAST_USED is only kept to the minute or so, to save on writes from busy
+-- integrations.
+-- name: TouchAPIToken :exec
+update API_TOKEN
+set LAST_USED = sqlc.arg(now)
+where ID = sqlc.arg(id)
+    and (LAST_USED is null or LAST_USED < sqlc.arg(stale_before));
+
+-- name: DeleteEventAPITokenEvents :exec
+delete from API_TOKEN__EVENT where EVENT = ?;
+
+-- name: CreateSession :execlastid
+insert into `SESSION` (
+    USER_ID, USER_HANDLE, TOKEN_HASH, USER_AGENT, CLIENT_ADDRESS, CREATED, LAST_USED, EXPIRES
+)
+values (?, ?, ?, ?, ?, ?, ?, ?);
+
+-- SessionByTokenHash finds the session for a refresh token, whether that's
+-- the session's current token or the one before it. Both args are that token's
+-- hash.
+-- name: SessionByTokenHash :one
+select *
+from `SESSION`
+where TOKEN_HASH = sqlc.arg(token_hash)
+    or PREVIOUS_TOKEN_HASH = sqlc.arg(previous_token_hash);
+
+-- RotateSession replaces the session's refresh token, but only if it hasn't
+-- been replaced already in the meantime. MariaDB makes these assignments in
+-- order, so PREVIOUS_TOKEN_HASH gets the token that's being replaced.
+-- name: RotateSession :execrows
+update `SESSION`
+set PREVIOUS_TOKEN_HASH = TOKEN_HASH,
+    TOKEN_HASH = sqlc.arg(new_token_hash),
+    ROTATED = sqlc.arg(rotated),
+    LAST_USED = sqlc.arg(last_used)
+where ID = sqlc.arg(id)
+    and TOKEN_HASH = sqlc.arg(old_token_hash);
+
+-- name: TouchSession :exec
+update `SESSION`
+set LAST_USED = ?
+where ID = ?;
+
+-- name: RevokeSession :execrows
+update `SESSION`
+set REVOKED = ?
+where ID = ? and REVOKED is null;
+
+-- name: RevokeUserSession :execrows
+update `SESSION`
+set REVOKED = ?
+where ID = ? and USER_ID = ? and REVOKED is null;
+
+-- name: RevokeUserSessions :exec
+update `SESSION`
+set REVOKED = ?
+where USER_ID = ? and REVOKED is null;
+
+-- name: ActiveSessions :many
+select *
+from `SESSION`
+where (sqlc.narg(user_id) is null or USER_ID = sqlc.narg(user_id))
+    and REVOKED is null
+    and EXPIRES > sqlc.arg(now)
+order by LAST_USED desc;
+
+-- name: PruneSessions :exec
+delete from `SESSION`
+where EXPIRES < ?;
+
+-- LoginThrottle gives the failed login count for an identification or client
+-- address.
+-- name: LoginThrottle :one
+select *
+from LOGIN_THROTTLE
+where KIND = ? and SUBJECT = ?;
+
+-- RecordLoginFailure counts a failed login. Failures older than reset_before
+-- are forgotten, as are those before a lockout that's since ended, so the
+-- count starts over from one. The assignments are made in order, so FAILURES
+-- has to be worked out before LAST_FAILURE and LOCKED_UNTIL are changed.
+-- name: RecordLoginFailure :exec
+insert into LOGIN_THROTTLE (KIND, SUBJECT, FAILURES, LAST_FAILURE)
+values (sqlc.arg(kind), sqlc.arg(subject), 1, sqlc.arg(now))
+on duplicate key update
+    FAILURES = if(LAST_FAILURE < sqlc.arg(reset_before) or LOCKED_UNTIL <= values(LAST_FAILURE), 1, FAILURES + 1),
+    LAST_FAILURE = values(LAST_FAILURE),
+    LOCKED_UNTIL = if(LOCKED_UNTIL <= values(LAST_FAILURE), null, LOCKED_UNTIL);
+
+-- LockLogin locks an identification, unless it's already locked.
+-- name: LockLogin :execrows
+update LOGIN_THROTTLE
+set LOCKED_UNTIL = sqlc.arg(locked_until)
+where ID = sqlc.arg(id)
+    and (LOCKED_UNTIL is null or LOCKED_UNTIL < sqlc.arg(now));
+
+-- name: ClearLoginThrottle :exec
+delete from LOGIN_THROTTLE
+where KIND = ? and SUBJECT = ?;
+
+-- name: DeleteLoginThrottle :execrows
+delete from LOGIN_THROTTLE
+where ID = ?;
+
+-- ActiveLoginThrottles gives the identifications and addresses that are
+-- locked, or that have failed to log in since failed_since.
+-- name: ActiveLoginThrottles :many
+select *
+from LOGIN_THROTTLE
+where LAST_FAILURE >= sqlc.arg(failed_since)
+    or LOCKED_UNTIL > sqlc.arg(now)
+order by LAST_FAILURE desc;
+
+-- name: PruneLoginThrottles :exec
+delete from LOGIN_THROTTLE
+where LAST_FAILURE < sqlc.arg(failed_before)
+    and (LOCKED_UNTIL is null or LOCKED_UNTIL < sqlc.arg(now));
+
+-- JWTKeys gives the JWT signing keys that are in use, newest first. Those
+-- retired before retired_since are left out, since every JWT they signed has
+-- expired.
+-- name: JWTKeys :many
+select *
+from JWT_KEY
+where RETIRED is null or RETIRED >= sqlc.arg(retired_since)
+order by CREATED desc;
+
+-- name: CreateJWTKey :exec
+insert into JWT_KEY (ID, ALGORITHM, SECRET, CREATED)
+values (?, ?, ?, ?);
+
+-- name: RetireJWTKeys :exec
+update JWT_KEY
+set RETIRED = ?
+where RETIRED is null;
+
+-- name: PruneJWTKeys :exec
+delete from JWT_KEY
+where RETIRED < ?;
+
+-- name: CreateBreakGlass :execlastid
+insert into BREAK_GLASS (EVENT, INCIDENT_NUMBER, VISIT_NUMBER, HANDLE, JUSTIFICATION, CREATED, EXPIRES)
+values (?, ?, ?, ?, ?, ?, ?);
+
+-- name: IncidentBreakGlassActive :one
+select count(*) from BREAK_GLASS
+where EVENT = ?
+    and INCIDENT_NUMBER = ?
+    and HANDLE = ?
+    and EXPIRES > sqlc.arg(now)
+;
+
+-- name: VisitBreakGlassActive :one
+select count(*) from BREAK_GLASS
+where EVENT = ?
+    and VISIT_NUMBER = ?
+    and HANDLE = ?
+    and EXPIRES > sqlc.arg(now)
+;
+
+-- name: BreakGlasses :many
+select sqlc.embed(bg), e.NAME as EVENT_NAME
+from BREAK_GLASS bg
+    join `EVENT` e
+        on e.ID = bg.EVENT
+where bg.CREATED >= sqlc.arg(since)
+order by bg.CREATED desc, bg.ID desc
+;
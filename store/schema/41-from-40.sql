@@ -0,0 +1,31 @@
+/* Add a table recording each change to an Incident's state.
+
+   INCIDENT only holds the current STATE, along with CREATED and CLOSED, so
+   there was no way to tell how long an Incident sat in, say, dispatched before
+   going on_scene, short of parsing the "Changed state" text out of generated
+   report entries. A row is written here in the same transaction as the state
+   change itself. An Incident's initial state of new is implied by its CREATED
+   time, and isn't recorded here. */
+
+create table INCIDENT__STATE_CHANGE (
+    ID              integer     not null auto_increment,
+    `EVENT`         integer     not null,
+    INCIDENT_NUMBER integer     not null,
+    STATE enum(
+        'new', 'on_hold', 'dispatched', 'on_scene', 'closed'
+    ) not null,
+    AUTHOR          varchar(64) not null,
+    CREATED         double      not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+    foreign key (`EVENT`, INCIDENT_NUMBER) references INCIDENT(`EVENT`, NUMBER),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `INCIDENT__STATE_CHANGE_EVENT_INCIDENT_NUMBER_index`
+    on `INCIDENT__STATE_CHANGE` (`EVENT`, INCIDENT_NUMBER);
+
+update `SCHEMA_INFO`
+set `VERSION` = 41
+where true;
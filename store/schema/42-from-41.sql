@@ -0,0 +1,14 @@
+/* Add a column marking an Incident that was merged into another.
+
+   Dispatch sometimes opens two Incidents for the same call. Merging moves
+   everything attached to the duplicate over to the surviving Incident, then
+   closes the duplicate and points it at the survivor here, so that anyone who
+   still has the duplicate open can be sent along to the right place. The
+   survivor is always in the same Event. There's deliberately no foreign key,
+   since that would stop an Event's Incidents from being deleted in bulk. */
+
+alter table INCIDENT add column MERGED_INTO integer after `VERSION`;
+
+update `SCHEMA_INFO`
+set `VERSION` = 42
+where true;
@@ -0,0 +1,31 @@
+/* Number the writes to each Event, so that clients can ask what changed.
+
+   A client that misses some server-sent events has had to refetch every
+   Incident, Field Report and Visit to catch up, since VERSION only moves on
+   writes to the record's own columns. Now every write to one of those
+   records, including to its report entries, Rangers, types and links, bumps
+   its Event's CHANGE_SEQ and stamps the new value on each record it touched.
+   A client that remembers the latest value it has seen can then fetch only
+   the records stamped after that.
+
+   The bump is the last thing each transaction does, and EVENT's row lock is
+   then held until commit, so the values commit in order: once a reader sees
+   an Event's CHANGE_SEQ, every record stamped with that value or less is
+   visible too. */
+
+alter table `EVENT` add column CHANGE_SEQ bigint not null default 0;
+
+alter table INCIDENT add column CHANGE_SEQ bigint not null default 0 after MERGED_INTO;
+alter table FIELD_REPORT add column CHANGE_SEQ bigint not null default 0 after `VERSION`;
+alter table VISIT add column CHANGE_SEQ bigint not null default 0 after `VERSION`;
+
+create index `INCIDENT_EVENT_CHANGE_SEQ_index`
+    on `INCIDENT` (`EVENT`, CHANGE_SEQ);
+create index `FIELD_REPORT_EVENT_CHANGE_SEQ_index`
+    on `FIELD_REPORT` (`EVENT`, CHANGE_SEQ);
+create index `VISIT_EVENT_CHANGE_SEQ_index`
+    on `VISIT` (`EVENT`, CHANGE_SEQ);
+
+update `SCHEMA_INFO`
+set `VERSION` = 43
+where true;
@@ -0,0 +1,41 @@
+/* Carry server-sent events between IMS replicas.
+
+   Each replica has only ever known about the writes made through itself, so
+   with more than one replica behind a load balancer, a browser heard about
+   only some of the changes. Now a replica that makes a change writes a row
+   to SSE_OUTBOX, and every replica polls that table and sends its own
+   browsers whatever rows appear, including the ones it wrote itself.
+
+   SSE_OUTBOX.ID is also the SSE ID, which clients compare across reconnects
+   to find out whether they missed anything, so it has to be in one global
+   order. It comes from the single row in SSE_SEQUENCE, which each writer
+   bumps in the same transaction as its insert. That row's lock is held until
+   commit, so the IDs commit in order, and a poller that sees some ID has
+   already seen, or will never see, every lower one. */
+
+create table SSE_SEQUENCE (
+    -- Always 1, which keeps the table to its one row, and gives it a
+    -- primary key that bumping ID doesn't move.
+    SINGLETON tinyint not null default 1,
+    ID        bigint  not null,
+
+    primary key (SINGLETON),
+    constraint SSE_SEQUENCE_ONE_ROW check (SINGLETON = 1)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+insert into SSE_SEQUENCE (ID) values (0);
+
+create table SSE_OUTBOX (
+    ID                  bigint  not null,
+    EVENT               integer not null,
+    INCIDENT_NUMBER     integer,
+    FIELD_REPORT_NUMBER integer,
+    VISIT_NUMBER        integer,
+    CREATED             double  not null,
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+update `SCHEMA_INFO`
+set `VERSION` = 44
+where true;
@@ -0,0 +1,72 @@
+/* Add outbound webhooks.
+
+   Admins register a WEBHOOK on an Event, to be told about some kinds of
+   change to its records. Each such change queues a WEBHOOK_DELIVERY, which
+   every IMS server's worker polls for, and which then stays around as the log
+   of how that delivery went. WEBHOOK_DELIVERY.EVENT repeats the WEBHOOK's, for
+   deleting an Event's deliveries along with the rest of it.
+
+   WEBHOOK.SECRET is encrypted under the deployment's master key, like
+   TOTP_SECRET is. It's set just after the WEBHOOK is created, since its ID is
+   part of what's sealed, so it can't be "not null".
+
+   A delivery doesn't keep the payload it sends, which would be a copy of the
+   record held for as long as the delivery log is, and out of reach of later
+   redaction. It says which record it's about instead, and its payload is built
+   afresh for each attempt. BODY_DIGEST is the SHA-256 of what the last attempt
+   sent, so that it can be matched up with what the receiver got. */
+
+create table WEBHOOK (
+    ID      integer       not null auto_increment,
+    `EVENT` integer       not null,
+    URL     varchar(1024) not null,
+    SECRET  varbinary(256),
+    ENABLED boolean       not null default true,
+    CREATED double        not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create table WEBHOOK__TRIGGER (
+    WEBHOOK      integer not null,
+    TRIGGER_TYPE enum(
+        'incident.created', 'incident.updated', 'incident.state_changed',
+        'field_report.created', 'field_report.updated', 'field_report.attached',
+        'visit.created', 'visit.updated', 'visit.departed'
+    ) not null,
+
+    foreign key (WEBHOOK) references WEBHOOK(ID),
+
+    primary key (WEBHOOK, TRIGGER_TYPE)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create table WEBHOOK_DELIVERY (
+    ID                  bigint       not null auto_increment,
+    WEBHOOK             integer      not null,
+    `EVENT`             integer      not null,
+    TRIGGER_TYPE        varchar(64)  not null,
+    INCIDENT_NUMBER     integer,
+    FIELD_REPORT_NUMBER integer,
+    VISIT_NUMBER        integer,
+    STATUS              enum('pending', 'delivered', 'dead') not null,
+    ATTEMPTS            integer      not null default 0,
+    NEXT_ATTEMPT        double       not null,
+    CREATED             double       not null,
+    LAST_ATTEMPT        double,
+    LAST_STATUS_CODE    integer,
+    LAST_ERROR          varchar(1024),
+    BODY_DIGEST         char(64),
+
+    foreign key (WEBHOOK) references WEBHOOK(ID),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `WEBHOOK_DELIVERY_STATUS_NEXT_ATTEMPT_index`
+    on WEBHOOK_DELIVERY (STATUS, NEXT_ATTEMPT);
+
+update `SCHEMA_INFO`
+set `VERSION` = 45
+where true;
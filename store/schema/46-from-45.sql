@@ -0,0 +1,37 @@
+/* Add API tokens, for integrations and service accounts.
+
+   An API_TOKEN stands in for a person, under its own NAME, but with only the
+   permissions it was created with, and only on the Events in
+   API_TOKEN__EVENT. Only a hash of each token is stored. A revoked token's row
+   is kept, so that the action log's references to its name still make sense. */
+
+create table API_TOKEN (
+    ID                 integer      not null auto_increment,
+    NAME               varchar(128) not null,
+    TOKEN_HASH         char(64)     not null,
+    EVENT_PERMISSIONS  integer      not null,
+    GLOBAL_PERMISSIONS integer      not null,
+    CREATED            double       not null,
+    CREATED_BY         varchar(128) not null,
+    EXPIRES            double,
+    LAST_USED          double,
+    REVOKED            double,
+
+    unique key (TOKEN_HASH),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create table API_TOKEN__EVENT (
+    API_TOKEN integer not null,
+    `EVENT`   integer not null,
+
+    foreign key (API_TOKEN) references API_TOKEN(ID),
+    foreign key (`EVENT`) references `EVENT`(ID),
+
+    primary key (API_TOKEN, `EVENT`)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+update `SCHEMA_INFO`
+set `VERSION` = 46
+where true;
@@ -0,0 +1,36 @@
+/* Keep refresh tokens as server-side sessions.
+
+   Each login makes a SESSION, which holds a hash of its current refresh
+   token. The token is replaced every time it's used, and the one it replaced
+   is kept in PREVIOUS_TOKEN_HASH, so that a stolen token that's used after the
+   rightful owner's can be spotted. A revoked or expired SESSION's refresh
+   token no longer works. */
+
+create table `SESSION` (
+    ID                  bigint       not null auto_increment,
+    USER_ID             bigint       not null,
+    USER_HANDLE         varchar(128) not null,
+    TOKEN_HASH          char(64)     not null,
+    PREVIOUS_TOKEN_HASH char(64),
+    ROTATED             double,
+    USER_AGENT          varchar(512),
+    CLIENT_ADDRESS      varchar(128),
+    CREATED             double       not null,
+    LAST_USED           double       not null,
+    EXPIRES             double       not null,
+    REVOKED             double,
+
+    unique key (TOKEN_HASH),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `SESSION_PREVIOUS_TOKEN_HASH_index`
+    on `SESSION` (PREVIOUS_TOKEN_HASH);
+
+create index `SESSION_USER_ID_index`
+    on `SESSION` (USER_ID);
+
+update `SCHEMA_INFO`
+set `VERSION` = 47
+where true;
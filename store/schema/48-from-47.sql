@@ -0,0 +1,25 @@
+/* Throttle login attempts.
+
+   LOGIN_THROTTLE counts the recent failed logins for each identification
+   (a handle or email) and each client address. Once a subject has failed a
+   few times, it has to wait longer and longer between attempts. An
+   identification that keeps failing gets locked until LOCKED_UNTIL. This is
+   kept in the database, rather than in memory, so that every IMS server sees
+   the same counts. */
+
+create table LOGIN_THROTTLE (
+    ID            bigint                                not null auto_increment,
+    KIND          enum('identification', 'address')     not null,
+    SUBJECT       varchar(256)                          not null,
+    FAILURES      int                                   not null,
+    LAST_FAILURE  double                                not null,
+    LOCKED_UNTIL  double,
+
+    unique key (KIND, SUBJECT),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+update `SCHEMA_INFO`
+set `VERSION` = 48
+where true;
@@ -0,0 +1,31 @@
+/* Two-factor authentication for the IMS-native directory.
+
+   A DIRECTORY_PERSON may enroll an authenticator app, which gives them
+   time-based one-time passwords (TOTP, RFC 6238) to enter after their
+   password. TOTP_SECRET is the shared secret, encrypted under the
+   deployment's master key, and TOTP_CONFIRMED is whether the person has proven
+   that their app has it. TOTP_LAST_STEP is the period of the last code used,
+   so that no code can be used twice. An admin can set TOTP_REQUIRED, which
+   makes the person enroll the next time they log in.
+
+   DIRECTORY_RECOVERY_CODE holds hashes of the single-use recovery codes that a
+   person can use instead of a TOTP code, should they lose their app. */
+
+alter table DIRECTORY_PERSON
+    add column TOTP_SECRET    varbinary(128),
+    add column TOTP_CONFIRMED boolean not null default false,
+    add column TOTP_LAST_STEP bigint,
+    add column TOTP_REQUIRED  boolean not null default false;
+
+create table DIRECTORY_RECOVERY_CODE (
+    PERSON_ID bigint   not null,
+    CODE_HASH char(64) not null,
+    USED      double,
+
+    primary key (PERSON_ID, CODE_HASH),
+    foreign key (PERSON_ID) references DIRECTORY_PERSON (ID) on delete cascade
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+update `SCHEMA_INFO`
+set `VERSION` = 49
+where true;
@@ -0,0 +1,23 @@
+/* Signing keys for JWTs, so that the key can be rotated without logging
+   everyone out.
+
+   Each JWT_KEY has an ID, which goes in the "kid" header of the JWTs it signs.
+   The newest key that hasn't been RETIRED is the one to sign with. Retired
+   keys are only kept to verify the JWTs they signed, until those expire.
+   SECRET is the HS256 secret or the Ed25519 seed, encrypted under the
+   deployment's master key. Without any keys, JWTs are signed with
+   IMS_JWT_SECRET, as before. */
+
+create table JWT_KEY (
+    ID        varchar(64) not null,
+    ALGORITHM varchar(16) not null,
+    SECRET    varbinary(128) not null,
+    CREATED   double      not null,
+    RETIRED   double,
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+update `SCHEMA_INFO`
+set `VERSION` = 50
+where true;
@@ -0,0 +1,32 @@
+/* Invitation and password reset emails for the IMS-native directory.
+
+   Each email has a link with a token in it, which lets whoever has the email
+   set the person's password, once. DIRECTORY_PASSWORD_TOKEN holds the tokens'
+   hashes, rather than the tokens themselves. A token is only good until it
+   EXPIRES, and until it's USED. Issuing a new token for a person, or using
+   one, marks their other tokens used too.
+
+   DIRECTORY_PERSON.PASSWORD_RESET_SENT is when the person was last sent a
+   password reset, which limits how often they can be sent one. */
+
+alter table DIRECTORY_PERSON
+    add column PASSWORD_RESET_SENT double;
+
+create table DIRECTORY_PASSWORD_TOKEN (
+    ID         bigint                   not null auto_increment,
+    PERSON_ID  bigint                   not null,
+    PURPOSE    enum('invite', 'reset')  not null,
+    TOKEN_HASH char(64)                 not null,
+    CREATED    double                   not null,
+    EXPIRES    double                   not null,
+    USED       double,
+
+    unique key (TOKEN_HASH),
+
+    primary key (ID),
+    foreign key (PERSON_ID) references DIRECTORY_PERSON (ID) on delete cascade
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+update `SCHEMA_INFO`
+set `VERSION` = 51
+where true;
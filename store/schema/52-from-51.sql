@@ -0,0 +1,14 @@
+/* Record which password policy each DIRECTORY_PERSON's password was checked
+   against when it was set.
+
+   PASSWORD_POLICY describes the policy's rules, e.g.
+   "min=12,max=256,identity,breached". It's null for passwords set before IMS
+   had a password policy, so that admins can find the people whose passwords
+   predate the current policy. */
+
+alter table DIRECTORY_PERSON
+    add column PASSWORD_POLICY varchar(128);
+
+update `SCHEMA_INFO`
+set `VERSION` = 52
+where true;
@@ -0,0 +1,30 @@
+/* On-duty tracking for the IMS-native directory.
+
+   ON_DUTY_POSITION_ID is the position that a DIRECTORY_PERSON is on duty in,
+   if any, and ON_DUTY_SINCE is when they signed in to it. DIRECTORY_SHIFT is
+   the history of sign-ins and sign-outs, for reporting. A shift keeps the
+   title its position had at the time, since the position may be renamed or
+   deleted later. OFF_DUTY is null for a shift that's still going. */
+
+alter table DIRECTORY_PERSON
+    add column ON_DUTY_POSITION_ID bigint,
+    add column ON_DUTY_SINCE double,
+    add foreign key (ON_DUTY_POSITION_ID) references DIRECTORY_POSITION (ID) on delete set null;
+
+create table DIRECTORY_SHIFT (
+    ID             bigint       not null auto_increment,
+    PERSON_ID      bigint       not null,
+    POSITION_ID    bigint,
+    POSITION_TITLE varchar(128) not null,
+    ON_DUTY        double       not null,
+    OFF_DUTY       double,
+
+    primary key (ID),
+    key (ON_DUTY),
+    foreign key (PERSON_ID)   references DIRECTORY_PERSON (ID)   on delete cascade,
+    foreign key (POSITION_ID) references DIRECTORY_POSITION (ID) on delete set null
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+update `SCHEMA_INFO`
+set `VERSION` = 53
+where true;
@@ -0,0 +1,31 @@
+/* Keep a history of changes to EVENT_ACCESS.
+
+   PostEventAccess replaces all of an Event's rules for one MODE at a time, so
+   each row here is one such replacement: who made it, when, and the rules for
+   that MODE before and after, as JSON arrays. A MODE's rules at any moment
+   are then the AFTER_RULES of its last change up to then, or the
+   BEFORE_RULES of its first change after, or what's in EVENT_ACCESS now if
+   it's never been changed since this table was added.
+
+   Only the rules are kept, not the people that they matched at the time. */
+
+create table EVENT_ACCESS_HISTORY (
+    ID           integer     not null auto_increment,
+    `EVENT`      integer     not null,
+    MODE         enum ('read', 'write', 'report', 'write_visits') not null,
+    AUTHOR       varchar(64) not null,
+    CREATED      double      not null,
+    BEFORE_RULES json        not null,
+    AFTER_RULES  json        not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `EVENT_ACCESS_HISTORY_EVENT_CREATED_index`
+    on `EVENT_ACCESS_HISTORY` (`EVENT`, CREATED);
+
+update `SCHEMA_INFO`
+set `VERSION` = 54
+where true;
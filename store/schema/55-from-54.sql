@@ -0,0 +1,32 @@
+/* Record break-glass access.
+
+   Someone without read access to an Event may still read one of its
+   Incidents or Visits, by giving a JUSTIFICATION, until EXPIRES. Each row is
+   one such grant to the person with HANDLE, for exactly one of an Incident or
+   a Visit. The rows are kept after they've expired, as the record of who
+   broke the glass, when, and why. */
+
+create table BREAK_GLASS (
+    ID              integer       not null auto_increment,
+    `EVENT`         integer       not null,
+    INCIDENT_NUMBER integer,
+    VISIT_NUMBER    integer,
+    HANDLE          varchar(64)   not null,
+    JUSTIFICATION   varchar(1024) not null,
+    CREATED         double        not null,
+    EXPIRES         double        not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+    foreign key (`EVENT`, INCIDENT_NUMBER) references INCIDENT(`EVENT`, NUMBER),
+    foreign key (`EVENT`, VISIT_NUMBER) references VISIT(`EVENT`, NUMBER),
+    constraint BREAK_GLASS_ONE_RECORD check ((INCIDENT_NUMBER is null) <> (VISIT_NUMBER is null)),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `BREAK_GLASS_EVENT_HANDLE_index`
+    on `BREAK_GLASS` (`EVENT`, HANDLE);
+
+update `SCHEMA_INFO`
+set `VERSION` = 55
+where true;
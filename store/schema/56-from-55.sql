@@ -0,0 +1,19 @@
+/* Confidential Incidents.
+
+   An Incident with CONFIDENTIAL set (say, a sexual assault, or one involving
+   law enforcement) may only be read by those who also match one of its
+   Event's 'read_confidential' EVENT_ACCESS rules. The Field Reports and Visits
+   attached to it are restricted the same way. */
+
+alter table INCIDENT
+    add column CONFIDENTIAL boolean not null default false;
+
+alter table EVENT_ACCESS
+    modify column MODE enum ('read', 'write', 'report', 'write_visits', 'read_confidential') not null;
+
+alter table EVENT_ACCESS_HISTORY
+    modify column MODE enum ('read', 'write', 'report', 'write_visits', 'read_confidential') not null;
+
+update `SCHEMA_INFO`
+set `VERSION` = 56
+where true;
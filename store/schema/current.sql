@@ -6,7 +6,7 @@ create table SCHEMA_INFO (
 -- This value must be updated when you make a new migration file.
 --
 
-insert into SCHEMA_INFO (VERSION) values (40);
+insert into SCHEMA_INFO (VERSION) values (56);
 
 
 create table `EVENT` (
@@ -26,6 +26,10 @@ create table `EVENT` (
     -- Whether to rewrite client-supplied addresses into canonical BRC form.
     NORMALIZE_ADDRESSES boolean not null default false,
 
+    -- The latest change sequence number handed out to a write in this Event.
+    -- See INCIDENT.CHANGE_SEQ.
+    CHANGE_SEQ bigint not null default 0,
+
     primary key (ID),
     unique key (NAME),
     foreign key `PARENT_GROUP_TO_PARENT`(PARENT_GROUP) references `EVENT`(ID)
@@ -89,11 +93,32 @@ create table INCIDENT (
     -- field-report/visit assignment.
     `VERSION` integer not null default 1,
 
+    -- The NUMBER of the Incident in the same Event that this one was merged
+    -- into, if any. A merged Incident is closed, and everything that was
+    -- attached to it now belongs to that other Incident. There's no foreign
+    -- key, so that deleting an Event's Incidents needn't be done in order.
+    MERGED_INTO integer,
+
+    -- The Event's CHANGE_SEQ as of the latest write to this Incident, or to
+    -- anything attached to it. Unlike VERSION, that includes report entries,
+    -- the Ranger roster, incident types, links, and field-report/visit
+    -- assignment. It's stamped last thing before the write commits, and
+    -- backs the change feed.
+    CHANGE_SEQ bigint not null default 0,
+
+    -- A CONFIDENTIAL Incident, and the Field Reports and Visits attached to
+    -- it, may only be read by those with a 'read_confidential' EVENT_ACCESS
+    -- rule for the Event, as well as a 'read' or 'write' rule.
+    CONFIDENTIAL boolean not null default false,
+
     foreign key (`EVENT`) references `EVENT`(ID),
 
     primary key (`EVENT`, NUMBER)
 ) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+create index `INCIDENT_EVENT_CHANGE_SEQ_index`
+    on `INCIDENT` (`EVENT`, CHANGE_SEQ);
+
 
 create table INCIDENT__RANGER (
     ID              integer     not null auto_increment,
@@ -114,6 +139,28 @@ create table INCIDENT__RANGER (
 create index `INCIDENT__RANGER_EVENT_INCIDENT_NUMBER_index`
     on `INCIDENT__RANGER` (`EVENT`, INCIDENT_NUMBER);
 
+
+-- Each change to an Incident's state, with who made it and when. The initial
+-- state of new is implied by INCIDENT.CREATED, and isn't recorded here.
+create table INCIDENT__STATE_CHANGE (
+    ID              integer     not null auto_increment,
+    `EVENT`         integer     not null,
+    INCIDENT_NUMBER integer     not null,
+    STATE enum(
+        'new', 'on_hold', 'dispatched', 'on_scene', 'closed'
+    ) not null,
+    AUTHOR          varchar(64) not null,
+    CREATED         double      not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+    foreign key (`EVENT`, INCIDENT_NUMBER) references INCIDENT(`EVENT`, NUMBER),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `INCIDENT__STATE_CHANGE_EVENT_INCIDENT_NUMBER_index`
+    on `INCIDENT__STATE_CHANGE` (`EVENT`, INCIDENT_NUMBER);
+
 create table INCIDENT__LINKED_INCIDENT (
     EVENT_1             integer not null,
     INCIDENT_NUMBER_1   integer not null,
@@ -157,7 +204,7 @@ create table EVENT_ACCESS (
     `EVENT`    integer      not null,
     EXPRESSION varchar(128) not null,
 
-    MODE     enum ('read', 'write', 'report', 'write_visits') not null,
+    MODE     enum ('read', 'write', 'report', 'write_visits', 'read_confidential') not null,
     VALIDITY enum ('always', 'onsite') not null default 'always',
     -- An optional timestamp at which the access rule expires
     NOT_AFTER  double,
@@ -173,6 +220,25 @@ create table EVENT_ACCESS (
     primary key (ID)
 ) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- Each replacement of an Event's EVENT_ACCESS rules for one MODE, with the
+-- rules from before and after it as JSON arrays.
+create table EVENT_ACCESS_HISTORY (
+    ID           integer     not null auto_increment,
+    `EVENT`      integer     not null,
+    MODE         enum ('read', 'write', 'report', 'write_visits', 'read_confidential') not null,
+    AUTHOR       varchar(64) not null,
+    CREATED      double      not null,
+    BEFORE_RULES json        not null,
+    AFTER_RULES  json        not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `EVENT_ACCESS_HISTORY_EVENT_CREATED_index`
+    on `EVENT_ACCESS_HISTORY` (`EVENT`, CREATED);
+
 
 create table FIELD_REPORT (
     `EVENT` integer  not null,
@@ -185,12 +251,18 @@ create table FIELD_REPORT (
     -- Optimistic-concurrency version counter; see INCIDENT.VERSION.
     `VERSION` integer not null default 1,
 
+    -- See INCIDENT.CHANGE_SEQ.
+    CHANGE_SEQ bigint not null default 0,
+
     foreign key (`EVENT`) references `EVENT`(ID),
     foreign key (`EVENT`, INCIDENT_NUMBER) references INCIDENT(`EVENT`, NUMBER),
 
     primary key (`EVENT`, NUMBER)
 ) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+create index `FIELD_REPORT_EVENT_CHANGE_SEQ_index`
+    on `FIELD_REPORT` (`EVENT`, CHANGE_SEQ);
+
 
 create table FIELD_REPORT__REPORT_ENTRY (
     `EVENT`                integer not null,
@@ -308,12 +380,18 @@ create table VISIT (
     -- Optimistic-concurrency version counter; see INCIDENT.VERSION.
     `VERSION` integer not null default 1,
 
+    -- See INCIDENT.CHANGE_SEQ.
+    CHANGE_SEQ bigint not null default 0,
+
     foreign key `VISIT_TO_EVENT` (`EVENT`) references `EVENT`(ID),
     foreign key `VISIT_TO_INCIDENT` (`EVENT`, INCIDENT_NUMBER) references INCIDENT(`EVENT`, NUMBER),
 
     primary key (`EVENT`, NUMBER)
 ) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+create index `VISIT_EVENT_CHANGE_SEQ_index`
+    on `VISIT` (`EVENT`, CHANGE_SEQ);
+
 create table VISIT__REPORT_ENTRY (
     `EVENT`             integer not null,
     VISIT_NUMBER        integer not null,
@@ -341,6 +419,29 @@ create table VISIT__RANGER (
     primary key (ID)
 ) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- Each grant of break-glass access, to one Incident or Visit for someone who
+-- can't otherwise read it, until EXPIRES. These are kept after they expire.
+create table BREAK_GLASS (
+    ID              integer       not null auto_increment,
+    `EVENT`         integer       not null,
+    INCIDENT_NUMBER integer,
+    VISIT_NUMBER    integer,
+    HANDLE          varchar(64)   not null,
+    JUSTIFICATION   varchar(1024) not null,
+    CREATED         double        not null,
+    EXPIRES         double        not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+    foreign key (`EVENT`, INCIDENT_NUMBER) references INCIDENT(`EVENT`, NUMBER),
+    foreign key (`EVENT`, VISIT_NUMBER) references VISIT(`EVENT`, NUMBER),
+    constraint BREAK_GLASS_ONE_RECORD check ((INCIDENT_NUMBER is null) <> (VISIT_NUMBER is null)),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `BREAK_GLASS_EVENT_HANDLE_index`
+    on `BREAK_GLASS` (`EVENT`, HANDLE);
+
 
 -- These tables are IMS's own user directory, used when IMS_DIRECTORY is set
 -- to "ims" rather than "clubhousedb". They are unused (and empty) on
@@ -355,6 +456,24 @@ create table DIRECTORY_PERSON (
     PASSWORD varchar(256) not null,
     ACTIVE   boolean      not null default true,
     ONSITE   boolean      not null default false,
+    -- The TOTP secret for two-factor authentication, encrypted under the
+    -- master key. It's only in use once TOTP_CONFIRMED.
+    TOTP_SECRET    varbinary(128),
+    TOTP_CONFIRMED boolean not null default false,
+    -- The period of the last TOTP code used, so that none is used twice.
+    TOTP_LAST_STEP bigint,
+    -- Whether this person must enroll in TOTP the next time they log in.
+    TOTP_REQUIRED  boolean not null default false,
+    -- When this person was last sent a password reset email.
+    PASSWORD_RESET_SENT double,
+    -- The password policy that PASSWORD was checked against when it was set,
+    -- or null if it was set before IMS had one.
+    PASSWORD_POLICY varchar(128),
+    -- The position this person is on duty in, and when they signed in to it.
+    -- Both are null when they're off duty. The foreign key on
+    -- ON_DUTY_POSITION_ID is added below, after DIRECTORY_POSITION.
+    ON_DUTY_POSITION_ID bigint,
+    ON_DUTY_SINCE       double,
 
     primary key (ID),
     unique key UNIQUE_HANDLE (HANDLE),
@@ -379,6 +498,9 @@ create table DIRECTORY_POSITION (
     unique key UNIQUE_TITLE (TITLE)
 ) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+alter table DIRECTORY_PERSON
+    add foreign key (ON_DUTY_POSITION_ID) references DIRECTORY_POSITION (ID) on delete set null;
+
 create table DIRECTORY_PERSON__TEAM (
     PERSON_ID bigint not null,
     TEAM_ID   bigint not null,
@@ -396,3 +518,226 @@ create table DIRECTORY_PERSON__POSITION (
     foreign key (PERSON_ID)   references DIRECTORY_PERSON (ID)   on delete cascade,
     foreign key (POSITION_ID) references DIRECTORY_POSITION (ID) on delete cascade
 ) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- DIRECTORY_RECOVERY_CODE is hashes of a person's single-use recovery codes,
+-- any of which they can use in place of a TOTP code.
+create table DIRECTORY_RECOVERY_CODE (
+    PERSON_ID bigint   not null,
+    CODE_HASH char(64) not null,
+    USED      double,
+
+    primary key (PERSON_ID, CODE_HASH),
+    foreign key (PERSON_ID) references DIRECTORY_PERSON (ID) on delete cascade
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- DIRECTORY_PASSWORD_TOKEN is hashes of the single-use tokens in invitation
+-- and password reset emails, which let a person set their own password.
+create table DIRECTORY_PASSWORD_TOKEN (
+    ID         bigint                   not null auto_increment,
+    PERSON_ID  bigint                   not null,
+    PURPOSE    enum('invite', 'reset')  not null,
+    TOKEN_HASH char(64)                 not null,
+    CREATED    double                   not null,
+    EXPIRES    double                   not null,
+    USED       double,
+
+    unique key (TOKEN_HASH),
+
+    primary key (ID),
+    foreign key (PERSON_ID) references DIRECTORY_PERSON (ID) on delete cascade
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- DIRECTORY_SHIFT is the history of people signing in to and out of positions,
+-- for reporting. A shift keeps the title its position had at the time, since
+-- the position may be renamed or deleted later. OFF_DUTY is null for a shift
+-- that's still going.
+create table DIRECTORY_SHIFT (
+    ID             bigint       not null auto_increment,
+    PERSON_ID      bigint       not null,
+    POSITION_ID    bigint,
+    POSITION_TITLE varchar(128) not null,
+    ON_DUTY        double       not null,
+    OFF_DUTY       double,
+
+    primary key (ID),
+    key (ON_DUTY),
+    foreign key (PERSON_ID)   references DIRECTORY_PERSON (ID)   on delete cascade,
+    foreign key (POSITION_ID) references DIRECTORY_POSITION (ID) on delete set null
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+
+-- SSE_SEQUENCE's one row hands out the IDs for SSE_OUTBOX. It's bumped in
+-- the same transaction as each insert into SSE_OUTBOX, so that the IDs commit
+-- in order.
+create table SSE_SEQUENCE (
+    -- Always 1, which keeps the table to its one row, and gives it a
+    -- primary key that bumping ID doesn't move.
+    SINGLETON tinyint not null default 1,
+    ID        bigint  not null,
+
+    primary key (SINGLETON),
+    constraint SSE_SEQUENCE_ONE_ROW check (SINGLETON = 1)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+insert into SSE_SEQUENCE (ID) values (0);
+
+-- SSE_OUTBOX holds recent server-sent events, which every IMS replica polls
+-- for, so that each one's browsers hear about writes made through any of them.
+create table SSE_OUTBOX (
+    ID                  bigint  not null,
+    EVENT               integer not null,
+    INCIDENT_NUMBER     integer,
+    FIELD_REPORT_NUMBER integer,
+    VISIT_NUMBER        integer,
+    CREATED             double  not null,
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+
+-- WEBHOOK is an admin's subscription to some kinds of change to an Event's
+-- records. The kinds are in WEBHOOK__TRIGGER. SECRET is encrypted under the
+-- master key, and a Webhook without one can't be enabled.
+create table WEBHOOK (
+    ID      integer       not null auto_increment,
+    `EVENT` integer       not null,
+    URL     varchar(1024) not null,
+    SECRET  varbinary(256),
+    ENABLED boolean       not null default true,
+    CREATED double        not null,
+
+    foreign key (`EVENT`) references `EVENT`(ID),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create table WEBHOOK__TRIGGER (
+    WEBHOOK      integer not null,
+    TRIGGER_TYPE enum(
+        'incident.created', 'incident.updated', 'incident.state_changed',
+        'field_report.created', 'field_report.updated', 'field_report.attached',
+        'visit.created', 'visit.updated', 'visit.departed'
+    ) not null,
+
+    foreign key (WEBHOOK) references WEBHOOK(ID),
+
+    primary key (WEBHOOK, TRIGGER_TYPE)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- WEBHOOK_DELIVERY is both the queue of webhook requests to be sent, and the
+-- log of how they went. It names the record that changed, by one of the
+-- *_NUMBERs, rather than keeping a copy of it, and the payload is built from
+-- the record for each attempt. BODY_DIGEST is the SHA-256 of the last one sent.
+create table WEBHOOK_DELIVERY (
+    ID                  bigint       not null auto_increment,
+    WEBHOOK             integer      not null,
+    `EVENT`             integer      not null,
+    TRIGGER_TYPE        varchar(64)  not null,
+    INCIDENT_NUMBER     integer,
+    FIELD_REPORT_NUMBER integer,
+    VISIT_NUMBER        integer,
+    STATUS              enum('pending', 'delivered', 'dead') not null,
+    ATTEMPTS            integer      not null default 0,
+    NEXT_ATTEMPT        double       not null,
+    CREATED             double       not null,
+    LAST_ATTEMPT        double,
+    LAST_STATUS_CODE    integer,
+    LAST_ERROR          varchar(1024),
+    BODY_DIGEST         char(64),
+
+    foreign key (WEBHOOK) references WEBHOOK(ID),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `WEBHOOK_DELIVERY_STATUS_NEXT_ATTEMPT_index`
+    on WEBHOOK_DELIVERY (STATUS, NEXT_ATTEMPT);
+
+-- API_TOKEN is a long-lived credential for an integration or service account.
+-- It acts under its own NAME, with only the permissions it was created with,
+-- and only on the Events in API_TOKEN__EVENT. Only a hash of the token is
+-- stored.
+create table API_TOKEN (
+    ID                 integer      not null auto_increment,
+    NAME               varchar(128) not null,
+    TOKEN_HASH         char(64)     not null,
+    EVENT_PERMISSIONS  integer      not null,
+    GLOBAL_PERMISSIONS integer      not null,
+    CREATED            double       not null,
+    CREATED_BY         varchar(128) not null,
+    EXPIRES            double,
+    LAST_USED          double,
+    REVOKED            double,
+
+    unique key (TOKEN_HASH),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create table API_TOKEN__EVENT (
+    API_TOKEN integer not null,
+    `EVENT`   integer not null,
+
+    foreign key (API_TOKEN) references API_TOKEN(ID),
+    foreign key (`EVENT`) references `EVENT`(ID),
+
+    primary key (API_TOKEN, `EVENT`)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- SESSION is one login, and holds a hash of that login's current refresh
+-- token. The token is replaced each time it's used. The one it replaced is
+-- kept in PREVIOUS_TOKEN_HASH, so that reuse of a stolen token can be spotted.
+create table `SESSION` (
+    ID                  bigint       not null auto_increment,
+    USER_ID             bigint       not null,
+    USER_HANDLE         varchar(128) not null,
+    TOKEN_HASH          char(64)     not null,
+    PREVIOUS_TOKEN_HASH char(64),
+    ROTATED             double,
+    USER_AGENT          varchar(512),
+    CLIENT_ADDRESS      varchar(128),
+    CREATED             double       not null,
+    LAST_USED           double       not null,
+    EXPIRES             double       not null,
+    REVOKED             double,
+
+    unique key (TOKEN_HASH),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+create index `SESSION_PREVIOUS_TOKEN_HASH_index`
+    on `SESSION` (PREVIOUS_TOKEN_HASH);
+
+create index `SESSION_USER_ID_index`
+    on `SESSION` (USER_ID);
+
+-- LOGIN_THROTTLE counts recent failed logins for an identification (a handle
+-- or email) or a client address. An identification that keeps failing gets
+-- locked until LOCKED_UNTIL.
+create table LOGIN_THROTTLE (
+    ID            bigint                                not null auto_increment,
+    KIND          enum('identification', 'address')     not null,
+    SUBJECT       varchar(256)                          not null,
+    FAILURES      int                                   not null,
+    LAST_FAILURE  double                                not null,
+    LOCKED_UNTIL  double,
+
+    unique key (KIND, SUBJECT),
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- JWT_KEY holds the keys that IMS signs JWTs with, on top of IMS_JWT_SECRET.
+-- The newest key that hasn't been RETIRED is the one to sign with, and the
+-- others are only kept to verify the JWTs they signed. SECRET is encrypted
+-- under the deployment's master key.
+create table JWT_KEY (
+    ID        varchar(64) not null,
+    ALGORITHM varchar(16) not null,
+    SECRET    varbinary(128) not null,
+    CREATED   double      not null,
+    RETIRED   double,
+
+    primary key (ID)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -33,7 +33,9 @@ import (
 	"github.com/burningmantech/ranger-ims-go/web/template"
 )
 
-func AddToMux(mux *http.ServeMux, cfg *conf.IMSConfig) *http.ServeMux {
+// AddToMux adds the web UI's routes to mux. If endSession isn't nil, the
+// logout page calls it before clearing the refresh cookie.
+func AddToMux(mux *http.ServeMux, cfg *conf.IMSConfig, endSession func(*http.Request)) *http.ServeMux {
 	if mux == nil {
 		mux = http.NewServeMux()
 	}
@@ -171,13 +173,28 @@ func AddToMux(mux *http.ServeMux, cfg *conf.IMSConfig) *http.ServeMux {
 		},
 	)
 
+	// Only the IMS-native directory has passwords that people can reset through
+	// IMS, and only if IMS can email them the link to do it.
+	selfServiceReset := cfg.Directory.Directory.IncludesIMS() && cfg.Mail.Enabled()
 	mux.Handle("GET /ims/auth/login",
-		AdaptTempl(template.Login(deployment, versionName, versionRef), cfg.Core.CacheControlLong),
+		AdaptTempl(
+			template.Login(deployment, versionName, versionRef, cfg.OIDC.Enabled(), selfServiceReset),
+			cfg.Core.CacheControlLong,
+		),
+	)
+	mux.Handle("GET /ims/auth/password",
+		AdaptTempl(
+			template.Password(deployment, versionName, versionRef, cfg.Core.PasswordMinLength),
+			cfg.Core.CacheControlLong,
+		),
 	)
 	mux.Handle("GET /ims/auth/logout",
 		Adapt(
 			func(w http.ResponseWriter, req *http.Request) {
 				slog.Info("Redirecting from logout")
+				if endSession != nil {
+					endSession(req)
+				}
 				http.SetCookie(w, &http.Cookie{
 					Name:     authz.RefreshTokenCookieName,
 					MaxAge:   -1,
@@ -50,6 +50,7 @@ var templEndpoints = []string{
 	"/ims/app/search",
 	"/ims/auth/login",
 	"/ims/auth/logout",
+	"/ims/auth/password",
 }
 
 // TestTemplEndpoints tests that the IMS server can render all the
@@ -59,7 +60,7 @@ func TestTemplEndpoints(t *testing.T) {
 	ctx := t.Context()
 	cfg := conf.DefaultIMS()
 	require.NoError(t, cfg.Validate())
-	s := httptest.NewServer(web.AddToMux(nil, cfg))
+	s := httptest.NewServer(web.AddToMux(nil, cfg, nil))
 	defer s.Close()
 	serverURL, err := url.Parse(s.URL)
 	require.NoError(t, err)
@@ -87,7 +88,7 @@ func TestRedirects(t *testing.T) {
 	ctx := t.Context()
 	cfg := conf.DefaultIMS()
 	require.NoError(t, cfg.Validate())
-	s := httptest.NewServer(web.AddToMux(nil, cfg))
+	s := httptest.NewServer(web.AddToMux(nil, cfg, nil))
 	defer s.Close()
 	serverURL, err := url.Parse(s.URL)
 	require.NoError(t, err)
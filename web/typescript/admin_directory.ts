@@ -27,6 +27,10 @@ interface DirectoryPerson {
     onsite?: boolean|null;
     team_ids?: number[]|null;
     position_ids?: number[]|null;
+    totp_required?: boolean|null;
+    totp_enrolled?: boolean;
+    on_duty_position_id?: number|null;
+    on_duty_since?: string;
 }
 interface DirectoryGroup {
     id?: number;
@@ -38,6 +42,15 @@ interface Directory {
     teams: DirectoryGroup[];
     positions: DirectoryGroup[];
 }
+interface DirectoryShift {
+    id: number;
+    person_id: number;
+    handle: string;
+    position_id: number|null;
+    position_title: string;
+    on_duty: string;
+    off_duty?: string;
+}
 
 declare global {
     interface Window {
@@ -48,7 +61,11 @@ declare global {
         setPersonEmail: (el: HTMLInputElement)=>Promise<void>;
         setPersonActive: (el: HTMLInputElement)=>Promise<void>;
         setPersonOnsite: (el: HTMLInputElement)=>Promise<void>;
+        setPersonTOTPRequired: (el: HTMLInputElement)=>Promise<void>;
+        setPersonOnDuty: (el: HTMLSelectElement)=>Promise<void>;
         setPersonPassword: (el: HTMLElement)=>Promise<void>;
+        invitePerson: (el: HTMLElement)=>Promise<void>;
+        resetPersonTOTP: (el: HTMLElement)=>Promise<void>;
         deletePerson: (el: HTMLElement)=>Promise<void>;
     }
 }
@@ -56,6 +73,8 @@ declare global {
 const el = {
     personsTbody: ims.typedElement("persons_tbody", HTMLElement),
     personRowTemplate: ims.typedElement("person_row_template", HTMLTemplateElement),
+    shiftsTbody: ims.typedElement("shifts_tbody", HTMLElement),
+    shiftRowTemplate: ims.typedElement("shift_row_template", HTMLTemplateElement),
     groupLiTemplate: ims.typedElement("group_li_template", HTMLTemplateElement),
     teamsList: ims.typedElement("teams_list", HTMLElement),
     positionsList: ims.typedElement("positions_list", HTMLElement),
@@ -64,8 +83,11 @@ const el = {
     editPersonEmail: ims.typedElement("edit_person_email", HTMLInputElement),
     editPersonActive: ims.typedElement("edit_person_active", HTMLInputElement),
     editPersonOnsite: ims.typedElement("edit_person_onsite", HTMLInputElement),
+    editPersonTOTPRequired: ims.typedElement("edit_person_totp_required", HTMLInputElement),
+    editPersonTOTPStatus: ims.typedElement("edit_person_totp_status", HTMLElement),
     editPersonTeams: ims.typedElement("edit_person_teams", HTMLElement),
     editPersonPositions: ims.typedElement("edit_person_positions", HTMLElement),
+    editPersonOnDuty: ims.typedElement("edit_person_on_duty", HTMLSelectElement),
     editPersonPassword: ims.typedElement("edit_person_password", HTMLInputElement),
 };
 
@@ -85,7 +107,11 @@ async function initAdminDirectoryPage(): Promise<void> {
     window.setPersonEmail = setPersonEmail;
     window.setPersonActive = setPersonActive;
     window.setPersonOnsite = setPersonOnsite;
+    window.setPersonTOTPRequired = setPersonTOTPRequired;
+    window.setPersonOnDuty = setPersonOnDuty;
     window.setPersonPassword = setPersonPassword;
+    window.invitePerson = invitePerson;
+    window.resetPersonTOTP = resetPersonTOTP;
     window.deletePerson = deletePerson;
 
     await loadAndDrawDirectory();
@@ -94,13 +120,20 @@ async function initAdminDirectoryPage(): Promise<void> {
 }
 
 let directory: Directory|null = null;
+let shifts: DirectoryShift[] = [];
+
+// The shift history goes back this far.
+const shiftHistoryMs = 7 * 24 * 60 * 60 * 1000;
 
 async function loadAndDrawDirectory(): Promise<void> {
-    const {err} = await loadDirectory();
+    const [{err}, {err: shiftsErr}] = await Promise.all([loadDirectory(), loadShifts()]);
     if (err == null) {
         drawPersons();
         drawGroups();
     }
+    if (shiftsErr == null) {
+        drawShifts();
+    }
 }
 
 async function loadDirectory(): Promise<{err: string|null}> {
@@ -120,6 +153,23 @@ async function loadDirectory(): Promise<{err: string|null}> {
     return {err: null};
 }
 
+async function loadShifts(): Promise<{err: string|null}> {
+    const params = new URLSearchParams({minTimeUnixMs: (Date.now() - shiftHistoryMs).toString()});
+    const {json, err} = await ims.fetchNoThrow<DirectoryShift[]>(`${url_directoryShifts}?${params.toString()}`, {
+        headers: {"Cache-Control": "no-cache"},
+    });
+    if (err != null || json == null) {
+        const message = "Failed to load shifts:\n" + err;
+        console.error(message);
+        ims.setErrorMessage(message);
+        return {err: message};
+    }
+    // Most recent first
+    json.sort((a, b) => b.on_duty.localeCompare(a.on_duty));
+    shifts = json;
+    return {err: null};
+}
+
 function groupTitlesByID(groups: DirectoryGroup[]): Map<number, string> {
     const byID = new Map<number, string>();
     for (const group of groups) {
@@ -151,6 +201,8 @@ function drawPersons(): void {
             (person.team_ids??[]).map(id => teamTitles.get(id)??"").join(", ");
         row.getElementsByClassName("person-positions")[0]!.textContent =
             (person.position_ids??[]).map(id => positionTitles.get(id)??"").join(", ");
+        row.getElementsByClassName("person-on-duty")[0]!.textContent =
+            person.on_duty_position_id == null ? "" : positionTitles.get(person.on_duty_position_id)??"";
 
         const showEditModal: HTMLElement = row.querySelector(".show-edit-modal")!;
         showEditModal.addEventListener("click", (_e: MouseEvent): void => {
@@ -161,18 +213,56 @@ function drawPersons(): void {
     }
 }
 
+function drawShifts(): void {
+    el.shiftsTbody.querySelectorAll("tr").forEach(row => {row.remove();});
+
+    for (const shift of shifts) {
+        const rowFrag = el.shiftRowTemplate.content.cloneNode(true) as DocumentFragment;
+        const row = rowFrag.querySelector("tr")!;
+        row.getElementsByClassName("shift-handle")[0]!.textContent = shift.handle;
+        row.getElementsByClassName("shift-position")[0]!.textContent = shift.position_title;
+        row.getElementsByClassName("shift-on-duty")[0]!.textContent =
+            ims.formatDateShort(new Date(shift.on_duty));
+        row.getElementsByClassName("shift-off-duty")[0]!.textContent =
+            shift.off_duty ? ims.formatDateShort(new Date(shift.off_duty)) : "On duty";
+        el.shiftsTbody.append(rowFrag);
+    }
+}
+
 function showPersonModal(person: DirectoryPerson): void {
     el.editPersonModal.dataset["personId"] = person.id?.toString();
     el.editPersonHandle.value = person.handle??"";
     el.editPersonEmail.value = person.email??"";
     el.editPersonActive.checked = person.active??false;
     el.editPersonOnsite.checked = person.onsite??false;
+    el.editPersonTOTPRequired.checked = person.totp_required??false;
+    el.editPersonTOTPStatus.textContent = person.totp_enrolled ? "Enrolled in TOTP." : "Not enrolled in TOTP.";
     el.editPersonPassword.value = "";
     drawMembershipCheckboxes(el.editPersonTeams, directory?.teams??[], person.team_ids??[], "team");
     drawMembershipCheckboxes(el.editPersonPositions, directory?.positions??[], person.position_ids??[], "position");
+    drawOnDutySelect(person);
     ims.bsModal(el.editPersonModal).show();
 }
 
+// drawOnDutySelect offers the active positions that the person holds, which
+// are the only ones they can go on duty in.
+function drawOnDutySelect(person: DirectoryPerson): void {
+    const offDuty = document.createElement("option");
+    offDuty.value = "";
+    offDuty.textContent = "(off duty)";
+    el.editPersonOnDuty.replaceChildren(offDuty);
+    for (const position of directory?.positions??[]) {
+        if (position.id == null || !position.active || !(person.position_ids??[]).includes(position.id)) {
+            continue;
+        }
+        const option = document.createElement("option");
+        option.value = position.id.toString();
+        option.textContent = position.title??"";
+        el.editPersonOnDuty.append(option);
+    }
+    el.editPersonOnDuty.value = person.on_duty_position_id?.toString()??"";
+}
+
 function drawMembershipCheckboxes(
     container: HTMLElement,
     groups: DirectoryGroup[],
@@ -319,6 +409,33 @@ async function setPersonOnsite(sender: HTMLInputElement): Promise<void> {
     await sendPersonFromControl(sender, {id: id, onsite: sender.checked});
 }
 
+async function setPersonTOTPRequired(sender: HTMLInputElement): Promise<void> {
+    const id = modalPersonID();
+    if (id == null) {
+        return;
+    }
+    await sendPersonFromControl(sender, {id: id, totp_required: sender.checked});
+}
+
+async function setPersonOnDuty(sender: HTMLSelectElement): Promise<void> {
+    const id = modalPersonID();
+    if (id == null) {
+        return;
+    }
+    const url = url_directoryPersonOnDuty.replace("<person_id>", id.toString());
+    const positionID = ims.parseInt10(sender.value);
+    const {err} = positionID == null
+        ? await ims.fetchNoThrow(url, {method: "DELETE"})
+        : await ims.fetchNoThrow(url, {body: JSON.stringify({position_id: positionID})});
+    if (err != null) {
+        alertFailure("Failed to change on-duty position", err);
+        ims.controlHasError(sender);
+        return;
+    }
+    ims.controlHasSuccess(sender);
+    await loadAndDrawDirectory();
+}
+
 async function setPersonMemberships(kind: "team"|"position"): Promise<void> {
     const id = modalPersonID();
     if (id == null) {
@@ -362,6 +479,46 @@ async function setPersonPassword(sender: HTMLElement): Promise<void> {
     ims.controlHasSuccess(sender);
 }
 
+async function invitePerson(sender: HTMLElement): Promise<void> {
+    const id = modalPersonID();
+    if (id == null) {
+        return;
+    }
+    const url = url_directoryPersonInvite.replace("<person_id>", id.toString());
+    const {err} = await ims.fetchNoThrow(url, {
+        body: JSON.stringify({}),
+    });
+    if (err != null) {
+        alertFailure("Failed to send invitation", err);
+        ims.controlHasError(sender);
+        return;
+    }
+    ims.controlHasSuccess(sender);
+}
+
+async function resetPersonTOTP(sender: HTMLElement): Promise<void> {
+    const id = modalPersonID();
+    if (id == null) {
+        return;
+    }
+    if (!confirm(
+        "Reset this person's TOTP? They'll be able to log in with just their " +
+        "password, unless TOTP is required, in which case they'll enroll again.",
+    )) {
+        return;
+    }
+    const url = url_directoryPersonTOTP.replace("<person_id>", id.toString());
+    const {err} = await ims.fetchNoThrow(url, {method: "DELETE"});
+    if (err != null) {
+        alertFailure("Failed to reset TOTP", err);
+        ims.controlHasError(sender);
+        return;
+    }
+    el.editPersonTOTPStatus.textContent = "Not enrolled in TOTP.";
+    ims.controlHasSuccess(sender);
+    await loadAndDrawDirectory();
+}
+
 async function deletePerson(_sender: HTMLElement): Promise<void> {
     const id = modalPersonID();
     if (id == null) {
@@ -127,7 +127,7 @@ interface AccessTargets {
     teams?: string[]|null;
 }
 
-const allAccessModes = ["readers", "writers", "reporters", "visit_writers"] as const;
+const allAccessModes = ["readers", "writers", "reporters", "visit_writers", "confidential_readers"] as const;
 type AccessMode = typeof allAccessModes[number];
 type EventAccess = Partial<Record<AccessMode, Access[]>>;
 // key is event name
@@ -784,6 +784,8 @@ function displayMode(m: AccessMode): string {
             return "Report own";
         case "visit_writers":
             return "Write visits";
+        case "confidential_readers":
+            return "Read confidential";
         default:
             throw new Error(`unexpected access mode ${m satisfies never}`);
     }
@@ -865,6 +867,12 @@ function confirmExpression(expression: string): boolean {
         );
     }
 
+    // A compound expression, such as "team:Council EXCEPT person:Hubcap", is
+    // checked by the server, which flags any target in it that's unknown.
+    if (/[()"]|(^|\s)(AND|OR|NOT|EXCEPT)(\s|$)/.test(expression)) {
+        return true;
+    }
+
     const validPrefix = expression === "*" ||
         expression.startsWith("person:") || expression.startsWith("position:") ||
         expression.startsWith("team:") || expression.startsWith("onduty:");
@@ -874,7 +882,8 @@ function confirmExpression(expression: string): boolean {
             "expression. Example expressions include 'person:Hubcap' for an individual, " +
             "'position:007' for a role, 'onduty:007' for people currently on duty for a position, " +
             "and 'team:Council' for a team. Wildcards are " +
-            "supported as well, e.g. '*'\n\n" +
+            "supported as well, e.g. '*', and these can be combined with AND, OR, NOT, " +
+            "EXCEPT, and parentheses.\n\n" +
             "Proceed with firing footgun?"
         );
     }
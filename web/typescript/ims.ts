@@ -1707,57 +1707,138 @@ export function requestEventSourceLock(): void  {
     return;
 }
 
-// This starts the EventSource call and configures event listeners to propagate
-// updates to BroadcastChannels. The idea is that only one browsing context should
-// have an EventSource connection at any given time.
+// This opens the SSE stream and propagates the updates it receives to
+// BroadcastChannels. The idea is that only one browsing context should have an
+// SSE connection at any given time.
 //
-// The "closed" param is a callback to notify the caller that the EventSource has
-// been closed.
+// The "closed" param is a callback to notify the caller that the stream has
+// been closed. The server ends the stream when the access token it was opened
+// with expires, and the caller then reconnects, picking up a fresh token.
 function subscribeToUpdates(closed: (_value?: undefined)=>void): void {
-    const eventSource = new EventSource(
-        url_eventSource, { withCredentials: true }
-    );
-
-    eventSource.addEventListener("open", function(): void {
-        console.log("Event listener opened");
+    streamUpdates().catch((err: unknown): void => {
+        console.log(`Event listener error: ${err}`);
+    }).finally((): void => {
+        console.log("Event listener closed");
+        closed();
     });
+}
 
-    eventSource.addEventListener("error", function(): void {
-        if (eventSource.readyState === EventSource.CLOSED) {
-            console.log("Event listener closed");
-            eventSource.close();
-            closed();
-        } else {
-            // EventSource automatically reconnects in this case.
-            console.log("Event listener error");
-        }
+async function streamUpdates(): Promise<void> {
+    // The browser's EventSource can't send an Authorization header, so this
+    // reads the stream through fetch instead.
+    await maybeRefreshAuth();
+    const tok = getAccessToken();
+    if (!tok) {
+        console.log("Not listening for updates, as there's no access token");
+        return;
+    }
+    const response = await fetch(url_eventSource, {
+        headers: {
+            "Accept": "text/event-stream",
+            "Authorization": "Bearer " + tok,
+        },
+        cache: "no-store",
     });
+    if (!response.ok || response.body == null) {
+        console.log(`Event listener failed to connect: ${response.statusText} (${response.status})`);
+        return;
+    }
+    console.log("Event listener opened");
+    await readEventStream(response.body, dispatchUpdate);
+}
 
-    eventSource.addEventListener("InitialEvent", function(e: MessageEvent<string>) {
-        const previousId = localStorage.getItem(lastSseIDKey);
-        console.log(`Got InitialEvent. Its lastEventId is ${e.lastEventId} and previousId is ${previousId}`);
-        if (e.lastEventId === previousId) {
+function dispatchUpdate(frame: EventStreamFrame): void {
+    switch (frame.event) {
+        case "InitialEvent": {
+            const previousId = localStorage.getItem(lastSseIDKey);
+            console.log(`Got InitialEvent. Its lastEventId is ${frame.id} and previousId is ${previousId}`);
+            if (frame.id === previousId) {
+                return;
+            }
+            localStorage.setItem(lastSseIDKey, frame.id);
+            newIncidentChannel().postMessage({update_all: true});
+            newFieldReportChannel().postMessage({update_all: true});
             return;
         }
-        localStorage.setItem(lastSseIDKey, e.lastEventId);
-        newIncidentChannel().postMessage({update_all: true});
-        newFieldReportChannel().postMessage({update_all: true});
-    });
-
-    eventSource.addEventListener("Incident", function(e: MessageEvent<string>) {
-        localStorage.setItem(lastSseIDKey, e.lastEventId);
-        newIncidentChannel().postMessage(JSON.parse(e.data) as IncidentBroadcast);
-    });
+        case "Incident":
+            localStorage.setItem(lastSseIDKey, frame.id);
+            newIncidentChannel().postMessage(JSON.parse(frame.data) as IncidentBroadcast);
+            return;
+        case "FieldReport":
+            localStorage.setItem(lastSseIDKey, frame.id);
+            newFieldReportChannel().postMessage(JSON.parse(frame.data) as FieldReportBroadcast);
+            return;
+        case "Visit":
+            localStorage.setItem(lastSseIDKey, frame.id);
+            newVisitChannel().postMessage(JSON.parse(frame.data) as VisitBroadcast);
+            return;
+    }
+}
 
-    eventSource.addEventListener("FieldReport", function(e: MessageEvent<string>) {
-        localStorage.setItem(lastSseIDKey, e.lastEventId);
-        newFieldReportChannel().postMessage(JSON.parse(e.data) as FieldReportBroadcast);
-    });
+// One event from a text/event-stream body.
+export type EventStreamFrame = {
+    event: string;
+    data: string;
+    // The last event ID seen on the stream, which, as with EventSource, carries
+    // over to later events that don't set their own.
+    id: string;
+};
 
-    eventSource.addEventListener("Visit", function(e: MessageEvent<string>) {
-        localStorage.setItem(lastSseIDKey, e.lastEventId);
-        newVisitChannel().postMessage(JSON.parse(e.data) as VisitBroadcast);
-    });
+// readEventStream parses a text/event-stream body, calling onFrame for each
+// event in it, and resolves once the body ends. It covers the parts of the
+// format that IMS uses: "event", "data", and "id" fields, and comment lines.
+export async function readEventStream(
+    body: ReadableStream<Uint8Array>,
+    onFrame: (frame: EventStreamFrame)=>void,
+): Promise<void> {
+    const reader = body.pipeThrough(new TextDecoderStream()).getReader();
+    let buffered = "";
+    let lastId = "";
+    let event = "";
+    let data: string[] = [];
+    while (true) {
+        const {value, done} = await reader.read();
+        if (done) {
+            return;
+        }
+        buffered += value;
+        const lines = buffered.split("\n");
+        // The last piece is an incomplete line, unless it's empty.
+        buffered = lines.pop()!;
+        for (let line of lines) {
+            if (line.endsWith("\r")) {
+                line = line.substring(0, line.length - 1);
+            }
+            if (line === "") {
+                if (data.length > 0) {
+                    onFrame({event: event || "message", data: data.join("\n"), id: lastId});
+                }
+                event = "";
+                data = [];
+                continue;
+            }
+            if (line.startsWith(":")) {
+                continue;
+            }
+            const colon = line.indexOf(":");
+            const field = colon < 0 ? line : line.substring(0, colon);
+            let fieldValue = colon < 0 ? "" : line.substring(colon + 1);
+            if (fieldValue.startsWith(" ")) {
+                fieldValue = fieldValue.substring(1);
+            }
+            switch (field) {
+                case "event":
+                    event = fieldValue;
+                    break;
+                case "data":
+                    data.push(fieldValue);
+                    break;
+                case "id":
+                    lastId = fieldValue;
+                    break;
+            }
+        }
+    }
 }
 
 // Set the user-visible error information on the page to the provided string.
@@ -2210,6 +2291,7 @@ export type LinkedIncident = {
     event_id?: number|null;
     number?: number|null;
     summary?: string|null;
+    confidential?: boolean|null;
 }
 
 export type IncidentRanger = {
@@ -2241,6 +2323,15 @@ export type Incident = {
     field_reports?: number[]|null;
     visits?: number[]|null;
     linked_incidents?: LinkedIncident[]|null;
+    merged_into?: number|null;
+    state_changes?: IncidentStateChange[]|null;
+    confidential?: boolean|null;
+}
+
+export type IncidentStateChange = {
+    state?: IncidentState|null;
+    author?: string|null;
+    created?: string|null;
 }
 
 export type FieldReport = {
@@ -2470,6 +2561,7 @@ export type AuthInfoEventAccess = {
     readVisits: boolean,
     writeVisits: boolean,
     attachFiles: boolean,
+    readConfidential: boolean,
 }
 
 export type Personnel = {
@@ -2492,6 +2584,8 @@ export type IncidentBroadcast = {
     // fields from SSE
     event_id?: number|null;
     incident_number?: number|null;
+    // the updated Incident, as its GET endpoint returns it, if the server could load it
+    incident?: Incident|null;
     // additional fields for use in BroadcastChannel
     update_all?: boolean;
 }
@@ -2500,6 +2594,8 @@ export type FieldReportBroadcast = {
     // fields from SSE
     event_id?: number|null;
     field_report_number?: number|null;
+    // the updated Field Report, as its GET endpoint returns it, if the server could load it
+    field_report?: FieldReport|null;
     // additional fields for use in BroadcastChannel
     update_all?: boolean
 }
@@ -2508,6 +2604,8 @@ export type VisitBroadcast = {
     // fields from SSE
     event_id?: number|null;
     visit_number?: number|null;
+    // the updated Visit, as its GET endpoint returns it, if the server could load it
+    visit?: Visit|null;
     // additional fields for use in BroadcastChannel
     update_all?: boolean
 }
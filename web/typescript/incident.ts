@@ -22,6 +22,7 @@ import {fetchPersonnel} from "./ims.ts";
 declare global {
     interface Window {
         editState: ()=>Promise<void>;
+        editConfidential: ()=>Promise<void>;
         editIncidentSummary: ()=>Promise<void>;
         editLocationName: ()=>Promise<void>;
         editLocationAddress: ()=>Promise<void>;
@@ -65,6 +66,7 @@ const el = {
     incidentState: ims.typedElement("incident_state", HTMLSelectElement),
     startedDatetime: ims.typedElement("started_datetime", HTMLInputElement) as ims.FlatpickrHTMLInputElement,
     startedDatetimeTz: ims.typedElement("started_datetime_tz", HTMLSpanElement),
+    incidentConfidential: ims.typedElement("incident_confidential", HTMLInputElement),
 
     locationName: ims.typedElement("incident_location_name", HTMLInputElement),
     locationAddress: ims.typedElement("incident_location_address", HTMLInputElement),
@@ -120,6 +122,7 @@ async function initIncidentPage(): Promise<void> {
     }
 
     window.editState = editState;
+    window.editConfidential = editConfidential;
     window.editIncidentSummary = editIncidentSummary;
     window.editLocationName = editLocationName;
     window.editLocationAddress = editLocationAddress;
@@ -586,6 +589,7 @@ function drawIncidentFields() {
     drawIncidentNumber();
     drawState();
     drawStarted();
+    drawConfidential();
     drawPriority();
     drawIncidentSummary();
     drawRangers();
@@ -672,6 +676,16 @@ function drawStarted(): void {
         `All date and time fields in IMS use your computer's time zone, not necessarily Gerlach time.`;
 }
 
+//
+// Populate confidential checkbox
+//
+
+function drawConfidential(): void {
+    el.incidentConfidential.checked = incident!.confidential??false;
+    // Only those who may read confidential Incidents may mark one as such.
+    el.incidentConfidential.disabled = !ims.eventAccess?.readConfidential;
+}
+
 //
 // Populate incident priority
 //
@@ -1195,6 +1209,17 @@ async function editState(): Promise<void> {
     await ims.editFromElement(el.incidentState, "state");
 }
 
+async function editConfidential(): Promise<void> {
+    const confidential = el.incidentConfidential.checked;
+    if (!confidential && !confirm(
+        "Make this Incident visible to everyone who may read Incidents in this Event?",
+    )) {
+        el.incidentConfidential.checked = true;
+        return;
+    }
+    await sendEdits({confidential: confidential});
+}
+
 async function setStartDatetime(selectedDates: Date[], _dateStr: string, sender: ims.Flatpickr): Promise<void> {
     const prevDate = new Date(incident?.started??0);
     const newDate = selectedDates[0];
@@ -289,15 +289,21 @@ async function initIncidentsTable(): Promise<void> {
                 return;
             }
 
-            const {json, err} = await ims.fetchNoThrow(
-                ims.urlReplace(url_incidentNumber).replace("<incident_number>", number.toString()),
-                null,
-            );
-            if (err != null) {
-                const message = `Failed to update Incident ${number}: ${err}`;
-                console.error(message);
-                ims.setErrorMessage(message);
-                return;
+            // The update usually carries the Incident itself. Only fetch it if
+            // the server couldn't include it.
+            let json: ims.Incident|null = e.data.incident ?? null;
+            if (json == null) {
+                const res = await ims.fetchNoThrow<ims.Incident>(
+                    ims.urlReplace(url_incidentNumber).replace("<incident_number>", number.toString()),
+                    null,
+                );
+                if (res.err != null) {
+                    const message = `Failed to update Incident ${number}: ${res.err}`;
+                    console.error(message);
+                    ims.setErrorMessage(message);
+                    return;
+                }
+                json = res.json;
             }
             // Now update/create the relevant row. This is a change from pre-2025, in that
             // we no longer reload all incidents here on any single incident update.
@@ -34,8 +34,23 @@ const el = {
     usernameInput: ims.typedElement("username_input", HTMLInputElement),
     passwordInput: ims.typedElement("password_input", HTMLInputElement),
     passwordShowHide: ims.typedElement("password_show_hide", HTMLButtonElement),
+    totpSecret: ims.typedElement("totp_secret", HTMLElement),
+    totpURI: ims.typedElement("totp_uri", HTMLAnchorElement),
+    secondFactorInput: ims.typedElement("second_factor_input", HTMLInputElement),
+    recoveryCodesList: ims.typedElement("recovery_codes_list", HTMLUListElement),
+    oidcFailedMessage: ims.typedElement("oidc_failed_message", HTMLElement),
+    // This is only on the page when OIDC login is set up.
+    oidcLogin: document.getElementById("oidc_login") as HTMLAnchorElement|null,
 };
 
+// secondFactorToken is set once the password has been accepted, but a second
+// factor is still needed.
+let secondFactorToken: string|null = null;
+
+// completedLogin is set while the recovery codes from a TOTP enrollment are
+// shown, so that they can be written down before moving on.
+let completedLogin: AuthResponse|null = null;
+
 initLoginPage();
 
 async function initLoginPage(): Promise<void> {
@@ -52,9 +67,39 @@ async function initLoginPage(): Promise<void> {
 
     await ims.commonPageInit();
 
+    const params = new URLSearchParams(window.location.search);
+    if (el.oidcLogin != null) {
+        const redirect = params.get("o");
+        if (redirect != null) {
+            el.oidcLogin.href = url_authOIDCLogin + "?" + new URLSearchParams({"o": redirect}).toString();
+        }
+    }
+    const oidcFailed = params.get("oidc_failed");
+    if (oidcFailed != null) {
+        el.oidcFailedMessage.textContent = oidcFailed;
+        ims.unhide(".if-oidc-failed");
+    }
+    if (params.get("oidc") === "1") {
+        await finishOIDCLogin();
+        return;
+    }
+
     el.usernameInput.focus();
 }
 
+// finishOIDCLogin picks up after the OIDC callback, which has left a refresh
+// cookie for us to swap for an access token.
+async function finishOIDCLogin(): Promise<void> {
+    const {json, err} = await ims.fetchNoThrow<AuthResponse>(url_authRefresh, {
+        body: JSON.stringify({}),
+    });
+    if (err != null || json == null) {
+        ims.unhide(".if-authentication-failed");
+        return;
+    }
+    finishLogin(json);
+}
+
 function toggleShowPassword(): void {
     if (el.passwordShowHide.textContent === "Show") {
         el.passwordShowHide.textContent = "Hide";
@@ -66,6 +111,14 @@ function toggleShowPassword(): void {
 }
 
 async function login(): Promise<void> {
+    if (completedLogin != null) {
+        finishLogin(completedLogin);
+        return;
+    }
+    if (secondFactorToken != null) {
+        await submitSecondFactor(secondFactorToken);
+        return;
+    }
     const username = el.usernameInput.value;
     const password = el.passwordInput.value;
     const {json, err} = await ims.fetchNoThrow<AuthResponse>(url_auth, {
@@ -78,6 +131,59 @@ async function login(): Promise<void> {
         ims.unhide(".if-authentication-failed");
         return;
     }
+    ims.hide(".if-authentication-failed");
+    if (json.second_factor != null) {
+        showSecondFactor(json);
+        return;
+    }
+    finishLogin(json);
+}
+
+function showSecondFactor(json: AuthResponse): void {
+    secondFactorToken = json.second_factor_token ?? null;
+    if (json.totp_enrollment != null) {
+        el.totpSecret.textContent = json.totp_enrollment.secret;
+        el.totpURI.href = json.totp_enrollment.uri;
+        ims.unhide("#totp_enrollment");
+    }
+    ims.hide("#password_step");
+    ims.unhide("#second_factor_step");
+    el.secondFactorInput.focus();
+}
+
+async function submitSecondFactor(token: string): Promise<void> {
+    const value = el.secondFactorInput.value.trim();
+    // Authentication codes are all digits, and recovery codes never are.
+    const isCode = /^\d+$/.test(value);
+    const {json, err} = await ims.fetchNoThrow<AuthResponse>(url_authSecondFactor, {
+        body: JSON.stringify({
+            "second_factor_token": token,
+            "code": isCode ? value : undefined,
+            "recovery_code": isCode ? undefined : value,
+        }),
+    });
+    if (err != null || json == null) {
+        el.secondFactorInput.value = "";
+        ims.unhide(".if-authentication-failed");
+        return;
+    }
+    ims.hide(".if-authentication-failed");
+    secondFactorToken = null;
+    if (json.recovery_codes != null && json.recovery_codes.length > 0) {
+        completedLogin = json;
+        el.recoveryCodesList.replaceChildren(...json.recovery_codes.map((code: string): HTMLLIElement => {
+            const li = document.createElement("li");
+            li.textContent = code;
+            return li;
+        }));
+        ims.hide("#second_factor_step");
+        ims.unhide("#recovery_codes_step");
+        return;
+    }
+    finishLogin(json);
+}
+
+function finishLogin(json: AuthResponse): void {
     ims.clearLocalStorage();
     ims.clearSessionStorage();
     ims.setAccessToken(json.token);
@@ -102,4 +208,11 @@ async function login(): Promise<void> {
 type AuthResponse = {
     token: string;
     expires_unix_ms: number;
+    second_factor?: string;
+    second_factor_token?: string;
+    totp_enrollment?: {
+        secret: string;
+        uri: string;
+    };
+    recovery_codes?: string[];
 }
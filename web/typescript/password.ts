@@ -0,0 +1,119 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+"use strict";
+
+import * as ims from "./ims.ts";
+
+//
+// Initialize UI
+//
+
+const el = {
+    resetForm: ims.typedElement("reset_form", HTMLFormElement),
+    identificationInput: ims.typedElement("identification_input", HTMLInputElement),
+    setPasswordForm: ims.typedElement("set_password_form", HTMLFormElement),
+    newPasswordInput: ims.typedElement("new_password_input", HTMLInputElement),
+    confirmPasswordInput: ims.typedElement("confirm_password_input", HTMLInputElement),
+    passwordMinLength: ims.typedElement("password_min_length", HTMLElement),
+    setPasswordFailedMessage: ims.typedElement("set_password_failed_message", HTMLElement),
+};
+
+// token is from the invitation or password reset email's link, which puts it
+// in the URL's fragment, so that it's never sent to the server in a GET.
+const token: string|null = new URLSearchParams(window.location.hash.slice(1)).get("token");
+
+initPasswordPage();
+
+async function initPasswordPage(): Promise<void> {
+    // Attach these before awaiting anything, as on the login page, so that a
+    // submit can't fall through to a native POST.
+    el.resetForm.addEventListener("submit", (e: SubmitEvent): void => {
+        e.preventDefault();
+        requestReset();
+    });
+    el.setPasswordForm.addEventListener("submit", (e: SubmitEvent): void => {
+        e.preventDefault();
+        setPassword();
+    });
+
+    await ims.commonPageInit();
+
+    if (token != null) {
+        ims.unhide("#set_password_form");
+        el.newPasswordInput.focus();
+    } else {
+        ims.unhide("#reset_form");
+        el.identificationInput.focus();
+    }
+}
+
+async function requestReset(): Promise<void> {
+    const identification = el.identificationInput.value.trim();
+    if (!identification) {
+        return;
+    }
+    ims.hide(".if-reset-sent");
+    ims.hide(".if-reset-failed");
+    const {err} = await ims.fetchNoThrow(url_authPasswordReset, {
+        body: JSON.stringify({"identification": identification}),
+    });
+    if (err != null) {
+        ims.unhide(".if-reset-failed");
+        return;
+    }
+    ims.unhide(".if-reset-sent");
+}
+
+function setPasswordFailed(message: string): void {
+    el.setPasswordFailedMessage.textContent = message;
+    ims.unhide(".if-set-password-failed");
+}
+
+async function setPassword(): Promise<void> {
+    if (token == null) {
+        return;
+    }
+    ims.hide(".if-set-password-failed");
+    const password = el.newPasswordInput.value;
+    const minLength = Number(el.passwordMinLength.dataset["minLength"]);
+    // The server checks these too, but there's no need to bother it.
+    if ([...password].length < minLength) {
+        setPasswordFailed(`Your password must be at least ${minLength} characters long.`);
+        return;
+    }
+    if (password !== el.confirmPasswordInput.value) {
+        setPasswordFailed("Those passwords don't match.");
+        return;
+    }
+    const {err} = await ims.fetchNoThrow(url_authPassword, {
+        body: JSON.stringify({
+            "token": token,
+            "password": password,
+        }),
+    });
+    if (err != null) {
+        setPasswordFailed(err);
+        return;
+    }
+    // The token has been used up, so it's no good to keep it around.
+    history.replaceState(null, "", window.location.pathname);
+    el.newPasswordInput.value = "";
+    el.confirmPasswordInput.value = "";
+    el.newPasswordInput.disabled = true;
+    el.confirmPasswordInput.disabled = true;
+    ims.unhide(".if-password-set");
+}
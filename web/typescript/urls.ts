@@ -28,6 +28,10 @@ const url_actionlogs = "/ims/api/actionlogs";
 const url_errorlogs = "/ims/api/errorlogs";
 const url_auth = "/ims/api/auth";
 const url_authRefresh = "/ims/api/auth/refresh";
+const url_authSecondFactor = "/ims/api/auth/second_factor";
+const url_authOIDCLogin = "/ims/api/auth/oidc/login";
+const url_authPasswordReset = "/ims/api/auth/password_reset";
+const url_authPassword = "/ims/api/auth/password";
 const url_acl = "/ims/api/access";
 const url_accessTargets = "/ims/api/access_targets";
 const url_personnel = "/ims/api/personnel";
@@ -35,6 +39,10 @@ const url_directory = "/ims/api/directory";
 const url_directoryPersons = "/ims/api/directory/persons";
 const url_directoryPerson = "/ims/api/directory/persons/<person_id>";
 const url_directoryPersonPassword = "/ims/api/directory/persons/<person_id>/password";
+const url_directoryPersonTOTP = "/ims/api/directory/persons/<person_id>/totp";
+const url_directoryPersonInvite = "/ims/api/directory/persons/<person_id>/invite";
+const url_directoryPersonOnDuty = "/ims/api/directory/persons/<person_id>/on_duty";
+const url_directoryShifts = "/ims/api/directory/shifts";
 const url_directoryTeams = "/ims/api/directory/teams";
 const url_directoryTeam = "/ims/api/directory/teams/<team_id>";
 const url_directoryPositions = "/ims/api/directory/positions";
@@ -76,6 +84,8 @@ const url_authApp = "/ims/auth";
 const url_login = "/ims/auth/login";
 const url_loginJS = "/ims/static/login.js";
 const url_logout = "/ims/auth/logout";
+const url_password = "/ims/auth/password";
+const url_passwordJS = "/ims/static/password.js";
 const url_app = "/ims/app/";
 const url_rootJS = "/ims/static/root.js";
 const url_imsJS = "/ims/static/ims.js";
@@ -28,6 +28,7 @@ interface ServerPerson {
     onsite?: boolean | null;
     team_ids?: number[] | null;
     position_ids?: number[] | null;
+    on_duty_position_id?: number | null;
 }
 interface ServerGroup {
     id?: number;
@@ -40,7 +41,18 @@ interface ServerDirectory {
     positions: ServerGroup[];
 }
 
+interface ServerShift {
+    id: number;
+    person_id: number;
+    handle: string;
+    position_id: number | null;
+    position_title: string;
+    on_duty: string;
+    off_duty?: string;
+}
+
 let serverDirectory: ServerDirectory;
+let serverShifts: ServerShift[];
 
 beforeEach((): void => {
     vi.resetModules();
@@ -59,6 +71,12 @@ beforeEach((): void => {
         teams: [{ id: 10, title: "Green Dot", active: true }],
         positions: [{ id: 20, title: "Khaki", active: false }],
     };
+    serverShifts = [
+        {
+            id: 1, person_id: 1, handle: "Defect", position_id: 20, position_title: "Khaki",
+            on_duty: "2026-08-25T18:00:00Z", off_duty: "2026-08-26T02:00:00Z",
+        },
+    ];
 });
 
 // A fake server that applies edits to serverDirectory, so a redraw after a
@@ -131,6 +149,20 @@ function directoryRoutes(url: string, init?: RequestInit): Response | undefined
     if (/\/password$/.test(url) && init?.body != null) {
         return new Response(null, { status: 204 });
     }
+    if (url.startsWith(`${url_directoryShifts}?`) && init?.body == null) {
+        return jsonResponse(serverShifts);
+    }
+    const onDuty = new RegExp(`^${url_directoryPersonOnDuty.replace("<person_id>", "(\\d+)")}$`).exec(url);
+    if (onDuty != null) {
+        const person = serverDirectory.persons.find((p): boolean => p.id === Number(onDuty[1]));
+        if (person == null) {
+            return problemResponse("No such person", 404);
+        }
+        person.on_duty_position_id = init?.method === "DELETE"
+            ? null
+            : (JSON.parse(init!.body as string) as { position_id: number }).position_id;
+        return new Response(null, { status: 204 });
+    }
     return undefined;
 }
 
@@ -480,6 +512,7 @@ test("modal handlers send nothing before a person has been loaded", async (): Pr
     await window.setPersonEmail(modalInput("edit_person_email"));
     await window.setPersonActive(modalInput("edit_person_active"));
     await window.setPersonOnsite(modalInput("edit_person_onsite"));
+    await window.setPersonOnDuty(document.getElementById("edit_person_on_duty") as HTMLSelectElement);
     await window.setPersonPassword(document.getElementById("edit_person_password_save")!);
     await window.deletePerson(document.getElementById("edit_person_delete")!);
 
@@ -624,3 +657,68 @@ test("a failed person edit reports the failure and marks the control invalid", a
     expect(handleField.classList.contains("is-invalid")).toBe(true);
     expect(personRows()[0]!.querySelector(".person-handle")!.textContent).toBe("Defect");
 });
+
+test("on-duty positions and recent shifts are rendered", async (): Promise<void> => {
+    serverDirectory.persons[0]!.on_duty_position_id = 20;
+    serverShifts.unshift({
+        id: 2, person_id: 1, handle: "Defect", position_id: 20, position_title: "Khaki",
+        on_duty: "2026-08-27T18:00:00Z",
+    });
+    const mock = await initAdminDirectoryPage();
+
+    expect(personRows()[0]!.querySelector(".person-on-duty")!.textContent).toBe("Khaki");
+    expect(personRows()[1]!.querySelector(".person-on-duty")!.textContent).toBe("");
+
+    const shiftsCall = mock.mock.calls.find(([url]) => url.startsWith(`${url_directoryShifts}?`))!;
+    expect(new URL(shiftsCall[0], "http://localhost").searchParams.get("minTimeUnixMs")).not.toBeNull();
+    await vi.waitFor((): void => {
+        expect(document.querySelectorAll("#shifts_tbody tr").length).toBe(2);
+    });
+    const shiftRows = [...document.querySelectorAll<HTMLTableRowElement>("#shifts_tbody tr")];
+    // Most recent first, and the one that's still going has no end.
+    expect(shiftRows[0]!.querySelector(".shift-off-duty")!.textContent).toBe("On duty");
+    expect(shiftRows[1]!.querySelector(".shift-handle")!.textContent).toBe("Defect");
+    expect(shiftRows[1]!.querySelector(".shift-position")!.textContent).toBe("Khaki");
+});
+
+test("the on-duty select offers only the person's active positions", async (): Promise<void> => {
+    serverDirectory.positions.push({ id: 21, title: "Dirt", active: true });
+    serverDirectory.positions.push({ id: 22, title: "Echelon", active: true });
+    serverDirectory.persons[0]!.position_ids = [20, 21];
+    await initAdminDirectoryPage();
+    openPersonModal(0);
+
+    const select = document.getElementById("edit_person_on_duty") as HTMLSelectElement;
+    expect(select.getAttribute("onchange")).toBe("setPersonOnDuty(this);");
+    expect([...select.options].map((o) => o.textContent)).toEqual(["(off duty)", "Dirt"]);
+    expect(select.value).toBe("");
+});
+
+test("signing a person in and out posts and deletes their on-duty position", async (): Promise<void> => {
+    serverDirectory.positions[0]!.active = true;
+    const mock = await initAdminDirectoryPage();
+    openPersonModal(0);
+    const select = document.getElementById("edit_person_on_duty") as HTMLSelectElement;
+
+    mock.mockClear();
+    select.value = "20";
+    await window.setPersonOnDuty(select);
+
+    const signOn = mock.mock.calls.find(
+        ([url, init]) => url === "/ims/api/directory/persons/1/on_duty" && init?.body != null)!;
+    expect(JSON.parse(signOn[1]!.body as string)).toEqual({ position_id: 20 });
+    await vi.waitFor((): void => {
+        expect(personRows()[0]!.querySelector(".person-on-duty")!.textContent).toBe("Khaki");
+    });
+
+    mock.mockClear();
+    select.value = "";
+    await window.setPersonOnDuty(select);
+
+    expect(mock.mock.calls.some(
+        ([url, init]) => url === "/ims/api/directory/persons/1/on_duty" && init?.method === "DELETE",
+    )).toBe(true);
+    await vi.waitFor((): void => {
+        expect(personRows()[0]!.querySelector(".person-on-duty")!.textContent).toBe("");
+    });
+});
@@ -50,6 +50,7 @@ beforeEach((): void => {
         writeFieldReports: true,
         readVisits: true,
         writeVisits: true,
+        readConfidential: true,
         attachFiles: true,
     };
     serverFieldReport = {
@@ -52,6 +52,7 @@ beforeEach((): void => {
         writeFieldReports: true,
         readVisits: true,
         writeVisits: true,
+        readConfidential: true,
         attachFiles: true,
     };
     serverFieldReports = [
@@ -277,32 +277,6 @@ export class MockFlatpickr {
     }
 }
 
-// A minimal stand-in for EventSource, which happy-dom doesn't implement.
-// setup.ts installs this as the EventSource global; tests can inspect
-// MockEventSource.instances and dispatch MessageEvents at them.
-export class MockEventSource extends EventTarget {
-    static instances: MockEventSource[] = [];
-
-    static readonly CONNECTING = 0;
-    static readonly OPEN = 1;
-    static readonly CLOSED = 2;
-
-    url: string;
-    withCredentials: boolean;
-    readyState: number = MockEventSource.CONNECTING;
-
-    constructor(url: string, init?: { withCredentials?: boolean }) {
-        super();
-        this.url = url;
-        this.withCredentials = init?.withCredentials ?? false;
-        MockEventSource.instances.push(this);
-    }
-
-    close(): void {
-        this.readyState = MockEventSource.CLOSED;
-    }
-}
-
 interface DataTableColumn {
     name?: string;
     data?: string;
@@ -453,3 +453,70 @@ test("clearLocalStorage drops the browser-local settings, including the theme",
     expect(localStorage.getItem("keyboard_shortcuts_enabled")).toBeNull();
     expect(localStorage.getItem("theme")).toBeNull();
 });
+
+// streamOf makes a response body that delivers the given chunks one by one,
+// the way a long-lived SSE response trickles in.
+function streamOf(...chunks: string[]): ReadableStream<Uint8Array> {
+    const encoder = new TextEncoder();
+    return new ReadableStream<Uint8Array>({
+        start(controller): void {
+            for (const chunk of chunks) {
+                controller.enqueue(encoder.encode(chunk));
+            }
+            controller.close();
+        },
+    });
+}
+
+test("readEventStream parses frames, even when they're split across chunks", async (): Promise<void> => {
+    const frames: ims.EventStreamFrame[] = [];
+    await ims.readEventStream(
+        streamOf(
+            "id: 4\nevent: InitialEvent\ndata: {\"initial_event\":true}\n\n",
+            ":\n\n",
+            "id: 5\nevent: Incident\nda",
+            "ta: {\"event_id\":1,\"incident_number\":2}\n",
+            "\nid: 6\r\nevent: Visit\r\ndata:{\"visit_number\":3}\r\n\r\n",
+        ),
+        (frame: ims.EventStreamFrame): void => {
+            frames.push(frame);
+        },
+    );
+    expect(frames).toEqual([
+        { event: "InitialEvent", data: "{\"initial_event\":true}", id: "4" },
+        { event: "Incident", data: "{\"event_id\":1,\"incident_number\":2}", id: "5" },
+        { event: "Visit", data: "{\"visit_number\":3}", id: "6" },
+    ]);
+});
+
+test("readEventStream joins data lines and carries the last ID forward", async (): Promise<void> => {
+    const frames: ims.EventStreamFrame[] = [];
+    await ims.readEventStream(
+        streamOf("id: 9\ndata: one\ndata: two\n\nevent: FieldReport\ndata: three\n\ndata: incomplete"),
+        (frame: ims.EventStreamFrame): void => {
+            frames.push(frame);
+        },
+    );
+    expect(frames).toEqual([
+        { event: "message", data: "one\ntwo", id: "9" },
+        { event: "FieldReport", data: "three", id: "9" },
+    ]);
+});
+
+test("readEventStream reads a multi-byte character split between chunks", async (): Promise<void> => {
+    const bytes = new TextEncoder().encode("data: {\"summary\":\"🔥\"}\n\n");
+    const frames: ims.EventStreamFrame[] = [];
+    await ims.readEventStream(
+        new ReadableStream<Uint8Array>({
+            start(controller): void {
+                controller.enqueue(bytes.slice(0, 20));
+                controller.enqueue(bytes.slice(20));
+                controller.close();
+            },
+        }),
+        (frame: ims.EventStreamFrame): void => {
+            frames.push(frame);
+        },
+    );
+    expect(frames).toEqual([{ event: "message", data: "{\"summary\":\"🔥\"}", id: "" }]);
+});
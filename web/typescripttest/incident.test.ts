@@ -55,6 +55,7 @@ beforeEach((): void => {
         writeFieldReports: true,
         readVisits: true,
         writeVisits: true,
+        readConfidential: true,
         attachFiles: true,
     };
     serverIncident = {
@@ -54,6 +54,7 @@ beforeEach((): void => {
         writeFieldReports: true,
         readVisits: true,
         writeVisits: true,
+        readConfidential: true,
         attachFiles: true,
     };
     serverIncidents = [
@@ -342,6 +343,33 @@ test("an incident update broadcast refreshes the matching row in place", async (
     channel.close();
 });
 
+test("an incident update broadcast that carries the incident doesn't refetch it", async (): Promise<void> => {
+    let fetched = false;
+    const handler = (url: string, init?: RequestInit): Response | undefined => {
+        if (url === `/ims/api/events/${eventName}/incidents/1`) {
+            fetched = true;
+        }
+        return incidentsRoutes(url, init);
+    };
+    await initIncidentsPage(handler);
+    const table = MockDataTable.lastInstance!;
+    await vi.waitFor((): void => {
+        expect(table.data().length).toBe(2);
+    });
+
+    const pushed: ims.Incident = {
+        number: 1, event: eventName, state: "closed", priority: 3, summary: "Pushed summary", incident_type_ids: [1], report_entries: [],
+    };
+    const channel = new BroadcastChannel("incident_update");
+    channel.postMessage({ incident_number: 1, event_id: eventId, incident: pushed });
+    await vi.waitFor((): void => {
+        const row = table.data().find((i: ims.Incident) => i.number === 1);
+        expect(row.summary).toBe("Pushed summary");
+    });
+    expect(fetched).toBe(false);
+    channel.close();
+});
+
 test("a broadcast for an unknown incident adds a new row", async (): Promise<void> => {
     const created: ims.Incident = {
         number: 9, event: eventName, state: "new", priority: 3, summary: "Brand new", incident_type_ids: [], report_entries: [],
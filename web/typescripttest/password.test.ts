@@ -0,0 +1,153 @@
+//
+// See the file COPYRIGHT for copyright information.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Tests for password.ts against the real templ-rendered password page
+// (password.templ).
+
+import { beforeEach, expect, test, vi } from "vitest";
+import { type FetchHandler, jsonResponse, loadFixture, mockFetch, problemResponse } from "./helpers.ts";
+
+beforeEach((): void => {
+    // password.ts reads the token and looks up its elements at import time, so
+    // each test must set the URL and load the fixture first, then dynamically
+    // import a fresh copy of the module.
+    vi.resetModules();
+    history.replaceState(null, "", "/ims/auth/password");
+    loadFixture("password.html");
+});
+
+// Import password.ts and wait for it to reveal the form it's going to use.
+async function initPasswordPage(handler: FetchHandler, formId: string) {
+    const mock = mockFetch((url, init) => {
+        // commonPageInit's auth check, a GET to url_auth.
+        if (url === url_auth && init?.body == null) {
+            return jsonResponse({ authenticated: false });
+        }
+        return handler(url, init);
+    });
+    await import("../typescript/password.ts");
+    await vi.waitFor((): void => {
+        expect(document.getElementById(formId)!.classList.contains("hidden")).toBe(false);
+    });
+    return mock;
+}
+
+function submit(formId: string): void {
+    document.getElementById(formId)!.dispatchEvent(
+        new Event("submit", { bubbles: true, cancelable: true }),
+    );
+}
+
+function isHidden(selector: string): boolean {
+    return document.querySelector(selector)!.classList.contains("hidden");
+}
+
+function setPasswords(password: string, confirm: string): void {
+    (document.getElementById("new_password_input") as HTMLInputElement).value = password;
+    (document.getElementById("confirm_password_input") as HTMLInputElement).value = confirm;
+}
+
+test("without a token, requesting a reset posts the identification", async (): Promise<void> => {
+    const mock = await initPasswordPage((url) => {
+        if (url === url_authPasswordReset) {
+            return new Response(null, { status: 204 });
+        }
+        return undefined;
+    }, "reset_form");
+    expect(isHidden("#set_password_form")).toBe(true);
+
+    (document.getElementById("identification_input") as HTMLInputElement).value = " Tool ";
+    submit("reset_form");
+
+    await vi.waitFor((): void => {
+        expect(isHidden(".if-reset-sent")).toBe(false);
+    });
+    const call = mock.mock.calls.find(([url]) => url === url_authPasswordReset)!;
+    expect(JSON.parse(call[1]!.body as string)).toEqual({ identification: "Tool" });
+});
+
+test("with a token, mismatched passwords are caught before posting", async (): Promise<void> => {
+    window.location.hash = "#token=abc";
+    const mock = await initPasswordPage(() => undefined, "set_password_form");
+    expect(isHidden("#reset_form")).toBe(true);
+
+    setPasswords("correct horse battery", "correct horse battery staple");
+    submit("set_password_form");
+
+    await vi.waitFor((): void => {
+        expect(isHidden(".if-set-password-failed")).toBe(false);
+    });
+    expect(document.getElementById("set_password_failed_message")!.textContent)
+        .toBe("Those passwords don't match.");
+    expect(mock.mock.calls.some(([url]) => url === url_authPassword)).toBe(false);
+});
+
+test("with a token, a short password is caught before posting", async (): Promise<void> => {
+    window.location.hash = "#token=abc";
+    const mock = await initPasswordPage(() => undefined, "set_password_form");
+
+    setPasswords("short", "short");
+    submit("set_password_form");
+
+    await vi.waitFor((): void => {
+        expect(isHidden(".if-set-password-failed")).toBe(false);
+    });
+    expect(document.getElementById("set_password_failed_message")!.textContent)
+        .toContain("at least 12 characters");
+    expect(mock.mock.calls.some(([url]) => url === url_authPassword)).toBe(false);
+});
+
+test("with a token, setting the password posts it and drops the token", async (): Promise<void> => {
+    window.location.hash = "#token=abc";
+    const mock = await initPasswordPage((url) => {
+        if (url === url_authPassword) {
+            return new Response(null, { status: 204 });
+        }
+        return undefined;
+    }, "set_password_form");
+
+    setPasswords("correct horse battery", "correct horse battery");
+    submit("set_password_form");
+
+    await vi.waitFor((): void => {
+        expect(isHidden(".if-password-set")).toBe(false);
+    });
+    const call = mock.mock.calls.find(([url]) => url === url_authPassword)!;
+    expect(JSON.parse(call[1]!.body as string)).toEqual({
+        token: "abc",
+        password: "correct horse battery",
+    });
+    expect(window.location.hash).toBe("");
+});
+
+test("with a token, the server's reason for refusing it is shown", async (): Promise<void> => {
+    window.location.hash = "#token=used";
+    await initPasswordPage((url) => {
+        if (url === url_authPassword) {
+            return problemResponse("This link is invalid, has expired, or has already been used", 400);
+        }
+        return undefined;
+    }, "set_password_form");
+
+    setPasswords("correct horse battery", "correct horse battery");
+    submit("set_password_form");
+
+    await vi.waitFor((): void => {
+        expect(isHidden(".if-set-password-failed")).toBe(false);
+    });
+    expect(document.getElementById("set_password_failed_message")!.textContent)
+        .toContain("has already been used");
+});
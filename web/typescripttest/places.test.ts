@@ -45,6 +45,7 @@ beforeEach((): void => {
         writeFieldReports: true,
         readVisits: true,
         writeVisits: true,
+        readConfidential: true,
         attachFiles: true,
     };
     // The external_data payloads only need the fields places.ts reads (name,
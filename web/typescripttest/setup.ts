@@ -20,7 +20,7 @@ import { readFileSync } from "node:fs";
 import { join } from "node:path";
 import process from "node:process";
 import { beforeEach } from "vitest";
-import { MockEventSource, MockFlatpickr } from "./helpers.ts";
+import { MockFlatpickr } from "./helpers.ts";
 
 // In production, urls.js is loaded as a classic (non-module) script, so its
 // top-level "const url_*" declarations are globals that the page modules
@@ -48,8 +48,6 @@ Object.assign(globalThis, {
             }),
         },
     },
-    // happy-dom doesn't implement EventSource.
-    EventSource: MockEventSource,
     // flatpickr is loaded as a classic script in head.templ.
     flatpickr: (selector: string | Node, opts: ConstructorParameters<typeof MockFlatpickr>[1]): MockFlatpickr =>
         new MockFlatpickr(selector, opts),
@@ -58,6 +56,5 @@ Object.assign(globalThis, {
 beforeEach((): void => {
     localStorage.clear();
     sessionStorage.clear();
-    MockEventSource.instances.length = 0;
     MockFlatpickr.instances.length = 0;
 });